@@ -0,0 +1,63 @@
+package main
+
+import (
+	"github.com/yalue/elf32_string_replace/stringreplace"
+	"github.com/yalue/elf_reader"
+	"regexp"
+	"testing"
+)
+
+// Returns the last PT_LOAD segment in the file.
+func lastLoadSegment(t *testing.T,
+	f *elf_reader.ELF32File) *elf_reader.ELF32ProgramHeader {
+	for i := len(f.Segments) - 1; i >= 0; i-- {
+		if f.Segments[i].Type == elf_reader.LoadableSegment {
+			return &(f.Segments[i])
+		}
+	}
+	t.Fatalf("The file has no loadable segments")
+	return nil
+}
+
+// Relocates pie_exec's .dynstr using the given address strategy, and checks
+// that the new PT_LOAD segment is page-aligned, and placed above the memory
+// covered by the existing one.
+func checkPIESegmentAddress(t *testing.T,
+	strategy stringreplace.AddressStrategy) {
+	input := corpusInput(t, "pie_exec")
+	original := *lastLoadSegment(t, parseTestELF(t, input))
+	output, _, e := stringreplace.Replace(input, stringreplace.Options{
+		Rules: []stringreplace.Rule{{
+			Match:       regexp.MustCompile(`^libc\.so\.6$`),
+			Replacement: "libc_with_a_longer_name.so.6",
+		}},
+		AddressStrategy: strategy,
+	})
+	if e != nil {
+		t.Fatalf("Failed replacing strings using %s: %s", strategy, e)
+	}
+	load := lastLoadSegment(t, parseTestELF(t, output))
+	if load.VirtualAddress == original.VirtualAddress {
+		t.Fatalf("No new loadable segment was added using %s", strategy)
+	}
+	if load.Align != original.Align {
+		t.Errorf("Using %s, the new segment's alignment is 0x%x, expected "+
+			"0x%x", strategy, load.Align, original.Align)
+	}
+	if (load.VirtualAddress % load.Align) != (load.FileOffset % load.Align) {
+		t.Errorf("Using %s, the new segment's VA (0x%08x) isn't congruent "+
+			"to its offset (0x%08x)", strategy, load.VirtualAddress,
+			load.FileOffset)
+	}
+	originalEnd := original.VirtualAddress + original.MemorySize
+	if load.VirtualAddress < originalEnd {
+		t.Errorf("Using %s, the new segment's VA (0x%08x) is below the end "+
+			"of the existing layout (0x%08x)", strategy, load.VirtualAddress,
+			originalEnd)
+	}
+}
+
+func TestPIESegmentAddress(t *testing.T) {
+	checkPIESegmentAddress(t, stringreplace.MirrorOffsetAddress)
+	checkPIESegmentAddress(t, stringreplace.AfterLastLoadAddress)
+}
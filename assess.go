@@ -0,0 +1,97 @@
+package main
+
+// This file implements the "assess" subcommand, which estimates how risky
+// applying a rule to a file would be, before anything is patched.
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/yalue/elf32_string_replace/stringreplace"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+)
+
+// Writes a human-readable summary of the assessment to w.
+func writeAssessment(w io.Writer, path string,
+	a *stringreplace.Assessment) {
+	fmt.Fprintf(w, "Risk of patching %s: %s\n", path, a.Risk)
+	fmt.Fprintf(w, "  String tables touched: %d\n", a.TablesTouched)
+	fmt.Fprintf(w, "  Strings replaced: %d\n", a.StringsReplaced)
+	fmt.Fprintf(w, "  Loaded tables relocated: %d\n", a.TablesRelocated)
+	fmt.Fprintf(w, "  Relocations involving the tables: %d (%d not "+
+		"updated)\n", a.RelocationsIntoTables, a.RelocationsNotUpdated)
+	fmt.Fprintf(w, "  Compressed sections: %d\n", len(a.CompressedSections))
+	fmt.Fprintf(w, "  Version hashes affected: %d\n", a.VersionHashesAffected)
+	fmt.Fprintf(w, "  References not updated: %d\n", a.UnsupportedReferences)
+	for _, f := range a.Factors {
+		fmt.Fprintf(w, "  [%s] %s\n", f.Risk, f.Description)
+	}
+	for _, warning := range a.Warnings {
+		fmt.Fprintf(w, "  Warning: %s\n", warning)
+	}
+}
+
+func runAssessCommand(arguments []string) int {
+	var inputFile, matchRegex, replacement string
+	var outputJSON bool
+	flags := flag.NewFlagSet("assess", flag.ContinueOnError)
+	flags.StringVar(&inputFile, "file", "", "The path to the ELF file to "+
+		"assess.")
+	flags.StringVar(&matchRegex, "to_match", "", "The regular expression "+
+		"matching the strings to replace.")
+	flags.StringVar(&replacement, "replace", "", "The replacement for "+
+		"matched strings.")
+	flags.BoolVar(&outputJSON, "json", false, "Print the assessment as JSON "+
+		"rather than a summary.")
+	e := flags.Parse(arguments)
+	if e != nil {
+		return 1
+	}
+	if (inputFile == "") || (matchRegex == "") || (replacement == "") {
+		log.Println("Invalid arguments. Run with -help for more information.")
+		return 1
+	}
+	regex, e := regexp.Compile(matchRegex)
+	if e != nil {
+		log.Printf("Failed processing to_match regular expression: %s\n", e)
+		return 1
+	}
+	rules := []stringreplace.Rule{
+		{
+			Match:       regex,
+			Replacement: replacement,
+		},
+	}
+	e = stringreplace.ValidateRule(&(rules[0]))
+	if e != nil {
+		log.Printf("Invalid -replace value: %s\n", e)
+		return 1
+	}
+	rawInput, e := ioutil.ReadFile(inputFile)
+	if e != nil {
+		log.Printf("Failed reading input file: %s\n", e)
+		return 1
+	}
+	assessment, e := stringreplace.Assess(rawInput, stringreplace.Options{
+		Rules: rules,
+	})
+	if e != nil {
+		log.Printf("Failed assessing %s: %s\n", inputFile, e)
+		return 1
+	}
+	if !outputJSON {
+		writeAssessment(os.Stdout, inputFile, assessment)
+		return 0
+	}
+	content, e := json.MarshalIndent(assessment, "", "  ")
+	if e != nil {
+		log.Printf("Failed encoding the assessment: %s\n", e)
+		return 1
+	}
+	fmt.Printf("%s\n", content)
+	return 0
+}
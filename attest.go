@@ -0,0 +1,210 @@
+package main
+
+// This file implements the "attest" subcommand, which uses the metadata
+// bundle written by -patchmeta to prove how a patched file was produced: that
+// the file is the one the bundle describes, that the recorded changes account
+// for every difference from the original, optionally that a given file is
+// that original, and which rules were applied.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/yalue/elf32_string_replace/stringreplace"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// Returns the hex-encoded SHA-256 digest of the content, as recorded in
+// reports and metadata bundles.
+func fileDigest(content []byte) string {
+	digest := sha256.Sum256(content)
+	return hex.EncodeToString(digest[:])
+}
+
+// The result of attesting a patched file.
+type attestation struct {
+	File     string `json:"file"`
+	Metadata string `json:"metadata"`
+	// The input and output files named in the bundle, and their digests.
+	Input        string `json:"input"`
+	Output       string `json:"output"`
+	InputSHA256  string `json:"input_sha256"`
+	OutputSHA256 string `json:"output_sha256"`
+	// True if the original file was given and matches InputSHA256.
+	OriginalVerified bool `json:"original_verified"`
+	// The rules, versioned renames, and symbol strings that were applied.
+	Rules            json.RawMessage                 `json:"rules"`
+	VersionedRenames []stringreplace.VersionedRename `json:"versioned_renames,omitempty"`
+	SymbolStrings    []stringreplace.SymbolString    `json:"symbol_strings,omitempty"`
+	// The strings that were replaced.
+	Replacements []stringreplace.Replacement `json:"replacements"`
+}
+
+// Checks the patched content against the metadata bundle, and the original
+// content too if it isn't nil. Returns an error describing the first check
+// that failed.
+func attestFile(patched, original []byte,
+	metadata *patchMetadata) (*attestation, error) {
+	report := metadata.Report
+	if fileDigest(patched) != metadata.OutputSHA256 {
+		return nil, fmt.Errorf("The file's SHA-256 digest doesn't match the " +
+			"output recorded in the metadata, so it was modified after it " +
+			"was patched, or the metadata belongs to another file")
+	}
+	// Reverting the file proves that the recorded changes are the only
+	// differences from an input with the recorded digest.
+	reverted, e := stringreplace.Revert(patched, report)
+	if e != nil {
+		return nil, fmt.Errorf("The recorded changes don't account for the "+
+			"file's content: %s", e)
+	}
+	if fileDigest(reverted) != metadata.InputSHA256 {
+		return nil, fmt.Errorf("Reverting the recorded changes doesn't " +
+			"produce the recorded input")
+	}
+	toReturn := &attestation{
+		Input:            metadata.Input,
+		Output:           metadata.Output,
+		InputSHA256:      metadata.InputSHA256,
+		OutputSHA256:     metadata.OutputSHA256,
+		Rules:            metadata.Rules,
+		VersionedRenames: metadata.VersionedRenames,
+		SymbolStrings:    metadata.SymbolStrings,
+		Replacements:     report.Replacements,
+	}
+	if original == nil {
+		return toReturn, nil
+	}
+	if fileDigest(original) != metadata.InputSHA256 {
+		return nil, fmt.Errorf("The original file's SHA-256 digest doesn't " +
+			"match the input recorded in the metadata")
+	}
+	toReturn.OriginalVerified = true
+	return toReturn, nil
+}
+
+// Writes a human-readable summary of the attestation to w.
+func writeAttestation(w io.Writer, a *attestation) {
+	fmt.Fprintf(w, "%s was produced from %s by the recorded patch.\n",
+		a.File, a.Input)
+	fmt.Fprintf(w, "  Output SHA-256: %s\n", a.OutputSHA256)
+	if a.OriginalVerified {
+		fmt.Fprintf(w, "  Input SHA-256: %s (verified against the given "+
+			"original)\n", a.InputSHA256)
+	} else {
+		fmt.Fprintf(w, "  Input SHA-256: %s (no original was given to "+
+			"verify)\n", a.InputSHA256)
+	}
+	var rules []struct {
+		ToMatch  string   `json:"to_match"`
+		Replace  string   `json:"replace"`
+		Sections []string `json:"sections"`
+	}
+	if (len(a.Rules) != 0) && (json.Unmarshal(a.Rules, &rules) == nil) {
+		for i, r := range rules {
+			fmt.Fprintf(w, "  Rule %d: %q -> %q", i, r.ToMatch, r.Replace)
+			if len(r.Sections) != 0 {
+				fmt.Fprintf(w, " (sections: %v)", r.Sections)
+			}
+			fmt.Fprintf(w, "\n")
+		}
+	} else {
+		fmt.Fprintf(w, "  The metadata doesn't record the rules.\n")
+	}
+	for _, r := range a.VersionedRenames {
+		fmt.Fprintf(w, "  Versioned rename: %s@%s -> %s@%s\n", r.Symbol,
+			r.Version, r.NewSymbol, r.NewVersion)
+	}
+	for _, s := range a.SymbolStrings {
+		fmt.Fprintf(w, "  Symbol %s's string -> %q\n", s.Symbol,
+			s.Replacement)
+	}
+	for _, r := range a.Replacements {
+		fmt.Fprintf(w, "  Replaced in section %d: %s -> %s\n",
+			r.SectionIndex, r.Original, r.New)
+	}
+}
+
+// Runs the "attest" subcommand, with the given arguments, not including the
+// subcommand name itself. Returns the process exit code: 0 if the file
+// matches its metadata (and the original, if given), and 1 otherwise.
+func runAttestCommand(arguments []string) int {
+	var inputFile, metadataFile, originalFile string
+	var outputJSON bool
+	flags := flag.NewFlagSet("attest", flag.ContinueOnError)
+	flags.StringVar(&inputFile, "file", "", "The path to the patched ELF "+
+		"file. May also be given as a positional argument.")
+	flags.StringVar(&metadataFile, "metadata", "", "The path to the "+
+		"metadata bundle written by -patchmeta. Defaults to the file's path "+
+		"plus "+patchMetadataSuffix+".")
+	flags.StringVar(&originalFile, "original", "", "If set, also verify "+
+		"that this file is the original the patched file was produced from.")
+	flags.BoolVar(&outputJSON, "json", false, "Print the attestation as "+
+		"JSON rather than a summary.")
+	e := flags.Parse(arguments)
+	if e != nil {
+		return 1
+	}
+	if (inputFile == "") && (flags.NArg() == 1) {
+		inputFile = flags.Arg(0)
+	} else if flags.NArg() != 0 {
+		inputFile = ""
+	}
+	if inputFile == "" {
+		log.Println("Invalid arguments. Run with -help for more information.")
+		return 1
+	}
+	if metadataFile == "" {
+		metadataFile = inputFile + patchMetadataSuffix
+	}
+	content, e := ioutil.ReadFile(metadataFile)
+	if e != nil {
+		log.Printf("Failed reading metadata: %s\n", e)
+		return 1
+	}
+	metadata, e := readPatchMetadata(content)
+	if (e == nil) && (metadata == nil) {
+		e = fmt.Errorf("%s isn't a metadata bundle written by -patchmeta",
+			metadataFile)
+	}
+	if e != nil {
+		log.Printf("%s\n", e)
+		return 1
+	}
+	patched, e := ioutil.ReadFile(inputFile)
+	if e != nil {
+		log.Printf("Failed reading input file: %s\n", e)
+		return 1
+	}
+	var original []byte
+	if originalFile != "" {
+		original, e = ioutil.ReadFile(originalFile)
+		if e != nil {
+			log.Printf("Failed reading original file: %s\n", e)
+			return 1
+		}
+	}
+	a, e := attestFile(patched, original, metadata)
+	if e != nil {
+		log.Printf("Attestation of %s failed: %s\n", inputFile, e)
+		return 1
+	}
+	a.File = inputFile
+	a.Metadata = metadataFile
+	if !outputJSON {
+		writeAttestation(os.Stdout, a)
+		return 0
+	}
+	encoded, e := json.MarshalIndent(a, "", "  ")
+	if e != nil {
+		log.Printf("Failed encoding attestation: %s\n", e)
+		return 1
+	}
+	fmt.Printf("%s\n", encoded)
+	return 0
+}
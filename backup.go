@@ -0,0 +1,128 @@
+package main
+
+// This file implements the -backup_dir flag, which saves a copy of each file
+// patched in place to a separate directory, mirroring the tree being
+// patched, rather than leaving backups next to the patched files. Each
+// backup is recorded in a manifest in the backup directory, so the originals
+// can be found (and restored) later.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The name of the manifest file in the backup directory. Each line holds a
+// JSON backupRecord, and records from later runs are appended.
+const backupManifestName = "manifest.jsonl"
+
+// Describes a single backed-up file in the manifest.
+type backupRecord struct {
+	// The absolute path of the file that was patched in place.
+	Original string `json:"original"`
+	// The backup's path, relative to the backup directory.
+	Backup string `json:"backup"`
+	// The SHA-256 digest of the original content.
+	SHA256 string    `json:"sha256"`
+	Time   time.Time `json:"time"`
+}
+
+// Saves backups of files patched in place to a directory.
+type backupStore struct {
+	directory string
+	// Backups of files under this directory (e.g. the -output_dir, when
+	// patching a tree in place) mirror their paths relative to it. Other
+	// files are backed up using their base names.
+	root string
+}
+
+// Returns the path, relative to the backup directory, at which to save a
+// backup of the given file: its path relative to the root, if it's under
+// the root, or its base name otherwise.
+func (b *backupStore) relativePath(path string) string {
+	if b.root != "" {
+		relative, e := filepath.Rel(b.root, path)
+		if (e == nil) && !strings.HasPrefix(relative, "..") {
+			return relative
+		}
+	}
+	return filepath.Base(path)
+}
+
+// Creates a new file for the backup at the given relative path, or, if a
+// file already exists there (e.g. from an earlier run), at the same path
+// with the first free numeric suffix (.1, .2, ...). Returns the file and its
+// relative path.
+func (b *backupStore) createBackupFile(relative string) (*os.File, string,
+	error) {
+	e := os.MkdirAll(filepath.Join(b.directory, filepath.Dir(relative)),
+		0755)
+	if e != nil {
+		return nil, "", e
+	}
+	candidate := relative
+	for i := 1; ; i++ {
+		f, e := os.OpenFile(filepath.Join(b.directory, candidate),
+			os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if e == nil {
+			return f, candidate, nil
+		}
+		if !os.IsExist(e) {
+			return nil, "", e
+		}
+		candidate = fmt.Sprintf("%s.%d", relative, i)
+	}
+}
+
+// Saves the original content of the file at the given path, and records it
+// in the manifest.
+func (b *backupStore) save(path string, content []byte) error {
+	f, relative, e := b.createBackupFile(b.relativePath(path))
+	if e != nil {
+		return fmt.Errorf("Failed creating backup: %s", e)
+	}
+	_, e = f.Write(content)
+	closeError := f.Close()
+	if e == nil {
+		e = closeError
+	}
+	if e != nil {
+		return fmt.Errorf("Failed writing backup: %s", e)
+	}
+	absolute, e := filepath.Abs(path)
+	if e != nil {
+		absolute = path
+	}
+	digest := sha256.Sum256(content)
+	line, e := json.Marshal(&backupRecord{
+		Original: absolute,
+		Backup:   filepath.ToSlash(relative),
+		SHA256:   hex.EncodeToString(digest[:]),
+		Time:     time.Now().UTC(),
+	})
+	if e != nil {
+		return fmt.Errorf("Failed encoding backup record: %s", e)
+	}
+	manifest, e := os.OpenFile(filepath.Join(b.directory,
+		backupManifestName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if e != nil {
+		return fmt.Errorf("Failed opening backup manifest: %s", e)
+	}
+	_, e = manifest.Write(append(line, '\n'))
+	closeError = manifest.Close()
+	if e == nil {
+		e = closeError
+	}
+	if e != nil {
+		return fmt.Errorf("Failed updating backup manifest: %s", e)
+	}
+	log.Printf("Saved a backup of %s to %s.\n", path,
+		filepath.Join(b.directory, relative))
+	return nil
+}
@@ -0,0 +1,192 @@
+package main
+
+// This file contains code for processing multiple input files, or entire
+// directory trees, in a single run.
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/yalue/elf32_string_replace/stringreplace"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Holds a single input file, and the path to which its modified copy will be
+// written.
+type batchJob struct {
+	inputPath  string
+	outputPath string
+	// If this is non-empty, the input is a symbolic link, and rather than
+	// processing it, a link with this target will be created at outputPath.
+	symlinkTarget string
+	// Describes the input's format, e.g. "ELF32 big-endian", if it's known.
+	format string
+	// If this is non-empty, the input is in a format that can't be patched,
+	// such as an ELF file with an invalid class, and is skipped for this
+	// reason.
+	skipReason string
+}
+
+// Returns a description of the format of a file starting with the given
+// header, e.g. "ELF32 little-endian" or "Mach-O", or an empty string if it
+// isn't an ELF, Mach-O, or PE file. If the file can't be patched, e.g.
+// because its ELF header is invalid, the reason is also returned.
+func describeFileFormat(header []byte) (format, skipReason string) {
+	if stringreplace.IsMachOFile(header) {
+		return "Mach-O", ""
+	}
+	if stringreplace.IsPEFile(header) {
+		return "PE", ""
+	}
+	if (len(header) < 6) || !bytes.Equal(header[0:4], []byte("\x7fELF")) {
+		return "", ""
+	}
+	// Bytes 4 and 5 of the ELF identification hold the class (1 for 32-bit,
+	// 2 for 64-bit) and data encoding (1 for little-endian, 2 for
+	// big-endian).
+	class := fmt.Sprintf("ELF (class %d)", header[4])
+	switch header[4] {
+	case 1:
+		class = "ELF32"
+	case 2:
+		class = "ELF64"
+	}
+	encoding := fmt.Sprintf("encoding %d", header[5])
+	switch header[5] {
+	case 1:
+		encoding = "little-endian"
+	case 2:
+		encoding = "big-endian"
+	}
+	format = class + " " + encoding
+	switch {
+	case (header[4] != 1) && (header[4] != 2):
+		skipReason = "the ELF class is invalid"
+	case (header[5] != 1) && (header[5] != 2):
+		skipReason = "the ELF data encoding is invalid"
+	}
+	return format, skipReason
+}
+
+// Reads the start of the file at the given path, and returns its format and
+// the reason it can't be patched, as described by describeFileFormat.
+func identifyFile(path string) (format, skipReason string, e error) {
+	file, e := os.Open(path)
+	if e != nil {
+		return "", "", e
+	}
+	defer file.Close()
+	// PE headers are found using an offset in the DOS header, and usually
+	// start within the first few hundred bytes.
+	header := make([]byte, 1024)
+	n, e := io.ReadFull(file, header)
+	if (e != nil) && (e != io.EOF) && (e != io.ErrUnexpectedEOF) {
+		return "", "", e
+	}
+	format, skipReason = describeFileFormat(header[:n])
+	return format, skipReason, nil
+}
+
+// Walks the directory at root, appending a job for each ELF file, Mach-O
+// file, PE file, or symbolic link in it. ELF files that can't be patched,
+// such as ones with invalid headers, are included, so they can be reported as
+// skipped. The output paths mirror the structure of the tree under outputDir.
+func collectDirectoryJobs(root, outputDir string,
+	jobs []batchJob) ([]batchJob, error) {
+	e := filepath.Walk(root, func(path string, info os.FileInfo,
+		e error) error {
+		if e != nil {
+			return e
+		}
+		if info.IsDir() {
+			return nil
+		}
+		relativePath, e := filepath.Rel(root, path)
+		if e != nil {
+			return e
+		}
+		job := batchJob{
+			inputPath:  path,
+			outputPath: filepath.Join(outputDir, relativePath),
+		}
+		if (info.Mode() & os.ModeSymlink) != 0 {
+			job.symlinkTarget, e = os.Readlink(path)
+			if e != nil {
+				return e
+			}
+			jobs = append(jobs, job)
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		job.format, job.skipReason, e = identifyFile(path)
+		if e != nil {
+			return e
+		}
+		if job.format == "" {
+			log.Printf("Skipping %s: not an ELF, Mach-O, or PE file.\n",
+				path)
+			return nil
+		}
+		jobs = append(jobs, job)
+		return nil
+	})
+	return jobs, e
+}
+
+// Returns a list of jobs for the given input paths. Each input may be a file,
+// which will be written to outputDir using its base name, or a directory,
+// which will be mirrored under outputDir.
+func collectBatchJobs(inputs []string, outputDir string) ([]batchJob, error) {
+	jobs := make([]batchJob, 0, len(inputs))
+	var info os.FileInfo
+	var e error
+	for _, input := range inputs {
+		info, e = os.Stat(input)
+		if e != nil {
+			return nil, fmt.Errorf("Failed reading %s: %s", input, e)
+		}
+		if !info.IsDir() {
+			job := batchJob{
+				inputPath:  input,
+				outputPath: filepath.Join(outputDir, filepath.Base(input)),
+			}
+			job.format, job.skipReason, e = identifyFile(input)
+			if e != nil {
+				return nil, fmt.Errorf("Failed reading %s: %s", input, e)
+			}
+			jobs = append(jobs, job)
+			continue
+		}
+		jobs, e = collectDirectoryJobs(input, outputDir, jobs)
+		if e != nil {
+			return nil, fmt.Errorf("Failed walking %s: %s", input, e)
+		}
+	}
+	return jobs, nil
+}
+
+// Creates the parent directory of the job's output path, if needed.
+func createOutputDirectory(job *batchJob) error {
+	return os.MkdirAll(filepath.Dir(job.outputPath), 0755)
+}
+
+// Re-creates the symbolic link described by the job at its output path,
+// replacing any existing link.
+func copySymlink(job *batchJob) error {
+	e := createOutputDirectory(job)
+	if e != nil {
+		return e
+	}
+	_, e = os.Lstat(job.outputPath)
+	if e == nil {
+		e = os.Remove(job.outputPath)
+		if e != nil {
+			return e
+		}
+	}
+	return os.Symlink(job.symlinkTarget, job.outputPath)
+}
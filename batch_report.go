@@ -0,0 +1,157 @@
+package main
+
+// This file contains the combined report written by -report when processing
+// many files with -output_dir, so that a large batch of changes can be
+// audited from a single file.
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/yalue/elf32_string_replace/stringreplace"
+	"io/ioutil"
+	"os"
+)
+
+// Describes the result of processing a single file in a batch.
+type batchFileReport struct {
+	Input  string `json:"input"`
+	Output string `json:"output"`
+	// The file's format, e.g. "ELF32 big-endian", if it was detected.
+	Format string `json:"format,omitempty"`
+	// The outcome: "changed", "unmatched", "failed", "skipped" (for files
+	// that can't be patched), "linked" (for symbolic links), or "processed"
+	// (for files without details).
+	Status string `json:"status"`
+	// Set if the file couldn't be processed.
+	Error string `json:"error,omitempty"`
+	// The number of strings replaced, or of names changed in Mach-O and PE
+	// files.
+	Changes int `json:"changes"`
+	// The full report, for ELF files.
+	Report *stringreplace.Report `json:"report,omitempty"`
+	// Explains why there are no details, e.g. for symbolic links.
+	Note string `json:"note,omitempty"`
+	// True once the number of changes is known.
+	recorded bool
+}
+
+// Totals over every file in a batch.
+type batchTotals struct {
+	Files int `json:"files"`
+	// The number of files in which something was changed, in which nothing
+	// matched, which couldn't be processed, and which were skipped because
+	// they can't be patched.
+	Changed   int `json:"changed"`
+	Unmatched int `json:"unmatched"`
+	Failed    int `json:"failed"`
+	Skipped   int `json:"skipped"`
+	// Totals over the files' individual reports.
+	Changes    int `json:"changes"`
+	References int `json:"references"`
+	Warnings   int `json:"warnings"`
+}
+
+// The combined report for a batch of files.
+type batchReport struct {
+	Files  []batchFileReport `json:"files"`
+	Totals batchTotals       `json:"totals"`
+	// The input paths of the files in which nothing matched.
+	Unmatched []string `json:"unmatched"`
+	// The file currently being processed.
+	current *batchFileReport
+}
+
+// Returns a new, empty batch report.
+func newBatchReport() *batchReport {
+	return &batchReport{
+		Files:     make([]batchFileReport, 0, 16),
+		Unmatched: make([]string, 0, 4),
+	}
+}
+
+// Must be called before processing each job in the batch.
+func (b *batchReport) startFile(job *batchJob) {
+	if b == nil {
+		return
+	}
+	b.current = &batchFileReport{
+		Input:  job.inputPath,
+		Output: job.outputPath,
+		Format: job.format,
+	}
+	if job.symlinkTarget != "" {
+		b.current.Status = "linked"
+		b.current.Note = fmt.Sprintf("Symbolic link to %s", job.symlinkTarget)
+	}
+	if job.skipReason != "" {
+		b.current.Status = "skipped"
+		b.current.Note = "Skipped: " + job.skipReason
+	}
+}
+
+// Records the result of patching the current file: its report, if it's an
+// ELF file, and the number of changes made. Does nothing if b is nil, i.e.
+// if no batch report is being written.
+func (b *batchReport) recordResult(report *stringreplace.Report,
+	changes int) {
+	if (b == nil) || (b.current == nil) {
+		return
+	}
+	b.current.Report = report
+	b.current.Changes = changes
+	b.current.recorded = true
+}
+
+// Must be called after processing each job in the batch, with the error
+// returned by processing it, if any.
+func (b *batchReport) finishFile(e error) {
+	if (b == nil) || (b.current == nil) {
+		return
+	}
+	c := b.current
+	b.current = nil
+	b.Totals.Files++
+	switch {
+	case e != nil:
+		c.Error = e.Error()
+		c.Status = "failed"
+		b.Totals.Failed++
+	case c.Status == "skipped":
+		b.Totals.Skipped++
+	case !c.recorded:
+		if c.Status == "" {
+			c.Status = "processed"
+		}
+		if c.Note == "" {
+			c.Note = "Details aren't available for this type of file"
+		}
+	case c.Changes == 0:
+		c.Status = "unmatched"
+		b.Totals.Unmatched++
+		b.Unmatched = append(b.Unmatched, c.Input)
+	default:
+		c.Status = "changed"
+		b.Totals.Changed++
+	}
+	b.Totals.Changes += c.Changes
+	if c.Report != nil {
+		b.Totals.References += len(c.Report.References)
+		b.Totals.Warnings += len(c.Report.Warnings)
+	}
+	b.Files = append(b.Files, *c)
+}
+
+// Writes the report to the given path as JSON, or to stdout if the path is
+// "-".
+func (b *batchReport) write(path string) error {
+	content, e := json.MarshalIndent(b, "", "  ")
+	if e != nil {
+		return fmt.Errorf("Failed encoding report: %s", e)
+	}
+	content = append(content, '\n')
+	if path == "-" {
+		_, e = os.Stdout.Write(content)
+		return e
+	}
+	return ioutil.WriteFile(path, content, 0644)
+}
@@ -0,0 +1,169 @@
+package main
+
+// This file implements the -checksum and -checksum_command flags, which fix
+// up checksums in the image surrounding an embedded ELF file (e.g. in a
+// vendor firmware header) after it has been patched.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// The supported checksum algorithms, mapped to the size of their output, in
+// bytes.
+var checksumSizes = map[string]int{
+	"crc32":  4,
+	"crc32c": 4,
+	"sum8":   1,
+	"sum16":  2,
+	"sum32":  4,
+}
+
+// Describes a checksum to recompute after patching.
+type checksumSpec struct {
+	algorithm string
+	// The offset in the image at which the checksum is stored.
+	storeOffset uint64
+	// The range of the image covered by the checksum. If toEnd is true, the
+	// range extends to the end of the image.
+	start, end uint64
+	toEnd      bool
+	bigEndian  bool
+}
+
+// Holds the values of the repeatable -checksum flag. Implements flag.Value.
+type checksumFlag []checksumSpec
+
+func (c *checksumFlag) String() string {
+	return fmt.Sprintf("%d checksums", len(*c))
+}
+
+// Parses a checksum spec in the format
+// <algorithm>:<store offset>:<start>-<end>[:be], where end may be "end".
+func (c *checksumFlag) Set(value string) error {
+	var spec checksumSpec
+	var e error
+	parts := strings.Split(value, ":")
+	if (len(parts) < 3) || (len(parts) > 4) {
+		return fmt.Errorf("Expected <algorithm>:<offset>:<start>-<end>[:be]")
+	}
+	spec.algorithm = parts[0]
+	if _, ok := checksumSizes[spec.algorithm]; !ok {
+		return fmt.Errorf("Unsupported checksum algorithm: %s", parts[0])
+	}
+	spec.storeOffset, e = strconv.ParseUint(parts[1], 0, 32)
+	if e != nil {
+		return fmt.Errorf("Invalid checksum offset: %s", e)
+	}
+	bounds := strings.SplitN(parts[2], "-", 2)
+	if len(bounds) != 2 {
+		return fmt.Errorf("Invalid checksum range: %s", parts[2])
+	}
+	spec.start, e = strconv.ParseUint(bounds[0], 0, 32)
+	if e != nil {
+		return fmt.Errorf("Invalid checksum range start: %s", e)
+	}
+	if bounds[1] == "end" {
+		spec.toEnd = true
+	} else {
+		spec.end, e = strconv.ParseUint(bounds[1], 0, 32)
+		if e != nil {
+			return fmt.Errorf("Invalid checksum range end: %s", e)
+		}
+		if spec.end < spec.start {
+			return fmt.Errorf("The checksum range ends before it starts")
+		}
+	}
+	if len(parts) == 4 {
+		switch parts[3] {
+		case "be":
+			spec.bigEndian = true
+		case "le":
+		default:
+			return fmt.Errorf("Invalid checksum byte order: %s", parts[3])
+		}
+	}
+	*c = append(*c, spec)
+	return nil
+}
+
+// Computes the checksum over the given data.
+func computeChecksum(algorithm string, data []byte) uint32 {
+	switch algorithm {
+	case "crc32":
+		return crc32.ChecksumIEEE(data)
+	case "crc32c":
+		return crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli))
+	}
+	var sum uint32
+	for _, b := range data {
+		sum += uint32(b)
+	}
+	switch algorithm {
+	case "sum8":
+		return sum & 0xff
+	case "sum16":
+		return sum & 0xffff
+	}
+	return sum
+}
+
+// Recomputes the checksum over the image, and stores it at the spec's
+// offset. If the stored checksum lies within the covered range, it's treated
+// as zero while computing the checksum.
+func (spec *checksumSpec) apply(image []byte) error {
+	size := uint64(checksumSizes[spec.algorithm])
+	end := spec.end
+	if spec.toEnd {
+		end = uint64(len(image))
+	}
+	if (end > uint64(len(image))) || (spec.start > end) ||
+		((spec.storeOffset + size) > uint64(len(image))) {
+		return fmt.Errorf("The %s checksum's offsets are outside of the "+
+			"image", spec.algorithm)
+	}
+	stored := image[spec.storeOffset : spec.storeOffset+size]
+	for i := range stored {
+		stored[i] = 0
+	}
+	value := computeChecksum(spec.algorithm, image[spec.start:end])
+	var order binary.ByteOrder = binary.LittleEndian
+	if spec.bigEndian {
+		order = binary.BigEndian
+	}
+	switch size {
+	case 1:
+		stored[0] = uint8(value)
+	case 2:
+		order.PutUint16(stored, uint16(value))
+	default:
+		order.PutUint32(stored, value)
+	}
+	log.Printf("Updated %s checksum of 0x%x-0x%x at offset 0x%x: 0x%x\n",
+		spec.algorithm, spec.start, end, spec.storeOffset, value)
+	return nil
+}
+
+// Runs the user-specified checksum command, with the path to the output file
+// appended to its arguments. The command may modify the file in place.
+func runChecksumCommand(command, outputPath string) error {
+	arguments := strings.Fields(command)
+	if len(arguments) == 0 {
+		return nil
+	}
+	arguments = append(arguments, outputPath)
+	c := exec.Command(arguments[0], arguments[1:]...)
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	e := c.Run()
+	if e != nil {
+		return fmt.Errorf("Checksum command failed: %s", e)
+	}
+	return nil
+}
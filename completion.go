@@ -0,0 +1,433 @@
+package main
+
+// This file implements the "completion" subcommand, which prints shell
+// completion scripts for bash, zsh, and fish.
+
+import (
+	"fmt"
+	"github.com/yalue/elf32_string_replace/stringreplace"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+// The name of the executable, as used by the completion scripts.
+const completionProgramName = "elf32_string_replace"
+
+// Indicates what sort of value a flag takes, for the purposes of completion.
+type completionValue int
+
+const (
+	// The flag takes a value, but no completion is available for it.
+	completeAnything completionValue = iota
+	// The flag is a boolean and takes no value.
+	completeNoValue
+	// The flag's value is a file path.
+	completeFile
+	// The flag's value is the name of a section in the -file input.
+	completeSection
+	// The flag's value is one of a fixed list of choices.
+	completeChoice
+)
+
+// Describes a single flag for the purposes of completion.
+type completionFlag struct {
+	name    string
+	value   completionValue
+	choices []string
+}
+
+// Describes the flags accepted by a single subcommand. The main replacement
+// command has an empty name.
+type completionCommand struct {
+	name  string
+	flags []completionFlag
+}
+
+// The flags accepted by the patch subcommand, and by the deprecated
+// invocation without a subcommand.
+var patchCompletionFlags = []completionFlag{
+	{name: "file", value: completeFile},
+	{name: "output", value: completeFile},
+	{name: "output_dir", value: completeFile},
+	{name: "progress_interval", value: completeAnything},
+	{name: "watch", value: completeFile},
+	{name: "watch_filter", value: completeAnything},
+	{name: "watch_interval", value: completeAnything},
+	{name: "to_match", value: completeAnything},
+	{name: "replace", value: completeAnything},
+	{name: "rules", value: completeFile},
+	{name: "exclude_sections", value: completeAnything},
+	{name: "not_matching", value: completeAnything},
+	{name: "treat_as_strtab", value: completeSection},
+	{name: "detect_strtabs", value: completeNoValue},
+	{name: "all_strtabs", value: completeNoValue},
+	{name: "only_needed", value: completeNoValue},
+	{name: "rename_warning_sections", value: completeNoValue},
+	{name: "rewrite_warning_text", value: completeNoValue},
+	{name: "clear_prelink", value: completeNoValue},
+	{name: "symbol_binding", value: completeChoice,
+		choices: []string{"local", "global", "weak", "gnu_unique"}},
+	{name: "symbol_type", value: completeChoice,
+		choices: []string{"notype", "object", "func", "section",
+			"file", "common", "tls", "gnu_ifunc"}},
+	{name: "symbol_visibility", value: completeChoice,
+		choices: []string{"default", "internal", "hidden",
+			"protected"}},
+	{name: "only_imports", value: completeNoValue},
+	{name: "only_exports", value: completeNoValue},
+	{name: "rename_versioned", value: completeAnything},
+	{name: "symbol", value: completeAnything},
+	{name: "add_needed", value: completeAnything},
+	{name: "add_soname", value: completeAnything},
+	{name: "add_rpath", value: completeAnything},
+	{name: "add_runpath", value: completeAnything},
+	{name: "patch_script", value: completeFile},
+	{name: "patch_script_format", value: completeChoice,
+		choices: []string{"r2", "ida", "ghidra", "ops"}},
+	{name: "va_strategy", value: completeChoice,
+		choices: []string{"mirror-offset", "after-last-load",
+			"fixed="}},
+	{name: "extend_last_load", value: completeNoValue},
+	{name: "reuse_padding", value: completeNoValue},
+	{name: "strip_notes", value: completeNoValue},
+	{name: "hybrid", value: completeNoValue},
+	{name: "in_place", value: completeNoValue},
+	{name: "in_place_fallback", value: completeNoValue},
+	{name: "phdr_align", value: completeAnything},
+	{name: "phdr_placement", value: completeChoice,
+		choices: []string{"before", "after"}},
+	{name: "max_growth", value: completeAnything},
+	{name: "validate_with", value: completeChoice,
+		choices: []string{"readelf", "objdump"}},
+	{name: "backup_dir", value: completeFile},
+	{name: "patchmeta", value: completeNoValue},
+	{name: "output_format", value: completeChoice,
+		choices: []string{"file", "tar", "cpio"}},
+	{name: "embedded_offset", value: completeAnything},
+	{name: "checksum", value: completeAnything},
+	{name: "checksum_command", value: completeAnything},
+	{name: "listing", value: completeNoValue},
+	{name: "dry_run", value: completeNoValue},
+	{name: "dry_run_context", value: completeAnything},
+	{name: "report", value: completeFile},
+	{name: "json", value: completeNoValue},
+	{name: "map_file", value: completeFile},
+	{name: "map_output", value: completeFile},
+	{name: "depfile", value: completeFile},
+	{name: "depfile_sysroot", value: completeFile},
+	{name: "shim_plan", value: completeFile},
+	{name: "shim_plan_format", value: completeChoice,
+		choices: []string{"symlink", "copy", "json"}},
+	{name: "allow_raw_bytes", value: completeNoValue},
+	{name: "allow_empty_match", value: completeNoValue},
+	{name: "encoding", value: completeChoice,
+		choices: []string{"utf-8", "latin1", "shift-jis"}},
+	{name: "sync", value: completeNoValue},
+	{name: "color", value: completeChoice,
+		choices: []string{"auto", "always", "never"}},
+	{name: "events", value: completeFile},
+	{name: "explain", value: completeNoValue},
+	{name: "timings", value: completeNoValue},
+	{name: "config", value: completeFile},
+	{name: "profile_cpu", value: completeFile},
+	{name: "profile_mem", value: completeFile},
+	{name: "parallelism", value: completeAnything},
+}
+
+// Lists the subcommands and flags to complete. This must be kept up to date
+// when flags or subcommands are added.
+var completionCommands = []completionCommand{
+	{
+		name:  "",
+		flags: patchCompletionFlags,
+	},
+	{
+		name:  "patch",
+		flags: patchCompletionFlags,
+	},
+	{
+		name: "strings",
+		flags: []completionFlag{
+			{name: "file", value: completeFile},
+			{name: "to_match", value: completeAnything},
+			{name: "min_length", value: completeAnything},
+			{name: "section", value: completeSection},
+			{name: "references", value: completeNoValue},
+		},
+	},
+	{
+		name: "grep",
+		flags: []completionFlag{
+			{name: "section", value: completeAnything},
+		},
+	},
+	{
+		name: "revert",
+		flags: []completionFlag{
+			{name: "file", value: completeFile},
+			{name: "report", value: completeFile},
+			{name: "output", value: completeFile},
+			{name: "sync", value: completeNoValue},
+		},
+	},
+	{
+		name: "verify-versions",
+		flags: []completionFlag{
+			{name: "file", value: completeFile},
+		},
+	},
+	{
+		name: "verify-loader",
+		flags: []completionFlag{
+			{name: "file", value: completeFile},
+			{name: "loader", value: completeChoice,
+				choices: []string{"all", "glibc", "musl", "uclibc"}},
+		},
+	},
+	{
+		name: "assess",
+		flags: []completionFlag{
+			{name: "file", value: completeFile},
+			{name: "to_match", value: completeAnything},
+			{name: "replace", value: completeAnything},
+			{name: "json", value: completeNoValue},
+		},
+	},
+	{
+		name: "attest",
+		flags: []completionFlag{
+			{name: "file", value: completeFile},
+			{name: "metadata", value: completeFile},
+			{name: "original", value: completeFile},
+			{name: "json", value: completeNoValue},
+		},
+	},
+	{
+		name: "stats",
+		flags: []completionFlag{
+			{name: "file", value: completeFile},
+			{name: "to_match", value: completeAnything},
+			{name: "replace", value: completeAnything},
+			{name: "json", value: completeNoValue},
+		},
+	},
+	{
+		// patchelf's options start with "--", so they aren't completed.
+		name: "patchelf-compat",
+	},
+	{
+		name: "round-trip",
+		flags: []completionFlag{
+			{name: "file", value: completeFile},
+			{name: "same_size", value: completeNoValue},
+		},
+	},
+	{
+		name: "selftest",
+	},
+	{
+		name: "serve",
+		flags: []completionFlag{
+			{name: "listen", value: completeAnything},
+			{name: "max_request_size", value: completeAnything},
+		},
+	},
+	{
+		name:  "completion",
+		flags: nil,
+	},
+}
+
+// The shells supported by the completion subcommand.
+var completionShells = []string{"bash", "zsh", "fish"}
+
+// Returns a space-separated list of the subcommand names.
+func completionSubcommandNames() string {
+	names := make([]string, 0, len(completionCommands))
+	for _, c := range completionCommands {
+		if c.name != "" {
+			names = append(names, c.name)
+		}
+	}
+	return strings.Join(names, " ")
+}
+
+// Returns a space-separated list of the given flags' names, each with a
+// leading dash.
+func completionFlagNames(flags []completionFlag) string {
+	names := make([]string, len(flags))
+	for i, f := range flags {
+		names[i] = "-" + f.name
+	}
+	return strings.Join(names, " ")
+}
+
+// Writes a bash completion script. This is also used for zsh, via zsh's
+// bashcompinit.
+func writeBashCompletion(w io.Writer) {
+	fmt.Fprintf(w, "# bash completion for %s\n", completionProgramName)
+	fmt.Fprintf(w, "_%s() {\n", completionProgramName)
+	fmt.Fprintf(w, "    local cur=\"${COMP_WORDS[COMP_CWORD]}\"\n")
+	fmt.Fprintf(w, "    local prev=\"${COMP_WORDS[COMP_CWORD-1]}\"\n")
+	fmt.Fprintf(w, "    local command=\"\" file=\"\" i\n")
+	fmt.Fprintf(w, "    case \"${COMP_WORDS[1]}\" in\n")
+	fmt.Fprintf(w, "    %s) command=\"${COMP_WORDS[1]}\" ;;\n",
+		strings.Replace(completionSubcommandNames(), " ", "|", -1))
+	fmt.Fprintf(w, "    esac\n")
+	fmt.Fprintf(w, "    for ((i = 1; i < COMP_CWORD; i++)); do\n")
+	fmt.Fprintf(w, "        if [[ \"${COMP_WORDS[i]}\" == \"-file\" ]]; then\n")
+	fmt.Fprintf(w, "            file=\"${COMP_WORDS[i+1]}\"\n")
+	fmt.Fprintf(w, "        fi\n")
+	fmt.Fprintf(w, "    done\n")
+	fmt.Fprintf(w, "    case \"${command}:${prev}\" in\n")
+	for _, c := range completionCommands {
+		for _, f := range c.flags {
+			switch f.value {
+			case completeFile:
+				fmt.Fprintf(w, "    %s:-%s) COMPREPLY=($(compgen -f -- "+
+					"\"$cur\")); return ;;\n", c.name, f.name)
+			case completeSection:
+				fmt.Fprintf(w, "    %s:-%s) COMPREPLY=($(compgen -W "+
+					"\"$(%s __complete_sections \"$file\" 2>/dev/null)\" -- "+
+					"\"$cur\")); return ;;\n", c.name, f.name,
+					completionProgramName)
+			case completeChoice:
+				fmt.Fprintf(w, "    %s:-%s) COMPREPLY=($(compgen -W \"%s\" -- "+
+					"\"$cur\")); return ;;\n", c.name, f.name,
+					strings.Join(f.choices, " "))
+			case completeAnything:
+				fmt.Fprintf(w, "    %s:-%s) return ;;\n", c.name, f.name)
+			}
+		}
+	}
+	fmt.Fprintf(w, "    esac\n")
+	fmt.Fprintf(w, "    case \"${command}\" in\n")
+	var words string
+	for _, c := range completionCommands {
+		words = completionFlagNames(c.flags)
+		if c.name == "completion" {
+			words = strings.Join(completionShells, " ")
+		}
+		if c.name == "" {
+			fmt.Fprintf(w, "    \"\")\n")
+			fmt.Fprintf(w, "        if [[ $COMP_CWORD -eq 1 ]]; then\n")
+			fmt.Fprintf(w, "            COMPREPLY=($(compgen -W \"%s %s\" -- "+
+				"\"$cur\"))\n", completionSubcommandNames(), words)
+			fmt.Fprintf(w, "        else\n")
+			fmt.Fprintf(w, "            COMPREPLY=($(compgen -W \"%s\" -- "+
+				"\"$cur\"))\n", words)
+			fmt.Fprintf(w, "        fi ;;\n")
+			continue
+		}
+		fmt.Fprintf(w, "    %s) COMPREPLY=($(compgen -W \"%s\" -- \"$cur\")) "+
+			";;\n", c.name, words)
+	}
+	fmt.Fprintf(w, "    esac\n")
+	fmt.Fprintf(w, "}\n")
+	fmt.Fprintf(w, "complete -o default -F _%s %s\n", completionProgramName,
+		completionProgramName)
+}
+
+// Writes a zsh completion script, which reuses the bash completion function.
+func writeZshCompletion(w io.Writer) {
+	fmt.Fprintf(w, "# zsh completion for %s\n", completionProgramName)
+	fmt.Fprintf(w, "autoload -U +X bashcompinit && bashcompinit\n")
+	writeBashCompletion(w)
+}
+
+// Writes a fish completion script.
+func writeFishCompletion(w io.Writer) {
+	name := completionProgramName
+	fmt.Fprintf(w, "# fish completion for %s\n", name)
+	// This helper prints the value following -file on the command line.
+	fmt.Fprintf(w, "function __%s_input_file\n", name)
+	fmt.Fprintf(w, "    set -l tokens (commandline -opc)\n")
+	fmt.Fprintf(w, "    set -l i (contains -i -- -file $tokens)\n")
+	fmt.Fprintf(w, "    and echo $tokens[(math $i + 1)]\n")
+	fmt.Fprintf(w, "end\n")
+	fmt.Fprintf(w, "complete -c %s -f -n '__fish_use_subcommand' -a '%s'\n",
+		name, completionSubcommandNames())
+	var condition string
+	for _, c := range completionCommands {
+		condition = "not __fish_seen_subcommand_from " +
+			completionSubcommandNames()
+		if c.name != "" {
+			condition = "__fish_seen_subcommand_from " + c.name
+		}
+		if c.name == "completion" {
+			fmt.Fprintf(w, "complete -c %s -f -n '%s' -a '%s'\n", name,
+				condition, strings.Join(completionShells, " "))
+			continue
+		}
+		for _, f := range c.flags {
+			fmt.Fprintf(w, "complete -c %s -n '%s' -o %s", name, condition,
+				f.name)
+			switch f.value {
+			case completeNoValue:
+				fmt.Fprintf(w, " -f")
+			case completeFile:
+				fmt.Fprintf(w, " -r -F")
+			case completeSection:
+				fmt.Fprintf(w, " -x -a '(%s __complete_sections "+
+					"(__%s_input_file) 2>/dev/null)'", name, name)
+			case completeChoice:
+				fmt.Fprintf(w, " -x -a '%s'", strings.Join(f.choices, " "))
+			default:
+				fmt.Fprintf(w, " -x")
+			}
+			fmt.Fprintf(w, "\n")
+		}
+	}
+}
+
+// Runs the "completion" subcommand, which writes a completion script for the
+// shell named in the arguments to stdout. Returns the process exit code.
+func runCompletionCommand(arguments []string) int {
+	if len(arguments) != 1 {
+		log.Printf("Usage: %s completion <%s>\n", completionProgramName,
+			strings.Join(completionShells, "|"))
+		return 1
+	}
+	switch arguments[0] {
+	case "bash":
+		writeBashCompletion(os.Stdout)
+	case "zsh":
+		writeZshCompletion(os.Stdout)
+	case "fish":
+		writeFishCompletion(os.Stdout)
+	default:
+		log.Printf("Unsupported shell: %s\n", arguments[0])
+		return 1
+	}
+	return 0
+}
+
+// Runs the hidden "__complete_sections" subcommand, used by the completion
+// scripts. Prints the name of each section in the ELF file named by the
+// argument, one per line. Errors are silently ignored, since there's nothing
+// useful to do with them while completing.
+func runCompleteSectionsCommand(arguments []string) int {
+	if len(arguments) != 1 {
+		return 1
+	}
+	rawInput, e := ioutil.ReadFile(arguments[0])
+	if e != nil {
+		return 1
+	}
+	elf, e := stringreplace.ParseELF32File(rawInput)
+	if e != nil {
+		return 1
+	}
+	var name string
+	for i := range elf.Sections {
+		name, e = stringreplace.SectionName(elf, uint16(i))
+		if (e != nil) || (name == "") {
+			continue
+		}
+		fmt.Println(name)
+	}
+	return 0
+}
@@ -0,0 +1,302 @@
+package main
+
+// This file contains code for reading default options from a configuration
+// file, so that projects don't need to repeat the same flags for every
+// invocation. The file uses a small subset of TOML: each top-level key is the
+// name of a command-line flag, and each [[rule]] table adds a replacement
+// rule, for example:
+//
+//    # .elf32replace.toml
+//    reuse_padding = true
+//    va_strategy = "after-last-load"
+//    checksum = ["crc32:0x1c:0x200-end"]
+//
+//    [[rule]]
+//    to_match = 'libc\.so\.6'
+//    replace = "libc_copy.so.6"
+//    sections = [".dynstr"]
+//    machines = ["arm"]
+//
+// Flags given on the command line override the values in the file, and the
+// rules are only used if -to_match isn't given.
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/yalue/elf32_string_replace/stringreplace"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The name of the configuration file searched for in the current directory
+// and its parents if -config isn't given.
+const defaultConfigName = ".elf32replace.toml"
+
+// Holds a flag's value(s) from the configuration file. Flags that may be
+// repeated, such as -checksum, may be given an array of values.
+type configEntry struct {
+	name   string
+	values []string
+	line   int
+}
+
+// Holds a replacement rule from a [[rule]] table in the configuration file.
+type configRule struct {
+	toMatch         string
+	replace         string
+	sections        []string
+	excludeSections []string
+	machines        []string
+	line            int
+}
+
+// Holds the parsed content of a configuration file.
+type configFile struct {
+	path    string
+	entries []configEntry
+	rules   []configRule
+}
+
+// Returns the path of the configuration file in the current directory or
+// the nearest parent directory containing one, or an empty string if there
+// isn't one.
+func findConfigFile() string {
+	directory, e := os.Getwd()
+	if e != nil {
+		return ""
+	}
+	for {
+		path := filepath.Join(directory, defaultConfigName)
+		info, e := os.Stat(path)
+		if (e == nil) && info.Mode().IsRegular() {
+			return path
+		}
+		parent := filepath.Dir(directory)
+		if parent == directory {
+			return ""
+		}
+		directory = parent
+	}
+}
+
+// Parses a quoted TOML string at the start of s, returning its value and the
+// remainder of s following the closing quote. Basic ("...") strings may
+// contain the same escape sequences as Go strings, and literal ('...')
+// strings are used as-is.
+func parseConfigString(s string) (string, string, error) {
+	if strings.HasPrefix(s, "'") {
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return "", "", fmt.Errorf("Unterminated string")
+		}
+		return s[1 : end+1], s[end+2:], nil
+	}
+	end := 1
+	for (end < len(s)) && (s[end] != '"') {
+		if s[end] == '\\' {
+			end++
+		}
+		end++
+	}
+	if end >= len(s) {
+		return "", "", fmt.Errorf("Unterminated string")
+	}
+	value, e := strconv.Unquote(s[:end+1])
+	if e != nil {
+		return "", "", fmt.Errorf("Invalid string %s: %s", s[:end+1], e)
+	}
+	return value, s[end+1:], nil
+}
+
+// Returns an error if s contains anything other than whitespace or a
+// comment.
+func checkConfigTrailer(s string) error {
+	s = strings.TrimSpace(s)
+	if (s == "") || strings.HasPrefix(s, "#") {
+		return nil
+	}
+	return fmt.Errorf("Unexpected text after value: %s", s)
+}
+
+// Parses the value following the = in a line of the configuration file. The
+// value may be a string, an array of strings on a single line, or a bare
+// value such as a number or boolean, which is passed to the flag as-is.
+func parseConfigValue(s string) ([]string, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "\"") || strings.HasPrefix(s, "'") {
+		value, rest, e := parseConfigString(s)
+		if e != nil {
+			return nil, e
+		}
+		return []string{value}, checkConfigTrailer(rest)
+	}
+	if !strings.HasPrefix(s, "[") {
+		if comment := strings.IndexByte(s, '#'); comment >= 0 {
+			s = s[:comment]
+		}
+		s = strings.TrimSpace(s)
+		if s == "" {
+			return nil, fmt.Errorf("Missing value")
+		}
+		return []string{s}, nil
+	}
+	toReturn := make([]string, 0, 2)
+	s = strings.TrimSpace(s[1:])
+	for !strings.HasPrefix(s, "]") {
+		if !strings.HasPrefix(s, "\"") && !strings.HasPrefix(s, "'") {
+			return nil, fmt.Errorf("Arrays may only contain strings, and " +
+				"must be on a single line")
+		}
+		value, rest, e := parseConfigString(s)
+		if e != nil {
+			return nil, e
+		}
+		toReturn = append(toReturn, value)
+		s = strings.TrimSpace(rest)
+		if strings.HasPrefix(s, ",") {
+			s = strings.TrimSpace(s[1:])
+		} else if !strings.HasPrefix(s, "]") {
+			return nil, fmt.Errorf("Expected , or ] in array")
+		}
+	}
+	return toReturn, checkConfigTrailer(s[1:])
+}
+
+// Parses the configuration file at the given path.
+func parseConfigFile(path string) (*configFile, error) {
+	content, e := ioutil.ReadFile(path)
+	if e != nil {
+		return nil, e
+	}
+	toReturn := &configFile{
+		path: path,
+	}
+	var rule *configRule
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if (line == "") || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if line == "[[rule]]" {
+			toReturn.rules = append(toReturn.rules, configRule{
+				line: lineNumber,
+			})
+			rule = &(toReturn.rules[len(toReturn.rules)-1])
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			return nil, fmt.Errorf("%s:%d: Unsupported table %s (only "+
+				"[[rule]] is supported)", path, lineNumber, line)
+		}
+		equals := strings.IndexByte(line, '=')
+		if equals <= 0 {
+			return nil, fmt.Errorf("%s:%d: Expected key = value", path,
+				lineNumber)
+		}
+		key := strings.TrimSpace(line[:equals])
+		values, e := parseConfigValue(line[equals+1:])
+		if e != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, lineNumber, e)
+		}
+		if rule == nil {
+			toReturn.entries = append(toReturn.entries, configEntry{
+				name:   key,
+				values: values,
+				line:   lineNumber,
+			})
+			continue
+		}
+		switch key {
+		case "to_match", "replace":
+			if len(values) != 1 {
+				return nil, fmt.Errorf("%s:%d: %s must be a single string",
+					path, lineNumber, key)
+			}
+			if key == "to_match" {
+				rule.toMatch = values[0]
+			} else {
+				rule.replace = values[0]
+			}
+		case "sections":
+			rule.sections = values
+		case "exclude_sections":
+			rule.excludeSections = values
+		case "machines":
+			rule.machines = values
+		default:
+			return nil, fmt.Errorf("%s:%d: Unknown rule key %q", path,
+				lineNumber, key)
+		}
+	}
+	e = scanner.Err()
+	if e != nil {
+		return nil, e
+	}
+	for _, r := range toReturn.rules {
+		if r.toMatch == "" {
+			return nil, fmt.Errorf("%s:%d: The rule has no to_match value",
+				path, r.line)
+		}
+	}
+	return toReturn, nil
+}
+
+// Sets each flag in the configuration file that wasn't given on the command
+// line. The explicit map holds the names of the flags that were given.
+func (c *configFile) apply(flags *flag.FlagSet,
+	explicit map[string]bool) error {
+	var e error
+	for _, entry := range c.entries {
+		if (entry.name == "config") || (flags.Lookup(entry.name) == nil) {
+			return fmt.Errorf("%s:%d: Unknown option %q", c.path, entry.line,
+				entry.name)
+		}
+		if explicit[entry.name] {
+			continue
+		}
+		for _, value := range entry.values {
+			e = flags.Set(entry.name, value)
+			if e != nil {
+				return fmt.Errorf("%s:%d: Invalid value for %s: %s", c.path,
+					entry.line, entry.name, e)
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the replacement rules from the configuration file's [[rule]]
+// tables, in the order they were given.
+func (c *configFile) buildRules() ([]stringreplace.Rule, error) {
+	toReturn := make([]stringreplace.Rule, len(c.rules))
+	var e error
+	for i, r := range c.rules {
+		toReturn[i].Match, e = regexp.Compile(r.toMatch)
+		if e != nil {
+			return nil, fmt.Errorf("%s:%d: Invalid to_match regular "+
+				"expression: %s", c.path, r.line, e)
+		}
+		toReturn[i].Replacement = r.replace
+		toReturn[i].Sections = r.sections
+		toReturn[i].ExcludeSections = r.excludeSections
+		toReturn[i].Machines, e = stringreplace.ParseMachines(r.machines)
+		if e != nil {
+			return nil, fmt.Errorf("%s:%d: %s", c.path, r.line, e)
+		}
+		e = stringreplace.ValidateRule(&(toReturn[i]))
+		if e != nil {
+			return nil, fmt.Errorf("%s:%d: Invalid rule: %s", c.path, r.line,
+				e)
+		}
+	}
+	return toReturn, nil
+}
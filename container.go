@@ -0,0 +1,135 @@
+package main
+
+// This file defines the interface shared by the container formats (such as
+// Intel HEX files) which hold a memory image in which an ELF file is stored.
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// The largest range of addresses a container may span. This guards against
+// allocating huge images for sparse files.
+const maxContainerImageSize = 256 * 1024 * 1024
+
+// The value used for bytes in a reconstructed image that aren't covered by
+// the container, matching the erased state of flash memory.
+const imageFillByte = 0xff
+
+// Implemented by the container formats which can be patched.
+type imageContainer interface {
+	// Returns the name of the container's format, for messages.
+	formatName() string
+	// Returns the reconstructed memory image. Modifications to the returned
+	// slice are reflected in the output of encode.
+	getImage() []byte
+	// Returns the content of the container, updated to hold the (possibly
+	// modified) image.
+	encode() ([]byte, error)
+}
+
+// Holds a piece of data to be placed at an address in a memory image.
+type imageChunk struct {
+	address uint32
+	data    []byte
+}
+
+// Holds a memory image reconstructed from a container file.
+type memoryImage struct {
+	// The address of the first byte in image.
+	baseAddress uint32
+	// The reconstructed memory image, and a copy of it that won't be
+	// modified.
+	image         []byte
+	originalImage []byte
+	// Indicates which bytes in image are covered by the container's data.
+	covered []bool
+}
+
+// Returns the memory image, implementing part of imageContainer.
+func (m *memoryImage) getImage() []byte {
+	return m.image
+}
+
+// Builds the memory image from the given chunks. Bytes between the chunks
+// are set to imageFillByte.
+func (m *memoryImage) build(chunks []imageChunk) error {
+	var start, end uint64
+	found := false
+	for _, c := range chunks {
+		if len(c.data) == 0 {
+			continue
+		}
+		if !found || (uint64(c.address) < start) {
+			start = uint64(c.address)
+		}
+		if !found || ((uint64(c.address) + uint64(len(c.data))) > end) {
+			end = uint64(c.address) + uint64(len(c.data))
+		}
+		found = true
+	}
+	if !found {
+		return fmt.Errorf("The file contains no data")
+	}
+	if (end - start) > maxContainerImageSize {
+		return fmt.Errorf("The data spans too many addresses (0x%x to 0x%x)",
+			start, end)
+	}
+	m.baseAddress = uint32(start)
+	m.image = bytes.Repeat([]byte{imageFillByte}, int(end-start))
+	m.covered = make([]bool, len(m.image))
+	var offset int
+	for _, c := range chunks {
+		offset = int(c.address - m.baseAddress)
+		copy(m.image[offset:], c.data)
+		for j := range c.data {
+			m.covered[offset+j] = true
+		}
+	}
+	m.originalImage = make([]byte, len(m.image))
+	copy(m.originalImage, m.image)
+	return nil
+}
+
+// Returns the bytes of the image at the given address, which must be covered
+// by the image.
+func (m *memoryImage) imageData(address uint32, size int) []byte {
+	offset := int(address - m.baseAddress)
+	return m.image[offset : offset+size]
+}
+
+// Returns an error if any modified byte in the image isn't covered by the
+// container's data, since the containers are never extended.
+func (m *memoryImage) checkUncoveredChanges() error {
+	for i := range m.image {
+		if !m.covered[i] && (m.image[i] != m.originalImage[i]) {
+			return fmt.Errorf("Modified address 0x%08x isn't covered by the "+
+				"file's data", m.baseAddress+uint32(i))
+		}
+	}
+	return nil
+}
+
+// Parses the content of the file at the given path if its extension
+// indicates a supported container format. Returns nil (and no error) if the
+// file isn't a container.
+func openContainer(path string, content []byte) (imageContainer, error) {
+	var toReturn imageContainer
+	var e error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".hex", ".ihex", ".ihx":
+		toReturn, e = parseHexFile(content, "ihex")
+	case ".srec", ".s19", ".s28", ".s37", ".mot":
+		toReturn, e = parseHexFile(content, "srec")
+	case ".uf2":
+		toReturn, e = parseUF2File(content)
+	default:
+		return nil, nil
+	}
+	if e != nil {
+		return nil, fmt.Errorf("Failed parsing container: %s", e)
+	}
+	return toReturn, nil
+}
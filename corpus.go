@@ -0,0 +1,1024 @@
+package main
+
+// This file implements the hidden "gen-corpus" subcommand, which writes a set
+// of small ELF files to a directory. The files cover the shapes of file
+// this tool supports, along with edge cases it must handle gracefully, so
+// they can seed a fuzzer. The list of shapes in corpusFiles also documents
+// what the tool is expected to cope with.
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Builds the content of a string table, returning the offset of each string
+// added to it.
+type corpusStrings struct {
+	content []byte
+	offsets map[string]uint32
+}
+
+func newCorpusStrings() *corpusStrings {
+	return &corpusStrings{
+		content: []byte{0},
+		offsets: map[string]uint32{"": 0},
+	}
+}
+
+// Returns the offset of the string in the table, adding it if necessary.
+func (s *corpusStrings) add(str string) uint32 {
+	if offset, ok := s.offsets[str]; ok {
+		return offset
+	}
+	offset := uint32(len(s.content))
+	s.content = append(s.content, []byte(str)...)
+	s.content = append(s.content, 0)
+	s.offsets[str] = offset
+	return offset
+}
+
+// A symbol in a generated symbol table. The section is the name of the
+// section containing the symbol, or "" for undefined symbols, in which case
+// the symbol is absolute if absolute is true.
+type corpusSymbol struct {
+	name     string
+	info     uint8
+	section  string
+	absolute bool
+}
+
+// A dynamic table entry. If addressOf or sizeOf is set, the value is the
+// address or size of the section with that name.
+type corpusDynamicEntry struct {
+	tag       uint32
+	value     uint32
+	addressOf string
+	sizeOf    string
+}
+
+// A relocation in a generated SHT_RELA section. It's applied to the address
+// of the section named by offsetOf, plus 4 bytes for each earlier relocation
+// in the same section. The addend is the address of the section named by
+// addendOf plus addend, or just addend if addendOf is empty.
+type corpusRelocation struct {
+	// r_info: the symbol index and relocation type.
+	info     uint32
+	offsetOf string
+	addendOf string
+	addend   uint32
+}
+
+// A segment other than the PT_LOAD and PT_DYNAMIC segments, covering the
+// named section. Segments covering unloaded sections have no memory size.
+type corpusSegment struct {
+	segmentType uint32
+	section     string
+}
+
+// A section in a generated file. The content of a dynamic table is built
+// from its entries once the file's layout is known, and includes the final
+// DT_NULL entry. The same applies to the content of a relocation table with
+// relocations.
+type corpusSection struct {
+	name        string
+	sectionType uint32
+	flags       uint32
+	content     []byte
+	dynamic     []corpusDynamicEntry
+	relocations []corpusRelocation
+	// The name of the linked section, if any.
+	link      string
+	info      uint32
+	align     uint32
+	entrySize uint32
+}
+
+// Returns the size of the section's content. The entry size of a dynamic
+// table or relocation table must be set.
+func (s *corpusSection) size() uint32 {
+	if s.sectionType == 6 {
+		return uint32(len(s.dynamic)+1) * s.entrySize
+	}
+	if len(s.relocations) != 0 {
+		return uint32(len(s.relocations)) * s.entrySize
+	}
+	return uint32(len(s.content))
+}
+
+// Describes a generated file.
+type corpusFile struct {
+	name        string
+	description string
+	order       binary.ByteOrder
+	fileType    uint16
+	machine     uint16
+	// If true, the file is a 64-bit (ELFCLASS64) file.
+	class64 bool
+	// The address at which file offset 0 is loaded, for files with a
+	// PT_LOAD segment.
+	base uint32
+	// The alignment of the PT_LOAD segment covering every SHF_ALLOC section,
+	// or 0 if the file has no program headers.
+	segmentAlign uint32
+	// Allocated sections must come first.
+	sections []corpusSection
+	// Additional program headers, following the PT_PHDR, PT_LOAD, and
+	// PT_DYNAMIC segments. Only used if segmentAlign isn't 0.
+	segments []corpusSegment
+	// If true, a PT_PHDR segment covering the program header table precedes
+	// the other segments, as in executables requesting an interpreter.
+	phdrSegment bool
+	// The number of zero-filled bytes loaded after the last allocated
+	// section, as for .bss, making the PT_LOAD segment's memory size larger
+	// than its file size.
+	bssSize uint32
+	// If true, e_shnum is 0, as in stripped or packed files.
+	noSectionHeaders bool
+	// If true, the file has no .shstrtab and e_shstrndx is SHN_UNDEF.
+	noSectionNames bool
+	// The number of bytes inserted before each section, to produce offsets
+	// that don't respect the sections' alignment.
+	misalign uint32
+}
+
+// Returns the index of the named section in the generated file, or 0 if
+// there is no such section.
+func (c *corpusFile) sectionIndex(name string) uint32 {
+	for i := range c.sections {
+		if c.sections[i].name == name {
+			return uint32(i + 1)
+		}
+	}
+	return 0
+}
+
+// Returns true if the file contains a dynamic table.
+func (c *corpusFile) hasDynamicTable() bool {
+	return c.sectionIndex(".dynamic") != 0
+}
+
+// Returns the sizes of the ELF header, a program header, and a section
+// header in the file.
+func (c *corpusFile) headerSizes() (uint32, uint32, uint32) {
+	if c.class64 {
+		return 64, 56, 64
+	}
+	return 52, 32, 40
+}
+
+// Returns x rounded up to a multiple of align.
+func alignUp(x, align uint32) uint32 {
+	if align <= 1 {
+		return x
+	}
+	return (x + align - 1) / align * align
+}
+
+// Lays out and returns the content of the generated file.
+func (c *corpusFile) build() []byte {
+	o := c.order
+	sections := append([]corpusSection(nil), c.sections...)
+	var names *corpusStrings
+	if !c.noSectionNames {
+		names = newCorpusStrings()
+		names.add(".shstrtab")
+		for i := range sections {
+			names.add(sections[i].name)
+		}
+		sections = append(sections, corpusSection{
+			name:        ".shstrtab",
+			sectionType: 3,
+			content:     names.content,
+			align:       1,
+		})
+	}
+	programHeaders := uint32(0)
+	if c.segmentAlign != 0 {
+		programHeaders = 1
+		if c.hasDynamicTable() {
+			programHeaders++
+		}
+		programHeaders += uint32(len(c.segments))
+		if c.phdrSegment {
+			programHeaders++
+		}
+	}
+	headerSize, programHeaderSize, sectionHeaderSize := c.headerSizes()
+	// Addresses, offsets, and sizes in headers and tables are 4 or 8 bytes.
+	wordSize := uint32(4)
+	putWord := func(b []byte, value uint32) {
+		o.PutUint32(b, value)
+	}
+	if c.class64 {
+		wordSize = 8
+		putWord = func(b []byte, value uint32) {
+			o.PutUint64(b, uint64(value))
+		}
+	}
+	offsets := make([]uint32, len(sections))
+	addresses := make(map[string]uint32)
+	sizes := make(map[string]uint32)
+	offset := headerSize + (programHeaderSize * programHeaders)
+	var loadEnd uint32
+	for i := range sections {
+		s := &(sections[i])
+		offset = alignUp(offset, s.align) + c.misalign
+		offsets[i] = offset
+		sizes[s.name] = s.size()
+		// Only sections with SHF_ALLOC in files with segments are loaded.
+		if ((s.flags & 2) != 0) && (c.segmentAlign != 0) {
+			addresses[s.name] = c.base + offset
+			loadEnd = offset + s.size()
+		}
+		offset += s.size()
+	}
+	sectionHeaderOffset := alignUp(offset, wordSize)
+	sectionCount := uint32(len(sections) + 1)
+	size := sectionHeaderOffset + (sectionHeaderSize * sectionCount)
+	if c.noSectionHeaders {
+		sectionHeaderOffset = 0
+		sectionCount = 0
+		size = offset
+	}
+	raw := make([]byte, size)
+	copy(raw, "\x7fELF")
+	// ELFCLASS32 or ELFCLASS64, the byte order, and EV_CURRENT.
+	raw[4] = 1
+	if c.class64 {
+		raw[4] = 2
+	}
+	raw[5] = 1
+	if o == binary.BigEndian {
+		raw[5] = 2
+	}
+	raw[6] = 1
+	o.PutUint16(raw[16:], c.fileType)
+	o.PutUint16(raw[18:], c.machine)
+	o.PutUint32(raw[20:], 1)
+	// e_phoff and e_shoff follow e_entry, and the rest of the header
+	// follows e_flags.
+	if programHeaders != 0 {
+		putWord(raw[24+wordSize:], headerSize)
+	}
+	putWord(raw[24+2*wordSize:], sectionHeaderOffset)
+	sizesField := raw[28+3*wordSize:]
+	o.PutUint16(sizesField[0:], uint16(headerSize))
+	o.PutUint16(sizesField[2:], uint16(programHeaderSize))
+	o.PutUint16(sizesField[4:], uint16(programHeaders))
+	o.PutUint16(sizesField[6:], uint16(sectionHeaderSize))
+	o.PutUint16(sizesField[8:], uint16(sectionCount))
+	if !c.noSectionNames && !c.noSectionHeaders {
+		o.PutUint16(sizesField[10:], uint16(len(sections)))
+	}
+	writeProgramHeader := func(index, segmentType, offset, address, size,
+		memorySize, flags, align uint32) {
+		h := raw[headerSize+(programHeaderSize*index):]
+		o.PutUint32(h[0:], segmentType)
+		fields := h[4:]
+		// In 64-bit files, p_flags follows p_type.
+		if c.class64 {
+			o.PutUint32(h[4:], flags)
+			fields = h[8:]
+		}
+		for i, value := range []uint32{offset, address, address, size,
+			memorySize} {
+			putWord(fields[uint32(i)*wordSize:], value)
+		}
+		if !c.class64 {
+			o.PutUint32(h[24:], flags)
+		}
+		putWord(h[programHeaderSize-wordSize:], align)
+	}
+	if programHeaders != 0 {
+		index := uint32(0)
+		if c.phdrSegment {
+			// PT_PHDR, with PF_R
+			writeProgramHeader(index, 6, headerSize, c.base+headerSize,
+				programHeaderSize*programHeaders,
+				programHeaderSize*programHeaders, 4, wordSize)
+			index++
+		}
+		// PT_LOAD, with PF_R | PF_W
+		writeProgramHeader(index, 1, 0, c.base, loadEnd, loadEnd+c.bssSize,
+			6, c.segmentAlign)
+		index++
+		if c.hasDynamicTable() {
+			// PT_DYNAMIC
+			writeProgramHeader(index, 2,
+				offsets[c.sectionIndex(".dynamic")-1],
+				addresses[".dynamic"], sizes[".dynamic"], sizes[".dynamic"],
+				6, wordSize)
+			index++
+		}
+		for _, s := range c.segments {
+			section := c.sectionIndex(s.section) - 1
+			memorySize := uint32(0)
+			if (sections[section].flags & 2) != 0 {
+				memorySize = sizes[s.section]
+			}
+			// PF_R
+			writeProgramHeader(index, s.segmentType, offsets[section],
+				addresses[s.section], sizes[s.section], memorySize, 4, 1)
+			index++
+		}
+	}
+	for i := range sections {
+		s := &(sections[i])
+		for j, r := range s.relocations {
+			entry := raw[offsets[i]+uint32(j)*s.entrySize:]
+			addend := r.addend
+			if r.addendOf != "" {
+				addend += addresses[r.addendOf]
+			}
+			putWord(entry[0:], addresses[r.offsetOf]+uint32(j*4))
+			if c.class64 {
+				// ELF64_R_INFO puts the symbol index in the upper 32 bits.
+				o.PutUint64(entry[8:], (uint64(r.info>>8)<<32)|
+					uint64(r.info&0xff))
+			} else {
+				o.PutUint32(entry[4:], r.info)
+			}
+			putWord(entry[2*wordSize:], addend)
+		}
+		if s.sectionType != 6 {
+			copy(raw[offsets[i]:], s.content)
+			continue
+		}
+		for j, entry := range s.dynamic {
+			value := entry.value
+			if entry.addressOf != "" {
+				value = addresses[entry.addressOf]
+			} else if entry.sizeOf != "" {
+				value = sizes[entry.sizeOf]
+			}
+			entryOffset := offsets[i] + uint32(j)*s.entrySize
+			putWord(raw[entryOffset:], entry.tag)
+			putWord(raw[entryOffset+wordSize:], value)
+		}
+	}
+	if c.noSectionHeaders {
+		return raw
+	}
+	// Section 0 is left as the null section header.
+	for i := range sections {
+		s := &(sections[i])
+		h := raw[sectionHeaderOffset+(sectionHeaderSize*uint32(i+1)):]
+		if names != nil {
+			o.PutUint32(h[0:], names.add(s.name))
+		}
+		o.PutUint32(h[4:], s.sectionType)
+		// sh_flags, sh_addr, sh_offset, and sh_size are words, followed by
+		// the 32-bit sh_link and sh_info, and the sh_addralign and
+		// sh_entsize words.
+		putWord(h[8:], s.flags)
+		putWord(h[8+wordSize:], addresses[s.name])
+		putWord(h[8+2*wordSize:], offsets[i])
+		putWord(h[8+3*wordSize:], s.size())
+		fields := h[8+4*wordSize:]
+		if s.link != "" {
+			o.PutUint32(fields[0:], c.sectionIndex(s.link))
+		}
+		o.PutUint32(fields[4:], s.info)
+		putWord(fields[8:], s.align)
+		putWord(fields[8+wordSize:], s.entrySize)
+	}
+	return raw
+}
+
+// Returns the content of a symbol table containing the null symbol followed
+// by the given symbols, whose names are added to the string table. The file
+// is used to find the index of each symbol's section, and its class.
+func corpusSymbolTable(o binary.ByteOrder, names *corpusStrings,
+	symbols []corpusSymbol, file *corpusFile) []byte {
+	// In an Elf32_Sym, st_info follows st_value and st_size, and in an
+	// Elf64_Sym, it follows st_name.
+	symbolSize, infoOffset := 16, 12
+	if file.class64 {
+		symbolSize, infoOffset = 24, 4
+	}
+	toReturn := make([]byte, symbolSize*(len(symbols)+1))
+	for i, s := range symbols {
+		entry := toReturn[symbolSize*(i+1):]
+		o.PutUint32(entry[0:], names.add(s.name))
+		entry[infoOffset] = s.info
+		switch {
+		case s.section != "":
+			o.PutUint16(entry[infoOffset+2:],
+				uint16(file.sectionIndex(s.section)))
+		case s.absolute:
+			// SHN_ABS
+			o.PutUint16(entry[infoOffset+2:], 0xfff1)
+		}
+	}
+	return toReturn
+}
+
+// Returns the content of a SysV hash table with the given number of buckets,
+// covering the null symbol followed by the symbols with the given names.
+func corpusHashTable(o binary.ByteOrder, names []string,
+	bucketCount uint32) []byte {
+	symbolCount := uint32(len(names) + 1)
+	toReturn := make([]byte, 4*(2+bucketCount+symbolCount))
+	o.PutUint32(toReturn[0:], bucketCount)
+	o.PutUint32(toReturn[4:], symbolCount)
+	buckets := toReturn[8:]
+	chains := toReturn[8+(4*bucketCount):]
+	// Each symbol is added to the start of its bucket's chain, which ends
+	// at the null symbol.
+	for i, name := range names {
+		b := corpusELFHash(name) % bucketCount
+		o.PutUint32(chains[4*(i+1):], o.Uint32(buckets[4*b:]))
+		o.PutUint32(buckets[4*b:], uint32(i+1))
+	}
+	return toReturn
+}
+
+// Computes the GNU hash of a name, as used in .gnu.hash sections.
+func corpusGNUHash(name string) uint32 {
+	h := uint32(5381)
+	for i := 0; i < len(name); i++ {
+		h = (h * 33) + uint32(name[i])
+	}
+	return h
+}
+
+// Returns the content of a GNU hash table with a single bucket and a single
+// bloom filter word, covering every symbol after the null symbol, whose names
+// are given. The bloom filter word has 64 bits in 64-bit files, and 32 bits
+// otherwise.
+func corpusGNUHashTable(o binary.ByteOrder, names []string,
+	class64 bool) []byte {
+	bloomBytes := 4
+	if class64 {
+		bloomBytes = 8
+	}
+	bloomBits := uint32(8 * bloomBytes)
+	// The header, one bloom filter word, one bucket, and the chain.
+	toReturn := make([]byte, 16+bloomBytes+4*(1+len(names)))
+	bloomShift := uint32(5)
+	o.PutUint32(toReturn[0:], 1)
+	o.PutUint32(toReturn[4:], 1)
+	o.PutUint32(toReturn[8:], 1)
+	o.PutUint32(toReturn[12:], bloomShift)
+	chain := toReturn[16+bloomBytes+4:]
+	var bloom uint64
+	for i, name := range names {
+		h := corpusGNUHash(name)
+		bloom |= (1 << (h % bloomBits)) | (1 << ((h >> bloomShift) % bloomBits))
+		// The low bit marks the last symbol in the bucket's chain.
+		h &^= 1
+		if i == (len(names) - 1) {
+			h |= 1
+		}
+		o.PutUint32(chain[4*i:], h)
+	}
+	if class64 {
+		o.PutUint64(toReturn[16:], bloom)
+	} else {
+		o.PutUint32(toReturn[16:], uint32(bloom))
+	}
+	if len(names) != 0 {
+		o.PutUint32(toReturn[16+bloomBytes:], 1)
+	}
+	return toReturn
+}
+
+// Returns the content of a .riscv.attributes section holding a "riscv"
+// subsection with a file attribute for the given ISA string (Tag_RISCV_arch,
+// which is 5) and one for 16-byte stack alignment (Tag_RISCV_stack_align,
+// which is 4).
+func corpusRISCVAttributes(o binary.ByteOrder, arch string) []byte {
+	attributes := append([]byte{4, 16, 5}, []byte(arch)...)
+	attributes = append(attributes, 0)
+	// Tag_File (1), followed by the size of the tag and its attributes.
+	file := make([]byte, 5, 5+len(attributes))
+	file[0] = 1
+	o.PutUint32(file[1:], uint32(5+len(attributes)))
+	file = append(file, attributes...)
+	// The subsection's size includes itself, and the vendor name.
+	subsection := make([]byte, 4, 4+6+len(file))
+	o.PutUint32(subsection, uint32(4+6+len(file)))
+	subsection = append(subsection, []byte("riscv\x00")...)
+	subsection = append(subsection, file...)
+	// Format version 'A'.
+	return append([]byte{'A'}, subsection...)
+}
+
+// Computes the SysV ELF hash of a name, as used in version requirements.
+func corpusELFHash(name string) uint32 {
+	var h, g uint32
+	for i := 0; i < len(name); i++ {
+		h = (h << 4) + uint32(name[i])
+		g = h & 0xf0000000
+		if g != 0 {
+			h ^= g >> 24
+		}
+		h &= ^g
+	}
+	return h
+}
+
+// Returns the content of a version definition section defining the base
+// version, named after the soname, with index 1, and the given version, with
+// index 3. Each Elf32_Verdef is followed by its single Elf32_Verdaux.
+func corpusVersionDefinitions(o binary.ByteOrder, dynstr *corpusStrings,
+	soname, version string) []byte {
+	toReturn := make([]byte, 56)
+	for i, name := range []string{soname, version} {
+		d := toReturn[28*i:]
+		// vd_version, vd_flags (VER_FLG_BASE for the base version), vd_ndx,
+		// vd_cnt, vd_hash, vd_aux, and vd_next.
+		o.PutUint16(d[0:], 1)
+		if i == 0 {
+			o.PutUint16(d[2:], 1)
+			o.PutUint16(d[4:], 1)
+			o.PutUint32(d[16:], 28)
+		} else {
+			o.PutUint16(d[4:], 3)
+		}
+		o.PutUint16(d[6:], 1)
+		o.PutUint32(d[8:], corpusELFHash(name))
+		o.PutUint32(d[12:], 20)
+		// vda_name and vda_next.
+		o.PutUint32(d[20:], dynstr.add(name))
+	}
+	return toReturn
+}
+
+// Holds the settings for corpusDynamicFile.
+type corpusDynamicSettings struct {
+	name        string
+	description string
+	order       binary.ByteOrder
+	machine     uint16
+	// ET_DYN (3) for shared libraries, or ET_EXEC (2) for executables.
+	fileType uint16
+	base     uint32
+	// The dependency and soname, either of which may be empty. If neededIn
+	// is true, the dependency's name is stored as a suffix of the soname,
+	// as linkers do when merging strings.
+	needed   string
+	soname   string
+	neededIn bool
+	// If true, the file has symbol versions, requiring GLIBC_2.0 from the
+	// dependency.
+	versioned bool
+	// If set, the versioned file also defines this version, given to its
+	// function, along with the base version named after its soname.
+	definedVersion string
+	// If true, the file has no symbols other than the null symbol.
+	noSymbols bool
+	// If set, the file is an executable requesting this program interpreter
+	// in .interp and PT_INTERP. Position-independent ones are marked with
+	// DF_1_PIE.
+	interpreter string
+	// The type to give the .dynstr section, normally SHT_STRTAB.
+	dynstrType uint32
+	// For each type, a .rela.dyn relocation of that type that doesn't refer
+	// to a symbol, applied to .data, whose addend is the address of the
+	// dependency's name.
+	relocationTypes []uint32
+	// If true, the file has a .gnu.hash section as well as .hash, as linkers
+	// produce with --hash-style=both.
+	gnuHash bool
+	// The number of buckets in .hash, if not 1.
+	hashBuckets uint32
+	// If true, the file is a 64-bit file.
+	class64 bool
+}
+
+// Returns a dynamically-linked file: a shared library or executable with
+// .hash, .dynsym, .dynstr, and .dynamic sections, an optional .gnu.hash
+// section and symbol versions, and an unloaded .symtab and .strtab.
+func corpusDynamicFile(settings *corpusDynamicSettings) *corpusFile {
+	o := settings.order
+	f := &corpusFile{
+		name:         settings.name,
+		description:  settings.description,
+		order:        o,
+		fileType:     settings.fileType,
+		machine:      settings.machine,
+		class64:      settings.class64,
+		base:         settings.base,
+		segmentAlign: 0x1000,
+	}
+	// The alignment of words, and the sizes of symbols, dynamic entries, and
+	// relocations with addends.
+	wordSize, symbolSize, dynamicSize, relocationSize := uint32(4),
+		uint32(16), uint32(8), uint32(12)
+	if settings.class64 {
+		wordSize, symbolSize, dynamicSize, relocationSize = 8, 24, 16, 24
+	}
+	// The section list is filled in first, so symbol section indices can be
+	// found, and then the content of each section is set.
+	sectionList := []corpusSection{
+		{name: ".hash", sectionType: 5, flags: 2, link: ".dynsym", align: 4,
+			entrySize: 4},
+		{name: ".dynsym", sectionType: 11, flags: 2, link: ".dynstr",
+			info: 1, align: wordSize, entrySize: symbolSize},
+		{name: ".dynstr", sectionType: settings.dynstrType, flags: 2,
+			align: 1},
+	}
+	if settings.gnuHash {
+		sectionList = append([]corpusSection{{name: ".gnu.hash",
+			sectionType: 0x6ffffff6, flags: 2, link: ".dynsym",
+			align: wordSize}}, sectionList...)
+	}
+	if settings.versioned {
+		sectionList = append(sectionList,
+			corpusSection{name: ".gnu.version", sectionType: 0x6fffffff,
+				flags: 2, link: ".dynsym", align: 2, entrySize: 2})
+	}
+	if settings.definedVersion != "" {
+		sectionList = append(sectionList,
+			corpusSection{name: ".gnu.version_d", sectionType: 0x6ffffffd,
+				flags: 2, link: ".dynstr", info: 2, align: 4})
+	}
+	if settings.versioned {
+		sectionList = append(sectionList,
+			corpusSection{name: ".gnu.version_r", sectionType: 0x6ffffffe,
+				flags: 2, link: ".dynstr", info: 1, align: 4})
+	}
+	if len(settings.relocationTypes) != 0 {
+		sectionList = append(sectionList,
+			corpusSection{name: ".rela.dyn", sectionType: 4, flags: 2,
+				link: ".dynsym", align: wordSize, entrySize: relocationSize},
+			corpusSection{name: ".data", sectionType: 1, flags: 3,
+				content: make([]byte, 4*len(settings.relocationTypes)),
+				align:   4})
+	}
+	sectionList = append(sectionList,
+		// SHF_WRITE | SHF_ALLOC
+		corpusSection{name: ".dynamic", sectionType: 6, flags: 3,
+			link: ".dynstr", align: wordSize, entrySize: dynamicSize},
+		corpusSection{name: ".symtab", sectionType: 2, link: ".strtab",
+			info: 2, align: wordSize, entrySize: symbolSize},
+		corpusSection{name: ".strtab", sectionType: 3, align: 1})
+	if settings.interpreter != "" {
+		sectionList = append([]corpusSection{{name: ".interp",
+			sectionType: 1, flags: 2, align: 1,
+			content: []byte(settings.interpreter + "\x00")}},
+			sectionList...)
+		// PT_INTERP
+		f.segments = append(f.segments, corpusSegment{segmentType: 3,
+			section: ".interp"})
+		f.phdrSegment = true
+	}
+	f.sections = sectionList
+	section := func(name string) *corpusSection {
+		return &(f.sections[f.sectionIndex(name)-1])
+	}
+	dynstr := newCorpusStrings()
+	entries := make([]corpusDynamicEntry, 0, 16)
+	if (settings.interpreter != "") && (settings.fileType == 3) {
+		// DT_FLAGS_1, with DF_1_PIE
+		entries = append(entries, corpusDynamicEntry{tag: 0x6ffffffb,
+			value: 0x08000000})
+	}
+	if settings.soname != "" {
+		// DT_SONAME
+		entries = append(entries, corpusDynamicEntry{tag: 14,
+			value: dynstr.add(settings.soname)})
+	}
+	if settings.needed != "" {
+		var offset uint32
+		if settings.neededIn {
+			offset = dynstr.add(settings.soname) +
+				uint32(len(settings.soname)-len(settings.needed))
+		} else {
+			offset = dynstr.add(settings.needed)
+		}
+		// DT_NEEDED
+		entries = append(entries, corpusDynamicEntry{tag: 1, value: offset})
+	}
+	var dynamicSymbols []corpusSymbol
+	if !settings.noSymbols {
+		dynamicSymbols = []corpusSymbol{
+			// STB_GLOBAL, STT_FUNC
+			{name: "corpus_function", info: 0x12, absolute: true},
+			{name: "puts", info: 0x12},
+		}
+	}
+	section(".dynsym").content = corpusSymbolTable(o, dynstr, dynamicSymbols,
+		f)
+	symbolCount := uint32(len(dynamicSymbols) + 1)
+	symbolNames := make([]string, len(dynamicSymbols))
+	for i := range dynamicSymbols {
+		symbolNames[i] = dynamicSymbols[i].name
+	}
+	hashBuckets := settings.hashBuckets
+	if hashBuckets == 0 {
+		hashBuckets = 1
+	}
+	section(".hash").content = corpusHashTable(o, symbolNames, hashBuckets)
+	if settings.gnuHash {
+		section(".gnu.hash").content = corpusGNUHashTable(o, symbolNames,
+			settings.class64)
+		// DT_GNU_HASH
+		entries = append(entries, corpusDynamicEntry{tag: 0x6ffffef5,
+			addressOf: ".gnu.hash"})
+	}
+	entries = append(entries,
+		// DT_HASH, DT_STRTAB, DT_SYMTAB, DT_STRSZ, and DT_SYMENT
+		corpusDynamicEntry{tag: 4, addressOf: ".hash"},
+		corpusDynamicEntry{tag: 5, addressOf: ".dynstr"},
+		corpusDynamicEntry{tag: 6, addressOf: ".dynsym"},
+		corpusDynamicEntry{tag: 10, sizeOf: ".dynstr"},
+		corpusDynamicEntry{tag: 11, value: symbolSize})
+	if settings.versioned {
+		// Symbol 1 is global, and symbol 2 requires version index 2.
+		versym := make([]byte, 2*symbolCount)
+		for i := uint32(1); i < symbolCount; i++ {
+			o.PutUint16(versym[2*i:], uint16(i))
+		}
+		if settings.definedVersion != "" {
+			// Symbol 1 has the defined version, with index 3.
+			o.PutUint16(versym[2:], 3)
+			section(".gnu.version_d").content = corpusVersionDefinitions(o,
+				dynstr, settings.soname, settings.definedVersion)
+			entries = append(entries,
+				// DT_VERDEF and DT_VERDEFNUM
+				corpusDynamicEntry{tag: 0x6ffffffc,
+					addressOf: ".gnu.version_d"},
+				corpusDynamicEntry{tag: 0x6ffffffd, value: 2})
+		}
+		section(".gnu.version").content = versym
+		need := make([]byte, 32)
+		// vn_version, vn_cnt, vn_file, vn_aux, and vn_next.
+		o.PutUint16(need[0:], 1)
+		o.PutUint16(need[2:], 1)
+		o.PutUint32(need[4:], dynstr.add(settings.needed))
+		o.PutUint32(need[8:], 16)
+		// vna_hash, vna_flags, vna_other, vna_name, and vna_next.
+		o.PutUint32(need[16:], corpusELFHash("GLIBC_2.0"))
+		o.PutUint16(need[22:], 2)
+		o.PutUint32(need[24:], dynstr.add("GLIBC_2.0"))
+		section(".gnu.version_r").content = need
+		entries = append(entries,
+			// DT_VERSYM, DT_VERNEED, and DT_VERNEEDNUM
+			corpusDynamicEntry{tag: 0x6ffffff0, addressOf: ".gnu.version"},
+			corpusDynamicEntry{tag: 0x6ffffffe, addressOf: ".gnu.version_r"},
+			corpusDynamicEntry{tag: 0x6fffffff, value: 1})
+	}
+	if len(settings.relocationTypes) != 0 {
+		relocations := make([]corpusRelocation, len(settings.relocationTypes))
+		for i, relocationType := range settings.relocationTypes {
+			relocations[i] = corpusRelocation{
+				info:     relocationType,
+				offsetOf: ".data",
+				addendOf: ".dynstr",
+				addend:   dynstr.add(settings.needed),
+			}
+		}
+		section(".rela.dyn").relocations = relocations
+		entries = append(entries,
+			// DT_RELA, DT_RELASZ, and DT_RELAENT
+			corpusDynamicEntry{tag: 7, addressOf: ".rela.dyn"},
+			corpusDynamicEntry{tag: 8, sizeOf: ".rela.dyn"},
+			corpusDynamicEntry{tag: 9, value: relocationSize})
+	}
+	section(".dynstr").content = dynstr.content
+	section(".dynamic").dynamic = entries
+	strtab := newCorpusStrings()
+	section(".symtab").content = corpusSymbolTable(o, strtab, []corpusSymbol{
+		// STB_LOCAL, STT_FILE
+		{name: "corpus.c", info: 0x04, absolute: true},
+		{name: "corpus_function", info: 0x12, absolute: true},
+	}, f)
+	section(".strtab").content = strtab.content
+	return f
+}
+
+// Returns a file without a dynamic table: an ET_REL object, or an ET_EXEC
+// file loaded at the given base address, with a .text section and an
+// unloaded .symtab and .strtab.
+func corpusStaticFile(name, description string, o binary.ByteOrder,
+	machine, fileType uint16, base uint32) *corpusFile {
+	f := &corpusFile{
+		name:        name,
+		description: description,
+		order:       o,
+		fileType:    fileType,
+		machine:     machine,
+		base:        base,
+		sections: []corpusSection{
+			// SHF_ALLOC | SHF_EXECINSTR
+			{name: ".text", sectionType: 1, flags: 6,
+				content: make([]byte, 16), align: 4},
+			{name: ".comment", sectionType: 1, flags: 0x30,
+				content: []byte("GCC: (corpus) 1.0\x00"), align: 1,
+				entrySize: 1},
+			{name: ".symtab", sectionType: 2, link: ".strtab", info: 2,
+				align: 4, entrySize: 16},
+			{name: ".strtab", sectionType: 3, align: 1},
+		},
+	}
+	if fileType == 2 {
+		f.segmentAlign = 0x1000
+	}
+	strtab := newCorpusStrings()
+	f.sections[2].content = corpusSymbolTable(o, strtab, []corpusSymbol{
+		{name: "corpus.c", info: 0x04, absolute: true},
+		{name: "_start", info: 0x12, section: ".text"},
+	}, f)
+	f.sections[3].content = strtab.content
+	return f
+}
+
+// Returns the files written by gen-corpus.
+func corpusFiles() []*corpusFile {
+	le := binary.LittleEndian
+	be := binary.BigEndian
+	shared := func(name, description string) *corpusDynamicSettings {
+		return &corpusDynamicSettings{
+			name:        name,
+			description: description,
+			order:       le,
+			// EM_386
+			machine:    3,
+			fileType:   3,
+			needed:     "libc.so.6",
+			soname:     "libcorpus.so.1",
+			versioned:  true,
+			dynstrType: 3,
+		}
+	}
+	toReturn := make([]*corpusFile, 0, 16)
+	s := shared("shared_le.so", "Little-endian i386 shared library with "+
+		"symbol versions")
+	toReturn = append(toReturn, corpusDynamicFile(s))
+	s = shared("shared_be.so", "Big-endian PowerPC shared library with "+
+		"symbol versions")
+	s.order = be
+	// EM_PPC
+	s.machine = 20
+	toReturn = append(toReturn, corpusDynamicFile(s))
+	s = shared("exec_dynamic", "Dynamically-linked i386 executable (ET_EXEC)")
+	s.fileType = 2
+	s.base = 0x08048000
+	s.soname = ""
+	toReturn = append(toReturn, corpusDynamicFile(s))
+	s = shared("pie_exec", "Position-independent i386 executable (ET_DYN) "+
+		"with a PT_INTERP segment, whose PT_LOAD segment's memory extends "+
+		"past the end of the file")
+	s.soname = ""
+	s.interpreter = "/lib/ld-linux.so.2"
+	f := corpusDynamicFile(s)
+	f.bssSize = 0x2000
+	toReturn = append(toReturn, f)
+	s = shared("musl_exec", "Position-independent i386 executable linked "+
+		"against musl, as on Alpine, without symbol versions")
+	s.soname = ""
+	s.needed = "libc.musl-x86.so.1"
+	s.interpreter = "/lib/ld-musl-i386.so.1"
+	s.versioned = false
+	toReturn = append(toReturn, corpusDynamicFile(s))
+	s = shared("uclibc_exec", "Big-endian MIPS executable (ET_EXEC) linked "+
+		"against uClibc-ng, as on OpenWrt, without symbol versions")
+	s.order = be
+	// EM_MIPS
+	s.machine = 8
+	s.fileType = 2
+	s.base = 0x00400000
+	s.soname = ""
+	s.needed = "libc.so.0"
+	s.interpreter = "/lib/ld-uClibc.so.0"
+	s.versioned = false
+	toReturn = append(toReturn, corpusDynamicFile(s))
+	s = shared("unversioned.so", "Shared library without symbol versions")
+	s.versioned = false
+	toReturn = append(toReturn, corpusDynamicFile(s))
+	s = shared("empty_dynstr.so", "Shared library whose .dynstr contains "+
+		"only the empty string, with no dependencies or symbols")
+	s.needed = ""
+	s.soname = ""
+	s.versioned = false
+	s.noSymbols = true
+	toReturn = append(toReturn, corpusDynamicFile(s))
+	s = shared("suffix_sharing.so", "Shared library whose DT_NEEDED string "+
+		"is the tail of its DT_SONAME string")
+	s.soname = "libcorpus_util.so"
+	s.needed = "util.so"
+	s.neededIn = true
+	s.versioned = false
+	toReturn = append(toReturn, corpusDynamicFile(s))
+	s = shared("gnu_hash.so", "Shared library with both .hash and "+
+		".gnu.hash symbol hash tables, the former with several buckets")
+	s.gnuHash = true
+	s.hashBuckets = 5
+	toReturn = append(toReturn, corpusDynamicFile(s))
+	s = shared("defined_versions.so", "Shared library defining a version "+
+		"of its function, besides the base version named after its soname")
+	s.definedVersion = "LIBCORPUS_1.0"
+	toReturn = append(toReturn, corpusDynamicFile(s))
+	s = shared("mistyped_dynstr.so", "Shared library whose .dynstr has the "+
+		"SHT_PROGBITS type")
+	s.dynstrType = 1
+	toReturn = append(toReturn, corpusDynamicFile(s))
+	f = corpusDynamicFile(shared("no_section_headers.so", "Shared library "+
+		"without section headers (e_shnum is 0)"))
+	f.noSectionHeaders = true
+	toReturn = append(toReturn, f)
+	f = corpusDynamicFile(shared("no_section_names.so", "Shared library "+
+		"without .shstrtab (e_shstrndx is SHN_UNDEF)"))
+	f.noSectionNames = true
+	toReturn = append(toReturn, f)
+	f = corpusDynamicFile(shared("odd_alignment.so", "Shared library with "+
+		"64 KiB segment alignment and sections at unaligned offsets"))
+	f.segmentAlign = 0x10000
+	f.misalign = 3
+	toReturn = append(toReturn, f)
+	f = corpusDynamicFile(shared("unreferenced_strtab.so", "Shared library "+
+		"with a .stabstr string table nothing refers to"))
+	f.sections = append(f.sections, corpusSection{name: ".stabstr",
+		sectionType: 3, content: []byte("\x00corpus.c\x00libc.so.6\x00"),
+		align: 1})
+	toReturn = append(toReturn, f)
+	s = shared("riscv32.so", "RV32 shared library with R_RISCV_RELATIVE "+
+		"and R_RISCV_TLS_TPREL32 relocations whose addends are the "+
+		"dependency's address, and a .riscv.attributes section")
+	// EM_RISCV
+	s.machine = 243
+	// R_RISCV_RELATIVE and R_RISCV_TLS_TPREL32. Only the first addend is an
+	// address.
+	s.relocationTypes = []uint32{3, 10}
+	f = corpusDynamicFile(s)
+	f.sections = append(f.sections, corpusSection{name: ".riscv.attributes",
+		sectionType: 0x70000003, content: corpusRISCVAttributes(le,
+			"rv32i2p1_m2p0_a2p1_c2p0"), align: 1})
+	// PT_RISCV_ATTRIBUTES
+	f.segments = []corpusSegment{{segmentType: 0x70000003,
+		section: ".riscv.attributes"}}
+	toReturn = append(toReturn, f)
+	s = shared("shared64_le.so", "Little-endian x86-64 shared library "+
+		"with symbol versions and both symbol hash tables")
+	s.class64 = true
+	// EM_X86_64
+	s.machine = 62
+	s.gnuHash = true
+	s.hashBuckets = 3
+	toReturn = append(toReturn, corpusDynamicFile(s))
+	s = shared("shared64_be.so", "Big-endian PowerPC64 shared library with "+
+		"symbol versions")
+	s.class64 = true
+	s.order = be
+	// EM_PPC64
+	s.machine = 21
+	toReturn = append(toReturn, corpusDynamicFile(s))
+	s = shared("exec64_dynamic", "Dynamically-linked x86-64 executable "+
+		"(ET_EXEC) with a PT_INTERP segment and a PT_PHDR segment")
+	s.class64 = true
+	s.machine = 62
+	s.fileType = 2
+	s.base = 0x00400000
+	s.soname = ""
+	s.interpreter = "/lib64/ld-linux-x86-64.so.2"
+	toReturn = append(toReturn, corpusDynamicFile(s))
+	toReturn = append(toReturn,
+		corpusStaticFile("static_exec", "Statically-linked i386 executable "+
+			"without a dynamic table", le, 3, 2, 0x08048000),
+		corpusStaticFile("relocatable_le.o", "Little-endian i386 "+
+			"relocatable object without program headers", le, 3, 1, 0),
+		// EM_MIPS
+		corpusStaticFile("relocatable_be.o", "Big-endian MIPS relocatable "+
+			"object without program headers", be, 8, 1, 0))
+	return toReturn
+}
+
+// Runs the hidden "gen-corpus" subcommand.
+func runGenCorpusCommand(arguments []string) int {
+	var outputDir string
+	flags := flag.NewFlagSet("gen-corpus", flag.ContinueOnError)
+	flags.StringVar(&outputDir, "output_dir", "", "The directory in which "+
+		"to write the generated files. Created if it doesn't exist.")
+	e := flags.Parse(arguments)
+	if e != nil {
+		return 1
+	}
+	if outputDir == "" {
+		log.Println("Invalid arguments. Run with -help for more information.")
+		return 1
+	}
+	e = os.MkdirAll(outputDir, 0755)
+	if e != nil {
+		log.Printf("Failed creating output directory: %s\n", e)
+		return 1
+	}
+	files := corpusFiles()
+	for _, f := range files {
+		path := filepath.Join(outputDir, f.name)
+		e = ioutil.WriteFile(path, f.build(), 0644)
+		if e != nil {
+			log.Printf("Failed writing %s: %s\n", path, e)
+			return 1
+		}
+		fmt.Printf("%-24s %s\n", f.name, f.description)
+	}
+	log.Printf("Wrote %d files to %s.\n", len(files), outputDir)
+	return 0
+}
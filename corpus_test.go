@@ -0,0 +1,42 @@
+package main
+
+// This file contains helpers shared by the tests, which patch the synthetic
+// files generated by the gen-corpus subcommand, like the self-test.
+
+import (
+	"github.com/yalue/elf_reader"
+	"testing"
+)
+
+// Returns the content of the corpus file with the given name.
+func corpusInput(t *testing.T, name string) []byte {
+	f := findCorpusFile(name)
+	if f == nil {
+		t.Fatalf("Unknown corpus file %s", name)
+	}
+	return f.build()
+}
+
+// Parses the given ELF file content, failing the test if it's invalid.
+func parseTestELF(t *testing.T, content []byte) *elf_reader.ELF32File {
+	f, e := elf_reader.ParseELF32File(content)
+	if e != nil {
+		t.Fatalf("Failed parsing the output: %s", e)
+	}
+	return f
+}
+
+// Returns the single string referred to by the file's dynamic entries with
+// the given tag, failing the test unless there's exactly one.
+func dynamicString(t *testing.T, f *elf_reader.ELF32File,
+	tag elf_reader.ELF32DynamicTag) string {
+	values, e := readDynamicStrings(f, tag)
+	if e != nil {
+		t.Fatalf("%s", e)
+	}
+	if len(values) != 1 {
+		t.Fatalf("Expected one dynamic entry with tag %d, got %q", tag,
+			values)
+	}
+	return values[0]
+}
@@ -0,0 +1,324 @@
+package main
+
+// This file contains support for patching the ELF files in newc-format cpio
+// archives, such as Linux initramfs images, which may be compressed using
+// gzip or zstd.
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/yalue/elf32_string_replace/stringreplace"
+	"github.com/yalue/elf_reader"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// The compression formats supported for cpio archives.
+const (
+	cpioUncompressed = "none"
+	cpioGzip         = "gzip"
+	cpioZstd         = "zstd"
+)
+
+// The indices of the fields in a newc cpio header that we care about.
+const (
+	cpioModeField     = 1
+	cpioFileSizeField = 6
+	cpioNameSizeField = 11
+	cpioCheckField    = 12
+)
+
+// The size of a newc cpio header: a 6-byte magic number followed by 13
+// 8-digit hex fields.
+const cpioHeaderSize = 6 + 13*8
+
+// Holds a single file (or other entry) in a cpio archive.
+type cpioEntry struct {
+	// Either "070701" (newc) or "070702" (newc with checksums).
+	magic  string
+	fields [13]uint32
+	name   string
+	data   []byte
+}
+
+// Holds a parsed cpio archive.
+type cpioArchive struct {
+	compression string
+	entries     []cpioEntry
+	// Any data following the last archive's trailer, such as padding, which
+	// is preserved as-is.
+	trailingData []byte
+}
+
+// Returns the number of bytes needed to pad n to a multiple of 4.
+func cpioPadding(n int) int {
+	return (4 - (n % 4)) % 4
+}
+
+// Returns true if the content starts with a newc cpio header.
+func isCPIOData(content []byte) bool {
+	return bytes.HasPrefix(content, []byte("070701")) ||
+		bytes.HasPrefix(content, []byte("070702"))
+}
+
+// Decompresses zstd data using the zstd command-line tool, since the
+// standard library doesn't support zstd.
+func runZstd(content []byte, arguments ...string) ([]byte, error) {
+	var output, errors bytes.Buffer
+	command := exec.Command("zstd", arguments...)
+	command.Stdin = bytes.NewReader(content)
+	command.Stdout = &output
+	command.Stderr = &errors
+	e := command.Run()
+	if e != nil {
+		return nil, fmt.Errorf("zstd failed: %s %s", e, errors.String())
+	}
+	return output.Bytes(), nil
+}
+
+// Returns the decompressed content and the compression format, if the
+// content is a (possibly compressed) cpio archive. Returns nil if the
+// content isn't a cpio archive.
+func decompressCPIO(content []byte) ([]byte, string, error) {
+	if isCPIOData(content) {
+		return content, cpioUncompressed, nil
+	}
+	if bytes.HasPrefix(content, []byte{0x1f, 0x8b}) {
+		reader, e := gzip.NewReader(bytes.NewReader(content))
+		if e != nil {
+			return nil, "", nil
+		}
+		decompressed, e := ioutil.ReadAll(reader)
+		if (e != nil) || !isCPIOData(decompressed) {
+			return nil, "", nil
+		}
+		return decompressed, cpioGzip, nil
+	}
+	if bytes.HasPrefix(content, []byte{0x28, 0xb5, 0x2f, 0xfd}) {
+		decompressed, e := runZstd(content, "-d", "-c", "-q")
+		if e != nil {
+			return nil, "", fmt.Errorf("Failed decompressing: %s", e)
+		}
+		if !isCPIOData(decompressed) {
+			return nil, "", nil
+		}
+		return decompressed, cpioZstd, nil
+	}
+	return nil, "", nil
+}
+
+// Parses the given uncompressed cpio data, which may contain several
+// concatenated archives.
+func parseCPIOArchive(content []byte) (*cpioArchive, error) {
+	toReturn := &cpioArchive{
+		entries: make([]cpioEntry, 0, 256),
+	}
+	offset := 0
+	var entry cpioEntry
+	var value uint64
+	var e error
+	for offset < len(content) {
+		if !isCPIOData(content[offset:]) {
+			// Skip the zero padding between concatenated archives, and keep
+			// anything else as trailing data.
+			if content[offset] == 0 {
+				next := offset
+				for (next < len(content)) && (content[next] == 0) {
+					next++
+				}
+				if (next < len(content)) && isCPIOData(content[next:]) {
+					toReturn.entries = append(toReturn.entries, cpioEntry{
+						data: content[offset:next],
+					})
+					offset = next
+					continue
+				}
+			}
+			toReturn.trailingData = content[offset:]
+			break
+		}
+		if (offset + cpioHeaderSize) > len(content) {
+			return nil, fmt.Errorf("Truncated header at offset %d", offset)
+		}
+		entry = cpioEntry{magic: string(content[offset : offset+6])}
+		for i := range entry.fields {
+			start := offset + 6 + i*8
+			value, e = strconv.ParseUint(string(content[start:start+8]), 16,
+				32)
+			if e != nil {
+				return nil, fmt.Errorf("Invalid header at offset %d: %s",
+					offset, e)
+			}
+			entry.fields[i] = uint32(value)
+		}
+		nameStart := offset + cpioHeaderSize
+		nameSize := int(entry.fields[cpioNameSizeField])
+		dataStart := nameStart + nameSize
+		dataStart += cpioPadding(dataStart)
+		dataEnd := dataStart + int(entry.fields[cpioFileSizeField])
+		if (nameSize == 0) || (dataEnd > len(content)) {
+			return nil, fmt.Errorf("Truncated entry at offset %d", offset)
+		}
+		entry.name = string(bytes.TrimRight(
+			content[nameStart:nameStart+nameSize], "\x00"))
+		entry.data = content[dataStart:dataEnd]
+		toReturn.entries = append(toReturn.entries, entry)
+		offset = dataEnd + cpioPadding(dataEnd)
+		if offset > len(content) {
+			offset = len(content)
+		}
+	}
+	return toReturn, nil
+}
+
+// Returns the uncompressed content of the archive, with each entry's size
+// (and checksum, if needed) updated to match its data.
+func (a *cpioArchive) encode() []byte {
+	var output bytes.Buffer
+	var sum uint32
+	for i := range a.entries {
+		entry := &(a.entries[i])
+		if entry.magic == "" {
+			// This holds the padding between archives.
+			output.Write(entry.data)
+			continue
+		}
+		entry.fields[cpioFileSizeField] = uint32(len(entry.data))
+		entry.fields[cpioNameSizeField] = uint32(len(entry.name) + 1)
+		if entry.magic == "070702" {
+			sum = 0
+			for _, b := range entry.data {
+				sum += uint32(b)
+			}
+			entry.fields[cpioCheckField] = sum
+		}
+		output.WriteString(entry.magic)
+		for _, v := range entry.fields {
+			fmt.Fprintf(&output, "%08X", v)
+		}
+		output.WriteString(entry.name)
+		output.WriteByte(0)
+		output.Write(make([]byte, cpioPadding(output.Len())))
+		output.Write(entry.data)
+		output.Write(make([]byte, cpioPadding(output.Len())))
+	}
+	output.Write(a.trailingData)
+	return output.Bytes()
+}
+
+// Returns the archive's content, compressed using its original format.
+func (a *cpioArchive) compress() ([]byte, error) {
+	content := a.encode()
+	switch a.compression {
+	case cpioGzip:
+		var output bytes.Buffer
+		writer := gzip.NewWriter(&output)
+		_, e := writer.Write(content)
+		if e == nil {
+			e = writer.Close()
+		}
+		if e != nil {
+			return nil, fmt.Errorf("Failed compressing: %s", e)
+		}
+		return output.Bytes(), nil
+	case cpioZstd:
+		return runZstd(content, "-c", "-q", "-19")
+	}
+	return content, nil
+}
+
+// Returns true if the cpio entry is a regular file holding a 32-bit ELF file.
+func (entry *cpioEntry) isELF32File() bool {
+	// The file type bits of the mode indicate a regular file.
+	if (entry.magic == "") ||
+		((entry.fields[cpioModeField] & 0170000) != 0100000) {
+		return false
+	}
+	return bytes.HasPrefix(entry.data, []byte("\x7fELF\x01"))
+}
+
+// Patches every 32-bit ELF file in the given (possibly compressed) cpio
+// archive, and writes the rebuilt archive, using the same compression, to
+// outputPath. No output is written if outputPath is empty.
+func processCPIOArchive(inputPath, outputPath string, content []byte,
+	compression string, settings *fileSettings) error {
+	archive, e := parseCPIOArchive(content)
+	if e != nil {
+		return fmt.Errorf("Failed parsing cpio archive: %s", e)
+	}
+	archive.compression = compression
+	patched := 0
+	var elf *elf_reader.ELF32File
+	var original []byte
+	for i := range archive.entries {
+		entry := &(archive.entries[i])
+		if !entry.isELF32File() {
+			continue
+		}
+		log.Printf("Processing %s in %s.\n", entry.name, inputPath)
+		settings.events.setFile(inputPath + ":" + entry.name)
+		// Parse a copy, so the original data is still available for the
+		// listing.
+		original = entry.data
+		parseStart := time.Now()
+		elf, e = stringreplace.ParseELF32File(append([]byte(nil),
+			entry.data...))
+		if e != nil {
+			log.Printf("Skipping %s: %s\n", entry.name, e)
+			continue
+		}
+		parseTime := time.Since(parseStart)
+		report, e := stringreplace.ReplaceStrings(elf, &settings.options)
+		if e != nil {
+			return fmt.Errorf("Failed patching %s: %s", entry.name, e)
+		}
+		e = settings.maxGrowth.check(entry.name, len(original), len(elf.Raw))
+		if e != nil {
+			return e
+		}
+		addParseTiming(report, parseTime)
+		logPhaseTimings(settings, report)
+		if settings.showDiff {
+			writeReplacementDiff(os.Stdout, entry.name, report)
+		}
+		if settings.options.Explain {
+			writeRuleExplanations(os.Stdout, entry.name,
+				settings.options.Rules, report)
+		}
+		if settings.showListing {
+			originalELF, e := stringreplace.ParseELF32File(original)
+			if e != nil {
+				return fmt.Errorf("Error parsing original file for "+
+					"listing: %s", e)
+			}
+			writeChangeListing(os.Stdout, originalELF, elf)
+		}
+		if settings.dryRun {
+			writeReferencePreview(os.Stdout, entry.name, original, elf.Raw, 0,
+				report)
+			writeReplacementContext(os.Stdout, entry.name, original, report,
+				settings.dryRunContext)
+		}
+		entry.data = elf.Raw
+		patched++
+	}
+	log.Printf("Patched %d ELF files in %s.\n", patched, inputPath)
+	if outputPath == "" {
+		return nil
+	}
+	output, e := archive.compress()
+	if e != nil {
+		return fmt.Errorf("Failed rebuilding cpio archive: %s", e)
+	}
+	e = writeOutputFile(outputPath, output, 0644, nil,
+		settings.syncOutput)
+	if e != nil {
+		return fmt.Errorf("Error creating output file: %s", e)
+	}
+	return nil
+}
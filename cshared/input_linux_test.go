@@ -0,0 +1,32 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+func TestInputBytesLargeLength(t *testing.T) {
+	// Reserve more than 2 GiB without committing any memory, since only the
+	// first and last bytes are touched.
+	length := 3 << 30
+	mapped, e := syscall.Mmap(-1, 0, length, syscall.PROT_READ|
+		syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANON|
+		syscall.MAP_NORESERVE)
+	if e != nil {
+		t.Skipf("Failed mapping %d bytes: %s", length, e)
+	}
+	defer syscall.Munmap(mapped)
+	mapped[0] = 0x7f
+	mapped[length-1] = 0xff
+	input, e := inputBytes(unsafe.Pointer(&(mapped[0])), uint64(length))
+	if e != nil {
+		t.Fatalf("Failed getting the input bytes: %s", e)
+	}
+	if len(input) != length {
+		t.Fatalf("Expected %d input bytes, got %d", length, len(input))
+	}
+	if (input[0] != 0x7f) || (input[length-1] != 0xff) {
+		t.Errorf("The input doesn't refer to the original buffer")
+	}
+}
@@ -0,0 +1,89 @@
+// This package exports a C API for the string replacement library, so that it
+// can be called in-process from C, C++, Python (via ctypes), and so on. It
+// must be built as a shared library, which "go generate" does in this
+// directory by running:
+//
+//	go build -buildmode=c-shared -o libelf32_string_replace.so
+//
+// This also produces libelf32_string_replace.h, declaring the exported
+// functions.
+package main
+
+//go:generate go build -buildmode=c-shared -o libelf32_string_replace.so
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"fmt"
+	"github.com/yalue/elf32_string_replace/stringreplace"
+	"math"
+	"unsafe"
+)
+
+// Sets *errorMessage to a newly allocated copy of the error string, if
+// errorMessage isn't NULL. Always returns 1, for convenience.
+func setError(errorMessage **C.char, e error) C.int {
+	if errorMessage != nil {
+		*errorMessage = C.CString(e.Error())
+	}
+	return 1
+}
+
+// Returns a slice referring to the length bytes at data, without copying
+// them. Returns an error if the length doesn't fit in an int.
+func inputBytes(data unsafe.Pointer, length uint64) ([]byte, error) {
+	if length > math.MaxInt {
+		return nil, fmt.Errorf("The input's length (%d bytes) is too large",
+			length)
+	}
+	return unsafe.Slice((*byte)(data), int(length)), nil
+}
+
+// Replaces strings in the 32- or 64-bit ELF file of length dataLength pointed
+// to by data, using the JSON array of rules in rulesJSON. On success, returns
+// 0 and sets *out and *outLength to a newly allocated buffer containing the
+// modified file. On failure, returns nonzero and sets *errorMessage (if
+// errorMessage is not NULL) to a newly allocated error string. Buffers
+// returned by this function must be freed using elf32_replace_free.
+//
+//export elf32_replace
+func elf32_replace(data *C.uchar, dataLength C.size_t, rulesJSON *C.char,
+	out **C.uchar, outLength *C.size_t, errorMessage **C.char) C.int {
+	if (data == nil) || (rulesJSON == nil) || (out == nil) ||
+		(outLength == nil) {
+		return setError(errorMessage, fmt.Errorf("Got a NULL argument"))
+	}
+	// Replace copies the input rather than modifying or keeping it, so the
+	// caller's buffer can be used directly.
+	input, e := inputBytes(unsafe.Pointer(data), uint64(dataLength))
+	if e != nil {
+		return setError(errorMessage, e)
+	}
+	rules, e := stringreplace.ParseJSONRules([]byte(C.GoString(rulesJSON)))
+	if e != nil {
+		return setError(errorMessage, e)
+	}
+	output, _, e := stringreplace.Replace(input, stringreplace.Options{
+		Rules: rules,
+	})
+	if e != nil {
+		return setError(errorMessage, e)
+	}
+	*out = (*C.uchar)(C.CBytes(output))
+	*outLength = C.size_t(len(output))
+	return 0
+}
+
+// Frees a buffer or error string returned by elf32_replace.
+//
+//export elf32_replace_free
+func elf32_replace_free(p unsafe.Pointer) {
+	C.free(p)
+}
+
+// This is required by the c-shared build mode, but is never called.
+func main() {
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// Calls the library with input that isn't an ELF file and with invalid
+// rules, checking that each call fails with an error message.
+const sharedLibraryTestProgram = `#include <stdio.h>
+#include <string.h>
+#include "libelf32_string_replace.h"
+
+static int ExpectError(const char *input, const char *rules) {
+  unsigned char *out = NULL;
+  size_t out_length = 0;
+  char *error_message = NULL;
+  int result = elf32_replace((unsigned char *) input, strlen(input),
+    (char *) rules, &out, &out_length, &error_message);
+  if (result == 0) {
+    printf("Expected an error for rules %s\n", rules);
+    elf32_replace_free(out);
+    return 0;
+  }
+  if (!error_message) {
+    printf("Didn't get an error message for rules %s\n", rules);
+    return 0;
+  }
+  printf("Got expected error: %s\n", error_message);
+  elf32_replace_free(error_message);
+  return 1;
+}
+
+int main(void) {
+  if (!ExpectError("not an ELF file", "[]")) return 1;
+  if (!ExpectError("not an ELF file", "not JSON")) return 1;
+  return 0;
+}
+`
+
+func TestSharedLibrary(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Building the shared library takes a while")
+	}
+	compiler, e := exec.LookPath("cc")
+	if e != nil {
+		t.Skip("No C compiler is available")
+	}
+	directory := t.TempDir()
+	// This is the go:generate command, writing to the temporary directory.
+	build := exec.Command("go", "build", "-buildmode=c-shared", "-o",
+		filepath.Join(directory, "libelf32_string_replace.so"))
+	output, e := build.CombinedOutput()
+	if e != nil {
+		t.Fatalf("Failed building the shared library: %s\n%s", e, output)
+	}
+	source := filepath.Join(directory, "test.c")
+	e = ioutil.WriteFile(source, []byte(sharedLibraryTestProgram), 0644)
+	if e != nil {
+		t.Fatalf("Failed writing %s: %s", source, e)
+	}
+	program := filepath.Join(directory, "test")
+	compile := exec.Command(compiler, "-o", program, source,
+		"-I"+directory, "-L"+directory, "-lelf32_string_replace",
+		"-Wl,-rpath,"+directory)
+	output, e = compile.CombinedOutput()
+	if e != nil {
+		t.Fatalf("Failed compiling the test program: %s\n%s", e, output)
+	}
+	output, e = exec.Command(program).CombinedOutput()
+	if e != nil {
+		t.Fatalf("The test program failed: %s\n%s", e, output)
+	}
+}
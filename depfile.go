@@ -0,0 +1,82 @@
+package main
+
+// This file implements the -depfile flag, which writes a Make-style
+// dependency file so that build systems such as Make and Ninja re-run the
+// patch step exactly when one of its inputs changes.
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/yalue/elf32_string_replace/stringreplace"
+	"github.com/yalue/elf_reader"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The directories, relative to the sysroot, searched for the libraries named
+// by the input's DT_NEEDED entries.
+var depfileLibraryDirectories = []string{"lib", "usr/lib", "lib32",
+	"usr/lib32"}
+
+// Returns the path escaped for use in a Make rule, which Ninja also accepts.
+func escapeDepfilePath(path string) string {
+	path = strings.Replace(path, "\\", "\\\\", -1)
+	path = strings.Replace(path, " ", "\\ ", -1)
+	path = strings.Replace(path, "#", "\\#", -1)
+	return strings.Replace(path, "$", "$$", -1)
+}
+
+// Returns the paths to the libraries under the sysroot named by the ELF
+// file's DT_NEEDED entries. Libraries that can't be found are ignored, since
+// the patch step doesn't read them.
+func findSysrootLibraries(f *elf_reader.ELF32File,
+	sysroot string) ([]string, error) {
+	names, e := readNeededNames(f)
+	if e != nil {
+		return nil, e
+	}
+	toReturn := make([]string, 0, len(names))
+	for _, name := range names {
+		for _, directory := range depfileLibraryDirectories {
+			path := filepath.Join(sysroot, directory, name)
+			if strings.Contains(name, "/") {
+				path = filepath.Join(sysroot, name)
+			}
+			_, e = os.Stat(path)
+			if e == nil {
+				toReturn = append(toReturn, path)
+				break
+			}
+		}
+	}
+	return toReturn, nil
+}
+
+// Writes a depfile to the given path, listing the input file, the other given
+// files it was patched using (such as the configuration file), and the
+// libraries it depends on under the sysroot (if it isn't empty) as
+// dependencies of the output file.
+func writeDepfile(path, outputPath, inputPath string, rawInput []byte,
+	others []string, sysroot string) error {
+	dependencies := append([]string{inputPath}, others...)
+	if sysroot != "" {
+		f, e := stringreplace.ParseELF32File(rawInput)
+		if e != nil {
+			return fmt.Errorf("Failed parsing input file: %s", e)
+		}
+		libraries, e := findSysrootLibraries(f, sysroot)
+		if e != nil {
+			return fmt.Errorf("Failed finding sysroot libraries: %s", e)
+		}
+		dependencies = append(dependencies, libraries...)
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s:", escapeDepfilePath(outputPath))
+	for _, d := range dependencies {
+		fmt.Fprintf(&b, " \\\n  %s", escapeDepfilePath(d))
+	}
+	fmt.Fprintf(&b, "\n")
+	return ioutil.WriteFile(path, b.Bytes(), 0644)
+}
@@ -0,0 +1,80 @@
+package main
+
+// This file contains code for printing a colored, diff-style summary of the
+// replacements made in a file, which is easier to read interactively than
+// the log output.
+
+import (
+	"fmt"
+	"github.com/yalue/elf32_string_replace/stringreplace"
+	"io"
+	"os"
+)
+
+// ANSI escape sequences used by the diff output.
+const (
+	colorRed   = "\x1b[31m"
+	colorGreen = "\x1b[32m"
+	colorBold  = "\x1b[1m"
+	colorReset = "\x1b[0m"
+)
+
+// Returns true if f refers to a terminal.
+func isTerminal(f *os.File) bool {
+	info, e := f.Stat()
+	if e != nil {
+		return false
+	}
+	return (info.Mode() & os.ModeCharDevice) != 0
+}
+
+// Returns whether the diff should be shown for the given -color setting:
+// "auto" (only if stdout is a terminal), "always", or "never".
+func parseColorSetting(setting string) (bool, error) {
+	switch setting {
+	case "auto":
+		return isTerminal(os.Stdout), nil
+	case "always":
+		return true, nil
+	case "never":
+		return false, nil
+	}
+	return false, fmt.Errorf("Invalid -color setting: %s", setting)
+}
+
+// Writes the replacements in the report to w, in a format resembling a
+// unified diff: each table gets a header, followed by the old (red) and new
+// (green) value of each replaced string, with the offsets of the references
+// updated to point to it indented below.
+func writeReplacementDiff(w io.Writer, name string,
+	report *stringreplace.Report) {
+	// Group the references by the string they point to.
+	type stringKey struct {
+		section uint16
+		offset  uint32
+	}
+	references := make(map[stringKey][]uint32)
+	var key stringKey
+	for _, r := range report.References {
+		key = stringKey{r.SectionIndex, r.OriginalValue}
+		references[key] = append(references[key], r.FileOffset)
+	}
+	fmt.Fprintf(w, "%sdiff %s%s\n", colorBold, name, colorReset)
+	for _, t := range report.Tables {
+		fmt.Fprintf(w, "%s--- %s (section %d, offset 0x%08x)%s\n", colorBold,
+			t.Name, t.SectionIndex, t.OriginalOffset, colorReset)
+		fmt.Fprintf(w, "%s+++ %s (section %d, offset 0x%08x)%s\n", colorBold,
+			t.Name, t.SectionIndex, t.NewOffset, colorReset)
+		for _, r := range report.Replacements {
+			if r.SectionIndex != t.SectionIndex {
+				continue
+			}
+			fmt.Fprintf(w, "%s-%s%s\n", colorRed, r.Original, colorReset)
+			fmt.Fprintf(w, "%s+%s%s\n", colorGreen, r.New, colorReset)
+			key = stringKey{r.SectionIndex, r.OriginalOffset}
+			for _, offset := range references[key] {
+				fmt.Fprintf(w, "    referenced at 0x%08x\n", offset)
+			}
+		}
+	}
+}
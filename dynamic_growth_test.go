@@ -0,0 +1,219 @@
+package main
+
+import (
+	"github.com/yalue/elf32_string_replace/stringreplace"
+	"github.com/yalue/elf_reader"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// Returns the file's dynamic table entries, and its PT_DYNAMIC segment.
+func dynamicEntries(t *testing.T, f *elf_reader.ELF32File) (
+	[]elf_reader.ELF32DynamicEntry, *elf_reader.ELF32ProgramHeader) {
+	var segment *elf_reader.ELF32ProgramHeader
+	for i := range f.Segments {
+		if f.Segments[i].Type == elf_reader.DynamicLinkingSegment {
+			segment = &(f.Segments[i])
+		}
+	}
+	if segment == nil {
+		t.Fatalf("The file has no PT_DYNAMIC segment")
+	}
+	entries, e := f.GetDynamicTable(sectionNamed(t, f, ".dynamic"))
+	if e != nil {
+		t.Fatalf("Failed reading the dynamic table: %s", e)
+	}
+	return entries, segment
+}
+
+// Returns the tags of the entries before the first DT_NULL entry.
+func tagsBeforeNull(entries []elf_reader.ELF32DynamicEntry) []uint32 {
+	var tags []uint32
+	for _, entry := range entries {
+		if entry.Tag == 0 {
+			break
+		}
+		tags = append(tags, uint32(entry.Tag))
+	}
+	return tags
+}
+
+func TestAddDynamicEntriesRelocatesTable(t *testing.T) {
+	input := corpusInput(t, "shared_le.so")
+	original := parseTestELF(t, input)
+	originalEntries, originalSegment := dynamicEntries(t, original)
+	output, report, e := stringreplace.Replace(input, stringreplace.Options{
+		// The file already depends on libc.so.6.
+		AddNeeded:  []string{"libm.so.6", "libc.so.6"},
+		AddRunPath: "/opt/corpus/lib",
+	})
+	if e != nil {
+		t.Fatalf("Failed adding dynamic entries: %s", e)
+	}
+	f := parseTestELF(t, output)
+	entries, segment := dynamicEntries(t, f)
+	// The table ends with a single DT_NULL, so it has no room for the new
+	// entries and must be moved to a new writable segment.
+	if segment.VirtualAddress == originalSegment.VirtualAddress {
+		t.Fatalf("The dynamic table wasn't moved")
+	}
+	writable := false
+	for _, s := range f.Segments {
+		if (s.Type == elf_reader.LoadableSegment) &&
+			(s.VirtualAddress <= segment.VirtualAddress) &&
+			((s.VirtualAddress + s.MemorySize) >=
+				(segment.VirtualAddress + segment.MemorySize)) {
+			// PF_W is 2.
+			writable = (s.Flags & 2) != 0
+		}
+	}
+	if !writable {
+		t.Errorf("The moved dynamic table isn't in a writable PT_LOAD " +
+			"segment")
+	}
+	index := sectionNamed(t, f, ".dynamic")
+	if f.Sections[index].VirtualAddress != segment.VirtualAddress {
+		t.Errorf("The .dynamic section header wasn't pointed at the new " +
+			"table")
+	}
+	if len(entries) != (len(originalEntries) + 2) {
+		t.Fatalf("Expected %d dynamic entries, got %d",
+			len(originalEntries)+2, len(entries))
+	}
+	if entries[len(entries)-1].Tag != 0 {
+		t.Errorf("The dynamic table doesn't end with DT_NULL")
+	}
+	// Every original entry is kept, in order, with DT_NEEDED entries
+	// grouped together.
+	var expected []uint32
+	for _, tag := range tagsBeforeNull(originalEntries) {
+		expected = append(expected, tag)
+		if tag == 1 {
+			expected = append(expected, 1)
+		}
+	}
+	expected = append(expected, dtRunpath)
+	if tags := tagsBeforeNull(entries); !reflect.DeepEqual(tags,
+		expected) {
+		t.Errorf("Expected dynamic tags %v, got %v", expected, tags)
+	}
+	needed, e := readNeededNames(f)
+	if e != nil {
+		t.Fatalf("Failed reading the dependencies: %s", e)
+	}
+	if !reflect.DeepEqual(needed, []string{"libc.so.6", "libm.so.6"}) {
+		t.Errorf("Expected libm.so.6 to be added once, after libc.so.6, "+
+			"got %q", needed)
+	}
+	if s := dynamicString(t, f, dtRunpath); s != "/opt/corpus/lib" {
+		t.Errorf("Expected a DT_RUNPATH of /opt/corpus/lib, got %q", s)
+	}
+	if len(report.DynamicEntries) != 2 {
+		t.Fatalf("Expected 2 added entries in the report, got %d",
+			len(report.DynamicEntries))
+	}
+	for _, added := range report.DynamicEntries {
+		if uint32(entries[added.Index].Tag) != added.Tag {
+			t.Errorf("The report lists a %s entry at index %d, which has "+
+				"tag %d", added.TagName, added.Index,
+				entries[added.Index].Tag)
+		}
+	}
+
+	// A rule can replace the string of the added DT_RUNPATH entry.
+	output, _, e = stringreplace.Replace(output, stringreplace.Options{
+		Rules: []stringreplace.Rule{{
+			Match:       regexp.MustCompile(`^/opt/corpus/lib$`),
+			Replacement: "/usr/local/lib/corpus",
+		}},
+	})
+	if e != nil {
+		t.Fatalf("Failed replacing the added DT_RUNPATH: %s", e)
+	}
+	s := dynamicString(t, parseTestELF(t, output), dtRunpath)
+	if s != "/usr/local/lib/corpus" {
+		t.Errorf("Expected the DT_RUNPATH to be replaced, got %q", s)
+	}
+}
+
+func TestAddDynamicEntriesInPlace(t *testing.T) {
+	// Remove the DT_SONAME entry, leaving a spare DT_NULL entry at the end of
+	// the dynamic table.
+	input := corpusInput(t, "shared_le.so")
+	f := parseTestELF(t, input)
+	entries, originalSegment := dynamicEntries(t, f)
+	var spare []elf_reader.ELF32DynamicEntry
+	for _, entry := range entries {
+		if entry.Tag != dtSoname {
+			spare = append(spare, entry)
+		}
+	}
+	spare = append(spare, elf_reader.ELF32DynamicEntry{})
+	offset := f.Sections[sectionNamed(t, f, ".dynamic")].FileOffset
+	for i, entry := range spare {
+		f.Endianness.PutUint32(input[offset+uint32(8*i):], uint32(entry.Tag))
+		f.Endianness.PutUint32(input[offset+uint32(8*i)+4:], entry.Value)
+	}
+	output, report, e := stringreplace.Replace(input, stringreplace.Options{
+		AddSoname: "libcorpus_added.so.1",
+	})
+	if e != nil {
+		t.Fatalf("Failed adding a DT_SONAME entry: %s", e)
+	}
+	f = parseTestELF(t, output)
+	entries, segment := dynamicEntries(t, f)
+	if segment.VirtualAddress != originalSegment.VirtualAddress {
+		t.Errorf("The dynamic table was moved, despite having a spare " +
+			"DT_NULL entry")
+	}
+	if len(entries) != len(spare) {
+		t.Errorf("Expected the dynamic table to keep its %d entries, got %d",
+			len(spare), len(entries))
+	}
+	if s := dynamicString(t, f, dtSoname); s != "libcorpus_added.so.1" {
+		t.Errorf("Expected a DT_SONAME of libcorpus_added.so.1, got %q", s)
+	}
+	if len(report.NewSegments) != 1 {
+		t.Errorf("Expected only the relocated string table's segment to be "+
+			"added, got %d segments", len(report.NewSegments))
+	}
+}
+
+func TestAddDynamicEntriesExisting(t *testing.T) {
+	input := corpusInput(t, "shared_le.so")
+	// The file already has this SONAME, so nothing needs to be added.
+	output, report, e := stringreplace.Replace(input, stringreplace.Options{
+		AddSoname: "libcorpus.so.1",
+		AddNeeded: []string{"libc.so.6"},
+	})
+	if e != nil {
+		t.Fatalf("Failed adding existing dynamic entries: %s", e)
+	}
+	if len(report.DynamicEntries) != 0 {
+		t.Errorf("Expected no entries to be added, got %d",
+			len(report.DynamicEntries))
+	}
+	if s := dynamicString(t, parseTestELF(t, output), dtSoname); s !=
+		"libcorpus.so.1" {
+		t.Errorf("Expected the SONAME to be unchanged, got %q", s)
+	}
+	_, _, e = stringreplace.Replace(input, stringreplace.Options{
+		AddSoname: "libcorpus_other.so.1",
+	})
+	if e == nil {
+		t.Fatalf("Didn't get an error adding a second DT_SONAME")
+	}
+	if !strings.Contains(e.Error(), "already has a DT_SONAME") {
+		t.Errorf("Got an unexpected error adding a second DT_SONAME: %s", e)
+	}
+	_, _, e = stringreplace.Replace(corpusInput(t, "static_exec"),
+		stringreplace.Options{
+			AddNeeded: []string{"libm.so.6"},
+		})
+	if e == nil {
+		t.Errorf("Didn't get an error adding a dependency to a static " +
+			"executable")
+	}
+}
@@ -4,633 +4,1294 @@
 // not work for other strings.
 //
 // Usage:
-//    ./elf32_string_replace -file /bin/bash -output ./bash_modified \
+//    ./elf32_string_replace patch -file /bin/bash -output ./bash_modified \
 //        -to_match "libc.so.6" -replace "libc_alternative.so.6"
+//
+// The patch subcommand's flags may also be given without the subcommand, as
+// in earlier versions. This is deprecated, but still supported.
+//
+// To process several files or directory trees, mirroring them under an output
+// directory:
+//    ./elf32_string_replace patch -output_dir ./patched \
+//        -to_match "libc.so.6" -replace "libc_alternative.so.6" \
+//        /usr/lib /bin/bash
+//
+// To patch ELF files as a build writes them to a staging directory:
+//    ./elf32_string_replace patch -watch ./staging -watch_filter '\.so' \
+//        -to_match "libc.so.6" -replace "libc_alternative.so.6"
+//
+// To list printable strings in all sections without modifying anything:
+//    ./elf32_string_replace strings -file /bin/bash -to_match "libc"
+//
+// To undo a patch, using the report saved with -report when patching:
+//    ./elf32_string_replace revert -file ./bash_modified -report report.json \
+//        -output ./bash_restored
+//
+// To accept replacement requests over HTTP:
+//    ./elf32_string_replace serve -listen unix:/tmp/elf32_string_replace.sock
 package main
 
 import (
-	"bytes"
 	"encoding/binary"
 	"flag"
 	"fmt"
+	"github.com/yalue/elf32_string_replace/stringreplace"
 	"github.com/yalue/elf_reader"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 )
 
-// This tracks each string that was replaced, including old and new offsets
-// into the string table.
-type replacedString struct {
-	originalOffset uint32
-	newOffset      uint32
+// Holds the settings used when processing each input file.
+type fileSettings struct {
+	options           stringreplace.Options
+	patchScript       string
+	patchScriptFormat string
+	showListing       bool
+	// If true, nothing is written, and each reference that would be
+	// rewritten is printed instead.
+	dryRun bool
+	// The number of neighboring strings to print around each replacement in
+	// a dry run.
+	dryRunContext int
+	// If non-empty, the JSON report for the patched file is written to this
+	// path.
+	reportPath string
+	// If non-nil, each file's result is added to this combined report when
+	// processing a batch of files.
+	batchReport *batchReport
+	// If non-empty, the GNU ld map file to update with the new names, and the
+	// path to write the updated map to.
+	mapFile   string
+	mapOutput string
+	// If non-empty, the path to which to write a plan for making renamed
+	// dependencies available under their new names, and the plan's format.
+	shimPlan       string
+	shimPlanFormat string
+	// If non-empty, the path to which to write a depfile listing the files
+	// the output depends on: the input, the files in depfileInputs, and the
+	// libraries it needs under depfileSysroot, if that's set.
+	depfile        string
+	depfileInputs  []string
+	depfileSysroot string
+	// If true, output files and their directories are flushed to storage
+	// after they're renamed into place.
+	syncOutput bool
+	// If non-empty, the input is a larger image containing an ELF file at
+	// this offset, or "auto" to search for it, or "all" to patch every ELF
+	// file in it.
+	embeddedOffset string
+	// Checksums in the surrounding image to update after patching embedded
+	// ELF files, and a command to run on the output afterwards.
+	checksums       checksumFlag
+	checksumCommand string
+	// If true, log the time taken by each phase of patching each file.
+	showTimings bool
+	// If true, print a colored diff of the replacements in each file.
+	showDiff bool
+	// If non-nil, receives the events from patching each file.
+	events *eventWriter
+	// Patching fails if a file would grow by more than this.
+	maxGrowth growthLimit
+	// If non-empty, the external tool (readelf or objdump) used to check
+	// each patched ELF file.
+	validateWith string
+	// If true, a metadata bundle is written alongside each output file. See
+	// patchmeta.go.
+	patchMeta bool
+	// If non-nil, a copy of each file patched in place is saved here before
+	// it's patched.
+	backups *backupStore
+	// The format in which patched ELF files are written: outputFormatFile,
+	// or an archive holding the patched file.
+	outputFormat string
+}
+
+// Logs the time taken by each phase of patching a file, if enabled in the
+// settings.
+func logPhaseTimings(settings *fileSettings, report *stringreplace.Report) {
+	if !settings.showTimings {
+		return
+	}
+	var total time.Duration
+	log.Printf("Phase timings:\n")
+	for _, t := range report.Timings {
+		log.Printf("  %-22s %s\n", t.Phase, t.Duration)
+		total += t.Duration
+	}
+	log.Printf("  %-22s %s\n", "total", total)
 }
 
-// This tracks each updated string table.
-type replacedStringTable struct {
-	oldContent        []byte
-	newContent        []byte
-	oldFileOffset     uint32
-	newFileOffset     uint32
-	oldVirtualAddress uint32
-	newVirtualAddress uint32
-	sectionIndex      uint16
-	replacements      []replacedString
+// Adds the time taken to parse the ELF file to the start of the report's
+// timings, for files patched using ReplaceStrings rather than Replace.
+func addParseTiming(report *stringreplace.Report, parseTime time.Duration) {
+	report.Timings = append([]stringreplace.PhaseTiming{
+		{Phase: "parse", Duration: parseTime},
+	}, report.Timings...)
 }
 
-// Returns a string representation of the replacedString value at
-// replacements[i]. This is mostly for logging/debugging, so the string values
-// may be incorrect if the index or replacedStringTable structure contains any
-// errors.
-func (r *replacedStringTable) showReplacement(replacementIndex int) string {
-	if replacementIndex > len(r.replacements) {
-		return fmt.Sprintf("Invalid replacedString index %d", replacementIndex)
-	}
-	originalOffset := r.replacements[replacementIndex].originalOffset
-	newOffset := r.replacements[replacementIndex].newOffset
-	tmp, e := elf_reader.ReadStringAtOffset(originalOffset, r.oldContent)
-	var originalString, newString string
-	if e != nil {
-		originalString = fmt.Sprintf("<error reading: %s>", e)
-	} else {
-		originalString = string(tmp)
+// Returns true if the ELF file's type, in its header, is ET_CORE.
+func isCoreDump(raw []byte) bool {
+	if len(raw) < 18 {
+		return false
 	}
-	tmp, e = elf_reader.ReadStringAtOffset(newOffset, r.newContent)
-	if e != nil {
-		newString = fmt.Sprintf("<error reading: %s>", e)
-	} else {
-		newString = string(tmp)
+	// EI_DATA is 2 for big-endian files.
+	if raw[5] == 2 {
+		return binary.BigEndian.Uint16(raw[16:]) == 4
 	}
-	return fmt.Sprintf("%s -> %s", originalString, newString)
+	return binary.LittleEndian.Uint16(raw[16:]) == 4
 }
 
-// Fills in the replacements and newContent slices in the replacedStringTable
-// structure. The oldContent field must already be set before calling this. If
-// no strings are replaced, the replacements and newContent fields will be set
-// to nil, but no error will be returned. Otherwise, newContent will be set to
-// a newly allocated string table with the replaced values, and replacements
-// will contain the replaced string offsets.
-func (t *replacedStringTable) doReplacements(regex *regexp.Regexp,
-	replacement string) error {
-	replacements := make([]replacedString, 0, 4)
-	sectionStrings := strings.Split(string(t.oldContent), "\x00")
-	var currentOldOffset uint32
-	var newString string
-	var replacementOffsets replacedString
-	newContent := make([]byte, len(t.oldContent))
-	copy(newContent, t.oldContent)
-	tableChanged := false
-	for _, oldString := range sectionStrings {
-		newString = regex.ReplaceAllString(oldString, replacement)
-		replacementOffsets.originalOffset = currentOldOffset
-		currentOldOffset += uint32(len(oldString)) + 1
-		if oldString == newString {
-			continue
+// Patches the ELF image at the given offset in blob, without changing its
+// size, and copies the result back into blob.
+func patchEmbeddedImage(blob []byte, offset int, settings *fileSettings) error {
+	parseStart := time.Now()
+	elf, e := stringreplace.ExtractEmbeddedELF(blob, offset)
+	if e != nil {
+		return e
+	}
+	parseTime := time.Since(parseStart)
+	var original []byte
+	if settings.showListing || settings.dryRun {
+		original = make([]byte, len(elf.Raw))
+		copy(original, elf.Raw)
+	}
+	// The surrounding image can't be changed, so neither can the size of the
+	// ELF file.
+	options := settings.options
+	options.SameSize = true
+	report, e := stringreplace.ReplaceStrings(elf, &options)
+	if e != nil {
+		return e
+	}
+	addParseTiming(report, parseTime)
+	logPhaseTimings(settings, report)
+	if settings.showDiff {
+		writeReplacementDiff(os.Stdout, fmt.Sprintf("ELF image at offset "+
+			"0x%x", offset), report)
+	}
+	if options.Explain {
+		writeRuleExplanations(os.Stdout, fmt.Sprintf("ELF image at offset "+
+			"0x%x", offset), options.Rules, report)
+	}
+	if settings.showListing {
+		originalELF, e := stringreplace.ParseELF32File(original)
+		if e != nil {
+			return fmt.Errorf("Error parsing original file for listing: %s", e)
 		}
-		// New strings will be appended to the end of the table.
-		replacementOffsets.newOffset = uint32(len(newContent))
-		tableChanged = true
-		replacements = append(replacements, replacementOffsets)
-		newContent = append(newContent, []byte(newString)...)
-		newContent = append(newContent, 0x00)
+		writeChangeListing(os.Stdout, originalELF, elf)
 	}
-	if !tableChanged {
-		return nil
+	if settings.dryRun {
+		writeReferencePreview(os.Stdout, fmt.Sprintf("ELF image at offset "+
+			"0x%x", offset), original, elf.Raw, offset, report)
+		writeReplacementContext(os.Stdout, fmt.Sprintf("ELF image at "+
+			"offset 0x%x", offset), original, report, settings.dryRunContext)
 	}
-	t.newContent = newContent
-	t.replacements = replacements
+	copy(blob[offset:], elf.Raw)
 	return nil
 }
 
-// Creates the list of string tables with replaced strings, and returns a slice
-// of them. May return a nil or 0-length slice if no strings were replaced.
-// Returns an error if one occurs.
-func processReplacements(f *elf_reader.ELF32File, regex *regexp.Regexp,
-	replacement string) ([]replacedStringTable, error) {
-	toReturn := make([]replacedStringTable, 0, 1)
-	var t replacedStringTable
-	var section *elf_reader.ELF32SectionHeader
-	var e error
-	var sectionName string
-	for i := range f.Sections {
-		if !f.IsStringTable(uint16(i)) {
-			continue
-		}
-		t = replacedStringTable{}
-		t.sectionIndex = uint16(i)
-		section = &(f.Sections[i])
-		t.oldFileOffset = section.FileOffset
-		t.oldVirtualAddress = section.VirtualAddress
-		t.oldContent, e = f.GetSectionContent(uint16(i))
-		if e != nil {
-			return nil, fmt.Errorf("Failed reading section %d: %s", i, e)
+// Patches the ELF files embedded in blob, which was read from inputPath (and
+// decoded from the container, if it isn't nil). The embeddedSetting is the
+// -embedded_offset value, where "all" patches every ELF file in the blob.
+// The output is only written if every image is patched successfully.
+func processEmbeddedFiles(inputPath, outputPath string, blob []byte,
+	container imageContainer, embeddedSetting string,
+	settings *fileSettings) error {
+	var offsets []int
+	if embeddedSetting == "all" {
+		offsets = stringreplace.FindAllEmbeddedELF(blob)
+		if len(offsets) == 0 {
+			return fmt.Errorf("No 32-bit ELF files found in %s", inputPath)
 		}
-		e = (&t).doReplacements(regex, replacement)
+	} else {
+		offset, e := resolveEmbeddedOffset(blob, embeddedSetting)
 		if e != nil {
-			return nil, fmt.Errorf("Failed replacing strings in sec. %d: %s",
-				i, e)
+			return e
 		}
-		// Only keep track of sections where strings were actually replaced.
-		if len(t.replacements) == 0 {
+		offsets = []int{offset}
+	}
+	failed := 0
+	var e error
+	for _, offset := range offsets {
+		log.Printf("Processing ELF image at offset 0x%x in %s.\n", offset,
+			inputPath)
+		settings.events.setFile(fmt.Sprintf("%s@0x%x", inputPath, offset))
+		e = patchEmbeddedImage(blob, offset, settings)
+		if e == nil {
 			continue
 		}
-		sectionName, e = f.GetSectionName(t.sectionIndex)
-		if e != nil {
-			log.Printf("Replaced strings in sec. %d (bad name: %s)\n", i, e)
-		} else {
-			log.Printf("Replaced strings in section %s\n", sectionName)
+		if len(offsets) == 1 {
+			return e
 		}
-		toReturn = append(toReturn, t)
+		log.Printf("Failed patching ELF image at offset 0x%x: %s\n", offset,
+			e)
+		failed++
 	}
-	return toReturn, nil
-}
-
-// Converts a given file offset to a virtual address, based on the base virtual
-// address from the given section index.
-func fileOffsetToVirtualAddress(f *elf_reader.ELF32File, sectionIndex uint16,
-	offset uint32) (uint32, error) {
-	if int(sectionIndex) > len(f.Sections) {
-		return 0, fmt.Errorf("Invalid section index: %d", sectionIndex)
-	}
-	section := &(f.Sections[sectionIndex])
-	return offset + (section.VirtualAddress - section.FileOffset), nil
-}
-
-// Returns the byte offset to the start of the section header in f.Raw.
-func getSectionHeaderOffset(f *elf_reader.ELF32File,
-	sectionIndex uint16) uint32 {
-	return f.Header.SectionHeaderOffset + uint32(sectionIndex)*
-		uint32(binary.Size(elf_reader.ELF32SectionHeader{}))
-}
-
-// Wraps elf_reader.WriteAtOffset for this particular ELF file. Remember that
-// f.ReparseData must still be called later on.
-func writeAtELFOffset(f *elf_reader.ELF32File, offset uint32,
-	toWrite interface{}) error {
-	var e error
-	f.Raw, e = elf_reader.WriteAtOffset(f.Raw, uint64(offset), f.Endianness,
-		toWrite)
-	return e
-}
-
-// Appends new string tables (containing the replacements) to the end of the
-// ELF file, relocating the original string table sections to point to the new
-// tables. Sets the newFileOffset and newVirtualAddress fields in each of the
-// replacedStringTable entries. Returns nil on success.
-func relocateStringTables(f *elf_reader.ELF32File,
-	newTables []replacedStringTable) error {
-	if len(newTables) == 0 {
-		return nil
+	if len(offsets) > 1 {
+		log.Printf("Patched %d of %d ELF images in %s.\n",
+			len(offsets)-failed, len(offsets), inputPath)
 	}
-	// Align the end of the file to 8 bytes
-	for (len(f.Raw) % 8) != 0 {
-		f.Raw = append(f.Raw, 0)
+	if failed != 0 {
+		return fmt.Errorf("Failed patching %d of %d ELF images", failed,
+			len(offsets))
 	}
-	originalEndOffset := uint32(len(f.Raw))
-	originalEndVA, e := fileOffsetToVirtualAddress(f,
-		newTables[0].sectionIndex, originalEndOffset)
-	if e != nil {
-		return fmt.Errorf("Couldn't calculate ELF file end VA: %s", e)
-	}
-	// Start by appending all of the tables to the end of the file
-	currentFileOffset := originalEndOffset
-	currentVirtualAddress := originalEndVA
-	var newContentLength uint32
-	var t *replacedStringTable
-	var section *elf_reader.ELF32SectionHeader
-	for i := range newTables {
-		t = &(newTables[i])
-		t.newFileOffset = currentFileOffset
-		t.newVirtualAddress = currentVirtualAddress
-		f.Raw = append(f.Raw, t.newContent...)
-		newContentLength = uint32(len(t.newContent))
-		currentFileOffset += newContentLength
-		currentVirtualAddress += newContentLength
-		// Update the size, virtual address, and file offset in the section
-		// header for the original string table.
-		section = &(f.Sections[t.sectionIndex])
-		section.VirtualAddress = t.newVirtualAddress
-		section.FileOffset = t.newFileOffset
-		section.Size = newContentLength
-	}
-	// Write the (potentially) modified section headers back into the ELF file
-	// content.
-	e = writeAtELFOffset(f, f.Header.SectionHeaderOffset, f.Sections)
-	if e != nil {
-		return fmt.Errorf("Error updating section headers: %s", e)
-	}
-	// Pad to 8-byte alignment again before appending the new program header
-	// segment, too. (The program header segment will overlap with the new
-	// loadable string table segment, so that it actually gets loaded.)
-	stringTableSegmentSize := currentFileOffset - originalEndOffset
-	for (len(f.Raw) % 8) != 0 {
-		f.Raw = append(f.Raw, 0)
-		currentVirtualAddress += 1
-		currentFileOffset += 1
-		stringTableSegmentSize += 1
-	}
-	// Create a new segment which will hold the updated string tables.
-	newSegment := elf_reader.ELF32ProgramHeader{
-		Type:            elf_reader.LoadableSegment,
-		FileOffset:      originalEndOffset,
-		VirtualAddress:  originalEndVA,
-		PhysicalAddress: 0,
-		FileSize:        stringTableSegmentSize,
-		MemorySize:      stringTableSegmentSize,
-		Flags:           2,
-		Align:           8,
-	}
-	f.Segments = append(f.Segments, newSegment)
-	// Update the new segment size to encompass the program header table, which
-	// we'll also append to the end of the file.
-	programHeadersSize := uint32(binary.Size(f.Segments))
-	f.Segments[len(f.Segments)-1].FileSize += programHeadersSize
-	f.Segments[len(f.Segments)-1].MemorySize += programHeadersSize
-	// Find the self-referential program header table segment, then update its
-	// VA, offset, and size, too.
-	for i := range f.Segments {
-		if f.Segments[i].Type != elf_reader.ProgramHeaderSegment {
-			continue
+	for i := range settings.checksums {
+		e = settings.checksums[i].apply(blob)
+		if e != nil {
+			return e
 		}
-		f.Segments[i].FileOffset = currentFileOffset
-		f.Segments[i].VirtualAddress = currentVirtualAddress
-		f.Segments[i].PhysicalAddress = 0
-		f.Segments[i].FileSize = programHeadersSize
-		f.Segments[i].MemorySize = programHeadersSize
-		f.Segments[i].Align = 8
-		break
 	}
-	// Write the updated program header table to the end of the file.
-	e = writeAtELFOffset(f, currentFileOffset, f.Segments)
-	if e != nil {
-		return fmt.Errorf("Error writing updated program headers: %s", e)
+	if outputPath == "" {
+		return nil
 	}
-	// Update the ELF header to point to the new program header table. The
-	// offset to the start of the table is at 28 bytes into the ELF header, and
-	// the 2-byte number of entries is 44 bytes into the header.
-	e = writeAtELFOffset(f, 28, currentFileOffset)
-	if e != nil {
-		return fmt.Errorf("Failed writing the program header table offset: %s",
-			e)
+	output := blob
+	if container != nil {
+		output, e = container.encode()
+		if e != nil {
+			return fmt.Errorf("Failed re-encoding %s file: %s",
+				container.formatName(), e)
+		}
 	}
-	programHeaderEntryCount := uint16(len(f.Segments))
-	e = writeAtELFOffset(f, 44, programHeaderEntryCount)
-	if e != nil {
-		return fmt.Errorf("Failed writing the number of program header "+
-			"entries: %s", e)
+	// The checksum command runs before the output is moved into place, so
+	// the output is discarded if it fails.
+	var check outputCheck
+	if settings.checksumCommand != "" {
+		check = func(tempPath string) error {
+			return runChecksumCommand(settings.checksumCommand, tempPath)
+		}
 	}
-	e = f.ReparseData()
+	e = writeOutputFile(outputPath, output, 0755, check, settings.syncOutput)
 	if e != nil {
-		return fmt.Errorf("Error re-parsing ELF file after appending new "+
-			"string tables: %s", e)
+		return fmt.Errorf("Error creating output file: %s", e)
 	}
 	return nil
 }
 
-// Reads a 32-bit integer at the given offset in the ELF file. Returns an error
-// if one occurs.
-func readELFUint32(f *elf_reader.ELF32File, offset uint32) (uint32, error) {
-	if (uint64(offset) + 3) > uint64(len(f.Raw)) {
-		return 0, fmt.Errorf("Invalid offset for 32-bit value: %d", offset)
-	}
-	var toReturn uint32
-	data := bytes.NewReader(f.Raw[offset:])
-	e := binary.Read(data, f.Endianness, &toReturn)
-	if e != nil {
-		return 0, fmt.Errorf("Failed reading 32-bit value: %s", e)
+// Replaces strings in the file at inputPath, and writes the result to
+// outputPath. If outputPath is empty, the replacements are carried out (e.g.
+// for the listing) but no output is written. If outputPath is the same file
+// as inputPath, it's locked while it's being patched.
+func processFile(inputPath, outputPath string, settings *fileSettings) error {
+	settings.events.setFile(inputPath)
+	// Make sure no other process patches the same file at the same time.
+	inPlace := isInPlace(inputPath, outputPath)
+	if inPlace {
+		unlock, e := lockTarget(inputPath)
+		if e != nil {
+			return e
+		}
+		defer unlock()
 	}
-	return toReturn, nil
-}
-
-// Reads a 32-bit value the given offset in f.Raw, then uses this value as an
-// offset into the replaced string table. If the string has been replaced, the
-// 32-bit value in f.Raw will be replaced with a value pointing to the new
-// string.
-func replaceSingleOffset(f *elf_reader.ELF32File, offset uint32,
-	replacedTable *replacedStringTable) error {
-	value, e := readELFUint32(f, offset)
+	rawInput, e := ioutil.ReadFile(inputPath)
 	if e != nil {
-		return e
+		return fmt.Errorf("Failed reading input file: %s", e)
 	}
-	if uint64(value) > uint64(len(replacedTable.oldContent)) {
-		return fmt.Errorf("Value at offset 0x%d in the file was invalid for "+
-			"table %d", value, replacedTable.sectionIndex)
-	}
-	// Check this condition so we can at least know if the ELF file is doing
-	// any funny business (replacing strings of this sort is ambiguous in the
-	// current framework, so it won't occur).
-	if (value != 0) && (replacedTable.oldContent[value-1] != 0) {
-		s, e := elf_reader.ReadStringAtOffset(value, replacedTable.oldContent)
+	if inPlace && (settings.backups != nil) {
+		e = settings.backups.save(inputPath, rawInput)
 		if e != nil {
-			s = []byte(fmt.Sprintf("<error reading string: %s>", e))
+			return e
 		}
-		log.Printf("WARNING: String at offset %d in section %d (%s) doesn't "+
-			"start immediately after the previous string.\n", value,
-			replacedTable.sectionIndex, s)
 	}
-	for i, r := range replacedTable.replacements {
-		if r.originalOffset != value {
-			continue
+	if stringreplace.IsMachOFile(rawInput) {
+		e = requireFileOutput(settings, "Mach-O files")
+		if e != nil {
+			return e
 		}
-		e = writeAtELFOffset(f, offset, r.newOffset)
+		return processMachOFile(inputPath, outputPath, rawInput, settings)
+	}
+	if stringreplace.IsPEFile(rawInput) {
+		e = requireFileOutput(settings, "PE files")
 		if e != nil {
-			return fmt.Errorf("Failed writing new string table offset: %s", e)
+			return e
 		}
-		log.Printf("Replaced string reference at offset 0x%08x: %s\n", offset,
-			replacedTable.showReplacement(i))
-		break
+		return processPEFile(inputPath, outputPath, rawInput, settings)
 	}
-	return nil
-}
-
-// Returns a reference to the correct replacements table for the given section
-// index, or nil if no replacements were made in the section.
-func getReplacementTable(replacements []replacedStringTable,
-	sectionIndex uint16) *replacedStringTable {
-	var toReturn *replacedStringTable
-	for i := range replacements {
-		if replacements[i].sectionIndex != sectionIndex {
-			continue
+	if stringreplace.IsELF64File(rawInput) {
+		e = requireFileOutput(settings, "64-bit ELF files")
+		if e != nil {
+			return e
 		}
-		toReturn = &(replacements[i])
-		break
+		return processELF64File(inputPath, outputPath, rawInput, settings)
 	}
-	return toReturn
-}
-
-// Replaces any section names that may have been changed
-func replaceSectionNames(f *elf_reader.ELF32File,
-	replacements []replacedStringTable) error {
-	table := getReplacementTable(replacements, f.Header.SectionNamesTable)
-	if table == nil {
-		// No strings were replaced in the section names table.
-		return nil
+	// Archives (e.g. initramfs images) may contain several files to patch.
+	archiveContent, compression, e := decompressCPIO(rawInput)
+	if e != nil {
+		return fmt.Errorf("Failed reading cpio archive: %s", e)
 	}
-	var baseOffset uint32
-	var e error
-	for i := range f.Sections {
-		baseOffset = getSectionHeaderOffset(f, uint16(i))
-		if e != nil {
-			return fmt.Errorf("Failed finding section %d header: %s", i, e)
+	if archiveContent != nil {
+		if (settings.patchScript != "") || (settings.embeddedOffset != "") ||
+			(settings.reportPath != "") || (settings.mapFile != "") ||
+			(settings.shimPlan != "") || (settings.depfile != "") ||
+			settings.patchMeta {
+			return fmt.Errorf("The -patch_script, -embedded_offset, " +
+				"-report, -map_file, -shim_plan, -depfile, and -patchmeta " +
+				"flags aren't supported for cpio archives")
 		}
-		e = replaceSingleOffset(f, baseOffset, table)
+		e = requireFileOutput(settings, "cpio archives")
 		if e != nil {
-			return fmt.Errorf("Failed replacing section %d name: %s", i, e)
+			return e
 		}
+		return processCPIOArchive(inputPath, outputPath, archiveContent,
+			compression, settings)
 	}
-	return nil
-}
-
-// Checks all symbol tables in the ELF file, and replaces the name field of
-// each symbol as necessary.
-func replaceSymbolNames(f *elf_reader.ELF32File,
-	replacements []replacedStringTable) error {
-	var e error
-	var section *elf_reader.ELF32SectionHeader
-	var table *replacedStringTable
-	var currentSymbolOffset uint32
-	symbolSize := uint32(binary.Size(&elf_reader.ELF32Symbol{}))
-	// Loop through all symbol table sections
-	for i := range f.Sections {
-		if !f.IsSymbolTable(uint16(i)) {
-			continue
-		}
-		section = &(f.Sections[i])
-		table = getReplacementTable(replacements, uint16(section.LinkedIndex))
-		if table == nil {
-			continue
+	// Container files (e.g. Intel HEX files) are converted to a memory image,
+	// in which the ELF file is patched as if it were embedded in a larger
+	// blob.
+	embeddedSetting := settings.embeddedOffset
+	container, e := openContainer(inputPath, rawInput)
+	if e != nil {
+		return e
+	}
+	if container != nil {
+		if settings.patchScript != "" {
+			return fmt.Errorf("Patch scripts aren't supported for %s files",
+				container.formatName())
 		}
-		currentSymbolOffset = 0
-		// Loop through all symbol definitions in individual sections
-		for currentSymbolOffset < section.Size {
-			// The name is the first field in the symbol structure.
-			e = replaceSingleOffset(f, section.FileOffset+currentSymbolOffset,
-				table)
-			if e != nil {
-				return fmt.Errorf("Failed replacing symbol name: %s", e)
-			}
-			currentSymbolOffset += symbolSize
+		rawInput = container.getImage()
+		if embeddedSetting == "" {
+			embeddedSetting = "auto"
 		}
 	}
-	return nil
-}
-
-// Replaces names in the elf32_Verdaux structures, which are in turn referred
-// to by elf32_Verdef structures. These are generally only used by shared
-// library files to define symbol names.
-func replaceVersionDefinitionStrings(f *elf_reader.ELF32File,
-	replacements []replacedStringTable) error {
-	// TODO: Implement replaceVersionDefinitionNames (also parse these sections
-	// in elf_reader)
-	return nil
-}
-
-// Replaces file and requirement names in the elf32_verneed and elf32_vernaux
-// structures, from the .gnu_version_r section. This assumes that only one such
-// section will be included in each ELF file.
-func replaceVersionRequirementStrings(f *elf_reader.ELF32File,
-	replacements []replacedStringTable) error {
-	var section *elf_reader.ELF32SectionHeader
-	var sectionIndex uint16
-	for i := range f.Sections {
-		if !f.IsVersionRequirementSection(uint16(i)) {
-			continue
+	if (embeddedSetting != "") && ((settings.reportPath != "") ||
+		(settings.mapFile != "") || (settings.shimPlan != "") ||
+		(settings.depfile != "") || settings.patchMeta) {
+		return fmt.Errorf("The -report, -map_file, -shim_plan, -depfile, " +
+			"and -patchmeta flags aren't supported for embedded ELF files")
+	}
+	if embeddedSetting != "" {
+		e = requireFileOutput(settings, "embedded ELF files")
+		if e != nil {
+			return e
 		}
-		section = &(f.Sections[i])
-		sectionIndex = uint16(i)
-		break
+		return processEmbeddedFiles(inputPath, outputPath, rawInput, container,
+			embeddedSetting, settings)
 	}
-	// Do nothing if the file doesn't contain a GNU version requirement section
-	if section == nil {
-		return nil
+	if (len(settings.checksums) != 0) || (settings.checksumCommand != "") {
+		return fmt.Errorf("Checksums can only be updated for embedded ELF " +
+			"files")
 	}
-	table := getReplacementTable(replacements, uint16(section.LinkedIndex))
-	// Do nothing if no strings were replaced in the section
-	if table == nil {
-		return nil
+	// Core dumps can't be patched, but their strings can still be inspected.
+	if isCoreDump(rawInput) {
+		return fmt.Errorf("%s is a core dump, which can't be patched. Use "+
+			"the strings subcommand to list its strings instead", inputPath)
 	}
-	need, aux, e := f.ParseVersionRequirementSection(sectionIndex)
+	log.Printf("Patching ELF file %s.\n", inputPath)
+	// Finally, get to the meat of the operation. Replace doesn't modify
+	// rawInput, so it can still be compared against the output.
+	output, report, e := stringreplace.Replace(rawInput, settings.options)
 	if e != nil {
-		return fmt.Errorf("Failed parsing version requirement section: %s", e)
-	}
-	currentNeedOffset := section.FileOffset
-	var currentAuxOffset uint32
-	// Loop through all elf32_verneed and associated elf32_vernaux structures
-	// See the elf_reader package and
-	// http://docs.oracle.com/cd/E19683-01/816-1386/chapter6-61174/index.html
-	for i, n := range need {
-		// The file name follows 2 2-byte fields in the structure
-		e = replaceSingleOffset(f, currentNeedOffset+4, table)
-		if e != nil {
-			return fmt.Errorf("Failed replacing requirement file name: %s", e)
-		}
-		currentAuxOffset = currentNeedOffset + n.AuxOffset
-		for _, x := range aux[i] {
-			// The requirement name follows 1 4-byte and 2 2-byte fields
-			e = replaceSingleOffset(f, currentAuxOffset+8, table)
-			if e != nil {
-				return fmt.Errorf("Failed replacing requirement name: %s", e)
-			}
-			currentAuxOffset += x.Next
+		return e
+	}
+	e = settings.maxGrowth.check(inputPath, len(rawInput), len(output))
+	if e != nil {
+		return e
+	}
+	logPhaseTimings(settings, report)
+	if settings.showDiff {
+		writeReplacementDiff(os.Stdout, inputPath, report)
+	}
+	if settings.options.Explain {
+		writeRuleExplanations(os.Stdout, inputPath, settings.options.Rules,
+			report)
+	}
+	// The listing and patch script need the parsed output file.
+	var elf *elf_reader.ELF32File
+	if settings.showListing || (settings.patchScript != "") {
+		elf, e = stringreplace.ParseELF32File(output)
+		if e != nil {
+			return fmt.Errorf("Error parsing the output file: %s", e)
 		}
-		currentNeedOffset += n.Next
 	}
-	return nil
-}
-
-// Replaces strings and the string table address in the dynamic linking table.
-// Assumes that the file will only contain one dynamic linking table.
-func replaceDynamicTableStrings(f *elf_reader.ELF32File,
-	replacements []replacedStringTable) error {
-	var sectionIndex uint16
-	var section *elf_reader.ELF32SectionHeader
-	for i := range f.Sections {
-		if !f.IsDynamicSection(uint16(i)) {
-			continue
+	if settings.showListing {
+		original, e := stringreplace.ParseELF32File(rawInput)
+		if e != nil {
+			return fmt.Errorf("Error parsing original file for listing: %s", e)
 		}
-		sectionIndex = uint16(i)
-		section = &(f.Sections[i])
-		break
+		writeChangeListing(os.Stdout, original, elf)
 	}
-	// Do nothing if the ELF didn't have a dynamic linking table.
-	if section == nil {
-		return nil
+	// The previews would be mixed into a JSON report written to stdout.
+	if settings.dryRun && (settings.reportPath != "-") {
+		writeReferencePreview(os.Stdout, inputPath, rawInput, output, 0,
+			report)
+		writeReplacementContext(os.Stdout, inputPath, rawInput, report,
+			settings.dryRunContext)
+	}
+	if settings.reportPath != "" {
+		e = writeReportFile(settings.reportPath, report)
+		if e != nil {
+			return fmt.Errorf("Error creating report: %s", e)
+		}
+	}
+	settings.batchReport.recordResult(report, len(report.Replacements))
+	if settings.mapFile != "" {
+		e = updateMapFile(settings.mapFile, settings.mapOutput, rawInput,
+			output, report, settings.syncOutput)
+		if e != nil {
+			return fmt.Errorf("Error updating map file: %s", e)
+		}
 	}
-	table := getReplacementTable(replacements, uint16(section.LinkedIndex))
-	// Do nothing if no strings were replaced for this section.
-	if table == nil {
+	if outputPath == "" {
 		return nil
 	}
-	entries, e := f.GetDynamicTable(sectionIndex)
-	if e != nil {
-		return fmt.Errorf("Failed parsing dynamic table: %s", e)
-	}
-	currentOffset := section.FileOffset
-	entrySize := uint32(binary.Size(&elf_reader.ELF32DynamicEntry{}))
-	for _, entry := range entries {
-		// Only tags 1, 14 and 15 have strings as values, as far as I know. Tag
-		// 5 contains a string table address. The value field is 4 bytes from
-		// the start of the table entry.
-		switch entry.Tag {
-		case 1, 14, 15:
-			e = replaceSingleOffset(f, currentOffset+4, table)
-			if e != nil {
-				return fmt.Errorf("Failed replacing dynamic table string: %s",
-					e)
-			}
-		case 5:
-			e = writeAtELFOffset(f, currentOffset+4, table.newVirtualAddress)
+	// Finally output the new ELF file with updated strings.
+	check := verifyELFOutput
+	if settings.validateWith != "" {
+		check = func(tempPath string) error {
+			e := verifyELFOutput(tempPath)
 			if e != nil {
-				return fmt.Errorf(
-					"Failed replacing dynamic table string table address: %s",
-					e)
+				return e
 			}
-		default:
+			return validateWithTool(settings.validateWith, tempPath)
+		}
+	}
+	content := output
+	if settings.outputFormat != outputFormatFile {
+		content, e = encodeOutput(settings.outputFormat,
+			filepath.Base(inputPath), output, 0755)
+		if e != nil {
+			return e
+		}
+		// The patched file was checked before it was archived.
+		check = nil
+	}
+	e = writeOutputFile(outputPath, content, 0755, check, settings.syncOutput)
+	if e != nil {
+		return fmt.Errorf("Error creating output file: %s", e)
+	}
+	if settings.patchMeta {
+		e = writePatchMetadata(inputPath, outputPath, report,
+			&(settings.options))
+		if e != nil {
+			return fmt.Errorf("Error creating metadata bundle: %s", e)
+		}
+	}
+	if settings.patchScript != "" {
+		e = writePatchScript(settings.patchScript, settings.patchScriptFormat,
+			rawInput, elf)
+		if e != nil {
+			return fmt.Errorf("Error creating patch script: %s", e)
+		}
+	}
+	if settings.shimPlan != "" {
+		e = writeShimPlan(settings.shimPlan, settings.shimPlanFormat,
+			outputPath, rawInput, output)
+		if e != nil {
+			return fmt.Errorf("Error creating shim plan: %s", e)
+		}
+	}
+	if settings.depfile != "" {
+		e = writeDepfile(settings.depfile, outputPath, inputPath, rawInput,
+			settings.depfileInputs, settings.depfileSysroot)
+		if e != nil {
+			return fmt.Errorf("Error creating depfile: %s", e)
 		}
-		currentOffset += entrySize
 	}
 	return nil
 }
 
-// Updates all known string table references in the ELF file to point to new
-// string locations, if the referenced string was replaced. If this function
-// returns an error, the ELF32File structure may be inconsistent, so an error
-// should be treated as fatal to the entire procedure.
-func updateStringReferences(f *elf_reader.ELF32File,
-	replacements []replacedStringTable) error {
-	log.Printf("Replacing section names.\n")
-	e := replaceSectionNames(f, replacements)
-	if e != nil {
-		return fmt.Errorf("Failed replacing section names: %s", e)
-	}
-	log.Printf("Replacing symbol names.\n")
-	e = replaceSymbolNames(f, replacements)
-	if e != nil {
-		return fmt.Errorf("Failed replacing symbol names: %s", e)
+// Processes a single file from a batch, creating the output directory if
+// necessary.
+func runBatchJob(job *batchJob, settings *fileSettings) error {
+	if job.symlinkTarget != "" {
+		return copySymlink(job)
 	}
-	log.Printf("Replacing version definitions (stub: not supported).\n")
-	e = replaceVersionDefinitionStrings(f, replacements)
-	if e != nil {
-		return fmt.Errorf("Failed replacing version definition strings: %s", e)
+	if job.skipReason != "" {
+		log.Printf("Skipping %s (%s): %s.\n", job.inputPath, job.format,
+			job.skipReason)
+		return nil
 	}
-	log.Printf("Replacing version requirements.\n")
-	e = replaceVersionRequirementStrings(f, replacements)
+	e := createOutputDirectory(job)
 	if e != nil {
-		return fmt.Errorf("Failed replacing version req. strings: %s", e)
+		return fmt.Errorf("Failed creating output directory: %s", e)
 	}
-	log.Printf("Replacing dynamic table strings.\n")
-	e = replaceDynamicTableStrings(f, replacements)
+	return processFile(job.inputPath, job.outputPath, settings)
+}
+
+// Holds the values of the repeatable -rename_versioned flag. Implements
+// flag.Value.
+type versionedRenameFlag []stringreplace.VersionedRename
+
+func (v *versionedRenameFlag) String() string {
+	return fmt.Sprintf("%d versioned renames", len(*v))
+}
+
+// Parses a rename of the form name@VERSION=new_name@NEW_VERSION.
+func (v *versionedRenameFlag) Set(value string) error {
+	r, e := stringreplace.ParseVersionedRename(value)
 	if e != nil {
-		return fmt.Errorf("Failed replacing dynamic table strings: %s", e)
+		return e
 	}
-	log.Printf("Sanity-checking result.\n")
-	e = f.ReparseData()
+	*v = append(*v, *r)
+	return nil
+}
+
+// Holds the values of the repeatable -symbol flag. Implements flag.Value.
+type symbolStringFlag []stringreplace.SymbolString
+
+func (v *symbolStringFlag) String() string {
+	return fmt.Sprintf("%d symbol strings", len(*v))
+}
+
+// Parses a replacement of the form symbol=replacement.
+func (v *symbolStringFlag) Set(value string) error {
+	s, e := stringreplace.ParseSymbolString(value)
 	if e != nil {
-		return fmt.Errorf("Failed re-parsing ELF post-string-replacement: %s",
-			e)
+		return e
 	}
+	*v = append(*v, *s)
 	return nil
 }
 
+// Holds the values of a repeatable flag taking a string, such as
+// -add_needed. Implements flag.Value.
+type stringListFlag []string
+
+func (v *stringListFlag) String() string {
+	return strings.Join(*v, ",")
+}
+
+func (v *stringListFlag) Set(value string) error {
+	*v = append(*v, value)
+	return nil
+}
+
+// Returns the notice added to reports when the patch subcommand's flags are
+// given without the subcommand.
+func legacyInvocationNotice() stringreplace.DeprecationNotice {
+	return stringreplace.DeprecationNotice{
+		Feature:     "cli.plain_flags",
+		Replacement: completionProgramName + " patch",
+		Message: "Running " + completionProgramName + " without a " +
+			"subcommand is deprecated; run \"" + completionProgramName +
+			" patch\" with the same flags instead",
+	}
+}
+
 func run() int {
-	var inputFile, outputFile, matchRegex, replacement string
-	flag.StringVar(&inputFile, "file", "", "The path to the input ELF file.")
+	// Invoked as patchelf, e.g. through a symlink, only patchelf's options
+	// are accepted.
+	if strings.TrimSuffix(filepath.Base(os.Args[0]), ".exe") == "patchelf" {
+		return runPatchelfCommand(os.Args[1:])
+	}
+	// Subcommands are selected by the first argument, if it isn't a flag.
+	// Without one, the patch subcommand's flags are accepted directly, as
+	// they were before subcommands existed. That's deprecated, but will keep
+	// working, with a notice in each report.
+	arguments := os.Args[1:]
+	legacyInvocation := true
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "patch":
+			arguments = os.Args[2:]
+			legacyInvocation = false
+		case "strings":
+			return runStringsCommand(os.Args[2:])
+		case "grep":
+			return runGrepCommand(os.Args[2:])
+		case "serve":
+			return runServeCommand(os.Args[2:])
+		case "revert":
+			return runRevertCommand(os.Args[2:])
+		case "verify-versions":
+			return runVerifyVersionsCommand(os.Args[2:])
+		case "verify-loader":
+			return runVerifyLoaderCommand(os.Args[2:])
+		case "assess":
+			return runAssessCommand(os.Args[2:])
+		case "attest":
+			return runAttestCommand(os.Args[2:])
+		case "stats":
+			return runStatsCommand(os.Args[2:])
+		case "patchelf-compat":
+			return runPatchelfCommand(os.Args[2:])
+		case "round-trip":
+			return runRoundTripCommand(os.Args[2:])
+		case "selftest":
+			return runSelfTestCommand(os.Args[2:])
+		case "completion":
+			return runCompletionCommand(os.Args[2:])
+		case "__complete_sections":
+			return runCompleteSectionsCommand(os.Args[2:])
+		case "gen-corpus":
+			return runGenCorpusCommand(os.Args[2:])
+		}
+	}
+	var inputFile, outputFile, outputDir, matchRegex, replacement string
+	var addressStrategy, cpuProfile, memProfile, colorSetting string
+	var programHeaderPlacement, backupDir, encoding string
+	var programHeaderAlign uint
+	var eventsPath, watchDir, watchFilter, configPath, rulesPath string
+	var excludeSections, notMatching, treatAsStringTables string
+	var symbolBindings, symbolTypes, symbolVisibilities string
+	var onlyImports, onlyExports, jsonReport, inPlace, inPlaceFallback bool
+	var versionedRenames versionedRenameFlag
+	var symbolStrings symbolStringFlag
+	var addNeeded stringListFlag
+	var settings fileSettings
+	var progressInterval, watchInterval time.Duration
+	flag.StringVar(&inputFile, "file", "", "The path to the input ELF file. "+
+		"Additional input files or directories may be given as positional "+
+		"arguments.")
 	flag.StringVar(&outputFile, "output", "",
-		"The name to give the modified ELF file.")
+		"The name to give the modified ELF file. Use \"-\" to write it to "+
+			"stdout, in which case log messages are written to stderr.")
+	flag.StringVar(&outputDir, "output_dir", "", "The directory in which to "+
+		"write modified files when processing multiple inputs. Input "+
+		"directories are mirrored under this directory.")
+	flag.DurationVar(&progressInterval, "progress_interval", 5*time.Second,
+		"How often to report progress on stderr when processing multiple "+
+		"inputs with -output_dir. Set to 0 to disable progress reports.")
+	flag.StringVar(&watchDir, "watch", "", "If set, watch this directory "+
+		"until interrupted, and patch 32-bit ELF files as they're written "+
+		"to it. Files are patched in place, or written under -output_dir if "+
+		"it's set.")
+	flag.StringVar(&watchFilter, "watch_filter", "", "If set, only patch "+
+		"files in the -watch directory with names matching this regular "+
+		"expression.")
+	flag.DurationVar(&watchInterval, "watch_interval", time.Second, "How "+
+		"often to check the -watch directory for new files.")
 	flag.StringVar(&matchRegex, "to_match", "",
 		"The regular expression to match in the string tables.")
 	flag.StringVar(&replacement, "replace", "", "Matched string table entries"+
 		" will be replaced with this. Supports referring to capture groups in"+
 		" the regex using $<number>.")
-	flag.Parse()
-	if (inputFile == "") || (outputFile == "") || (matchRegex == "") ||
-		(replacement == "") {
+	flag.StringVar(&rulesPath, "rules", "", "The path to a file holding "+
+		"several replacement rules, applied in a single pass, in place of "+
+		"-to_match and -replace. The file is either a JSON array or one "+
+		"\"<to_match> <replace> [literal] [sections=<names>]\" rule per "+
+		"line.")
+	flag.StringVar(&excludeSections, "exclude_sections", "", "If set, "+
+		"string tables in sections with names matching this regular "+
+		"expression are never modified.")
+	flag.StringVar(&notMatching, "not_matching", "", "If set, strings "+
+		"matching this regular expression are never replaced, even if they "+
+		"match -to_match.")
+	flag.StringVar(&treatAsStringTables, "treat_as_strtab", "", "A "+
+		"comma-separated list of sections to treat as string tables, even "+
+		"though they don't have the SHT_STRTAB type.")
+	flag.BoolVar(&settings.options.DetectStringTables, "detect_strtabs",
+		false, "Also treat sections of other types as string tables if "+
+			"their content looks like one. This is a heuristic, and may "+
+			"match other text data.")
+	flag.BoolVar(&settings.options.AllStringTables, "all_strtabs", false,
+		"Also modify string tables that aren't used by any structure this "+
+			"tool updates, such as .stabstr. Otherwise, they're only "+
+			"modified if named by -treat_as_strtab or a rule's sections list.")
+	flag.BoolVar(&settings.options.OnlyNeeded, "only_needed", false, "Only "+
+		"replace strings used as dependency names by DT_NEEDED entries in "+
+		"the dynamic table, leaving symbols and other strings with the same "+
+		"text alone.")
+	flag.BoolVar(&settings.options.RenameWarningSections,
+		"rename_warning_sections", false, "Rename the .gnu.warning.<symbol> "+
+			"section of each renamed symbol, so the linker still prints its "+
+			"warning when the new name is used.")
+	flag.BoolVar(&settings.options.RewriteWarningText, "rewrite_warning_text",
+		false, "Replace renamed symbols' old names in the text of "+
+			".gnu.warning sections, where the new text fits.")
+	flag.BoolVar(&settings.options.ClearPrelink, "clear_prelink", false,
+		"Allow patching prelinked files, removing the prelink entries from "+
+			"the dynamic table so the loader relocates them normally.")
+	flag.StringVar(&symbolBindings, "symbol_binding", "", "If set, only "+
+		"rename symbols with these comma-separated bindings (local, global, "+
+		"weak, or gnu_unique).")
+	flag.StringVar(&symbolTypes, "symbol_type", "", "If set, only rename "+
+		"symbols with these comma-separated types (e.g. func or object).")
+	flag.StringVar(&symbolVisibilities, "symbol_visibility", "", "If set, "+
+		"only rename symbols with these comma-separated visibilities "+
+		"(default, internal, hidden, or protected).")
+	flag.BoolVar(&onlyImports, "only_imports", false, "Only rename "+
+		"undefined symbols, which the file expects other libraries to "+
+		"provide, leaving its own symbols alone.")
+	flag.BoolVar(&onlyExports, "only_exports", false, "Only rename "+
+		"symbols the file exports (defined, non-local symbols with default "+
+		"or protected visibility), leaving references to imported symbols "+
+		"alone.")
+	flag.Var(&versionedRenames, "rename_versioned", "Rename a specific "+
+		"version of a dynamic symbol and change its version, as "+
+		"name@VERSION=new_name@NEW_VERSION. May be repeated, and replaces "+
+		"-to_match and -replace.")
+	flag.Var(&symbolStrings, "symbol", "Overwrite the string a symbol "+
+		"refers to (or points to, for a 4-byte pointer), given as "+
+		"symbol=replacement, in place. The replacement can't be longer than "+
+		"the original string (or the symbol's character array). May be "+
+		"repeated, and may be used with or without -to_match.")
+	flag.Var(&addNeeded, "add_needed", "Add a DT_NEEDED entry for this "+
+		"library, unless the file already depends on it. May be repeated, "+
+		"and may be used with or without -to_match. The dynamic table is "+
+		"moved to a new segment if it has no room for the new entries.")
+	flag.StringVar(&settings.options.AddSoname, "add_soname", "", "Add a "+
+		"DT_SONAME entry with this name, like -add_needed. Fails if the "+
+		"file already has a different one.")
+	flag.StringVar(&settings.options.AddRPath, "add_rpath", "", "Add a "+
+		"DT_RPATH entry with this search path, like -add_needed. Fails if "+
+		"the file already has a different one.")
+	flag.StringVar(&settings.options.AddRunPath, "add_runpath", "", "Add a "+
+		"DT_RUNPATH entry with this search path, like -add_needed. Fails if "+
+		"the file already has a different one.")
+	flag.StringVar(&settings.patchScript, "patch_script", "", "If set, write "+
+		"a script applying the same changes to this path.")
+	flag.StringVar(&settings.patchScriptFormat, "patch_script_format", "r2",
+		"The format of the -patch_script output. Must be r2, ida, ghidra, "+
+			"or ops.")
+	flag.IntVar(&settings.options.Parallelism, "parallelism", 0, "The "+
+		"maximum number of goroutines to use when processing a single file. "+
+		"Defaults to the number of CPUs.")
+	flag.StringVar(&addressStrategy, "va_strategy", "mirror-offset", "How "+
+		"to choose the virtual address of the relocated string tables. Must "+
+		"be mirror-offset (use the same offset-to-VA delta as the original "+
+		"table), after-last-load (use the first page after all loadable "+
+		"segments), or fixed=<address>.")
+	flag.BoolVar(&settings.options.ExtendLastLoad, "extend_last_load", false,
+		"Grow the last loadable segment to cover the relocated string tables "+
+		"instead of adding a new segment, if its permissions allow it. "+
+		"-va_strategy is ignored if the segment is extended.")
+	flag.BoolVar(&settings.options.ReusePadding, "reuse_padding", false,
+		"Place the relocated string tables in unused padding at the end of "+
+		"existing segments, if they fit, rather than growing the file.")
+	flag.BoolVar(&settings.options.StripNotes, "strip_notes", false,
+		"Remove PT_NOTE segments, such as the build ID and ABI tag, and "+
+		"reuse their space and program header entries for the relocated "+
+		"string tables.")
+	flag.BoolVar(&settings.options.Hybrid, "hybrid", false, "When a string "+
+		"table must be relocated, keep the replacements that fit in the "+
+		"space of the strings they replace in place, and only add the rest "+
+		"to the end of the relocated table.")
+	flag.BoolVar(&inPlace, "in_place", false, "Overwrite each replaced "+
+		"string in its original location, padded with null bytes, leaving "+
+		"the file size and program headers unchanged. It is an error for a "+
+		"replacement to be longer than the string it replaces.")
+	flag.BoolVar(&inPlaceFallback, "in_place_fallback", false, "Like "+
+		"-in_place, but relocate the string tables containing a longer "+
+		"replacement as usual, rather than failing.")
+	flag.UintVar(&programHeaderAlign, "phdr_align", 8, "The alignment of "+
+		"the relocated program header table in the appended data. Must be "+
+		"a power of two between 4 and 4096.")
+	flag.StringVar(&programHeaderPlacement, "phdr_placement", "after",
+		"Where to place the relocated program header table in the appended "+
+		"data: before or after the relocated string tables.")
+	flag.Var(&settings.maxGrowth, "max_growth", "If set, fail rather than "+
+		"write an output file larger than its input by more than this "+
+		"many bytes, or this percentage of the input's size if it ends "+
+		"with %.")
+	flag.StringVar(&settings.validateWith, "validate_with", "", "If set to "+
+		"readelf or objdump (optionally with a cross-toolchain prefix), run "+
+		"that tool on each patched ELF file, if it's installed, and fail if "+
+		"it reports an error.")
+	flag.StringVar(&backupDir, "backup_dir", "", "If set, save a copy of "+
+		"each file patched in place (when -output or -output_dir names the "+
+		"input) to this directory before patching it, mirroring the tree "+
+		"under -output_dir, and record it in the directory's manifest.jsonl.")
+	flag.BoolVar(&settings.patchMeta, "patchmeta", false, "If set, write "+
+		"a metadata bundle holding the report, the input and output files' "+
+		"SHA-256 digests, and the data needed to revert the patch next to "+
+		"each output file, named after it with a .patchmeta suffix.")
+	flag.StringVar(&settings.outputFormat, "output_format", outputFormatFile,
+		"How to write each patched ELF file: file, or tar or cpio to write "+
+		"a tar or newc cpio archive holding the patched file, named after "+
+		"the input file.")
+	flag.StringVar(&settings.embeddedOffset, "embedded_offset", "", "If "+
+		"set, the input is a larger image (e.g. firmware) containing an ELF "+
+		"file at this offset, \"auto\" to use the first ELF file found, or "+
+		"\"all\" to patch every ELF file found. ELF files are patched "+
+		"without changing their size, and the rest of the image is left "+
+		"untouched.")
+	flag.Var(&settings.checksums, "checksum", "A checksum in the image "+
+		"surrounding an embedded ELF file to update after patching, as "+
+		"<algorithm>:<offset>:<start>-<end>[:be]. The algorithm is crc32, "+
+		"crc32c, sum8, sum16, or sum32, and end may be \"end\". May be "+
+		"repeated.")
+	flag.StringVar(&settings.checksumCommand, "checksum_command", "", "A "+
+		"command to run after writing an image containing embedded ELF "+
+		"files, with the output path appended to its arguments, e.g. to fix "+
+		"up vendor-specific checksums. The output is discarded if it fails.")
+	flag.BoolVar(&settings.showListing, "listing", false, "Print a "+
+		"readelf-style listing of affected structures, with before and after "+
+		"values. If -output isn't set, the planned changes are listed "+
+		"without writing a file.")
+	flag.BoolVar(&settings.dryRun, "dry_run", false, "Carry out the "+
+		"replacements without writing any output, and print the file offset, "+
+		"field, and old and new bytes of each reference that would be "+
+		"rewritten.")
+	flag.IntVar(&settings.dryRunContext, "dry_run_context", 2, "The number "+
+		"of neighboring strings to print before and after each replaced "+
+		"string with -dry_run. Set to 0 to disable.")
+	flag.StringVar(&settings.reportPath, "report", "", "If set, write a JSON "+
+		"report describing every change to this path. The report can be "+
+		"passed to the revert subcommand to restore the original file. "+
+		"With -output_dir, a combined report for every file is written, "+
+		"with totals and a list of files in which nothing matched. Use \"-\" "+
+		"to write it to stdout.")
+	flag.BoolVar(&jsonReport, "json", false, "Print the JSON report to "+
+		"stdout, in place of the diff and -dry_run previews. Equivalent to "+
+		"-report -.")
+	flag.StringVar(&settings.mapFile, "map_file", "", "If set, the path to "+
+		"a GNU ld map file for the input file, in which library and symbol "+
+		"names are updated to match the patched file.")
+	flag.StringVar(&settings.shimPlan, "shim_plan", "", "If set, write a "+
+		"plan for making each renamed dependency available under its new "+
+		"name, by linking or copying the existing library, to this path.")
+	flag.StringVar(&settings.shimPlanFormat, "shim_plan_format", "symlink",
+		"The format of the -shim_plan output: symlink or copy (shell "+
+			"scripts), or json (a manifest of renamed dependencies).")
+	flag.StringVar(&settings.depfile, "depfile", "", "If set, write a "+
+		"Make-style depfile to this path, listing the input file, the "+
+		"configuration and map files, and the libraries found under "+
+		"-depfile_sysroot as dependencies of the output file.")
+	flag.StringVar(&settings.depfileSysroot, "depfile_sysroot", "", "If "+
+		"set, the libraries named by the input's DT_NEEDED entries are "+
+		"looked up in this sysroot's lib, usr/lib, lib32, and usr/lib32 "+
+		"directories, and listed in the -depfile.")
+	flag.StringVar(&settings.mapOutput, "map_output", "", "The path to "+
+		"which the updated -map_file is written. Defaults to the -output "+
+		"path with \".map\" appended.")
+	flag.StringVar(&colorSetting, "color", "auto", "Whether to print a "+
+		"colored, diff-style summary of the replacements in each file: "+
+		"\"auto\" (only if stdout is a terminal), \"always\", or \"never\".")
+	flag.BoolVar(&settings.options.AllowRawBytes, "allow_raw_bytes", false,
+		"Allow replacements containing newlines, other control characters, "+
+			"or non-ASCII bytes, which are rejected by default.")
+	flag.StringVar(&encoding, "encoding", "utf-8", "The encoding of the "+
+		"text in string tables: utf-8, latin1, or shift-jis. Strings are "+
+		"decoded before -to_match and -not_matching are applied, and "+
+		"replacements are encoded again.")
+	flag.BoolVar(&settings.syncOutput, "sync", false, "Flush each output "+
+		"file and its directory to storage after it's renamed into place, "+
+		"so the output survives a crash or power loss.")
+	flag.BoolVar(&settings.options.AllowEmptyMatch, "allow_empty_match",
+		false, "Allow -to_match regular expressions that can match an empty "+
+			"string, such as \"x*\" or \"^\", which are rejected by default.")
+	flag.StringVar(&eventsPath, "events", "", "If set, write a JSON object "+
+		"to this path for each action taken (such as replacing a string or "+
+		"updating a reference) as it happens, one per line. Use \"-\" for "+
+		"stdout, in which case log messages are written to stderr.")
+	flag.BoolVar(&settings.options.Explain, "explain", false, "Print, for "+
+		"each rule, why it did or didn't take effect in each string table: "+
+		"e.g. no match, section excluded, or no references to update.")
+	flag.BoolVar(&settings.showTimings, "timings", false, "Log the time "+
+		"taken by each phase of patching each file.")
+	flag.StringVar(&configPath, "config", "", "The path to a configuration "+
+		"file providing default values for other flags, and replacement "+
+		"rules. Defaults to "+defaultConfigName+" in the current directory "+
+		"or its nearest parent containing one.")
+	flag.StringVar(&cpuProfile, "profile_cpu", "", "If set, write a pprof "+
+		"CPU profile of the run to this path.")
+	flag.StringVar(&memProfile, "profile_mem", "", "If set, write a pprof "+
+		"heap profile to this path at the end of the run.")
+	flag.CommandLine.Parse(arguments)
+	// Flags given on the command line take precedence over the config file.
+	var e error
+	var config *configFile
+	if configPath == "" {
+		configPath = findConfigFile()
+	}
+	if configPath != "" {
+		config, e = parseConfigFile(configPath)
+		if e != nil {
+			log.Printf("Failed reading config file: %s\n", e)
+			return 1
+		}
+		explicit := make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) {
+			explicit[f.Name] = true
+		})
+		e = config.apply(flag.CommandLine, explicit)
+		if e != nil {
+			log.Printf("%s\n", e)
+			return 1
+		}
+	}
+	useVersionedRenames := len(versionedRenames) != 0
+	if useVersionedRenames && (matchRegex != "") {
+		log.Println("The -rename_versioned flag can't be used with " +
+			"-to_match.")
+		return 1
+	}
+	useRulesFile := rulesPath != ""
+	if useRulesFile && (useVersionedRenames || (matchRegex != "")) {
+		log.Println("The -rules flag can't be used with -to_match or " +
+			"-rename_versioned.")
+		return 1
+	}
+	useConfigRules := !useVersionedRenames && !useRulesFile &&
+		(matchRegex == "") && (config != nil) && (len(config.rules) != 0)
+	inputs := flag.Args()
+	if inputFile != "" {
+		inputs = append([]string{inputFile}, inputs...)
+	}
+	// -symbol and the options adding dynamic entries may be used alone, but
+	// -to_match always needs -replace.
+	settings.options.AddNeeded = addNeeded
+	addsEntries := (len(addNeeded) != 0) ||
+		(settings.options.AddSoname != "") ||
+		(settings.options.AddRPath != "") ||
+		(settings.options.AddRunPath != "")
+	needRule := !useConfigRules && !useVersionedRenames && !useRulesFile &&
+		(((len(symbolStrings) == 0) && !addsEntries) || (matchRegex != ""))
+	if ((len(inputs) == 0) && (watchDir == "")) || (needRule &&
+		((matchRegex == "") || (replacement == ""))) ||
+		!isValidPatchScriptFormat(settings.patchScriptFormat) ||
+		!isValidShimPlanFormat(settings.shimPlanFormat) {
 		log.Println("Invalid arguments. Run with -help for more information.")
 		return 1
 	}
-	regex, e := regexp.Compile(matchRegex)
+	// The library doesn't log anything unless it's given a logger.
+	settings.options.Logger = log.Default()
+	settings.options.AddressStrategy, settings.options.FixedAddress, e =
+		stringreplace.ParseAddressStrategy(addressStrategy)
 	if e != nil {
-		log.Printf("Failed processing to_match regular expression: %s\n", e)
+		log.Printf("%s\n", e)
 		return 1
 	}
-	rawInput, e := ioutil.ReadFile(inputFile)
+	// -in_place is the library's in-place mode, with SameSize rejecting
+	// longer replacements.
+	settings.options.InPlace = inPlace || inPlaceFallback
+	if inPlace && !inPlaceFallback {
+		settings.options.SameSize = true
+	}
+	settings.options.Encoding, e = stringreplace.ParseEncoding(encoding)
 	if e != nil {
-		log.Printf("Failed reading input file: %s\n", e)
+		log.Printf("%s\n", e)
+		return 1
+	}
+	// The library treats 0 as the default, so it's rejected here.
+	if (programHeaderAlign == 0) || (programHeaderAlign > 0x1000) {
+		log.Printf("Invalid -phdr_align %d: it must be a power of two "+
+			"between 4 and 4096\n", programHeaderAlign)
 		return 1
 	}
-	elf, e := elf_reader.ParseELF32File(rawInput)
+	settings.options.ProgramHeaderAlign = uint32(programHeaderAlign)
+	e = stringreplace.ValidateProgramHeaderAlign(
+		settings.options.ProgramHeaderAlign)
 	if e != nil {
-		log.Printf("Failed parsing the input file: %s\n", e)
+		log.Printf("%s\n", e)
 		return 1
 	}
-	log.Printf("Parsed ELF file successfully.\n")
-	// Finally, get to the meat of the operation... First, calculate new string
-	// table content.
-	replacements, e := processReplacements(elf, regex, replacement)
+	switch settings.outputFormat {
+	case outputFormatFile, outputFormatTar, outputFormatCPIO:
+	default:
+		log.Printf("Invalid -output_format %s: must be file, tar, or cpio\n",
+			settings.outputFormat)
+		return 1
+	}
+	if backupDir != "" {
+		settings.backups = &backupStore{
+			directory: backupDir,
+			root:      outputDir,
+		}
+	}
+	if settings.patchMeta && (outputFile == "-") {
+		log.Println("The -patchmeta flag can't be used when writing the " +
+			"output to stdout.")
+		return 1
+	}
+	if (settings.outputFormat != outputFormatFile) &&
+		(settings.validateWith != "") {
+		log.Println("The -validate_with flag can't be used with an archive " +
+			"-output_format.")
+		return 1
+	}
+	switch programHeaderPlacement {
+	case "before":
+		settings.options.ProgramHeadersFirst = true
+	case "after":
+		settings.options.ProgramHeadersFirst = false
+	default:
+		log.Printf("Invalid -phdr_placement %s: must be before or after\n",
+			programHeaderPlacement)
+		return 1
+	}
+	if useVersionedRenames {
+		settings.options.VersionedRenames = versionedRenames
+	} else if useRulesFile {
+		content, e := ioutil.ReadFile(rulesPath)
+		if e == nil {
+			settings.options.Rules, e = stringreplace.ParseRulesFile(content)
+		}
+		if e != nil {
+			log.Printf("Failed reading rules file %s: %s\n", rulesPath, e)
+			return 1
+		}
+	} else if useConfigRules {
+		settings.options.Rules, e = config.buildRules()
+		if e != nil {
+			log.Printf("%s\n", e)
+			return 1
+		}
+	} else if matchRegex != "" {
+		regex, e := regexp.Compile(matchRegex)
+		if e != nil {
+			log.Printf("Failed processing to_match regular expression: %s\n",
+				e)
+			return 1
+		}
+		settings.options.Rules = []stringreplace.Rule{
+			{
+				Match:       regex,
+				Replacement: replacement,
+			},
+		}
+		e = stringreplace.ValidateRule(&(settings.options.Rules[0]))
+		if e != nil {
+			log.Printf("Invalid -replace value: %s\n", e)
+			return 1
+		}
+	}
+	settings.options.SymbolStrings = symbolStrings
+	if excludeSections != "" {
+		settings.options.ExcludeSections, e = regexp.Compile(excludeSections)
+		if e != nil {
+			log.Printf("Failed processing exclude_sections regular "+
+				"expression: %s\n", e)
+			return 1
+		}
+	}
+	if notMatching != "" {
+		settings.options.NotMatching, e = regexp.Compile(notMatching)
+		if e != nil {
+			log.Printf("Failed processing not_matching regular expression: "+
+				"%s\n", e)
+			return 1
+		}
+	}
+	if treatAsStringTables != "" {
+		settings.options.TreatAsStringTables = strings.Split(
+			treatAsStringTables, ",")
+	}
+	settings.options.SymbolFilter, e = stringreplace.ParseSymbolFilter(
+		symbolBindings, symbolTypes, symbolVisibilities)
 	if e != nil {
-		log.Printf("Error performing string replacements: %s\n", e)
+		log.Printf("Invalid symbol filter: %s\n", e)
 		return 1
 	}
-	// Second, append the new string tables to the end of the file, and update
-	// necessary headers to the new locations.
-	e = relocateStringTables(elf, replacements)
+	if settings.validateWith != "" {
+		_, e = validationToolKind(settings.validateWith)
+		if e != nil {
+			log.Printf("%s\n", e)
+			return 1
+		}
+	}
+	if onlyImports && onlyExports {
+		log.Println("The -only_imports and -only_exports flags can't be " +
+			"used together.")
+		return 1
+	}
+	if onlyImports || onlyExports {
+		if settings.options.SymbolFilter == nil {
+			settings.options.SymbolFilter = &stringreplace.SymbolFilter{}
+		}
+		settings.options.SymbolFilter.OnlyUndefined = onlyImports
+		settings.options.SymbolFilter.OnlyExported = onlyExports
+	}
+	if settings.dryRun && ((outputFile != "") || (outputDir != "") ||
+		(settings.patchScript != "") || (settings.checksumCommand != "") ||
+		(settings.shimPlan != "")) {
+		log.Println("The -dry_run flag can't be used with -output, " +
+			"-output_dir, -patch_script, -checksum_command, or -shim_plan.")
+		return 1
+	}
+	if jsonReport {
+		if settings.reportPath != "" {
+			log.Println("The -json and -report flags can't both be used.")
+			return 1
+		}
+		settings.reportPath = "-"
+	}
+	if (settings.shimPlan != "") && ((outputDir != "") || (watchDir != "") ||
+		(len(inputs) != 1)) {
+		log.Println("The -shim_plan flag can only be used with a single " +
+			"input file.")
+		return 1
+	}
+	if settings.depfile != "" {
+		if (outputDir != "") || (watchDir != "") || (len(inputs) != 1) ||
+			(outputFile == "") || (outputFile == "-") {
+			log.Println("The -depfile flag can only be used with a single " +
+				"input file and an -output path.")
+			return 1
+		}
+		if configPath != "" {
+			settings.depfileInputs = append(settings.depfileInputs,
+				configPath)
+		}
+		if settings.mapFile != "" {
+			settings.depfileInputs = append(settings.depfileInputs,
+				settings.mapFile)
+		}
+	} else if settings.depfileSysroot != "" {
+		log.Println("The -depfile_sysroot flag requires -depfile.")
+		return 1
+	}
+	if (settings.embeddedOffset != "") && (settings.patchScript != "") {
+		log.Println("The -patch_script flag can't be used with " +
+			"-embedded_offset.")
+		return 1
+	}
+	if settings.mapFile != "" {
+		if (outputDir != "") || (watchDir != "") || (len(inputs) != 1) {
+			log.Println("The -map_file flag can only be used with a single " +
+				"input file.")
+			return 1
+		}
+		if (settings.mapOutput == "") && !settings.dryRun {
+			if (outputFile == "") || (outputFile == "-") {
+				log.Println("The -map_output flag is required when not " +
+					"writing the output to a file.")
+				return 1
+			}
+			settings.mapOutput = outputFile + ".map"
+		}
+	} else if settings.mapOutput != "" {
+		log.Println("The -map_output flag requires -map_file.")
+		return 1
+	}
+	if settings.dryRun {
+		// Nothing is written in a dry run.
+		settings.mapOutput = ""
+	}
+	settings.showDiff, e = parseColorSetting(colorSetting)
 	if e != nil {
-		log.Printf("Error relocating string tables: %s\n", e)
+		log.Printf("%s\n", e)
 		return 1
 	}
-	// Third, update all of the string table references (now that the
-	// replacements list has all the needed information).
-	e = updateStringReferences(elf, replacements)
+	if outputFile == "-" {
+		// The diff would be mixed into the output file.
+		settings.showDiff = false
+		if settings.showListing || (settings.patchScript != "") ||
+			(settings.checksumCommand != "") {
+			log.Println("The -listing, -patch_script, and -checksum_command " +
+				"flags can't be used when writing to stdout.")
+			return 1
+		}
+		// Keep stdout clean for the output file.
+		log.SetOutput(os.Stderr)
+	}
+	if eventsPath == "-" {
+		if (outputFile == "-") || settings.showListing || settings.dryRun {
+			log.Println("The -output, -listing, and -dry_run flags can't " +
+				"write to stdout along with -events.")
+			return 1
+		}
+		// Keep stdout clean for the events.
+		settings.showDiff = false
+		log.SetOutput(os.Stderr)
+	}
+	if settings.reportPath == "-" {
+		if (outputFile == "-") || (eventsPath == "-") ||
+			settings.showListing || settings.options.Explain {
+			log.Println("The -output, -events, -listing, and -explain flags " +
+				"can't write to stdout along with the JSON report.")
+			return 1
+		}
+		// Keep stdout clean for the report.
+		settings.showDiff = false
+		log.SetOutput(os.Stderr)
+	}
+	// Written to stderr even when log messages go to stdout, so scripts
+	// reading the output of plain-flag invocations see no difference.
+	if legacyInvocation {
+		notice := legacyInvocationNotice()
+		fmt.Fprintf(os.Stderr, "%s.\n", notice.Message)
+		settings.options.Deprecations = append(settings.options.Deprecations,
+			notice)
+	}
+	if eventsPath != "" {
+		settings.events, e = newEventWriter(eventsPath)
+		if e != nil {
+			log.Printf("Failed creating events output: %s\n", e)
+			return 1
+		}
+		defer settings.events.close()
+		settings.options.OnEvent = settings.events.handle
+	}
+	if config != nil {
+		log.Printf("Using options from %s.\n", configPath)
+	}
+	stopProfiling, e := startProfiling(cpuProfile, memProfile)
 	if e != nil {
-		log.Printf("Error updating string references: %s\n", e)
+		log.Printf("%s\n", e)
 		return 1
 	}
-	// Finally output the new ELF file with updated strings.
-	e = ioutil.WriteFile(outputFile, elf.Raw, 0755)
+	defer stopProfiling()
+	if watchDir != "" {
+		if (len(inputs) != 0) || (outputFile != "") ||
+			(settings.patchScript != "") || (settings.reportPath != "") ||
+			(watchInterval <= 0) {
+			log.Println("Invalid arguments. The -file, -output, " +
+				"-patch_script, and -report flags can't be used with -watch, " +
+				"and -watch_interval must be positive.")
+			return 1
+		}
+		var filter *regexp.Regexp
+		if watchFilter != "" {
+			filter, e = regexp.Compile(watchFilter)
+			if e != nil {
+				log.Printf("Failed processing watch_filter regular "+
+					"expression: %s\n", e)
+				return 1
+			}
+		}
+		return runWatch(watchDir, outputDir, filter, watchInterval, &settings)
+	}
+	if outputDir == "" {
+		// Without an output directory, only a single input file is allowed.
+		if (len(inputs) != 1) || ((outputFile == "") &&
+			!settings.showListing && !settings.dryRun) {
+			log.Println("Invalid arguments. Use -output_dir with multiple " +
+				"inputs, or -output with a single input.")
+			return 1
+		}
+		e = processFile(inputs[0], outputFile, &settings)
+		if e != nil {
+			log.Printf("%s\n", e)
+			return 1
+		}
+		return 0
+	}
+	if (outputFile != "") || (settings.patchScript != "") {
+		log.Println("The -output and -patch_script flags can't be used " +
+			"with -output_dir.")
+		return 1
+	}
+	// With multiple files, -report names the combined report for all of
+	// them.
+	batchReportPath := settings.reportPath
+	if batchReportPath != "" {
+		settings.reportPath = ""
+		settings.batchReport = newBatchReport()
+	}
+	jobs, e := collectBatchJobs(inputs, outputDir)
 	if e != nil {
-		log.Printf("Error creating output file: %s\n", e)
+		log.Printf("Failed finding input files: %s\n", e)
+		return 1
+	}
+	failed := 0
+	progress := newProgressReporter(os.Stderr, len(jobs), progressInterval)
+	for i := range jobs {
+		progress.startFile(jobs[i].inputPath)
+		settings.batchReport.startFile(&(jobs[i]))
+		e = runBatchJob(&(jobs[i]), &settings)
+		settings.batchReport.finishFile(e)
+		progress.finishFile()
+		if e != nil {
+			log.Printf("Failed processing %s: %s\n", jobs[i].inputPath, e)
+			failed++
+		}
+	}
+	progress.finish()
+	if settings.batchReport != nil {
+		e = settings.batchReport.write(batchReportPath)
+		if e != nil {
+			log.Printf("Error creating report: %s\n", e)
+			return 1
+		}
+	}
+	if failed != 0 {
+		log.Printf("Failed processing %d of %d files.\n", failed, len(jobs))
 		return 1
 	}
 	return 0
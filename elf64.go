@@ -0,0 +1,105 @@
+package main
+
+// This file contains the code for patching 64-bit ELF files, which are
+// patched in the same way as 32-bit files, but support fewer flags.
+
+import (
+	"debug/elf"
+	"fmt"
+	"github.com/yalue/elf32_string_replace/stringreplace"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Like verifyELFOutput, for 64-bit ELF files. The file's dynamic section and
+// symbols must be readable, since they were likely modified.
+func verifyELF64Output(path string) error {
+	f, e := elf.Open(path)
+	if e != nil {
+		return fmt.Errorf("The written file isn't a valid ELF file: %s", e)
+	}
+	defer f.Close()
+	if f.Class != elf.ELFCLASS64 {
+		return fmt.Errorf("The written file isn't a 64-bit ELF file")
+	}
+	_, e = f.ImportedLibraries()
+	if e != nil {
+		return fmt.Errorf("Failed reading the written file's dependencies: "+
+			"%s", e)
+	}
+	_, e = f.DynamicSymbols()
+	if (e != nil) && (e != elf.ErrNoSymbols) {
+		return fmt.Errorf("Failed reading the written file's dynamic "+
+			"symbols: %s", e)
+	}
+	return nil
+}
+
+// Replaces strings in a 64-bit ELF file, and writes the result to
+// outputPath, if it isn't empty.
+func processELF64File(inputPath, outputPath string, rawInput []byte,
+	settings *fileSettings) error {
+	if (settings.patchScript != "") || (settings.embeddedOffset != "") ||
+		settings.showListing || (len(settings.checksums) != 0) ||
+		(settings.checksumCommand != "") || (settings.mapFile != "") ||
+		(settings.shimPlan != "") || (settings.depfile != "") ||
+		settings.patchMeta {
+		return fmt.Errorf("The -patch_script, -embedded_offset, -listing, " +
+			"-map_file, -shim_plan, -depfile, -patchmeta, and checksum " +
+			"flags aren't supported for 64-bit ELF files")
+	}
+	log.Printf("Patching 64-bit ELF file %s.\n", inputPath)
+	output, report, e := stringreplace.ReplaceELF64(rawInput,
+		settings.options)
+	if e != nil {
+		return e
+	}
+	e = settings.maxGrowth.check(inputPath, len(rawInput), len(output))
+	if e != nil {
+		return e
+	}
+	if settings.showDiff {
+		writeReplacementDiff(os.Stdout, inputPath, report)
+	}
+	if settings.dryRun && (settings.reportPath != "-") {
+		writeReferencePreview(os.Stdout, inputPath, rawInput, output, 0,
+			report)
+		writeReplacementContext(os.Stdout, inputPath, rawInput, report,
+			settings.dryRunContext)
+	}
+	if settings.reportPath != "" {
+		e = writeReportFile(settings.reportPath, report)
+		if e != nil {
+			return fmt.Errorf("Error creating report: %s", e)
+		}
+	}
+	settings.batchReport.recordResult(report, len(report.Replacements))
+	if outputPath == "" {
+		return nil
+	}
+	check := verifyELF64Output
+	if settings.validateWith != "" {
+		check = func(tempPath string) error {
+			e := verifyELF64Output(tempPath)
+			if e != nil {
+				return e
+			}
+			return validateWithTool(settings.validateWith, tempPath)
+		}
+	}
+	content := output
+	if settings.outputFormat != outputFormatFile {
+		content, e = encodeOutput(settings.outputFormat,
+			filepath.Base(inputPath), output, 0755)
+		if e != nil {
+			return e
+		}
+		check = nil
+	}
+	e = writeOutputFile(outputPath, content, 0755, check, settings.syncOutput)
+	if e != nil {
+		return fmt.Errorf("Error creating output file: %s", e)
+	}
+	return nil
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"github.com/yalue/elf32_string_replace/stringreplace"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+// Parses a 64-bit ELF file using the standard library, which is independent
+// of the code being tested.
+func parseTestELF64(t *testing.T, content []byte) *elf.File {
+	f, e := elf.NewFile(bytes.NewReader(content))
+	if e != nil {
+		t.Fatalf("Failed parsing the 64-bit ELF file: %s", e)
+	}
+	if f.Class != elf.ELFCLASS64 {
+		t.Fatalf("Expected a 64-bit ELF file, got %s", f.Class)
+	}
+	return f
+}
+
+// Returns the content of the named section, failing the test if it's
+// missing.
+func sectionData64(t *testing.T, f *elf.File, name string) []byte {
+	s := f.Section(name)
+	if s == nil {
+		t.Fatalf("The file has no %s section", name)
+	}
+	content, e := s.Data()
+	if e != nil {
+		t.Fatalf("Failed reading %s: %s", name, e)
+	}
+	return content
+}
+
+// Returns the index of the dynamic symbol found by looking up the name in
+// the file's SysV hash table, or 0 if it isn't found.
+func lookupSysv64(t *testing.T, f *elf.File, name string) uint32 {
+	content := sectionData64(t, f, ".hash")
+	words := make([]uint32, len(content)/4)
+	for i := range words {
+		words[i] = f.ByteOrder.Uint32(content[4*i:])
+	}
+	symbols, e := f.DynamicSymbols()
+	if e != nil {
+		t.Fatalf("Failed reading the dynamic symbols: %s", e)
+	}
+	bucketCount := words[0]
+	chains := words[2+bucketCount:]
+	for i := words[2+corpusELFHash(name)%bucketCount]; i != 0; i = chains[i] {
+		// DynamicSymbols omits the null symbol at index 0.
+		if symbols[i-1].Name == name {
+			return i
+		}
+	}
+	return 0
+}
+
+// Like lookupSysv64, but using the GNU hash table, with 64-bit bloom filter
+// words.
+func lookupGNU64(t *testing.T, f *elf.File, name string) uint32 {
+	content := sectionData64(t, f, ".gnu.hash")
+	o := f.ByteOrder
+	bucketCount := o.Uint32(content)
+	symbolOffset := o.Uint32(content[4:])
+	bloomSize := o.Uint32(content[8:])
+	bloomShift := o.Uint32(content[12:])
+	buckets := content[16+8*bloomSize:]
+	chain := buckets[4*bucketCount:]
+	symbols, e := f.DynamicSymbols()
+	if e != nil {
+		t.Fatalf("Failed reading the dynamic symbols: %s", e)
+	}
+	hash := corpusGNUHash(name)
+	word := o.Uint64(content[16+8*((hash/64)%bloomSize):])
+	if ((word>>(hash%64))&1) == 0 ||
+		((word>>((hash>>bloomShift)%64))&1) == 0 {
+		return 0
+	}
+	i := o.Uint32(buckets[4*(hash%bucketCount):])
+	if i == 0 {
+		return 0
+	}
+	for {
+		value := o.Uint32(chain[4*(i-symbolOffset):])
+		if ((value | 1) == (hash | 1)) && (symbols[i-1].Name == name) {
+			return i
+		}
+		if (value & 1) != 0 {
+			return 0
+		}
+		i++
+	}
+}
+
+func TestELF64Relocation(t *testing.T) {
+	options := stringreplace.Options{
+		Rules: []stringreplace.Rule{{
+			Match:       regexp.MustCompile(`^libc\.so\.6$`),
+			Replacement: "libc_with_a_longer_name.so.6",
+		}, {
+			Match:       regexp.MustCompile(`^corpus_function$`),
+			Replacement: "corpus_function_with_a_longer_name",
+		}},
+	}
+	for _, name := range []string{"shared64_le.so", "shared64_be.so",
+		"exec64_dynamic"} {
+		input := corpusInput(t, name)
+		original := parseTestELF64(t, input)
+		output, report, e := stringreplace.Replace(input, options)
+		if e != nil {
+			t.Fatalf("Failed patching %s: %s", name, e)
+		}
+		f := parseTestELF64(t, output)
+		needed, e := f.ImportedLibraries()
+		if e != nil {
+			t.Fatalf("Failed reading %s's dependencies: %s", name, e)
+		}
+		if !reflect.DeepEqual(needed,
+			[]string{"libc_with_a_longer_name.so.6"}) {
+			t.Errorf("Got unexpected dependencies in %s: %q", name, needed)
+		}
+		symbols, e := f.DynamicSymbols()
+		if e != nil {
+			t.Fatalf("Failed reading %s's dynamic symbols: %s", name, e)
+		}
+		if symbols[0].Name != "corpus_function_with_a_longer_name" {
+			t.Errorf("Expected corpus_function to be renamed in %s, got %s",
+				name, symbols[0].Name)
+		}
+		// The version requirement refers to the dependency by name.
+		imported, e := f.ImportedSymbols()
+		if e != nil {
+			t.Fatalf("Failed reading %s's imported symbols: %s", name, e)
+		}
+		if (len(imported) != 1) || (imported[0].Name != "puts") ||
+			(imported[0].Version != "GLIBC_2.0") ||
+			(imported[0].Library != "libc_with_a_longer_name.so.6") {
+			t.Errorf("Got unexpected imported symbols in %s: %v", name,
+				imported)
+		}
+		// .dynstr grew, so it must have been moved to a new segment.
+		if len(f.Progs) != (len(original.Progs) + 1) {
+			t.Fatalf("Expected a segment to be added to %s", name)
+		}
+		added := f.Progs[len(f.Progs)-1]
+		dynstr := f.Section(".dynstr")
+		if (added.Type != elf.PT_LOAD) || (dynstr.Addr < added.Vaddr) ||
+			((dynstr.Addr + dynstr.Size) > (added.Vaddr + added.Memsz)) {
+			t.Errorf("The new segment in %s doesn't load .dynstr", name)
+		}
+		if (added.Vaddr % added.Align) != (added.Off % added.Align) {
+			t.Errorf("The new segment's VA and offset in %s aren't "+
+				"congruent modulo its alignment", name)
+		}
+		// PT_PHDR must describe the moved program header table, which must
+		// be loaded.
+		for _, p := range f.Progs {
+			if p.Type != elf.PT_PHDR {
+				continue
+			}
+			if (p.Vaddr < added.Vaddr) ||
+				((p.Vaddr + p.Memsz) > (added.Vaddr + added.Memsz)) ||
+				((p.Vaddr - added.Vaddr) != (p.Off - added.Off)) {
+				t.Errorf("PT_PHDR in %s doesn't describe the program "+
+					"header table in the new segment", name)
+			}
+		}
+		if len(report.NewSegments) != 1 {
+			t.Errorf("Expected the report to list 1 new segment for %s, "+
+				"got %d", name, len(report.NewSegments))
+		}
+		restored, e := stringreplace.Revert(output, report)
+		if e != nil {
+			t.Fatalf("Failed reverting %s: %s", name, e)
+		}
+		if !bytes.Equal(restored, input) {
+			t.Errorf("Reverting didn't restore %s", name)
+		}
+	}
+}
+
+func TestELF64SameSize(t *testing.T) {
+	input := corpusInput(t, "shared64_be.so")
+	output, report, e := stringreplace.Replace(input, stringreplace.Options{
+		Rules: []stringreplace.Rule{{
+			Match:       regexp.MustCompile(`^libc\.so\.6$`),
+			Replacement: "libk.so.6",
+		}, {
+			Match:       regexp.MustCompile(`^GLIBC_2\.0$`),
+			Replacement: "GLIBC_2.1",
+		}},
+		SameSize: true,
+	})
+	if e != nil {
+		t.Fatalf("Failed patching shared64_be.so: %s", e)
+	}
+	if len(output) != len(input) {
+		t.Errorf("The file's size changed from %d to %d bytes", len(input),
+			len(output))
+	}
+	if len(report.NewSegments) != 0 {
+		t.Errorf("Expected no segments to be added, got %d",
+			len(report.NewSegments))
+	}
+	f := parseTestELF64(t, output)
+	imported, e := f.ImportedSymbols()
+	if e != nil {
+		t.Fatalf("Failed reading the imported symbols: %s", e)
+	}
+	if (len(imported) != 1) || (imported[0].Version != "GLIBC_2.1") ||
+		(imported[0].Library != "libk.so.6") {
+		t.Errorf("Got unexpected imported symbols: %v", imported)
+	}
+	// The vna_hash field must match the new version name.
+	content := sectionData64(t, f, ".gnu.version_r")
+	auxOffset := f.ByteOrder.Uint32(content[8:])
+	hash := f.ByteOrder.Uint32(content[auxOffset:])
+	if hash != corpusELFHash("GLIBC_2.1") {
+		t.Errorf("vna_hash wasn't updated for the new version name")
+	}
+}
+
+func TestELF64HashTables(t *testing.T) {
+	input := corpusInput(t, "shared64_le.so")
+	for _, inPlace := range []bool{false, true} {
+		replacement := "corpus_function_with_a_longer_name"
+		if inPlace {
+			replacement = "corpus_fn"
+		}
+		output, _, e := stringreplace.Replace(input, stringreplace.Options{
+			Rules: []stringreplace.Rule{{
+				Match:       regexp.MustCompile(`^corpus_function$`),
+				Replacement: replacement,
+			}},
+			InPlace: inPlace,
+		})
+		if e != nil {
+			t.Fatalf("Failed renaming corpus_function to %s: %s",
+				replacement, e)
+		}
+		f := parseTestELF64(t, output)
+		if i := lookupSysv64(t, f, replacement); i != 1 {
+			t.Errorf("Expected %s to be symbol 1 in .hash, got %d",
+				replacement, i)
+		}
+		if i := lookupGNU64(t, f, replacement); i != 1 {
+			t.Errorf("Expected %s to be symbol 1 in .gnu.hash, got %d",
+				replacement, i)
+		}
+		if (lookupSysv64(t, f, "corpus_function") != 0) ||
+			(lookupGNU64(t, f, "corpus_function") != 0) {
+			t.Errorf("Could still look up corpus_function after renaming "+
+				"it to %s", replacement)
+		}
+		if (lookupSysv64(t, f, "puts") != 2) ||
+			(lookupGNU64(t, f, "puts") != 2) {
+			t.Errorf("Couldn't look up puts after renaming corpus_function "+
+				"to %s", replacement)
+		}
+	}
+}
+
+func TestELF64UnsupportedOptions(t *testing.T) {
+	input := corpusInput(t, "shared64_le.so")
+	rules := []stringreplace.Rule{{
+		Match:       regexp.MustCompile(`^libc\.so\.6$`),
+		Replacement: "libk.so.6",
+	}}
+	tests := []stringreplace.Options{
+		{AddNeeded: []string{"libm.so.6"}},
+		{Rules: rules, Explain: true},
+		{Rules: rules, ProgramHeadersFirst: true},
+	}
+	for i, options := range tests {
+		_, _, e := stringreplace.Replace(input, options)
+		if e == nil {
+			t.Errorf("Didn't get an error using unsupported options %d", i)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+// This file contains helpers for the -embedded_offset flag, which allows
+// patching an ELF file contained in a larger image.
+
+import (
+	"fmt"
+	"github.com/yalue/elf32_string_replace/stringreplace"
+	"strconv"
+)
+
+// Returns the offset of the embedded ELF file in the given image, based on
+// the -embedded_offset flag's value: either a number (hex values must start
+// with 0x), or "auto" to search for the first ELF file in the image.
+func resolveEmbeddedOffset(image []byte, setting string) (int, error) {
+	if setting == "auto" {
+		offset := stringreplace.FindEmbeddedELF(image, 0)
+		if offset < 0 {
+			return 0, fmt.Errorf("No 32-bit ELF file found in the input")
+		}
+		return offset, nil
+	}
+	offset, e := strconv.ParseUint(setting, 0, 32)
+	if e != nil {
+		return 0, fmt.Errorf("Invalid embedded ELF offset: %s", e)
+	}
+	if offset >= uint64(len(image)) {
+		return 0, fmt.Errorf("Embedded ELF offset 0x%x is past the end of "+
+			"the input", offset)
+	}
+	return int(offset), nil
+}
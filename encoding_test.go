@@ -0,0 +1,42 @@
+package main
+
+import (
+	"github.com/yalue/elf32_string_replace/stringreplace"
+	"regexp"
+	"testing"
+)
+
+func TestShiftJISReplacement(t *testing.T) {
+	options := stringreplace.Options{
+		Rules: []stringreplace.Rule{{
+			Match:       regexp.MustCompile(`^libc\.so\.6$`),
+			Replacement: "libc_日本.so.6",
+		}},
+		Encoding: stringreplace.ShiftJISEncoding,
+	}
+	output, _, e := stringreplace.Replace(corpusInput(t, "shared_le.so"),
+		options)
+	if e != nil {
+		t.Fatalf("Failed writing a Shift-JIS dependency: %s", e)
+	}
+	// DT_NEEDED is 1.
+	needed := dynamicString(t, parseTestELF(t, output), 1)
+	if needed != "libc_\x93\xfa\x96\x7b.so.6" {
+		t.Fatalf("Expected the dependency to be encoded in Shift-JIS, got "+
+			"%x", needed)
+	}
+	// The rules match the decoded text, and ソ's second byte is '\'.
+	options.Rules = []stringreplace.Rule{{
+		Match:       regexp.MustCompile(`_日本\.`),
+		Replacement: "_ソ.",
+	}}
+	output, _, e = stringreplace.Replace(output, options)
+	if e != nil {
+		t.Fatalf("Failed replacing a Shift-JIS dependency: %s", e)
+	}
+	needed = dynamicString(t, parseTestELF(t, output), 1)
+	if needed != "libc_\x83\x5c.so.6" {
+		t.Errorf("Expected the dependency to be libc_ソ.so.6 in Shift-JIS, "+
+			"got %x", needed)
+	}
+}
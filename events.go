@@ -0,0 +1,77 @@
+package main
+
+// This file implements the -events flag, which writes a newline-delimited
+// JSON object for each action taken while patching, so that wrappers can
+// display progress and results as they happen.
+
+import (
+	"encoding/json"
+	"github.com/yalue/elf32_string_replace/stringreplace"
+	"log"
+	"os"
+)
+
+// A single line of the event stream: an event from the library, along with
+// the file it applies to.
+type fileEvent struct {
+	File string `json:"file"`
+	*stringreplace.Event
+}
+
+// Writes events to a file (or stdout) as newline-delimited JSON.
+type eventWriter struct {
+	output  *os.File
+	encoder *json.Encoder
+	// The name of the file currently being patched, included in each event.
+	currentFile string
+	// Set after the first write error, so the error is only logged once.
+	failed bool
+}
+
+// Creates the file at the given path, or uses stdout if the path is "-", and
+// returns an eventWriter writing to it.
+func newEventWriter(path string) (*eventWriter, error) {
+	output := os.Stdout
+	if path != "-" {
+		var e error
+		output, e = os.Create(path)
+		if e != nil {
+			return nil, e
+		}
+	}
+	return &eventWriter{
+		output:  output,
+		encoder: json.NewEncoder(output),
+	}, nil
+}
+
+// Sets the name of the file included in subsequent events. Does nothing if w
+// is nil, so callers needn't check whether events are enabled.
+func (w *eventWriter) setFile(name string) {
+	if w == nil {
+		return
+	}
+	w.currentFile = name
+}
+
+// Writes a single event. Implements stringreplace.EventHandler.
+func (w *eventWriter) handle(event *stringreplace.Event) {
+	if w.failed {
+		return
+	}
+	e := w.encoder.Encode(&fileEvent{
+		File:  w.currentFile,
+		Event: event,
+	})
+	if e != nil {
+		log.Printf("Failed writing event: %s\n", e)
+		w.failed = true
+	}
+}
+
+// Closes the output file, unless it's stdout.
+func (w *eventWriter) close() {
+	if w.output != os.Stdout {
+		w.output.Close()
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+// This file implements the -explain flag's summary of why each rule did or
+// didn't take effect in each string table.
+
+import (
+	"fmt"
+	"github.com/yalue/elf32_string_replace/stringreplace"
+	"io"
+)
+
+// Writes the report's explanations to w, grouped by rule. The rules must be
+// the ones used to produce the report.
+func writeRuleExplanations(w io.Writer, name string,
+	rules []stringreplace.Rule, report *stringreplace.Report) {
+	fmt.Fprintf(w, "Rule explanations for %s:\n", name)
+	for i := range rules {
+		rule := &(rules[i])
+		fmt.Fprintf(w, "Rule %d (%s -> %s):\n", i,
+			stringreplace.EscapeString(rule.Match.String()),
+			stringreplace.EscapeString(rule.Replacement))
+		found := false
+		for _, x := range report.Explanations {
+			if x.Rule != i {
+				continue
+			}
+			found = true
+			fmt.Fprintf(w, "  %s (section %d): %s: %s\n", x.Section,
+				x.SectionIndex, x.Outcome, x.Detail)
+		}
+		if !found {
+			fmt.Fprintf(w, "  The file contains no string tables.\n")
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+// This file implements the read-only "grep" subcommand, which lists the
+// string table entries matching a regular expression, with enough detail to
+// build a replacement command that targets exactly those entries.
+
+import (
+	"flag"
+	"fmt"
+	"github.com/yalue/elf32_string_replace/stringreplace"
+	"github.com/yalue/elf_reader"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Holds a single string table entry matched by the grep subcommand.
+type grepMatch struct {
+	sectionIndex uint16
+	sectionName  string
+	// The entry's offset in the string table, which is the value stored in
+	// references to it.
+	tableOffset uint32
+	fileOffset  uint32
+	// The virtual address of the entry. Only valid if hasVirtualAddress is
+	// true.
+	virtualAddress    uint32
+	hasVirtualAddress bool
+	content           string
+}
+
+// Returns the string quoted for a POSIX shell, using single quotes.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", "'\\''", -1) + "'"
+}
+
+// Returns every non-empty entry matching regex in the file's string tables.
+// If onlySection isn't empty, only the table in the section with that name is
+// searched.
+func findStringTableEntries(f *elf_reader.ELF32File, regex *regexp.Regexp,
+	onlySection string) ([]grepMatch, error) {
+	toReturn := make([]grepMatch, 0, 8)
+	for i := range f.Sections {
+		if !f.IsStringTable(uint16(i)) {
+			continue
+		}
+		section := &(f.Sections[i])
+		name, e := stringreplace.SectionName(f, uint16(i))
+		if e != nil {
+			name = fmt.Sprintf("<section %d>", i)
+		}
+		if (onlySection != "") && (name != onlySection) {
+			continue
+		}
+		content, e := f.GetSectionContent(uint16(i))
+		if e != nil {
+			return nil, fmt.Errorf("Failed reading section %d: %s", i, e)
+		}
+		var offset uint32
+		for _, s := range strings.Split(string(content), "\x00") {
+			start := offset
+			offset += uint32(len(s)) + 1
+			if (s == "") || !regex.MatchString(s) {
+				continue
+			}
+			toReturn = append(toReturn, grepMatch{
+				sectionIndex:      uint16(i),
+				sectionName:       name,
+				tableOffset:       start,
+				fileOffset:        section.FileOffset + start,
+				virtualAddress:    section.VirtualAddress + start,
+				hasVirtualAddress: sectionIsAllocated(section),
+				content:           s,
+			})
+		}
+	}
+	return toReturn, nil
+}
+
+// Writes one line to w for each match, ending with a -to_match argument that
+// matches only the entry's exact text, ready to paste into a replace command.
+func writeGrepMatches(w io.Writer, matches []grepMatch) {
+	var address string
+	for i := range matches {
+		m := &(matches[i])
+		address = "-"
+		if m.hasVirtualAddress {
+			address = fmt.Sprintf("0x%08x", m.virtualAddress)
+		}
+		fmt.Fprintf(w, "%-20s +0x%06x  offset 0x%08x  VA %-10s  %s  "+
+			"-to_match %s\n", stringreplace.EscapeString(m.sectionName),
+			m.tableOffset, m.fileOffset, address,
+			stringreplace.EscapeString(m.content),
+			shellQuote("^"+regexp.QuoteMeta(m.content)+"$"))
+	}
+}
+
+// Runs the "grep" subcommand, with the given arguments, not including the
+// subcommand name itself. The arguments are flags followed by a regular
+// expression and the path to an ELF file. Returns the process exit code: 0
+// if any entry matched, 1 if none did, and 2 on errors, like grep.
+func runGrepCommand(arguments []string) int {
+	var onlySection string
+	flags := flag.NewFlagSet("grep", flag.ContinueOnError)
+	flags.StringVar(&onlySection, "section", "", "If set, only search the "+
+		"string table in the section with this name.")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: grep [flags] <regex> <file>\n")
+		flags.PrintDefaults()
+	}
+	e := flags.Parse(arguments)
+	if e != nil {
+		return 2
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return 2
+	}
+	regex, e := regexp.Compile(flags.Arg(0))
+	if e != nil {
+		log.Printf("Failed processing the regular expression: %s\n", e)
+		return 2
+	}
+	rawInput, e := ioutil.ReadFile(flags.Arg(1))
+	if e != nil {
+		log.Printf("Failed reading input file: %s\n", e)
+		return 2
+	}
+	elf, e := stringreplace.ParseELF32File(rawInput)
+	if e != nil {
+		log.Printf("Failed parsing the input file: %s\n", e)
+		return 2
+	}
+	matches, e := findStringTableEntries(elf, regex, onlySection)
+	if e != nil {
+		log.Printf("Failed searching the string tables: %s\n", e)
+		return 2
+	}
+	writeGrepMatches(os.Stdout, matches)
+	if len(matches) == 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,78 @@
+package main
+
+// This file implements the -max_growth flag, which fails the run rather than
+// producing an output file that's grown by more than a set amount, e.g. to
+// keep images within the space available on a device's flash.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Holds the value of the -max_growth flag: a number of bytes, or a
+// percentage of the input's size. Implements flag.Value.
+type growthLimit struct {
+	// False if the flag wasn't set, in which case there's no limit.
+	set     bool
+	bytes   uint64
+	percent float64
+	// True if percent is used rather than bytes.
+	isPercent bool
+}
+
+func (l *growthLimit) String() string {
+	if !l.set {
+		return ""
+	}
+	if l.isPercent {
+		return strconv.FormatFloat(l.percent, 'g', -1, 64) + "%"
+	}
+	return strconv.FormatUint(l.bytes, 10)
+}
+
+// Parses a limit in the format <bytes> or <percent>%.
+func (l *growthLimit) Set(value string) error {
+	if strings.HasSuffix(value, "%") {
+		percent, e := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if (e != nil) || (percent < 0) {
+			return fmt.Errorf("Invalid percentage: %s", value)
+		}
+		l.percent = percent
+		l.isPercent = true
+	} else {
+		bytes, e := strconv.ParseUint(value, 0, 64)
+		if e != nil {
+			return fmt.Errorf("Invalid number of bytes: %s", e)
+		}
+		l.bytes = bytes
+		l.isPercent = false
+	}
+	l.set = true
+	return nil
+}
+
+// Returns the largest number of bytes by which a file of the given size may
+// grow.
+func (l *growthLimit) allowedGrowth(inputSize int) uint64 {
+	if !l.isPercent {
+		return l.bytes
+	}
+	return uint64(float64(inputSize) * l.percent / 100)
+}
+
+// Returns an error if the output of patching the named file is larger than
+// its input by more than the limit. Does nothing if the limit isn't set.
+func (l *growthLimit) check(name string, inputSize, outputSize int) error {
+	if !l.set || (outputSize <= inputSize) {
+		return nil
+	}
+	growth := uint64(outputSize - inputSize)
+	allowed := l.allowedGrowth(inputSize)
+	if growth <= allowed {
+		return nil
+	}
+	return fmt.Errorf("Patching %s would grow it by %d bytes (from %d to %d), "+
+		"more than the %d allowed by -max_growth %s", name, growth, inputSize,
+		outputSize, allowed, l.String())
+}
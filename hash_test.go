@@ -0,0 +1,183 @@
+package main
+
+import (
+	"github.com/yalue/elf32_string_replace/stringreplace"
+	"github.com/yalue/elf_reader"
+	"regexp"
+	"testing"
+)
+
+// Looks up dynamic symbols in a file's hash tables the way the dynamic linker
+// does, starting from the DT_HASH and DT_GNU_HASH entries.
+type hashLookup struct {
+	t *testing.T
+	f *elf_reader.ELF32File
+	// The 32-bit words of each hash table.
+	sysv, gnu []uint32
+	// The dynamic symbol table and its string table.
+	symbols, names []byte
+}
+
+// Returns the content of the section loaded at the address in the dynamic
+// table entry with the given tag, failing the test if there isn't one.
+func dynamicTarget(t *testing.T, f *elf_reader.ELF32File,
+	tag elf_reader.ELF32DynamicTag) []byte {
+	var address uint32
+	found := false
+	for i := range f.Sections {
+		if !f.IsDynamicSection(uint16(i)) {
+			continue
+		}
+		entries, e := f.GetDynamicTable(uint16(i))
+		if e != nil {
+			t.Fatalf("Failed reading the dynamic table: %s", e)
+		}
+		for _, entry := range entries {
+			if entry.Tag == tag {
+				address = entry.Value
+				found = true
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("The file has no dynamic entry with tag 0x%x", tag)
+	}
+	for i := range f.Sections {
+		if (f.Sections[i].VirtualAddress != address) ||
+			(f.Sections[i].Size == 0) {
+			continue
+		}
+		content, e := f.GetSectionContent(uint16(i))
+		if e != nil {
+			t.Fatalf("Failed reading section %d: %s", i, e)
+		}
+		return content
+	}
+	t.Fatalf("No section is loaded at 0x%08x, the address for dynamic "+
+		"tag 0x%x", address, tag)
+	return nil
+}
+
+func newHashLookup(t *testing.T, content []byte) *hashLookup {
+	f := parseTestELF(t, content)
+	toReturn := &hashLookup{
+		t: t,
+		f: f,
+	}
+	words := func(content []byte) []uint32 {
+		w := make([]uint32, len(content)/4)
+		for i := range w {
+			w[i] = f.Endianness.Uint32(content[4*i:])
+		}
+		return w
+	}
+	// DT_HASH, DT_GNU_HASH, DT_SYMTAB, and DT_STRTAB.
+	toReturn.sysv = words(dynamicTarget(t, f, 4))
+	toReturn.gnu = words(dynamicTarget(t, f, 0x6ffffef5))
+	toReturn.symbols = dynamicTarget(t, f, 6)
+	toReturn.names = dynamicTarget(t, f, 5)
+	return toReturn
+}
+
+// Returns the name of the dynamic symbol with the given index.
+func (h *hashLookup) symbolName(index uint32) string {
+	offset := h.f.Endianness.Uint32(h.symbols[16*index:])
+	name, e := elf_reader.ReadStringAtOffset(offset, h.names)
+	if e != nil {
+		h.t.Fatalf("Failed reading symbol %d's name: %s", index, e)
+	}
+	return string(name)
+}
+
+// Returns the index of the symbol found by looking up the name in the SysV
+// hash table, or 0 if it isn't found.
+func (h *hashLookup) lookupSysv(name string) uint32 {
+	bucketCount := h.sysv[0]
+	buckets := h.sysv[2:]
+	chains := h.sysv[2+bucketCount:]
+	for i := buckets[corpusELFHash(name)%bucketCount]; i != 0; i = chains[i] {
+		if h.symbolName(i) == name {
+			return i
+		}
+	}
+	return 0
+}
+
+// Like lookupSysv, but using the GNU hash table.
+func (h *hashLookup) lookupGNU(name string) uint32 {
+	bucketCount := h.gnu[0]
+	symbolOffset := h.gnu[1]
+	bloomSize := h.gnu[2]
+	bloomShift := h.gnu[3]
+	bloom := h.gnu[4 : 4+bloomSize]
+	buckets := h.gnu[4+bloomSize : 4+bloomSize+bucketCount]
+	chain := h.gnu[4+bloomSize+bucketCount:]
+	hash := corpusGNUHash(name)
+	word := bloom[(hash/32)%bloomSize]
+	if ((word>>(hash%32))&1) == 0 ||
+		((word>>((hash>>bloomShift)%32))&1) == 0 {
+		return 0
+	}
+	i := buckets[hash%bucketCount]
+	if i == 0 {
+		return 0
+	}
+	for {
+		value := chain[i-symbolOffset]
+		if ((value | 1) == (hash | 1)) && (h.symbolName(i) == name) {
+			return i
+		}
+		if (value & 1) != 0 {
+			return 0
+		}
+		i++
+	}
+}
+
+func TestHashTablesAfterRename(t *testing.T) {
+	replacements := []struct {
+		name    string
+		inPlace bool
+	}{
+		// A longer name requires relocating .dynstr, and a shorter one can
+		// overwrite the original.
+		{"corpus_function_with_a_longer_name", false},
+		{"corpus_fn", true},
+	}
+	input := corpusInput(t, "gnu_hash.so")
+	before := newHashLookup(t, input)
+	if (before.lookupSysv("corpus_function") != 1) ||
+		(before.lookupGNU("corpus_function") != 1) {
+		t.Fatalf("Couldn't look up corpus_function in the original file")
+	}
+	for _, r := range replacements {
+		output, _, e := stringreplace.Replace(input, stringreplace.Options{
+			Rules: []stringreplace.Rule{{
+				Match:       regexp.MustCompile(`^corpus_function$`),
+				Replacement: r.name,
+			}},
+			InPlace: r.inPlace,
+		})
+		if e != nil {
+			t.Fatalf("Failed renaming corpus_function to %s: %s", r.name, e)
+		}
+		after := newHashLookup(t, output)
+		if i := after.lookupSysv(r.name); i != 1 {
+			t.Errorf("Expected %s to be symbol 1 in .hash, got %d", r.name,
+				i)
+		}
+		if i := after.lookupGNU(r.name); i != 1 {
+			t.Errorf("Expected %s to be symbol 1 in .gnu.hash, got %d",
+				r.name, i)
+		}
+		if (after.lookupSysv("corpus_function") != 0) ||
+			(after.lookupGNU("corpus_function") != 0) {
+			t.Errorf("Could still look up corpus_function after renaming "+
+				"it to %s", r.name)
+		}
+		if (after.lookupSysv("puts") != 2) || (after.lookupGNU("puts") != 2) {
+			t.Errorf("Couldn't look up puts after renaming corpus_function "+
+				"to %s", r.name)
+		}
+	}
+}
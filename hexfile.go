@@ -0,0 +1,209 @@
+package main
+
+// This file contains support for reading and re-writing Intel HEX and
+// Motorola S-record files, so that ELF files stored in them (common for
+// microcontroller firmware) can be patched without manual conversion.
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Holds a single line of a hex file.
+type hexLine struct {
+	// The original text of the line, without the line ending.
+	text string
+	// The line ending, which is preserved when re-writing the file.
+	ending string
+	// True if this is a data record, in which case data holds its decoded
+	// content, and address holds the absolute address of the first byte.
+	isData  bool
+	address uint32
+	data    []byte
+	// The number of hex digits in the record's address field, for S-records.
+	addressDigits int
+}
+
+// Holds the content of an Intel HEX or S-record file.
+type hexFile struct {
+	// Either "ihex" or "srec".
+	format string
+	lines  []hexLine
+	memoryImage
+}
+
+// Returns the sum of the given bytes, modulo 256.
+func byteSum(data []byte) byte {
+	var toReturn byte
+	for _, b := range data {
+		toReturn += b
+	}
+	return toReturn
+}
+
+// Parses a single Intel HEX record. The upperAddress is the base set by the
+// most recent extended address record, and is updated if this is one.
+func parseIntelHexLine(line *hexLine, upperAddress *uint32) error {
+	if !strings.HasPrefix(line.text, ":") {
+		return fmt.Errorf("Record doesn't start with ':'")
+	}
+	record, e := hex.DecodeString(line.text[1:])
+	if e != nil {
+		return fmt.Errorf("Invalid record: %s", e)
+	}
+	if (len(record) < 5) || (len(record) != (int(record[0]) + 5)) {
+		return fmt.Errorf("Invalid record length")
+	}
+	if byteSum(record) != 0 {
+		return fmt.Errorf("Bad checksum")
+	}
+	data := record[4 : len(record)-1]
+	offset := (uint32(record[1]) << 8) | uint32(record[2])
+	switch record[3] {
+	case 0:
+		line.isData = true
+		line.address = *upperAddress + offset
+		line.data = data
+	case 2:
+		if len(data) != 2 {
+			return fmt.Errorf("Invalid extended segment address record")
+		}
+		*upperAddress = ((uint32(data[0]) << 8) | uint32(data[1])) << 4
+	case 4:
+		if len(data) != 2 {
+			return fmt.Errorf("Invalid extended linear address record")
+		}
+		*upperAddress = ((uint32(data[0]) << 8) | uint32(data[1])) << 16
+	}
+	return nil
+}
+
+// Parses a single Motorola S-record.
+func parseSRecordLine(line *hexLine) error {
+	if (len(line.text) < 2) || (line.text[0] != 'S') {
+		return fmt.Errorf("Record doesn't start with 'S'")
+	}
+	record, e := hex.DecodeString(line.text[2:])
+	if e != nil {
+		return fmt.Errorf("Invalid record: %s", e)
+	}
+	if (len(record) < 2) || (len(record) != (int(record[0]) + 1)) {
+		return fmt.Errorf("Invalid record length")
+	}
+	if byteSum(record) != 0xff {
+		return fmt.Errorf("Bad checksum")
+	}
+	var addressSize int
+	switch line.text[1] {
+	case '1':
+		addressSize = 2
+	case '2':
+		addressSize = 3
+	case '3':
+		addressSize = 4
+	default:
+		// Header, count, and start address records aren't modified.
+		return nil
+	}
+	if len(record) < (addressSize + 2) {
+		return fmt.Errorf("Invalid data record length")
+	}
+	line.isData = true
+	line.addressDigits = addressSize * 2
+	for _, b := range record[1 : addressSize+1] {
+		line.address = (line.address << 8) | uint32(b)
+	}
+	line.data = record[addressSize+1 : len(record)-1]
+	return nil
+}
+
+// Parses the content of an Intel HEX or S-record file, and reconstructs the
+// memory image it contains.
+func parseHexFile(content []byte, format string) (*hexFile, error) {
+	toReturn := &hexFile{
+		format: format,
+		lines:  make([]hexLine, 0, 1024),
+	}
+	var upperAddress uint32
+	var line hexLine
+	var e error
+	for i, text := range strings.SplitAfter(string(content), "\n") {
+		if text == "" {
+			continue
+		}
+		line = hexLine{text: strings.TrimRight(text, "\r\n")}
+		line.ending = text[len(line.text):]
+		if line.text != "" {
+			if format == "ihex" {
+				e = parseIntelHexLine(&line, &upperAddress)
+			} else {
+				e = parseSRecordLine(&line)
+			}
+			if e != nil {
+				return nil, fmt.Errorf("Line %d: %s", i+1, e)
+			}
+		}
+		toReturn.lines = append(toReturn.lines, line)
+	}
+	chunks := make([]imageChunk, 0, len(toReturn.lines))
+	for _, l := range toReturn.lines {
+		if l.isData {
+			chunks = append(chunks, imageChunk{l.address, l.data})
+		}
+	}
+	e = toReturn.build(chunks)
+	if e != nil {
+		return nil, e
+	}
+	return toReturn, nil
+}
+
+// Returns the text of the given data record, updated to contain the given
+// data, with a recomputed checksum.
+func (h *hexFile) encodeDataLine(line *hexLine, data []byte) string {
+	var record []byte
+	if h.format == "ihex" {
+		// Keep the original length, address and type fields.
+		record, _ = hex.DecodeString(line.text[1:9])
+		record = append(record, data...)
+		record = append(record, -byteSum(record))
+		return ":" + strings.ToUpper(hex.EncodeToString(record))
+	}
+	record, _ = hex.DecodeString(line.text[2 : 4+line.addressDigits])
+	record = append(record, data...)
+	record = append(record, 0xff-byteSum(record))
+	return line.text[0:2] + strings.ToUpper(hex.EncodeToString(record))
+}
+
+// Returns the name of the file's format.
+func (h *hexFile) formatName() string {
+	return h.format
+}
+
+// Returns the content of the hex file, with its data records updated to
+// match the (possibly modified) image. Returns an error if any modified byte
+// isn't covered by a data record, since records are never added.
+func (h *hexFile) encode() ([]byte, error) {
+	e := h.checkUncoveredChanges()
+	if e != nil {
+		return nil, e
+	}
+	var output bytes.Buffer
+	var data []byte
+	for i := range h.lines {
+		line := &(h.lines[i])
+		if !line.isData {
+			output.WriteString(line.text + line.ending)
+			continue
+		}
+		data = h.imageData(line.address, len(line.data))
+		if bytes.Equal(data, line.data) {
+			output.WriteString(line.text + line.ending)
+			continue
+		}
+		output.WriteString(h.encodeDataLine(line, data) + line.ending)
+	}
+	return output.Bytes(), nil
+}
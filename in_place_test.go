@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"github.com/yalue/elf32_string_replace/stringreplace"
+	"regexp"
+	"testing"
+)
+
+// The rule renaming suffix_sharing.so's SONAME, whose last bytes hold the
+// name of its dependency, util.so.
+func sonameRule(replacement string) []stringreplace.Rule {
+	return []stringreplace.Rule{{
+		Match:       regexp.MustCompile(`^libcorpus_util\.so$`),
+		Replacement: replacement,
+	}}
+}
+
+// Checks that the output's SONAME was replaced, and that the dependency
+// sharing its suffix was left alone.
+func checkSharedSuffix(t *testing.T, output []byte, soname string) {
+	f := parseTestELF(t, output)
+	// DT_SONAME is 14, and DT_NEEDED is 1.
+	if s := dynamicString(t, f, 14); s != soname {
+		t.Errorf("Expected the SONAME to be %q, got %q", soname, s)
+	}
+	if s := dynamicString(t, f, 1); s != "util.so" {
+		t.Errorf("The dependency sharing the SONAME's suffix was changed "+
+			"to %q", s)
+	}
+}
+
+func TestInPlaceSharedSuffix(t *testing.T) {
+	input := corpusInput(t, "suffix_sharing.so")
+	// Overwriting the SONAME would rename the dependency, so same-size
+	// modes must fail.
+	_, _, e := stringreplace.Replace(input, stringreplace.Options{
+		Rules:    sonameRule("libcorpus_abcd.so"),
+		InPlace:  true,
+		SameSize: true,
+	})
+	if e == nil {
+		t.Errorf("Replacing a string sharing its suffix in place didn't " +
+			"fail")
+	}
+	_, e = stringreplace.ReplaceEmbedded(input, 0, stringreplace.Options{
+		Rules: sonameRule("libcorpus_abcd.so"),
+	})
+	if e == nil {
+		t.Errorf("Replacing a string sharing its suffix in an embedded " +
+			"image didn't fail")
+	}
+	// The fallback mode appends the replacement instead.
+	output, _, e := stringreplace.Replace(input, stringreplace.Options{
+		Rules:   sonameRule("libcorpus_abcd.so"),
+		InPlace: true,
+	})
+	if e != nil {
+		t.Fatalf("Patching with InPlace failed: %s", e)
+	}
+	checkSharedSuffix(t, output, "libcorpus_abcd.so")
+	// A replacement keeping the shared suffix can still be made in place.
+	output, _, e = stringreplace.Replace(input, stringreplace.Options{
+		Rules:    sonameRule("libcorpus2util.so"),
+		InPlace:  true,
+		SameSize: true,
+	})
+	if e != nil {
+		t.Fatalf("Replacing a string in place without changing its "+
+			"suffix failed: %s", e)
+	}
+	if len(output) != len(input) {
+		t.Errorf("The file's size changed from %d to %d bytes", len(input),
+			len(output))
+	}
+	checkSharedSuffix(t, output, "libcorpus2util.so")
+}
+
+func TestInPlaceUnknownReferences(t *testing.T) {
+	// Nothing known refers to unreferenced_strtab.so's .stabstr, so
+	// something unknown may point into the middle of any of its strings.
+	input := corpusInput(t, "unreferenced_strtab.so")
+	rules := []stringreplace.Rule{{
+		Match:       regexp.MustCompile(`^libc\.so\.6$`),
+		Replacement: "libk.so.6",
+		Sections:    []string{".stabstr"},
+	}}
+	_, _, e := stringreplace.Replace(input, stringreplace.Options{
+		Rules:    rules,
+		SameSize: true,
+	})
+	if e == nil {
+		t.Errorf("Replacing a string in place in a table with unknown " +
+			"references didn't fail")
+	}
+	// The fallback mode appends the replacement, leaving the original
+	// bytes alone.
+	output, _, e := stringreplace.Replace(input, stringreplace.Options{
+		Rules:   rules,
+		InPlace: true,
+	})
+	if e != nil {
+		t.Fatalf("Patching with InPlace failed: %s", e)
+	}
+	f := parseTestELF(t, output)
+	original := sectionContent(t, parseTestELF(t, input), ".stabstr")
+	content := sectionContent(t, f, ".stabstr")
+	if !bytes.HasPrefix(content, original) {
+		t.Errorf("The original .stabstr content was overwritten")
+	}
+	if !bytes.Contains(content[len(original):], []byte("libk.so.6\x00")) {
+		t.Errorf("The replacement wasn't appended to .stabstr")
+	}
+}
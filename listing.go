@@ -0,0 +1,348 @@
+package main
+
+// This file contains code for printing a readelf-style listing of the ELF
+// structures affected by string replacement, with "before" and "after"
+// columns.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/yalue/elf32_string_replace/stringreplace"
+	"github.com/yalue/elf_reader"
+	"io"
+	"strings"
+)
+
+// Maps dynamic table tags to the names used by readelf.
+var dynamicTagNames = map[uint32]string{
+	0:          "NULL",
+	1:          "NEEDED",
+	2:          "PLTRELSZ",
+	3:          "PLTGOT",
+	4:          "HASH",
+	5:          "STRTAB",
+	6:          "SYMTAB",
+	7:          "RELA",
+	8:          "RELASZ",
+	9:          "RELAENT",
+	10:         "STRSZ",
+	11:         "SYMENT",
+	12:         "INIT",
+	13:         "FINI",
+	14:         "SONAME",
+	15:         "RPATH",
+	16:         "SYMBOLIC",
+	17:         "REL",
+	18:         "RELSZ",
+	19:         "RELENT",
+	20:         "PLTREL",
+	21:         "DEBUG",
+	22:         "TEXTREL",
+	23:         "JMPREL",
+	24:         "BIND_NOW",
+	25:         "INIT_ARRAY",
+	26:         "FINI_ARRAY",
+	27:         "INIT_ARRAYSZ",
+	28:         "FINI_ARRAYSZ",
+	29:         "RUNPATH",
+	30:         "FLAGS",
+	0x6ffffef5: "GNU_HASH",
+	0x6ffffff0: "VERSYM",
+	0x6ffffffa: "RELCOUNT",
+	0x6ffffffb: "FLAGS_1",
+	0x6ffffffc: "VERDEF",
+	0x6ffffffd: "VERDEFNUM",
+	0x6ffffffe: "VERNEED",
+	0x6fffffff: "VERNEEDNUM",
+}
+
+// Returns the readelf-style name for a dynamic table tag.
+func dynamicTagName(tag uint32) string {
+	name, ok := dynamicTagNames[tag]
+	if !ok {
+		return fmt.Sprintf("0x%08x", tag)
+	}
+	return name
+}
+
+// Returns true if the dynamic table entry with the given tag holds a string
+// table offset.
+func isDynamicStringTag(tag uint32) bool {
+	return (tag == 1) || (tag == 14) || (tag == 15) || (tag == 29)
+}
+
+// Returns the string at the given offset in the given string table section,
+// or a placeholder if it can't be read.
+func readListingString(f *elf_reader.ELF32File, tableIndex uint32,
+	offset uint32) string {
+	content, e := f.GetSectionContent(uint16(tableIndex))
+	if e != nil {
+		return fmt.Sprintf("<bad table %d>", tableIndex)
+	}
+	s, e := elf_reader.ReadStringAtOffset(offset, content)
+	if e != nil {
+		return fmt.Sprintf("<bad offset %d>", offset)
+	}
+	return stringreplace.EscapeString(string(s))
+}
+
+// Returns the index of the first section satisfying the given predicate, or
+// -1 if no such section exists.
+func findSection(f *elf_reader.ELF32File, check func(uint16) bool) int {
+	for i := range f.Sections {
+		if check(uint16(i)) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Formats a "before -> after" column pair, or only the value if unchanged.
+func beforeAfter(before, after string) string {
+	if before == after {
+		return before
+	}
+	return before + " -> " + after
+}
+
+// Returns a description of the loadable segment containing the given file
+// range, including its permissions.
+func describeLoadSegment(f *elf_reader.ELF32File, offset, size uint32) string {
+	index := stringreplace.ContainingLoadSegment(f, offset, size)
+	if index < 0 {
+		return "(not loaded)"
+	}
+	s := &(f.Segments[index])
+	return fmt.Sprintf("LOAD[%d] %s", index,
+		strings.TrimSpace(stringreplace.SegmentFlagsString(uint32(s.Flags))))
+}
+
+// Returns "*" if the given values differ, to mark changed lines.
+func changeMarker(changed bool) string {
+	if changed {
+		return "*"
+	}
+	return " "
+}
+
+// Writes a listing of section headers that differ between the two files.
+func writeSectionListing(w io.Writer, before, after *elf_reader.ELF32File) {
+	fmt.Fprintf(w, "Section headers (changed entries only):\n")
+	fmt.Fprintf(w, "  [Nr] %-20s %-24s %-24s %s\n", "Name", "Offset", "Addr",
+		"Size")
+	var a, b *elf_reader.ELF32SectionHeader
+	var nameBefore, nameAfter string
+	for i := range after.Sections {
+		if i >= len(before.Sections) {
+			break
+		}
+		b = &(before.Sections[i])
+		a = &(after.Sections[i])
+		if *a == *b {
+			continue
+		}
+		nameBefore, _ = stringreplace.SectionName(before, uint16(i))
+		nameAfter, _ = stringreplace.SectionName(after, uint16(i))
+		fmt.Fprintf(w, "* [%2d] %-20s %-24s %-24s %s\n", i,
+			beforeAfter(stringreplace.EscapeString(nameBefore),
+				stringreplace.EscapeString(nameAfter)),
+			beforeAfter(fmt.Sprintf("0x%x", b.FileOffset),
+				fmt.Sprintf("0x%x", a.FileOffset)),
+			beforeAfter(fmt.Sprintf("0x%x", b.VirtualAddress),
+				fmt.Sprintf("0x%x", a.VirtualAddress)),
+			beforeAfter(fmt.Sprintf("0x%x", b.Size),
+				fmt.Sprintf("0x%x", a.Size)))
+		fmt.Fprintf(w, "       loaded by: %s\n", beforeAfter(
+			describeLoadSegment(before, b.FileOffset, b.Size),
+			describeLoadSegment(after, a.FileOffset, a.Size)))
+	}
+	fmt.Fprintf(w, "\n")
+}
+
+// Writes a listing of the program headers in the modified file, marking any
+// which were added or changed.
+func writeSegmentListing(w io.Writer, before, after *elf_reader.ELF32File) {
+	fmt.Fprintf(w, "Program headers:\n")
+	fmt.Fprintf(w, "    %-12s %-10s %-10s %-10s %-10s %s\n", "Type", "Offset",
+		"VirtAddr", "FileSiz", "MemSiz", "Flg")
+	var s *elf_reader.ELF32ProgramHeader
+	var changed bool
+	for i := range after.Segments {
+		s = &(after.Segments[i])
+		changed = (i >= len(before.Segments)) || (*s != before.Segments[i])
+		fmt.Fprintf(w, "  %s %-12s 0x%08x 0x%08x 0x%08x 0x%08x %s",
+			changeMarker(changed),
+			stringreplace.MachineSegmentTypeName(uint16(after.Header.Machine),
+				uint32(s.Type)),
+			s.FileOffset, s.VirtualAddress, s.FileSize, s.MemorySize,
+			stringreplace.SegmentFlagsString(uint32(s.Flags)))
+		if i >= len(before.Segments) {
+			fmt.Fprintf(w, " (new)")
+		}
+		fmt.Fprintf(w, "\n")
+	}
+	fmt.Fprintf(w, "\n")
+}
+
+// Writes a listing of the dynamic table, with before and after values.
+func writeDynamicListing(w io.Writer, before, after *elf_reader.ELF32File) {
+	index := findSection(after, after.IsDynamicSection)
+	if index < 0 {
+		return
+	}
+	entriesBefore, e := before.GetDynamicTable(uint16(index))
+	if e != nil {
+		fmt.Fprintf(w, "Failed parsing original dynamic table: %s\n\n", e)
+		return
+	}
+	entriesAfter, e := after.GetDynamicTable(uint16(index))
+	if e != nil {
+		fmt.Fprintf(w, "Failed parsing new dynamic table: %s\n\n", e)
+		return
+	}
+	linkBefore := before.Sections[index].LinkedIndex
+	linkAfter := after.Sections[index].LinkedIndex
+	fmt.Fprintf(w, "Dynamic section:\n")
+	fmt.Fprintf(w, "    %-12s %s\n", "Tag", "Value")
+	var tag uint32
+	var valueBefore, valueAfter string
+	for i := range entriesAfter {
+		if i >= len(entriesBefore) {
+			break
+		}
+		tag = uint32(entriesAfter[i].Tag)
+		if isDynamicStringTag(tag) {
+			valueBefore = readListingString(before, linkBefore,
+				entriesBefore[i].Value)
+			valueAfter = readListingString(after, linkAfter,
+				entriesAfter[i].Value)
+		} else {
+			valueBefore = fmt.Sprintf("0x%x", entriesBefore[i].Value)
+			valueAfter = fmt.Sprintf("0x%x", entriesAfter[i].Value)
+		}
+		fmt.Fprintf(w, "  %s %-12s %s\n",
+			changeMarker(valueBefore != valueAfter), dynamicTagName(tag),
+			beforeAfter(valueBefore, valueAfter))
+		if tag == 0 {
+			break
+		}
+	}
+	fmt.Fprintf(w, "\n")
+}
+
+// Writes a listing of the version requirement tree, with before and after
+// file and version names.
+func writeVersionRequirementListing(w io.Writer, before,
+	after *elf_reader.ELF32File) {
+	index := findSection(after, after.IsVersionRequirementSection)
+	if index < 0 {
+		return
+	}
+	needBefore, auxBefore, e := before.ParseVersionRequirementSection(
+		uint16(index))
+	if e != nil {
+		fmt.Fprintf(w, "Failed parsing original version needs: %s\n\n", e)
+		return
+	}
+	needAfter, auxAfter, e := after.ParseVersionRequirementSection(
+		uint16(index))
+	if e != nil {
+		fmt.Fprintf(w, "Failed parsing new version needs: %s\n\n", e)
+		return
+	}
+	linkBefore := before.Sections[index].LinkedIndex
+	linkAfter := after.Sections[index].LinkedIndex
+	fmt.Fprintf(w, "Version needs:\n")
+	var fileBefore, fileAfter, nameBefore, nameAfter string
+	for i := range needAfter {
+		if (i >= len(needBefore)) || (i >= len(auxBefore)) {
+			break
+		}
+		fileBefore = readListingString(before, linkBefore, needBefore[i].File)
+		fileAfter = readListingString(after, linkAfter, needAfter[i].File)
+		fmt.Fprintf(w, "  %s File: %s\n", changeMarker(fileBefore != fileAfter),
+			beforeAfter(fileBefore, fileAfter))
+		for j := range auxAfter[i] {
+			if j >= len(auxBefore[i]) {
+				break
+			}
+			nameBefore = readListingString(before, linkBefore,
+				auxBefore[i][j].Name)
+			nameAfter = readListingString(after, linkAfter, auxAfter[i][j].Name)
+			fmt.Fprintf(w, "  %s     Name: %s\n",
+				changeMarker(nameBefore != nameAfter),
+				beforeAfter(nameBefore, nameAfter))
+		}
+	}
+	fmt.Fprintf(w, "\n")
+}
+
+// Parses the symbols in the given symbol table section.
+func readSymbols(f *elf_reader.ELF32File,
+	sectionIndex uint16) ([]elf_reader.ELF32Symbol, error) {
+	content, e := f.GetSectionContent(sectionIndex)
+	if e != nil {
+		return nil, e
+	}
+	symbolSize := binary.Size(&elf_reader.ELF32Symbol{})
+	symbols := make([]elf_reader.ELF32Symbol, len(content)/symbolSize)
+	e = binary.Read(bytes.NewReader(content), f.Endianness, symbols)
+	if e != nil {
+		return nil, e
+	}
+	return symbols, nil
+}
+
+// Writes a listing of every symbol whose name was changed.
+func writeSymbolListing(w io.Writer, before, after *elf_reader.ELF32File) {
+	var symbolsBefore, symbolsAfter []elf_reader.ELF32Symbol
+	var e error
+	var sectionName, nameBefore, nameAfter string
+	var linkBefore, linkAfter uint32
+	for i := range after.Sections {
+		if !after.IsSymbolTable(uint16(i)) || (i >= len(before.Sections)) {
+			continue
+		}
+		symbolsBefore, e = readSymbols(before, uint16(i))
+		if e == nil {
+			symbolsAfter, e = readSymbols(after, uint16(i))
+		}
+		if e != nil {
+			fmt.Fprintf(w, "Failed reading symbols in section %d: %s\n\n", i, e)
+			continue
+		}
+		sectionName, _ = stringreplace.SectionName(after, uint16(i))
+		linkBefore = before.Sections[i].LinkedIndex
+		linkAfter = after.Sections[i].LinkedIndex
+		fmt.Fprintf(w, "Symbol table '%s' (renamed entries only):\n",
+			stringreplace.EscapeString(sectionName))
+		fmt.Fprintf(w, "     Num    Value      Name\n")
+		for j := range symbolsAfter {
+			if j >= len(symbolsBefore) {
+				break
+			}
+			nameBefore = readListingString(before, linkBefore,
+				symbolsBefore[j].Name)
+			nameAfter = readListingString(after, linkAfter,
+				symbolsAfter[j].Name)
+			if nameBefore == nameAfter {
+				continue
+			}
+			fmt.Fprintf(w, "  * %5d: 0x%08x %s\n", j, symbolsAfter[j].Value,
+				beforeAfter(nameBefore, nameAfter))
+		}
+		fmt.Fprintf(w, "\n")
+	}
+}
+
+// Writes a readelf-style listing of the structures affected by the string
+// replacements, comparing the original file to the modified one. Lines
+// starting with "*" have changed.
+func writeChangeListing(w io.Writer, before, after *elf_reader.ELF32File) {
+	writeSectionListing(w, before, after)
+	writeSegmentListing(w, before, after)
+	writeDynamicListing(w, before, after)
+	writeVersionRequirementListing(w, before, after)
+	writeSymbolListing(w, before, after)
+}
@@ -0,0 +1,64 @@
+package main
+
+// This file contains code for taking an advisory lock on a file being
+// patched in place, so concurrent invocations (e.g. from a parallel build)
+// don't patch the same file at once.
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Returned by lockFile if another process holds the lock.
+var errLockHeld = errors.New("the lock is held by another process")
+
+// Returns true if outputPath refers to the same existing file as inputPath,
+// meaning the input will be patched in place.
+func isInPlace(inputPath, outputPath string) bool {
+	if (outputPath == "") || (outputPath == "-") {
+		return false
+	}
+	inputInfo, e := os.Stat(inputPath)
+	if e != nil {
+		return false
+	}
+	outputInfo, e := os.Stat(outputPath)
+	if e != nil {
+		return false
+	}
+	return os.SameFile(inputInfo, outputInfo)
+}
+
+// Takes an exclusive advisory lock on the file at path, failing immediately
+// if another process holds it. Returns a function that releases the lock.
+// The output is replaced by renaming a new file over it, so this also fails
+// if the file was replaced by another process while the lock was being
+// taken.
+func lockTarget(path string) (func(), error) {
+	f, e := os.Open(path)
+	if e != nil {
+		return nil, fmt.Errorf("Failed opening %s to lock it: %s", path, e)
+	}
+	e = lockFile(f)
+	if e == errLockHeld {
+		f.Close()
+		return nil, fmt.Errorf("%s is being patched by another process", path)
+	}
+	if e != nil {
+		f.Close()
+		return nil, fmt.Errorf("Failed locking %s: %s", path, e)
+	}
+	lockedInfo, e := f.Stat()
+	if e != nil {
+		f.Close()
+		return nil, fmt.Errorf("Failed checking locked file %s: %s", path, e)
+	}
+	currentInfo, e := os.Stat(path)
+	if (e != nil) || !os.SameFile(lockedInfo, currentInfo) {
+		f.Close()
+		return nil, fmt.Errorf("%s was replaced by another process", path)
+	}
+	// Closing the file releases the lock.
+	return func() { f.Close() }, nil
+}
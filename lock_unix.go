@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Takes an exclusive flock on the file, without blocking. Returns
+// errLockHeld if another process holds it.
+func lockFile(f *os.File) error {
+	e := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if e == syscall.EWOULDBLOCK {
+		return errLockHeld
+	}
+	return e
+}
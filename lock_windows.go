@@ -0,0 +1,14 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+)
+
+// Advisory locks aren't supported on Windows, where files that are open
+// generally can't be replaced anyway, so this does nothing.
+func lockFile(f *os.File) error {
+	return nil
+}
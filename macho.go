@@ -0,0 +1,67 @@
+package main
+
+// This file contains the code for patching Mach-O files, in which only the
+// dependency names and paths in the load commands are replaced.
+
+import (
+	"fmt"
+	"github.com/yalue/elf32_string_replace/stringreplace"
+	"io"
+	"log"
+	"os"
+)
+
+// Writes the changes to w, in the same format as writeReplacementDiff.
+func writeMachODiff(w io.Writer, name string,
+	changes []stringreplace.MachOChange) {
+	fmt.Fprintf(w, "%sdiff %s%s\n", colorBold, name, colorReset)
+	for _, c := range changes {
+		fmt.Fprintf(w, "%s@@ %s (load command %d, image offset 0x%08x)%s\n",
+			colorBold, c.Command, c.CommandIndex, c.SliceOffset, colorReset)
+		fmt.Fprintf(w, "%s-%s%s\n", colorRed, c.Original, colorReset)
+		fmt.Fprintf(w, "%s+%s%s\n", colorGreen, c.New, colorReset)
+		if c.NewSize != c.OriginalSize {
+			fmt.Fprintf(w, "    cmdsize %d -> %d\n", c.OriginalSize,
+				c.NewSize)
+		}
+	}
+}
+
+// Replaces the dependency names in a Mach-O file, and writes the result to
+// outputPath, if it isn't empty.
+func processMachOFile(inputPath, outputPath string, rawInput []byte,
+	settings *fileSettings) error {
+	if (settings.patchScript != "") || (settings.embeddedOffset != "") ||
+		(settings.reportPath != "") || settings.showListing ||
+		(len(settings.checksums) != 0) || (settings.checksumCommand != "") ||
+		(settings.mapFile != "") || settings.patchMeta {
+		return fmt.Errorf("The -patch_script, -embedded_offset, -report, " +
+			"-listing, -map_file, -patchmeta, and checksum flags aren't " +
+			"supported for Mach-O files")
+	}
+	log.Printf("Processing Mach-O file %s.\n", inputPath)
+	output, changes, e := stringreplace.ReplaceMachO(rawInput,
+		&settings.options)
+	if e != nil {
+		return e
+	}
+	e = settings.maxGrowth.check(inputPath, len(rawInput), len(output))
+	if e != nil {
+		return e
+	}
+	log.Printf("Replaced %d load command strings in %s.\n", len(changes),
+		inputPath)
+	settings.batchReport.recordResult(nil, len(changes))
+	if settings.showDiff || settings.dryRun {
+		writeMachODiff(os.Stdout, inputPath, changes)
+	}
+	if outputPath == "" {
+		return nil
+	}
+	e = writeOutputFile(outputPath, output, 0755, nil,
+		settings.syncOutput)
+	if e != nil {
+		return fmt.Errorf("Error creating output file: %s", e)
+	}
+	return nil
+}
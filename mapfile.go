@@ -0,0 +1,134 @@
+package main
+
+// This file implements the -map_file flag, which updates a GNU ld map file
+// to use the same library and symbol names as the patched file, so tools
+// reading the map don't disagree with the binary.
+
+import (
+	"bytes"
+	"github.com/yalue/elf32_string_replace/stringreplace"
+	"github.com/yalue/elf_reader"
+	"io/ioutil"
+	"log"
+	"path"
+)
+
+// Returns the strings replaced in the file, mapped to their replacements.
+// The strings are read from the original and patched file content, rather
+// than the report's escaped copies, using the tables' offsets in the report.
+func replacedStringMap(original, patched []byte,
+	report *stringreplace.Report) map[string]string {
+	toReturn := make(map[string]string)
+	for _, t := range report.Tables {
+		if ((uint64(t.OriginalOffset) + uint64(t.OriginalSize)) >
+			uint64(len(original))) || ((uint64(t.NewOffset) +
+			uint64(t.NewSize)) > uint64(len(patched))) {
+			continue
+		}
+		oldTable := original[t.OriginalOffset : t.OriginalOffset+
+			t.OriginalSize]
+		newTable := patched[t.NewOffset : t.NewOffset+t.NewSize]
+		for _, r := range report.Replacements {
+			if r.SectionIndex != t.SectionIndex {
+				continue
+			}
+			oldString, e := elf_reader.ReadStringAtOffset(r.OriginalOffset,
+				oldTable)
+			if (e != nil) || (len(oldString) == 0) {
+				continue
+			}
+			newString, e := elf_reader.ReadStringAtOffset(r.NewOffset,
+				newTable)
+			if e != nil {
+				continue
+			}
+			previous, ok := toReturn[string(oldString)]
+			if ok && (previous != string(newString)) {
+				log.Printf("WARNING: %s was replaced with both %s and %s. "+
+					"Using %s in the map file.\n",
+					stringreplace.EscapeString(string(oldString)),
+					stringreplace.EscapeString(previous),
+					stringreplace.EscapeString(string(newString)),
+					stringreplace.EscapeString(previous))
+				continue
+			}
+			toReturn[string(oldString)] = string(newString)
+		}
+	}
+	return toReturn
+}
+
+// Returns true if c separates the names in a map file line.
+func isMapFileSeparator(c byte) bool {
+	switch c {
+	case ' ', '\t', '\r', '\n', '(', ')', ',':
+		return true
+	}
+	return false
+}
+
+// Returns the replacement for a single name from a map file, or the name
+// itself if it wasn't replaced. Paths are matched by their base names, so
+// that e.g. "/usr/lib/libfoo.so.1" is updated if "libfoo.so.1" was replaced.
+func replaceMapFileName(name string, replacements map[string]string) string {
+	if newName, ok := replacements[name]; ok {
+		return newName
+	}
+	base := path.Base(name)
+	if (base == name) || (base == "/") {
+		return name
+	}
+	if newBase, ok := replacements[base]; ok {
+		return name[:len(name)-len(base)] + newBase
+	}
+	return name
+}
+
+// Replaces each name in the map file content with its replacement, if it
+// has one. Returns the new content and the number of names replaced.
+func rewriteMapFile(content []byte,
+	replacements map[string]string) ([]byte, int) {
+	toReturn := make([]byte, 0, len(content))
+	replaced := 0
+	start := 0
+	for start < len(content) {
+		if isMapFileSeparator(content[start]) {
+			toReturn = append(toReturn, content[start])
+			start++
+			continue
+		}
+		end := start
+		for (end < len(content)) && !isMapFileSeparator(content[end]) {
+			end++
+		}
+		name := string(content[start:end])
+		newName := replaceMapFileName(name, replacements)
+		if newName != name {
+			replaced++
+		}
+		toReturn = append(toReturn, newName...)
+		start = end
+	}
+	return toReturn, replaced
+}
+
+// Reads the map file at inputPath, replaces the names that were replaced in
+// the patched file, and writes the result to outputPath, unless it's empty.
+// If sync is true, the output is flushed to storage, as by writeOutputFile.
+func updateMapFile(inputPath, outputPath string, original, patched []byte,
+	report *stringreplace.Report, sync bool) error {
+	content, e := ioutil.ReadFile(inputPath)
+	if e != nil {
+		return e
+	}
+	newContent, replaced := rewriteMapFile(content,
+		replacedStringMap(original, patched, report))
+	log.Printf("Replaced %d names in map file %s.\n", replaced, inputPath)
+	if outputPath == "" {
+		return nil
+	}
+	if bytes.Equal(content, newContent) && (inputPath == outputPath) {
+		return nil
+	}
+	return writeOutputFile(outputPath, newContent, 0644, nil, sync)
+}
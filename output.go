@@ -0,0 +1,205 @@
+package main
+
+// This file contains code for writing output files so that a failure, such
+// as a patched file failing verification, never leaves a partially written or
+// unverified file at the output path. Long runs of zero bytes aren't written,
+// so that the output can be kept sparse.
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"github.com/yalue/elf32_string_replace/stringreplace"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Checks a written output file before it's moved into place. Receives the
+// path of the temporary file.
+type outputCheck func(tempPath string) error
+
+// Returns an error if the file at the given path can't be parsed as a 32-bit
+// ELF file. Used to check patched ELF files before replacing the output.
+func verifyELFOutput(path string) error {
+	content, e := ioutil.ReadFile(path)
+	if e != nil {
+		return e
+	}
+	_, e = stringreplace.ParseELF32File(content)
+	if e != nil {
+		return fmt.Errorf("The written file isn't a valid ELF file: %s", e)
+	}
+	return nil
+}
+
+// Writes content to a temporary file in the same directory as path, reads it
+// back to make sure it was written correctly, and passes it to the check
+// function, if it isn't nil. The temporary file is only renamed to path if
+// everything succeeds; otherwise it's removed, leaving any existing file at
+// path (including the input, if it's being replaced) untouched. If sync is
+// true, the output file and its directory are flushed to storage after the
+// rename, so the new file survives a crash or power loss. If path is "-", the
+// content is streamed to stdout instead, and check isn't called.
+func writeOutputFile(path string, content []byte, mode os.FileMode,
+	check outputCheck, sync bool) error {
+	if path == "-" {
+		n, e := os.Stdout.Write(content)
+		if e != nil {
+			return fmt.Errorf("Failed writing to stdout after %d of %d "+
+				"bytes: %s", n, len(content), e)
+		}
+		return nil
+	}
+	tempFile, e := ioutil.TempFile(filepath.Dir(path),
+		"."+filepath.Base(path)+".tmp")
+	if e != nil {
+		return e
+	}
+	tempPath := tempFile.Name()
+	committed := false
+	defer func() {
+		if committed {
+			return
+		}
+		log.Printf("Discarding unverified output %s.\n", tempPath)
+		os.Remove(tempPath)
+	}()
+	n, e := stringreplace.WriteSparse(tempFile, content)
+	if (e == nil) && (n != int64(len(content))) {
+		e = io.ErrShortWrite
+	}
+	if e != nil {
+		tempFile.Close()
+		return fmt.Errorf("Failed writing %s after %d of %d bytes: %s",
+			tempPath, n, len(content), e)
+	}
+	e = tempFile.Sync()
+	if e != nil {
+		tempFile.Close()
+		return fmt.Errorf("Failed flushing %s to storage: %s", tempPath, e)
+	}
+	e = tempFile.Close()
+	if e != nil {
+		return fmt.Errorf("Failed closing %s: %s", tempPath, e)
+	}
+	written, e := ioutil.ReadFile(tempPath)
+	if e != nil {
+		return fmt.Errorf("Failed reading back output: %s", e)
+	}
+	if len(written) != len(content) {
+		return fmt.Errorf("The output read back from %s is %d bytes, but %d "+
+			"were written", tempPath, len(written), len(content))
+	}
+	if !bytes.Equal(written, content) {
+		return fmt.Errorf("The output read back from %s doesn't match the "+
+			"content written", tempPath)
+	}
+	e = os.Chmod(tempPath, mode)
+	if e != nil {
+		return e
+	}
+	if check != nil {
+		e = check(tempPath)
+		if e != nil {
+			return fmt.Errorf("Output verification failed: %s", e)
+		}
+	}
+	e = os.Rename(tempPath, path)
+	if e != nil {
+		return fmt.Errorf("Failed renaming %s to %s: %s", tempPath, path, e)
+	}
+	committed = true
+	if !sync {
+		return nil
+	}
+	e = syncFile(path)
+	if e == nil {
+		e = syncDirectory(filepath.Dir(path))
+	}
+	if e != nil {
+		return fmt.Errorf("%s was written, but may not survive a crash: %s",
+			path, e)
+	}
+	return nil
+}
+
+// Flushes the file at the given path to storage.
+func syncFile(path string) error {
+	f, e := os.Open(path)
+	if e != nil {
+		return fmt.Errorf("Failed opening %s to flush it: %s", path, e)
+	}
+	e = f.Sync()
+	closeError := f.Close()
+	if e != nil {
+		return fmt.Errorf("Failed flushing %s to storage: %s", path, e)
+	}
+	if closeError != nil {
+		return fmt.Errorf("Failed closing %s: %s", path, closeError)
+	}
+	return nil
+}
+
+// The formats in which patched ELF files can be written.
+const (
+	outputFormatFile = "file"
+	outputFormatTar  = "tar"
+	outputFormatCPIO = "cpio"
+)
+
+// Returns the content to write to the output path in the given format: the
+// patched file itself, or an archive holding it as a single entry with the
+// given name and mode. The patched file is checked before it's archived,
+// since the archive itself can't be parsed as an ELF file.
+func encodeOutput(format, name string, content []byte,
+	mode os.FileMode) ([]byte, error) {
+	var archive bytes.Buffer
+	var e error
+	switch format {
+	case outputFormatFile:
+		return content, nil
+	case outputFormatTar:
+		_, e = stringreplace.ParseELF32File(content)
+		if e != nil {
+			break
+		}
+		tarWriter := tar.NewWriter(&archive)
+		w := &stringreplace.TarOutputWriter{
+			Writer: tarWriter,
+		}
+		e = w.WriteOutput(name, content, mode)
+		if e == nil {
+			e = tarWriter.Close()
+		}
+	case outputFormatCPIO:
+		_, e = stringreplace.ParseELF32File(content)
+		if e != nil {
+			break
+		}
+		w := stringreplace.NewCPIOOutputWriter(&archive)
+		e = w.WriteOutput(name, content, mode)
+		if e == nil {
+			e = w.Close()
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported output format: %s", format)
+	}
+	if e != nil {
+		return nil, fmt.Errorf("Failed writing %s output: %s", format, e)
+	}
+	return archive.Bytes(), nil
+}
+
+// Returns an error if the output format isn't a plain file, for inputs (such
+// as cpio archives or firmware images) that are always written in their
+// original format.
+func requireFileOutput(settings *fileSettings, kind string) error {
+	if settings.outputFormat == outputFormatFile {
+		return nil
+	}
+	return fmt.Errorf("The -output_format flag isn't supported for %s",
+		kind)
+}
@@ -0,0 +1,283 @@
+package main
+
+// This file implements the "ops" patch script format: a JSON list of
+// primitive operations (overwrite bytes, set a header field, append data,
+// truncate the file) that external tools, such as an updater running on a
+// device, can apply to a copy of the original file without running any Go
+// code. The schema is described in the README.
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/yalue/elf_reader"
+	"io"
+	"sort"
+)
+
+// Identifies the ops format, and the version of its schema. The version is
+// incremented if the schema changes incompatibly.
+const (
+	patchOpsFormat  = "elf32_string_replace-ops"
+	patchOpsVersion = 1
+)
+
+// The kinds of operation in the ops format.
+const (
+	patchOpWrite    = "write"
+	patchOpSetField = "set_field"
+	patchOpAppend   = "append"
+	patchOpTruncate = "truncate"
+)
+
+// A single operation in the ops format.
+type patchOp struct {
+	Op string `json:"op"`
+	// The file offset at which to write, append, or truncate the file.
+	Offset uint32 `json:"offset"`
+	// The number of bytes written or appended.
+	Size uint32 `json:"size,omitempty"`
+	// The bytes to write or append, as hex digits.
+	Data string `json:"data,omitempty"`
+	// The bytes being overwritten, as hex digits, so appliers can check that
+	// they're patching the expected file.
+	Original string `json:"original,omitempty"`
+	// For set_field, the field's name (e.g. "e_shoff", or "phdr[2].p_vaddr")
+	// and its original and new values.
+	Field         string  `json:"field,omitempty"`
+	OriginalValue *uint32 `json:"original_value,omitempty"`
+	Value         *uint32 `json:"value,omitempty"`
+}
+
+// The content of an ops file.
+type patchOps struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+	// "little" or "big", the byte order of the fields' values.
+	Endianness string `json:"endianness"`
+	// The size and hex-encoded SHA-256 digest of the original and patched
+	// files.
+	InputSize    uint32 `json:"input_size"`
+	InputSHA256  string `json:"input_sha256"`
+	OutputSize   uint32 `json:"output_size"`
+	OutputSHA256 string `json:"output_sha256"`
+	// The operations, to be applied in order.
+	Operations []patchOp `json:"operations"`
+}
+
+// A field in one of the ELF headers.
+type headerField struct {
+	name   string
+	offset uint32
+	size   uint32
+}
+
+// The names and sizes of the fields in each of the 32-bit ELF headers,
+// following e_ident.
+var (
+	elfHeaderFields = []headerField{
+		{"e_type", 16, 2}, {"e_machine", 18, 2}, {"e_version", 20, 4},
+		{"e_entry", 24, 4}, {"e_phoff", 28, 4}, {"e_shoff", 32, 4},
+		{"e_flags", 36, 4}, {"e_ehsize", 40, 2}, {"e_phentsize", 42, 2},
+		{"e_phnum", 44, 2}, {"e_shentsize", 46, 2}, {"e_shnum", 48, 2},
+		{"e_shstrndx", 50, 2},
+	}
+	programHeaderFields = []string{"p_type", "p_offset", "p_vaddr",
+		"p_paddr", "p_filesz", "p_memsz", "p_flags", "p_align"}
+	sectionHeaderFields = []string{"sh_name", "sh_type", "sh_flags",
+		"sh_addr", "sh_offset", "sh_size", "sh_link", "sh_info",
+		"sh_addralign", "sh_entsize"}
+)
+
+// Returns the header fields in the patched file, in order of offset. The
+// patched file's layout is used, since it describes what the new bytes mean.
+func patchedHeaderFields(f *elf_reader.ELF32File) []headerField {
+	toReturn := append([]headerField(nil), elfHeaderFields...)
+	// Each program header is 32 bytes, and each section header is 40, with
+	// every field taking 4 bytes.
+	for i := range f.Segments {
+		for j, name := range programHeaderFields {
+			toReturn = append(toReturn, headerField{
+				name:   fmt.Sprintf("phdr[%d].%s", i, name),
+				offset: f.Header.ProgramHeaderOffset + uint32(i*32+j*4),
+				size:   4,
+			})
+		}
+	}
+	for i := range f.Sections {
+		for j, name := range sectionHeaderFields {
+			toReturn = append(toReturn, headerField{
+				name:   fmt.Sprintf("shdr[%d].%s", i, name),
+				offset: f.Header.SectionHeaderOffset + uint32(i*40+j*4),
+				size:   4,
+			})
+		}
+	}
+	sort.SliceStable(toReturn, func(a, b int) bool {
+		return toReturn[a].offset < toReturn[b].offset
+	})
+	return toReturn
+}
+
+// Returns the value of the 2- or 4-byte field at the start of data.
+func readFieldValue(data []byte, order binary.ByteOrder) uint32 {
+	if len(data) == 2 {
+		return uint32(order.Uint16(data))
+	}
+	return order.Uint32(data)
+}
+
+// Returns the operations turning the original content into the patched file.
+// Changed header fields are set as a whole using set_field operations, and
+// other changed bytes within the original file's size are overwritten using
+// write operations.
+func computePatchOps(original []byte,
+	modified *elf_reader.ELF32File) *patchOps {
+	patched := modified.Raw
+	endianness := "little"
+	if modified.Endianness.Uint16([]byte{0, 1}) == 1 {
+		endianness = "big"
+	}
+	toReturn := &patchOps{
+		Format:       patchOpsFormat,
+		Version:      patchOpsVersion,
+		Endianness:   endianness,
+		InputSize:    uint32(len(original)),
+		InputSHA256:  fileDigest(original),
+		OutputSize:   uint32(len(patched)),
+		OutputSHA256: fileDigest(patched),
+		Operations:   make([]patchOp, 0, 16),
+	}
+	limit := len(original)
+	if len(patched) < limit {
+		limit = len(patched)
+	}
+	changed := make([]bool, limit)
+	for i := 0; i < limit; i++ {
+		changed[i] = original[i] != patched[i]
+	}
+	for _, field := range patchedHeaderFields(modified) {
+		if (uint64(field.offset) + uint64(field.size)) > uint64(limit) {
+			continue
+		}
+		end := field.offset + field.size
+		fieldChanged := false
+		for i := field.offset; i < end; i++ {
+			fieldChanged = fieldChanged || changed[i]
+			changed[i] = false
+		}
+		if !fieldChanged {
+			continue
+		}
+		originalValue := readFieldValue(original[field.offset:end],
+			modified.Endianness)
+		value := readFieldValue(patched[field.offset:end], modified.Endianness)
+		toReturn.Operations = append(toReturn.Operations, patchOp{
+			Op:            patchOpSetField,
+			Offset:        field.offset,
+			Size:          field.size,
+			Data:          hexString(patched[field.offset:end]),
+			Original:      hexString(original[field.offset:end]),
+			Field:         field.name,
+			OriginalValue: &originalValue,
+			Value:         &value,
+		})
+	}
+	for start := 0; start < limit; start++ {
+		if !changed[start] {
+			continue
+		}
+		end := start
+		for (end < limit) && changed[end] {
+			end++
+		}
+		toReturn.Operations = append(toReturn.Operations, patchOp{
+			Op:       patchOpWrite,
+			Offset:   uint32(start),
+			Size:     uint32(end - start),
+			Data:     hexString(patched[start:end]),
+			Original: hexString(original[start:end]),
+		})
+		start = end
+	}
+	sort.SliceStable(toReturn.Operations, func(a, b int) bool {
+		return toReturn.Operations[a].Offset < toReturn.Operations[b].Offset
+	})
+	if len(patched) > len(original) {
+		toReturn.Operations = append(toReturn.Operations, patchOp{
+			Op:     patchOpAppend,
+			Offset: uint32(len(original)),
+			Size:   uint32(len(patched) - len(original)),
+			Data:   hexString(patched[len(original):]),
+		})
+	} else if len(patched) < len(original) {
+		toReturn.Operations = append(toReturn.Operations, patchOp{
+			Op:     patchOpTruncate,
+			Offset: uint32(len(patched)),
+		})
+	}
+	return toReturn
+}
+
+// Applies the operations to the original content, in the way an external
+// applier would, and returns the result. Returns an error if the original or
+// result doesn't match the digests.
+func applyPatchOps(ops *patchOps, original []byte) ([]byte, error) {
+	if fileDigest(original) != ops.InputSHA256 {
+		return nil, fmt.Errorf("The original file doesn't match the " +
+			"operations' input digest")
+	}
+	content := append([]byte(nil), original...)
+	for i, op := range ops.Operations {
+		data, e := hex.DecodeString(op.Data)
+		if e != nil {
+			return nil, fmt.Errorf("Invalid data in operation %d: %s", i, e)
+		}
+		switch op.Op {
+		case patchOpWrite, patchOpSetField:
+			end := uint64(op.Offset) + uint64(len(data))
+			if end > uint64(len(content)) {
+				return nil, fmt.Errorf("Operation %d writes past the end of "+
+					"the file", i)
+			}
+			copy(content[op.Offset:], data)
+		case patchOpAppend:
+			if op.Offset != uint32(len(content)) {
+				return nil, fmt.Errorf("Operation %d appends at 0x%x, but the "+
+					"file is 0x%x bytes", i, op.Offset, len(content))
+			}
+			content = append(content, data...)
+		case patchOpTruncate:
+			if op.Offset > uint32(len(content)) {
+				return nil, fmt.Errorf("Operation %d truncates past the end "+
+					"of the file", i)
+			}
+			content = content[:op.Offset]
+		default:
+			return nil, fmt.Errorf("Unknown operation %q", op.Op)
+		}
+	}
+	if fileDigest(content) != ops.OutputSHA256 {
+		return nil, fmt.Errorf("Applying the operations doesn't produce the " +
+			"patched file")
+	}
+	return content, nil
+}
+
+// Writes the operations turning the original content into the patched file
+// as JSON, after checking that applying them produces the patched file.
+func writePatchOps(w io.Writer, original []byte,
+	modified *elf_reader.ELF32File) error {
+	ops := computePatchOps(original, modified)
+	_, e := applyPatchOps(ops, original)
+	if e != nil {
+		return fmt.Errorf("The generated operations are incorrect: %s", e)
+	}
+	content, e := json.MarshalIndent(ops, "", "  ")
+	if e != nil {
+		return e
+	}
+	_, e = w.Write(append(content, '\n'))
+	return e
+}
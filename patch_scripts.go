@@ -0,0 +1,272 @@
+package main
+
+// This file contains code for exporting the changes made to an ELF file as a
+// script for a reverse-engineering tool, so that the same patch can be applied
+// and annotated within an existing analysis database.
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/yalue/elf_reader"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Byte ranges that differ, but are separated by fewer than this many
+// unchanged bytes, will be merged into a single change to keep scripts short.
+const byteChangeMergeDistance = 8
+
+// Describes a contiguous range of bytes that was modified in, or appended to,
+// the original file.
+type byteChange struct {
+	fileOffset uint32
+	content    []byte
+	// This will be true if the change lies past the end of the original file.
+	appended bool
+	// The virtual address of the appended data, only valid if appended and
+	// hasVirtualAddress are both true.
+	virtualAddress    uint32
+	hasVirtualAddress bool
+}
+
+// Returns a list of the byte ranges that differ between the original and
+// modified file content. Any content past the end of the original file is
+// returned as a single final change.
+func computeByteChanges(original, modified []byte) []byteChange {
+	toReturn := make([]byteChange, 0, 16)
+	commonLength := len(original)
+	if len(modified) < commonLength {
+		commonLength = len(modified)
+	}
+	start := -1
+	lastDifferent := -1
+	for i := 0; i < commonLength; i++ {
+		if original[i] == modified[i] {
+			if (start >= 0) && ((i - lastDifferent) > byteChangeMergeDistance) {
+				toReturn = append(toReturn, byteChange{
+					fileOffset: uint32(start),
+					content:    modified[start : lastDifferent+1],
+				})
+				start = -1
+			}
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+		lastDifferent = i
+	}
+	if start >= 0 {
+		toReturn = append(toReturn, byteChange{
+			fileOffset: uint32(start),
+			content:    modified[start : lastDifferent+1],
+		})
+	}
+	if len(modified) > len(original) {
+		toReturn = append(toReturn, byteChange{
+			fileOffset: uint32(len(original)),
+			content:    modified[len(original):],
+			appended:   true,
+		})
+	}
+	return toReturn
+}
+
+// Fills in the virtual addresses of appended changes, based on the loadable
+// segments in the modified ELF file. Since appended data may begin with
+// alignment padding, an appended change will be trimmed to start at the
+// beginning of the loadable segment holding it, if there is one.
+func setAppendedChangeAddresses(f *elf_reader.ELF32File,
+	changes []byteChange) {
+	var c *byteChange
+	var s *elf_reader.ELF32ProgramHeader
+	var changeEnd, skipped uint32
+	for i := range changes {
+		c = &(changes[i])
+		if !c.appended {
+			continue
+		}
+		changeEnd = c.fileOffset + uint32(len(c.content))
+		for j := range f.Segments {
+			s = &(f.Segments[j])
+			if s.Type != elf_reader.LoadableSegment {
+				continue
+			}
+			if (s.FileOffset >= changeEnd) ||
+				((s.FileOffset + s.FileSize) <= c.fileOffset) {
+				continue
+			}
+			if s.FileOffset > c.fileOffset {
+				skipped = s.FileOffset - c.fileOffset
+				c.content = c.content[skipped:]
+				c.fileOffset = s.FileOffset
+			}
+			c.virtualAddress = s.VirtualAddress + (c.fileOffset - s.FileOffset)
+			c.hasVirtualAddress = true
+			break
+		}
+	}
+}
+
+// Formats the given bytes as a string of hex digits with no separators.
+func hexString(data []byte) string {
+	return fmt.Sprintf("%x", data)
+}
+
+// Formats the given bytes as a python list of integers.
+func pythonByteList(data []byte) string {
+	var b strings.Builder
+	b.WriteString("[")
+	for i, v := range data {
+		if i != 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%d", v)
+	}
+	b.WriteString("]")
+	return b.String()
+}
+
+// Writes a radare2 script applying the changes. It is intended to be run
+// against a copy of the original file using "r2 -n -w -q -i <script> <file>",
+// so addresses are file offsets.
+func writeRadare2Script(w io.Writer, changes []byteChange,
+	newSize int) error {
+	var b bytes.Buffer
+	b.WriteString("# Generated by elf32_string_replace.\n")
+	b.WriteString("# Apply using: r2 -n -w -q -i <this script> <file copy>\n")
+	for _, c := range changes {
+		if c.appended {
+			fmt.Fprintf(&b, "# Grow the file to hold %d appended bytes\n",
+				len(c.content))
+			fmt.Fprintf(&b, "r %d\n", newSize)
+		}
+		fmt.Fprintf(&b, "wx %s @ 0x%x\n", hexString(c.content), c.fileOffset)
+		fmt.Fprintf(&b, "CC elf32_string_replace: patched %d bytes @ 0x%x\n",
+			len(c.content), c.fileOffset)
+	}
+	_, e := w.Write(b.Bytes())
+	return e
+}
+
+// Writes an IDAPython script applying the changes to the open database.
+func writeIDAScript(w io.Writer, changes []byteChange) error {
+	var b bytes.Buffer
+	b.WriteString("# Generated by elf32_string_replace. Run using " +
+		"File -> Script file... in IDA.\n")
+	b.WriteString("import ida_bytes\nimport ida_idaapi\nimport ida_loader\n" +
+		"import ida_segment\nimport idc\n\n")
+	b.WriteString("def patch_file_offset(offset, data):\n" +
+		"    ea = ida_loader.get_fileregion_ea(offset)\n" +
+		"    if ea == ida_idaapi.BADADDR:\n" +
+		"        print(\"File offset 0x%x isn't loaded; skipping\" % offset)\n" +
+		"        return\n" +
+		"    ida_bytes.patch_bytes(ea, bytes(bytearray(data)))\n" +
+		"    idc.set_cmt(ea, \"elf32_string_replace: patched %d bytes\" % " +
+		"len(data), 0)\n\n")
+	b.WriteString("def add_appended_data(ea, data):\n" +
+		"    ida_segment.add_segm(0, ea, ea + len(data), " +
+		"\"elf32_string_replace\", \"CONST\")\n" +
+		"    ida_bytes.patch_bytes(ea, bytes(bytearray(data)))\n" +
+		"    idc.set_cmt(ea, \"elf32_string_replace: appended data\", 0)\n\n")
+	for _, c := range changes {
+		if !c.appended {
+			fmt.Fprintf(&b, "patch_file_offset(0x%x, %s)\n", c.fileOffset,
+				pythonByteList(c.content))
+			continue
+		}
+		if !c.hasVirtualAddress {
+			fmt.Fprintf(&b, "# %d bytes appended at file offset 0x%x aren't "+
+				"loaded into memory.\n", len(c.content), c.fileOffset)
+			continue
+		}
+		fmt.Fprintf(&b, "add_appended_data(0x%x, %s)\n", c.virtualAddress,
+			pythonByteList(c.content))
+	}
+	_, e := w.Write(b.Bytes())
+	return e
+}
+
+// Writes a Ghidra (Jython) script applying the changes to the current
+// program.
+func writeGhidraScript(w io.Writer, changes []byteChange) error {
+	var b bytes.Buffer
+	b.WriteString("# Generated by elf32_string_replace. Run using the " +
+		"Ghidra script manager.\n")
+	b.WriteString("# @category Patching\n")
+	b.WriteString("import jarray\n\n")
+	b.WriteString("def to_java_bytes(data):\n" +
+		"    return jarray.array([(v - 256) if v > 127 else v " +
+		"for v in data], 'b')\n\n")
+	b.WriteString("def patch_file_offset(offset, data):\n" +
+		"    memory = currentProgram.getMemory()\n" +
+		"    addresses = memory.locateAddressesForFileOffset(offset)\n" +
+		"    if addresses.isEmpty():\n" +
+		"        print(\"File offset 0x%x isn't loaded; skipping\" % offset)\n" +
+		"        return\n" +
+		"    for address in addresses:\n" +
+		"        setBytes(address, to_java_bytes(data))\n" +
+		"        setPreComment(address, \"elf32_string_replace: patched " +
+		"%d bytes\" % len(data))\n\n")
+	b.WriteString("def add_appended_data(va, data):\n" +
+		"    address = toAddr(va)\n" +
+		"    createMemoryBlock(\"elf32_string_replace\", address, " +
+		"to_java_bytes(data), False)\n" +
+		"    setPreComment(address, \"elf32_string_replace: appended data\")\n\n")
+	for _, c := range changes {
+		if !c.appended {
+			fmt.Fprintf(&b, "patch_file_offset(0x%x, %s)\n", c.fileOffset,
+				pythonByteList(c.content))
+			continue
+		}
+		if !c.hasVirtualAddress {
+			fmt.Fprintf(&b, "# %d bytes appended at file offset 0x%x aren't "+
+				"loaded into memory.\n", len(c.content), c.fileOffset)
+			continue
+		}
+		fmt.Fprintf(&b, "add_appended_data(0x%x, %s)\n", c.virtualAddress,
+			pythonByteList(c.content))
+	}
+	_, e := w.Write(b.Bytes())
+	return e
+}
+
+// Returns true if the given patch script format is supported.
+func isValidPatchScriptFormat(format string) bool {
+	switch format {
+	case "r2", "ida", "ghidra", "ops":
+		return true
+	}
+	return false
+}
+
+// Writes a script in the given format to the given path, applying the changes
+// between the original file content and the modified ELF file.
+func writePatchScript(path, format string, original []byte,
+	modified *elf_reader.ELF32File) error {
+	changes := computeByteChanges(original, modified.Raw)
+	setAppendedChangeAddresses(modified, changes)
+	var script bytes.Buffer
+	var e error
+	switch format {
+	case "r2":
+		e = writeRadare2Script(&script, changes, len(modified.Raw))
+	case "ida":
+		e = writeIDAScript(&script, changes)
+	case "ghidra":
+		e = writeGhidraScript(&script, changes)
+	case "ops":
+		e = writePatchOps(&script, original, modified)
+	default:
+		e = fmt.Errorf("Unsupported patch script format: %s", format)
+	}
+	if e != nil {
+		return fmt.Errorf("Failed generating patch script: %s", e)
+	}
+	e = ioutil.WriteFile(path, script.Bytes(), 0644)
+	if e != nil {
+		return fmt.Errorf("Failed writing %s: %s", path, e)
+	}
+	return nil
+}
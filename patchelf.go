@@ -0,0 +1,275 @@
+package main
+
+// This file implements the "patchelf-compat" subcommand, which accepts the
+// most common patchelf options, so that build scripts written for patchelf
+// can use this tool for 32-bit files instead. It's also run if the binary is
+// invoked under the name "patchelf", e.g. through a symlink.
+
+import (
+	"fmt"
+	"github.com/yalue/elf32_string_replace/stringreplace"
+	"github.com/yalue/elf_reader"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+// The dynamic table tags of the strings patchelf-compat reads and replaces.
+const (
+	dtSoname  = 14
+	dtRpath   = 15
+	dtRunpath = 29
+)
+
+// Holds the options given to patchelf-compat.
+type patchelfOptions struct {
+	setRpath     string
+	hasRpath     bool
+	setSoname    string
+	hasSoname    bool
+	printNeeded  bool
+	output       string
+	addNeeded    []string
+	replacements [][2]string
+	files        []string
+}
+
+const patchelfUsage = `Usage: patchelf-compat [options] <file>...
+Options:
+  --set-rpath <rpath>          Replace the DT_RPATH and DT_RUNPATH strings,
+                               which may grow, or add a DT_RUNPATH entry if
+                               there's neither.
+  --replace-needed <old> <new> Rename a DT_NEEDED dependency. May be repeated.
+  --add-needed <library>       Add a DT_NEEDED dependency. May be repeated.
+  --set-soname <soname>        Replace the DT_SONAME string, or add one.
+  --print-needed               Print the DT_NEEDED dependencies.
+  --output <file>              Write the result here rather than in place.
+`
+
+// Parses patchelf-style arguments, in which options start with "--" and
+// --replace-needed takes two values.
+func parsePatchelfArguments(arguments []string) (*patchelfOptions, error) {
+	toReturn := &patchelfOptions{}
+	for i := 0; i < len(arguments); i++ {
+		argument := arguments[i]
+		values := 0
+		switch argument {
+		case "--set-rpath", "--set-soname", "--output", "--add-needed":
+			values = 1
+		case "--replace-needed":
+			values = 2
+		}
+		if (i + values) >= len(arguments) {
+			return nil, fmt.Errorf("%s requires %d value(s)", argument, values)
+		}
+		switch argument {
+		case "--set-rpath":
+			toReturn.setRpath = arguments[i+1]
+			toReturn.hasRpath = true
+		case "--set-soname":
+			toReturn.setSoname = arguments[i+1]
+			toReturn.hasSoname = true
+		case "--output":
+			toReturn.output = arguments[i+1]
+		case "--add-needed":
+			toReturn.addNeeded = append(toReturn.addNeeded, arguments[i+1])
+		case "--replace-needed":
+			toReturn.replacements = append(toReturn.replacements,
+				[2]string{arguments[i+1], arguments[i+2]})
+		case "--print-needed":
+			toReturn.printNeeded = true
+		default:
+			if strings.HasPrefix(argument, "-") {
+				return nil, fmt.Errorf("Unsupported option %s", argument)
+			}
+			toReturn.files = append(toReturn.files, argument)
+		}
+		i += values
+	}
+	if len(toReturn.files) == 0 {
+		return nil, fmt.Errorf("No input files were given")
+	}
+	if (toReturn.output != "") && (len(toReturn.files) != 1) {
+		return nil, fmt.Errorf("--output requires a single input file")
+	}
+	return toReturn, nil
+}
+
+// Returns the only string referred to by dynamic entries with the given tag,
+// and false if there are none. Returns an error if there's more than one.
+func readSingleDynamicString(f *elf_reader.ELF32File,
+	tag elf_reader.ELF32DynamicTag, tagName string) (string, bool, error) {
+	values, e := readDynamicStrings(f, tag)
+	if e != nil {
+		return "", false, e
+	}
+	if len(values) > 1 {
+		return "", false, fmt.Errorf("The file has %d %s entries", len(values),
+			tagName)
+	}
+	if len(values) == 0 {
+		return "", false, nil
+	}
+	return values[0], true, nil
+}
+
+// Returns the names of the sections the rules apply to: the string table
+// linked to the dynamic table. Like patchelf, this only changes the dynamic
+// entries' strings, leaving identical strings elsewhere (e.g. in .strtab or
+// .comment) alone. Returns nil, applying the rules to every string table, if
+// the file has no section names to tell the tables apart.
+func dynamicStringSections(f *elf_reader.ELF32File) []string {
+	_, ok := stringreplace.SectionNamesTable(f)
+	if !ok {
+		return nil
+	}
+	for i := range f.Sections {
+		if !f.IsDynamicSection(uint16(i)) {
+			continue
+		}
+		name, e := stringreplace.SectionName(f,
+			uint16(f.Sections[i].LinkedIndex))
+		if e == nil {
+			return []string{name}
+		}
+	}
+	return []string{".dynstr"}
+}
+
+// Applies the options to the file at the given path. Returns an error if an
+// option can't be applied, in which case nothing is written. The file is
+// locked while it's being patched in place.
+func patchelfFile(path string, options *patchelfOptions) error {
+	outputPath := options.output
+	if outputPath == "" {
+		outputPath = path
+	}
+	if isInPlace(path, outputPath) {
+		unlock, e := lockTarget(path)
+		if e != nil {
+			return e
+		}
+		defer unlock()
+	}
+	rawInput, e := ioutil.ReadFile(path)
+	if e != nil {
+		return fmt.Errorf("Failed reading %s: %s", path, e)
+	}
+	f, e := stringreplace.ParseELF32File(rawInput)
+	if e != nil {
+		return fmt.Errorf("Failed parsing %s: %s", path, e)
+	}
+	needed, e := readNeededNames(f)
+	if e != nil {
+		return e
+	}
+	if options.printNeeded {
+		for _, name := range needed {
+			fmt.Println(name)
+		}
+	}
+	var rules []stringreplace.Rule
+	// Entries that don't exist yet are added when relocating the tables.
+	added := stringreplace.Options{
+		AddNeeded: options.addNeeded,
+	}
+	for _, r := range options.replacements {
+		found := false
+		for _, name := range needed {
+			found = found || (name == r[0])
+		}
+		if !found {
+			log.Printf("%s doesn't depend on %s; not replacing it.\n", path,
+				r[0])
+			continue
+		}
+		rules = append(rules, stringreplace.LiteralRule(r[0], r[1]))
+	}
+	if options.hasSoname {
+		soname, ok, e := readSingleDynamicString(f, dtSoname, "DT_SONAME")
+		if e != nil {
+			return e
+		}
+		if !ok {
+			added.AddSoname = options.setSoname
+		} else if soname != options.setSoname {
+			rules = append(rules, stringreplace.LiteralRule(soname,
+				options.setSoname))
+		}
+	}
+	if options.hasRpath {
+		rpath, ok, e := readSingleDynamicString(f, dtRpath, "DT_RPATH")
+		if e != nil {
+			return e
+		}
+		runpath, hasRunpath, e := readSingleDynamicString(f, dtRunpath,
+			"DT_RUNPATH")
+		if e != nil {
+			return e
+		}
+		// Like patchelf, a DT_RUNPATH entry is added if there's neither.
+		if !ok && !hasRunpath {
+			added.AddRunPath = options.setRpath
+		}
+		if ok && (rpath != options.setRpath) {
+			rules = append(rules, stringreplace.LiteralRule(rpath,
+				options.setRpath))
+		}
+		// Both entries may use the same string, which only needs one rule.
+		if hasRunpath && (runpath != options.setRpath) &&
+			!(ok && (runpath == rpath)) {
+			rules = append(rules, stringreplace.LiteralRule(runpath,
+				options.setRpath))
+		}
+	}
+	addsEntries := (len(added.AddNeeded) != 0) || (added.AddSoname != "") ||
+		(added.AddRunPath != "")
+	if (len(rules) == 0) && !addsEntries {
+		if options.output != "" {
+			return writeOutputFile(options.output, rawInput, 0755,
+				verifyELFOutput, false)
+		}
+		return nil
+	}
+	sections := dynamicStringSections(f)
+	for i := range rules {
+		rules[i].Sections = sections
+	}
+	added.Rules = rules
+	output, _, e := stringreplace.Replace(rawInput, added)
+	if e != nil {
+		return fmt.Errorf("Failed patching %s: %s", path, e)
+	}
+	mode := os.FileMode(0755)
+	if info, e := os.Stat(path); e == nil {
+		mode = info.Mode().Perm()
+	}
+	return writeOutputFile(outputPath, output, mode, verifyELFOutput, false)
+}
+
+// Runs the "patchelf-compat" subcommand, with the given arguments, not
+// including the subcommand name itself. Returns the process exit code.
+func runPatchelfCommand(arguments []string) int {
+	for _, argument := range arguments {
+		if (argument == "--help") || (argument == "-h") {
+			fmt.Print(patchelfUsage)
+			return 0
+		}
+	}
+	options, e := parsePatchelfArguments(arguments)
+	if e != nil {
+		log.Printf("%s\n", e)
+		fmt.Fprint(os.Stderr, patchelfUsage)
+		return 1
+	}
+	status := 0
+	for _, path := range options.files {
+		e = patchelfFile(path, options)
+		if e != nil {
+			log.Printf("%s\n", e)
+			status = 1
+		}
+	}
+	return status
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestParsePatchelfArguments(t *testing.T) {
+	options, e := parsePatchelfArguments([]string{"--replace-needed",
+		"libc.so.6", "libc.so.7", "--add-needed", "libm.so.6",
+		"--add-needed", "libz.so.1", "--set-soname", "libnew.so",
+		"--set-rpath", "", "--print-needed", "--output", "out.so", "in.so"})
+	if e != nil {
+		t.Fatalf("Failed parsing valid arguments: %s", e)
+	}
+	expected := &patchelfOptions{
+		hasRpath:     true,
+		setSoname:    "libnew.so",
+		hasSoname:    true,
+		printNeeded:  true,
+		output:       "out.so",
+		addNeeded:    []string{"libm.so.6", "libz.so.1"},
+		replacements: [][2]string{{"libc.so.6", "libc.so.7"}},
+		files:        []string{"in.so"},
+	}
+	if !reflect.DeepEqual(options, expected) {
+		t.Errorf("Expected options %+v, got %+v", expected, options)
+	}
+	invalid := [][]string{
+		// --replace-needed is missing its second value.
+		{"--replace-needed", "libc.so.6", "in.so"},
+		{"--set-soname"},
+		{"--shrink-rpath", "in.so"},
+		{"--print-needed"},
+		{"--output", "out.so", "a.so", "b.so"},
+	}
+	for _, arguments := range invalid {
+		_, e = parsePatchelfArguments(arguments)
+		if e == nil {
+			t.Errorf("Didn't get an error for arguments %q", arguments)
+		}
+	}
+}
+
+// Writes the given corpus file to a temporary directory, returning its path.
+func writeCorpusFile(t *testing.T, name string, content []byte) string {
+	path := filepath.Join(t.TempDir(), name)
+	e := ioutil.WriteFile(path, content, 0755)
+	if e != nil {
+		t.Fatalf("Failed writing %s: %s", path, e)
+	}
+	return path
+}
+
+func TestPatchelfReplaceNeeded(t *testing.T) {
+	input := corpusInput(t, "shared_le.so")
+	// Give a symbol in .strtab the dependency's name, which patchelf-compat
+	// must leave alone, since it only changes the dynamic entries' strings.
+	f := parseTestELF(t, input)
+	strtab := f.Sections[sectionNamed(t, f, ".strtab")]
+	start := int(strtab.FileOffset)
+	offset := bytes.Index(input[start:], []byte("corpus_function\x00"))
+	if offset < 0 {
+		t.Fatalf("Didn't find corpus_function in .strtab")
+	}
+	copy(input[start+offset:], "libc.so.6\x00")
+	path := writeCorpusFile(t, "shared_le.so", input)
+	e := patchelfFile(path, &patchelfOptions{
+		replacements: [][2]string{{"libc.so.6", "libc_renamed.so.6"},
+			{"libmissing.so", "libother.so"}},
+	})
+	if e != nil {
+		t.Fatalf("Failed patching %s in place: %s", path, e)
+	}
+	output, e := ioutil.ReadFile(path)
+	if e != nil {
+		t.Fatalf("Failed reading the output: %s", e)
+	}
+	f = parseTestELF(t, output)
+	// DT_NEEDED is 1.
+	if s := dynamicString(t, f, 1); s != "libc_renamed.so.6" {
+		t.Errorf("Expected the dependency to be libc_renamed.so.6, got %q",
+			s)
+	}
+	original := parseTestELF(t, input)
+	if !bytes.Equal(sectionContent(t, f, ".strtab"),
+		sectionContent(t, original, ".strtab")) {
+		t.Errorf("Replacing a dependency changed .strtab")
+	}
+}
+
+func TestPatchelfAddEntries(t *testing.T) {
+	path := writeCorpusFile(t, "shared_le.so", corpusInput(t,
+		"shared_le.so"))
+	outputPath := filepath.Join(filepath.Dir(path), "output.so")
+	e := patchelfFile(path, &patchelfOptions{
+		addNeeded: []string{"libm.so.6"},
+		setSoname: "libcorpus_renamed.so.1",
+		hasSoname: true,
+		setRpath:  "/opt/corpus/lib",
+		hasRpath:  true,
+		output:    outputPath,
+	})
+	if e != nil {
+		t.Fatalf("Failed patching %s: %s", path, e)
+	}
+	output, e := ioutil.ReadFile(outputPath)
+	if e != nil {
+		t.Fatalf("Failed reading the output: %s", e)
+	}
+	f := parseTestELF(t, output)
+	needed, e := readNeededNames(f)
+	if e != nil {
+		t.Fatalf("Failed reading the dependencies: %s", e)
+	}
+	if !reflect.DeepEqual(needed, []string{"libc.so.6", "libm.so.6"}) {
+		t.Errorf("Expected libm.so.6 to be added after libc.so.6, got %q",
+			needed)
+	}
+	if s := dynamicString(t, f, dtSoname); s != "libcorpus_renamed.so.1" {
+		t.Errorf("Expected the SONAME to be replaced, got %q", s)
+	}
+	// The file has no DT_RPATH or DT_RUNPATH, so a DT_RUNPATH is added.
+	if s := dynamicString(t, f, dtRunpath); s != "/opt/corpus/lib" {
+		t.Errorf("Expected a DT_RUNPATH of /opt/corpus/lib, got %q", s)
+	}
+	unchanged, e := ioutil.ReadFile(path)
+	if e != nil {
+		t.Fatalf("Failed reading the input: %s", e)
+	}
+	if !bytes.Equal(unchanged, corpusInput(t, "shared_le.so")) {
+		t.Errorf("Writing to --output modified the input file")
+	}
+}
+
+func TestPatchelfLocksInPlace(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Files aren't locked on Windows")
+	}
+	input := corpusInput(t, "shared_le.so")
+	path := writeCorpusFile(t, "shared_le.so", input)
+	unlock, e := lockTarget(path)
+	if e != nil {
+		t.Fatalf("Failed locking %s: %s", path, e)
+	}
+	defer unlock()
+	e = patchelfFile(path, &patchelfOptions{
+		setSoname: "libcorpus_renamed.so.1",
+		hasSoname: true,
+	})
+	if (e == nil) || !strings.Contains(e.Error(), "another process") {
+		t.Errorf("Expected an error patching a locked file, got %v", e)
+	}
+	output, e := ioutil.ReadFile(path)
+	if e != nil {
+		t.Fatalf("Failed reading %s: %s", path, e)
+	}
+	if !bytes.Equal(output, input) {
+		t.Errorf("The locked file was modified")
+	}
+}
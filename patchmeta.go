@@ -0,0 +1,92 @@
+package main
+
+// This file implements the -patchmeta flag, which writes a detached metadata
+// bundle alongside each patched file, for workflows where the audit trail
+// can't be embedded in the binary itself (e.g. size-checked firmware). The
+// bundle holds the same report as -report, which includes the data needed to
+// revert the patch, so it can be passed to the revert subcommand in place of
+// a report, along with the rules that were applied, so the attest subcommand
+// can show what produced the file.
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/yalue/elf32_string_replace/stringreplace"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// The suffix added to an output file's path to get its metadata bundle's.
+const patchMetadataSuffix = ".patchmeta"
+
+// The value of the Format field in every metadata bundle, identifying the
+// file and its version.
+const patchMetadataFormat = "elf32_string_replace-patchmeta-1"
+
+// The content of a metadata bundle.
+type patchMetadata struct {
+	Format string `json:"format"`
+	// The base names of the input and output files.
+	Input  string `json:"input"`
+	Output string `json:"output"`
+	// The SHA-256 digests of the input and output files, copied from the
+	// report for convenience.
+	InputSHA256  string                `json:"input_sha256"`
+	OutputSHA256 string                `json:"output_sha256"`
+	Report       *stringreplace.Report `json:"report"`
+	// The rules that were applied, in the format accepted by
+	// stringreplace.ParseJSONRules, and any versioned renames and strings
+	// replaced through symbols.
+	Rules            json.RawMessage                 `json:"rules"`
+	VersionedRenames []stringreplace.VersionedRename `json:"versioned_renames,omitempty"`
+	SymbolStrings    []stringreplace.SymbolString    `json:"symbol_strings,omitempty"`
+}
+
+// Writes the metadata bundle for the output file to the output path plus
+// patchMetadataSuffix.
+func writePatchMetadata(inputPath, outputPath string,
+	report *stringreplace.Report, options *stringreplace.Options) error {
+	rules, e := stringreplace.MarshalJSONRules(options.Rules)
+	if e != nil {
+		return fmt.Errorf("Failed encoding rules: %s", e)
+	}
+	content, e := json.MarshalIndent(&patchMetadata{
+		Format:           patchMetadataFormat,
+		Input:            filepath.Base(inputPath),
+		Output:           filepath.Base(outputPath),
+		InputSHA256:      report.OriginalSHA256,
+		OutputSHA256:     report.PatchedSHA256,
+		Report:           report,
+		Rules:            rules,
+		VersionedRenames: options.VersionedRenames,
+		SymbolStrings:    options.SymbolStrings,
+	}, "", "  ")
+	if e != nil {
+		return fmt.Errorf("Failed encoding metadata: %s", e)
+	}
+	content = append(content, '\n')
+	return ioutil.WriteFile(outputPath+patchMetadataSuffix, content, 0644)
+}
+
+// Returns the metadata bundle in the content, or nil if it isn't one.
+func readPatchMetadata(content []byte) (*patchMetadata, error) {
+	var metadata patchMetadata
+	e := json.Unmarshal(content, &metadata)
+	if (e != nil) || (metadata.Format != patchMetadataFormat) {
+		return nil, nil
+	}
+	if metadata.Report == nil {
+		return nil, fmt.Errorf("The metadata bundle doesn't contain a report")
+	}
+	return &metadata, nil
+}
+
+// Returns the report in the content, if it's a metadata bundle, or nil if it
+// isn't one.
+func parsePatchMetadata(content []byte) (*stringreplace.Report, error) {
+	metadata, e := readPatchMetadata(content)
+	if (metadata == nil) || (e != nil) {
+		return nil, e
+	}
+	return metadata.Report, nil
+}
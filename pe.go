@@ -0,0 +1,64 @@
+package main
+
+// This file contains the code for patching PE files, in which only the DLL
+// names in the import and delay-load import directories are replaced.
+
+import (
+	"fmt"
+	"github.com/yalue/elf32_string_replace/stringreplace"
+	"io"
+	"log"
+	"os"
+)
+
+// Writes the changes to w, in the same format as writeReplacementDiff.
+func writePEDiff(w io.Writer, name string, changes []stringreplace.PEChange) {
+	fmt.Fprintf(w, "%sdiff %s%s\n", colorBold, name, colorReset)
+	for _, c := range changes {
+		fmt.Fprintf(w, "%s@@ %s descriptor %d%s\n", colorBold, c.Directory,
+			c.DescriptorIndex, colorReset)
+		fmt.Fprintf(w, "%s-%s%s\n", colorRed, c.Original, colorReset)
+		fmt.Fprintf(w, "%s+%s%s\n", colorGreen, c.New, colorReset)
+		if c.NewRVA != c.OriginalRVA {
+			fmt.Fprintf(w, "    moved from RVA 0x%08x to 0x%08x\n",
+				c.OriginalRVA, c.NewRVA)
+		}
+	}
+}
+
+// Replaces the DLL names in a PE file, and writes the result to outputPath,
+// if it isn't empty.
+func processPEFile(inputPath, outputPath string, rawInput []byte,
+	settings *fileSettings) error {
+	if (settings.patchScript != "") || (settings.embeddedOffset != "") ||
+		(settings.reportPath != "") || settings.showListing ||
+		(len(settings.checksums) != 0) || (settings.checksumCommand != "") ||
+		(settings.mapFile != "") || settings.patchMeta {
+		return fmt.Errorf("The -patch_script, -embedded_offset, -report, " +
+			"-listing, -map_file, -patchmeta, and checksum flags aren't " +
+			"supported for PE files")
+	}
+	log.Printf("Processing PE file %s.\n", inputPath)
+	output, changes, e := stringreplace.ReplacePE(rawInput, &settings.options)
+	if e != nil {
+		return e
+	}
+	e = settings.maxGrowth.check(inputPath, len(rawInput), len(output))
+	if e != nil {
+		return e
+	}
+	log.Printf("Replaced %d DLL names in %s.\n", len(changes), inputPath)
+	settings.batchReport.recordResult(nil, len(changes))
+	if settings.showDiff || settings.dryRun {
+		writePEDiff(os.Stdout, inputPath, changes)
+	}
+	if outputPath == "" {
+		return nil
+	}
+	e = writeOutputFile(outputPath, output, 0755, nil,
+		settings.syncOutput)
+	if e != nil {
+		return fmt.Errorf("Error creating output file: %s", e)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+// This file implements the -dry_run flag's preview of every reference that
+// would be rewritten, including the exact bytes, and of the strings around
+// each replacement, so the changes can be checked before writing an output
+// file.
+
+import (
+	"fmt"
+	"github.com/yalue/elf32_string_replace/stringreplace"
+	"io"
+	"strings"
+)
+
+// Returns the hex representation of the 4 bytes at the given offset in
+// content, in file order, or a placeholder if they're out of bounds.
+func previewBytes(content []byte, offset uint32) string {
+	if (uint64(offset) + 4) > uint64(len(content)) {
+		return "<out of bounds>"
+	}
+	b := content[offset : offset+4]
+	return fmt.Sprintf("%02x %02x %02x %02x", b[0], b[1], b[2], b[3])
+}
+
+// Writes one line to w for each reference updated in the report, giving its
+// file offset, the field containing it, and its value and bytes before and
+// after patching. The original and patched arguments hold the ELF file's
+// content before and after patching. The baseOffset is added to each file
+// offset, for ELF files embedded in a larger image.
+func writeReferencePreview(w io.Writer, name string, original,
+	patched []byte, baseOffset int, report *stringreplace.Report) {
+	fmt.Fprintf(w, "%d references would be rewritten in %s:\n",
+		len(report.References), name)
+	var offset uint32
+	for _, r := range report.References {
+		offset = r.FileOffset
+		fmt.Fprintf(w, "  0x%08x  %-36s  0x%08x -> 0x%08x  [%s] -> [%s]\n",
+			uint64(offset)+uint64(baseOffset), r.Location, r.OriginalValue,
+			r.NewValue, previewBytes(original, offset),
+			previewBytes(patched, offset))
+	}
+}
+
+// Holds an entry in a string table, for writeReplacementContext.
+type tableEntry struct {
+	offset  uint32
+	content string
+}
+
+// Splits the string table content into its entries.
+func splitTableEntries(content []byte) []tableEntry {
+	toReturn := make([]tableEntry, 0, 64)
+	var offset uint32
+	for _, s := range strings.Split(string(content), "\x00") {
+		toReturn = append(toReturn, tableEntry{
+			offset:  offset,
+			content: s,
+		})
+		offset += uint32(len(s)) + 1
+	}
+	// The last entry only holds whatever follows the final NUL, which is
+	// empty in well-formed tables.
+	if toReturn[len(toReturn)-1].content == "" {
+		toReturn = toReturn[:len(toReturn)-1]
+	}
+	return toReturn
+}
+
+// Writes each replacement in the report along with up to the given number of
+// neighboring entries before and after it in the original string table, so
+// that clusters of similar strings hit by the same rule stand out. Replaced
+// neighbors are marked with a '*' and shown with their new values. The
+// original argument holds the ELF file's content before patching.
+func writeReplacementContext(w io.Writer, name string, original []byte,
+	report *stringreplace.Report, context int) {
+	if (context <= 0) || (len(report.Replacements) == 0) {
+		return
+	}
+	fmt.Fprintf(w, "Replacements in %s, with %d neighboring strings:\n", name,
+		context)
+	for _, t := range report.Tables {
+		end := uint64(t.OriginalOffset) + uint64(t.OriginalSize)
+		if end > uint64(len(original)) {
+			fmt.Fprintf(w, "  %s: <original table out of bounds>\n", t.Name)
+			continue
+		}
+		entries := splitTableEntries(original[t.OriginalOffset:end])
+		replaced := make(map[uint32]*stringreplace.Replacement)
+		for i := range report.Replacements {
+			r := &(report.Replacements[i])
+			if r.SectionIndex == t.SectionIndex {
+				replaced[r.OriginalOffset] = r
+			}
+		}
+		for i, entry := range entries {
+			if replaced[entry.offset] == nil {
+				continue
+			}
+			fmt.Fprintf(w, "  %s +0x%06x:\n", t.Name, entry.offset)
+			first := i - context
+			if first < 0 {
+				first = 0
+			}
+			last := i + context
+			if last >= len(entries) {
+				last = len(entries) - 1
+			}
+			for j := first; j <= last; j++ {
+				writeContextEntry(w, &(entries[j]), replaced[entries[j].offset],
+					j == i)
+			}
+		}
+	}
+}
+
+// Writes a single line of writeReplacementContext's output. The replacement
+// is nil if the entry wasn't replaced. The current entry is marked with an
+// arrow.
+func writeContextEntry(w io.Writer, entry *tableEntry,
+	replacement *stringreplace.Replacement, current bool) {
+	marker := " "
+	if current {
+		marker = ">"
+	} else if replacement != nil {
+		marker = "*"
+	}
+	if replacement == nil {
+		fmt.Fprintf(w, "   %s +0x%06x  %s\n", marker, entry.offset,
+			stringreplace.EscapeString(entry.content))
+		return
+	}
+	fmt.Fprintf(w, "   %s +0x%06x  %s -> %s\n", marker, entry.offset,
+		replacement.Original, replacement.New)
+}
@@ -0,0 +1,61 @@
+package main
+
+// This file implements the -profile_cpu and -profile_mem flags, which write
+// pprof profiles covering a run, for diagnosing performance problems with
+// large inputs.
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"runtime/pprof"
+)
+
+// Starts CPU profiling if cpuPath isn't empty. Returns a function that must
+// be called at the end of the run, which stops CPU profiling and writes a
+// heap profile to memPath, if it isn't empty.
+func startProfiling(cpuPath, memPath string) (func(), error) {
+	var cpuFile *os.File
+	var e error
+	if cpuPath != "" {
+		cpuFile, e = os.Create(cpuPath)
+		if e != nil {
+			return nil, fmt.Errorf("Failed creating CPU profile: %s", e)
+		}
+		e = pprof.StartCPUProfile(cpuFile)
+		if e != nil {
+			cpuFile.Close()
+			return nil, fmt.Errorf("Failed starting CPU profile: %s", e)
+		}
+	}
+	return func() {
+		if cpuFile != nil {
+			pprof.StopCPUProfile()
+			cpuFile.Close()
+			log.Printf("Wrote CPU profile to %s.\n", cpuPath)
+		}
+		if memPath == "" {
+			return
+		}
+		e := writeHeapProfile(memPath)
+		if e != nil {
+			log.Printf("Failed writing memory profile: %s\n", e)
+			return
+		}
+		log.Printf("Wrote memory profile to %s.\n", memPath)
+	}, nil
+}
+
+// Writes a heap profile, reflecting all allocations made so far, to the
+// given path.
+func writeHeapProfile(path string) error {
+	f, e := os.Create(path)
+	if e != nil {
+		return e
+	}
+	defer f.Close()
+	// Make sure the profile reflects up-to-date statistics.
+	runtime.GC()
+	return pprof.WriteHeapProfile(f)
+}
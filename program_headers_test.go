@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/binary"
+	"github.com/yalue/elf32_string_replace/stringreplace"
+	"regexp"
+	"testing"
+)
+
+// Returns a copy of the corpus file with the given name whose program header
+// table is moved to the end of the file and padded with PT_NULL entries to
+// the given number of entries, using PN_XNUM to store the count in section
+// 0's sh_info.
+func manyProgramHeaders(t *testing.T, name string, count uint32) []byte {
+	content := corpusInput(t, name)
+	f := parseTestELF(t, content)
+	o := binary.LittleEndian
+	offset := uint32(len(content))
+	table := make([]byte, 32*count)
+	copy(table, content[f.Header.ProgramHeaderOffset:][:32*len(f.Segments)])
+	content = append(content, table...)
+	// e_phoff, e_phnum, and section 0's sh_info.
+	o.PutUint32(content[28:], offset)
+	o.PutUint16(content[44:], 0xffff)
+	o.PutUint32(content[f.Header.SectionHeaderOffset+28:], count)
+	return content
+}
+
+func TestExtendedProgramHeaderCount(t *testing.T) {
+	count := uint32(0x10005)
+	input := manyProgramHeaders(t, "shared_le.so", count)
+	f, e := stringreplace.ParseELF32File(input)
+	if e != nil {
+		t.Fatalf("Failed parsing the input: %s", e)
+	}
+	if uint32(len(f.Segments)) != count {
+		t.Fatalf("Expected %d program headers, got %d", count,
+			len(f.Segments))
+	}
+	// Relocating .dynstr adds a loadable segment, and rewrites the table.
+	output, _, e := stringreplace.Replace(input, stringreplace.Options{
+		Rules: []stringreplace.Rule{{
+			Match:       regexp.MustCompile(`^libc\.so\.6$`),
+			Replacement: "libc_with_a_longer_name.so.6",
+		}},
+	})
+	if e != nil {
+		t.Fatalf("Failed replacing strings: %s", e)
+	}
+	f, e = stringreplace.ParseELF32File(output)
+	if e != nil {
+		t.Fatalf("Failed parsing the output: %s", e)
+	}
+	if f.Header.ProgramHeaderEntries != 0xffff {
+		t.Errorf("Expected e_phnum to be PN_XNUM, got 0x%x",
+			f.Header.ProgramHeaderEntries)
+	}
+	if f.Sections[0].Info != (count + 1) {
+		t.Errorf("Expected section 0's sh_info to hold %d, got %d",
+			count+1, f.Sections[0].Info)
+	}
+	if uint32(len(f.Segments)) != (count + 1) {
+		t.Fatalf("Expected %d program headers in the output, got %d",
+			count+1, len(f.Segments))
+	}
+	if s := f.Segments[count]; s.Type != 1 {
+		t.Errorf("The new program header isn't a PT_LOAD segment: %+v", s)
+	}
+	// DT_NEEDED is 1.
+	if s := dynamicString(t, f, 1); s != "libc_with_a_longer_name.so.6" {
+		t.Errorf("Expected the output to need the new name, got %q", s)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+// This file contains code for reporting progress when processing many files.
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// Periodically writes the number of files processed, the current file, and an
+// estimate of the remaining time.
+type progressReporter struct {
+	output io.Writer
+	// The minimum time between reports. Progress is never reported if this is
+	// 0.
+	interval   time.Duration
+	total      int
+	done       int
+	start      time.Time
+	lastReport time.Time
+}
+
+// Returns a new progressReporter for the given number of files. Reports are
+// written to w at most once per interval.
+func newProgressReporter(w io.Writer, total int,
+	interval time.Duration) *progressReporter {
+	now := time.Now()
+	return &progressReporter{
+		output:     w,
+		interval:   interval,
+		total:      total,
+		start:      now,
+		lastReport: now,
+	}
+}
+
+// Returns a human-readable estimate of the time remaining, based on the
+// average time per file so far.
+func (p *progressReporter) estimateRemaining() string {
+	if p.done == 0 {
+		return "unknown"
+	}
+	perFile := time.Since(p.start) / time.Duration(p.done)
+	remaining := perFile * time.Duration(p.total-p.done)
+	return remaining.Round(time.Second).String()
+}
+
+// Must be called before processing each file. Writes a progress report if
+// enough time has passed since the last one.
+func (p *progressReporter) startFile(path string) {
+	if p.interval <= 0 {
+		return
+	}
+	now := time.Now()
+	if now.Sub(p.lastReport) < p.interval {
+		return
+	}
+	p.lastReport = now
+	fmt.Fprintf(p.output, "Progress: %d/%d files done (%.1f%%), current: %s, "+
+		"ETA: %s\n", p.done, p.total,
+		100.0*float64(p.done)/float64(p.total), path, p.estimateRemaining())
+}
+
+// Must be called after processing each file, whether or not it succeeded.
+func (p *progressReporter) finishFile() {
+	p.done++
+}
+
+// Writes a final report, if progress reporting is enabled.
+func (p *progressReporter) finish() {
+	if p.interval <= 0 {
+		return
+	}
+	fmt.Fprintf(p.output, "Progress: %d/%d files done in %s\n", p.done,
+		p.total, time.Since(p.start).Round(time.Millisecond))
+}
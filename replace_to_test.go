@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"github.com/yalue/elf32_string_replace/stringreplace"
+	"regexp"
+	"testing"
+)
+
+func TestReplaceToMatchesReplace(t *testing.T) {
+	rules := []stringreplace.Rule{{
+		Match:       regexp.MustCompile(`^libc\.so\.6$`),
+		Replacement: "libc_replaced_for_streaming.so.6",
+	}}
+	files := []string{"shared_le.so", "shared_be.so", "exec_dynamic"}
+	for _, name := range files {
+		input := corpusInput(t, name)
+		original := append([]byte(nil), input...)
+		for _, inPlace := range []bool{false, true} {
+			options := stringreplace.Options{
+				Rules:   rules,
+				InPlace: inPlace,
+			}
+			expected, _, e := stringreplace.Replace(input, options)
+			if e != nil {
+				t.Fatalf("Failed patching %s: %s", name, e)
+			}
+			var output bytes.Buffer
+			_, e = stringreplace.ReplaceTo(&output, input, options)
+			if e != nil {
+				t.Fatalf("Failed patching %s to a writer: %s", name, e)
+			}
+			if !bytes.Equal(output.Bytes(), expected) {
+				t.Errorf("ReplaceTo's output for %s (in place: %v) doesn't "+
+					"match Replace's", name, inPlace)
+			}
+		}
+		if !bytes.Equal(input, original) {
+			t.Errorf("Patching %s modified the input", name)
+		}
+	}
+}
+
+func TestReplaceToDryRun(t *testing.T) {
+	options := stringreplace.Options{
+		Rules:  sonameRule("libdry_run.so"),
+		DryRun: true,
+	}
+	var output bytes.Buffer
+	report, e := stringreplace.ReplaceTo(&output, corpusInput(t,
+		"suffix_sharing.so"), options)
+	if e != nil {
+		t.Fatalf("Failed patching in a dry run: %s", e)
+	}
+	if report == nil {
+		t.Errorf("Didn't get a report from a dry run")
+	}
+	if output.Len() != 0 {
+		t.Errorf("Expected a dry run to write nothing, but it wrote %d "+
+			"bytes", output.Len())
+	}
+	// Embedded images are patched in same-size mode, so this needs a file
+	// without strings sharing the replaced one's bytes.
+	options.Rules = []stringreplace.Rule{{
+		Match:       regexp.MustCompile(`^libc\.so\.6$`),
+		Replacement: "libz.so.6",
+	}}
+	_, e = stringreplace.ReplaceEmbeddedTo(&output, corpusInput(t,
+		"shared_le.so"), 0, options)
+	if e != nil {
+		t.Fatalf("Failed patching an embedded image in a dry run: %s", e)
+	}
+	if output.Len() != 0 {
+		t.Errorf("Expected a dry run of an embedded image to write "+
+			"nothing, but it wrote %d bytes", output.Len())
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+// This file implements the -report flag, which saves a JSON description of
+// the changes made to a file, and the "revert" subcommand, which uses such a
+// report to restore the original file.
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/yalue/elf32_string_replace/stringreplace"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// Writes the report to the file at the given path, as indented JSON, or to
+// stdout if the path is "-".
+func writeReportFile(path string, report *stringreplace.Report) error {
+	content, e := json.MarshalIndent(report, "", "  ")
+	if e != nil {
+		return fmt.Errorf("Failed encoding report: %s", e)
+	}
+	content = append(content, '\n')
+	if path == "-" {
+		_, e = os.Stdout.Write(content)
+		return e
+	}
+	return ioutil.WriteFile(path, content, 0644)
+}
+
+// Reads a report previously written by writeReportFile, or the report in a
+// metadata bundle written by writePatchMetadata.
+func readReportFile(path string) (*stringreplace.Report, error) {
+	content, e := ioutil.ReadFile(path)
+	if e != nil {
+		return nil, e
+	}
+	bundled, e := parsePatchMetadata(content)
+	if (bundled != nil) || (e != nil) {
+		return bundled, e
+	}
+	var report stringreplace.Report
+	e = json.Unmarshal(content, &report)
+	if e != nil {
+		return nil, fmt.Errorf("Failed parsing report: %s", e)
+	}
+	return &report, nil
+}
+
+// Runs the "revert" subcommand, with the given arguments, not including the
+// subcommand name itself. Returns the process exit code.
+func runRevertCommand(arguments []string) int {
+	var inputFile, reportFile, outputFile string
+	var syncOutput bool
+	flags := flag.NewFlagSet("revert", flag.ContinueOnError)
+	flags.StringVar(&inputFile, "file", "", "The path to the patched ELF "+
+		"file.")
+	flags.StringVar(&reportFile, "report", "", "The path to the report "+
+		"written by -report when the file was patched, or the metadata "+
+		"bundle written by -patchmeta.")
+	flags.StringVar(&outputFile, "output", "", "The path at which to write "+
+		"the restored file, or \"-\" for stdout.")
+	flags.BoolVar(&syncOutput, "sync", false, "Flush the restored file and "+
+		"its directory to storage after it's renamed into place.")
+	e := flags.Parse(arguments)
+	if e != nil {
+		return 1
+	}
+	if (inputFile == "") || (reportFile == "") || (outputFile == "") {
+		log.Println("Invalid arguments. Run with -help for more information.")
+		return 1
+	}
+	report, e := readReportFile(reportFile)
+	if e != nil {
+		log.Printf("Failed reading report: %s\n", e)
+		return 1
+	}
+	patched, e := ioutil.ReadFile(inputFile)
+	if e != nil {
+		log.Printf("Failed reading input file: %s\n", e)
+		return 1
+	}
+	original, e := stringreplace.Revert(patched, report)
+	if e != nil {
+		log.Printf("Failed reverting %s: %s\n", inputFile, e)
+		return 1
+	}
+	e = writeOutputFile(outputFile, original, 0755, verifyELFOutput,
+		syncOutput)
+	if e != nil {
+		log.Printf("Error creating output file: %s\n", e)
+		return 1
+	}
+	if outputFile != "-" {
+		log.Printf("Restored %d ranges and removed %d appended bytes.\n",
+			len(report.Restore), len(patched)-len(original))
+	}
+	return 0
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/yalue/elf32_string_replace/stringreplace"
+	"github.com/yalue/elf_reader"
+	"regexp"
+	"testing"
+)
+
+// Returns the index of the section with the given name, failing the test if
+// there isn't one.
+func sectionNamed(t *testing.T, f *elf_reader.ELF32File, name string) uint16 {
+	for i := range f.Sections {
+		n, e := f.GetSectionName(uint16(i))
+		if (e == nil) && (n == name) {
+			return uint16(i)
+		}
+	}
+	t.Fatalf("The file has no %s section", name)
+	return 0
+}
+
+// Returns the content of the section with the given name.
+func sectionContent(t *testing.T, f *elf_reader.ELF32File,
+	name string) []byte {
+	content, e := f.GetSectionContent(sectionNamed(t, f, name))
+	if e != nil {
+		t.Fatalf("Failed reading %s: %s", name, e)
+	}
+	return content
+}
+
+// Returns the PT_RISCV_ATTRIBUTES segment, failing the test if there isn't
+// one.
+func riscvAttributesSegment(t *testing.T,
+	f *elf_reader.ELF32File) elf_reader.ELF32ProgramHeader {
+	for _, s := range f.Segments {
+		if uint32(s.Type) == 0x70000003 {
+			return s
+		}
+	}
+	t.Fatalf("The file has no PT_RISCV_ATTRIBUTES segment")
+	return elf_reader.ELF32ProgramHeader{}
+}
+
+func TestRISCVRelocations(t *testing.T) {
+	input := corpusInput(t, "riscv32.so")
+	output, _, e := stringreplace.Replace(input, stringreplace.Options{
+		Rules: []stringreplace.Rule{{
+			Match:       regexp.MustCompile(`^libc\.so\.6$`),
+			Replacement: "libc_with_a_longer_name.so.6",
+		}},
+	})
+	if e != nil {
+		t.Fatalf("Failed replacing strings: %s", e)
+	}
+	original := parseTestELF(t, input)
+	f := parseTestELF(t, output)
+	// The attributes, and the unloaded segment covering them, must be left
+	// alone.
+	originalAttributes := sectionContent(t, original, ".riscv.attributes")
+	if !bytes.Equal(sectionContent(t, f, ".riscv.attributes"),
+		originalAttributes) {
+		t.Errorf("The content of .riscv.attributes changed")
+	}
+	if riscvAttributesSegment(t, f) != riscvAttributesSegment(t, original) {
+		t.Errorf("The PT_RISCV_ATTRIBUTES segment changed")
+	}
+	// The corpus file's .rela.dyn holds an R_RISCV_RELATIVE relocation
+	// followed by an R_RISCV_TLS_TPREL32 one, both with the address of the
+	// dependency's name as their addend. Only the first is an address, so
+	// only it must follow the relocated string.
+	originalRelocations := sectionContent(t, original, ".rela.dyn")
+	relocations := sectionContent(t, f, ".rela.dyn")
+	dynstr := &(f.Sections[sectionNamed(t, f, ".dynstr")])
+	relative := binary.LittleEndian.Uint32(relocations[8:])
+	content := sectionContent(t, f, ".dynstr")
+	offset := relative - dynstr.VirtualAddress
+	if (relative < dynstr.VirtualAddress) ||
+		(offset >= uint32(len(content))) {
+		t.Fatalf("The R_RISCV_RELATIVE addend (0x%08x) doesn't point into "+
+			"the relocated .dynstr", relative)
+	}
+	name := content[offset:]
+	name = name[:bytes.IndexByte(name, 0)]
+	if string(name) != "libc_with_a_longer_name.so.6" {
+		t.Errorf("The R_RISCV_RELATIVE addend points to %q", name)
+	}
+	if !bytes.Equal(relocations[12:], originalRelocations[12:]) {
+		t.Errorf("The R_RISCV_TLS_TPREL32 relocation was changed")
+	}
+}
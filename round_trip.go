@@ -0,0 +1,59 @@
+package main
+
+// This file implements the "round-trip" subcommand, which patches files with
+// a rule that can't match anything and checks that the output is identical to
+// the input, to confirm that the tool doesn't change a file on its own.
+
+import (
+	"flag"
+	"github.com/yalue/elf32_string_replace/stringreplace"
+	"io/ioutil"
+	"log"
+)
+
+// Runs the "round-trip" subcommand, with the given arguments, not including
+// the subcommand name itself. Returns the process exit code: 0 if every file
+// is unchanged, and 1 otherwise.
+func runRoundTripCommand(arguments []string) int {
+	var inputFile string
+	var sameSize bool
+	flags := flag.NewFlagSet("round-trip", flag.ContinueOnError)
+	flags.StringVar(&inputFile, "file", "", "The path to the ELF file to "+
+		"check. Additional files may be given as positional arguments.")
+	flags.BoolVar(&sameSize, "same_size", false, "Run the in-place pipeline "+
+		"used for images given with -embedded_offset, rather than the one "+
+		"relocating string tables.")
+	e := flags.Parse(arguments)
+	if e != nil {
+		return 1
+	}
+	paths := flags.Args()
+	if inputFile != "" {
+		paths = append([]string{inputFile}, paths...)
+	}
+	if len(paths) == 0 {
+		log.Println("Invalid arguments. Run with -help for more information.")
+		return 1
+	}
+	failed := 0
+	for _, path := range paths {
+		rawInput, e := ioutil.ReadFile(path)
+		if e == nil {
+			e = stringreplace.CheckRoundTrip(rawInput, stringreplace.Options{
+				SameSize: sameSize,
+			})
+		}
+		if e != nil {
+			log.Printf("%s: round trip failed: %s\n", path, e)
+			failed++
+			continue
+		}
+		log.Printf("%s: unchanged.\n", path)
+	}
+	if failed != 0 {
+		log.Printf("%d of %d files failed the round trip.\n", failed,
+			len(paths))
+		return 1
+	}
+	return 0
+}
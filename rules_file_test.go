@@ -0,0 +1,58 @@
+package main
+
+import (
+	"github.com/yalue/elf32_string_replace/stringreplace"
+	"github.com/yalue/elf_reader"
+	"testing"
+)
+
+// Returns true if the symbol table has a symbol with the given name.
+func symbolNamed(t *testing.T, f *elf_reader.ELF32File, symbolTable,
+	stringTable, name string) bool {
+	symbols := sectionContent(t, f, symbolTable)
+	names := sectionContent(t, f, stringTable)
+	for i := 0; (i + 16) <= len(symbols); i += 16 {
+		offset := f.Endianness.Uint32(symbols[i:])
+		symbolName, e := elf_reader.ReadStringAtOffset(offset, names)
+		if e != nil {
+			t.Fatalf("Failed reading a symbol name in %s: %s", symbolTable, e)
+		}
+		if string(symbolName) == name {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRulesFileSections(t *testing.T) {
+	rules, e := stringreplace.ParseRulesFile([]byte(`
+# corpus_function is in both .dynstr and .strtab.
+^corpus_function$ renamed_function sections=.dynstr
+libc\.so\.(\d) libz.so.$1
+`))
+	if e != nil {
+		t.Fatalf("Failed parsing the rules: %s", e)
+	}
+	output, _, e := stringreplace.Replace(corpusInput(t, "shared_le.so"),
+		stringreplace.Options{
+			Rules: rules,
+			// Otherwise .strtab would be skipped regardless of the rules.
+			AllStringTables: true,
+		})
+	if e != nil {
+		t.Fatalf("Failed applying the rules: %s", e)
+	}
+	f := parseTestELF(t, output)
+	// DT_NEEDED is 1.
+	needed := dynamicString(t, f, 1)
+	if needed != "libz.so.6" {
+		t.Errorf("Expected the dependency to be libz.so.6, got %s", needed)
+	}
+	// Replaced strings are appended, so check the names the symbols use.
+	if !symbolNamed(t, f, ".dynsym", ".dynstr", "renamed_function") {
+		t.Errorf("corpus_function wasn't renamed in .dynsym")
+	}
+	if !symbolNamed(t, f, ".symtab", ".strtab", "corpus_function") {
+		t.Errorf("corpus_function was renamed in .symtab")
+	}
+}
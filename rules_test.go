@@ -0,0 +1,50 @@
+package main
+
+import (
+	"github.com/yalue/elf32_string_replace/stringreplace"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestRejectEmptyMatch(t *testing.T) {
+	input := corpusInput(t, "shared_le.so")
+	for _, pattern := range []string{`x*`, `^`, `(libc)?`, `\b`, `a|`} {
+		rules := []stringreplace.Rule{{
+			Match:       regexp.MustCompile(pattern),
+			Replacement: "libz",
+		}}
+		_, _, e := stringreplace.Replace(input, stringreplace.Options{
+			Rules: rules,
+		})
+		if e == nil {
+			t.Errorf("A rule matching %q didn't return an error", pattern)
+			continue
+		}
+		if !strings.Contains(e.Error(), "can match an empty string") {
+			t.Errorf("Unexpected error for a rule matching %q: %s", pattern,
+				e)
+		}
+	}
+	// Patterns that always consume a character are allowed.
+	_, _, e := stringreplace.Replace(input, stringreplace.Options{
+		Rules: []stringreplace.Rule{{
+			Match:       regexp.MustCompile(`c+\.so`),
+			Replacement: "z.so",
+		}},
+	})
+	if e != nil {
+		t.Errorf("Failed replacing strings with a non-empty match: %s", e)
+	}
+	// AllowEmptyMatch skips the check.
+	_, _, e = stringreplace.Replace(input, stringreplace.Options{
+		Rules: []stringreplace.Rule{{
+			Match:       regexp.MustCompile(`^(libc\.so\.6)?$`),
+			Replacement: "${1}.1",
+		}},
+		AllowEmptyMatch: true,
+	})
+	if e != nil {
+		t.Errorf("AllowEmptyMatch didn't allow an empty match: %s", e)
+	}
+}
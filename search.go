@@ -0,0 +1,272 @@
+package main
+
+// This file implements the read-only "strings" subcommand, which is intended
+// to help users decide what can safely be replaced before actually modifying
+// a file.
+
+import (
+	"flag"
+	"fmt"
+	"github.com/yalue/elf32_string_replace/stringreplace"
+	"github.com/yalue/elf_reader"
+	"io/ioutil"
+	"log"
+	"regexp"
+	"sort"
+)
+
+// Holds information about a single printable string found in an ELF section.
+type foundString struct {
+	sectionIndex uint16
+	// If this is nonnegative, the string was found in the segment with this
+	// index rather than in a section. This happens for files without section
+	// headers, such as core dumps.
+	segmentIndex int
+	// The file offset at which the string starts.
+	fileOffset uint32
+	// The virtual address at which the string will be loaded. Only valid if
+	// hasVirtualAddress is true.
+	virtualAddress    uint32
+	hasVirtualAddress bool
+	content           []byte
+}
+
+// Returns true if the byte is considered printable for the purposes of the
+// string search. Like the standard strings utility, tabs are considered
+// printable.
+func isPrintableByte(b byte) bool {
+	return (b == '\t') || ((b >= 0x20) && (b <= 0x7e))
+}
+
+// Returns true if the section's content occupies memory when the program is
+// loaded (the SHF_ALLOC flag).
+func sectionIsAllocated(section *elf_reader.ELF32SectionHeader) bool {
+	return (uint32(section.Flags) & 2) != 0
+}
+
+// Calls found with the start and end offsets of each run of at least
+// minLength printable characters in content that matches regex (if regex is
+// non-nil).
+func scanPrintableStrings(content []byte, minLength int, regex *regexp.Regexp,
+	found func(start, end int)) {
+	start := -1
+	// Looping to len(content) (inclusive) handles strings ending exactly at
+	// the end of the content.
+	for j := 0; j <= len(content); j++ {
+		if (j < len(content)) && isPrintableByte(content[j]) {
+			if start < 0 {
+				start = j
+			}
+			continue
+		}
+		if start < 0 {
+			continue
+		}
+		if ((j - start) >= minLength) &&
+			((regex == nil) || regex.Match(content[start:j])) {
+			found(start, j)
+		}
+		start = -1
+	}
+}
+
+// Scans the content of every section containing file data for runs of at
+// least minLength printable characters. If regex is non-nil, only strings
+// matching it will be returned. Unlike the replacement code, this doesn't
+// only look at string tables. If the file has no sections (e.g. a core dump),
+// the content of each segment is scanned instead.
+func findPrintableStrings(f *elf_reader.ELF32File, minLength int,
+	regex *regexp.Regexp) ([]foundString, error) {
+	toReturn := make([]foundString, 0, 32)
+	var section *elf_reader.ELF32SectionHeader
+	var content []byte
+	var e error
+	for i := range f.Sections {
+		section = &(f.Sections[i])
+		// Skip the null section type (0) and sections without any file
+		// content (type 8, SHT_NOBITS).
+		if (section.Type == 0) || (section.Type == 8) || (section.Size == 0) {
+			continue
+		}
+		content, e = f.GetSectionContent(uint16(i))
+		if e != nil {
+			return nil, fmt.Errorf("Failed reading section %d: %s", i, e)
+		}
+		scanPrintableStrings(content, minLength, regex, func(start, end int) {
+			toReturn = append(toReturn, foundString{
+				sectionIndex:      uint16(i),
+				segmentIndex:      -1,
+				fileOffset:        section.FileOffset + uint32(start),
+				virtualAddress:    section.VirtualAddress + uint32(start),
+				hasVirtualAddress: sectionIsAllocated(section),
+				content:           content[start:end],
+			})
+		})
+	}
+	if len(f.Sections) > 1 {
+		return toReturn, nil
+	}
+	var segment *elf_reader.ELF32ProgramHeader
+	for i := range f.Segments {
+		segment = &(f.Segments[i])
+		if (segment.FileSize == 0) || ((uint64(segment.FileOffset) +
+			uint64(segment.FileSize)) > uint64(len(f.Raw))) {
+			continue
+		}
+		content = f.Raw[segment.FileOffset : segment.FileOffset+
+			segment.FileSize]
+		scanPrintableStrings(content, minLength, regex, func(start, end int) {
+			toReturn = append(toReturn, foundString{
+				segmentIndex:   i,
+				fileOffset:     segment.FileOffset + uint32(start),
+				virtualAddress: segment.VirtualAddress + uint32(start),
+				hasVirtualAddress: segment.Type ==
+					elf_reader.LoadableSegment,
+				content: content[start:end],
+			})
+		})
+	}
+	return toReturn, nil
+}
+
+// Runs the "strings" subcommand, with the given arguments, not including the
+// subcommand name itself. Returns the process exit code.
+func runStringsCommand(arguments []string) int {
+	var inputFile, matchRegex, onlySection string
+	var minLength int
+	var showReferences bool
+	flags := flag.NewFlagSet("strings", flag.ContinueOnError)
+	flags.StringVar(&inputFile, "file", "", "The path to the input ELF file.")
+	flags.StringVar(&matchRegex, "to_match", "", "If set, only print strings "+
+		"matching this regular expression.")
+	flags.IntVar(&minLength, "min_length", 4, "The minimum number of "+
+		"printable characters needed to report a string.")
+	flags.StringVar(&onlySection, "section", "", "If set, only print strings "+
+		"in the section with this name.")
+	flags.BoolVar(&showReferences, "references", false, "List the "+
+		"instructions that appear to refer to each loaded string, which may "+
+		"depend on its length or content.")
+	e := flags.Parse(arguments)
+	if e != nil {
+		return 1
+	}
+	if (inputFile == "") || (minLength <= 0) {
+		log.Println("Invalid arguments. Run with -help for more information.")
+		return 1
+	}
+	var regex *regexp.Regexp
+	if matchRegex != "" {
+		regex, e = regexp.Compile(matchRegex)
+		if e != nil {
+			log.Printf("Failed processing to_match regular expression: %s\n", e)
+			return 1
+		}
+	}
+	rawInput, e := ioutil.ReadFile(inputFile)
+	if e != nil {
+		log.Printf("Failed reading input file: %s\n", e)
+		return 1
+	}
+	elf, e := stringreplace.ParseELF32File(rawInput)
+	if e != nil {
+		log.Printf("Failed parsing the input file: %s\n", e)
+		return 1
+	}
+	found, e := findPrintableStrings(elf, minLength, regex)
+	if e != nil {
+		log.Printf("Failed searching for strings: %s\n", e)
+		return 1
+	}
+	var sectionName, address string
+	names := make([]string, len(found))
+	for i, s := range found {
+		if s.segmentIndex >= 0 {
+			names[i] = fmt.Sprintf("<segment %d>", s.segmentIndex)
+			continue
+		}
+		names[i], e = stringreplace.SectionName(elf, s.sectionIndex)
+		if e != nil {
+			names[i] = fmt.Sprintf("<section %d>", s.sectionIndex)
+		}
+	}
+	var references []stringreplace.CodeReference
+	if showReferences {
+		references, e = findStringReferences(elf, found, names, onlySection)
+		if e != nil {
+			log.Printf("Failed searching for references: %s\n", e)
+			return 1
+		}
+	}
+	for i, s := range found {
+		sectionName = names[i]
+		if (onlySection != "") && (sectionName != onlySection) {
+			continue
+		}
+		address = "-"
+		if s.hasVirtualAddress {
+			address = fmt.Sprintf("0x%08x", s.virtualAddress)
+		}
+		log.Printf("%-20s offset 0x%08x  VA %-10s  %s\n",
+			stringreplace.EscapeString(sectionName), s.fileOffset, address,
+			s.content)
+		if s.hasVirtualAddress {
+			logStringReferences(elf, &s, references)
+		}
+	}
+	return 0
+}
+
+// Returns the code references to any of the loaded strings that will be
+// printed, sorted by target address.
+func findStringReferences(f *elf_reader.ELF32File, found []foundString,
+	names []string, onlySection string) ([]stringreplace.CodeReference,
+	error) {
+	var start, end uint32
+	foundAny := false
+	for i, s := range found {
+		if !s.hasVirtualAddress ||
+			((onlySection != "") && (names[i] != onlySection)) {
+			continue
+		}
+		// Include the terminating NUL, which code may refer to as well.
+		stringEnd := s.virtualAddress + uint32(len(s.content)) + 1
+		if !foundAny || (s.virtualAddress < start) {
+			start = s.virtualAddress
+		}
+		if !foundAny || (stringEnd > end) {
+			end = stringEnd
+		}
+		foundAny = true
+	}
+	if !foundAny {
+		return nil, nil
+	}
+	return stringreplace.FindCodeReferences(f, start, end)
+}
+
+// Logs each reference to the string, found using findStringReferences.
+func logStringReferences(f *elf_reader.ELF32File, s *foundString,
+	references []stringreplace.CodeReference) {
+	end := s.virtualAddress + uint32(len(s.content)) + 1
+	first := sort.Search(len(references), func(i int) bool {
+		return references[i].Target >= s.virtualAddress
+	})
+	var r *stringreplace.CodeReference
+	for i := first; i < len(references); i++ {
+		r = &(references[i])
+		if r.Target >= end {
+			break
+		}
+		sectionName, e := stringreplace.SectionName(f, r.SectionIndex)
+		if e != nil {
+			sectionName = fmt.Sprintf("<section %d>", r.SectionIndex)
+		}
+		offset := ""
+		if r.Target != s.virtualAddress {
+			offset = fmt.Sprintf(" (string + %d)",
+				r.Target-s.virtualAddress)
+		}
+		log.Printf("    referenced by %s at 0x%08x in %s%s\n", r.Kind,
+			r.Address, stringreplace.EscapeString(sectionName), offset)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+// This file implements the "selftest" subcommand, which patches synthetic
+// ELF files generated in memory and checks the results, so users can
+// confirm that their build of the tool works on their platform before using
+// it on real binaries. The checks are independent of any particular loader;
+// use the verify-loader subcommand for those.
+
+import (
+	"bytes"
+	"debug/elf"
+	"flag"
+	"fmt"
+	"github.com/yalue/elf32_string_replace/stringreplace"
+	"log"
+	"regexp"
+)
+
+// Describes one of the canned replacements carried out by the self-test.
+type selfTestCase struct {
+	// The name of the corpus file to patch.
+	file string
+	// A short description of the replacement, e.g. "relocated tables".
+	description string
+	// The dependency name expected in the output, followed by any added
+	// using the options' AddNeeded.
+	needed  string
+	options stringreplace.Options
+	// If set, the output must also satisfy the invariants of this dynamic
+	// loader.
+	loader *stringreplace.Loader
+	// If true, the file is patched with a rule matching nothing, and must
+	// be unchanged, rather than being patched using the options.
+	roundTrip bool
+}
+
+// Returns the replacements carried out by the self-test.
+func selfTestCases() []selfTestCase {
+	rule := func(replacement string) []stringreplace.Rule {
+		return []stringreplace.Rule{{
+			Match:       regexp.MustCompile(`^libc\.so\.6$`),
+			Replacement: replacement,
+		}}
+	}
+	toReturn := make([]selfTestCase, 0, 32)
+	for _, file := range []string{"shared_le.so", "shared_be.so",
+		"exec_dynamic", "riscv32.so"} {
+		toReturn = append(toReturn, selfTestCase{
+			file:        file,
+			description: "relocated tables",
+			needed:      "libselftest.so.6",
+			options: stringreplace.Options{
+				Rules: rule("libselftest.so.6"),
+			},
+		}, selfTestCase{
+			file:        file,
+			description: "same size",
+			needed:      "libk.so.6",
+			options: stringreplace.Options{
+				Rules:    rule("libk.so.6"),
+				SameSize: true,
+			},
+		}, selfTestCase{
+			file:        file,
+			description: "added needed",
+			needed:      "libc.so.6",
+			options: stringreplace.Options{
+				AddNeeded: []string{"libselftest.so.1"},
+			},
+		})
+	}
+	// Dynamic entries can't be added to 64-bit files.
+	for _, file := range []string{"shared64_le.so", "shared64_be.so",
+		"exec64_dynamic"} {
+		toReturn = append(toReturn, selfTestCase{
+			file:        file,
+			description: "relocated tables",
+			needed:      "libselftest.so.6",
+			options: stringreplace.Options{
+				Rules: rule("libselftest.so.6"),
+			},
+		}, selfTestCase{
+			file:        file,
+			description: "same size",
+			needed:      "libk.so.6",
+			options: stringreplace.Options{
+				Rules:    rule("libk.so.6"),
+				SameSize: true,
+			},
+		})
+	}
+	// Files linked against the C libraries common on embedded systems are
+	// also checked against their loaders.
+	musl := stringreplace.MuslLoader
+	uclibc := stringreplace.UclibcLoader
+	toReturn = append(toReturn, selfTestCase{
+		file:        "musl_exec",
+		description: "musl loader",
+		needed:      "libc.musl-selftest.so.1",
+		options: stringreplace.Options{
+			Rules: []stringreplace.Rule{{
+				Match:       regexp.MustCompile(`^libc\.musl-x86\.so\.1$`),
+				Replacement: "libc.musl-selftest.so.1",
+			}},
+		},
+		loader: &musl,
+	}, selfTestCase{
+		file:        "uclibc_exec",
+		description: "uClibc-ng loader",
+		needed:      "libselftest.so.0",
+		options: stringreplace.Options{
+			Rules: []stringreplace.Rule{{
+				Match:       regexp.MustCompile(`^libc\.so\.0$`),
+				Replacement: "libselftest.so.0",
+			}},
+		},
+		loader: &uclibc,
+	})
+	for _, f := range corpusFiles() {
+		toReturn = append(toReturn, selfTestCase{
+			file:        f.name,
+			description: "round trip",
+			roundTrip:   true,
+		})
+	}
+	return toReturn
+}
+
+// Returns the corpus file with the given name, or nil if there isn't one.
+func findCorpusFile(name string) *corpusFile {
+	for _, f := range corpusFiles() {
+		if f.name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// Patches the test case's file, and returns an error if the result isn't
+// what's expected or fails any of the internal checks.
+func runSelfTestCase(c *selfTestCase) error {
+	f := findCorpusFile(c.file)
+	if f == nil {
+		return fmt.Errorf("Unknown corpus file %s", c.file)
+	}
+	input := f.build()
+	if c.roundTrip {
+		return stringreplace.CheckRoundTrip(input, c.options)
+	}
+	output, report, e := stringreplace.Replace(input, c.options)
+	if e != nil {
+		return fmt.Errorf("Patching failed: %s", e)
+	}
+	if len(report.Warnings) != 0 {
+		return fmt.Errorf("Patching produced a warning: %s",
+			report.Warnings[0])
+	}
+	if c.options.SameSize && (len(output) != len(input)) {
+		return fmt.Errorf("The file's size changed from %d to %d bytes",
+			len(input), len(output))
+	}
+	if stringreplace.IsELF64File(output) {
+		e = checkELF64SelfTestOutput(output, c.needed)
+	} else {
+		e = checkELF32SelfTestOutput(output, c)
+	}
+	if e != nil {
+		return e
+	}
+	// Reverting the patch must restore the original file exactly.
+	restored, e := stringreplace.Revert(output, report)
+	if e != nil {
+		return fmt.Errorf("Reverting failed: %s", e)
+	}
+	if !bytes.Equal(restored, input) {
+		return fmt.Errorf("Reverting didn't restore the original file")
+	}
+	return nil
+}
+
+// Returns an error if the patched 32-bit ELF file doesn't have the test
+// case's dependencies, or fails the version or loader checks.
+func checkELF32SelfTestOutput(output []byte, c *selfTestCase) error {
+	elf, e := stringreplace.ParseELF32File(output)
+	if e != nil {
+		return fmt.Errorf("The output can't be parsed: %s", e)
+	}
+	needed, e := readNeededNames(elf)
+	if e != nil {
+		return e
+	}
+	expected := append([]string{c.needed}, c.options.AddNeeded...)
+	if fmt.Sprintf("%q", needed) != fmt.Sprintf("%q", expected) {
+		return fmt.Errorf("Expected the output to need %q, but got %q",
+			expected, needed)
+	}
+	problems := stringreplace.VerifyVersions(elf)
+	if len(problems) != 0 {
+		return fmt.Errorf("Symbol versions are inconsistent: %s",
+			problems[0])
+	}
+	if c.loader != nil {
+		problems = stringreplace.VerifyLoader(elf, *c.loader)
+		if len(problems) != 0 {
+			return fmt.Errorf("The output can't be loaded: %s", problems[0])
+		}
+	}
+	return nil
+}
+
+// Returns an error if the patched 64-bit ELF file can't be read by the
+// standard library, or doesn't have the given dependency. The dependency's
+// versioned symbols must also refer to it by its new name.
+func checkELF64SelfTestOutput(output []byte, needed string) error {
+	f, e := elf.NewFile(bytes.NewReader(output))
+	if e != nil {
+		return fmt.Errorf("The output can't be parsed: %s", e)
+	}
+	libraries, e := f.ImportedLibraries()
+	if e != nil {
+		return fmt.Errorf("Failed reading the dependencies: %s", e)
+	}
+	if fmt.Sprintf("%q", libraries) != fmt.Sprintf("%q", []string{needed}) {
+		return fmt.Errorf("Expected the output to need %q, but got %q",
+			[]string{needed}, libraries)
+	}
+	symbols, e := f.ImportedSymbols()
+	if e != nil {
+		return fmt.Errorf("Failed reading the imported symbols: %s", e)
+	}
+	for _, s := range symbols {
+		if (s.Library != "") && (s.Library != needed) {
+			return fmt.Errorf("Symbol %s's version requirement refers to %s",
+				s.Name, s.Library)
+		}
+	}
+	return nil
+}
+
+// Runs the "selftest" subcommand.
+func runSelfTestCommand(arguments []string) int {
+	flags := flag.NewFlagSet("selftest", flag.ContinueOnError)
+	e := flags.Parse(arguments)
+	if e != nil {
+		return 1
+	}
+	if flags.NArg() != 0 {
+		log.Println("Invalid arguments. Run with -help for more information.")
+		return 1
+	}
+	cases := selfTestCases()
+	failed := 0
+	for i := range cases {
+		c := &(cases[i])
+		e = runSelfTestCase(c)
+		status := "ok"
+		if e != nil {
+			status = "FAILED: " + e.Error()
+			failed++
+		}
+		fmt.Printf("%-22s %-16s %s\n", c.file, c.description, status)
+	}
+	if failed != 0 {
+		log.Printf("%d of %d self-tests failed.\n", failed, len(cases))
+		return 1
+	}
+	log.Printf("All %d self-tests passed.\n", len(cases))
+	return 0
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSelfTestCases(t *testing.T) {
+	cases := selfTestCases()
+	for i := range cases {
+		c := &(cases[i])
+		e := runSelfTestCase(c)
+		if e != nil {
+			t.Errorf("Self-test %s (%s) failed: %s", c.file, c.description,
+				e)
+		}
+	}
+}
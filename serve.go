@@ -0,0 +1,179 @@
+package main
+
+// This file implements the "serve" subcommand, which accepts replacement
+// requests over HTTP (on a TCP port or a Unix socket), avoiding the cost of
+// starting a new process for each file when patching many artifacts.
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/yalue/elf32_string_replace/stringreplace"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// The body of a request to the /replace endpoint.
+type serveRequest struct {
+	// The ELF file content. This is base64-encoded in the JSON.
+	Input []byte `json:"input"`
+	// A JSON array of rules, in the format accepted by
+	// stringreplace.ParseJSONRules.
+	Rules json.RawMessage `json:"rules"`
+}
+
+// Describes a single range of bytes that differs between the input and
+// output files.
+type serveChangedRange struct {
+	Offset   uint32 `json:"offset"`
+	Length   int    `json:"length"`
+	Appended bool   `json:"appended"`
+}
+
+// A summary of the changes made to the file, returned to the client.
+type serveReport struct {
+	InputSize     int                 `json:"input_size"`
+	OutputSize    int                 `json:"output_size"`
+	ChangedRanges []serveChangedRange `json:"changed_ranges"`
+	// The library's description of the changes.
+	Details *stringreplace.Report `json:"details"`
+}
+
+// The body of a response from the /replace endpoint. Exactly one of Error or
+// Output will be set.
+type serveResponse struct {
+	Error string `json:"error,omitempty"`
+	// The modified ELF file. This is base64-encoded in the JSON.
+	Output []byte       `json:"output,omitempty"`
+	Report *serveReport `json:"report,omitempty"`
+}
+
+// Writes the given response to the client as JSON, with the given status.
+func writeServeResponse(w http.ResponseWriter, status int,
+	response *serveResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	e := json.NewEncoder(w).Encode(response)
+	if e != nil {
+		log.Printf("Failed writing response: %s\n", e)
+	}
+}
+
+// Returns an http.Handler implementing the /replace endpoint. Request bodies
+// larger than maxRequestSize bytes will be rejected.
+func newReplaceHandler(maxRequestSize int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeServeResponse(w, http.StatusMethodNotAllowed, &serveResponse{
+				Error: "Only POST requests are supported",
+			})
+			return
+		}
+		var request serveRequest
+		body := http.MaxBytesReader(w, r.Body, maxRequestSize)
+		e := json.NewDecoder(body).Decode(&request)
+		if e != nil {
+			writeServeResponse(w, http.StatusBadRequest, &serveResponse{
+				Error: fmt.Sprintf("Invalid request: %s", e),
+			})
+			return
+		}
+		rules, e := stringreplace.ParseJSONRules(request.Rules)
+		if e != nil {
+			writeServeResponse(w, http.StatusBadRequest, &serveResponse{
+				Error: e.Error(),
+			})
+			return
+		}
+		output, details, e := stringreplace.Replace(request.Input,
+			stringreplace.Options{
+				Rules:  rules,
+				Logger: log.Default(),
+			})
+		if e != nil {
+			writeServeResponse(w, http.StatusUnprocessableEntity,
+				&serveResponse{
+					Error: e.Error(),
+				})
+			return
+		}
+		report := &serveReport{
+			InputSize:     len(request.Input),
+			OutputSize:    len(output),
+			ChangedRanges: make([]serveChangedRange, 0, 16),
+			Details:       details,
+		}
+		for _, c := range computeByteChanges(request.Input, output) {
+			report.ChangedRanges = append(report.ChangedRanges,
+				serveChangedRange{
+					Offset:   c.fileOffset,
+					Length:   len(c.content),
+					Appended: c.appended,
+				})
+		}
+		writeServeResponse(w, http.StatusOK, &serveResponse{
+			Output: output,
+			Report: report,
+		})
+	})
+}
+
+// Creates a listener for the given address. Addresses starting with "unix:"
+// refer to a Unix socket path, and all other addresses are TCP addresses.
+func listenOnAddress(address string) (net.Listener, error) {
+	if strings.HasPrefix(address, "unix:") {
+		path := strings.TrimPrefix(address, "unix:")
+		// Remove stale sockets left behind by a previous run, but never
+		// anything else that happens to be at the path.
+		info, e := os.Lstat(path)
+		if e == nil {
+			if (info.Mode() & os.ModeSocket) == 0 {
+				return nil, fmt.Errorf("%s already exists, and isn't a "+
+					"socket", path)
+			}
+			e = os.Remove(path)
+			if e != nil {
+				return nil, fmt.Errorf("Failed removing old socket: %s", e)
+			}
+		}
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", address)
+}
+
+// Runs the "serve" subcommand, with the given arguments, not including the
+// subcommand name itself. Returns the process exit code.
+func runServeCommand(arguments []string) int {
+	var address string
+	var maxRequestSize int64
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	flags.StringVar(&address, "listen", "127.0.0.1:7432", "The address to "+
+		"listen on. Use unix:<path> to listen on a Unix socket.")
+	flags.Int64Var(&maxRequestSize, "max_request_size", 256*1024*1024,
+		"The maximum size of a request body, in bytes.")
+	e := flags.Parse(arguments)
+	if e != nil {
+		return 1
+	}
+	if (address == "") || (maxRequestSize <= 0) {
+		log.Println("Invalid arguments. Run with -help for more information.")
+		return 1
+	}
+	listener, e := listenOnAddress(address)
+	if e != nil {
+		log.Printf("Failed listening on %s: %s\n", address, e)
+		return 1
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/replace", newReplaceHandler(maxRequestSize))
+	log.Printf("Listening on %s\n", address)
+	e = http.Serve(listener, mux)
+	if e != nil {
+		log.Printf("Server failed: %s\n", e)
+		return 1
+	}
+	return 0
+}
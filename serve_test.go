@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenOnUnixSocket(t *testing.T) {
+	dir, e := ioutil.TempDir("", "serve_test")
+	if e != nil {
+		t.Fatalf("Failed creating a temporary directory: %s", e)
+	}
+	defer os.RemoveAll(dir)
+	// A regular file at the path must be left alone.
+	path := filepath.Join(dir, "not_a_socket")
+	e = ioutil.WriteFile(path, []byte("data"), 0644)
+	if e != nil {
+		t.Fatalf("Failed creating %s: %s", path, e)
+	}
+	_, e = listenOnAddress("unix:" + path)
+	if e == nil {
+		t.Errorf("Listening on a regular file's path didn't fail")
+	}
+	content, e := ioutil.ReadFile(path)
+	if (e != nil) || (string(content) != "data") {
+		t.Errorf("The regular file at %s was changed or removed", path)
+	}
+	// A stale socket left behind by a previous run is replaced.
+	path = filepath.Join(dir, "stale.sock")
+	stale, e := net.Listen("unix", path)
+	if e != nil {
+		t.Fatalf("Failed creating a socket: %s", e)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	listener, e := listenOnAddress("unix:" + path)
+	if e != nil {
+		t.Fatalf("Failed replacing a stale socket: %s", e)
+	}
+	listener.Close()
+}
+
+// Sends a request to the /replace handler, and returns the status and the
+// decoded response.
+func postReplaceRequest(t *testing.T, method string,
+	request *serveRequest) (int, *serveResponse) {
+	body, e := json.Marshal(request)
+	if e != nil {
+		t.Fatalf("Failed encoding the request: %s", e)
+	}
+	recorder := httptest.NewRecorder()
+	newReplaceHandler(1024*1024).ServeHTTP(recorder,
+		httptest.NewRequest(method, "/replace", bytes.NewReader(body)))
+	var response serveResponse
+	e = json.Unmarshal(recorder.Body.Bytes(), &response)
+	if e != nil {
+		t.Fatalf("Failed decoding the response: %s", e)
+	}
+	return recorder.Code, &response
+}
+
+func TestReplaceHandler(t *testing.T) {
+	request := &serveRequest{
+		Input: corpusInput(t, "shared_le.so"),
+		Rules: json.RawMessage(`[{"to_match": "^libc\\.so\\.6$", ` +
+			`"replace": "libserve.so.6"}]`),
+	}
+	status, response := postReplaceRequest(t, http.MethodPost, request)
+	if status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", status, response.Error)
+	}
+	// DT_NEEDED is 1.
+	needed := dynamicString(t, parseTestELF(t, response.Output), 1)
+	if needed != "libserve.so.6" {
+		t.Errorf("Expected the output to need libserve.so.6, got %q",
+			needed)
+	}
+	if (response.Report == nil) ||
+		(response.Report.OutputSize != len(response.Output)) ||
+		(len(response.Report.ChangedRanges) == 0) {
+		t.Errorf("The response's report doesn't describe the output")
+	}
+	status, _ = postReplaceRequest(t, http.MethodGet, request)
+	if status != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405 for a GET request, got %d", status)
+	}
+	request.Rules = json.RawMessage(`[{"to_match": "("}]`)
+	status, response = postReplaceRequest(t, http.MethodPost, request)
+	if (status != http.StatusBadRequest) || (response.Error == "") {
+		t.Errorf("Expected status 400 with an error for an invalid rule, "+
+			"got %d", status)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+// This file implements the -shim_plan flag, which writes a script or manifest
+// describing how to make renamed dependencies available under their new
+// names, so the runtime environment can be brought in line with the patched
+// file in one step.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/yalue/elf32_string_replace/stringreplace"
+	"github.com/yalue/elf_reader"
+	"io/ioutil"
+)
+
+// The formats supported by -shim_plan_format.
+var shimPlanFormats = []string{"symlink", "copy", "json"}
+
+// Returns true if the format is one of shimPlanFormats.
+func isValidShimPlanFormat(format string) bool {
+	for _, f := range shimPlanFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// Describes a dependency that was renamed. The new name must be made to refer
+// to the library currently known by the original name.
+type dependencyRename struct {
+	Original string `json:"original"`
+	New      string `json:"new"`
+}
+
+// The content of a JSON shim plan.
+type shimManifest struct {
+	// The path to the patched file.
+	File         string             `json:"file"`
+	Dependencies []dependencyRename `json:"dependencies"`
+}
+
+// Returns the names in the file's DT_NEEDED entries, in order.
+func readNeededNames(f *elf_reader.ELF32File) ([]string, error) {
+	// Tag 1 is DT_NEEDED.
+	return readDynamicStrings(f, 1)
+}
+
+// Returns the strings referred to by the file's dynamic entries with the
+// given tag, in order.
+func readDynamicStrings(f *elf_reader.ELF32File,
+	tag elf_reader.ELF32DynamicTag) ([]string, error) {
+	toReturn := make([]string, 0, 8)
+	for i := range f.Sections {
+		if !f.IsDynamicSection(uint16(i)) {
+			continue
+		}
+		entries, e := f.GetDynamicTable(uint16(i))
+		if e != nil {
+			return nil, fmt.Errorf("Failed reading dynamic table: %s", e)
+		}
+		strings, e := f.GetSectionContent(uint16(f.Sections[i].LinkedIndex))
+		if e != nil {
+			return nil, fmt.Errorf("Failed reading dynamic string table: %s",
+				e)
+		}
+		for j, entry := range entries {
+			if entry.Tag != tag {
+				continue
+			}
+			name, e := elf_reader.ReadStringAtOffset(entry.Value, strings)
+			if e != nil {
+				return nil, fmt.Errorf("Bad string in dynamic entry %d: %s",
+					j, e)
+			}
+			toReturn = append(toReturn, string(name))
+		}
+	}
+	return toReturn, nil
+}
+
+// Returns the dependencies renamed by patching, by comparing the DT_NEEDED
+// entries in the original and patched files. Patching never adds or removes
+// dynamic entries, so they're compared in order.
+func findDependencyRenames(original, patched []byte) ([]dependencyRename,
+	error) {
+	originalELF, e := stringreplace.ParseELF32File(original)
+	if e != nil {
+		return nil, fmt.Errorf("Failed parsing original file: %s", e)
+	}
+	patchedELF, e := stringreplace.ParseELF32File(patched)
+	if e != nil {
+		return nil, fmt.Errorf("Failed parsing patched file: %s", e)
+	}
+	originalNames, e := readNeededNames(originalELF)
+	if e != nil {
+		return nil, e
+	}
+	newNames, e := readNeededNames(patchedELF)
+	if e != nil {
+		return nil, e
+	}
+	if len(originalNames) != len(newNames) {
+		return nil, fmt.Errorf("The original file has %d DT_NEEDED entries, "+
+			"but the patched file has %d", len(originalNames), len(newNames))
+	}
+	toReturn := make([]dependencyRename, 0, len(newNames))
+	seen := make(map[string]bool)
+	for i := range originalNames {
+		if (originalNames[i] == newNames[i]) || seen[newNames[i]] {
+			continue
+		}
+		seen[newNames[i]] = true
+		toReturn = append(toReturn, dependencyRename{
+			Original: originalNames[i],
+			New:      newNames[i],
+		})
+	}
+	return toReturn, nil
+}
+
+// Returns a shell script creating a symlink to, or copy of, each original
+// library under its new name, in the directory given as the script's first
+// argument.
+func shimScript(outputPath, format string,
+	renames []dependencyRename) []byte {
+	var b bytes.Buffer
+	command := "ln -sf"
+	description := "symlinking"
+	if format == "copy" {
+		command = "cp -p"
+		description = "copying"
+	}
+	fmt.Fprintf(&b, "#!/bin/sh\n")
+	fmt.Fprintf(&b, "# Makes the dependencies renamed in %s available under "+
+		"their new\n", outputPath)
+	fmt.Fprintf(&b, "# names by %s the existing libraries. Run it with the "+
+		"directory\n", description)
+	fmt.Fprintf(&b, "# containing the libraries as its argument (defaults to "+
+		"the current\n")
+	fmt.Fprintf(&b, "# directory).\n")
+	fmt.Fprintf(&b, "set -e\n")
+	fmt.Fprintf(&b, "cd \"${1:-.}\"\n")
+	for _, r := range renames {
+		fmt.Fprintf(&b, "%s %s %s\n", command, shellQuote(r.Original),
+			shellQuote(r.New))
+	}
+	return b.Bytes()
+}
+
+// Writes a plan, in the given format, for making the dependencies renamed
+// between the original and patched content of the file written to outputPath
+// available under their new names.
+func writeShimPlan(path, format, outputPath string, original,
+	patched []byte) error {
+	renames, e := findDependencyRenames(original, patched)
+	if e != nil {
+		return e
+	}
+	if format != "json" {
+		return ioutil.WriteFile(path, shimScript(outputPath, format, renames),
+			0755)
+	}
+	content, e := json.MarshalIndent(&shimManifest{
+		File:         outputPath,
+		Dependencies: renames,
+	}, "", "  ")
+	if e != nil {
+		return fmt.Errorf("Failed encoding shim plan: %s", e)
+	}
+	content = append(content, '\n')
+	return ioutil.WriteFile(path, content, 0644)
+}
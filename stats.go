@@ -0,0 +1,169 @@
+package main
+
+// This file implements the "stats" subcommand, which summarizes a file's
+// string tables and symbol names, and optionally how much each table would
+// grow if a rule were applied.
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/yalue/elf32_string_replace/stringreplace"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+)
+
+// The output of the stats subcommand.
+type fileStatistics struct {
+	*stringreplace.Statistics
+	// The number of bytes by which each table would grow if the rule were
+	// applied, keyed by section index. Only set if a rule was given.
+	Growth map[uint16]int `json:"growth,omitempty"`
+	// The total of Growth, not including the space needed to relocate the
+	// tables or program headers.
+	TotalGrowth int `json:"total_growth"`
+}
+
+// Returns the percentage of total that part makes up.
+func percentOf(part, total uint32) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(part) / float64(total)
+}
+
+// Writes a human-readable summary of the statistics to w.
+func writeStatistics(w io.Writer, path string, s *fileStatistics) {
+	fmt.Fprintf(w, "%s: %d bytes, %d in string tables (%.1f%%)\n", path,
+		s.FileSize, s.StringTableSize, percentOf(s.StringTableSize,
+			s.FileSize))
+	for _, t := range s.Tables {
+		loaded := ""
+		if t.Loaded {
+			loaded = ", loaded"
+		}
+		fmt.Fprintf(w, "  Section %d (%s): %d bytes (%.1f%% of string "+
+			"tables%s)\n", t.SectionIndex, t.Name, t.Size,
+			percentOf(t.Size, s.StringTableSize), loaded)
+		fmt.Fprintf(w, "    Strings: %d (%d unique, %d bytes duplicated)\n",
+			t.Entries, t.UniqueEntries, t.DuplicateBytes)
+		if t.LongestLength != 0 {
+			fmt.Fprintf(w, "    Longest: %d bytes: %s\n", t.LongestLength,
+				t.Longest)
+		}
+		for _, d := range t.Duplicates {
+			fmt.Fprintf(w, "    Duplicated %d times: %s\n", d.Count, d.String)
+		}
+		if t.ReferencesKnown {
+			fmt.Fprintf(w, "    References: %d, to %d offsets\n",
+				t.References, t.ReferencedStrings)
+		} else {
+			fmt.Fprintf(w, "    References: unknown\n")
+		}
+		if growth, ok := s.Growth[t.SectionIndex]; ok {
+			fmt.Fprintf(w, "    Growth with the rule: %d bytes\n", growth)
+		}
+	}
+	fmt.Fprintf(w, "  Symbol name lengths (%d named symbols):\n", s.Symbols)
+	for _, b := range s.SymbolNameLengths {
+		if b.MaxLength == 0 {
+			fmt.Fprintf(w, "    %4d+    : %d\n", b.MinLength, b.Count)
+			continue
+		}
+		fmt.Fprintf(w, "    %4d-%-4d: %d\n", b.MinLength, b.MaxLength,
+			b.Count)
+	}
+	if s.Growth != nil {
+		fmt.Fprintf(w, "  String table growth with the rule: %d bytes\n",
+			s.TotalGrowth)
+	}
+}
+
+// Runs the "stats" subcommand, with the given arguments, not including the
+// subcommand name itself. Returns the process exit code.
+func runStatsCommand(arguments []string) int {
+	var inputFile, matchRegex, replacement string
+	var outputJSON bool
+	flags := flag.NewFlagSet("stats", flag.ContinueOnError)
+	flags.StringVar(&inputFile, "file", "", "The path to the ELF file to "+
+		"summarize. May also be given as a positional argument.")
+	flags.StringVar(&matchRegex, "to_match", "", "If set, also report how "+
+		"much each string table would grow if strings matching this regular "+
+		"expression were replaced with -replace.")
+	flags.StringVar(&replacement, "replace", "", "The replacement for "+
+		"strings matching -to_match.")
+	flags.BoolVar(&outputJSON, "json", false, "Print the statistics as JSON "+
+		"rather than a summary.")
+	e := flags.Parse(arguments)
+	if e != nil {
+		return 1
+	}
+	if (inputFile == "") && (flags.NArg() == 1) {
+		inputFile = flags.Arg(0)
+	} else if flags.NArg() != 0 {
+		inputFile = ""
+	}
+	if (inputFile == "") || ((matchRegex == "") != (replacement == "")) {
+		log.Println("Invalid arguments. Run with -help for more information.")
+		return 1
+	}
+	rawInput, e := ioutil.ReadFile(inputFile)
+	if e != nil {
+		log.Printf("Failed reading input file: %s\n", e)
+		return 1
+	}
+	statistics, e := stringreplace.ComputeStatistics(rawInput)
+	if e != nil {
+		log.Printf("Failed reading statistics for %s: %s\n", inputFile, e)
+		return 1
+	}
+	result := &fileStatistics{
+		Statistics: statistics,
+	}
+	if matchRegex != "" {
+		regex, e := regexp.Compile(matchRegex)
+		if e != nil {
+			log.Printf("Failed processing to_match regular expression: %s\n",
+				e)
+			return 1
+		}
+		rules := []stringreplace.Rule{
+			{
+				Match:       regex,
+				Replacement: replacement,
+			},
+		}
+		e = stringreplace.ValidateRule(&(rules[0]))
+		if e != nil {
+			log.Printf("Invalid -replace value: %s\n", e)
+			return 1
+		}
+		analysis, e := stringreplace.Analyze(rawInput, stringreplace.Options{
+			Rules: rules,
+		})
+		if e != nil {
+			log.Printf("Failed analyzing %s: %s\n", inputFile, e)
+			return 1
+		}
+		result.Growth = make(map[uint16]int)
+		for _, t := range analysis.Tables {
+			growth := len(t.NewContent) - len(t.OriginalContent)
+			result.Growth[t.SectionIndex] = growth
+			result.TotalGrowth += growth
+		}
+	}
+	if !outputJSON {
+		writeStatistics(os.Stdout, inputFile, result)
+		return 0
+	}
+	content, e := json.MarshalIndent(result, "", "  ")
+	if e != nil {
+		log.Printf("Failed encoding the statistics: %s\n", e)
+		return 1
+	}
+	fmt.Printf("%s\n", content)
+	return 0
+}
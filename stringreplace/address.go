@@ -0,0 +1,159 @@
+package stringreplace
+
+// This file contains the logic for choosing the virtual address at which the
+// relocated string tables are loaded.
+
+import (
+	"fmt"
+	"github.com/yalue/elf_reader"
+	"strconv"
+	"strings"
+)
+
+// Selects how the virtual address of the segment holding the relocated
+// string tables is chosen.
+type AddressStrategy int
+
+const (
+	// Derive the address from the file offset, using the same offset-to-VA
+	// delta as the first relocated string table's original section. This is
+	// the default.
+	MirrorOffsetAddress AddressStrategy = iota
+	// Use the first page after the highest existing loadable segment, at an
+	// address congruent to the file offset modulo the page size.
+	AfterLastLoadAddress
+	// Use the address given in Options.FixedAddress.
+	FixedAddress
+)
+
+// Returns the name of the strategy, as accepted by ParseAddressStrategy.
+func (s AddressStrategy) String() string {
+	switch s {
+	case MirrorOffsetAddress:
+		return "mirror-offset"
+	case AfterLastLoadAddress:
+		return "after-last-load"
+	case FixedAddress:
+		return "fixed"
+	}
+	return fmt.Sprintf("<unknown address strategy %d>", int(s))
+}
+
+// Parses a strategy name: "mirror-offset", "after-last-load", or
+// "fixed=<address>". The address may be given in decimal, or in hex with a
+// leading 0x. The returned address is only meaningful for FixedAddress.
+func ParseAddressStrategy(s string) (AddressStrategy, uint32, error) {
+	switch s {
+	case "mirror-offset":
+		return MirrorOffsetAddress, 0, nil
+	case "after-last-load":
+		return AfterLastLoadAddress, 0, nil
+	}
+	if !strings.HasPrefix(s, "fixed=") {
+		return 0, 0, fmt.Errorf("Invalid address strategy: %s", s)
+	}
+	address, e := strconv.ParseUint(strings.TrimPrefix(s, "fixed="), 0, 32)
+	if e != nil {
+		return 0, 0, fmt.Errorf("Invalid fixed address: %s", e)
+	}
+	return FixedAddress, uint32(address), nil
+}
+
+// Returns true if any loadable segment occupies a page in the given range of
+// addresses.
+func overlapsLoadSegment(f *elf_reader.ELF32File, start, end uint64,
+	pageSize uint32) bool {
+	var s *elf_reader.ELF32ProgramHeader
+	var segmentStart, segmentEnd uint64
+	for i := range f.Segments {
+		s = &(f.Segments[i])
+		if (s.Type != elf_reader.LoadableSegment) || (s.MemorySize == 0) {
+			continue
+		}
+		segmentStart = pageStart(uint64(s.VirtualAddress), pageSize)
+		segmentEnd = pageEnd(uint64(s.VirtualAddress)+uint64(s.MemorySize),
+			pageSize)
+		if (start < segmentEnd) && (end > segmentStart) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if f is position-independent (ET_DYN): a shared library or
+// PIE.
+func isPositionIndependent(f *elf_reader.ELF32File) bool {
+	return uint32(f.Header.Type) == 3
+}
+
+// Returns the first address past all existing loadable segments at which a
+// segment of the given size, holding the file data starting at offset, can be
+// loaded, using the report's page size.
+func afterLastLoadAddress(f *elf_reader.ELF32File, offset, size uint32,
+	report *Report) (uint32, error) {
+	pageSize := loadPageSize(f, report.pageSize)
+	address := pageEnd(loadSegmentsEnd(f), pageSize) + uint64(offset%pageSize)
+	if (address + uint64(size)) > 0xffffffff {
+		return 0, fmt.Errorf("No room for a new segment after the existing " +
+			"loadable segments")
+	}
+	return uint32(address), nil
+}
+
+// Returns the virtual address at which to load a new segment of the given
+// size, holding the file data starting at offset. The mirrorAddress is the
+// address derived from the offset, used by MirrorOffsetAddress. Warnings are
+// added to the report.
+//
+// For position-independent files, the loader reserves a single region
+// spanning the first through last loadable segments (assuming they're sorted
+// by address, as the ELF spec requires), and maps each segment relative to
+// the region's base. The new segment is appended to the program header
+// table, so it must be placed above every existing segment; otherwise it
+// would fall outside the reservation and collide with other mappings.
+func chooseSegmentAddress(f *elf_reader.ELF32File, offset, size,
+	mirrorAddress uint32, options *Options, report *Report) (uint32, error) {
+	pageSize := loadPageSize(f, report.pageSize)
+	loadEnd := pageEnd(loadSegmentsEnd(f), pageSize)
+	switch options.AddressStrategy {
+	case MirrorOffsetAddress:
+		if isPositionIndependent(f) && (uint64(mirrorAddress) < loadEnd) {
+			address, e := afterLastLoadAddress(f, offset, size, report)
+			if e != nil {
+				return 0, e
+			}
+			report.logf("VA 0x%08x for the new segment is below the end of "+
+				"the existing position-independent layout (0x%08x). Using "+
+				"VA 0x%08x instead.\n", mirrorAddress, loadEnd, address)
+			return address, nil
+		}
+		return avoidRELROPages(f, offset, size, mirrorAddress, report)
+	case AfterLastLoadAddress:
+		return afterLastLoadAddress(f, offset, size, report)
+	case FixedAddress:
+		address := options.FixedAddress
+		if isPositionIndependent(f) && (uint64(address) < loadEnd) {
+			return 0, fmt.Errorf("Fixed VA 0x%08x is below the end of the "+
+				"existing position-independent layout (0x%08x)", address,
+				loadEnd)
+		}
+		if (address % pageSize) != (offset % pageSize) {
+			return 0, fmt.Errorf("Fixed VA 0x%08x isn't congruent to file "+
+				"offset 0x%08x modulo the page size (0x%x)", address, offset,
+				pageSize)
+		}
+		end := uint64(address) + uint64(size)
+		if end > 0xffffffff {
+			return 0, fmt.Errorf("A segment of size 0x%x doesn't fit at "+
+				"fixed VA 0x%08x", size, address)
+		}
+		if overlapsLoadSegment(f, pageStart(uint64(address), pageSize),
+			pageEnd(end, pageSize), pageSize) {
+			return 0, fmt.Errorf("Fixed VA 0x%08x shares a page with an "+
+				"existing loadable segment", address)
+		}
+		return address, nil
+	}
+	return 0, fmt.Errorf("Invalid address strategy: %s",
+		options.AddressStrategy)
+}
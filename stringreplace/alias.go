@@ -0,0 +1,133 @@
+package stringreplace
+
+// This file contains support for string tables described by more than one
+// section header, e.g. when a post-processing tool adds a second header for
+// .dynstr, or a section named by -treat_as_strtab overlaps an existing table.
+// Replacing strings in each header's table separately would produce
+// conflicting relocated copies, with (for example) the symbol names updated
+// to offsets in one copy and the DT_NEEDED entries in another, while the
+// loader only reads the copy DT_STRTAB points to. Instead, the tables are
+// merged: the rules applying to any of the sections are applied once, and
+// every section header is pointed at the single rebuilt table.
+
+import (
+	"fmt"
+	"github.com/yalue/elf_reader"
+)
+
+// Returns the names of the sections holding the table: its own section, and
+// any aliases.
+func (t *replacedStringTable) sectionNames() []string {
+	return append([]string{t.sectionName}, t.aliasNames...)
+}
+
+// Returns true if the table's section, or one of its aliases, has the name.
+func (t *replacedStringTable) hasSectionName(name string) bool {
+	for _, n := range t.sectionNames() {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the rule applies to the table's section, or any of its
+// aliases.
+func (t *replacedStringTable) ruleApplies(r *Rule) bool {
+	for _, name := range t.sectionNames() {
+		if r.appliesToSection(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the union of two sets of offsets, or nil if either is nil (meaning
+// every offset).
+func unionOffsets(a, b map[uint32]bool) map[uint32]bool {
+	if (a == nil) || (b == nil) {
+		return nil
+	}
+	toReturn := make(map[uint32]bool, len(a)+len(b))
+	for offset := range a {
+		toReturn[offset] = true
+	}
+	for offset := range b {
+		toReturn[offset] = true
+	}
+	return toReturn
+}
+
+// Merges candidate tables with the same file offset and size into the first
+// of them, recording the others as its aliases. Strings may be replaced if
+// any of the sections allows it, and not if any of them excludes it.
+func mergeAliasedTables(candidates []replacedStringTable,
+	report *Report) []replacedStringTable {
+	toReturn := make([]replacedStringTable, 0, len(candidates))
+	seen := make(map[tableLocation]int)
+	for _, t := range candidates {
+		location := tableLocation{
+			offset: t.oldFileOffset,
+			size:   uint32(len(t.oldContent)),
+		}
+		index, ok := seen[location]
+		if !ok || (location.size == 0) {
+			seen[location] = len(toReturn)
+			toReturn = append(toReturn, t)
+			continue
+		}
+		primary := &(toReturn[index])
+		report.logf("Sections %d and %d hold the same string table, so "+
+			"their replacements are merged.\n", primary.sectionIndex,
+			t.sectionIndex)
+		primary.aliases = append(primary.aliases, t.sectionIndex)
+		primary.aliasNames = append(primary.aliasNames, t.sectionName)
+		primary.allowedOffsets = unionOffsets(primary.allowedOffsets,
+			t.allowedOffsets)
+		if t.excludedOffsets != nil {
+			primary.excludedOffsets = unionOffsets(primary.excludedOffsets,
+				t.excludedOffsets)
+			if primary.excludedOffsets == nil {
+				primary.excludedOffsets = t.excludedOffsets
+			}
+		}
+	}
+	return toReturn
+}
+
+// Returns the tables, followed by a copy of each table for each of its
+// aliases, after pointing the aliases' section headers to the relocated
+// table. Must be called after relocateStringTables, so the references using
+// each alias are updated to match the single rebuilt table.
+func expandAliasedTables(f *elf_reader.ELF32File,
+	tables []replacedStringTable) ([]replacedStringTable, error) {
+	toReturn := tables
+	changed := false
+	for i := range tables {
+		t := &(tables[i])
+		primary := &(f.Sections[t.sectionIndex])
+		for j, alias := range t.aliases {
+			section := &(f.Sections[alias])
+			section.FileOffset = primary.FileOffset
+			section.VirtualAddress = primary.VirtualAddress
+			section.Size = primary.Size
+			copied := *t
+			copied.sectionIndex = alias
+			copied.sectionName = t.aliasNames[j]
+			copied.aliases = nil
+			copied.aliasNames = nil
+			toReturn = append(toReturn, copied)
+			changed = true
+		}
+	}
+	if !changed {
+		return toReturn, nil
+	}
+	e := writeAtELFOffset(f, f.Header.SectionHeaderOffset, f.Sections,
+		"section headers")
+	if e != nil {
+		return nil, fmt.Errorf("Error updating aliased section headers: %s",
+			e)
+	}
+	return toReturn, nil
+}
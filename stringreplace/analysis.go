@@ -0,0 +1,131 @@
+package stringreplace
+
+// This file exports the string tables and strings the rules would replace,
+// without patching the file, so that other tools can build their own
+// verification, visualization, or patch generation on top of them.
+
+import (
+	"fmt"
+	"github.com/yalue/elf_reader"
+	"time"
+)
+
+// Describes a string that would be replaced. Unlike Replacement, the strings
+// aren't escaped.
+type ReplacedString struct {
+	// The offsets of the original and new strings in the original and new
+	// string tables.
+	OriginalOffset uint32
+	NewOffset      uint32
+	Original       string
+	New            string
+}
+
+// Describes a string table in which strings would be replaced, before it's
+// relocated. The new table's location isn't chosen until the file is
+// patched; see the Tables in the Report returned by ReplaceStrings.
+type ReplacedStringTable struct {
+	// The index and name of the string table's section. The name isn't
+	// escaped.
+	SectionIndex uint16
+	Name         string
+	// The table's file offset and virtual address.
+	OriginalOffset  uint32
+	OriginalAddress uint32
+	// The index of the loadable segment containing the table, or -1 if the
+	// table isn't loaded.
+	OriginalSegment int
+	// The content of the original and new tables.
+	OriginalContent []byte
+	NewContent      []byte
+	// The replaced strings, ordered by their original offsets.
+	Replacements []ReplacedString
+}
+
+// Returns the exported form of the table.
+func (t *replacedStringTable) export() ReplacedStringTable {
+	toReturn := ReplacedStringTable{
+		SectionIndex:    t.sectionIndex,
+		Name:            t.sectionName,
+		OriginalOffset:  t.oldFileOffset,
+		OriginalAddress: t.oldVirtualAddress,
+		OriginalSegment: t.oldSegmentIndex,
+		OriginalContent: t.oldContent,
+		NewContent:      t.newContent,
+		Replacements:    make([]ReplacedString, len(t.replacements)),
+	}
+	for i := range t.replacements {
+		s := &(t.replacements[i])
+		original, _ := elf_reader.ReadStringAtOffset(s.originalOffset,
+			t.oldContent)
+		replacement, _ := elf_reader.ReadStringAtOffset(s.newOffset,
+			t.newContent)
+		toReturn.Replacements[i] = ReplacedString{
+			OriginalOffset: s.originalOffset,
+			NewOffset:      s.newOffset,
+			Original:       string(original),
+			New:            string(replacement),
+		}
+	}
+	return toReturn
+}
+
+// Holds the result of Analyze.
+type Analysis struct {
+	// The string tables in which strings would be replaced.
+	Tables []ReplacedStringTable
+	// Any warnings about the file or options, as would be added to the
+	// Report when patching the file.
+	Warnings []string
+	// The time taken by each phase of the analysis.
+	Timings []PhaseTiming
+}
+
+// Computes the replacements the given options would make in the ELF file,
+// without patching it. Like Replace, this doesn't modify the input, access
+// the filesystem, or log anything except to options.Logger. The options'
+// hooks are called as they would be by Replace, except for the PatchHook.
+func Analyze(input []byte, options Options) (*Analysis, error) {
+	start := time.Now()
+	raw := make([]byte, len(input))
+	copy(raw, input)
+	f, e := ParseELF32File(raw)
+	if e != nil {
+		return nil, fmt.Errorf("Failed parsing the input file: %s", e)
+	}
+	parseTime := time.Since(start)
+	analysis, e := analyzeFile(f, &options)
+	if e != nil {
+		return nil, e
+	}
+	analysis.Timings = append([]PhaseTiming{{"parse", parseTime}},
+		analysis.Timings...)
+	return analysis, nil
+}
+
+// Computes the replacements the given options would make in f, which may be
+// modified, for Analyze. The returned timings don't include parsing f.
+func analyzeFile(f *elf_reader.ELF32File, options *Options) (*Analysis,
+	error) {
+	setup, e := prepareReplacement(f, options)
+	if e != nil {
+		return nil, e
+	}
+	report := setup.report
+	start := report.startPhase("compute replacements")
+	tables, e := processReplacements(f, setup.options,
+		effectiveParallelism(setup.options.Parallelism), report)
+	if e != nil {
+		return nil, fmt.Errorf("Error performing string replacements: %s", e)
+	}
+	report.addTiming("compute replacements", start)
+	toReturn := &Analysis{
+		Tables:   make([]ReplacedStringTable, len(tables)),
+		Warnings: report.Warnings,
+		Timings:  report.Timings,
+	}
+	for i := range tables {
+		toReturn.Tables[i] = tables[i].export()
+	}
+	return toReturn, nil
+}
@@ -0,0 +1,324 @@
+package stringreplace
+
+// This file contains Assess, which estimates how risky it would be to apply a
+// set of rules to a file, without patching it. It looks for the things most
+// likely to make a patched file misbehave: relocations involving the string
+// tables, compressed sections that can't be searched, version names whose
+// hashes would change, and fields referring to replaced strings that aren't
+// updated.
+
+import (
+	"fmt"
+	"github.com/yalue/elf_reader"
+)
+
+// The levels of risk in an Assessment, from least to most risky.
+const (
+	RiskNone   = "none"
+	RiskLow    = "low"
+	RiskMedium = "medium"
+	RiskHigh   = "high"
+)
+
+// Returns a number ordering the risk levels, so the highest can be found.
+func riskRank(risk string) int {
+	switch risk {
+	case RiskLow:
+		return 1
+	case RiskMedium:
+		return 2
+	case RiskHigh:
+		return 3
+	}
+	return 0
+}
+
+// A single reason a patch may be risky.
+type RiskFactor struct {
+	Risk        string `json:"risk"`
+	Description string `json:"description"`
+}
+
+// Holds the result of Assess.
+type Assessment struct {
+	// The number of string tables in which strings would be replaced, and
+	// the number of strings replaced in them.
+	TablesTouched   int `json:"tables_touched"`
+	StringsReplaced int `json:"strings_replaced"`
+	// The number of loaded tables that would grow, and so would need to be
+	// relocated to new memory.
+	TablesRelocated int `json:"tables_relocated"`
+	// The number of relocations applied to the touched tables' memory, or
+	// whose addends or targets hold addresses in them.
+	RelocationsIntoTables int `json:"relocations_into_tables"`
+	// The number of those relocations that wouldn't be updated.
+	RelocationsNotUpdated int `json:"relocations_not_updated"`
+	// The names of compressed (SHF_COMPRESSED) sections, whose strings
+	// aren't searched.
+	CompressedSections []string `json:"compressed_sections,omitempty"`
+	// The number of version names that would be replaced, changing the
+	// hashes stored with them.
+	VersionHashesAffected int `json:"version_hashes_affected"`
+	// The number of fields referring to replaced strings (or their tables)
+	// that wouldn't be updated. See Report.UnsupportedReferences.
+	UnsupportedReferences int `json:"unsupported_references"`
+	// The warnings that would be added to the Report when patching.
+	Warnings []string `json:"warnings,omitempty"`
+	// The reasons for the overall risk, and the overall risk, which is the
+	// highest of the factors' risks, or RiskNone if nothing would change.
+	Factors []RiskFactor `json:"factors"`
+	Risk    string       `json:"risk"`
+}
+
+// Adds a factor to the assessment, raising its overall risk if needed.
+func (a *Assessment) addFactor(risk, format string, args ...interface{}) {
+	a.Factors = append(a.Factors, RiskFactor{
+		Risk:        risk,
+		Description: fmt.Sprintf(format, args...),
+	})
+	if riskRank(risk) > riskRank(a.Risk) {
+		a.Risk = risk
+	}
+}
+
+// Analyzes how risky applying the options' rules to the ELF file would be,
+// without patching it. Like Analyze, this doesn't modify the input.
+func Assess(input []byte, options Options) (*Assessment, error) {
+	raw := make([]byte, len(input))
+	copy(raw, input)
+	f, e := ParseELF32File(raw)
+	if e != nil {
+		return nil, fmt.Errorf("Failed parsing the input file: %s", e)
+	}
+	setup, e := prepareReplacement(f, &options)
+	if e != nil {
+		return nil, e
+	}
+	report := setup.report
+	tables, e := processReplacements(f, setup.options,
+		effectiveParallelism(setup.options.Parallelism), report)
+	if e != nil {
+		return nil, fmt.Errorf("Error performing string replacements: %s", e)
+	}
+	toReturn := &Assessment{
+		TablesTouched: len(tables),
+		Risk:          RiskNone,
+	}
+	for i := range tables {
+		t := &(tables[i])
+		toReturn.StringsReplaced += len(t.replacements)
+		if (t.oldSegmentIndex >= 0) &&
+			(len(t.newContent) > len(t.oldContent)) {
+			toReturn.TablesRelocated++
+		}
+	}
+	e = toReturn.countRelocations(f, tables)
+	if e != nil {
+		return nil, e
+	}
+	toReturn.findCompressedSections(f)
+	e = toReturn.countVersionNames(f, tables)
+	if e != nil {
+		return nil, e
+	}
+	report.addUnsupportedReferences(f, tables)
+	toReturn.UnsupportedReferences = len(report.UnsupportedReferences)
+	toReturn.Warnings = report.Warnings
+	toReturn.addFactors()
+	return toReturn, nil
+}
+
+// Returns the table whose original content contains the address, or nil.
+func tableContainingAddress(tables []replacedStringTable,
+	address uint32) *replacedStringTable {
+	for i := range tables {
+		t := &(tables[i])
+		if t.oldSegmentIndex < 0 {
+			continue
+		}
+		if (address >= t.oldVirtualAddress) && (uint64(address) <
+			uint64(t.oldVirtualAddress)+uint64(len(t.oldContent))) {
+			return t
+		}
+	}
+	return nil
+}
+
+// Reads the 32-bit word the file loads at the given address. Returns an error
+// if the word isn't part of a loadable segment's file content.
+func readLoadedUint32(f *elf_reader.ELF32File, address uint32) (uint32,
+	error) {
+	for i := range f.Segments {
+		s := &(f.Segments[i])
+		if s.Type != elf_reader.LoadableSegment {
+			continue
+		}
+		if (address >= s.VirtualAddress) && ((uint64(address) + 4) <=
+			(uint64(s.VirtualAddress) + uint64(s.FileSize))) {
+			return readELFUint32(f, s.FileOffset+(address-s.VirtualAddress),
+				"relocation target")
+		}
+	}
+	return 0, fmt.Errorf("Address 0x%08x isn't loaded from the file",
+		address)
+}
+
+// Counts the relocations in SHT_REL and SHT_RELA sections that are applied
+// to a touched table, or whose addend (for SHT_RELA) or target word (for
+// SHT_REL) is the address of a replaced string. Only the addends of SHT_RELA
+// relocations that don't refer to a symbol, and point to the start of a
+// replaced string, are updated; the rest are counted as not updated.
+func (a *Assessment) countRelocations(f *elf_reader.ELF32File,
+	tables []replacedStringTable) error {
+	// Addends in relocatable objects are relative to sections.
+	// ET_REL is 1.
+	if uint32(f.Header.Type) == 1 {
+		return nil
+	}
+	for i := range f.Sections {
+		section := &(f.Sections[i])
+		// SHT_RELA is 4, and SHT_REL is 9.
+		entrySize := uint32(0)
+		switch section.Type {
+		case 4:
+			entrySize = relaEntrySize
+		case 9:
+			entrySize = 8
+		default:
+			continue
+		}
+		count := section.Size / entrySize
+		for j := uint32(0); j < count; j++ {
+			offset := section.FileOffset + (j * entrySize)
+			target, e := readELFUint32(f, offset, "relocation")
+			if e != nil {
+				return fmt.Errorf("Failed reading relocation: %s", e)
+			}
+			if tableContainingAddress(tables, target) != nil {
+				// The relocation would be applied to the original table,
+				// not its replacement.
+				a.RelocationsIntoTables++
+				a.RelocationsNotUpdated++
+				continue
+			}
+			var value, info uint32
+			if section.Type == 4 {
+				info, e = readELFUint32(f, offset+4, "relocation")
+				if e != nil {
+					return fmt.Errorf("Failed reading relocation: %s", e)
+				}
+				// Addends of symbol-less relocations that aren't addresses
+				// can't point to strings.
+				if ((info >> 8) == 0) && !relocationAddendIsAddress(f, info) {
+					continue
+				}
+				value, e = readELFUint32(f, offset+8, "relocation addend")
+			} else {
+				value, e = readLoadedUint32(f, target)
+			}
+			if e != nil {
+				continue
+			}
+			t := tableContainingAddress(tables, value)
+			if t == nil {
+				continue
+			}
+			// Pointers to strings that weren't replaced remain valid, since
+			// the original table is left in place.
+			stringOffset := value - t.oldVirtualAddress
+			_, replaced := t.replacementIndices[stringOffset]
+			if !replaced && !replacedStringContaining(t, stringOffset) {
+				continue
+			}
+			a.RelocationsIntoTables++
+			if !replaced || (section.Type != 4) {
+				a.RelocationsNotUpdated++
+				continue
+			}
+			if (info >> 8) != 0 {
+				a.RelocationsNotUpdated++
+			}
+		}
+	}
+	return nil
+}
+
+// Records the names of the compressed sections.
+func (a *Assessment) findCompressedSections(f *elf_reader.ELF32File) {
+	for i := range f.Sections {
+		// SHF_COMPRESSED is 0x800.
+		if (uint32(f.Sections[i].Flags) & 0x800) == 0 {
+			continue
+		}
+		name, e := SectionName(f, uint16(i))
+		if e != nil {
+			name = fmt.Sprintf("<section %d>", i)
+		}
+		a.CompressedSections = append(a.CompressedSections,
+			EscapeString(name))
+	}
+}
+
+// Counts the required and defined versions whose names would be replaced.
+func (a *Assessment) countVersionNames(f *elf_reader.ELF32File,
+	tables []replacedStringTable) error {
+	nodes, e := ReadVersionNodes(f)
+	if e != nil {
+		return fmt.Errorf("Failed reading symbol versions: %s", e)
+	}
+	for _, node := range nodes {
+		link := f.Sections[node.SectionIndex].LinkedIndex
+		name, e := readELFUint32(f, node.NameOffset, "version name")
+		if e != nil {
+			return fmt.Errorf("Failed reading version name: %s", e)
+		}
+		for i := range tables {
+			t := &(tables[i])
+			if uint32(t.sectionIndex) != link {
+				continue
+			}
+			if _, ok := t.replacementIndices[name]; ok {
+				a.VersionHashesAffected++
+			}
+		}
+	}
+	return nil
+}
+
+// Adds the factors contributing to the overall risk, based on the counts.
+func (a *Assessment) addFactors() {
+	if a.StringsReplaced == 0 {
+		return
+	}
+	a.addFactor(RiskLow, "%d strings would be replaced in %d string tables",
+		a.StringsReplaced, a.TablesTouched)
+	if a.TablesRelocated != 0 {
+		a.addFactor(RiskMedium, "%d loaded string tables would grow, so "+
+			"they'd be relocated to a new loadable segment",
+			a.TablesRelocated)
+	}
+	if a.RelocationsNotUpdated != 0 {
+		a.addFactor(RiskHigh, "%d of %d relocations involving the string "+
+			"tables wouldn't be updated", a.RelocationsNotUpdated,
+			a.RelocationsIntoTables)
+	} else if a.RelocationsIntoTables != 0 {
+		a.addFactor(RiskMedium, "%d relocations point to replaced strings, "+
+			"and would be updated", a.RelocationsIntoTables)
+	}
+	if len(a.CompressedSections) != 0 {
+		a.addFactor(RiskMedium, "%d compressed sections wouldn't be "+
+			"searched for strings", len(a.CompressedSections))
+	}
+	if a.VersionHashesAffected != 0 {
+		a.addFactor(RiskHigh, "%d version names would change, so the "+
+			"files providing or using them must match", a.VersionHashesAffected)
+	}
+	if a.UnsupportedReferences != 0 {
+		a.addFactor(RiskHigh, "%d references to replaced strings wouldn't be "+
+			"updated", a.UnsupportedReferences)
+	}
+	if len(a.Warnings) != 0 {
+		a.addFactor(RiskMedium, "%d warnings would be reported",
+			len(a.Warnings))
+	}
+}
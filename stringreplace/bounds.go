@@ -0,0 +1,53 @@
+package stringreplace
+
+// This file contains the bounds checks shared by every raw read and write of
+// the ELF file's content. A write past the end of f.Raw would otherwise grow
+// the file silently, so a single bad offset in a header could corrupt the
+// output without any error. Instead, such accesses fail with an
+// OutOfRangeError naming the structure being read or written.
+
+import (
+	"fmt"
+	"github.com/yalue/elf_reader"
+)
+
+// Returned when a read or write of the ELF file's content would extend past
+// the end of the file.
+type OutOfRangeError struct {
+	// Describes the structure being accessed, e.g. "program headers" or
+	// "section 3 sh_name".
+	Structure string
+	// The file offset and size, in bytes, of the attempted access.
+	Offset uint32
+	Size   uint64
+	// The size of the file at the time.
+	FileSize uint64
+	// True if the access was a write rather than a read.
+	Write bool
+}
+
+func (e *OutOfRangeError) Error() string {
+	access := "Reading"
+	if e.Write {
+		access = "Writing"
+	}
+	return fmt.Sprintf("%s %d bytes of the %s at offset 0x%x would extend "+
+		"past the end of the %d-byte file", access, e.Size, e.Structure,
+		e.Offset, e.FileSize)
+}
+
+// Returns an *OutOfRangeError if size bytes starting at offset don't lie
+// entirely within f.Raw, or nil if they do.
+func checkFileRange(f *elf_reader.ELF32File, offset uint32, size uint64,
+	structure string, write bool) error {
+	if (uint64(offset) + size) <= uint64(len(f.Raw)) {
+		return nil
+	}
+	return &OutOfRangeError{
+		Structure: structure,
+		Offset:    offset,
+		Size:      size,
+		FileSize:  uint64(len(f.Raw)),
+		Write:     write,
+	}
+}
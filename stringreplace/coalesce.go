@@ -0,0 +1,152 @@
+package stringreplace
+
+// This file contains support for rewriting the segment appended by a
+// previous run of this tool, rather than appending another one, so files that
+// are patched repeatedly don't accumulate unused segments.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/yalue/elf_reader"
+)
+
+// Returns the index of the loadable segment that looks like it was appended
+// by a previous run: the last program header, holding the end of the file,
+// which starts or ends with the program header table itself. Returns -1 if
+// there's no such segment.
+func findAppendedSegment(f *elf_reader.ELF32File) int {
+	index := len(f.Segments) - 1
+	if index < 0 {
+		return -1
+	}
+	s := &(f.Segments[index])
+	if (s.Type != elf_reader.LoadableSegment) ||
+		(s.FileSize != s.MemorySize) || ((s.FileOffset % 8) != 0) {
+		return -1
+	}
+	end := uint64(s.FileOffset) + uint64(s.FileSize)
+	if end != uint64(len(f.Raw)) {
+		return -1
+	}
+	tableSize := uint64(binary.Size(f.Segments))
+	tableStart := uint64(f.Header.ProgramHeaderOffset)
+	if (tableStart != uint64(s.FileOffset)) && ((tableStart + tableSize) !=
+		end) {
+		return -1
+	}
+	if tableStart < uint64(s.FileOffset) {
+		return -1
+	}
+	return index
+}
+
+// Returns the range of the appended segment at the given index that holds
+// string tables: everything but the program header table.
+func appendedTablesRange(f *elf_reader.ELF32File, index int) (uint64,
+	uint64) {
+	s := &(f.Segments[index])
+	start := uint64(s.FileOffset)
+	end := start + uint64(s.FileSize)
+	tableStart := uint64(f.Header.ProgramHeaderOffset)
+	if tableStart == start {
+		return tableStart + uint64(binary.Size(f.Segments)), end
+	}
+	return start, tableStart
+}
+
+// Returns a reason why the appended segment at the given index can't be
+// rewritten, or "" if it can: everything it holds before the program header
+// table must be either padding or one of the string tables about to be
+// relocated, and no other segment or the section header table may refer to
+// it.
+func appendedSegmentProblem(f *elf_reader.ELF32File, index int,
+	newTables []replacedStringTable) string {
+	s := &(f.Segments[index])
+	start := uint64(s.FileOffset)
+	end := start + uint64(s.FileSize)
+	tablesStart, tablesEnd := appendedTablesRange(f, index)
+	sectionTableEnd := uint64(f.Header.SectionHeaderOffset) +
+		uint64(binary.Size(f.Sections))
+	if (len(f.Sections) != 0) && (sectionTableEnd > start) &&
+		(uint64(f.Header.SectionHeaderOffset) < end) {
+		return "it contains the section header table"
+	}
+	for i := range f.Segments {
+		other := &(f.Segments[i])
+		if (i == index) || (other.Type == elf_reader.ProgramHeaderSegment) {
+			continue
+		}
+		otherEnd := uint64(other.FileOffset) + uint64(other.FileSize)
+		if (other.FileSize != 0) && (otherEnd > start) &&
+			(uint64(other.FileOffset) < end) {
+			return fmt.Sprintf("segment %d overlaps it", i)
+		}
+	}
+	relocated := make(map[uint16]bool)
+	for i := range newTables {
+		relocated[newTables[i].sectionIndex] = true
+		for _, alias := range newTables[i].aliases {
+			relocated[alias] = true
+		}
+	}
+	covered := make([]bool, tablesEnd-tablesStart)
+	for i := range f.Sections {
+		section := &(f.Sections[i])
+		// SHT_NULL and SHT_NOBITS sections have no content in the file.
+		if (section.Type == 0) || (section.Type == 8) ||
+			(section.Size == 0) {
+			continue
+		}
+		sectionStart := uint64(section.FileOffset)
+		sectionEnd := sectionStart + uint64(section.Size)
+		if (sectionEnd <= tablesStart) || (sectionStart >= tablesEnd) {
+			continue
+		}
+		if !relocated[uint16(i)] {
+			name, _ := SectionName(f, uint16(i))
+			return fmt.Sprintf("section %d (%s) in it isn't being relocated",
+				i, EscapeString(name))
+		}
+		if (sectionStart < tablesStart) || (sectionEnd > tablesEnd) {
+			return fmt.Sprintf("section %d extends outside of it", i)
+		}
+		for j := sectionStart; j < sectionEnd; j++ {
+			covered[j-tablesStart] = true
+		}
+	}
+	for i := range covered {
+		if !covered[i] && (f.Raw[tablesStart+uint64(i)] != 0) {
+			return fmt.Sprintf("the data at offset 0x%x in it doesn't "+
+				"belong to any string table", tablesStart+uint64(i))
+		}
+	}
+	return ""
+}
+
+// If the file ends with a segment appended by a previous run, which only
+// holds string tables that are about to be relocated again, removes the
+// segment and truncates the file to its start, so the relocated tables are
+// written in its place. Otherwise, leaves f unchanged. Doesn't re-parse f.
+func discardAppendedSegment(f *elf_reader.ELF32File,
+	newTables []replacedStringTable, report *Report) {
+	index := findAppendedSegment(f)
+	if index < 0 {
+		return
+	}
+	problem := appendedSegmentProblem(f, index, newTables)
+	if problem != "" {
+		report.logf("Not rewriting %s, which appears to have been added by "+
+			"a previous run: %s.\n", describeSegment(f, index), problem)
+		return
+	}
+	report.logf("Rewriting %s, which was added by a previous run, rather "+
+		"than adding another segment.\n", describeSegment(f, index))
+	// The original content of tables in the discarded segment refers to
+	// f.Raw, which is about to be overwritten.
+	for i := range newTables {
+		t := &(newTables[i])
+		t.oldContent = append([]byte(nil), t.oldContent...)
+	}
+	f.Raw = f.Raw[:f.Segments[index].FileOffset]
+	f.Segments = f.Segments[:index]
+}
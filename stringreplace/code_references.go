@@ -0,0 +1,290 @@
+package stringreplace
+
+// This file contains heuristics for finding instructions that refer to data,
+// such as strings in .rodata, so that users can be warned before editing
+// data that code may depend on (e.g. by assuming the string's length). Code
+// can't be reliably disassembled without more information than the ELF file
+// provides, so these heuristics may both miss references and report false
+// positives.
+
+import (
+	"fmt"
+	"github.com/yalue/elf_reader"
+	"sort"
+)
+
+// The e_machine values of the architectures with specific heuristics.
+const (
+	machineX86 = 3
+	machineARM = 40
+)
+
+// Describes an instruction or literal in an executable section which appears
+// to refer to an address.
+type CodeReference struct {
+	// The section containing the instruction or literal.
+	SectionIndex uint16 `json:"section_index"`
+	// The file offset and virtual address of the instruction or literal. For
+	// references made by several instructions together, this is the last one.
+	FileOffset uint32 `json:"file_offset"`
+	Address    uint32 `json:"address"`
+	// The address the instruction refers to.
+	Target uint32 `json:"target"`
+	// Describes the kind of reference, e.g. "push imm32".
+	Kind string `json:"kind"`
+}
+
+// Holds the state needed while scanning a single executable section.
+type codeScanner struct {
+	f            *elf_reader.ELF32File
+	sectionIndex uint16
+	section      *elf_reader.ELF32SectionHeader
+	content      []byte
+	// The range of addresses to look for references to.
+	start, end uint32
+	found      []CodeReference
+}
+
+// Returns true if the section contains instructions (SHF_EXECINSTR) and has
+// content in the file.
+func isExecutableSection(section *elf_reader.ELF32SectionHeader) bool {
+	return ((uint32(section.Flags) & 4) != 0) && (section.Type != 8) &&
+		(section.Size != 0)
+}
+
+// Records a reference from the given offset in the section, if the target is
+// in the range being searched for.
+func (s *codeScanner) add(offset int, target uint32, kind string) {
+	if (target < s.start) || (target >= s.end) {
+		return
+	}
+	s.found = append(s.found, CodeReference{
+		SectionIndex: s.sectionIndex,
+		FileOffset:   s.section.FileOffset + uint32(offset),
+		Address:      s.section.VirtualAddress + uint32(offset),
+		Target:       target,
+		Kind:         kind,
+	})
+}
+
+// Returns the 32-bit word at the given offset in the section, and whether
+// the offset was valid.
+func (s *codeScanner) word(offset int) (uint32, bool) {
+	if (offset < 0) || ((offset + 4) > len(s.content)) {
+		return 0, false
+	}
+	return s.f.Endianness.Uint32(s.content[offset:]), true
+}
+
+// Returns the 16-bit halfword at the given offset in the section, and
+// whether the offset was valid.
+func (s *codeScanner) halfword(offset int) (uint16, bool) {
+	if (offset < 0) || ((offset + 2) > len(s.content)) {
+		return 0, false
+	}
+	return s.f.Endianness.Uint16(s.content[offset:]), true
+}
+
+// Returns the address of the global offset table, which position-independent
+// x86 code addresses data relative to, or 0 if there isn't one.
+func findGOTAddress(f *elf_reader.ELF32File) uint32 {
+	var got uint32
+	for i := range f.Sections {
+		name, e := SectionName(f, uint16(i))
+		if e != nil {
+			continue
+		}
+		// _GLOBAL_OFFSET_TABLE_ is at the start of .got.plt, if there is
+		// one.
+		if name == ".got.plt" {
+			return f.Sections[i].VirtualAddress
+		}
+		if name == ".got" {
+			got = f.Sections[i].VirtualAddress
+		}
+	}
+	return got
+}
+
+// Returns a description of the x86 instruction likely to contain a 32-bit
+// immediate or displacement at the given offset.
+func describeX86Operand(content []byte, offset int) string {
+	before := func(n int) int {
+		if offset < n {
+			return -1
+		}
+		return int(content[offset-n])
+	}
+	switch {
+	case before(1) == 0x68:
+		return "push imm32"
+	case (before(1) >= 0xb8) && (before(1) <= 0xbf):
+		return "mov reg, imm32"
+	case (before(1) == 0xa1) || (before(1) == 0xa3):
+		return "mov eax, moffs32"
+	case (before(2) == 0xc7) || (before(3) == 0xc7):
+		return "mov r/m32, imm32"
+	case (before(2) == 0x8d) || (before(3) == 0x8d):
+		return "lea disp32"
+	}
+	return "32-bit constant"
+}
+
+// Looks for x86 instructions containing the target address as an immediate
+// or displacement, or (in position-independent code) as a displacement from
+// the global offset table, which is held in a register.
+func (s *codeScanner) scanX86(got uint32) {
+	var value uint32
+	for i := 0; (i + 4) <= len(s.content); i++ {
+		value = s.f.Endianness.Uint32(s.content[i:])
+		s.add(i, value, describeX86Operand(s.content, i))
+		// A ModRM byte with mod 10 is followed by a 32-bit displacement,
+		// e.g. "lea eax, [ebx+disp32]" with ebx holding the GOT address.
+		if (got != 0) && (i > 0) && ((s.content[i-1] & 0xc0) == 0x80) {
+			s.add(i, got+value, "GOT-relative disp32")
+		}
+	}
+}
+
+// Returns the value of the literal loaded by the ARM-mode "ldr rt, [pc,
+// #imm]" instruction at the given offset, if it loads into register rt.
+func (s *codeScanner) armLiteral(offset int, rt uint32) (uint32, bool) {
+	insn, ok := s.word(offset)
+	if !ok || ((insn & 0x0f7f0000) != 0x051f0000) ||
+		(((insn >> 12) & 0xf) != rt) {
+		return 0, false
+	}
+	// The PC reads as the instruction's address plus 8.
+	literal := offset + 8
+	if (insn & (1 << 23)) != 0 {
+		literal += int(insn & 0xfff)
+	} else {
+		literal -= int(insn & 0xfff)
+	}
+	return s.word(literal)
+}
+
+// Returns the value of the literal loaded by the Thumb "ldr rt, [pc, #imm]"
+// instruction at the given offset, if it loads into register rt.
+func (s *codeScanner) thumbLiteral(offset int, rt uint16) (uint32, bool) {
+	insn, ok := s.halfword(offset)
+	if !ok || ((insn & 0xf800) != 0x4800) || (((insn >> 8) & 7) != rt) {
+		return 0, false
+	}
+	// The PC reads as the instruction's address plus 4, aligned down to a
+	// word boundary.
+	address := s.section.VirtualAddress + uint32(offset)
+	literal := ((address + 4) &^ 3) + uint32(insn&0xff)*4
+	return s.word(int(literal - s.section.VirtualAddress))
+}
+
+// Looks for ARM and Thumb code referring to the target address: absolute
+// addresses in literal pools, literals added to the PC in position-
+// independent code, and movw/movt pairs.
+func (s *codeScanner) scanARM() {
+	// The number of instructions to search before a PC-relative add for the
+	// load of its literal, or after a movw for the matching movt.
+	const window = 16
+	for i := 0; (i + 4) <= len(s.content); i += 2 {
+		// Instructions are 2-byte (Thumb) or 4-byte (ARM) aligned.
+		if (i % 4) == 0 {
+			insn, _ := s.word(i)
+			s.add(i, insn, "literal pool word")
+			// ARM "add rd, pc, rm", with rm loaded by a PC-relative ldr.
+			if (insn & 0x0fef0ff0) == 0x008f0000 {
+				for j := i - 4; (j >= 0) && (j >= (i - 4*window)); j -= 4 {
+					literal, ok := s.armLiteral(j, insn&0xf)
+					if ok {
+						address := s.section.VirtualAddress + uint32(i)
+						s.add(i, literal+address+8, "ldr/add pc (ARM)")
+						break
+					}
+				}
+			}
+			// ARM "movw rd, #lo" followed by "movt rd, #hi".
+			if (insn & 0x0ff00000) == 0x03000000 {
+				rd := (insn >> 12) & 0xf
+				low := ((insn >> 4) & 0xf000) | (insn & 0xfff)
+				for j := i + 4; j <= (i + 4*window); j += 4 {
+					next, ok := s.word(j)
+					if !ok {
+						break
+					}
+					if ((next & 0x0ff00000) != 0x03400000) ||
+						(((next >> 12) & 0xf) != rd) {
+						continue
+					}
+					high := ((next >> 4) & 0xf000) | (next & 0xfff)
+					s.add(j, (high<<16)|low, "movw/movt (ARM)")
+					break
+				}
+			}
+		}
+		// Thumb "add rdn, pc", with rdn loaded by a PC-relative ldr.
+		half, _ := s.halfword(i)
+		if (half & 0xff78) != 0x4478 {
+			continue
+		}
+		rdn := (half & 7) | ((half >> 4) & 8)
+		if rdn > 7 {
+			continue
+		}
+		for j := i - 2; (j >= 0) && (j >= (i - 2*window)); j -= 2 {
+			literal, ok := s.thumbLiteral(j, rdn)
+			if ok {
+				address := s.section.VirtualAddress + uint32(i)
+				s.add(i, literal+address+4, "ldr/add pc (Thumb)")
+				break
+			}
+		}
+	}
+}
+
+// Looks for instructions in executable sections that appear to refer to
+// addresses in the range [start, end), e.g. a string in .rodata. For x86,
+// 32-bit immediates and displacements are checked, including displacements
+// relative to the global offset table. For ARM, literal pool words,
+// PC-relative literal loads followed by adds to the PC (in ARM and Thumb
+// code), and movw/movt pairs are checked. For other architectures, only
+// aligned 32-bit words containing the address are found. The results are
+// sorted by target address, and are heuristic: some references may be
+// missed, and unrelated data may appear to be a reference.
+func FindCodeReferences(f *elf_reader.ELF32File, start,
+	end uint32) ([]CodeReference, error) {
+	var toReturn []CodeReference
+	got := findGOTAddress(f)
+	for i := range f.Sections {
+		section := &(f.Sections[i])
+		if !isExecutableSection(section) {
+			continue
+		}
+		content, e := f.GetSectionContent(uint16(i))
+		if e != nil {
+			return nil, fmt.Errorf("Failed reading section %d: %s", i, e)
+		}
+		s := &codeScanner{
+			f:            f,
+			sectionIndex: uint16(i),
+			section:      section,
+			content:      content,
+			start:        start,
+			end:          end,
+		}
+		switch uint32(f.Header.Machine) {
+		case machineX86:
+			s.scanX86(got)
+		case machineARM:
+			s.scanARM()
+		default:
+			for j := 0; (j + 4) <= len(content); j += 4 {
+				value, _ := s.word(j)
+				s.add(j, value, "32-bit word")
+			}
+		}
+		toReturn = append(toReturn, s.found...)
+	}
+	sort.SliceStable(toReturn, func(a, b int) bool {
+		return toReturn[a].Target < toReturn[b].Target
+	})
+	return toReturn, nil
+}
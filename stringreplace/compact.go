@@ -0,0 +1,446 @@
+package stringreplace
+
+// This file contains code for writing a string table back over the original,
+// rather than appending it to the file, when the replacement strings fit in
+// the space freed by the strings they replace (or already exist in the
+// table). The output's layout is then identical to the input's.
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/yalue/elf_reader"
+	"sort"
+)
+
+// The references to strings in a single string table, found before any are
+// updated.
+type tableReferences struct {
+	// The offsets referred to by fields that are updated when the string
+	// they refer to is replaced.
+	updated map[uint32]bool
+	// The offsets referred to by fields that are never updated, such as
+	// DT_AUDIT entries (see unsupportedStringReferences), or symbols
+	// rejected by the symbol filter.
+	pinned map[uint32]bool
+	// The number of fields referring to each offset, updated or not.
+	counts map[uint32]int
+}
+
+// Records a field referring to the given offset. The field is updated when
+// the string it refers to is replaced, unless updated is false.
+func (r *tableReferences) add(offset uint32, updated bool) {
+	if updated {
+		r.updated[offset] = true
+	} else {
+		r.pinned[offset] = true
+	}
+	r.counts[offset]++
+}
+
+// Returns the references to the given string table. Returns false if the
+// table may be referred to by anything this package doesn't know about (e.g.
+// a section of another type linking to it), in which case none of its
+// strings can safely be moved.
+func findTableReferences(f *elf_reader.ELF32File, tableIndex uint16,
+	filter *SymbolFilter) (*tableReferences, bool, error) {
+	toReturn := &tableReferences{
+		updated: make(map[uint32]bool),
+		pinned:  make(map[uint32]bool),
+		counts:  make(map[uint32]int),
+	}
+	namesIndex, hasNames := SectionNamesTable(f)
+	isNames := hasNames && (tableIndex == namesIndex)
+	if !isNames && !referencedStringTables(f)[tableIndex] {
+		return nil, false, nil
+	}
+	for i := range f.Sections {
+		section := &(f.Sections[i])
+		if isNames {
+			toReturn.add(section.Name, true)
+		}
+		if section.LinkedIndex != uint32(tableIndex) {
+			continue
+		}
+		sectionType := uint32(section.Type)
+		var e error
+		switch {
+		// SHT_SYMTAB
+		case f.IsSymbolTable(uint16(i)) || (sectionType == 2):
+			e = toReturn.addSymbolNames(f, uint16(i), filter)
+		case f.IsDynamicSection(uint16(i)):
+			e = toReturn.addDynamicStrings(f, uint16(i))
+		case f.IsVersionRequirementSection(uint16(i)):
+			e = toReturn.addRequirementNames(f, uint16(i))
+		case sectionType == VersionDefinitionSection:
+			e = toReturn.addDefinitionNames(f, uint16(i))
+		default:
+			return nil, false, nil
+		}
+		if e != nil {
+			return nil, false, e
+		}
+	}
+	for offset := range unsupportedStringReferences(f, tableIndex) {
+		toReturn.add(offset, false)
+	}
+	e := toReturn.addRelocationAddends(f, tableIndex)
+	if e != nil {
+		return nil, false, e
+	}
+	return toReturn, true, nil
+}
+
+// Adds the offsets of strings in the given table whose addresses are used as
+// the addends of relocations that don't refer to a symbol. These are updated
+// by replaceRelocationStrings, but only if they point to the start of a
+// string.
+func (r *tableReferences) addRelocationAddends(f *elf_reader.ELF32File,
+	tableIndex uint16) error {
+	table := &(f.Sections[tableIndex])
+	// ET_REL is 1.
+	if (table.VirtualAddress == 0) || (uint32(f.Header.Type) == 1) {
+		return nil
+	}
+	tableEnd := uint64(table.VirtualAddress) + uint64(table.Size)
+	for i := range f.Sections {
+		section := &(f.Sections[i])
+		// SHT_RELA is 4.
+		if section.Type != 4 {
+			continue
+		}
+		for offset := section.FileOffset; (offset + relaEntrySize) <=
+			(section.FileOffset + section.Size); offset += relaEntrySize {
+			info, e := readELFUint32(f, offset+4, "relocation")
+			if e != nil {
+				return fmt.Errorf("Failed reading relocation: %s", e)
+			}
+			if ((info >> 8) != 0) || !relocationAddendIsAddress(f, info) {
+				continue
+			}
+			addend, e := readELFUint32(f, offset+8, "relocation addend")
+			if e != nil {
+				return fmt.Errorf("Failed reading relocation: %s", e)
+			}
+			if (addend >= table.VirtualAddress) && (uint64(addend) < tableEnd) {
+				r.add(addend-table.VirtualAddress, true)
+			}
+		}
+	}
+	return nil
+}
+
+// Adds the names of the symbols in the given symbol table. Names of symbols
+// rejected by the filter aren't updated.
+func (r *tableReferences) addSymbolNames(f *elf_reader.ELF32File,
+	sectionIndex uint16, filter *SymbolFilter) error {
+	section := &(f.Sections[sectionIndex])
+	// Each Elf32_Sym is 16 bytes, starting with st_name.
+	for offset := section.FileOffset; (offset + 16) <= (section.FileOffset +
+		section.Size); offset += 16 {
+		name, e := readELFUint32(f, offset, "symbol")
+		if e != nil {
+			return fmt.Errorf("Failed reading symbol name: %s", e)
+		}
+		r.add(name, filter.acceptsSymbolAt(f, offset))
+	}
+	return nil
+}
+
+// Adds the string offsets in the given dynamic table.
+func (r *tableReferences) addDynamicStrings(f *elf_reader.ELF32File,
+	sectionIndex uint16) error {
+	entries, e := f.GetDynamicTable(sectionIndex)
+	if e != nil {
+		return fmt.Errorf("Failed parsing dynamic table: %s", e)
+	}
+	for _, entry := range entries {
+		if _, ok := dynamicStringTagNames[entry.Tag]; ok {
+			r.add(entry.Value, true)
+		}
+	}
+	return nil
+}
+
+// Adds the file and version names in the given version requirement section.
+func (r *tableReferences) addRequirementNames(f *elf_reader.ELF32File,
+	sectionIndex uint16) error {
+	need, aux, e := f.ParseVersionRequirementSection(sectionIndex)
+	if e != nil {
+		return fmt.Errorf("Failed parsing version requirement section: %s", e)
+	}
+	for i, n := range need {
+		r.add(n.File, true)
+		for _, x := range aux[i] {
+			r.add(x.Name, true)
+		}
+	}
+	return nil
+}
+
+// Adds every name in the given version definition section: each definition's
+// own name, and the names of its parent versions in the Elf32_Verdaux entries
+// after the first.
+func (r *tableReferences) addDefinitionNames(f *elf_reader.ELF32File,
+	sectionIndex uint16) error {
+	section := &(f.Sections[sectionIndex])
+	defOffset := section.FileOffset
+	// sh_info holds the number of Elf32_Verdef entries.
+	for i := uint32(0); i < section.Info; i++ {
+		count, e := readSectionUint16(f, section, defOffset+6)
+		var auxDelta, next, name, auxNext uint32
+		if e == nil {
+			auxDelta, e = readSectionUint32(f, section, defOffset+12)
+		}
+		if e == nil {
+			next, e = readSectionUint32(f, section, defOffset+16)
+		}
+		if e != nil {
+			return fmt.Errorf("Bad verdef %d: %s", i, e)
+		}
+		auxOffset := defOffset + auxDelta
+		for j := uint16(0); j < count; j++ {
+			name, e = readSectionUint32(f, section, auxOffset)
+			if e == nil {
+				auxNext, e = readSectionUint32(f, section, auxOffset+4)
+			}
+			if e != nil {
+				return fmt.Errorf("Bad verdef %d aux %d: %s", i, j, e)
+			}
+			r.add(name, true)
+			auxOffset += auxNext
+		}
+		if next == 0 {
+			break
+		}
+		defOffset += next
+	}
+	return nil
+}
+
+// Returns true if any of the offsets are in the range [start, end].
+func anyOffsetInRange(offsets map[uint32]bool, start, end uint32) bool {
+	for offset := range offsets {
+		if (offset >= start) && (offset <= end) {
+			return true
+		}
+	}
+	return false
+}
+
+// A range of unused bytes in a string table, [start, end).
+type tableGap struct {
+	start, end uint32
+}
+
+// Tries to lay out the table's replacement strings within the original
+// table's size, without moving any string that may still be referred to.
+// Each replaced string's space is freed, unless something that isn't updated
+// refers to it, or something refers to its middle (e.g. a shorter string
+// sharing its suffix). Replacements that already exist in the table are
+// shared rather than copied. On success, the table's new content and
+// replacement offsets are updated, and true is returned. Otherwise, the table
+// is left unchanged, and false is returned.
+func compactTable(t *replacedStringTable, references *tableReferences) bool {
+	return layoutTable(t, references, false)
+}
+
+// Implements compactTable. If grow is true, replacements that don't fit in
+// the freed space are appended to the table instead, so this always succeeds
+// (unless the table is malformed), and replacements that fit in the space of
+// the string they replace are written there first, so they keep its offset.
+func layoutTable(t *replacedStringTable, references *tableReferences,
+	grow bool) bool {
+	// The layout is rebuilt from the replacements, which would drop any
+	// strings added for new dynamic table entries.
+	if t.addedStrings != 0 {
+		return false
+	}
+	content := append([]byte(nil), t.oldContent...)
+	gaps := make([]tableGap, 0, len(t.replacements))
+	// The index in gaps of the space freed by each replacement, or -1.
+	ownGaps := make([]int, len(t.replacements))
+	for i, r := range t.replacements {
+		ownGaps[i] = -1
+		end := uint32(bytes.IndexByte(content[r.originalOffset:], 0))
+		if end == 0xffffffff {
+			return false
+		}
+		end += r.originalOffset
+		if references.pinned[r.originalOffset] ||
+			anyOffsetInRange(references.pinned, r.originalOffset, end) ||
+			anyOffsetInRange(references.updated, r.originalOffset+1, end) {
+			continue
+		}
+		for j := r.originalOffset; j <= end; j++ {
+			content[j] = 0
+		}
+		ownGaps[i] = len(gaps)
+		gaps = append(gaps, tableGap{r.originalOffset, end + 1})
+	}
+	// Place the longest strings first, so they get the largest gaps.
+	order := make([]int, len(t.replacements))
+	newStrings := make([][]byte, len(t.replacements))
+	for i, r := range t.replacements {
+		order[i] = i
+		s, e := elf_reader.ReadStringAtOffset(r.newOffset, t.newContent)
+		if e != nil {
+			return false
+		}
+		newStrings[i] = s
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return len(newStrings[order[a]]) > len(newStrings[order[b]])
+	})
+	newOffsets := make([]uint32, len(t.replacements))
+	placed := make([]bool, len(t.replacements))
+	if grow {
+		for i, s := range newStrings {
+			if (len(s) == 0) || (ownGaps[i] < 0) {
+				continue
+			}
+			g := &(gaps[ownGaps[i]])
+			if (g.end - g.start) < uint32(len(s)+1) {
+				continue
+			}
+			copy(content[g.start:], s)
+			newOffsets[i] = g.start
+			g.start += uint32(len(s) + 1)
+			placed[i] = true
+		}
+	}
+	for _, i := range order {
+		s := newStrings[i]
+		if placed[i] {
+			continue
+		}
+		if len(s) == 0 {
+			// Offset 0 always holds the empty string.
+			newOffsets[i] = 0
+			continue
+		}
+		// Any non-empty match is in bytes that won't be overwritten, since
+		// the gaps are zeroed.
+		existing := bytes.Index(content, append(append([]byte(nil), s...), 0))
+		if existing >= 0 {
+			newOffsets[i] = uint32(existing)
+			continue
+		}
+		for j := range gaps {
+			g := &(gaps[j])
+			if (g.end - g.start) < uint32(len(s)+1) {
+				continue
+			}
+			copy(content[g.start:], s)
+			content[g.start+uint32(len(s))] = 0
+			newOffsets[i] = g.start
+			g.start += uint32(len(s) + 1)
+			placed[i] = true
+			break
+		}
+		if placed[i] {
+			continue
+		}
+		if !grow {
+			return false
+		}
+		newOffsets[i] = uint32(len(content))
+		content = append(append(content, s...), 0)
+	}
+	t.newContent = content
+	for i := range t.replacements {
+		t.replacements[i].newOffset = newOffsets[i]
+	}
+	return true
+}
+
+// Writes the string tables whose replacements fit within their original size,
+// according to compactTable, back over the originals, leaving them at the
+// same offset and address. Returns the tables that didn't fit, which must
+// still be relocated, along with their indices in newTables.
+func rewriteTablesInPlace(f *elf_reader.ELF32File,
+	newTables []replacedStringTable, options *Options,
+	report *Report) ([]replacedStringTable, []int, error) {
+	remaining := make([]replacedStringTable, 0, len(newTables))
+	positions := make([]int, 0, len(newTables))
+	rewritten := 0
+	for i := range newTables {
+		t := &(newTables[i])
+		references, ok, e := findTableReferences(f, t.sectionIndex,
+			options.SymbolFilter)
+		if e != nil {
+			return nil, nil, e
+		}
+		// References using an aliased section header aren't collected, so
+		// aliased tables are always relocated.
+		if !ok || (len(t.aliases) != 0) || !compactTable(t, references) {
+			remaining = append(remaining, *t)
+			positions = append(positions, i)
+			continue
+		}
+		t.newFileOffset = t.oldFileOffset
+		t.newVirtualAddress = t.oldVirtualAddress
+		t.newSegmentIndex = t.oldSegmentIndex
+		// The old content may refer to the memory we're about to overwrite,
+		// but it's still needed to log the replacements.
+		t.oldContent = append([]byte(nil), t.oldContent...)
+		e = writeAtELFOffset(f, t.oldFileOffset, t.newContent,
+			"string table")
+		if e != nil {
+			return nil, nil, fmt.Errorf("Failed overwriting the string table "+
+				"in section %d: %s", t.sectionIndex, e)
+		}
+		report.logf("String table in section %d rewritten in place, since "+
+			"the replacements fit in its original size.\n", t.sectionIndex)
+		rewritten++
+	}
+	if rewritten != 0 {
+		e := reparseELF(f)
+		if e != nil {
+			return nil, nil, fmt.Errorf("Error re-parsing ELF file after "+
+				"rewriting string tables: %s", e)
+		}
+	}
+	return remaining, positions, nil
+}
+
+// Lays out each table that must be relocated using layoutTable, so that
+// replacements fitting in the space of the strings they replace are written
+// there, and only the rest are appended to the table, for Options.Hybrid.
+// Tables whose references can't all be found, aliased tables, and tables
+// holding a single string are left as they are.
+func layoutHybridTables(f *elf_reader.ELF32File, tables []replacedStringTable,
+	options *Options, report *Report) error {
+	for i := range tables {
+		t := &(tables[i])
+		if (len(t.aliases) != 0) || ((len(t.replacements) == 1) &&
+			looksLikeSingleString(t.oldContent)) {
+			continue
+		}
+		references, ok, e := findTableReferences(f, t.sectionIndex,
+			options.SymbolFilter)
+		if e != nil {
+			return e
+		}
+		if !ok {
+			continue
+		}
+		previousSize := len(t.newContent)
+		if !layoutTable(t, references, true) {
+			continue
+		}
+		inPlace := 0
+		for _, r := range t.replacements {
+			if r.newOffset < uint32(len(t.oldContent)) {
+				inPlace++
+			}
+		}
+		if inPlace == 0 {
+			continue
+		}
+		report.logf("Placed %d of %d replacements in section %d within its "+
+			"original content, shrinking the relocated table from %d to %d "+
+			"bytes.\n", inPlace, len(t.replacements), t.sectionIndex,
+			previousSize, len(t.newContent))
+	}
+	return nil
+}
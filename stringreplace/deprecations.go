@@ -0,0 +1,19 @@
+package stringreplace
+
+// This file contains the deprecation notices recorded in reports. Callers
+// with deprecated interfaces of their own, such as the command-line tool's
+// plain-flag invocation, keep them working, but list the ones that were used
+// in each report, along with what replaces them, so automation reading the
+// JSON report can migrate before they're removed. Unlike warnings, notices
+// are never treated as errors in strict mode.
+
+// Describes a deprecated feature that was used to produce a report.
+type DeprecationNotice struct {
+	// A stable identifier for the feature, e.g. "cli.plain_flags", so
+	// automation can match notices without parsing the message.
+	Feature string `json:"feature"`
+	// What to use instead, e.g. "elf32_string_replace patch".
+	Replacement string `json:"replacement"`
+	// A human-readable description of the deprecation.
+	Message string `json:"message"`
+}
@@ -0,0 +1,236 @@
+package stringreplace
+
+// This file contains functions for interpreting the values of dynamic table
+// entries, which are either addresses (d_ptr) or other values (d_val).
+
+import (
+	"fmt"
+	"github.com/yalue/elf_reader"
+	"sort"
+)
+
+// The dynamic tags below DT_ENCODING (32) whose values are addresses. Above
+// DT_ENCODING, even tags are addresses, with the exceptions in
+// dynamicValueTags.
+var dynamicPointerTags = map[elf_reader.ELF32DynamicTag]bool{
+	3:  true, // DT_PLTGOT
+	4:  true, // DT_HASH
+	5:  true, // DT_STRTAB
+	6:  true, // DT_SYMTAB
+	7:  true, // DT_RELA
+	12: true, // DT_INIT
+	13: true, // DT_FINI
+	17: true, // DT_REL
+	21: true, // DT_DEBUG
+	23: true, // DT_JMPREL
+	25: true, // DT_INIT_ARRAY
+	26: true, // DT_FINI_ARRAY
+}
+
+// Even dynamic tags above DT_ENCODING whose values aren't addresses.
+var dynamicValueTags = map[elf_reader.ELF32DynamicTag]bool{
+	0x6ffffffa: true, // DT_RELCOUNT
+}
+
+// Returns true if the dynamic table entry's value is an address (d_ptr),
+// which the loader relocates by the load base of position-independent files,
+// rather than a size, offset, or flags (d_val).
+func dynamicTagIsPointer(tag elf_reader.ELF32DynamicTag) bool {
+	if tag < 32 {
+		return dynamicPointerTags[tag]
+	}
+	// DT_VALRNGLO to DT_VALRNGHI are values, and DT_ADDRRNGLO to
+	// DT_ADDRRNGHI (including DT_GNU_HASH) are addresses.
+	if (tag >= 0x6ffffd00) && (tag <= 0x6ffffdff) {
+		return false
+	}
+	if (tag >= 0x6ffffe00) && (tag <= 0x6ffffeff) {
+		return true
+	}
+	if dynamicValueTags[tag] {
+		return false
+	}
+	return (tag % 2) == 0
+}
+
+// Returns the d_ptr value referring to the table's new location. This is the
+// link-time virtual address of the segment the table was loaded in, offset
+// to the table: an absolute address for ET_EXEC files, and an address
+// relative to the load base (which the loader adds to it) for ET_DYN files.
+// Returns an error if the table isn't loaded, or isn't loaded at the address
+// its file offset implies.
+func dynamicPointerValue(f *elf_reader.ELF32File,
+	t *replacedStringTable) (uint32, error) {
+	if (t.newSegmentIndex < 0) || (t.newSegmentIndex >= len(f.Segments)) {
+		return 0, fmt.Errorf("The string table at offset 0x%08x isn't "+
+			"loaded by any segment", t.newFileOffset)
+	}
+	s := &(f.Segments[t.newSegmentIndex])
+	address := s.VirtualAddress + (t.newFileOffset - s.FileOffset)
+	if address != t.newVirtualAddress {
+		return 0, fmt.Errorf("The string table at offset 0x%08x has VA "+
+			"0x%08x, but segment %d loads it at 0x%08x", t.newFileOffset,
+			t.newVirtualAddress, t.newSegmentIndex, address)
+	}
+	switch uint32(f.Header.Type) {
+	case 2:
+		// ET_EXEC: the loader uses the address as-is.
+		return address, nil
+	case 3:
+		// ET_DYN: segment addresses are relative to a base of 0 (or to the
+		// prelinked base, which the loader also subtracts), so the address
+		// is already in the form the loader expects.
+		return address, nil
+	}
+	return 0, fmt.Errorf("Unexpected dynamic table in an ELF file of "+
+		"type %d", uint32(f.Header.Type))
+}
+
+// The names of the dynamic table tags describing the string table.
+var dynamicTableTagNames = map[elf_reader.ELF32DynamicTag]string{
+	5:  "DT_STRTAB",
+	10: "DT_STRSZ",
+}
+
+// Updates the value, at the given file offset, of a dynamic table entry
+// describing the string table: its address if the entry holds an address
+// (e.g. DT_STRTAB), or its size otherwise (e.g. DT_STRSZ).
+func updateStringTableEntry(f *elf_reader.ELF32File, t *replacedStringTable,
+	offset uint32, index int, entry elf_reader.ELF32DynamicEntry) error {
+	var value uint32
+	var e error
+	if dynamicTagIsPointer(entry.Tag) {
+		value, e = dynamicPointerValue(f, t)
+		if e != nil {
+			return e
+		}
+	} else {
+		value = uint32(len(t.newContent))
+	}
+	if value == entry.Value {
+		return nil
+	}
+	e = writeELFUint32(f, offset, value, "dynamic entry")
+	if e != nil {
+		return e
+	}
+	t.report.addReference(ReferenceUpdate{
+		FileOffset:    offset,
+		SectionIndex:  t.sectionIndex,
+		OriginalValue: entry.Value,
+		NewValue:      value,
+		Location: fmt.Sprintf("dynamic entry %d %s", index,
+			dynamicTableTagNames[entry.Tag]),
+	})
+	return nil
+}
+
+// The names of the address-valued dynamic table tags, used when describing
+// them.
+var dynamicPointerTagNames = map[elf_reader.ELF32DynamicTag]string{
+	3:          "DT_PLTGOT",
+	4:          "DT_HASH",
+	5:          "DT_STRTAB",
+	6:          "DT_SYMTAB",
+	7:          "DT_RELA",
+	12:         "DT_INIT",
+	13:         "DT_FINI",
+	17:         "DT_REL",
+	23:         "DT_JMPREL",
+	25:         "DT_INIT_ARRAY",
+	26:         "DT_FINI_ARRAY",
+	32:         "DT_PREINIT_ARRAY",
+	0x6ffffef5: "DT_GNU_HASH",
+	0x6ffffef8: "DT_GNU_CONFLICT",
+	0x6ffffef9: "DT_GNU_LIBLIST",
+	0x6ffffff0: "DT_VERSYM",
+	0x6ffffffc: "DT_VERDEF",
+	0x6ffffffe: "DT_VERNEED",
+}
+
+// Returns a name for the dynamic tag, for use in messages.
+func describeDynamicPointerTag(tag elf_reader.ELF32DynamicTag) string {
+	name, ok := dynamicPointerTagNames[tag]
+	if ok {
+		return name
+	}
+	return fmt.Sprintf("tag 0x%x", uint32(tag))
+}
+
+// Returns true if the address is within, or at the end of, the memory of a
+// loadable segment.
+func isLoadedAddress(f *elf_reader.ELF32File, address uint32) bool {
+	for i := range f.Segments {
+		s := &(f.Segments[i])
+		if s.Type != elf_reader.LoadableSegment {
+			continue
+		}
+		if (address >= s.VirtualAddress) && (uint64(address) <=
+			uint64(s.VirtualAddress)+uint64(s.MemorySize)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a description of each address-valued (d_ptr) entry in the dynamic
+// table that doesn't point into any loadable segment, keyed by the entry's
+// index. DT_DEBUG, which the loader fills in at runtime, and null addresses
+// are ignored.
+func danglingDynamicPointers(f *elf_reader.ELF32File) (map[int]string,
+	error) {
+	toReturn := make(map[int]string)
+	for i := range f.Sections {
+		if !f.IsDynamicSection(uint16(i)) {
+			continue
+		}
+		entries, e := f.GetDynamicTable(uint16(i))
+		if e != nil {
+			return nil, fmt.Errorf("Failed parsing dynamic table: %s", e)
+		}
+		for j, entry := range entries {
+			// DT_NULL ends the table.
+			if entry.Tag == 0 {
+				break
+			}
+			// Tag 21 is DT_DEBUG.
+			if !dynamicTagIsPointer(entry.Tag) || (entry.Tag == 21) ||
+				(entry.Value == 0) {
+				continue
+			}
+			if isLoadedAddress(f, entry.Value) {
+				continue
+			}
+			toReturn[j] = fmt.Sprintf("Dynamic entry %d (%s) points to "+
+				"0x%08x, outside every loadable segment", j,
+				describeDynamicPointerTag(entry.Tag), entry.Value)
+		}
+		break
+	}
+	return toReturn, nil
+}
+
+// Adds a warning to the report for each address-valued dynamic table entry
+// that points outside every loadable segment after patching, but didn't
+// before (as given by the result of danglingDynamicPointers on the original
+// file). This catches layout mistakes that leave an entry pointing at memory
+// that's no longer mapped.
+func checkDynamicPointers(f *elf_reader.ELF32File, before map[int]string,
+	report *Report) error {
+	after, e := danglingDynamicPointers(f)
+	if e != nil {
+		return e
+	}
+	indices := make([]int, 0, len(after))
+	for index := range after {
+		if _, ok := before[index]; ok {
+			continue
+		}
+		indices = append(indices, index)
+	}
+	sort.Ints(indices)
+	for _, index := range indices {
+		report.addWarning("After patching: %s", after[index])
+	}
+	return nil
+}
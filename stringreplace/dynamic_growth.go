@@ -0,0 +1,534 @@
+package stringreplace
+
+// This file contains the code for adding entries to the dynamic table, such
+// as new DT_NEEDED dependencies, which Options.AddNeeded, AddSoname, AddRPath,
+// and AddRunPath are built on. The new entries' strings are appended to the
+// dynamic string table, which is then relocated along with any other replaced
+// tables. Most dynamic tables end with a single DT_NULL entry, with no room
+// for more, so unless there are enough spare DT_NULL entries at the end, the
+// table is copied to a new writable loadable segment, with the new entries
+// before its DT_NULL terminator. The PT_DYNAMIC segment, the section header,
+// and the _DYNAMIC symbol are then pointed at the copy, and the original is
+// left unused. The segment must be writable, since the loader stores the
+// address of its debugging structure in DT_DEBUG, and older loaders relocate
+// the d_ptr values in place.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/yalue/elf_reader"
+)
+
+// Describes an entry added to the dynamic table.
+type DynamicEntryReport struct {
+	// The entry's index in the updated dynamic table.
+	Index   int    `json:"index"`
+	Tag     uint32 `json:"tag"`
+	TagName string `json:"tag_name"`
+	// The string the entry refers to, escaped using EscapeString.
+	Value string `json:"value"`
+}
+
+// An entry to add to the dynamic table, whose value is a string.
+type dynamicAddition struct {
+	tag   elf_reader.ELF32DynamicTag
+	value string
+}
+
+// The names of the tags of the entries that can be added.
+var addedDynamicTagNames = map[elf_reader.ELF32DynamicTag]string{
+	1:  "DT_NEEDED",
+	14: "DT_SONAME",
+	15: "DT_RPATH",
+	29: "DT_RUNPATH",
+}
+
+// Returns true if the options add any entries to the dynamic table.
+func (o *Options) addsDynamicEntries() bool {
+	return (len(o.AddNeeded) != 0) || (o.AddSoname != "") ||
+		(o.AddRPath != "") || (o.AddRunPath != "")
+}
+
+// Returns the index of the file's dynamic table section, or -1 if it doesn't
+// have one.
+func dynamicSectionIndex(f *elf_reader.ELF32File) int {
+	for i := range f.Sections {
+		if f.IsDynamicSection(uint16(i)) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Returns the offset of a NUL-terminated copy of s in the string table
+// content, which may be the end of a longer string, or -1 if there isn't one.
+func findTableString(content []byte, s string) int {
+	return bytes.Index(content, append([]byte(s), 0))
+}
+
+// Returns the entries to add to f's dynamic table according to the options.
+// Dependencies the file already has, or which are listed more than once, are
+// skipped, as is a DT_SONAME, DT_RPATH, or DT_RUNPATH entry the file already
+// has with the same value. Returns an error if the file has no dynamic table,
+// or already has one of those entries with a different value, in which case
+// a rule should be used to replace its string instead (see
+// replaceDynamicTableStrings).
+func planDynamicAdditions(f *elf_reader.ELF32File, options *Options,
+	report *Report) ([]dynamicAddition, error) {
+	index := dynamicSectionIndex(f)
+	if index < 0 {
+		return nil, fmt.Errorf("The file has no dynamic table, so dynamic " +
+			"entries can't be added to it")
+	}
+	entries, e := f.GetDynamicTable(uint16(index))
+	if e != nil {
+		return nil, fmt.Errorf("Failed parsing dynamic table: %s", e)
+	}
+	dynstr, e := f.GetSectionContent(uint16(f.Sections[index].LinkedIndex))
+	if e != nil {
+		return nil, fmt.Errorf("Failed reading the dynamic string table: %s",
+			e)
+	}
+	existing := make(map[elf_reader.ELF32DynamicTag][]string)
+	for _, entry := range entries {
+		if _, ok := addedDynamicTagNames[entry.Tag]; !ok {
+			continue
+		}
+		value, e := elf_reader.ReadStringAtOffset(entry.Value, dynstr)
+		if e != nil {
+			return nil, fmt.Errorf("Failed reading the %s string: %s",
+				addedDynamicTagNames[entry.Tag], e)
+		}
+		existing[entry.Tag] = append(existing[entry.Tag], string(value))
+	}
+	var toReturn []dynamicAddition
+	for _, name := range options.AddNeeded {
+		if name == "" {
+			return nil, fmt.Errorf("Can't add an empty DT_NEEDED entry")
+		}
+		found := false
+		for _, other := range existing[1] {
+			found = found || (other == name)
+		}
+		if found {
+			report.logf("Not adding DT_NEEDED %s, since the file already "+
+				"depends on it.\n", EscapeString(name))
+			continue
+		}
+		existing[1] = append(existing[1], name)
+		toReturn = append(toReturn, dynamicAddition{1, name})
+	}
+	single := []dynamicAddition{{14, options.AddSoname},
+		{15, options.AddRPath}, {29, options.AddRunPath}}
+	for _, a := range single {
+		if a.value == "" {
+			continue
+		}
+		name := addedDynamicTagNames[a.tag]
+		values := existing[a.tag]
+		if len(values) == 0 {
+			toReturn = append(toReturn, a)
+			continue
+		}
+		if (len(values) == 1) && (values[0] == a.value) {
+			report.logf("Not adding %s %s, since the file already has it.\n",
+				name, EscapeString(a.value))
+			continue
+		}
+		return nil, fmt.Errorf("The file already has a %s entry (%s); use a "+
+			"rule matching %s to replace its string instead", name,
+			EscapeString(values[0]), EscapeString(values[0]))
+	}
+	return toReturn, nil
+}
+
+// Appends the strings of the new dynamic table entries that aren't already
+// in the dynamic string table to the end of its new content, adding the table
+// to the list of replaced tables if no strings in it were replaced. Returns
+// the updated list of tables.
+func addDynamicStrings(f *elf_reader.ELF32File,
+	additions []dynamicAddition, tables []replacedStringTable,
+	report *Report) ([]replacedStringTable, error) {
+	tableIndex := uint16(f.Sections[dynamicSectionIndex(f)].LinkedIndex)
+	t := getReplacementTable(tables, tableIndex)
+	var created replacedStringTable
+	if t == nil {
+		name, _ := SectionName(f, tableIndex)
+		var e error
+		created, e = newReplacedStringTable(f, tableIndex, name, report)
+		if e != nil {
+			return nil, e
+		}
+		created.newContent = append([]byte(nil), created.oldContent...)
+		t = &created
+	}
+	for _, a := range additions {
+		if findTableString(t.newContent, a.value) >= 0 {
+			continue
+		}
+		report.logf("Adding %s to the string table in section %d at offset "+
+			"0x%x, for a new %s entry.\n", EscapeString(a.value),
+			tableIndex, len(t.newContent), addedDynamicTagNames[a.tag])
+		t.newContent = append(append(t.newContent, a.value...), 0)
+		t.addedStrings++
+	}
+	if (t == &created) && (created.addedStrings != 0) {
+		tables = append(tables, created)
+	}
+	return tables, nil
+}
+
+// Adds the new entries to the dynamic table, after the last existing entry
+// with the same tag, or else before the DT_NULL terminator. The table's
+// spare DT_NULL entries are used if there are enough of them, and otherwise,
+// it's relocated to a new segment. Must be called after the dynamic string
+// table has been relocated, and its references updated.
+func growDynamicTable(f *elf_reader.ELF32File, additions []dynamicAddition,
+	options *Options, report *Report) error {
+	index := dynamicSectionIndex(f)
+	section := &(f.Sections[index])
+	dynstr, e := f.GetSectionContent(uint16(section.LinkedIndex))
+	if e != nil {
+		return fmt.Errorf("Failed reading the dynamic string table: %s", e)
+	}
+	entries, e := f.GetDynamicTable(uint16(index))
+	if e != nil {
+		return fmt.Errorf("Failed parsing dynamic table: %s", e)
+	}
+	// DT_NULL is 0, and ends the table. Any DT_NULL entries after the first
+	// are spare.
+	end := 0
+	for (end < len(entries)) && (entries[end].Tag != 0) {
+		end++
+	}
+	spare := 0
+	for i := end + 1; (i < len(entries)) && (entries[i].Tag == 0); i++ {
+		spare++
+	}
+	newEntries := append([]elf_reader.ELF32DynamicEntry(nil),
+		entries[:end]...)
+	added := make([]elf_reader.ELF32DynamicEntry, len(additions))
+	for i, a := range additions {
+		offset := findTableString(dynstr, a.value)
+		if offset < 0 {
+			return fmt.Errorf("The string for the new %s entry wasn't found "+
+				"in the dynamic string table", addedDynamicTagNames[a.tag])
+		}
+		added[i] = elf_reader.ELF32DynamicEntry{
+			Tag:   a.tag,
+			Value: uint32(offset),
+		}
+		position := len(newEntries)
+		for j := range newEntries {
+			if newEntries[j].Tag == a.tag {
+				position = j + 1
+			}
+		}
+		newEntries = append(newEntries[:position],
+			append([]elf_reader.ELF32DynamicEntry{added[i]},
+				newEntries[position:]...)...)
+	}
+	newEntries = append(newEntries, elf_reader.ELF32DynamicEntry{})
+	if spare >= len(additions) {
+		report.logf("Adding %d entries to the dynamic table in place, using "+
+			"%d of its %d spare DT_NULL entries.\n", len(additions),
+			len(additions), spare)
+		for len(newEntries) < (end + 1 + spare) {
+			newEntries = append(newEntries, elf_reader.ELF32DynamicEntry{})
+		}
+		e = writeAtELFOffset(f, section.FileOffset, newEntries,
+			"dynamic table")
+		if e != nil {
+			return fmt.Errorf("Failed writing the dynamic table: %s", e)
+		}
+	} else {
+		e = relocateDynamicTable(f, uint16(index), newEntries, options,
+			report)
+		if e != nil {
+			return fmt.Errorf("Failed relocating the dynamic table: %s", e)
+		}
+	}
+	e = reparseELF(f)
+	if e != nil {
+		return fmt.Errorf("Error re-parsing ELF file after adding dynamic "+
+			"entries: %s", e)
+	}
+	for i, a := range additions {
+		for j := range newEntries {
+			if newEntries[j] != added[i] {
+				continue
+			}
+			report.DynamicEntries = append(report.DynamicEntries,
+				DynamicEntryReport{
+					Index:   j,
+					Tag:     uint32(a.tag),
+					TagName: addedDynamicTagNames[a.tag],
+					Value:   EscapeString(a.value),
+				})
+			report.logf("Added dynamic entry %d: %s %s\n", j,
+				addedDynamicTagNames[a.tag], EscapeString(a.value))
+			break
+		}
+	}
+	return nil
+}
+
+// Writes the given entries to a new writable loadable segment, and points
+// the dynamic table's section header, the PT_DYNAMIC segment, and any
+// _DYNAMIC symbols at them.
+func relocateDynamicTable(f *elf_reader.ELF32File, sectionIndex uint16,
+	entries []elf_reader.ELF32DynamicEntry, options *Options,
+	report *Report) error {
+	var content bytes.Buffer
+	e := binary.Write(&content, f.Endianness, entries)
+	if e != nil {
+		return fmt.Errorf("Failed encoding the dynamic table: %s", e)
+	}
+	section := &(f.Sections[sectionIndex])
+	oldFileOffset := section.FileOffset
+	oldAddress := section.VirtualAddress
+	loadIndex, e := appendWritableSegment(f, content.Bytes(), options,
+		report)
+	if e != nil {
+		return e
+	}
+	load := f.Segments[loadIndex]
+	// appendWritableSegment re-parsed the headers.
+	section = &(f.Sections[sectionIndex])
+	section.FileOffset = load.FileOffset
+	section.VirtualAddress = load.VirtualAddress
+	section.Size = uint32(content.Len())
+	e = writeAtELFOffset(f, f.Header.SectionHeaderOffset, f.Sections,
+		"section headers")
+	if e != nil {
+		return fmt.Errorf("Error updating section headers: %s", e)
+	}
+	for i := range f.Segments {
+		s := &(f.Segments[i])
+		if s.Type != elf_reader.DynamicLinkingSegment {
+			continue
+		}
+		s.FileOffset = load.FileOffset
+		s.VirtualAddress = load.VirtualAddress
+		s.PhysicalAddress = load.VirtualAddress
+		s.FileSize = uint32(content.Len())
+		s.MemorySize = s.FileSize
+	}
+	e = writeAtELFOffset(f, f.Header.ProgramHeaderOffset, f.Segments,
+		"program headers")
+	if e != nil {
+		return fmt.Errorf("Error writing updated program headers: %s", e)
+	}
+	e = moveDynamicSymbols(f, oldAddress, load.VirtualAddress, report)
+	if e != nil {
+		return e
+	}
+	report.logf("Dynamic table moved from offset 0x%08x (VA 0x%08x) to %s\n",
+		oldFileOffset, oldAddress, describeSegment(f, loadIndex))
+	report.addSegment(f, loadIndex, false)
+	return nil
+}
+
+// Updates the value of each _DYNAMIC symbol at the old address, which code
+// may use to find the dynamic table, to the new address.
+func moveDynamicSymbols(f *elf_reader.ELF32File, oldAddress,
+	newAddress uint32, report *Report) error {
+	symbolSize := uint32(binary.Size(&elf_reader.ELF32Symbol{}))
+	for i := range f.Sections {
+		if !f.IsSymbolTable(uint16(i)) {
+			continue
+		}
+		names, e := readSymbolNames(f, uint16(i))
+		if e != nil {
+			continue
+		}
+		for j, name := range names {
+			if string(name) != "_DYNAMIC" {
+				continue
+			}
+			// The value is 4 bytes into the symbol.
+			offset := f.Sections[i].FileOffset + uint32(j)*symbolSize + 4
+			value, e := readELFUint32(f, offset, "symbol")
+			if e != nil {
+				return e
+			}
+			if value != oldAddress {
+				continue
+			}
+			e = writeELFUint32(f, offset, newAddress, "symbol")
+			if e != nil {
+				return e
+			}
+			report.logf("Updated section %d symbol %d (_DYNAMIC) from "+
+				"0x%08x to 0x%08x\n", i, j, oldAddress, newAddress)
+		}
+	}
+	return nil
+}
+
+// Appends the data to the end of the file, in a new readable and writable
+// loadable segment, aligned to the page size, and returns the segment's
+// index. A program header slot freed by a removed segment is used if there is
+// one, and otherwise, the program header table is moved after the data, in
+// the same segment, with room for the new entry. The segment is loaded after
+// every existing one, as with AfterLastLoadAddress, since it must follow any
+// segment just added for the relocated string tables, regardless of the
+// address strategy they used. In ET_EXEC files, the address given by the
+// first loadable segment's mapping is used instead if possible (see
+// firstLoadMirrorAddress).
+func appendWritableSegment(f *elf_reader.ELF32File, data []byte,
+	options *Options, report *Report) (int, error) {
+	programHeaderAlign := options.ProgramHeaderAlign
+	if programHeaderAlign == 0 {
+		programHeaderAlign = 8
+	}
+	for (len(f.Raw) % 8) != 0 {
+		f.Raw = append(f.Raw, 0)
+	}
+	start := uint32(len(f.Raw))
+	size := uint32(len(data))
+	useSlot := report.freed.slots > 0
+	var programHeadersOffset, programHeadersSize uint32
+	if !useSlot {
+		programHeadersOffset = size
+		for ((start + programHeadersOffset) % programHeaderAlign) != 0 {
+			programHeadersOffset++
+		}
+		programHeadersSize = uint32(binary.Size(
+			elf_reader.ELF32ProgramHeader{})) * uint32(len(f.Segments)+1)
+		size = programHeadersOffset + programHeadersSize
+	}
+	address, ok := firstLoadMirrorAddress(f, start, size,
+		loadPageSize(f, report.pageSize))
+	var e error
+	if !ok {
+		address, e = afterLastLoadAddress(f, start, size, report)
+	}
+	if e != nil {
+		return 0, fmt.Errorf("Couldn't choose a VA for the new segment: %s", e)
+	}
+	f.Raw = append(f.Raw, data...)
+	f.Segments = append(f.Segments, elf_reader.ELF32ProgramHeader{
+		Type:           elf_reader.LoadableSegment,
+		FileOffset:     start,
+		VirtualAddress: address,
+		FileSize:       size,
+		MemorySize:     size,
+		Flags:          6, // PF_R | PF_W
+		Align:          loadPageSize(f, report.pageSize),
+	})
+	loadIndex := len(f.Segments) - 1
+	tableSize := uint32(binary.Size(f.Segments))
+	programHeadersFileOffset := f.Header.ProgramHeaderOffset
+	if useSlot {
+		report.freed.slots--
+	} else {
+		programHeadersFileOffset = start + programHeadersOffset
+		for uint32(len(f.Raw)) < (start + size) {
+			f.Raw = append(f.Raw, 0)
+		}
+		// The ELF header's program header table offset is 28 bytes in.
+		e = writeAtELFOffset(f, 28, programHeadersFileOffset, "ELF header")
+		if e != nil {
+			return 0, fmt.Errorf("Failed writing the program header table "+
+				"offset: %s", e)
+		}
+	}
+	for i := range f.Segments {
+		s := &(f.Segments[i])
+		if s.Type != elf_reader.ProgramHeaderSegment {
+			continue
+		}
+		s.FileSize = tableSize
+		s.MemorySize = tableSize
+		if !useSlot {
+			s.FileOffset = programHeadersFileOffset
+			s.VirtualAddress = address + programHeadersOffset
+			s.PhysicalAddress = 0
+			s.Align = programHeaderAlign
+		}
+	}
+	e = writeAtELFOffset(f, programHeadersFileOffset, f.Segments,
+		"program headers")
+	if e != nil {
+		return 0, fmt.Errorf("Error writing updated program headers: %s", e)
+	}
+	e = writeProgramHeaderCount(f)
+	if e != nil {
+		return 0, fmt.Errorf("Failed writing the number of program header "+
+			"entries: %s", e)
+	}
+	e = reparseELF(f)
+	if e != nil {
+		return 0, fmt.Errorf("Error re-parsing ELF file after adding a "+
+			"segment: %s", e)
+	}
+	repaired, e := validateProgramHeaderSegment(f, report)
+	if e != nil {
+		return 0, fmt.Errorf("Invalid program header layout: %s", e)
+	}
+	if repaired {
+		e = reparseELF(f)
+		if e != nil {
+			return 0, fmt.Errorf("Error re-parsing ELF file after repairing "+
+				"the PHDR segment: %s", e)
+		}
+	}
+	return loadIndex, nil
+}
+
+// Returns the address at which the first loadable segment's mapping would
+// load size bytes at the given file offset, and true if a new segment can
+// load them there: f must be an ET_EXEC file, the address must be above the
+// start of every existing loadable segment, so they stay sorted, and the new
+// segment may only share pages with non-executable segments mapping the same
+// file content, since it may override their permissions. Kernels that derive
+// the program header table's address from the first loadable segment expect
+// a relocated table to be loaded this way.
+func firstLoadMirrorAddress(f *elf_reader.ELF32File, offset, size,
+	pageSize uint32) (uint32, bool) {
+	if uint32(f.Header.Type) != 2 {
+		return 0, false
+	}
+	var first *elf_reader.ELF32ProgramHeader
+	for i := range f.Segments {
+		if f.Segments[i].Type != elf_reader.LoadableSegment {
+			continue
+		}
+		if (first == nil) || (f.Segments[i].FileOffset < first.FileOffset) {
+			first = &(f.Segments[i])
+		}
+	}
+	if first == nil {
+		return 0, false
+	}
+	delta := int64(first.VirtualAddress) - int64(first.FileOffset)
+	address := int64(offset) + delta
+	if (address < 0) || ((address + int64(size)) > 0xffffffff) {
+		return 0, false
+	}
+	start := pageStart(uint64(address), pageSize)
+	end := pageEnd(uint64(address)+uint64(size), pageSize)
+	for i := range f.Segments {
+		s := &(f.Segments[i])
+		if s.Type != elf_reader.LoadableSegment {
+			continue
+		}
+		if int64(s.VirtualAddress) > address {
+			return 0, false
+		}
+		segmentStart := pageStart(uint64(s.VirtualAddress), pageSize)
+		segmentEnd := pageEnd(uint64(s.VirtualAddress)+
+			uint64(s.MemorySize), pageSize)
+		if (start >= segmentEnd) || (end <= segmentStart) {
+			continue
+		}
+		// PF_X is 1.
+		if ((int64(s.VirtualAddress) - int64(s.FileOffset)) != delta) ||
+			((s.Flags & 1) != 0) {
+			return 0, false
+		}
+	}
+	return uint32(address), true
+}
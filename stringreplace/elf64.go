@@ -0,0 +1,1278 @@
+package stringreplace
+
+// This file contains support for 64-bit ELF files, which are patched in the
+// same way as 32-bit files: the strings in each string table are replaced by
+// replacedStringTable.doReplacements, the modified tables are overwritten in
+// place or appended to the file (in a new loadable segment, if any of them
+// are loaded into memory), and every known reference to a replaced string is
+// updated: section names, symbol names, the dynamic table's strings and its
+// string table's address and size, and the names and hashes in the version
+// requirements and definitions. The symbol hash tables are then rebuilt for
+// the new symbol names. The elf_reader package only parses 32-bit files, so
+// the headers and the structures referring to strings are read and written
+// here. Some options aren't supported for 64-bit files; see ReplaceELF64.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/yalue/elf_reader"
+)
+
+// The sizes of the structures in a 64-bit ELF file used here.
+const (
+	elf64HeaderSize        = 64
+	elf64ProgramHeaderSize = 56
+	elf64SectionHeaderSize = 64
+	elf64SymbolSize        = 24
+	elf64DynamicEntrySize  = 16
+)
+
+// A section header in a 64-bit ELF file.
+type elf64Section struct {
+	name      uint32
+	kind      uint32
+	flags     uint64
+	address   uint64
+	offset    uint64
+	size      uint64
+	link      uint32
+	info      uint32
+	align     uint64
+	entrySize uint64
+}
+
+// A program header in a 64-bit ELF file.
+type elf64Segment struct {
+	kind            uint32
+	flags           uint32
+	offset          uint64
+	address         uint64
+	physicalAddress uint64
+	fileSize        uint64
+	memorySize      uint64
+	align           uint64
+}
+
+// Holds a 64-bit ELF file's content and headers. The headers are only
+// written back to the content by the functions changing them.
+type elf64File struct {
+	data  []byte
+	order binary.ByteOrder
+	// The e_type field, e.g. 3 for shared objects.
+	fileType uint16
+	// The file offsets of the program and section header tables.
+	segmentsOffset uint64
+	sectionsOffset uint64
+	// The index of the section names table, or 0 if there isn't one.
+	namesIndex uint32
+	segments   []elf64Segment
+	sections   []elf64Section
+}
+
+// Returns true if the data starts with the identification of a 64-bit ELF
+// file.
+func IsELF64File(data []byte) bool {
+	return (len(data) >= 16) && (string(data[0:4]) == "\x7fELF") &&
+		(data[4] == 2)
+}
+
+// Returns an error if the given number of bytes at the given offset don't fit
+// in the file.
+func (f *elf64File) checkRange(offset, size uint64, structure string) error {
+	if (offset > uint64(len(f.data))) ||
+		(size > (uint64(len(f.data)) - offset)) {
+		return fmt.Errorf("The %s extend past the end of the file",
+			structure)
+	}
+	return nil
+}
+
+// Parses the section header at the start of the data.
+func parseELF64Section(h []byte, order binary.ByteOrder) elf64Section {
+	return elf64Section{
+		name:      order.Uint32(h),
+		kind:      order.Uint32(h[4:]),
+		flags:     order.Uint64(h[8:]),
+		address:   order.Uint64(h[16:]),
+		offset:    order.Uint64(h[24:]),
+		size:      order.Uint64(h[32:]),
+		link:      order.Uint32(h[40:]),
+		info:      order.Uint32(h[44:]),
+		align:     order.Uint64(h[48:]),
+		entrySize: order.Uint64(h[56:]),
+	}
+}
+
+// Parses a 64-bit ELF file's headers. The data isn't copied, so changes made
+// through the returned file modify it.
+func parseELF64File(data []byte) (*elf64File, error) {
+	if (len(data) < elf64HeaderSize) || !IsELF64File(data) {
+		return nil, fmt.Errorf("Not a 64-bit ELF file")
+	}
+	// The report describes file offsets using 32 bits.
+	if uint64(len(data)) > 0xffffffff {
+		return nil, fmt.Errorf("64-bit ELF files of 4 GiB or more aren't " +
+			"supported")
+	}
+	f := &elf64File{
+		data: data,
+	}
+	switch data[5] {
+	case 1:
+		f.order = binary.LittleEndian
+	case 2:
+		f.order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("Invalid ELF data encoding %d", data[5])
+	}
+	order := f.order
+	f.fileType = order.Uint16(data[0x10:])
+	f.segmentsOffset = order.Uint64(data[0x20:])
+	f.sectionsOffset = order.Uint64(data[0x28:])
+	segmentSize := order.Uint16(data[0x36:])
+	segmentCount := uint64(order.Uint16(data[0x38:]))
+	sectionSize := order.Uint16(data[0x3a:])
+	sectionCount := uint64(order.Uint16(data[0x3c:]))
+	f.namesIndex = uint32(order.Uint16(data[0x3e:]))
+	// PN_XNUM means the count is in section 0's sh_info, but the count
+	// would then have to be updated there when adding a segment.
+	if segmentCount == 0xffff {
+		return nil, fmt.Errorf("Extended program header counts aren't " +
+			"supported in 64-bit ELF files")
+	}
+	if (segmentCount != 0) && (segmentSize != elf64ProgramHeaderSize) {
+		return nil, fmt.Errorf("Unsupported program header size %d",
+			segmentSize)
+	}
+	e := f.checkRange(f.segmentsOffset, segmentCount*elf64ProgramHeaderSize,
+		"program headers")
+	if e != nil {
+		return nil, e
+	}
+	f.segments = make([]elf64Segment, segmentCount)
+	for i := range f.segments {
+		h := data[f.segmentsOffset+uint64(i)*elf64ProgramHeaderSize:]
+		f.segments[i] = elf64Segment{
+			kind:            order.Uint32(h),
+			flags:           order.Uint32(h[4:]),
+			offset:          order.Uint64(h[8:]),
+			address:         order.Uint64(h[16:]),
+			physicalAddress: order.Uint64(h[24:]),
+			fileSize:        order.Uint64(h[32:]),
+			memorySize:      order.Uint64(h[40:]),
+			align:           order.Uint64(h[48:]),
+		}
+	}
+	if f.sectionsOffset == 0 {
+		f.namesIndex = 0
+		return f, nil
+	}
+	if sectionSize != elf64SectionHeaderSize {
+		return nil, fmt.Errorf("Unsupported section header size %d",
+			sectionSize)
+	}
+	e = f.checkRange(f.sectionsOffset, elf64SectionHeaderSize,
+		"section headers")
+	if e != nil {
+		return nil, e
+	}
+	// With extended section numbering, the number of sections and the index
+	// of the section names table (if it's SHN_XINDEX) are in section 0's
+	// sh_size and sh_link.
+	first := parseELF64Section(data[f.sectionsOffset:], order)
+	if sectionCount == 0 {
+		sectionCount = first.size
+	}
+	if f.namesIndex == 0xffff {
+		f.namesIndex = first.link
+	}
+	if sectionCount > (uint64(len(data)) / elf64SectionHeaderSize) {
+		return nil, fmt.Errorf("Invalid number of sections: %d",
+			sectionCount)
+	}
+	e = f.checkRange(f.sectionsOffset, sectionCount*elf64SectionHeaderSize,
+		"section headers")
+	if e != nil {
+		return nil, e
+	}
+	if uint64(f.namesIndex) >= sectionCount {
+		return nil, fmt.Errorf("Invalid section names table index %d",
+			f.namesIndex)
+	}
+	f.sections = make([]elf64Section, sectionCount)
+	for i := range f.sections {
+		f.sections[i] = parseELF64Section(data[f.sectionHeaderOffset(i):],
+			order)
+		// SHT_NOBITS (8) sections have no content in the file.
+		if (i == 0) || (f.sections[i].kind == 8) {
+			continue
+		}
+		e = f.checkRange(f.sections[i].offset, f.sections[i].size,
+			fmt.Sprintf("contents of section %d", i))
+		if e != nil {
+			return nil, e
+		}
+	}
+	return f, nil
+}
+
+// Returns the file offset of the header of the section with the given index.
+func (f *elf64File) sectionHeaderOffset(index int) uint64 {
+	return f.sectionsOffset + uint64(index)*elf64SectionHeaderSize
+}
+
+// Writes the header of the section with the given index back to the file.
+func (f *elf64File) writeSectionHeader(index int) {
+	s := &(f.sections[index])
+	h := f.data[f.sectionHeaderOffset(index):]
+	order := f.order
+	order.PutUint32(h, s.name)
+	order.PutUint32(h[4:], s.kind)
+	order.PutUint64(h[8:], s.flags)
+	order.PutUint64(h[16:], s.address)
+	order.PutUint64(h[24:], s.offset)
+	order.PutUint64(h[32:], s.size)
+	order.PutUint32(h[40:], s.link)
+	order.PutUint32(h[44:], s.info)
+	order.PutUint64(h[48:], s.align)
+	order.PutUint64(h[56:], s.entrySize)
+}
+
+// Writes the program header table to the given file offset, which must have
+// room for it.
+func (f *elf64File) writeSegments(offset uint64) {
+	order := f.order
+	for i := range f.segments {
+		s := &(f.segments[i])
+		h := f.data[offset+uint64(i)*elf64ProgramHeaderSize:]
+		order.PutUint32(h, s.kind)
+		order.PutUint32(h[4:], s.flags)
+		order.PutUint64(h[8:], s.offset)
+		order.PutUint64(h[16:], s.address)
+		order.PutUint64(h[24:], s.physicalAddress)
+		order.PutUint64(h[32:], s.fileSize)
+		order.PutUint64(h[40:], s.memorySize)
+		order.PutUint64(h[48:], s.align)
+	}
+}
+
+// Returns the content of the section with the given index, which is empty for
+// SHT_NOBITS sections.
+func (f *elf64File) sectionContent(index int) []byte {
+	s := &(f.sections[index])
+	if (index == 0) || (s.kind == 8) {
+		return nil
+	}
+	return f.data[s.offset : s.offset+s.size]
+}
+
+// Returns the name of the section with the given index.
+func (f *elf64File) sectionName(index int) (string, error) {
+	if f.namesIndex == 0 {
+		return "", fmt.Errorf("The file has no section names table")
+	}
+	name, e := elf_reader.ReadStringAtOffset(f.sections[index].name,
+		f.sectionContent(int(f.namesIndex)))
+	if e != nil {
+		return "", fmt.Errorf("Invalid name for section %d: %s", index, e)
+	}
+	return string(name), nil
+}
+
+// Returns true if the section with the given index is a string table
+// (SHT_STRTAB, which is 3).
+func (f *elf64File) isStringTable(index uint32) bool {
+	return (uint64(index) < uint64(len(f.sections))) &&
+		(f.sections[index].kind == 3)
+}
+
+// Returns the index of the loadable segment containing the given range of
+// the file, or -1 if there isn't one.
+func (f *elf64File) containingLoadSegment(offset, size uint64) int {
+	for i := range f.segments {
+		s := &(f.segments[i])
+		// PT_LOAD is 1.
+		if (s.kind == 1) && (offset >= s.offset) &&
+			((offset + size) <= (s.offset + s.fileSize)) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Like loadPageSize, for 64-bit files.
+func (f *elf64File) loadPageSize(minimum uint32) uint32 {
+	toReturn := minimum
+	for i := range f.segments {
+		s := &(f.segments[i])
+		if (s.kind == 1) && (s.align > uint64(toReturn)) &&
+			(s.align <= 0x80000000) {
+			toReturn = uint32(s.align)
+		}
+	}
+	return toReturn
+}
+
+// Returns the end of the highest loadable segment in memory.
+func (f *elf64File) loadSegmentsEnd() uint64 {
+	var toReturn uint64
+	for i := range f.segments {
+		s := &(f.segments[i])
+		if (s.kind == 1) && ((s.address + s.memorySize) > toReturn) {
+			toReturn = s.address + s.memorySize
+		}
+	}
+	return toReturn
+}
+
+// Like overlapsLoadSegment, for 64-bit files.
+func (f *elf64File) overlapsLoadSegment(start, end uint64,
+	pageSize uint32) bool {
+	for i := range f.segments {
+		s := &(f.segments[i])
+		if (s.kind != 1) || (s.memorySize == 0) {
+			continue
+		}
+		if (start < pageEnd(s.address+s.memorySize, pageSize)) &&
+			(end > pageStart(s.address, pageSize)) {
+			return true
+		}
+	}
+	return false
+}
+
+// A field in a 64-bit ELF file holding the offset of a string in a string
+// table.
+type elf64StringField struct {
+	// The field's file offset, and its size: 4 or 8 bytes.
+	offset uint64
+	size   uint64
+	// The index of the string table's section.
+	table uint32
+	// Describes the field, as in ReferenceUpdate.Location.
+	location string
+	// The file offset and description of a SysV hash of the string, which
+	// must match it, or an empty location if there isn't one.
+	hashOffset   uint64
+	hashLocation string
+	// True if the field isn't updated, e.g. a DT_AUDIT entry. The string
+	// mustn't be overwritten, but it can still be replaced by a new one.
+	pinned bool
+}
+
+// Returns the value of the field.
+func (f *elf64File) readField(field *elf64StringField) uint64 {
+	if field.size == 8 {
+		return f.order.Uint64(f.data[field.offset:])
+	}
+	return uint64(f.order.Uint32(f.data[field.offset:]))
+}
+
+// The references to the string tables in a 64-bit ELF file.
+type elf64References struct {
+	fields []elf64StringField
+	// The string tables referred to by the structures whose references are
+	// updated, and those referred to by other sections.
+	known   map[uint32]bool
+	unknown map[uint32]bool
+	// The links from other sections, which aren't updated.
+	unsupported []UnsupportedReference
+}
+
+// Adds the field to the references, after checking that it's in the file
+// and refers to a string table.
+func (r *elf64References) add(f *elf64File, field elf64StringField) error {
+	if !f.isStringTable(field.table) {
+		return fmt.Errorf("The %s refers to section %d, which isn't a string "+
+			"table", field.location, field.table)
+	}
+	e := f.checkRange(field.offset, field.size, field.location)
+	if e != nil {
+		return e
+	}
+	r.fields = append(r.fields, field)
+	return nil
+}
+
+// Returns the offsets referred to in the table with the given index, or nil
+// if anything unknown may refer to it. See canOverwrite.
+func (r *elf64References) referencedOffsets(f *elf64File,
+	table uint32) map[uint32]bool {
+	if r.unknown[table] {
+		return nil
+	}
+	toReturn := make(map[uint32]bool)
+	for i := range r.fields {
+		if r.fields[i].table == table {
+			toReturn[uint32(f.readField(&(r.fields[i])))] = true
+		}
+	}
+	return toReturn
+}
+
+// Returns every reference to a string table in the file. Section names,
+// symbol names, the dynamic table's strings, and the version requirements'
+// and definitions' names are known; tables linked to by sections of other
+// types are recorded as unknown.
+func (f *elf64File) findReferences() (*elf64References, error) {
+	r := &elf64References{
+		known:   make(map[uint32]bool),
+		unknown: make(map[uint32]bool),
+	}
+	var e error
+	if f.namesIndex != 0 {
+		r.known[f.namesIndex] = true
+		for i := range f.sections {
+			e = r.add(f, elf64StringField{
+				offset:   f.sectionHeaderOffset(i),
+				size:     4,
+				table:    f.namesIndex,
+				location: fmt.Sprintf("section %d sh_name", i),
+			})
+			if e != nil {
+				return nil, e
+			}
+		}
+	}
+	for i := range f.sections {
+		s := &(f.sections[i])
+		// Section 0's sh_link holds the extended e_shstrndx, if it's used,
+		// rather than a link.
+		if (i == 0) || !f.isStringTable(s.link) {
+			continue
+		}
+		switch s.kind {
+		// SHT_SYMTAB and SHT_DYNSYM
+		case 2, 11:
+			e = f.findSymbolNames(i, r)
+		// SHT_DYNAMIC
+		case 6:
+			e = f.findDynamicStrings(i, r)
+		case VersionDefinitionSection:
+			e = f.findDefinitionNames(i, r)
+		// SHT_GNU_verneed
+		case 0x6ffffffe:
+			e = f.findRequirementNames(i, r)
+		default:
+			name, _ := f.sectionName(i)
+			r.unknown[s.link] = true
+			r.unsupported = append(r.unsupported, UnsupportedReference{
+				// sh_link is at offset 40 in the section header.
+				FileOffset:   uint32(f.sectionHeaderOffset(i) + 40),
+				SectionIndex: uint16(s.link),
+				Location: fmt.Sprintf("section %d (%s, type 0x%x) sh_link",
+					i, EscapeString(name), s.kind),
+				WholeTable: true,
+			})
+			continue
+		}
+		if e != nil {
+			return nil, fmt.Errorf("Failed reading section %d: %s", i, e)
+		}
+		r.known[s.link] = true
+	}
+	return r, nil
+}
+
+// Adds the st_name field of each symbol in the symbol table with the given
+// index to the references.
+func (f *elf64File) findSymbolNames(index int, r *elf64References) error {
+	s := &(f.sections[index])
+	symbolSize := s.entrySize
+	if symbolSize < elf64SymbolSize {
+		symbolSize = elf64SymbolSize
+	}
+	for i := uint64(0); i < (s.size / symbolSize); i++ {
+		e := r.add(f, elf64StringField{
+			offset: s.offset + i*symbolSize,
+			size:   4,
+			table:  s.link,
+			location: fmt.Sprintf("section %d symbol %d st_name", index,
+				i),
+		})
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// Adds the string-valued entries of the dynamic table in the section with the
+// given index to the references. The entries with tags in
+// unsupportedDynamicStringTags are pinned.
+func (f *elf64File) findDynamicStrings(index int, r *elf64References) error {
+	s := &(f.sections[index])
+	for i := uint64(0); ((i + 1) * elf64DynamicEntrySize) <= s.size; i++ {
+		offset := s.offset + i*elf64DynamicEntrySize
+		tag := f.order.Uint64(f.data[offset:])
+		// DT_NULL ends the table.
+		if tag == 0 {
+			break
+		}
+		if tag > 0xffffffff {
+			continue
+		}
+		dynamicTag := elf_reader.ELF32DynamicTag(tag)
+		name, ok := dynamicStringTagNames[dynamicTag]
+		pinned := false
+		if !ok {
+			name, pinned = unsupportedDynamicStringTags[dynamicTag]
+		}
+		if name == "" {
+			continue
+		}
+		// d_val follows the 8-byte d_tag.
+		e := r.add(f, elf64StringField{
+			offset:   offset + 8,
+			size:     8,
+			table:    s.link,
+			location: fmt.Sprintf("dynamic entry %d %s", i, name),
+			pinned:   pinned,
+		})
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// Calls visit with the file offset of each structure in a chain of version
+// requirements or definitions (or their auxiliary structures) in the section
+// with the given index, starting at the given file offset. The 32-bit field
+// at nextField holds the offset of the following structure, relative to the
+// current one.
+func (f *elf64File) walkVersionChain(index int, offset, count, size,
+	nextField uint64, visit func(i, offset uint64) error) error {
+	s := &(f.sections[index])
+	for i := uint64(0); i < count; i++ {
+		if (offset < s.offset) || (offset > (s.offset + s.size)) ||
+			(size > (s.offset + s.size - offset)) {
+			return fmt.Errorf("Version structure %d is outside of the "+
+				"section", i)
+		}
+		e := visit(i, offset)
+		if e != nil {
+			return e
+		}
+		next := uint64(f.order.Uint32(f.data[offset+nextField:]))
+		if next == 0 {
+			break
+		}
+		offset += next
+	}
+	return nil
+}
+
+// Adds the names in the version requirement section with the given index to
+// the references: vn_file in each 16-byte Elf64_Verneed, and vna_name in each
+// 16-byte Elf64_Vernaux, along with its hash in vna_hash.
+func (f *elf64File) findRequirementNames(index int,
+	r *elf64References) error {
+	s := &(f.sections[index])
+	order := f.order
+	// sh_info holds the number of Elf64_Verneed structures.
+	return f.walkVersionChain(index, s.offset, uint64(s.info), 16, 12,
+		func(i, need uint64) error {
+			e := r.add(f, elf64StringField{
+				offset:   need + 4,
+				size:     4,
+				table:    s.link,
+				location: fmt.Sprintf("verneed %d vn_file", i),
+			})
+			if e != nil {
+				return e
+			}
+			// vn_cnt is at offset 2, and vn_aux at offset 8.
+			return f.walkVersionChain(index,
+				need+uint64(order.Uint32(f.data[need+8:])),
+				uint64(order.Uint16(f.data[need+2:])), 16, 12,
+				func(j, aux uint64) error {
+					return r.add(f, elf64StringField{
+						offset: aux + 8,
+						size:   4,
+						table:  s.link,
+						location: fmt.Sprintf("verneed %d aux %d vna_name",
+							i, j),
+						hashOffset: aux,
+						hashLocation: fmt.Sprintf("verneed %d aux %d "+
+							"vna_hash", i, j),
+					})
+				})
+		})
+}
+
+// Adds the names in the version definition section with the given index to
+// the references: vda_name in each 8-byte Elf64_Verdaux following a 20-byte
+// Elf64_Verdef. The first name of each definition is the version's own, whose
+// hash is in vd_hash.
+func (f *elf64File) findDefinitionNames(index int,
+	r *elf64References) error {
+	s := &(f.sections[index])
+	order := f.order
+	// sh_info holds the number of Elf64_Verdef structures.
+	return f.walkVersionChain(index, s.offset, uint64(s.info), 20, 16,
+		func(i, definition uint64) error {
+			// vd_cnt is at offset 6, and vd_aux at offset 12.
+			return f.walkVersionChain(index,
+				definition+uint64(order.Uint32(f.data[definition+12:])),
+				uint64(order.Uint16(f.data[definition+6:])), 8, 4,
+				func(j, aux uint64) error {
+					field := elf64StringField{
+						offset: aux,
+						size:   4,
+						table:  s.link,
+						location: fmt.Sprintf("verdef %d aux %d vda_name", i,
+							j),
+					}
+					if j == 0 {
+						field.hashOffset = definition + 8
+						field.hashLocation = fmt.Sprintf("verdef %d vd_hash",
+							i)
+					}
+					return r.add(f, field)
+				})
+		})
+}
+
+// Returns an error naming the first option which is set, but isn't supported
+// for 64-bit ELF files.
+func checkELF64Options(options *Options) error {
+	unsupported := []struct {
+		set  bool
+		name string
+	}{
+		{len(options.VersionedRenames) != 0, "VersionedRenames"},
+		{len(options.SymbolStrings) != 0, "SymbolStrings"},
+		{options.addsDynamicEntries(), "AddNeeded, AddSoname, AddRPath, " +
+			"and AddRunPath"},
+		{options.OnlyNeeded, "OnlyNeeded"},
+		{options.SymbolFilter != nil, "SymbolFilter"},
+		{len(options.TreatAsStringTables) != 0, "TreatAsStringTables"},
+		{options.DetectStringTables, "DetectStringTables"},
+		{options.RenameWarningSections || options.RewriteWarningText,
+			"RenameWarningSections and RewriteWarningText"},
+		{options.ExtendLastLoad, "ExtendLastLoad"},
+		{options.ReusePadding, "ReusePadding"},
+		{options.StripNotes, "StripNotes"},
+		{options.ProgramHeadersFirst, "ProgramHeadersFirst"},
+		{options.Hybrid, "Hybrid"},
+		{options.PatchHook != nil, "PatchHook"},
+		{options.Explain, "Explain"},
+	}
+	for _, option := range unsupported {
+		if option.set {
+			return fmt.Errorf("%s can't be used with 64-bit ELF files",
+				option.name)
+		}
+	}
+	return nil
+}
+
+// Returns the string tables in which strings were replaced according to the
+// options, chosen in the same way as processReplacements chooses them in
+// 32-bit files.
+func (f *elf64File) processReplacements(references *elf64References,
+	options *Options, report *Report) ([]replacedStringTable, error) {
+	candidates := make([]replacedStringTable, 0, 4)
+	for i := range f.sections {
+		if !f.isStringTable(uint32(i)) {
+			continue
+		}
+		// A bad name simply won't match any rule's section list.
+		name, _ := f.sectionName(i)
+		if (options.ExcludeSections != nil) &&
+			options.ExcludeSections.MatchString(name) {
+			report.logf("Skipping excluded section %s.\n",
+				EscapeString(name))
+			continue
+		}
+		if !options.AllStringTables && !references.known[uint32(i)] &&
+			!isRequestedSection(options, name) {
+			report.logf("Skipping unreferenced string table %s.\n",
+				EscapeString(name))
+			continue
+		}
+		if !anyRuleApplies(options.Rules, name) {
+			continue
+		}
+		s := &(f.sections[i])
+		if (i > 0xffff) || (s.address > 0xffffffff) {
+			return nil, fmt.Errorf("String table %s can't be patched: "+
+				"section indices above 0xffff and addresses above 4 GiB "+
+				"aren't supported", EscapeString(name))
+		}
+		t := replacedStringTable{
+			oldContent:        f.sectionContent(i),
+			oldFileOffset:     uint32(s.offset),
+			oldVirtualAddress: uint32(s.address),
+			sectionIndex:      uint16(i),
+			sectionName:       name,
+			oldSegmentIndex:   f.containingLoadSegment(s.offset, s.size),
+			newSegmentIndex:   -1,
+			report:            report,
+		}
+		if options.SameSize || options.InPlace {
+			t.referencedOffsets = references.referencedOffsets(f,
+				uint32(i))
+		}
+		candidates = append(candidates, t)
+	}
+	warnMissingRuleSections(options.Rules, candidates, report)
+	for i := range candidates {
+		e := candidates[i].doReplacements(options)
+		if e != nil {
+			return nil, fmt.Errorf("Failed replacing strings in sec. %d: %s",
+				candidates[i].sectionIndex, e)
+		}
+	}
+	e := checkEmptyExpansions(options.Rules, candidates)
+	if e != nil {
+		return nil, e
+	}
+	toReturn := make([]replacedStringTable, 0, 1)
+	for i := range candidates {
+		t := &(candidates[i])
+		if len(t.replacements) == 0 {
+			continue
+		}
+		name := EscapeString(t.sectionName)
+		report.logf("Replaced strings in section %s\n", name)
+		report.emitTable(t, name)
+		toReturn = append(toReturn, *t)
+	}
+	return toReturn, nil
+}
+
+// Like chooseSegmentAddress, for 64-bit files. The mirrored address is only
+// used if it's past every existing loadable segment, since the new segment
+// comes last in the program header table.
+func (f *elf64File) chooseSegmentAddress(offset, size, mirrorAddress uint64,
+	options *Options, report *Report) (uint64, error) {
+	pageSize := f.loadPageSize(report.pageSize)
+	loadEnd := pageEnd(f.loadSegmentsEnd(), pageSize)
+	afterLastLoad := loadEnd + (offset % uint64(pageSize))
+	switch options.AddressStrategy {
+	case MirrorOffsetAddress:
+		if (mirrorAddress >= loadEnd) && ((mirrorAddress % uint64(pageSize)) ==
+			(offset % uint64(pageSize))) {
+			return mirrorAddress, nil
+		}
+		report.logf("VA 0x%x for the new segment is below the end of the "+
+			"existing loadable segments (0x%x). Using VA 0x%x instead.\n",
+			mirrorAddress, loadEnd, afterLastLoad)
+		return afterLastLoad, nil
+	case AfterLastLoadAddress:
+		return afterLastLoad, nil
+	case FixedAddress:
+		address := uint64(options.FixedAddress)
+		// ET_DYN
+		if (f.fileType == 3) && (address < loadEnd) {
+			return 0, fmt.Errorf("Fixed VA 0x%08x is below the end of the "+
+				"existing position-independent layout (0x%x)", address,
+				loadEnd)
+		}
+		if (address % uint64(pageSize)) != (offset % uint64(pageSize)) {
+			return 0, fmt.Errorf("Fixed VA 0x%08x isn't congruent to file "+
+				"offset 0x%08x modulo the page size (0x%x)", address, offset,
+				pageSize)
+		}
+		if f.overlapsLoadSegment(pageStart(address, pageSize),
+			pageEnd(address+size, pageSize), pageSize) {
+			return 0, fmt.Errorf("Fixed VA 0x%08x shares a page with an "+
+				"existing loadable segment", address)
+		}
+		return address, nil
+	}
+	return 0, fmt.Errorf("Invalid address strategy: %s",
+		options.AddressStrategy)
+}
+
+// Writes the new tables to the file. Tables which kept their size in
+// same-size or in-place mode are written over the originals, and the rest are
+// appended to the end of the file. If any of the appended tables are loaded
+// into memory, they're loaded by a new segment, followed by the program
+// header table with an entry for the new segment, as in
+// relocateRemainingTables. The section headers are updated to point to the
+// new tables.
+func (f *elf64File) relocateStringTables(tables []replacedStringTable,
+	options *Options, report *Report) error {
+	var appended []*replacedStringTable
+	loaded := false
+	for i := range tables {
+		t := &(tables[i])
+		if (options.SameSize || options.InPlace) &&
+			(len(t.newContent) == len(t.oldContent)) {
+			// The old content refers to the bytes about to be overwritten,
+			// but it's still needed to describe the replacements.
+			t.oldContent = append([]byte(nil), t.oldContent...)
+			copy(f.data[t.oldFileOffset:], t.newContent)
+			t.newFileOffset = t.oldFileOffset
+			t.newVirtualAddress = t.oldVirtualAddress
+			t.newSegmentIndex = t.oldSegmentIndex
+			report.logf("String table in section %d overwritten in "+
+				"place.\n", t.sectionIndex)
+			continue
+		}
+		if options.SameSize {
+			return fmt.Errorf("Table in section %d changed size from %d to "+
+				"%d bytes", t.sectionIndex, len(t.oldContent),
+				len(t.newContent))
+		}
+		appended = append(appended, t)
+		// SHF_ALLOC is 2.
+		loaded = loaded || ((f.sections[t.sectionIndex].flags & 2) != 0)
+	}
+	if len(appended) == 0 {
+		return nil
+	}
+	for (len(f.data) % 8) != 0 {
+		f.data = append(f.data, 0)
+	}
+	start := uint64(len(f.data))
+	var tablesSize uint64
+	for _, t := range appended {
+		tablesSize += uint64(len(t.newContent))
+	}
+	// The new segment holds the tables, followed by the program header
+	// table with one more entry.
+	programHeaderAlign := uint64(options.ProgramHeaderAlign)
+	if programHeaderAlign == 0 {
+		programHeaderAlign = 8
+	}
+	programHeadersOffset := tablesSize
+	for ((start + programHeadersOffset) % programHeaderAlign) != 0 {
+		programHeadersOffset++
+	}
+	programHeadersSize := uint64(len(f.segments)+1) * elf64ProgramHeaderSize
+	segmentSize := programHeadersOffset + programHeadersSize
+	var address uint64
+	if loaded {
+		var mirror *elf64Section
+		for _, t := range appended {
+			s := &(f.sections[t.sectionIndex])
+			if (mirror == nil) && ((s.flags & 2) != 0) {
+				mirror = s
+			}
+		}
+		var e error
+		address, e = f.chooseSegmentAddress(start, segmentSize,
+			start+(mirror.address-mirror.offset), options, report)
+		if e != nil {
+			return fmt.Errorf("Couldn't choose a VA for the new segment: %s",
+				e)
+		}
+		// The report describes addresses using 32 bits.
+		if (address + segmentSize) > 0xffffffff {
+			return fmt.Errorf("The new segment at VA 0x%x doesn't fit "+
+				"below 4 GiB, which is required for 64-bit files", address)
+		}
+	}
+	for _, t := range appended {
+		s := &(f.sections[t.sectionIndex])
+		t.newFileOffset = uint32(len(f.data))
+		t.newVirtualAddress = uint32(s.address)
+		if loaded && ((s.flags & 2) != 0) {
+			t.newVirtualAddress = uint32(address + (uint64(t.newFileOffset) -
+				start))
+			t.newSegmentIndex = len(f.segments)
+		}
+		f.data = append(f.data, t.newContent...)
+		s.offset = uint64(t.newFileOffset)
+		s.address = uint64(t.newVirtualAddress)
+		s.size = uint64(len(t.newContent))
+		f.writeSectionHeader(int(t.sectionIndex))
+		report.logf("String table in section %d moved to offset 0x%08x.\n",
+			t.sectionIndex, t.newFileOffset)
+	}
+	if !loaded {
+		return nil
+	}
+	segment := elf64Segment{
+		// PT_LOAD, with PF_R.
+		kind:            1,
+		flags:           4,
+		offset:          start,
+		address:         address,
+		physicalAddress: address,
+		fileSize:        segmentSize,
+		memorySize:      segmentSize,
+		align:           uint64(f.loadPageSize(report.pageSize)),
+	}
+	f.segments = append(f.segments, segment)
+	programHeadersFileOffset := start + programHeadersOffset
+	for i := range f.segments {
+		s := &(f.segments[i])
+		// PT_PHDR is 6.
+		if s.kind != 6 {
+			continue
+		}
+		s.offset = programHeadersFileOffset
+		s.address = address + programHeadersOffset
+		s.physicalAddress = s.address
+		s.fileSize = programHeadersSize
+		s.memorySize = programHeadersSize
+		s.align = programHeaderAlign
+	}
+	for uint64(len(f.data)) < (start + segmentSize) {
+		f.data = append(f.data, 0)
+	}
+	f.writeSegments(programHeadersFileOffset)
+	f.segmentsOffset = programHeadersFileOffset
+	f.order.PutUint64(f.data[0x20:], f.segmentsOffset)
+	f.order.PutUint16(f.data[0x38:], uint16(len(f.segments)))
+	report.logf("Added a segment at VA 0x%08x for the string tables.\n",
+		address)
+	report.addSegmentReport(SegmentReport{
+		Index:          len(f.segments) - 1,
+		FileOffset:     uint32(segment.offset),
+		VirtualAddress: uint32(segment.address),
+		FileSize:       uint32(segment.fileSize),
+		MemorySize:     uint32(segment.memorySize),
+		Flags:          segment.flags,
+	})
+	return nil
+}
+
+// Writes the given value to the field, and records the change in the report.
+func (f *elf64File) writeField(field *elf64StringField, original,
+	value uint64, sectionIndex uint16, report *Report) {
+	if field.size == 8 {
+		f.order.PutUint64(f.data[field.offset:], value)
+	} else {
+		f.order.PutUint32(f.data[field.offset:], uint32(value))
+	}
+	report.addReference(ReferenceUpdate{
+		FileOffset:    uint32(field.offset),
+		SectionIndex:  sectionIndex,
+		OriginalValue: uint32(original),
+		NewValue:      uint32(value),
+		Location:      field.location,
+	})
+}
+
+// Updates each field referring to a replaced string to refer to the new one,
+// along with any hash of the string. The pinned fields and the links from
+// unknown sections are added to the report's unsupported references.
+func (f *elf64File) updateStringReferences(tables []replacedStringTable,
+	references *elf64References, report *Report) error {
+	byIndex := make(map[uint32]*replacedStringTable, len(tables))
+	for i := range tables {
+		byIndex[uint32(tables[i].sectionIndex)] = &(tables[i])
+	}
+	unsupported := make(map[uint32][]UnsupportedReference)
+	for _, r := range references.unsupported {
+		unsupported[uint32(r.SectionIndex)] = append(
+			unsupported[uint32(r.SectionIndex)], r)
+	}
+	for i := range references.fields {
+		field := &(references.fields[i])
+		t := byIndex[field.table]
+		if t == nil {
+			continue
+		}
+		value := f.readField(field)
+		if field.pinned {
+			unsupported[field.table] = append(unsupported[field.table],
+				UnsupportedReference{
+					FileOffset:   uint32(field.offset),
+					SectionIndex: t.sectionIndex,
+					StringOffset: uint32(value),
+					Location:     field.location,
+				})
+			continue
+		}
+		index, e := t.findReplacement(value)
+		if e != nil {
+			return fmt.Errorf("Invalid %s: %s", field.location, e)
+		}
+		if index < 0 {
+			continue
+		}
+		r := &(t.replacements[index])
+		f.writeField(field, value, uint64(r.newOffset), t.sectionIndex,
+			report)
+		report.logf("Replaced string reference at offset 0x%08x: %s\n",
+			field.offset, t.showReplacement(index))
+		if field.hashLocation == "" {
+			continue
+		}
+		name, e := elf_reader.ReadStringAtOffset(r.newOffset, t.newContent)
+		if e != nil {
+			return fmt.Errorf("Failed reading new version name: %s", e)
+		}
+		hashField := elf64StringField{
+			offset:   field.hashOffset,
+			size:     4,
+			location: field.hashLocation,
+		}
+		original := f.readField(&hashField)
+		if uint64(sysvHash(name)) != original {
+			f.writeField(&hashField, original, uint64(sysvHash(name)),
+				t.sectionIndex, report)
+		}
+	}
+	for i := range tables {
+		t := &(tables[i])
+		report.addUnsupportedTableReferences(t,
+			unsupported[uint32(t.sectionIndex)])
+	}
+	f.updateDynamicStringTable(byIndex, report)
+	return nil
+}
+
+// Updates the DT_STRTAB and DT_STRSZ entries in each dynamic table whose
+// string table was replaced.
+func (f *elf64File) updateDynamicStringTable(
+	byIndex map[uint32]*replacedStringTable, report *Report) {
+	for i := range f.sections {
+		s := &(f.sections[i])
+		t := byIndex[s.link]
+		// SHT_DYNAMIC is 6.
+		if (i == 0) || (s.kind != 6) || (t == nil) {
+			continue
+		}
+		for j := uint64(0); ((j + 1) * elf64DynamicEntrySize) <= s.size; j++ {
+			offset := s.offset + j*elf64DynamicEntrySize
+			tag := f.order.Uint64(f.data[offset:])
+			if tag == 0 {
+				break
+			}
+			var value uint64
+			switch tag {
+			// DT_STRTAB, which is only updated if the table is loaded.
+			case 5:
+				if (f.sections[t.sectionIndex].flags & 2) == 0 {
+					continue
+				}
+				value = uint64(t.newVirtualAddress)
+			// DT_STRSZ
+			case 10:
+				value = uint64(len(t.newContent))
+			default:
+				continue
+			}
+			field := elf64StringField{
+				offset: offset + 8,
+				size:   8,
+				location: fmt.Sprintf("dynamic entry %d %s", j,
+					dynamicTableTagNames[elf_reader.ELF32DynamicTag(tag)]),
+			}
+			original := f.readField(&field)
+			if original != value {
+				f.writeField(&field, original, value, t.sectionIndex, report)
+			}
+		}
+	}
+}
+
+// Returns the names of the symbols in the symbol table with the given index,
+// read from its (possibly relocated) string table.
+func (f *elf64File) symbolNames(index int) ([][]byte, error) {
+	s := &(f.sections[index])
+	if !f.isStringTable(s.link) {
+		return nil, fmt.Errorf("Symbol table %d isn't linked to a string "+
+			"table", index)
+	}
+	strings := f.sectionContent(int(s.link))
+	symbolSize := s.entrySize
+	if symbolSize < elf64SymbolSize {
+		symbolSize = elf64SymbolSize
+	}
+	toReturn := make([][]byte, s.size/symbolSize)
+	for i := range toReturn {
+		offset := f.order.Uint32(f.data[s.offset+uint64(i)*symbolSize:])
+		name, e := elf_reader.ReadStringAtOffset(offset, strings)
+		if e != nil {
+			return nil, fmt.Errorf("Failed reading symbol %d's name: %s", i,
+				e)
+		}
+		toReturn[i] = name
+	}
+	return toReturn, nil
+}
+
+// Like rebuildHashTables, for 64-bit files, whose GNU hash tables use 64-bit
+// bloom filter words. SysV hash tables with 8-byte entries, used by a few
+// 64-bit architectures, aren't supported.
+func (f *elf64File) rebuildHashTables(report *Report) error {
+	rebuilt := false
+	for i := range f.sections {
+		s := &(f.sections[i])
+		if ((s.kind != sysvHashSection) && (s.kind != gnuHashSection)) ||
+			(uint64(s.link) >= uint64(len(f.sections))) {
+			continue
+		}
+		symbols := &(f.sections[s.link])
+		renamed := false
+		for _, r := range report.References {
+			if (uint64(r.FileOffset) >= symbols.offset) &&
+				(uint64(r.FileOffset) < (symbols.offset + symbols.size)) {
+				renamed = true
+				break
+			}
+		}
+		if !renamed {
+			continue
+		}
+		names, e := f.symbolNames(int(s.link))
+		if e != nil {
+			return e
+		}
+		if s.kind == gnuHashSection {
+			e = rebuildGNUHashContent(f.sectionContent(i), f.order, 64,
+				names)
+		} else if s.entrySize == 8 {
+			e = fmt.Errorf("Hash tables with 8-byte entries aren't " +
+				"supported")
+		} else {
+			e = rebuildSysvHashContent(f.sectionContent(i), f.order, names)
+		}
+		if e != nil {
+			return fmt.Errorf("Failed rebuilding hash table in section %d: "+
+				"%s", i, e)
+		}
+		rebuilt = true
+		report.logf("Rebuilt the hash table in section %d.\n", i)
+	}
+	if !rebuilt {
+		return nil
+	}
+	return f.checkDynamicHashTables()
+}
+
+// Like checkDynamicHashTables, for 64-bit files.
+func (f *elf64File) checkDynamicHashTables() error {
+	for i := range f.sections {
+		s := &(f.sections[i])
+		// SHT_DYNAMIC is 6.
+		if (i == 0) || (s.kind != 6) {
+			continue
+		}
+		for j := uint64(0); ((j + 1) * elf64DynamicEntrySize) <= s.size; j++ {
+			entry := f.data[s.offset+j*elf64DynamicEntrySize:]
+			tag := f.order.Uint64(entry)
+			if tag == 0 {
+				break
+			}
+			// DT_HASH and DT_GNU_HASH
+			var expected uint32
+			switch tag {
+			case 4:
+				expected = sysvHashSection
+			case 0x6ffffef5:
+				expected = gnuHashSection
+			default:
+				continue
+			}
+			address := f.order.Uint64(entry[8:])
+			found := false
+			for k := range f.sections {
+				if (f.sections[k].kind == expected) &&
+					(f.sections[k].address == address) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return fmt.Errorf("The dynamic table's %s entry refers to "+
+					"VA 0x%x, which isn't a hash table section",
+					dynamicTableTagNames[elf_reader.ELF32DynamicTag(tag)],
+					address)
+			}
+		}
+	}
+	return nil
+}
+
+// Parses the given 64-bit ELF file content and replaces strings according to
+// the options, in the same way as Replace does for 32-bit files, which it
+// calls this for. Returns the content of the modified file, and the report
+// describing the changes. The input slice is not modified.
+//
+// Other than the rules, only the options used to choose the strings to
+// replace and how they're written (NotMatching, ExcludeSections,
+// AllStringTables, Encoding, AllowRawBytes, AllowEmptyMatch, CandidateHook,
+// and OnReplace), the options controlling where the tables are placed
+// (SameSize, InPlace, AddressStrategy, FixedAddress, PageSize, and
+// ProgramHeaderAlign), and Strict, DryRun, Logger, and OnEvent are supported.
+// Using any other option is an error. Relocation addends and interpreter
+// paths aren't updated, the report contains no timings, and files whose
+// string tables or new segment would be above 4 GiB can't be patched.
+func ReplaceELF64(input []byte, options Options) ([]byte, *Report, error) {
+	e := checkELF64Options(&options)
+	if e != nil {
+		return nil, nil, e
+	}
+	if len(options.Rules) == 0 {
+		return nil, nil, fmt.Errorf("No replacement rules were provided")
+	}
+	e = options.validateRules()
+	if e != nil {
+		return nil, nil, e
+	}
+	e = ValidatePageSize(options.PageSize)
+	if e != nil {
+		return nil, nil, e
+	}
+	e = ValidateProgramHeaderAlign(options.ProgramHeaderAlign)
+	if e != nil {
+		return nil, nil, e
+	}
+	raw := make([]byte, len(input))
+	copy(raw, input)
+	f, e := parseELF64File(raw)
+	if e != nil {
+		return nil, nil, fmt.Errorf("Failed parsing the input file: %s", e)
+	}
+	// Relocatable objects, executables, and shared objects.
+	if (f.fileType < 1) || (f.fileType > 3) {
+		return nil, nil, fmt.Errorf("ELF files of type %d can't be patched",
+			f.fileType)
+	}
+	report := newReport(&options)
+	references, e := f.findReferences()
+	if e != nil {
+		return nil, nil, e
+	}
+	tables, e := f.processReplacements(references, &options, report)
+	if e != nil {
+		return nil, nil, e
+	}
+	e = f.relocateStringTables(tables, &options, report)
+	if e != nil {
+		return nil, nil, fmt.Errorf("Failed relocating string tables: %s", e)
+	}
+	e = f.updateStringReferences(tables, references, report)
+	if e != nil {
+		return nil, nil, fmt.Errorf("Failed updating string references: %s",
+			e)
+	}
+	e = f.rebuildHashTables(report)
+	if e != nil {
+		return nil, nil, fmt.Errorf("Error rebuilding hash tables: %s", e)
+	}
+	// Make sure the result can still be parsed.
+	f, e = parseELF64File(f.data)
+	if e != nil {
+		return nil, nil, fmt.Errorf("Failed re-parsing the patched file: %s",
+			e)
+	}
+	for i := range tables {
+		t := &(tables[i])
+		name, e := f.sectionName(int(t.sectionIndex))
+		if e != nil {
+			name = fmt.Sprintf("<bad name: %s>", e)
+		}
+		report.addTable(t, EscapeString(name))
+	}
+	if options.Strict && (len(report.Warnings) != 0) {
+		return nil, nil, fmt.Errorf("Strict mode is enabled, but patching "+
+			"produced %d warnings. The first was: %s", len(report.Warnings),
+			report.Warnings[0])
+	}
+	report.recordRestore(input, f.data)
+	if options.DryRun {
+		return nil, report, nil
+	}
+	return f.data, report, nil
+}
@@ -0,0 +1,153 @@
+package stringreplace
+
+// This file contains support for patching ELF images embedded in a larger
+// binary blob, such as a flat firmware image.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/yalue/elf_reader"
+)
+
+// Returns the number of bytes occupied by the ELF image, i.e. the end of the
+// furthest header, section, or segment in the file. Any data after this
+// isn't part of the ELF file.
+func ImageSize(f *elf_reader.ELF32File) uint32 {
+	var toReturn uint64
+	updateEnd := func(start uint32, size uint64) {
+		if (start == 0) && (size == 0) {
+			return
+		}
+		if (uint64(start) + size) > toReturn {
+			toReturn = uint64(start) + size
+		}
+	}
+	updateEnd(0, uint64(binary.Size(&f.Header)))
+	updateEnd(f.Header.ProgramHeaderOffset, uint64(binary.Size(f.Segments)))
+	updateEnd(f.Header.SectionHeaderOffset, uint64(binary.Size(f.Sections)))
+	for i := range f.Sections {
+		// SHT_NOBITS (8) sections don't occupy any file space.
+		if f.Sections[i].Type == 8 {
+			continue
+		}
+		updateEnd(f.Sections[i].FileOffset, uint64(f.Sections[i].Size))
+	}
+	for i := range f.Segments {
+		updateEnd(f.Segments[i].FileOffset, uint64(f.Segments[i].FileSize))
+	}
+	if toReturn > uint64(len(f.Raw)) {
+		return uint32(len(f.Raw))
+	}
+	return uint32(toReturn)
+}
+
+// Returns the offset of the first valid 32-bit ELF image in blob, starting
+// the search at the given offset. Returns -1 if no ELF image is found.
+func FindEmbeddedELF(blob []byte, start int) int {
+	magic := []byte("\x7fELF\x01")
+	var index int
+	for start < len(blob) {
+		index = bytes.Index(blob[start:], magic)
+		if index < 0 {
+			return -1
+		}
+		start += index
+		_, e := ParseELF32File(blob[start:])
+		if e == nil {
+			return start
+		}
+		start++
+	}
+	return -1
+}
+
+// Returns the offsets of all of the 32-bit ELF images in blob, in order.
+// Searching resumes after the end of each image found, so ELF-like data
+// inside an image isn't reported separately.
+func FindAllEmbeddedELF(blob []byte) []int {
+	toReturn := make([]int, 0, 2)
+	start := 0
+	var offset int
+	var size uint32
+	for start < len(blob) {
+		offset = FindEmbeddedELF(blob, start)
+		if offset < 0 {
+			break
+		}
+		toReturn = append(toReturn, offset)
+		f, e := ParseELF32File(blob[offset:])
+		size = 1
+		if e == nil {
+			size = ImageSize(f)
+		}
+		if size == 0 {
+			size = 1
+		}
+		start = offset + int(size)
+	}
+	return toReturn
+}
+
+// Extracts a copy of the ELF image starting at the given offset in blob, and
+// parses it. The blob slice isn't modified. When patching the result, use
+// same-size mode so that it still fits in the blob.
+func ExtractEmbeddedELF(blob []byte, offset int) (*elf_reader.ELF32File,
+	error) {
+	if (offset < 0) || (offset >= len(blob)) {
+		return nil, fmt.Errorf("Invalid embedded ELF offset: %d", offset)
+	}
+	f, e := ParseELF32File(blob[offset:])
+	if e != nil {
+		return nil, fmt.Errorf("Failed parsing ELF at offset 0x%x: %s", offset,
+			e)
+	}
+	// Parse a copy of only the ELF image, so any modifications can't touch
+	// the surrounding data.
+	image := make([]byte, ImageSize(f))
+	copy(image, blob[offset:])
+	f, e = ParseELF32File(image)
+	if e != nil {
+		return nil, fmt.Errorf("Failed parsing ELF at offset 0x%x: %s", offset,
+			e)
+	}
+	return f, nil
+}
+
+// Patches a copy of the ELF image embedded at the given offset in blob, in
+// same-size mode, and returns the patched image.
+func replaceEmbeddedImage(blob []byte, offset int, options Options) ([]byte,
+	*Report, error) {
+	f, e := ExtractEmbeddedELF(blob, offset)
+	if e != nil {
+		return nil, nil, e
+	}
+	options.SameSize = true
+	originalSize := len(f.Raw)
+	report, e := ReplaceStrings(f, &options)
+	if e != nil {
+		return nil, nil, e
+	}
+	if len(f.Raw) != originalSize {
+		return nil, nil, fmt.Errorf("The ELF image size changed from %d to "+
+			"%d bytes", originalSize, len(f.Raw))
+	}
+	return f.Raw, report, nil
+}
+
+// Replaces strings in the ELF image embedded at the given offset in blob,
+// which may also contain other data. The image is patched in same-size mode
+// (regardless of options.SameSize), so the returned copy of blob has the same
+// size as the original, and every byte outside of the ELF image is left
+// untouched. The blob slice itself is not modified.
+func ReplaceEmbedded(blob []byte, offset int, options Options) ([]byte,
+	error) {
+	image, _, e := replaceEmbeddedImage(blob, offset, options)
+	if e != nil {
+		return nil, e
+	}
+	toReturn := make([]byte, len(blob))
+	copy(toReturn, blob)
+	copy(toReturn[offset:], image)
+	return toReturn, nil
+}
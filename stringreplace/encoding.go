@@ -0,0 +1,214 @@
+package stringreplace
+
+// This file contains support for string tables holding text in an encoding
+// other than UTF-8, such as Latin-1 or Shift-JIS in some vendor binaries.
+// Each entry is decoded to UTF-8 before the rules are applied, so that
+// regular expressions such as "é" or "\w" behave predictably, and the result
+// is encoded again before it's written.
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Identifies the encoding of the text in string tables.
+type Encoding int
+
+const (
+	// Strings are matched and written as-is. This is the default.
+	UTF8Encoding Encoding = iota
+	// ISO-8859-1: each byte is the Unicode code point with the same value.
+	Latin1Encoding
+	// Shift-JIS: ASCII and halfwidth katakana are single bytes, and the JIS
+	// X 0208 characters are pairs of bytes, the second of which may be in
+	// the ASCII range.
+	ShiftJISEncoding
+)
+
+// The encodings accepted by ParseEncoding.
+var AllEncodings = []Encoding{UTF8Encoding, Latin1Encoding, ShiftJISEncoding}
+
+// Returns the name of the encoding, as accepted by ParseEncoding.
+func (n Encoding) String() string {
+	switch n {
+	case UTF8Encoding:
+		return "utf-8"
+	case Latin1Encoding:
+		return "latin1"
+	case ShiftJISEncoding:
+		return "shift-jis"
+	}
+	return fmt.Sprintf("<unknown encoding %d>", int(n))
+}
+
+// Parses an encoding name: "utf-8", "latin1", or "shift-jis". Case is
+// ignored, and "utf8", "iso-8859-1", "shift_jis", and "sjis" are also
+// accepted.
+func ParseEncoding(s string) (Encoding, error) {
+	s = strings.ToLower(s)
+	switch s {
+	case "utf8":
+		return UTF8Encoding, nil
+	case "iso-8859-1", "iso8859-1":
+		return Latin1Encoding, nil
+	case "shift_jis", "sjis":
+		return ShiftJISEncoding, nil
+	}
+	for _, n := range AllEncodings {
+		if n.String() == s {
+			return n, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown encoding: %s", s)
+}
+
+// The number of double-byte Shift-JIS characters: 47 lead bytes (0x81-0x9f
+// and 0xe0-0xef), each followed by one of 188 trail bytes (0x40-0xfc, other
+// than 0x7f).
+const shiftJISTableSize = 47 * 188
+
+// The first of the single-byte halfwidth katakana in Shift-JIS (0xa1-0xdf),
+// and the Unicode code point it maps to. The rest follow in order.
+const (
+	firstHalfwidthKatakana     = 0xa1
+	lastHalfwidthKatakana      = 0xdf
+	halfwidthKatakanaCodePoint = 0xff61
+)
+
+// Returns the index of the double-byte Shift-JIS character in shiftJISTable.
+// Returns false if lead and trail aren't a lead byte and trail byte.
+func shiftJISIndex(lead, trail byte) (int, bool) {
+	var row int
+	switch {
+	case (lead >= 0x81) && (lead <= 0x9f):
+		row = int(lead - 0x81)
+	case (lead >= 0xe0) && (lead <= 0xef):
+		row = int(lead-0xe0) + 31
+	default:
+		return 0, false
+	}
+	if (trail < 0x40) || (trail > 0xfc) || (trail == 0x7f) {
+		return 0, false
+	}
+	column := int(trail - 0x40)
+	if trail > 0x7f {
+		column--
+	}
+	return row*188 + column, true
+}
+
+// Maps Unicode code points to double-byte Shift-JIS characters, with the
+// lead byte in the upper 8 bits. Built by shiftJISEncoder on first use.
+var shiftJISCodes map[rune]uint16
+var shiftJISCodesOnce sync.Once
+
+// Returns the map from code points to double-byte Shift-JIS characters.
+func shiftJISEncoder() map[rune]uint16 {
+	shiftJISCodesOnce.Do(func() {
+		shiftJISCodes = make(map[rune]uint16, shiftJISTableSize)
+		for i, c := range shiftJISTable {
+			if c == 0 {
+				continue
+			}
+			lead := 0x81 + i/188
+			if lead > 0x9f {
+				lead += 0xe0 - 0xa0
+			}
+			trail := 0x40 + i%188
+			if trail >= 0x7f {
+				trail++
+			}
+			shiftJISCodes[rune(c)] = uint16(lead<<8 | trail)
+		}
+	})
+	return shiftJISCodes
+}
+
+// Returns the UTF-8 text of the string table entry s. Bytes that aren't part
+// of a valid character in the encoding are decoded as U+FFFD, so a string
+// containing them can't be encoded again.
+func (n Encoding) decode(s string) string {
+	switch n {
+	case Latin1Encoding:
+		var toReturn strings.Builder
+		toReturn.Grow(len(s))
+		for i := 0; i < len(s); i++ {
+			toReturn.WriteRune(rune(s[i]))
+		}
+		return toReturn.String()
+	case ShiftJISEncoding:
+		return decodeShiftJIS(s)
+	}
+	return s
+}
+
+// Returns the UTF-8 text of the Shift-JIS string s.
+func decodeShiftJIS(s string) string {
+	var toReturn strings.Builder
+	toReturn.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 0x80 {
+			toReturn.WriteByte(c)
+			continue
+		}
+		if (c >= firstHalfwidthKatakana) && (c <= lastHalfwidthKatakana) {
+			toReturn.WriteRune(rune(c-firstHalfwidthKatakana) +
+				halfwidthKatakanaCodePoint)
+			continue
+		}
+		if (i + 1) < len(s) {
+			index, ok := shiftJISIndex(c, s[i+1])
+			if ok && (shiftJISTable[index] != 0) {
+				toReturn.WriteRune(rune(shiftJISTable[index]))
+				i++
+				continue
+			}
+		}
+		toReturn.WriteRune(utf8.RuneError)
+	}
+	return toReturn.String()
+}
+
+// Returns the UTF-8 text s in the encoding, to write to a string table.
+// Returns an error if s contains a character the encoding can't represent.
+func (n Encoding) encode(s string) (string, error) {
+	if n == UTF8Encoding {
+		return s, nil
+	}
+	toReturn := make([]byte, 0, len(s))
+	for _, c := range s {
+		if c == utf8.RuneError {
+			return "", fmt.Errorf("The replacement %q isn't valid UTF-8, "+
+				"or the original string isn't valid %s", s, n)
+		}
+		switch {
+		case c < 0x80:
+			toReturn = append(toReturn, byte(c))
+			continue
+		case n == Latin1Encoding:
+			if c <= 0xff {
+				toReturn = append(toReturn, byte(c))
+				continue
+			}
+		case n == ShiftJISEncoding:
+			katakana := c - halfwidthKatakanaCodePoint
+			if (katakana >= 0) && (katakana <= (lastHalfwidthKatakana -
+				firstHalfwidthKatakana)) {
+				toReturn = append(toReturn,
+					byte(katakana+firstHalfwidthKatakana))
+				continue
+			}
+			code, ok := shiftJISEncoder()[c]
+			if ok {
+				toReturn = append(toReturn, byte(code>>8), byte(code))
+				continue
+			}
+		}
+		return "", fmt.Errorf("The replacement %q contains %q, which "+
+			"can't be represented in %s", s, c, n)
+	}
+	return string(toReturn), nil
+}
@@ -0,0 +1,110 @@
+package stringreplace
+
+import (
+	"testing"
+	"unicode/utf8"
+)
+
+func TestShiftJISRoundTrip(t *testing.T) {
+	characters := 0
+	for lead := 0x81; lead <= 0xef; lead++ {
+		for trail := 0x40; trail <= 0xfc; trail++ {
+			original := string([]byte{byte(lead), byte(trail)})
+			index, ok := shiftJISIndex(byte(lead), byte(trail))
+			if !ok || (shiftJISTable[index] == 0) {
+				continue
+			}
+			characters++
+			decoded := ShiftJISEncoding.decode(original)
+			if utf8.RuneCountInString(decoded) != 1 {
+				t.Fatalf("Expected 0x%02x%02x to decode to one character, "+
+					"got %q", lead, trail, decoded)
+			}
+			encoded, e := ShiftJISEncoding.encode(decoded)
+			if e != nil {
+				t.Fatalf("Failed encoding %q: %s", decoded, e)
+			}
+			if encoded != original {
+				t.Fatalf("Expected %q to encode to 0x%02x%02x, got %x",
+					decoded, lead, trail, encoded)
+			}
+		}
+	}
+	// JIS X 0208 has 6879 characters.
+	if characters != 6879 {
+		t.Errorf("Expected 6879 double-byte characters, got %d", characters)
+	}
+}
+
+func TestShiftJISStrings(t *testing.T) {
+	tests := []struct {
+		encoded string
+		decoded string
+	}{
+		{"libc.so.6", "libc.so.6"},
+		{"\x93\xfa\x96\x7b\x8c\xea", "日本語"},
+		// The trail byte of ソ is '\', which must not be treated as ASCII.
+		{"\x83\x5c.so", "ソ.so"},
+		// Halfwidth katakana are single bytes.
+		{"\xb1\xdf", "ｱﾟ"},
+	}
+	for _, test := range tests {
+		decoded := ShiftJISEncoding.decode(test.encoded)
+		if decoded != test.decoded {
+			t.Errorf("Expected %x to decode to %q, got %q", test.encoded,
+				test.decoded, decoded)
+		}
+		encoded, e := ShiftJISEncoding.encode(test.decoded)
+		if e != nil {
+			t.Errorf("Failed encoding %q: %s", test.decoded, e)
+			continue
+		}
+		if encoded != test.encoded {
+			t.Errorf("Expected %q to encode to %x, got %x", test.decoded,
+				test.encoded, encoded)
+		}
+	}
+	// A lead byte without a trail byte, an invalid trail byte, and a byte
+	// that's never valid.
+	for _, invalid := range []string{"a\x93", "\x93\x7f", "\xf5\x40"} {
+		decoded := ShiftJISEncoding.decode(invalid)
+		_, e := ShiftJISEncoding.encode(decoded)
+		if e == nil {
+			t.Errorf("Didn't get an error encoding invalid Shift-JIS %x "+
+				"again", invalid)
+		}
+	}
+	// Neither é nor ¥ (which some mappings assign to 0x5c) is in Shift-JIS.
+	for _, unsupported := range []string{"é", "¥"} {
+		_, e := ShiftJISEncoding.encode(unsupported)
+		if e == nil {
+			t.Errorf("Didn't get an error encoding %q", unsupported)
+		}
+	}
+}
+
+func TestParseEncoding(t *testing.T) {
+	tests := map[string]Encoding{
+		"utf-8":      UTF8Encoding,
+		"UTF8":       UTF8Encoding,
+		"latin1":     Latin1Encoding,
+		"ISO-8859-1": Latin1Encoding,
+		"shift-jis":  ShiftJISEncoding,
+		"Shift_JIS":  ShiftJISEncoding,
+		"sjis":       ShiftJISEncoding,
+	}
+	for name, expected := range tests {
+		n, e := ParseEncoding(name)
+		if e != nil {
+			t.Errorf("Failed parsing encoding %s: %s", name, e)
+			continue
+		}
+		if n != expected {
+			t.Errorf("Expected %s to be %s, got %s", name, expected, n)
+		}
+	}
+	_, e := ParseEncoding("euc-jp")
+	if e == nil {
+		t.Errorf("Didn't get an error for an unsupported encoding")
+	}
+}
@@ -0,0 +1,22 @@
+package stringreplace
+
+import (
+	"strconv"
+	"unicode/utf8"
+)
+
+// Returns s unchanged if it's valid UTF-8 consisting only of printable
+// characters. Otherwise, returns s in Go-quoted form (e.g. "lib\x1b[2J.so"),
+// so that string table content can't inject terminal escape sequences into
+// logs, or be silently altered when encoded as JSON.
+func EscapeString(s string) string {
+	if !utf8.ValidString(s) {
+		return strconv.Quote(s)
+	}
+	for _, r := range s {
+		if !strconv.IsPrint(r) {
+			return strconv.Quote(s)
+		}
+	}
+	return s
+}
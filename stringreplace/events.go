@@ -0,0 +1,68 @@
+package stringreplace
+
+// This file defines the events passed to Options.OnEvent while a file is
+// being patched, allowing callers (such as GUI front-ends) to display progress
+// as it happens rather than waiting for the final Report or parsing the log.
+
+import (
+	"time"
+)
+
+// The types of events passed to an EventHandler.
+const (
+	// A string table containing strings to replace was found. Name and
+	// SectionIndex are set.
+	TableFoundEvent = "table_found"
+	// A string was replaced. Replacement is set.
+	StringReplacedEvent = "string_replaced"
+	// A reference to a string table or string was updated. Reference is set.
+	ReferencePatchedEvent = "reference_patched"
+	// A loadable segment was added or grown. Segment is set.
+	SegmentAddedEvent = "segment_added"
+	// A potential problem was found. Message is set.
+	WarningEvent = "warning"
+	// A phase of patching, as listed in Report.Timings, started. Phase is
+	// set.
+	PhaseStartedEvent = "phase_started"
+	// A phase of patching finished. Phase and Duration are set.
+	PhaseFinishedEvent = "phase_finished"
+)
+
+// Describes a single action taken while patching a file. Only the fields
+// relevant to the Type are set.
+type Event struct {
+	Type         string           `json:"type"`
+	SectionIndex uint16           `json:"section_index,omitempty"`
+	Name         string           `json:"name,omitempty"`
+	Replacement  *Replacement     `json:"replacement,omitempty"`
+	Reference    *ReferenceUpdate `json:"reference,omitempty"`
+	Segment      *SegmentReport   `json:"segment,omitempty"`
+	Message      string           `json:"message,omitempty"`
+	Phase        string           `json:"phase,omitempty"`
+	Duration     time.Duration    `json:"duration_ns,omitempty"`
+}
+
+// Called for each event while a file is patched. Calls are never concurrent,
+// but may come from different goroutines.
+type EventHandler func(event *Event)
+
+// Passes the event to the report's event handler, if there is one. Safe to
+// call concurrently.
+func (r *Report) emit(event *Event) {
+	if r.eventHandler == nil {
+		return
+	}
+	r.eventMutex.Lock()
+	r.eventHandler(event)
+	r.eventMutex.Unlock()
+}
+
+// Passes a PhaseStartedEvent for the named phase to the report's event
+// handler, and returns the phase's start time, to pass to addTiming.
+func (r *Report) startPhase(phase string) time.Time {
+	r.emit(&Event{
+		Type:  PhaseStartedEvent,
+		Phase: phase,
+	})
+	return time.Now()
+}
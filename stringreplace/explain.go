@@ -0,0 +1,368 @@
+package stringreplace
+
+// This file contains the explanations, added to the report when
+// Options.Explain is set, of why each rule did or didn't take effect in each
+// string table.
+
+import (
+	"fmt"
+	"github.com/yalue/elf_reader"
+	"sort"
+	"strings"
+)
+
+// Summarizes what happened when applying a rule to a string table.
+type RuleOutcome string
+
+const (
+	// The rule replaced strings, and references to them were updated.
+	RuleApplied RuleOutcome = "applied"
+	// The rule doesn't apply to the table's section, due to the rule's
+	// Sections or ExcludeSections lists or Options.ExcludeSections.
+	RuleSectionExcluded RuleOutcome = "section excluded"
+	// The table wasn't considered at all, e.g. because nothing this package
+	// updates refers to it.
+	RuleTableSkipped RuleOutcome = "table skipped"
+	// The rule didn't match any string in the table.
+	RuleNoMatch RuleOutcome = "no match"
+	// The rule only matched strings excluded by Options.NotMatching,
+	// OnlyNeeded, or SymbolFilter.
+	RuleFiltered RuleOutcome = "filtered"
+	// The rule matched strings, but they were left unchanged: the
+	// replacement was identical, a later rule changed them back, or a hook
+	// vetoed the replacement.
+	RuleUnchanged RuleOutcome = "unchanged"
+	// The rule replaced strings, but nothing referred to them, so the
+	// replacements have no effect.
+	RuleNoReferences RuleOutcome = "no references"
+	// The rule replaced strings, but they're only referred to by structures
+	// this package doesn't update, such as DT_AUDIT entries.
+	RuleUnsupportedReferences RuleOutcome = "unsupported references"
+)
+
+// Explains why a rule did or didn't take effect in a string table.
+type RuleExplanation struct {
+	// The index of the rule in Options.Rules.
+	Rule int `json:"rule"`
+	// The index and escaped name of the string table's section.
+	SectionIndex uint16      `json:"section_index"`
+	Section      string      `json:"section"`
+	Outcome      RuleOutcome `json:"outcome"`
+	// The number of strings the rule matched and changed, and the number of
+	// references to the changed strings that were updated.
+	Matched    int `json:"matched"`
+	Replaced   int `json:"replaced"`
+	References int `json:"references"`
+	// A human-readable description of the outcome.
+	Detail string `json:"detail"`
+}
+
+// Tracks what a single rule did in a string table, for the explanations.
+type ruleStats struct {
+	// The number of strings the rule matched, and of matching strings that
+	// were skipped by filters before the rules were applied.
+	matched  int
+	filtered int
+	// The original offsets of the strings the rule changed, whose
+	// replacements were kept.
+	changed []uint32
+}
+
+// Records each active rule matching a string that was skipped by the filters
+// before the rules were applied.
+func (t *replacedStringTable) recordFilteredString(rules []Rule,
+	active []bool, s string) {
+	for i := range rules {
+		if active[i] && rules[i].Match.MatchString(s) {
+			t.ruleStats[i].filtered++
+		}
+	}
+}
+
+// Records the string at the given offset as changed by each rule in
+// changedBy, once its replacement is known to be kept.
+func (t *replacedStringTable) recordChangedString(changedBy []bool,
+	offset uint32) {
+	for i, changed := range changedBy {
+		if changed {
+			t.ruleStats[i].changed = append(t.ruleStats[i].changed, offset)
+		}
+	}
+}
+
+// Returns the reason the rule doesn't apply to the section, for
+// RuleSectionExcluded explanations.
+func (r *Rule) exclusionReason(name string) string {
+	if r.otherMachine {
+		return "the rule is limited to files for other machines"
+	}
+	for _, excluded := range r.ExcludeSections {
+		if name == excluded {
+			return "the section is in the rule's exclude list"
+		}
+	}
+	return fmt.Sprintf("the rule is limited to %s",
+		EscapeString(strings.Join(r.Sections, ", ")))
+}
+
+// Adds an explanation for each rule to a table that wasn't processed, if
+// explanations are enabled. The outcome is RuleSectionExcluded for rules
+// that don't apply to the section, and the given outcome otherwise.
+func (r *Report) explainSkippedTable(rules []Rule, sectionIndex uint16,
+	name string, outcome RuleOutcome, detail string) {
+	if !r.explain {
+		return
+	}
+	for i := range rules {
+		explanation := RuleExplanation{
+			Rule:         i,
+			SectionIndex: sectionIndex,
+			Section:      EscapeString(name),
+			Outcome:      outcome,
+			Detail:       detail,
+		}
+		if !rules[i].appliesToSection(name) {
+			explanation.Outcome = RuleSectionExcluded
+			explanation.Detail = rules[i].exclusionReason(name)
+		}
+		r.Explanations = append(r.Explanations, explanation)
+	}
+}
+
+// Adds an explanation for each rule to a table that was processed, if
+// explanations are enabled. Must be called after the references to the
+// table's strings have been updated, if any strings were replaced.
+func (r *Report) explainTable(f *elf_reader.ELF32File, t *replacedStringTable,
+	rules []Rule) {
+	if !r.explain {
+		return
+	}
+	var unsupported map[uint32]string
+	// Count the updated references to each replaced string.
+	references := make(map[uint32]int)
+	for j := range r.References {
+		reference := &(r.References[j])
+		if reference.SectionIndex == t.sectionIndex {
+			references[reference.OriginalValue]++
+		}
+	}
+	for i := range rules {
+		stats := &(t.ruleStats[i])
+		explanation := RuleExplanation{
+			Rule:         i,
+			SectionIndex: t.sectionIndex,
+			Section:      EscapeString(t.sectionName),
+			Matched:      stats.matched,
+			Replaced:     len(stats.changed),
+		}
+		for _, offset := range stats.changed {
+			explanation.References += references[offset]
+		}
+		switch {
+		case !t.ruleApplies(&(rules[i])):
+			explanation.Outcome = RuleSectionExcluded
+			explanation.Detail = rules[i].exclusionReason(t.sectionName)
+		case (stats.matched == 0) && (stats.filtered != 0):
+			explanation.Outcome = RuleFiltered
+			explanation.Detail = fmt.Sprintf("the rule matched %d strings, "+
+				"but they were excluded by -not_matching, -only_needed, or "+
+				"the symbol filters", stats.filtered)
+		case stats.matched == 0:
+			explanation.Outcome = RuleNoMatch
+			explanation.Detail = "the rule didn't match any string"
+		case len(stats.changed) == 0:
+			explanation.Outcome = RuleUnchanged
+			explanation.Detail = fmt.Sprintf("the rule matched %d strings, "+
+				"but none were changed: the replacement was identical, a "+
+				"later rule undid it, or a hook vetoed it", stats.matched)
+		case explanation.References != 0:
+			explanation.Outcome = RuleApplied
+			explanation.Detail = fmt.Sprintf("replaced %d strings, and "+
+				"updated %d references to them", explanation.Replaced,
+				explanation.References)
+		default:
+			if unsupported == nil {
+				unsupported = unsupportedStringReferences(f, t.sectionIndex)
+			}
+			explanation.Outcome = RuleNoReferences
+			explanation.Detail = fmt.Sprintf("replaced %d strings, but "+
+				"nothing refers to them", explanation.Replaced)
+			kinds := make([]string, 0, 2)
+			for _, offset := range stats.changed {
+				kind, ok := unsupported[offset]
+				if ok {
+					kinds = append(kinds, kind)
+				}
+			}
+			if len(kinds) != 0 {
+				explanation.Outcome = RuleUnsupportedReferences
+				explanation.Detail = fmt.Sprintf("replaced %d strings, but "+
+					"they're only referred to by fields this tool doesn't "+
+					"update: %s", explanation.Replaced,
+					strings.Join(kinds, ", "))
+			}
+		}
+		r.Explanations = append(r.Explanations, explanation)
+	}
+}
+
+// Sorts the explanations by section, and then by rule.
+func (r *Report) sortExplanations() {
+	sort.SliceStable(r.Explanations, func(a, b int) bool {
+		x := &(r.Explanations[a])
+		y := &(r.Explanations[b])
+		if x.SectionIndex != y.SectionIndex {
+			return x.SectionIndex < y.SectionIndex
+		}
+		return x.Rule < y.Rule
+	})
+}
+
+// The names of dynamic table tags whose values are string offsets, but which
+// aren't updated.
+var unsupportedDynamicStringTags = map[elf_reader.ELF32DynamicTag]string{
+	0x6ffffefa: "DT_CONFIG",
+	0x6ffffefb: "DT_DEPAUDIT",
+	0x6ffffefc: "DT_AUDIT",
+	0x7ffffffd: "DT_AUXILIARY",
+	0x7fffffff: "DT_FILTER",
+}
+
+// Describes a field referring to a string in a string table which this
+// package doesn't update.
+type UnsupportedReference struct {
+	// The offset of the field in the file.
+	FileOffset uint32 `json:"file_offset"`
+	// The index of the referenced string table's section.
+	SectionIndex uint16 `json:"section_index"`
+	// The offset of the referenced string in the table, and the (escaped)
+	// string itself. Both are omitted for references to the whole table,
+	// such as another section's sh_link.
+	StringOffset uint32 `json:"string_offset,omitempty"`
+	String       string `json:"string,omitempty"`
+	// Describes the field, such as "dynamic entry 12 DT_RUNPATH".
+	Location string `json:"location"`
+	// True if the field refers to the whole table rather than one string.
+	WholeTable bool `json:"whole_table,omitempty"`
+}
+
+// Returns true if the section at the given index is of a type that links to
+// a string table, and whose references to it are updated (or known not to
+// be).
+func isSupportedStringTableUser(f *elf_reader.ELF32File, index uint16) bool {
+	sectionType := uint32(f.Sections[index].Type)
+	// SHT_SYMTAB
+	return f.IsSymbolTable(index) || (sectionType == 2) ||
+		f.IsDynamicSection(index) || f.IsVersionRequirementSection(index) ||
+		(sectionType == VersionDefinitionSection)
+}
+
+// Returns the fields referring to the given string table which this package
+// doesn't update: dynamic entries with the tags in
+// unsupportedDynamicStringTags, and the links from sections of other
+// types. StringOffset and String aren't set.
+func findUnsupportedReferences(f *elf_reader.ELF32File,
+	tableIndex uint16) []UnsupportedReference {
+	toReturn := make([]UnsupportedReference, 0, 4)
+	for i := range f.Sections {
+		section := &(f.Sections[i])
+		// Section 0's sh_link holds the extended e_shstrndx, if it's used,
+		// rather than a link.
+		if (i == 0) || (section.LinkedIndex != uint32(tableIndex)) {
+			continue
+		}
+		if !isSupportedStringTableUser(f, uint16(i)) {
+			name, _ := SectionName(f, uint16(i))
+			toReturn = append(toReturn, UnsupportedReference{
+				// sh_link is at offset 24 in the section header.
+				FileOffset:   getSectionHeaderOffset(f, uint16(i)) + 24,
+				SectionIndex: tableIndex,
+				Location: fmt.Sprintf("section %d (%s, type 0x%x) sh_link",
+					i, EscapeString(name), uint32(section.Type)),
+				WholeTable: true,
+			})
+			continue
+		}
+		if !f.IsDynamicSection(uint16(i)) {
+			continue
+		}
+		entries, e := f.GetDynamicTable(uint16(i))
+		if e != nil {
+			continue
+		}
+		for j, entry := range entries {
+			name, ok := unsupportedDynamicStringTags[entry.Tag]
+			if !ok {
+				continue
+			}
+			toReturn = append(toReturn, UnsupportedReference{
+				// Each entry is 8 bytes, with d_val following d_tag.
+				FileOffset:   section.FileOffset + uint32(j)*8 + 4,
+				SectionIndex: tableIndex,
+				StringOffset: entry.Value,
+				Location:     fmt.Sprintf("dynamic entry %d %s", j, name),
+			})
+		}
+	}
+	return toReturn
+}
+
+// Returns the offsets of strings in the given string table that are referred
+// to by fields this package doesn't update, mapped to a description of the
+// field.
+func unsupportedStringReferences(f *elf_reader.ELF32File,
+	tableIndex uint16) map[uint32]string {
+	toReturn := make(map[uint32]string)
+	for _, r := range findUnsupportedReferences(f, tableIndex) {
+		if !r.WholeTable {
+			toReturn[r.StringOffset] = r.Location
+		}
+	}
+	return toReturn
+}
+
+// Adds each field referring to a string replaced in one of the tables, but
+// which this package doesn't update, to the report, with a warning, along
+// with the links to the tables from sections this package doesn't know how
+// to update. Such fields still refer to the original strings after patching.
+func (r *Report) addUnsupportedReferences(f *elf_reader.ELF32File,
+	tables []replacedStringTable) {
+	for i := range tables {
+		t := &(tables[i])
+		if len(t.replacements) == 0 {
+			continue
+		}
+		r.addUnsupportedTableReferences(t, findUnsupportedReferences(f,
+			t.sectionIndex))
+	}
+}
+
+// Carries out addUnsupportedReferences for a single table, given the fields
+// referring to it which aren't updated, in either a 32-bit or a 64-bit file.
+func (r *Report) addUnsupportedTableReferences(t *replacedStringTable,
+	references []UnsupportedReference) {
+	for _, reference := range references {
+		if reference.WholeTable {
+			r.UnsupportedReferences = append(r.UnsupportedReferences,
+				reference)
+			r.addWarning("%s at offset 0x%08x refers to the string table in "+
+				"section %d, which was changed, but it isn't updated",
+				reference.Location, reference.FileOffset, t.sectionIndex)
+			continue
+		}
+		offset := reference.StringOffset
+		if offset >= uint32(len(t.oldContent)) {
+			continue
+		}
+		_, replaced := t.replacementIndices[offset]
+		if !replaced && !replacedStringContaining(t, offset) {
+			continue
+		}
+		s, _ := elf_reader.ReadStringAtOffset(offset, t.oldContent)
+		reference.String = EscapeString(string(s))
+		r.UnsupportedReferences = append(r.UnsupportedReferences, reference)
+		r.addWarning("%s at offset 0x%08x refers to the replaced string %s, "+
+			"but isn't updated, so it still refers to the original",
+			reference.Location, reference.FileOffset, reference.String)
+	}
+}
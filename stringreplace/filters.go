@@ -0,0 +1,244 @@
+package stringreplace
+
+// This file contains filters restricting which strings may be replaced based
+// on how they're used in the file, rather than on their content.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/yalue/elf_reader"
+	"sort"
+	"strings"
+)
+
+// Returns the offsets of the strings named by DT_NEEDED entries in the
+// dynamic table, keyed by the index of the string table they refer to.
+// Returns an empty map if the file has no dynamic table.
+func findNeededStrings(f *elf_reader.ELF32File) (map[uint16]map[uint32]bool,
+	error) {
+	toReturn := make(map[uint16]map[uint32]bool)
+	for i := range f.Sections {
+		if !f.IsDynamicSection(uint16(i)) {
+			continue
+		}
+		entries, e := f.GetDynamicTable(uint16(i))
+		if e != nil {
+			return nil, fmt.Errorf("Failed parsing dynamic table: %s", e)
+		}
+		tableIndex := uint16(f.Sections[i].LinkedIndex)
+		for _, entry := range entries {
+			// Tag 1 is DT_NEEDED.
+			if entry.Tag != 1 {
+				continue
+			}
+			if toReturn[tableIndex] == nil {
+				toReturn[tableIndex] = make(map[uint32]bool)
+			}
+			toReturn[tableIndex][entry.Value] = true
+		}
+	}
+	return toReturn, nil
+}
+
+// Restricts the symbols whose names may be replaced. Each list holds the
+// accepted values of the corresponding field of the symbol; an empty list
+// accepts any value. Other references to a string used by both matching and
+// non-matching symbols are still updated, but the non-matching symbols keep
+// their original names.
+type SymbolFilter struct {
+	// Accepted bindings (the high 4 bits of st_info), e.g. 1 for STB_GLOBAL.
+	Bindings []uint8
+	// Accepted types (the low 4 bits of st_info), e.g. 2 for STT_FUNC.
+	Types []uint8
+	// Accepted visibilities (the low 2 bits of st_other), e.g. 2 for
+	// STV_HIDDEN.
+	Visibilities []uint8
+	// If true, only undefined symbols (with st_shndx set to SHN_UNDEF) are
+	// accepted: those the file imports from other libraries.
+	OnlyUndefined bool
+	// If true, only exported symbols are accepted: those that are defined
+	// in the file, aren't local, and have default or protected visibility.
+	OnlyExported bool
+	// If not nil, only the symbols at these file offsets are accepted. Used
+	// for versioned renames, which select individual symbols.
+	symbolOffsets map[uint32]bool
+}
+
+// The names accepted by ParseSymbolFilter for each field.
+var symbolBindingNames = map[string]uint8{
+	"local":      0,
+	"global":     1,
+	"weak":       2,
+	"gnu_unique": 10,
+}
+
+var symbolTypeNames = map[string]uint8{
+	"notype":    0,
+	"object":    1,
+	"func":      2,
+	"section":   3,
+	"file":      4,
+	"common":    5,
+	"tls":       6,
+	"gnu_ifunc": 10,
+}
+
+var symbolVisibilityNames = map[string]uint8{
+	"default":   0,
+	"internal":  1,
+	"hidden":    2,
+	"protected": 3,
+}
+
+// Parses a comma-separated list of names from the given map, which may be
+// given in either case, with or without the prefix (e.g. "STB_").
+func parseSymbolAttributeList(list, prefix string,
+	names map[string]uint8) ([]uint8, error) {
+	if list == "" {
+		return nil, nil
+	}
+	var toReturn []uint8
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		name = strings.TrimPrefix(name, strings.ToLower(prefix))
+		value, ok := names[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown symbol attribute %q (expected "+
+				"one of %s)", name, joinAttributeNames(names))
+		}
+		toReturn = append(toReturn, value)
+	}
+	return toReturn, nil
+}
+
+// Returns the names in the map, sorted and separated by commas, for error
+// messages.
+func joinAttributeNames(names map[string]uint8) string {
+	list := make([]string, 0, len(names))
+	for name := range names {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return strings.Join(list, ", ")
+}
+
+// Parses comma-separated lists of symbol bindings (e.g. "global,weak"),
+// types (e.g. "func"), and visibilities (e.g. "hidden"), any of which may be
+// empty. Returns nil if all of them are empty.
+func ParseSymbolFilter(bindings, types, visibilities string) (*SymbolFilter,
+	error) {
+	var toReturn SymbolFilter
+	var e error
+	toReturn.Bindings, e = parseSymbolAttributeList(bindings, "STB_",
+		symbolBindingNames)
+	if e != nil {
+		return nil, e
+	}
+	toReturn.Types, e = parseSymbolAttributeList(types, "STT_",
+		symbolTypeNames)
+	if e != nil {
+		return nil, e
+	}
+	toReturn.Visibilities, e = parseSymbolAttributeList(visibilities, "STV_",
+		symbolVisibilityNames)
+	if e != nil {
+		return nil, e
+	}
+	if (toReturn.Bindings == nil) && (toReturn.Types == nil) &&
+		(toReturn.Visibilities == nil) {
+		return nil, nil
+	}
+	return &toReturn, nil
+}
+
+// Returns true if value is in the list, or the list is empty.
+func attributeAccepted(list []uint8, value uint8) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the symbol starting at the given offset in f.Raw is
+// accepted by the filter. A nil filter accepts every symbol.
+func (s *SymbolFilter) acceptsSymbolAt(f *elf_reader.ELF32File,
+	offset uint32) bool {
+	if s == nil {
+		return true
+	}
+	if (s.symbolOffsets != nil) && !s.symbolOffsets[offset] {
+		return false
+	}
+	// st_info and st_other follow the 4-byte name, value, and size fields,
+	// and are followed by the 2-byte st_shndx.
+	if (uint64(offset) + 16) > uint64(len(f.Raw)) {
+		return false
+	}
+	info := f.Raw[offset+12]
+	other := f.Raw[offset+13]
+	sectionIndex := f.Endianness.Uint16(f.Raw[offset+14:])
+	if s.OnlyUndefined && (sectionIndex != 0) {
+		return false
+	}
+	if s.OnlyExported && ((sectionIndex == 0) || ((info >> 4) == 0) ||
+		((other & 3) == 1) || ((other & 3) == 2)) {
+		return false
+	}
+	return attributeAccepted(s.Bindings, info>>4) &&
+		attributeAccepted(s.Types, info&0xf) &&
+		attributeAccepted(s.Visibilities, other&3)
+}
+
+// Returns the offsets of the strings that may not be replaced because of the
+// symbol filter, keyed by string table index: those used as names only by
+// symbols the filter rejects. If inPlace is true, strings may be overwritten
+// in place, so strings used by any rejected symbol are included.
+func findFilteredSymbolNames(f *elf_reader.ELF32File, filter *SymbolFilter,
+	inPlace bool) map[uint16]map[uint32]bool {
+	accepted := make(map[uint16]map[uint32]bool)
+	rejected := make(map[uint16]map[uint32]bool)
+	symbolSize := uint32(binary.Size(&elf_reader.ELF32Symbol{}))
+	var section *elf_reader.ELF32SectionHeader
+	var tableIndex uint16
+	var offset, name uint32
+	var e error
+	for i := range f.Sections {
+		if !f.IsSymbolTable(uint16(i)) {
+			continue
+		}
+		section = &(f.Sections[i])
+		tableIndex = uint16(section.LinkedIndex)
+		if accepted[tableIndex] == nil {
+			accepted[tableIndex] = make(map[uint32]bool)
+			rejected[tableIndex] = make(map[uint32]bool)
+		}
+		for j := uint32(0); j < (section.Size / symbolSize); j++ {
+			offset = section.FileOffset + j*symbolSize
+			name, e = readELFUint32(f, offset, "symbol")
+			if e != nil {
+				break
+			}
+			if filter.acceptsSymbolAt(f, offset) {
+				accepted[tableIndex][name] = true
+			} else {
+				rejected[tableIndex][name] = true
+			}
+		}
+	}
+	for tableIndex, names := range rejected {
+		if inPlace {
+			continue
+		}
+		for name := range names {
+			if accepted[tableIndex][name] {
+				delete(names, name)
+			}
+		}
+	}
+	return rejected
+}
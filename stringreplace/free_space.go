@@ -0,0 +1,226 @@
+package stringreplace
+
+// This file contains a small allocator over the space freed by removing
+// segments during a run (see stripNoteSegments), which the relocation code
+// uses before growing the file: relocated string tables are placed in freed
+// file ranges that are still loaded, and otherwise, a freed program header
+// slot lets the new segment be added without moving the program header
+// table.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/yalue/elf_reader"
+)
+
+// A range of the file that's no longer used by anything, but is still loaded
+// by a loadable segment.
+type freeRegion struct {
+	segmentIndex   int
+	fileOffset     uint32
+	virtualAddress uint32
+	size           uint32
+}
+
+// Tracks the space freed by removing segments in the current run.
+type freeSpace struct {
+	// The number of unused entries at the end of the program header table,
+	// which is still covered by the PT_PHDR segment's original size.
+	slots   int
+	regions []freeRegion
+}
+
+// Records a freed range of the file, if it's nonempty, loaded, and doesn't
+// overlap a range that was already recorded (e.g. by another note segment
+// covering the same sections).
+func (s *freeSpace) addRegion(f *elf_reader.ELF32File, offset, size uint32) {
+	if size == 0 {
+		return
+	}
+	end := uint64(offset) + uint64(size)
+	for i := range s.regions {
+		r := &(s.regions[i])
+		if (uint64(r.fileOffset) < end) &&
+			(uint64(offset) < (uint64(r.fileOffset) + uint64(r.size))) {
+			return
+		}
+	}
+	index := ContainingLoadSegment(f, offset, size)
+	if index < 0 {
+		return
+	}
+	load := &(f.Segments[index])
+	s.regions = append(s.regions, freeRegion{
+		segmentIndex:   index,
+		fileOffset:     offset,
+		virtualAddress: load.VirtualAddress + (offset - load.FileOffset),
+		size:           size,
+	})
+}
+
+// Returns the location of size bytes taken from the first freed region with
+// enough room, and false if none has enough.
+func (s *freeSpace) allocate(size uint32) (freeRegion, bool) {
+	for i := range s.regions {
+		r := &(s.regions[i])
+		if r.size < size {
+			continue
+		}
+		toReturn := *r
+		toReturn.size = size
+		r.fileOffset += size
+		r.virtualAddress += size
+		r.size -= size
+		return toReturn, true
+	}
+	return freeRegion{}, false
+}
+
+// Returns a copy of the free space, so allocations can be tried without
+// affecting the original.
+func (s *freeSpace) clone() *freeSpace {
+	toReturn := *s
+	toReturn.regions = append([]freeRegion(nil), s.regions...)
+	return &toReturn
+}
+
+// Points each table's section header at its new location, and logs the
+// move, describing the new segment with the given prefix, such as "new". The
+// tables' newFileOffset, newVirtualAddress, and newSegmentIndex fields must
+// already be set. Writes the section headers, but doesn't re-parse f.
+func moveTableSections(f *elf_reader.ELF32File,
+	newTables []replacedStringTable, prefix string, report *Report) error {
+	for i := range newTables {
+		t := &(newTables[i])
+		section := &(f.Sections[t.sectionIndex])
+		section.VirtualAddress = t.newVirtualAddress
+		section.FileOffset = t.newFileOffset
+		section.Size = uint32(len(t.newContent))
+		report.logf("String table in section %d moved from %s to %s %s\n",
+			t.sectionIndex, describeSegment(f, t.oldSegmentIndex), prefix,
+			describeSegment(f, t.newSegmentIndex))
+	}
+	e := writeAtELFOffset(f, f.Header.SectionHeaderOffset, f.Sections,
+		"section headers")
+	if e != nil {
+		return fmt.Errorf("Error updating section headers: %s", e)
+	}
+	return nil
+}
+
+// Attempts to place every new table in the file ranges freed by removed
+// segments, which are already loaded, so no segment needs to change. Returns
+// false without modifying f if the tables don't all fit.
+func placeTablesInFreedRegions(f *elf_reader.ELF32File,
+	newTables []replacedStringTable, report *Report) (bool, error) {
+	if len(report.freed.regions) == 0 {
+		return false, nil
+	}
+	space := report.freed.clone()
+	locations := make([]freeRegion, len(newTables))
+	for i := range newTables {
+		var ok bool
+		locations[i], ok = space.allocate(uint32(len(newTables[i].newContent)))
+		if !ok {
+			report.logf("Not enough freed space for the string table in "+
+				"section %d.\n", newTables[i].sectionIndex)
+			return false, nil
+		}
+	}
+	report.freed = space
+	for i := range newTables {
+		t := &(newTables[i])
+		t.newFileOffset = locations[i].fileOffset
+		t.newVirtualAddress = locations[i].virtualAddress
+		t.newSegmentIndex = locations[i].segmentIndex
+		copy(f.Raw[t.newFileOffset:], t.newContent)
+	}
+	e := moveTableSections(f, newTables, "freed space in", report)
+	if e != nil {
+		return false, e
+	}
+	e = reparseELF(f)
+	if e != nil {
+		return false, fmt.Errorf("Error re-parsing ELF file after placing "+
+			"tables in freed space: %s", e)
+	}
+	return true, nil
+}
+
+// Appends the new tables to the end of the file, in a new loadable segment
+// whose program header takes a slot freed by a removed segment, so the
+// program header table stays where it is. The PT_PHDR segment grows back to
+// cover the new entry.
+func appendTablesInFreeSlot(f *elf_reader.ELF32File,
+	newTables []replacedStringTable, options *Options,
+	report *Report) error {
+	for (len(f.Raw) % 8) != 0 {
+		f.Raw = append(f.Raw, 0)
+	}
+	start := uint32(len(f.Raw))
+	address, e := fileOffsetToVirtualAddress(f, newTables[0].sectionIndex,
+		start)
+	if e != nil {
+		return fmt.Errorf("Couldn't calculate ELF file end VA: %s", e)
+	}
+	var size uint32
+	for i := range newTables {
+		size += uint32(len(newTables[i].newContent))
+	}
+	address, e = chooseSegmentAddress(f, start, size, address, options,
+		report)
+	if e != nil {
+		return fmt.Errorf("Couldn't choose a VA for the new segment: %s", e)
+	}
+	// Unlike the segment holding a relocated program header table, this one
+	// is aligned to the page size, which glibc requires of every PT_LOAD.
+	f.Segments = append(f.Segments, elf_reader.ELF32ProgramHeader{
+		Type:           elf_reader.LoadableSegment,
+		FileOffset:     start,
+		VirtualAddress: address,
+		FileSize:       size,
+		MemorySize:     size,
+		Flags:          4, // PF_R
+		Align:          loadPageSize(f, report.pageSize),
+	})
+	loadIndex := len(f.Segments) - 1
+	report.freed.slots--
+	offset := start
+	for i := range newTables {
+		t := &(newTables[i])
+		t.newFileOffset = offset
+		t.newVirtualAddress = address + (offset - start)
+		t.newSegmentIndex = loadIndex
+		f.Raw = append(f.Raw, t.newContent...)
+		offset += uint32(len(t.newContent))
+	}
+	e = moveTableSections(f, newTables, "new", report)
+	if e != nil {
+		return e
+	}
+	tableSize := uint32(binary.Size(f.Segments))
+	for i := range f.Segments {
+		if f.Segments[i].Type == elf_reader.ProgramHeaderSegment {
+			f.Segments[i].FileSize = tableSize
+			f.Segments[i].MemorySize = tableSize
+		}
+	}
+	e = writeAtELFOffset(f, f.Header.ProgramHeaderOffset, f.Segments,
+		"program headers")
+	if e != nil {
+		return fmt.Errorf("Error writing updated program headers: %s", e)
+	}
+	e = writeProgramHeaderCount(f)
+	if e != nil {
+		return fmt.Errorf("Failed writing the number of program header "+
+			"entries: %s", e)
+	}
+	e = reparseELF(f)
+	if e != nil {
+		return fmt.Errorf("Error re-parsing ELF file after appending new "+
+			"string tables: %s", e)
+	}
+	checkRELROCoverage(f, report)
+	report.addSegment(f, loadIndex, false)
+	return nil
+}
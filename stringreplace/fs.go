@@ -0,0 +1,51 @@
+package stringreplace
+
+import (
+	"bytes"
+	"io/fs"
+)
+
+// The type of function called by ReplaceFS for each 32-bit ELF file it finds.
+// The path is relative to the root of the fs.FS. If processing the file
+// succeeded, output holds the modified file content and e is nil. Otherwise,
+// output is nil and e describes the failure. If this function returns an
+// error, ReplaceFS stops and returns the same error.
+type FSOutputFunc func(path string, output []byte, e error) error
+
+// Returns true if the given content starts with the signature of a 32-bit ELF
+// file.
+func isELF32Content(content []byte) bool {
+	return (len(content) > 4) && bytes.HasPrefix(content, []byte("\x7fELF")) &&
+		(content[4] == 1)
+}
+
+// Walks the tree rooted at root in fsys, replacing strings in every regular
+// 32-bit ELF file using the given options. Other files are ignored. Outputs
+// (or errors) for each ELF file are passed to the output function in the
+// order the files are visited. This never writes to fsys, so it works with
+// read-only filesystems such as zip archives or fstest.MapFS. Returns an error
+// if walking the tree fails or if the output function returns one.
+func ReplaceFS(fsys fs.FS, root string, options Options,
+	output FSOutputFunc) error {
+	return fs.WalkDir(fsys, root, func(path string, d fs.DirEntry,
+		e error) error {
+		if e != nil {
+			return e
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		content, e := fs.ReadFile(fsys, path)
+		if e != nil {
+			return output(path, nil, e)
+		}
+		if !isELF32Content(content) {
+			return nil
+		}
+		result, _, e := Replace(content, options)
+		if e != nil {
+			return output(path, nil, e)
+		}
+		return output(path, result, nil)
+	})
+}
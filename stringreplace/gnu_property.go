@@ -0,0 +1,116 @@
+package stringreplace
+
+// This file contains checks for the PT_GNU_PROPERTY segment, which holds the
+// .note.gnu.property section describing features such as x86 IBT and SHSTK
+// or ARM BTI. The kernel reads the note from the file, and glibc from memory,
+// and both ignore or reject a note that isn't laid out exactly as they
+// expect, silently disabling the features it requests.
+
+import (
+	"fmt"
+	"github.com/yalue/elf_reader"
+)
+
+// The program header type of the PT_GNU_PROPERTY segment.
+const gnuPropertySegment = 0x6474e553
+
+// The note type of the note in the PT_GNU_PROPERTY segment.
+const gnuPropertyNoteType = 5
+
+// Returns a description of each problem with the PT_GNU_PROPERTY segment, or
+// an empty slice if there isn't one or it's valid.
+func gnuPropertyProblems(f *elf_reader.ELF32File) []string {
+	problems := make([]string, 0, 2)
+	index := -1
+	for i := range f.Segments {
+		if uint32(f.Segments[i].Type) != gnuPropertySegment {
+			continue
+		}
+		if index >= 0 {
+			problems = append(problems, fmt.Sprintf("Segments %d and %d are "+
+				"both GNU_PROPERTY segments", index, i))
+			continue
+		}
+		index = i
+		problems = append(problems, checkGNUPropertySegment(f, i)...)
+	}
+	return problems
+}
+
+// Returns a description of each problem with the PT_GNU_PROPERTY segment at
+// the given index.
+func checkGNUPropertySegment(f *elf_reader.ELF32File, index int) []string {
+	s := &(f.Segments[index])
+	problems := make([]string, 0, 2)
+	// glibc ignores the segment unless it's aligned to 4 bytes in 32-bit
+	// files.
+	if s.Align != 4 {
+		problems = append(problems, fmt.Sprintf("The GNU_PROPERTY segment's "+
+			"alignment is 0x%x rather than 4", s.Align))
+	}
+	if ((s.FileOffset % 4) != 0) || ((s.VirtualAddress % 4) != 0) {
+		problems = append(problems, fmt.Sprintf("The GNU_PROPERTY segment's "+
+			"offset (0x%08x) or VA (0x%08x) isn't 4-byte aligned",
+			s.FileOffset, s.VirtualAddress))
+	}
+	if s.FileSize != s.MemorySize {
+		problems = append(problems, fmt.Sprintf("The GNU_PROPERTY segment's "+
+			"file size (0x%x) differs from its memory size (0x%x)",
+			s.FileSize, s.MemorySize))
+	}
+	end := uint64(s.FileOffset) + uint64(s.FileSize)
+	if end > uint64(len(f.Raw)) {
+		return append(problems, "The GNU_PROPERTY segment extends past "+
+			"the end of the file")
+	}
+	loadIndex := ContainingLoadSegment(f, s.FileOffset, s.FileSize)
+	if loadIndex < 0 {
+		problems = append(problems, fmt.Sprintf("The GNU_PROPERTY segment "+
+			"at offset 0x%x isn't contained in a loadable segment",
+			s.FileOffset))
+	} else {
+		load := &(f.Segments[loadIndex])
+		expected := load.VirtualAddress + (s.FileOffset - load.FileOffset)
+		if s.VirtualAddress != expected {
+			problems = append(problems, fmt.Sprintf("The GNU_PROPERTY "+
+				"segment's VA is 0x%08x, but its content is loaded at 0x%08x",
+				s.VirtualAddress, expected))
+		}
+	}
+	// The segment must hold a single note: a 12-byte header, followed by the
+	// name "GNU\0" and the properties.
+	if s.FileSize < 16 {
+		return append(problems, fmt.Sprintf("The GNU_PROPERTY segment is "+
+			"too small (0x%x bytes) to hold a note", s.FileSize))
+	}
+	nameSize, _ := readELFUint32(f, s.FileOffset, "note header")
+	descriptionSize, _ := readELFUint32(f, s.FileOffset+4,
+		"note header")
+	noteType, _ := readELFUint32(f, s.FileOffset+8, "note header")
+	name := f.Raw[s.FileOffset+12 : s.FileOffset+16]
+	if (nameSize != 4) || (string(name) != "GNU\x00") ||
+		(noteType != gnuPropertyNoteType) {
+		problems = append(problems, "The GNU_PROPERTY segment doesn't "+
+			"start with an NT_GNU_PROPERTY_TYPE_0 note named GNU")
+	} else if (16 + uint64(descriptionSize)) > uint64(s.FileSize) {
+		problems = append(problems, fmt.Sprintf("The GNU_PROPERTY note's "+
+			"properties (0x%x bytes) extend past the end of the segment",
+			descriptionSize))
+	}
+	return problems
+}
+
+// Returns an error if the PT_GNU_PROPERTY segment was valid before
+// patching, as indicated by validBefore, but no longer is.
+func checkGNUPropertyPreserved(f *elf_reader.ELF32File,
+	validBefore bool) error {
+	if !validBefore {
+		return nil
+	}
+	problems := gnuPropertyProblems(f)
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("Patching invalidated the GNU_PROPERTY segment: %s",
+		problems[0])
+}
@@ -0,0 +1,244 @@
+package stringreplace
+
+// This file contains support for .gnu.warning.<symbol> sections, whose content
+// the GNU linker prints as a warning whenever the named symbol is referenced.
+// They're tied to the symbol by name alone, so renaming the symbol without
+// renaming the section silently drops the warning.
+
+import (
+	"fmt"
+	"github.com/yalue/elf_reader"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// The prefix of the names of linker warning sections. The rest of the name
+// is the symbol the warning applies to.
+const gnuWarningPrefix = ".gnu.warning."
+
+// Returns true if a symbol table uses the string table in the given section
+// for its names.
+func isSymbolStringTable(f *elf_reader.ELF32File, index uint16) bool {
+	for i := range f.Sections {
+		if f.IsSymbolTable(uint16(i)) &&
+			(f.Sections[i].LinkedIndex == uint32(index)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the symbol names replaced in the given tables, mapping each
+// original name to its replacement.
+func symbolRenames(f *elf_reader.ELF32File,
+	tables []replacedStringTable) map[string]string {
+	toReturn := make(map[string]string)
+	for i := range tables {
+		t := &(tables[i])
+		if (len(t.replacements) == 0) ||
+			!isSymbolStringTable(f, t.sectionIndex) {
+			continue
+		}
+		for _, r := range t.replacements {
+			original, e := elf_reader.ReadStringAtOffset(r.originalOffset,
+				t.oldContent)
+			if e != nil {
+				continue
+			}
+			replacement, e := elf_reader.ReadStringAtOffset(r.newOffset,
+				t.newContent)
+			if e != nil {
+				continue
+			}
+			toReturn[string(original)] = string(replacement)
+		}
+	}
+	return toReturn
+}
+
+// Replaces the string at the given offset in the table with newString,
+// unless it's already being replaced. If options.SameSize is true, the string
+// is overwritten in place, and false is returned if that isn't possible (see
+// canOverwrite). If options.InPlace is true, the string is overwritten in
+// place if possible, and appended otherwise.
+func (t *replacedStringTable) addReplacement(offset uint32, newString string,
+	options *Options) bool {
+	if _, ok := t.replacementIndices[offset]; ok {
+		return true
+	}
+	original, e := elf_reader.ReadStringAtOffset(offset, t.oldContent)
+	if e != nil {
+		return false
+	}
+	if t.newContent == nil {
+		t.newContent = append([]byte(nil), t.oldContent...)
+	}
+	r := replacedString{
+		originalOffset: offset,
+	}
+	if options.SameSize && (len(newString) > len(original)) {
+		return false
+	}
+	overwrite, e := t.canOverwrite(offset, string(original), newString,
+		options)
+	if e != nil {
+		return false
+	}
+	if overwrite {
+		r.newOffset = offset
+		copy(t.newContent[offset:], newString)
+		for i := len(newString); i < len(original); i++ {
+			t.newContent[int(offset)+i] = 0
+		}
+	} else {
+		r.newOffset = uint32(len(t.newContent))
+		t.newContent = append(t.newContent, []byte(newString)...)
+		t.newContent = append(t.newContent, 0)
+	}
+	t.replacements = append(t.replacements, r)
+	sort.Slice(t.replacements, func(a, b int) bool {
+		return t.replacements[a].originalOffset <
+			t.replacements[b].originalOffset
+	})
+	t.replacementIndices = make(map[uint32]int, len(t.replacements))
+	for i, r := range t.replacements {
+		t.replacementIndices[r.originalOffset] = i
+	}
+	return true
+}
+
+// Renames the .gnu.warning.<symbol> section for each renamed symbol, by
+// adding replacements to the section name table. The table is added to the
+// candidates if no rule changed it. Returns the updated candidates.
+func renameWarningSections(f *elf_reader.ELF32File,
+	candidates []replacedStringTable, options *Options,
+	report *Report) ([]replacedStringTable, error) {
+	renames := symbolRenames(f, candidates)
+	if len(renames) == 0 {
+		return candidates, nil
+	}
+	// Without a section name table, no section can be a warning section.
+	namesIndex, ok := SectionNamesTable(f)
+	if !ok {
+		return candidates, nil
+	}
+	var names *replacedStringTable
+	for i := range candidates {
+		if candidates[i].sectionIndex == namesIndex {
+			names = &(candidates[i])
+			break
+		}
+	}
+	for i := range f.Sections {
+		name, e := SectionName(f, uint16(i))
+		if (e != nil) || !strings.HasPrefix(name, gnuWarningPrefix) {
+			continue
+		}
+		newSymbol, ok := renames[strings.TrimPrefix(name, gnuWarningPrefix)]
+		if !ok {
+			continue
+		}
+		if names == nil {
+			tableName, _ := SectionName(f, namesIndex)
+			if (options.ExcludeSections != nil) &&
+				options.ExcludeSections.MatchString(tableName) {
+				report.addWarning("Not renaming section %s, since the "+
+					"section names table is excluded", EscapeString(name))
+				continue
+			}
+			t, e := newReplacedStringTable(f, namesIndex, tableName, report)
+			if e != nil {
+				return nil, e
+			}
+			if options.SameSize || options.InPlace {
+				e = t.findReferencedOffsets(f, options.SymbolFilter)
+				if e != nil {
+					return nil, e
+				}
+			}
+			if report.explain {
+				t.ruleStats = make([]ruleStats, len(options.Rules))
+			}
+			candidates = append(candidates, t)
+			names = &(candidates[len(candidates)-1])
+		}
+		newName := gnuWarningPrefix + newSymbol
+		if !names.addReplacement(f.Sections[i].Name, newName, options) {
+			report.addWarning("Couldn't rename section %s to %s",
+				EscapeString(name), EscapeString(newName))
+			continue
+		}
+		report.logf("Renaming warning section %s to %s.\n",
+			EscapeString(name), EscapeString(newName))
+	}
+	return candidates, nil
+}
+
+// Rewrites the old names of renamed symbols in the text of .gnu.warning
+// sections, after the references to the given replaced tables have been
+// updated. The text is overwritten in place, so a warning is added to the
+// report instead if the new text doesn't fit in the section.
+func rewriteWarningText(f *elf_reader.ELF32File,
+	tables []replacedStringTable, report *Report) error {
+	renames := symbolRenames(f, tables)
+	if len(renames) == 0 {
+		return nil
+	}
+	originals := make(map[string]string)
+	for original, replacement := range renames {
+		originals[replacement] = original
+	}
+	for i := range f.Sections {
+		section := &(f.Sections[i])
+		name, e := SectionName(f, uint16(i))
+		// SHT_NOBITS (8) sections have no text to rewrite.
+		if (e != nil) || !strings.HasPrefix(name, gnuWarningPrefix) ||
+			(section.Type == 8) {
+			continue
+		}
+		// The section may or may not have been renamed already.
+		symbol := strings.TrimPrefix(name, gnuWarningPrefix)
+		original, replacement := symbol, renames[symbol]
+		if replacement == "" {
+			original, replacement = originals[symbol], symbol
+		}
+		if original == "" {
+			continue
+		}
+		content, e := f.GetSectionContent(uint16(i))
+		if e != nil {
+			return fmt.Errorf("Failed reading section %d: %s", i, e)
+		}
+		text := string(content)
+		end := strings.IndexByte(text, 0)
+		if end >= 0 {
+			text = text[:end]
+		}
+		pattern := regexp.MustCompile(`\b` + regexp.QuoteMeta(original) +
+			`\b`)
+		newText := pattern.ReplaceAllLiteralString(text, replacement)
+		if newText == text {
+			continue
+		}
+		// Keep a terminating NUL if the original text had one.
+		limit := len(content)
+		if len(text) < len(content) {
+			limit--
+		}
+		if len(newText) > limit {
+			report.addWarning("The rewritten text of section %s doesn't "+
+				"fit in the section, so it was left unchanged",
+				EscapeString(name))
+			continue
+		}
+		start := int(section.FileOffset)
+		copy(f.Raw[start:], newText)
+		for j := len(newText); j < len(text); j++ {
+			f.Raw[start+j] = 0
+		}
+		report.logf("Rewrote the text of warning section %s: %s\n",
+			EscapeString(name), EscapeString(newText))
+	}
+	return nil
+}
@@ -0,0 +1,457 @@
+package stringreplace
+
+// This file contains code for rebuilding the SysV (.hash) and GNU
+// (.gnu.hash) symbol hash tables after dynamic symbols are renamed, since the
+// dynamic linker finds exported symbols by the hash of their names.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/yalue/elf_reader"
+)
+
+// The section types of the SysV and GNU hash tables.
+const (
+	sysvHashSection = 5
+	gnuHashSection  = 0x6ffffff6
+)
+
+// Computes the SysV ELF hash of a symbol name.
+func sysvHash(name []byte) uint32 {
+	var h, g uint32
+	for _, c := range name {
+		h = (h << 4) + uint32(c)
+		g = h & 0xf0000000
+		if g != 0 {
+			h ^= g >> 24
+		}
+		h &= ^g
+	}
+	return h
+}
+
+// Computes the GNU hash (DJB2) of a symbol name.
+func gnuHash(name []byte) uint32 {
+	h := uint32(5381)
+	for _, c := range name {
+		h = (h << 5) + h + uint32(c)
+	}
+	return h
+}
+
+// Returns the names of the symbols in the given symbol table section, read
+// from its (possibly relocated) string table.
+func readSymbolNames(f *elf_reader.ELF32File,
+	sectionIndex uint16) ([][]byte, error) {
+	section := &(f.Sections[sectionIndex])
+	strings, e := f.GetSectionContent(uint16(section.LinkedIndex))
+	if e != nil {
+		return nil, fmt.Errorf("Failed reading symbol names: %s", e)
+	}
+	symbolSize := uint32(binary.Size(&elf_reader.ELF32Symbol{}))
+	count := section.Size / symbolSize
+	toReturn := make([][]byte, count)
+	var nameOffset uint32
+	for i := uint32(0); i < count; i++ {
+		nameOffset, e = readELFUint32(f, section.FileOffset+i*symbolSize,
+			"symbol")
+		if e != nil {
+			return nil, e
+		}
+		toReturn[i], e = elf_reader.ReadStringAtOffset(nameOffset, strings)
+		if e != nil {
+			return nil, fmt.Errorf("Failed reading symbol %d's name: %s", i,
+				e)
+		}
+	}
+	return toReturn, nil
+}
+
+// Returns the content of a hash table section in f.Raw, so it can be
+// rebuilt in place.
+func hashTableContent(f *elf_reader.ELF32File,
+	section *elf_reader.ELF32SectionHeader) ([]byte, error) {
+	if (uint64(section.FileOffset) + uint64(section.Size)) >
+		uint64(len(f.Raw)) {
+		return nil, fmt.Errorf("The hash table extends past the end of the " +
+			"file")
+	}
+	return f.Raw[section.FileOffset : section.FileOffset+section.Size], nil
+}
+
+// Rebuilds a SysV hash table section in a 32-bit file.
+func rebuildSysvHashSection(f *elf_reader.ELF32File,
+	section *elf_reader.ELF32SectionHeader, names [][]byte) error {
+	content, e := hashTableContent(f, section)
+	if e != nil {
+		return e
+	}
+	return rebuildSysvHashContent(content, f.Endianness, names)
+}
+
+// Rebuilds a GNU hash table section in a 32-bit file.
+func rebuildGNUHashSection(f *elf_reader.ELF32File,
+	section *elf_reader.ELF32SectionHeader, names [][]byte) error {
+	content, e := hashTableContent(f, section)
+	if e != nil {
+		return e
+	}
+	return rebuildGNUHashContent(content, f.Endianness, 32, names)
+}
+
+// Rebuilds a SysV hash table in place, keeping its number of buckets.
+func rebuildSysvHash(words []uint32, names [][]byte) error {
+	if len(words) < 2 {
+		return fmt.Errorf("The hash table is too small")
+	}
+	bucketCount := words[0]
+	chainCount := words[1]
+	if (bucketCount == 0) || (uint64(chainCount) != uint64(len(names))) ||
+		((2 + uint64(bucketCount) + uint64(chainCount)) >
+			uint64(len(words))) {
+		return fmt.Errorf("Invalid hash table header (%d buckets, %d "+
+			"chains, %d symbols)", bucketCount, chainCount, len(names))
+	}
+	buckets := words[2 : 2+bucketCount]
+	chains := words[2+bucketCount : 2+bucketCount+chainCount]
+	for i := range buckets {
+		buckets[i] = 0
+	}
+	for i := range chains {
+		chains[i] = 0
+	}
+	// Symbol 0 is always the undefined symbol, and 0 terminates chains.
+	var b uint32
+	for i := 1; i < len(names); i++ {
+		b = sysvHash(names[i]) % bucketCount
+		chains[i] = buckets[b]
+		buckets[b] = uint32(i)
+	}
+	return nil
+}
+
+// A GNU hash table, split into its parts. Each bloom filter word has as many
+// bits as an address: 32 in 32-bit files, and 64 in 64-bit files.
+type gnuHashTable struct {
+	symbolOffset uint32
+	bloomShift   uint32
+	bloomBits    uint32
+	bloom        []uint64
+	buckets      []uint32
+	chain        []uint32
+}
+
+// Parses the content of a GNU hash table covering the given number of
+// symbols, with bloom filter words of the given number of bits.
+func parseGNUHashTable(content []byte, order binary.ByteOrder,
+	bloomBits uint32, symbolCount int) (*gnuHashTable, error) {
+	if len(content) < 16 {
+		return nil, fmt.Errorf("The GNU hash table is too small")
+	}
+	bucketCount := order.Uint32(content[0:])
+	symbolOffset := order.Uint32(content[4:])
+	bloomSize := order.Uint32(content[8:])
+	bloomBytes := uint64(bloomSize) * uint64(bloomBits/8)
+	chainStart := 16 + bloomBytes + 4*uint64(bucketCount)
+	if (bucketCount == 0) || (bloomSize == 0) ||
+		(uint64(symbolOffset) > uint64(symbolCount)) ||
+		((chainStart + 4*(uint64(symbolCount)-uint64(symbolOffset))) >
+			uint64(len(content))) {
+		return nil, fmt.Errorf("Invalid GNU hash table header (%d buckets, "+
+			"symbol offset %d, bloom size %d, %d symbols)", bucketCount,
+			symbolOffset, bloomSize, symbolCount)
+	}
+	toReturn := &gnuHashTable{
+		symbolOffset: symbolOffset,
+		bloomShift:   order.Uint32(content[12:]),
+		bloomBits:    bloomBits,
+		bloom:        make([]uint64, bloomSize),
+		buckets:      make([]uint32, bucketCount),
+		chain:        make([]uint32, symbolCount-int(symbolOffset)),
+	}
+	for i := range toReturn.bloom {
+		if bloomBits == 64 {
+			toReturn.bloom[i] = order.Uint64(content[16+8*i:])
+		} else {
+			toReturn.bloom[i] = uint64(order.Uint32(content[16+4*i:]))
+		}
+	}
+	words := content[16+bloomBytes:]
+	for i := range toReturn.buckets {
+		toReturn.buckets[i] = order.Uint32(words[4*i:])
+	}
+	words = content[chainStart:]
+	for i := range toReturn.chain {
+		toReturn.chain[i] = order.Uint32(words[4*i:])
+	}
+	return toReturn, nil
+}
+
+// Writes the table back over the content it was parsed from.
+func (t *gnuHashTable) write(content []byte, order binary.ByteOrder) {
+	offset := 16
+	for _, w := range t.bloom {
+		if t.bloomBits == 64 {
+			order.PutUint64(content[offset:], w)
+			offset += 8
+		} else {
+			order.PutUint32(content[offset:], uint32(w))
+			offset += 4
+		}
+	}
+	for _, words := range [][]uint32{t.buckets, t.chain} {
+		for _, w := range words {
+			order.PutUint32(content[offset:], w)
+			offset += 4
+		}
+	}
+}
+
+// Sets the bits for the hash in the bloom filter.
+func (t *gnuHashTable) addToBloom(h uint32) {
+	bits := uint64(t.bloomBits)
+	t.bloom[(uint64(h)/bits)%uint64(len(t.bloom))] |=
+		(1 << (uint64(h) % bits)) | (1 << (uint64(h>>t.bloomShift) % bits))
+}
+
+// Returns true if the bloom filter may contain the hash.
+func (t *gnuHashTable) inBloom(h uint32) bool {
+	bits := uint64(t.bloomBits)
+	word := t.bloom[(uint64(h)/bits)%uint64(len(t.bloom))]
+	return ((word >> (uint64(h) % bits)) &
+		(word >> (uint64(h>>t.bloomShift) % bits)) & 1) != 0
+}
+
+// Rebuilds a GNU hash table, keeping its size. The linker sorts the hashed
+// symbols by bucket, and renaming symbols would change their buckets, but
+// reordering the symbol table would invalidate every reference to a symbol
+// index. Instead, every non-empty bucket points to the first hashed symbol,
+// and all hashed symbols form a single chain, so a lookup in any bucket
+// checks every symbol. The bloom filter is rebuilt to match.
+func (t *gnuHashTable) rebuild(names [][]byte) {
+	for i := range t.bloom {
+		t.bloom[i] = 0
+	}
+	first := uint32(0)
+	if len(t.chain) != 0 {
+		first = t.symbolOffset
+	}
+	for i := range t.buckets {
+		t.buckets[i] = first
+	}
+	var h uint32
+	for i := range t.chain {
+		h = gnuHash(names[uint32(i)+t.symbolOffset])
+		t.addToBloom(h)
+		// The low bit marks the end of a chain.
+		t.chain[i] = h &^ 1
+		if i == (len(t.chain) - 1) {
+			t.chain[i] |= 1
+		}
+	}
+}
+
+// Rebuilds the hash tables for any dynamic symbol table in which a symbol
+// was renamed, according to the references recorded in the report. The
+// tables are rebuilt in place without changing their size, so DT_HASH and
+// DT_GNU_HASH remain valid. Returns an error if a renamed symbol can't be
+// looked up in a rebuilt table, or if the dynamic table refers to a hash
+// table that isn't one of the rebuilt sections.
+func rebuildHashTables(f *elf_reader.ELF32File, report *Report) error {
+	var section, symbols *elf_reader.ELF32SectionHeader
+	var renamed, rebuilt bool
+	for i := range f.Sections {
+		section = &(f.Sections[i])
+		if (section.Type != sysvHashSection) &&
+			(section.Type != gnuHashSection) {
+			continue
+		}
+		if !f.IsSymbolTable(uint16(section.LinkedIndex)) {
+			continue
+		}
+		symbols = &(f.Sections[section.LinkedIndex])
+		renamed = false
+		for _, r := range report.References {
+			if (r.FileOffset >= symbols.FileOffset) &&
+				(r.FileOffset < (symbols.FileOffset + symbols.Size)) {
+				renamed = true
+				break
+			}
+		}
+		if !renamed {
+			continue
+		}
+		names, e := readSymbolNames(f, uint16(section.LinkedIndex))
+		if e != nil {
+			return e
+		}
+		if section.Type == sysvHashSection {
+			e = rebuildSysvHashSection(f, section, names)
+		} else {
+			e = rebuildGNUHashSection(f, section, names)
+		}
+		if e != nil {
+			return fmt.Errorf("Failed rebuilding hash table in section %d: "+
+				"%s", i, e)
+		}
+		rebuilt = true
+		report.logf("Rebuilt the hash table in section %d.\n", i)
+	}
+	if !rebuilt {
+		return nil
+	}
+	return checkDynamicHashTables(f)
+}
+
+// Returns the index of the symbol with the given name found by looking it up
+// in a SysV hash table the way the dynamic linker does, or 0 if the lookup
+// fails. The table must have been validated by rebuildSysvHash.
+func lookupSysvHash(words []uint32, names [][]byte, name []byte) uint32 {
+	bucketCount := words[0]
+	chains := words[2+bucketCount:]
+	i := words[2+(sysvHash(name)%bucketCount)]
+	// A chain longer than the symbol table must contain a loop.
+	for steps := 0; (i != 0) && (steps < len(names)); steps++ {
+		if i >= uint32(len(names)) {
+			return 0
+		}
+		if string(names[i]) == string(name) {
+			return i
+		}
+		i = chains[i]
+	}
+	return 0
+}
+
+// Like lookupSysvHash, but for a GNU hash table. The bloom filter is checked
+// first, as the dynamic linker skips the buckets if it rejects the name.
+func (t *gnuHashTable) lookup(names [][]byte, name []byte) uint32 {
+	h := gnuHash(name)
+	if !t.inBloom(h) {
+		return 0
+	}
+	i := t.buckets[h%uint32(len(t.buckets))]
+	if (i == 0) || (i < t.symbolOffset) {
+		return 0
+	}
+	for ; i < uint32(len(names)); i++ {
+		entry := t.chain[i-t.symbolOffset]
+		if (((entry ^ h) >> 1) == 0) && (string(names[i]) == string(name)) {
+			return i
+		}
+		if (entry & 1) != 0 {
+			break
+		}
+	}
+	return 0
+}
+
+// Returns an error if a named symbol, from the first one in a hash table,
+// can't be found by looking up its name, e.g. because it's shadowed by an
+// earlier symbol with the same name.
+func checkHashLookups(names [][]byte, first int,
+	lookup func(name []byte) uint32) error {
+	var found uint32
+	for i := first; i < len(names); i++ {
+		if len(names[i]) == 0 {
+			continue
+		}
+		found = lookup(names[i])
+		// Duplicate names are only reachable through the first, so it's
+		// enough for the lookup to find a symbol with the same name.
+		if (found == 0) || (string(names[found]) != string(names[i])) {
+			return fmt.Errorf("Symbol %d (%s) can't be looked up", i,
+				EscapeString(string(names[i])))
+		}
+	}
+	return nil
+}
+
+// Rebuilds the content of a SysV hash table for the given symbol names,
+// returning an error if the rebuilt table is invalid.
+func rebuildSysvHashContent(content []byte, order binary.ByteOrder,
+	names [][]byte) error {
+	words := make([]uint32, len(content)/4)
+	for i := range words {
+		words[i] = order.Uint32(content[4*i:])
+	}
+	e := rebuildSysvHash(words, names)
+	if e != nil {
+		return e
+	}
+	e = checkHashLookups(names, 1, func(name []byte) uint32 {
+		return lookupSysvHash(words, names, name)
+	})
+	if e != nil {
+		return fmt.Errorf("The rebuilt hash table is invalid: %s", e)
+	}
+	for i, w := range words {
+		order.PutUint32(content[4*i:], w)
+	}
+	return nil
+}
+
+// Like rebuildSysvHashContent, but for a GNU hash table with bloom filter
+// words of the given number of bits.
+func rebuildGNUHashContent(content []byte, order binary.ByteOrder,
+	bloomBits uint32, names [][]byte) error {
+	t, e := parseGNUHashTable(content, order, bloomBits, len(names))
+	if e != nil {
+		return e
+	}
+	t.rebuild(names)
+	e = checkHashLookups(names, int(t.symbolOffset),
+		func(name []byte) uint32 {
+			return t.lookup(names, name)
+		})
+	if e != nil {
+		return fmt.Errorf("The rebuilt GNU hash table is invalid: %s", e)
+	}
+	t.write(content, order)
+	return nil
+}
+
+// Returns an error if the DT_HASH or DT_GNU_HASH entry in the dynamic table
+// doesn't point to a hash table section of the matching type. The dynamic
+// linker only uses the tables the dynamic table points to, so a renamed
+// symbol can't be found if one of them isn't a section that was rebuilt.
+func checkDynamicHashTables(f *elf_reader.ELF32File) error {
+	for i := range f.Sections {
+		if !f.IsDynamicSection(uint16(i)) {
+			continue
+		}
+		entries, e := f.GetDynamicTable(uint16(i))
+		if e != nil {
+			return fmt.Errorf("Failed parsing dynamic table: %s", e)
+		}
+		for _, entry := range entries {
+			var sectionType uint32
+			// DT_HASH is 4, and DT_GNU_HASH is 0x6ffffef5.
+			switch entry.Tag {
+			case 4:
+				sectionType = sysvHashSection
+			case 0x6ffffef5:
+				sectionType = gnuHashSection
+			default:
+				continue
+			}
+			found := false
+			for j := range f.Sections {
+				section := &(f.Sections[j])
+				if (uint32(section.Type) == sectionType) &&
+					(section.VirtualAddress == entry.Value) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return fmt.Errorf("%s points to 0x%08x, which isn't the "+
+					"address of a hash table section, so it couldn't be "+
+					"rebuilt for the renamed symbols",
+					describeDynamicPointerTag(entry.Tag), entry.Value)
+			}
+		}
+		break
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package stringreplace
+
+// This file contains the optional callbacks that let callers apply their own
+// policies to the replacement process, without modifying this package.
+
+import (
+	"fmt"
+	"github.com/yalue/elf_reader"
+)
+
+// Describes a string that the rules would replace, passed to
+// Options.CandidateHook before the replacement is made.
+type Candidate struct {
+	// The index of the string table's section.
+	SectionIndex uint16
+	// The offset of the string in the original string table.
+	Offset uint32
+	// The original string.
+	Original string
+	// The string produced by the rules. The hook may change this to override
+	// the replacement.
+	Replacement string
+}
+
+// Called for each string that the rules would replace. The hook may modify
+// c.Replacement, and returns false to veto the replacement, leaving the
+// string unchanged. Candidates in different string tables may be passed to
+// the hook concurrently, so it must be safe for concurrent use.
+type CandidateHook func(c *Candidate) bool
+
+// Called with the name of the section (or, for Mach-O and PE files, the load
+// command or import directory) containing each string the rules would
+// replace, along with the original and replacement strings. Returns the
+// string to use instead, and false to reject the replacement, leaving the
+// string unchanged. Like CandidateHook, this may be called concurrently.
+type ReplaceCallback func(section, old, new string) (string, bool)
+
+// Called after all references have been updated, with the report describing
+// every change that was made. The hook may modify f.Raw, e.g. to patch
+// additional bytes, and f is re-parsed after it returns. In same-size mode,
+// the hook must not change the size of f.Raw. If the hook returns an error,
+// ReplaceStrings fails.
+type PatchHook func(f *elf_reader.ELF32File, report *Report) error
+
+// Returns the final string to use in place of original, after consulting the
+// options' CandidateHook and then their OnReplace callback, or original if
+// either vetoed the replacement.
+func applyReplacementHooks(options *Options, report *Report,
+	sectionIndex uint16, sectionName string, offset uint32, original,
+	replacement string) string {
+	replacement = applyCandidateHook(options.CandidateHook, report,
+		sectionIndex, offset, original, replacement)
+	if replacement == original {
+		return original
+	}
+	return applyReplaceCallback(options, sectionName, original, replacement)
+}
+
+// Returns the string to use in place of original according to the options'
+// OnReplace callback, or original if the callback rejected the replacement.
+// Returns replacement if there's no callback.
+func applyReplaceCallback(options *Options, sectionName, original,
+	replacement string) string {
+	if options.OnReplace == nil {
+		return replacement
+	}
+	replacement, ok := options.OnReplace(sectionName, original, replacement)
+	if !ok {
+		options.logf("Replacement of %q in %s rejected.\n", original,
+			EscapeString(sectionName))
+		return original
+	}
+	return replacement
+}
+
+// Returns the final string to use in place of original, after consulting the
+// hook, or original if the hook vetoed the replacement.
+func applyCandidateHook(hook CandidateHook, report *Report, sectionIndex uint16,
+	offset uint32, original, replacement string) string {
+	if hook == nil {
+		return replacement
+	}
+	c := Candidate{
+		SectionIndex: sectionIndex,
+		Offset:       offset,
+		Original:     original,
+		Replacement:  replacement,
+	}
+	if !hook(&c) {
+		report.logf("Replacement of %q in section %d vetoed.\n", original,
+			sectionIndex)
+		return original
+	}
+	return c.Replacement
+}
+
+// Runs the options' PatchHook, if there is one, and re-parses f afterwards.
+func runPatchHook(f *elf_reader.ELF32File, report *Report,
+	options *Options) error {
+	if options.PatchHook == nil {
+		return nil
+	}
+	originalSize := len(f.Raw)
+	e := options.PatchHook(f, report)
+	if e != nil {
+		return fmt.Errorf("Patch hook failed: %s", e)
+	}
+	if options.SameSize && (len(f.Raw) != originalSize) {
+		return fmt.Errorf("The patch hook changed the file size from %d to "+
+			"%d bytes in same-size mode", originalSize, len(f.Raw))
+	}
+	e = reparseELF(f)
+	if e != nil {
+		return fmt.Errorf("Failed re-parsing ELF after the patch hook: %s", e)
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package stringreplace
+
+// This file contains the relocation step for Options.InPlace, used for
+// firmware images and statically linked binaries whose loaders expect a fixed
+// layout. Replacements that fit have already overwritten the originals (see
+// doReplacements), so any table that kept its size is written back over the
+// original, and only the tables containing a longer replacement go through
+// the usual append-and-relocate path.
+//
+// A string can only be overwritten if that doesn't change any other string
+// something refers to. Linkers share suffixes between strings, so e.g. a
+// DT_NEEDED entry naming "util.so" may point into the middle of the
+// "libcorpus_util.so" SONAME, and replacing the SONAME in place would rename
+// the dependency as well. If anything this package doesn't know about may
+// refer to a table, any string in it may be shared, so none are overwritten.
+
+import (
+	"fmt"
+	"github.com/yalue/elf_reader"
+)
+
+// Records the offsets referred to in the table, and in the tables it's an
+// alias of, for canOverwrite. If anything this package doesn't know about may
+// refer to one of them, referencedOffsets is left nil, so canOverwrite treats
+// every string as possibly shared.
+func (t *replacedStringTable) findReferencedOffsets(f *elf_reader.ELF32File,
+	filter *SymbolFilter) error {
+	offsets := make(map[uint32]bool)
+	sections := append([]uint16{t.sectionIndex}, t.aliases...)
+	for _, index := range sections {
+		references, ok, e := findTableReferences(f, index, filter)
+		if e != nil {
+			return fmt.Errorf("Failed finding references to section %d: %s",
+				index, e)
+		}
+		if !ok {
+			return nil
+		}
+		for offset := range references.updated {
+			offsets[offset] = true
+		}
+		for offset := range references.pinned {
+			offsets[offset] = true
+		}
+	}
+	t.referencedOffsets = offsets
+	return nil
+}
+
+// Returns the offset of a referenced string sharing the bytes of the string
+// at the given offset, which would change if oldString were overwritten with
+// newString, padded with null bytes. Returns false if there isn't one.
+func (t *replacedStringTable) changedSharedString(offset uint32, oldString,
+	newString string) (uint32, bool) {
+	for i := 1; i < len(oldString); i++ {
+		if !t.referencedOffsets[offset+uint32(i)] {
+			continue
+		}
+		// Past the end of newString, the shared string becomes empty.
+		if (i >= len(newString)) || (newString[i:] != oldString[i:]) {
+			return offset + uint32(i), true
+		}
+	}
+	return 0, false
+}
+
+// Returns true if the replacement for the string at the given offset should
+// overwrite the original, padded with null bytes, which requires
+// options.SameSize or options.InPlace, and a replacement that fits. It also
+// mustn't change another string sharing the original's bytes, which can't be
+// ruled out if the table's references are unknown (referencedOffsets is nil).
+// In either case, an error is returned if options.SameSize is set, and
+// otherwise, false is returned so the replacement is appended.
+func (t *replacedStringTable) canOverwrite(offset uint32, oldString,
+	newString string, options *Options) (bool, error) {
+	if !(options.SameSize || options.InPlace) ||
+		(len(newString) > len(oldString)) {
+		return false, nil
+	}
+	if t.referencedOffsets == nil {
+		if options.SameSize {
+			return false, fmt.Errorf("Can't replace %q with %q in place, "+
+				"since section %d may be referred to by something unknown, "+
+				"which could share the string's bytes", oldString, newString,
+				t.sectionIndex)
+		}
+		t.report.logf("Appending the replacement for %s at offset %d in "+
+			"section %d, since the section may be referred to by something "+
+			"unknown, which could share the string's bytes.\n",
+			EscapeString(oldString), offset, t.sectionIndex)
+		return false, nil
+	}
+	shared, changed := t.changedSharedString(offset, oldString, newString)
+	if !changed {
+		return true, nil
+	}
+	if options.SameSize {
+		return false, fmt.Errorf("Replacing %q with %q in place would "+
+			"change the string %q at offset %d, which shares its bytes",
+			oldString, newString, oldString[shared-offset:], shared)
+	}
+	t.report.logf("Appending the replacement for %s at offset %d in "+
+		"section %d, since overwriting it would change the string at "+
+		"offset %d.\n", EscapeString(oldString), offset, t.sectionIndex,
+		shared)
+	return false, nil
+}
+
+// Carries out relocateStringTables in in-place mode. Tables whose new content
+// is the same size as the original are overwritten in place, and the rest are
+// relocated by relocateRemainingTables, without first trying to compact them.
+func relocateGrownTables(f *elf_reader.ELF32File,
+	newTables []replacedStringTable, options *Options, report *Report) error {
+	var fitting, grown []replacedStringTable
+	var fittingPositions, grownPositions []int
+	for i := range newTables {
+		t := &(newTables[i])
+		if len(t.newContent) == len(t.oldContent) {
+			fitting = append(fitting, *t)
+			fittingPositions = append(fittingPositions, i)
+			continue
+		}
+		if t.addedStrings != 0 {
+			report.logf("String table in section %d must be relocated, "+
+				"since strings were added to it for new dynamic entries.\n",
+				t.sectionIndex)
+		} else {
+			report.logf("String table in section %d must be relocated, "+
+				"since a replacement in it is longer than the string it "+
+				"replaces.\n", t.sectionIndex)
+		}
+		grown = append(grown, *t)
+		grownPositions = append(grownPositions, i)
+	}
+	if len(fitting) != 0 {
+		e := writeTablesInPlace(f, fitting, report)
+		for i := range fitting {
+			newTables[fittingPositions[i]] = fitting[i]
+		}
+		if e != nil {
+			return e
+		}
+	}
+	if len(grown) == 0 {
+		return nil
+	}
+	e := relocateRemainingTables(f, grown, options, report)
+	// Copy the new locations back, even on failure, so the caller's tables
+	// stay consistent with the file.
+	for i := range grown {
+		newTables[grownPositions[i]] = grown[i]
+	}
+	return e
+}
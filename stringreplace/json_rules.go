@@ -0,0 +1,74 @@
+package stringreplace
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+)
+
+// The JSON representation of a single replacement rule.
+type jsonRule struct {
+	ToMatch         string   `json:"to_match"`
+	Replace         string   `json:"replace"`
+	Sections        []string `json:"sections"`
+	ExcludeSections []string `json:"exclude_sections"`
+	Machines        []string `json:"machines"`
+	Literal         bool     `json:"literal,omitempty"`
+}
+
+// Parses a JSON array of replacement rules, for example:
+// [{"to_match": "libc\\.so", "replace": "libc_copy.so"}]
+// Each rule may also have "sections" and "exclude_sections" arrays, limiting
+// the string tables it applies to, and a "machines" array, limiting the files
+// it applies to (see ParseMachine). If a rule has "literal": true, to_match
+// and replace are exact whole strings rather than a regular expression and
+// template (see LiteralRule).
+func ParseJSONRules(data []byte) ([]Rule, error) {
+	var parsed []jsonRule
+	e := json.Unmarshal(data, &parsed)
+	if e != nil {
+		return nil, fmt.Errorf("Invalid rules JSON: %s", e)
+	}
+	toReturn := make([]Rule, len(parsed))
+	for i, r := range parsed {
+		if r.Literal {
+			toReturn[i] = LiteralRule(r.ToMatch, r.Replace)
+		} else {
+			toReturn[i].Match, e = regexp.Compile(r.ToMatch)
+			if e != nil {
+				return nil, fmt.Errorf("Invalid regular expression in rule "+
+					"%d: %s", i, e)
+			}
+			toReturn[i].Replacement = r.Replace
+		}
+		toReturn[i].Sections = r.Sections
+		toReturn[i].ExcludeSections = r.ExcludeSections
+		toReturn[i].Machines, e = ParseMachines(r.Machines)
+		if e != nil {
+			return nil, fmt.Errorf("Invalid machines in rule %d: %s", i, e)
+		}
+		e = ValidateRule(&(toReturn[i]))
+		if e != nil {
+			return nil, fmt.Errorf("Invalid rule %d: %s", i, e)
+		}
+	}
+	return toReturn, nil
+}
+
+// Returns the JSON representation of the rules, in the format accepted by
+// ParseJSONRules. Machines are given as numeric e_machine values.
+func MarshalJSONRules(rules []Rule) ([]byte, error) {
+	toEncode := make([]jsonRule, len(rules))
+	for i := range rules {
+		r := &(rules[i])
+		toEncode[i].ToMatch = r.Match.String()
+		toEncode[i].Replace = r.Replacement
+		toEncode[i].Sections = r.Sections
+		toEncode[i].ExcludeSections = r.ExcludeSections
+		for _, machine := range r.Machines {
+			toEncode[i].Machines = append(toEncode[i].Machines,
+				fmt.Sprintf("%d", machine))
+		}
+	}
+	return json.Marshal(toEncode)
+}
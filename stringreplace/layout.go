@@ -0,0 +1,132 @@
+package stringreplace
+
+// This file defines the snapshot of a file's structure taken before it's
+// patched, which is included in the report so that auditors can reconstruct
+// every structural change made to the file, not just the replaced strings.
+
+import (
+	"github.com/yalue/elf_reader"
+)
+
+// The fields of the ELF header, as they were before patching.
+type HeaderSnapshot struct {
+	Class                  uint8  `json:"class"`
+	Endianness             uint8  `json:"endianness"`
+	Version                uint8  `json:"version"`
+	OSABI                  uint8  `json:"os_abi"`
+	ABIVersion             uint8  `json:"abi_version"`
+	Type                   uint16 `json:"type"`
+	Machine                uint16 `json:"machine"`
+	EntryPoint             uint32 `json:"entry_point"`
+	ProgramHeaderOffset    uint32 `json:"program_header_offset"`
+	SectionHeaderOffset    uint32 `json:"section_header_offset"`
+	Flags                  uint32 `json:"flags"`
+	HeaderSize             uint16 `json:"header_size"`
+	ProgramHeaderEntrySize uint16 `json:"program_header_entry_size"`
+	ProgramHeaderEntries   uint16 `json:"program_header_entries"`
+	SectionHeaderEntrySize uint16 `json:"section_header_entry_size"`
+	SectionHeaderEntries   uint16 `json:"section_header_entries"`
+	SectionNamesTable      uint16 `json:"section_names_table"`
+}
+
+// A section header, as it was before patching.
+type SectionSnapshot struct {
+	Index int `json:"index"`
+	// The section's name, if it could be read.
+	Name           string `json:"name,omitempty"`
+	NameOffset     uint32 `json:"name_offset"`
+	Type           uint32 `json:"type"`
+	Flags          uint32 `json:"flags"`
+	VirtualAddress uint32 `json:"virtual_address"`
+	FileOffset     uint32 `json:"file_offset"`
+	Size           uint32 `json:"size"`
+	Link           uint32 `json:"link"`
+	Info           uint32 `json:"info"`
+	Align          uint32 `json:"align"`
+	EntrySize      uint32 `json:"entry_size"`
+}
+
+// A program header, as it was before patching.
+type SegmentSnapshot struct {
+	Index           int    `json:"index"`
+	Type            uint32 `json:"type"`
+	FileOffset      uint32 `json:"file_offset"`
+	VirtualAddress  uint32 `json:"virtual_address"`
+	PhysicalAddress uint32 `json:"physical_address"`
+	FileSize        uint32 `json:"file_size"`
+	MemorySize      uint32 `json:"memory_size"`
+	Flags           uint32 `json:"flags"`
+	Align           uint32 `json:"align"`
+}
+
+// The ELF header, section header table, and program header table of a file
+// before it was patched.
+type LayoutSnapshot struct {
+	Header   HeaderSnapshot    `json:"header"`
+	Sections []SectionSnapshot `json:"sections"`
+	Segments []SegmentSnapshot `json:"segments"`
+}
+
+// Returns a snapshot of f's headers. Must be called before f is modified.
+func snapshotLayout(f *elf_reader.ELF32File) *LayoutSnapshot {
+	h := &(f.Header)
+	toReturn := &LayoutSnapshot{
+		Header: HeaderSnapshot{
+			Class:                  h.Class,
+			Endianness:             h.Endianness,
+			Version:                h.Version,
+			OSABI:                  h.OSABI,
+			ABIVersion:             h.EABI,
+			Type:                   uint16(h.Type),
+			Machine:                uint16(h.Machine),
+			EntryPoint:             h.EntryPoint,
+			ProgramHeaderOffset:    h.ProgramHeaderOffset,
+			SectionHeaderOffset:    h.SectionHeaderOffset,
+			Flags:                  h.Flags,
+			HeaderSize:             h.HeaderSize,
+			ProgramHeaderEntrySize: h.ProgramHeaderEntrySize,
+			ProgramHeaderEntries:   h.ProgramHeaderEntries,
+			SectionHeaderEntrySize: h.SectionHeaderEntrySize,
+			SectionHeaderEntries:   h.SectionHeaderEntries,
+			SectionNamesTable:      h.SectionNamesTable,
+		},
+		Sections: make([]SectionSnapshot, len(f.Sections)),
+		Segments: make([]SegmentSnapshot, len(f.Segments)),
+	}
+	for i := range f.Sections {
+		s := &(f.Sections[i])
+		name, e := SectionName(f, uint16(i))
+		if e != nil {
+			name = ""
+		}
+		toReturn.Sections[i] = SectionSnapshot{
+			Index:          i,
+			Name:           EscapeString(name),
+			NameOffset:     s.Name,
+			Type:           uint32(s.Type),
+			Flags:          uint32(s.Flags),
+			VirtualAddress: s.VirtualAddress,
+			FileOffset:     s.FileOffset,
+			Size:           s.Size,
+			Link:           s.LinkedIndex,
+			Info:           s.Info,
+			Align:          s.Align,
+			EntrySize:      s.EntrySize,
+		}
+	}
+	for i := range f.Segments {
+		s := &(f.Segments[i])
+		toReturn.Segments[i] = SegmentSnapshot{
+			Index:           i,
+			Type:            uint32(s.Type),
+			FileOffset:      s.FileOffset,
+			VirtualAddress:  s.VirtualAddress,
+			PhysicalAddress: s.PhysicalAddress,
+			FileSize:        s.FileSize,
+			MemorySize:      s.MemorySize,
+			Flags:           uint32(s.Flags),
+			Align:           s.Align,
+		}
+	}
+	return toReturn
+}
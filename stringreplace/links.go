@@ -0,0 +1,230 @@
+package stringreplace
+
+// This file contains functions for finding the string table used by a
+// section. Usually this is just the section's sh_link field, but
+// post-processed and packed binaries sometimes contain a zero or incorrect
+// sh_link, so the string table may need to be found in other ways.
+
+import (
+	"fmt"
+	"github.com/yalue/elf_reader"
+)
+
+// Returns true if the section at the given index exists and is a string table.
+func isValidStringTable(f *elf_reader.ELF32File, index uint32) bool {
+	return (index != 0) && (index < uint32(len(f.Sections))) &&
+		f.IsStringTable(uint16(index))
+}
+
+// Returns true if the section type is one which uses the dynamic string
+// table: SHT_DYNAMIC, SHT_DYNSYM, SHT_GNU_verdef or SHT_GNU_verneed.
+func usesDynamicStrings(sectionType uint32) bool {
+	switch sectionType {
+	case 6, 11, VersionDefinitionSection, VersionRequirementSection:
+		return true
+	}
+	return false
+}
+
+// Returns the index of the string table section loaded at the address given
+// by the dynamic table's DT_STRTAB entry. Returns false if there's no dynamic
+// table, or no string table section at that address.
+func findDynamicStringTable(f *elf_reader.ELF32File) (uint16, bool) {
+	var address uint32
+	found := false
+	for i := range f.Sections {
+		if !f.IsDynamicSection(uint16(i)) {
+			continue
+		}
+		entries, e := f.GetDynamicTable(uint16(i))
+		if e != nil {
+			return 0, false
+		}
+		for _, entry := range entries {
+			// Tag 5 is DT_STRTAB.
+			if entry.Tag == 5 {
+				address = entry.Value
+				found = true
+				break
+			}
+		}
+		break
+	}
+	if !found || (address == 0) {
+		return 0, false
+	}
+	for i := range f.Sections {
+		if (f.Sections[i].VirtualAddress == address) &&
+			isValidStringTable(f, uint32(i)) {
+			return uint16(i), true
+		}
+	}
+	return 0, false
+}
+
+// Returns the index of the first string table section with the given name.
+func findStringTableByName(f *elf_reader.ELF32File, name string) (uint16,
+	bool) {
+	for i := range f.Sections {
+		if !isValidStringTable(f, uint32(i)) {
+			continue
+		}
+		sectionName, e := SectionName(f, uint16(i))
+		if (e == nil) && (sectionName == name) {
+			return uint16(i), true
+		}
+	}
+	return 0, false
+}
+
+// Returns true if every vn_file offset in the version requirement section
+// refers to a string in the given string table, and every vna_name offset
+// refers to a string whose hash matches the vna_hash stored with it. Returns
+// false if the section has no vernaux entries, since nothing can be checked.
+func requirementsMatchTable(f *elf_reader.ELF32File, sectionIndex,
+	tableIndex uint16) bool {
+	need, aux, e := f.ParseVersionRequirementSection(sectionIndex)
+	if e != nil {
+		return false
+	}
+	strings, e := f.GetSectionContent(tableIndex)
+	if e != nil {
+		return false
+	}
+	checked := 0
+	for i, n := range need {
+		_, e = elf_reader.ReadStringAtOffset(n.File, strings)
+		if e != nil {
+			return false
+		}
+		for _, x := range aux[i] {
+			name, e := elf_reader.ReadStringAtOffset(x.Name, strings)
+			if (e != nil) || (sysvHash(name) != x.Hash) {
+				return false
+			}
+			checked++
+		}
+	}
+	return checked != 0
+}
+
+// Returns the index of the string table holding the names in the version
+// requirement section at the given index. Each structure's names are checked
+// against their hashes (see requirementsMatchTable) in each of the candidate
+// tables: the one given by DT_STRTAB, the section's own sh_link, and those
+// linked from the dynamic symbol table and dynamic table, in that order.
+// Returns false if none of them hold the names.
+func findRequirementStringTable(f *elf_reader.ELF32File,
+	sectionIndex uint16) (uint16, bool) {
+	candidates := make([]uint32, 0, 4)
+	if index, ok := findDynamicStringTable(f); ok {
+		candidates = append(candidates, uint32(index))
+	}
+	candidates = append(candidates, f.Sections[sectionIndex].LinkedIndex)
+	for i := range f.Sections {
+		sectionType := uint32(f.Sections[i].Type)
+		// SHT_DYNAMIC is 6, and SHT_DYNSYM is 11.
+		if (sectionType == 6) || (sectionType == 11) {
+			candidates = append(candidates, f.Sections[i].LinkedIndex)
+		}
+	}
+	for _, index := range candidates {
+		if isValidStringTable(f, index) &&
+			requirementsMatchTable(f, sectionIndex, uint16(index)) {
+			return uint16(index), true
+		}
+	}
+	return 0, false
+}
+
+// Returns the index of the string table used by the section at the given
+// index. A version requirement section's table is the one holding names that
+// match their hashes, if one can be found. Otherwise, the section's sh_link is
+// used if it refers to a string table, unless the section uses the dynamic
+// string table and sh_link disagrees with DT_STRTAB. Otherwise, the dynamic
+// string table is found using DT_STRTAB, and a static symbol table's strings
+// are assumed to be in .strtab. Returns sh_link unchanged if no better string
+// table can be found.
+func linkedStringTable(f *elf_reader.ELF32File, sectionIndex uint16) uint16 {
+	section := &(f.Sections[sectionIndex])
+	linked := section.LinkedIndex
+	sectionType := uint32(section.Type)
+	if sectionType == VersionRequirementSection {
+		index, ok := findRequirementStringTable(f, sectionIndex)
+		if ok {
+			return index
+		}
+	}
+	if usesDynamicStrings(sectionType) {
+		index, ok := findDynamicStringTable(f)
+		if ok {
+			return index
+		}
+	}
+	if isValidStringTable(f, linked) {
+		return uint16(linked)
+	}
+	// SHT_SYMTAB
+	if sectionType == 2 {
+		index, ok := findStringTableByName(f, ".strtab")
+		if ok {
+			return index
+		}
+	}
+	return uint16(linked)
+}
+
+// Sets the LinkedIndex of each section that uses a string table to the
+// string table it actually uses (see linkedStringTable), so that the rest of
+// the patching process can rely on it, and writes the corrected links to the
+// file. Returns a description of each link that was corrected.
+func repairStringTableLinks(f *elf_reader.ELF32File) ([]string, error) {
+	toReturn := make([]string, 0, 1)
+	for i := range f.Sections {
+		section := &(f.Sections[i])
+		sectionType := uint32(section.Type)
+		// SHT_SYMTAB
+		if !usesDynamicStrings(sectionType) && (sectionType != 2) {
+			continue
+		}
+		actual := uint32(linkedStringTable(f, uint16(i)))
+		if actual == section.LinkedIndex {
+			continue
+		}
+		toReturn = append(toReturn, fmt.Sprintf("Section %d is linked to "+
+			"section %d, but its strings are in section %d", i,
+			section.LinkedIndex, actual))
+		section.LinkedIndex = actual
+		// sh_link is at offset 24 in the section header.
+		e := writeELFUint32(f, getSectionHeaderOffset(f, uint16(i))+24,
+			actual, "section header")
+		if e != nil {
+			return nil, fmt.Errorf("Failed updating section %d's link: %s",
+				i, e)
+		}
+	}
+	return toReturn, nil
+}
+
+// Returns the indices of the string tables referenced by the structures this
+// package updates: the section name table, and the string tables used by
+// symbol tables, the dynamic table, and the versioning sections, along with
+// the .interp section referenced by the PT_INTERP segment. Replacing strings in
+// any other string table has no effect on the references to them.
+func referencedStringTables(f *elf_reader.ELF32File) map[uint16]bool {
+	toReturn := make(map[uint16]bool)
+	if names, ok := SectionNamesTable(f); ok {
+		toReturn[names] = true
+	}
+	if interpreter := interpreterSection(f); interpreter >= 0 {
+		toReturn[uint16(interpreter)] = true
+	}
+	for i := range f.Sections {
+		sectionType := uint32(f.Sections[i].Type)
+		// SHT_SYMTAB
+		if usesDynamicStrings(sectionType) || (sectionType == 2) {
+			toReturn[uint16(f.Sections[i].LinkedIndex)] = true
+		}
+	}
+	return toReturn
+}
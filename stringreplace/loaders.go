@@ -0,0 +1,247 @@
+package stringreplace
+
+// This file contains checks for the invariants that the glibc, musl, and
+// uClibc-ng dynamic loaders rely on when loading a file. They mostly agree,
+// but each checks (or silently assumes) slightly different things, so a
+// patched file accepted by one may still fail to load with another.
+
+import (
+	"fmt"
+	"github.com/yalue/elf_reader"
+)
+
+// Identifies a dynamic loader whose invariants VerifyLoader checks.
+type Loader int
+
+const (
+	GlibcLoader Loader = iota
+	MuslLoader
+	UclibcLoader
+)
+
+// The loaders checked when no specific loader is requested.
+var AllLoaders = []Loader{GlibcLoader, MuslLoader, UclibcLoader}
+
+// Returns the name of the loader, as accepted by ParseLoader.
+func (l Loader) String() string {
+	switch l {
+	case GlibcLoader:
+		return "glibc"
+	case MuslLoader:
+		return "musl"
+	case UclibcLoader:
+		return "uclibc"
+	}
+	return fmt.Sprintf("<unknown loader %d>", int(l))
+}
+
+// Parses a loader name: "glibc", "musl", or "uclibc".
+func ParseLoader(s string) (Loader, error) {
+	for _, l := range AllLoaders {
+		if l.String() == s {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown loader: %s", s)
+}
+
+// Holds the state used while checking a file against a loader's invariants.
+type loaderChecker struct {
+	f        *elf_reader.ELF32File
+	loader   Loader
+	problems []string
+	// The values of the entries in the PT_DYNAMIC segment, keyed by tag.
+	dynamic map[uint32]uint32
+}
+
+// Records a problem.
+func (c *loaderChecker) addProblem(format string, args ...interface{}) {
+	c.problems = append(c.problems, fmt.Sprintf("%s: %s", c.loader,
+		fmt.Sprintf(format, args...)))
+}
+
+// Reads the entries of the PT_DYNAMIC segment, which the loaders use rather
+// than the .dynamic section. Returns false if the file has no PT_DYNAMIC
+// segment, and so doesn't use the dynamic loader.
+func (c *loaderChecker) readDynamicSegment() bool {
+	for i := range c.f.Segments {
+		s := &(c.f.Segments[i])
+		if s.Type != elf_reader.DynamicLinkingSegment {
+			continue
+		}
+		c.dynamic = make(map[uint32]uint32)
+		end := uint64(s.FileOffset) + uint64(s.FileSize)
+		for offset := uint64(s.FileOffset); (offset + 8) <= end; offset += 8 {
+			tag, e := readELFUint32(c.f, uint32(offset),
+				"dynamic entry")
+			if e != nil {
+				c.addProblem("PT_DYNAMIC extends past the end of the file")
+				break
+			}
+			// DT_NULL ends the table.
+			if tag == 0 {
+				break
+			}
+			value, _ := readELFUint32(c.f, uint32(offset)+4,
+				"dynamic entry")
+			// Like the loaders, keep the last value for each tag.
+			c.dynamic[tag] = value
+		}
+		return true
+	}
+	return false
+}
+
+// Returns the index of the loadable segment whose memory covers the given
+// address, or -1 if there isn't one.
+func (c *loaderChecker) loadSegmentAt(address uint32) int {
+	for i := range c.f.Segments {
+		s := &(c.f.Segments[i])
+		if s.Type != elf_reader.LoadableSegment {
+			continue
+		}
+		if (address >= s.VirtualAddress) && (uint64(address) <
+			(uint64(s.VirtualAddress) + uint64(s.MemorySize))) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Checks that the loadable segments can be mapped: their file offsets and
+// addresses must be congruent modulo the page size, since musl and uClibc-ng
+// map each segment at its page-aligned address and offset. glibc
+// additionally requires the alignment to be a multiple of the page size and
+// the segments to be sorted by address.
+func (c *loaderChecker) checkLoadSegments() {
+	var previous uint32
+	first := true
+	for i := range c.f.Segments {
+		s := &(c.f.Segments[i])
+		if s.Type != elf_reader.LoadableSegment {
+			continue
+		}
+		if s.FileSize > s.MemorySize {
+			c.addProblem("Segment %d's file size (0x%x) exceeds its memory "+
+				"size (0x%x)", i, s.FileSize, s.MemorySize)
+		}
+		if (s.FileOffset % minimumPageSize) !=
+			(s.VirtualAddress % minimumPageSize) {
+			c.addProblem("Segment %d's offset (0x%08x) and VA (0x%08x) "+
+				"aren't congruent modulo the page size", i, s.FileOffset,
+				s.VirtualAddress)
+		}
+		if c.loader == GlibcLoader {
+			if (s.Align % minimumPageSize) != 0 {
+				c.addProblem("Segment %d's alignment (0x%x) isn't a "+
+					"multiple of the page size", i, s.Align)
+			} else if (s.FileOffset % s.Align) != (s.VirtualAddress %
+				s.Align) {
+				c.addProblem("Segment %d's offset (0x%08x) and VA (0x%08x) "+
+					"aren't congruent modulo its alignment (0x%x)", i,
+					s.FileOffset, s.VirtualAddress, s.Align)
+			}
+			if !first && (s.VirtualAddress < previous) {
+				c.addProblem("Segment %d isn't sorted by VA: 0x%08x follows "+
+					"0x%08x", i, s.VirtualAddress, previous)
+			}
+		}
+		previous = s.VirtualAddress
+		first = false
+	}
+}
+
+// Checks that the tables the loader reads through the dynamic table are
+// loaded at the addresses it gives, and that the symbol lookup tables the
+// loader supports are present.
+func (c *loaderChecker) checkDynamicTable() {
+	// The tags whose values are addresses the loader reads from.
+	tags := []struct {
+		tag  uint32
+		name string
+	}{
+		{4, "DT_HASH"},
+		{5, "DT_STRTAB"},
+		{6, "DT_SYMTAB"},
+		{0x6ffffef5, "DT_GNU_HASH"},
+		{dynamicTagVersym, "DT_VERSYM"},
+		{dynamicTagVerneed, "DT_VERNEED"},
+		{dynamicTagVerdef, "DT_VERDEF"},
+	}
+	for _, t := range tags {
+		address, ok := c.dynamic[t.tag]
+		if !ok {
+			continue
+		}
+		if c.loadSegmentAt(address) < 0 {
+			c.addProblem("%s (0x%08x) isn't in a loadable segment", t.name,
+				address)
+		}
+	}
+	_, hasStrtab := c.dynamic[5]
+	_, hasSymtab := c.dynamic[6]
+	if !hasStrtab || !hasSymtab {
+		c.addProblem("The dynamic table must contain DT_STRTAB and DT_SYMTAB")
+	}
+	_, hasHash := c.dynamic[4]
+	_, hasGNUHash := c.dynamic[0x6ffffef5]
+	switch {
+	case !hasHash && !hasGNUHash:
+		c.addProblem("The dynamic table contains neither DT_HASH nor " +
+			"DT_GNU_HASH")
+	case !hasHash && (c.loader == UclibcLoader):
+		c.addProblem("The dynamic table contains DT_GNU_HASH but not " +
+			"DT_HASH, which uClibc-ng only supports if built with " +
+			"LDSO_GNU_HASH_SUPPORT")
+	}
+}
+
+// uClibc-ng reads only the first page of a shared library before mapping
+// it, and expects to find the program header table there.
+func (c *loaderChecker) checkProgramHeadersInFirstPage() {
+	if !isPositionIndependent(c.f) || isExecutable(c.f) {
+		// The kernel maps executables, and tells the loader where their
+		// program headers are.
+		return
+	}
+	end := uint64(c.f.Header.ProgramHeaderOffset) +
+		uint64(c.f.Header.ProgramHeaderEntrySize)*
+			uint64(len(c.f.Segments))
+	if end > minimumPageSize {
+		c.addProblem("The program header table ends at offset 0x%x, past "+
+			"the first page of the file", end)
+	}
+}
+
+// glibc reads the PT_GNU_PROPERTY note from memory once the file is mapped,
+// and ignores it if the segment isn't laid out as expected, which silently
+// disables features such as IBT and SHSTK.
+func (c *loaderChecker) checkGNUProperty() {
+	for _, problem := range gnuPropertyProblems(c.f) {
+		c.addProblem("%s", problem)
+	}
+}
+
+// Returns a description of each problem the given loader would have loading
+// the file, or an empty slice if there are none. Files without a PT_DYNAMIC
+// segment (e.g. static executables) don't use the loader, so they have no
+// problems.
+func VerifyLoader(f *elf_reader.ELF32File, loader Loader) []string {
+	c := &loaderChecker{
+		f:        f,
+		loader:   loader,
+		problems: make([]string, 0, 4),
+	}
+	if !c.readDynamicSegment() {
+		return c.problems
+	}
+	c.checkLoadSegments()
+	c.checkDynamicTable()
+	if loader == GlibcLoader {
+		c.checkGNUProperty()
+	}
+	if loader == UclibcLoader {
+		c.checkProgramHeadersInFirstPage()
+	}
+	return c.problems
+}
@@ -0,0 +1,109 @@
+package stringreplace
+
+// This file contains support for limiting rules to files for particular
+// architectures (e_machine values), so one set of rules can patch a tree
+// holding files for several architectures, such as a multi-arch firmware
+// image's sysroots, using a different replacement for each.
+
+import (
+	"fmt"
+	"github.com/yalue/elf_reader"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Maps the names accepted by ParseMachine to e_machine values.
+var machineNames = map[string]uint16{
+	"sparc":      2,
+	"386":        3,
+	"i386":       3,
+	"x86":        3,
+	"m68k":       4,
+	"mips":       8,
+	"ppc":        20,
+	"powerpc":    20,
+	"arm":        40,
+	"sh":         42,
+	"arc":        45,
+	"h8300":      46,
+	"or1k":       92,
+	"xtensa":     94,
+	"nios2":      113,
+	"microblaze": 189,
+	"riscv":      243,
+	"riscv32":    243,
+	"rv32":       243,
+}
+
+// Parses an architecture name, such as "arm" or "mips", or a numeric
+// e_machine value, such as "40" or "0x28". Names aren't case-sensitive.
+func ParseMachine(s string) (uint16, error) {
+	value, ok := machineNames[strings.ToLower(strings.TrimSpace(s))]
+	if ok {
+		return value, nil
+	}
+	parsed, e := strconv.ParseUint(strings.TrimSpace(s), 0, 16)
+	if e != nil {
+		names := make([]string, 0, len(machineNames))
+		for name := range machineNames {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return 0, fmt.Errorf("Unknown machine %q: expected a number or one "+
+			"of %s", s, strings.Join(names, ", "))
+	}
+	return uint16(parsed), nil
+}
+
+// Parses a list of machines using ParseMachine.
+func ParseMachines(names []string) ([]uint16, error) {
+	toReturn := make([]uint16, len(names))
+	var e error
+	for i, name := range names {
+		toReturn[i], e = ParseMachine(name)
+		if e != nil {
+			return nil, e
+		}
+	}
+	return toReturn, nil
+}
+
+// Returns true if the rule applies to files with the given e_machine value.
+func (r *Rule) appliesToMachine(machine uint16) bool {
+	if len(r.Machines) == 0 {
+		return true
+	}
+	for _, m := range r.Machines {
+		if m == machine {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the options, or a copy of them in which the rules limited to other
+// machines than f's are disabled. The rules keep their indices, so reports
+// and explanations refer to the same rule numbers whichever file is patched.
+func selectMachineRules(f *elf_reader.ELF32File, options *Options,
+	report *Report) *Options {
+	machine := uint16(f.Header.Machine)
+	var rules []Rule
+	for i := range options.Rules {
+		if options.Rules[i].appliesToMachine(machine) {
+			continue
+		}
+		if rules == nil {
+			rules = append([]Rule(nil), options.Rules...)
+		}
+		rules[i].otherMachine = true
+		report.logf("Rule %d doesn't apply to this file's machine (%d).\n",
+			i, machine)
+	}
+	if rules == nil {
+		return options
+	}
+	copied := *options
+	copied.Rules = rules
+	return &copied
+}
@@ -0,0 +1,333 @@
+package stringreplace
+
+// This file contains support for renaming dependencies in Mach-O files: the
+// install names and paths in LC_LOAD_DYLIB (and related), LC_ID_DYLIB, and
+// LC_RPATH load commands. Strings that grow are given larger load commands,
+// using the padding between the load commands and the first section, as
+// install_name_tool does.
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// The magic numbers identifying Mach-O files, as read in the file's own byte
+// order, and universal ("fat") files, which are always big-endian.
+const (
+	machOMagic32 = 0xfeedface
+	machOMagic64 = 0xfeedfacf
+	fatMagic     = 0xcafebabe
+	fatMagic64   = 0xcafebabf
+)
+
+// The load commands containing strings that may be replaced, mapped to their
+// names and the offset of the field holding the string's offset within the
+// command.
+var machOStringCommands = map[uint32]struct {
+	name        string
+	fieldOffset uint32
+}{
+	0xc:        {"LC_LOAD_DYLIB", 8},
+	0xd:        {"LC_ID_DYLIB", 8},
+	0x20:       {"LC_LAZY_LOAD_DYLIB", 8},
+	0x80000018: {"LC_LOAD_WEAK_DYLIB", 8},
+	0x8000001f: {"LC_REEXPORT_DYLIB", 8},
+	0x80000023: {"LC_LOAD_UPWARD_DYLIB", 8},
+	0x8000001c: {"LC_RPATH", 8},
+}
+
+// Describes a string replaced in a Mach-O load command.
+type MachOChange struct {
+	// The file offset of the Mach-O image containing the command: 0 unless
+	// the file is a universal binary.
+	SliceOffset uint32 `json:"slice_offset"`
+	// The index and name of the load command, e.g. "LC_LOAD_DYLIB".
+	CommandIndex uint32 `json:"command_index"`
+	Command      string `json:"command"`
+	// The command's size before and after the replacement.
+	OriginalSize uint32 `json:"original_size"`
+	NewSize      uint32 `json:"new_size"`
+	// The original and new strings, escaped using EscapeString.
+	Original string `json:"original"`
+	New      string `json:"new"`
+}
+
+// Returns true if the data starts with the magic number of a thin Mach-O
+// file, in either byte order, or a universal binary.
+func IsMachOFile(data []byte) bool {
+	if len(data) < 8 {
+		return false
+	}
+	magic := binary.LittleEndian.Uint32(data)
+	if (magic == machOMagic32) || (magic == machOMagic64) {
+		return true
+	}
+	magic = binary.BigEndian.Uint32(data)
+	if (magic == machOMagic32) || (magic == machOMagic64) {
+		return true
+	}
+	if (magic != fatMagic) && (magic != fatMagic64) {
+		return false
+	}
+	// Java class files share the universal binary magic number, but the
+	// second word is their version number, which is always much larger than
+	// any plausible number of architectures.
+	count := binary.BigEndian.Uint32(data[4:])
+	return (count != 0) && (count < 32)
+}
+
+// Returns a copy of the data with strings in the Mach-O load commands
+// replaced according to the options. Only Rules, NotMatching,
+// ExcludeSections, and AllowRawBytes are used; the load command's name (e.g.
+// LC_RPATH) is used in place of a section name. Universal binaries have each
+// of their architectures patched. The file's size never changes.
+func ReplaceMachO(input []byte, options *Options) ([]byte, []MachOChange,
+	error) {
+	if len(options.Rules) == 0 {
+		return nil, nil, fmt.Errorf("No replacement rules were provided")
+	}
+	e := options.validateRules()
+	if e != nil {
+		return nil, nil, e
+	}
+	output := make([]byte, len(input))
+	copy(output, input)
+	if len(output) < 8 {
+		return nil, nil, fmt.Errorf("The file is too short to be a Mach-O " +
+			"file")
+	}
+	magic := binary.BigEndian.Uint32(output)
+	if (magic != fatMagic) && (magic != fatMagic64) {
+		changes, e := replaceMachOSlice(output, 0, options)
+		if e != nil {
+			return nil, nil, e
+		}
+		return output, changes, nil
+	}
+	// Universal binaries start with a big-endian header listing the
+	// architectures: 20-byte fat_arch or 32-byte fat_arch_64 entries.
+	count := binary.BigEndian.Uint32(output[4:])
+	entrySize := uint64(20)
+	if magic == fatMagic64 {
+		entrySize = 32
+	}
+	if (8 + uint64(count)*entrySize) > uint64(len(output)) {
+		return nil, nil, fmt.Errorf("The universal binary's architecture " +
+			"list is truncated")
+	}
+	var changes []MachOChange
+	for i := uint64(0); i < uint64(count); i++ {
+		entry := output[8+i*entrySize:]
+		var offset, size uint64
+		if magic == fatMagic64 {
+			offset = binary.BigEndian.Uint64(entry[8:])
+			size = binary.BigEndian.Uint64(entry[16:])
+		} else {
+			offset = uint64(binary.BigEndian.Uint32(entry[8:]))
+			size = uint64(binary.BigEndian.Uint32(entry[12:]))
+		}
+		if ((offset + size) > uint64(len(output))) || (offset > 0xffffffff) {
+			return nil, nil, fmt.Errorf("Architecture %d of the universal "+
+				"binary is outside of the file", i)
+		}
+		sliceChanges, e := replaceMachOSlice(output[offset:offset+size],
+			uint32(offset), options)
+		if e != nil {
+			return nil, nil, fmt.Errorf("Failed patching architecture %d: %s",
+				i, e)
+		}
+		changes = append(changes, sliceChanges...)
+	}
+	return output, changes, nil
+}
+
+// Returns the file offset of the first section or segment content following
+// the load commands, which limits how much they can grow.
+func machOContentStart(data []byte, order binary.ByteOrder, is64Bit bool,
+	commands [][]byte) uint64 {
+	toReturn := uint64(len(data))
+	for _, c := range commands {
+		command := order.Uint32(c)
+		// LC_SEGMENT (0x1) and LC_SEGMENT_64 (0x19) commands are followed by
+		// their section headers.
+		var headerSize, sectionSize, offsetField uint32
+		var segmentOffset uint64
+		if (command == 0x1) && !is64Bit && (len(c) >= 56) {
+			headerSize, sectionSize, offsetField = 56, 68, 40
+			segmentOffset = uint64(order.Uint32(c[32:]))
+		} else if (command == 0x19) && is64Bit && (len(c) >= 72) {
+			headerSize, sectionSize, offsetField = 72, 80, 48
+			segmentOffset = order.Uint64(c[40:])
+		} else {
+			continue
+		}
+		// The segment containing the header starts at offset 0, so it doesn't
+		// limit anything, but other segments might.
+		if (segmentOffset != 0) && (segmentOffset < toReturn) {
+			toReturn = segmentOffset
+		}
+		sectionCount := order.Uint32(c[headerSize-8:])
+		for i := uint32(0); i < sectionCount; i++ {
+			start := uint64(headerSize) + uint64(i)*uint64(sectionSize)
+			if (start + uint64(sectionSize)) > uint64(len(c)) {
+				break
+			}
+			section := c[start:]
+			offset := uint64(order.Uint32(section[offsetField:]))
+			// Zero-fill sections have no file content, and an offset of 0.
+			if (offset != 0) && (offset < toReturn) {
+				toReturn = offset
+			}
+		}
+	}
+	return toReturn
+}
+
+// Replaces strings in the load commands of a single (thin) Mach-O image,
+// which starts at the given offset in the file. The data is modified in
+// place.
+func replaceMachOSlice(data []byte, sliceOffset uint32,
+	options *Options) ([]MachOChange, error) {
+	if len(data) < 28 {
+		return nil, fmt.Errorf("The file is too short to be a Mach-O file")
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	magic := order.Uint32(data)
+	if (magic != machOMagic32) && (magic != machOMagic64) {
+		order = binary.BigEndian
+		magic = order.Uint32(data)
+	}
+	if (magic != machOMagic32) && (magic != machOMagic64) {
+		return nil, fmt.Errorf("Invalid Mach-O magic number 0x%08x",
+			binary.LittleEndian.Uint32(data))
+	}
+	is64Bit := magic == machOMagic64
+	// The header is 28 bytes, plus a reserved field in 64-bit files. Load
+	// command sizes must be multiples of 4 or 8 bytes, respectively.
+	headerSize := uint64(28)
+	alignment := uint32(4)
+	if is64Bit {
+		headerSize = 32
+		alignment = 8
+	}
+	commandCount := order.Uint32(data[16:])
+	commandsSize := uint64(order.Uint32(data[20:]))
+	if (headerSize + commandsSize) > uint64(len(data)) {
+		return nil, fmt.Errorf("The load commands extend past the end of " +
+			"the file")
+	}
+	// Split the load commands, so they can be rebuilt with new sizes.
+	commands := make([][]byte, 0, commandCount)
+	offset := headerSize
+	end := headerSize + commandsSize
+	for i := uint32(0); i < commandCount; i++ {
+		if (offset + 8) > end {
+			return nil, fmt.Errorf("Load command %d is truncated", i)
+		}
+		size := uint64(order.Uint32(data[offset+4:]))
+		if (size < 8) || ((offset + size) > end) {
+			return nil, fmt.Errorf("Load command %d has invalid size %d", i,
+				size)
+		}
+		commands = append(commands, data[offset:offset+size])
+		offset += size
+	}
+	var changes []MachOChange
+	newCommands := make([][]byte, len(commands))
+	hasSignature := false
+	for i, c := range commands {
+		newCommands[i] = c
+		command := order.Uint32(c)
+		// LC_CODE_SIGNATURE
+		if command == 0x1d {
+			hasSignature = true
+		}
+		info, ok := machOStringCommands[command]
+		if !ok {
+			continue
+		}
+		if uint32(len(c)) < (info.fieldOffset + 4) {
+			return nil, fmt.Errorf("%s command %d is truncated", info.name, i)
+		}
+		stringOffset := order.Uint32(c[info.fieldOffset:])
+		if (stringOffset < (info.fieldOffset + 4)) ||
+			(stringOffset >= uint32(len(c))) {
+			return nil, fmt.Errorf("%s command %d has invalid string offset "+
+				"%d", info.name, i, stringOffset)
+		}
+		oldString := string(c[stringOffset:])
+		for j := 0; j < len(oldString); j++ {
+			if oldString[j] == 0 {
+				oldString = oldString[:j]
+				break
+			}
+		}
+		newString := applyNamedRules(options, info.name, oldString)
+		if newString == oldString {
+			continue
+		}
+		if !options.AllowRawBytes {
+			e := checkRawBytes(oldString, newString, false)
+			if e != nil {
+				return nil, e
+			}
+		}
+		// Keep the command's size if the new string fits, otherwise round
+		// the size up to the required alignment.
+		newSize := uint32(len(c))
+		needed := stringOffset + uint32(len(newString)) + 1
+		if needed > newSize {
+			newSize = needed
+			if (newSize % alignment) != 0 {
+				newSize += alignment - (newSize % alignment)
+			}
+		}
+		newCommand := make([]byte, newSize)
+		copy(newCommand, c[:stringOffset])
+		copy(newCommand[stringOffset:], newString)
+		order.PutUint32(newCommand[4:], newSize)
+		newCommands[i] = newCommand
+		changes = append(changes, MachOChange{
+			SliceOffset:  sliceOffset,
+			CommandIndex: uint32(i),
+			Command:      info.name,
+			OriginalSize: uint32(len(c)),
+			NewSize:      newSize,
+			Original:     EscapeString(oldString),
+			New:          EscapeString(newString),
+		})
+		options.logf("Replaced %s string in load command %d: %s -> %s\n",
+			info.name, i, EscapeString(oldString), EscapeString(newString))
+	}
+	if len(changes) == 0 {
+		return nil, nil
+	}
+	newCommandsSize := uint64(0)
+	for _, c := range newCommands {
+		newCommandsSize += uint64(len(c))
+	}
+	limit := machOContentStart(data, order, is64Bit, commands)
+	if (headerSize + newCommandsSize) > limit {
+		return nil, fmt.Errorf("The load commands need %d more bytes than "+
+			"the %d bytes available before the file's content. The file "+
+			"may need to be relinked with -headerpad_max_install_names",
+			headerSize+newCommandsSize-limit, limit-headerSize)
+	}
+	// Build the new load commands before overwriting the old ones, which
+	// the commands slice still refers to.
+	rebuilt := make([]byte, 0, newCommandsSize)
+	for _, c := range newCommands {
+		rebuilt = append(rebuilt, c...)
+	}
+	copy(data[headerSize:], rebuilt)
+	for i := headerSize + newCommandsSize; i < end; i++ {
+		data[i] = 0
+	}
+	order.PutUint32(data[20:], uint32(newCommandsSize))
+	if hasSignature {
+		options.logf("WARNING: The file's code signature is no longer valid, " +
+			"and it must be re-signed (e.g. using codesign) before it can " +
+			"be run on systems requiring signatures.\n")
+	}
+	return changes, nil
+}
@@ -0,0 +1,172 @@
+package stringreplace
+
+// This file contains support for string tables that some linkers emit with
+// the wrong section type, such as SHT_PROGBITS or a custom type, rather than
+// SHT_STRTAB. Such sections are temporarily given the SHT_STRTAB type while
+// the file is patched, so they go through the normal process.
+
+import (
+	"fmt"
+	"github.com/yalue/elf_reader"
+)
+
+// The section type of string tables.
+const stringTableType = 3
+
+// Returns true if the content looks like a string table: it starts and ends
+// with a NUL byte, contains at least two strings, contains only printable
+// ASCII characters and tabs, and doesn't contain runs of NUL bytes (which
+// usually indicate padding or binary data).
+func looksLikeStringTable(content []byte) bool {
+	if (len(content) < 4) || (content[0] != 0) ||
+		(content[len(content)-1] != 0) {
+		return false
+	}
+	strings := 0
+	for i := 1; i < len(content); i++ {
+		c := content[i]
+		if c == 0 {
+			if content[i-1] == 0 {
+				return false
+			}
+			strings++
+			continue
+		}
+		if ((c < 0x20) && (c != '\t')) || (c >= 0x7f) {
+			return false
+		}
+	}
+	return strings >= 2
+}
+
+// Returns true if the section may be a mistyped string table: it has content
+// in the file, isn't executable, and isn't one of the types whose content is
+// known not to be a string table (e.g. symbol or relocation tables).
+func mayBeMistypedStringTable(section *elf_reader.ELF32SectionHeader) bool {
+	if (section.Size == 0) || ((uint32(section.Flags) & 4) != 0) {
+		return false
+	}
+	switch uint32(section.Type) {
+	// SHT_PROGBITS, or any OS, processor or user-specific type.
+	case 1:
+		return true
+	case 0, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 14, 15, 16, 17, 18, 19:
+		return false
+	// The RISC-V and ARM attributes sections hold a target's build
+	// attributes, which include strings, but aren't string tables.
+	case riscvAttributes:
+		return false
+	}
+	return uint32(section.Type) >= 0x60000000
+}
+
+// Returns the indices of the sections which should be treated as string
+// tables despite their types, mapped to their original types: the .interp
+// section, those named in options.TreatAsStringTables, and, if
+// options.DetectStringTables is set, sections whose content looks like a
+// string table or a single string. Returns an error if a named section
+// doesn't exist, or doesn't end with a NUL byte.
+func findMistypedStringTables(f *elf_reader.ELF32File,
+	options *Options) (map[uint16]uint32, error) {
+	toReturn := make(map[uint16]uint32)
+	named := make(map[string]bool)
+	for _, name := range options.TreatAsStringTables {
+		named[name] = true
+	}
+	found := make(map[string]bool)
+	interpreter := interpreterSection(f)
+	for i := range f.Sections {
+		section := &(f.Sections[i])
+		if f.IsStringTable(uint16(i)) || (section.Type == 8) {
+			continue
+		}
+		name, e := SectionName(f, uint16(i))
+		if e != nil {
+			name = ""
+		}
+		if i == interpreter {
+			content, e := f.GetSectionContent(uint16(i))
+			if (e == nil) && looksLikeSingleString(content) {
+				found[name] = named[name]
+				toReturn[uint16(i)] = uint32(section.Type)
+				continue
+			}
+		}
+		if named[name] {
+			found[name] = true
+			content, e := f.GetSectionContent(uint16(i))
+			if e != nil {
+				return nil, fmt.Errorf("Failed reading section %s: %s",
+					EscapeString(name), e)
+			}
+			if (len(content) == 0) || (content[len(content)-1] != 0) {
+				return nil, fmt.Errorf("Section %s can't be treated as a "+
+					"string table, since it doesn't end with a NUL byte",
+					EscapeString(name))
+			}
+			toReturn[uint16(i)] = uint32(section.Type)
+			continue
+		}
+		if !options.DetectStringTables || !mayBeMistypedStringTable(section) {
+			continue
+		}
+		content, e := f.GetSectionContent(uint16(i))
+		if (e != nil) || !(looksLikeStringTable(content) ||
+			looksLikeSingleString(content)) {
+			continue
+		}
+		toReturn[uint16(i)] = uint32(section.Type)
+	}
+	for _, name := range options.TreatAsStringTables {
+		if !found[name] && !sectionIsStringTable(f, name) {
+			return nil, fmt.Errorf("Section %s doesn't exist",
+				EscapeString(name))
+		}
+	}
+	return toReturn, nil
+}
+
+// Returns true if the file contains a correctly-typed string table section
+// with the given name.
+func sectionIsStringTable(f *elf_reader.ELF32File, name string) bool {
+	_, ok := findStringTableByName(f, name)
+	return ok
+}
+
+// Sets the type of each of the given sections, both in f.Sections and in the
+// file's section headers.
+func setSectionTypes(f *elf_reader.ELF32File,
+	types map[uint16]uint32) error {
+	for index, sectionType := range types {
+		f.Sections[index].Type = elf_reader.SectionHeaderType(sectionType)
+		// sh_type is at offset 4 in the section header.
+		e := writeELFUint32(f, getSectionHeaderOffset(f, index)+4,
+			sectionType, "section header")
+		if e != nil {
+			return fmt.Errorf("Failed setting section %d's type: %s", index,
+				e)
+		}
+	}
+	return nil
+}
+
+// Gives each of the mistyped string tables (returned by
+// findMistypedStringTables) the SHT_STRTAB type, and returns a description of
+// each one.
+func retypeStringTables(f *elf_reader.ELF32File,
+	original map[uint16]uint32) ([]string, error) {
+	types := make(map[uint16]uint32)
+	toReturn := make([]string, 0, len(original))
+	for i := range f.Sections {
+		sectionType, ok := original[uint16(i)]
+		if !ok {
+			continue
+		}
+		types[uint16(i)] = stringTableType
+		name, _ := SectionName(f, uint16(i))
+		toReturn = append(toReturn, fmt.Sprintf("Treating section %d (%s, "+
+			"type 0x%x) as a string table", i, EscapeString(name),
+			sectionType))
+	}
+	return toReturn, setSectionTypes(f, types)
+}
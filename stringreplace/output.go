@@ -0,0 +1,256 @@
+package stringreplace
+
+// This file contains variants of Replace and ReplaceEmbedded that write their
+// output to an io.Writer, so that large results can be streamed (e.g. to a
+// pipe or network connection) without building another copy in memory.
+// When writing to a seekable file, long runs of zero bytes (e.g. from page
+// alignment padding) are skipped rather than written, so the filesystem can
+// keep the output sparse.
+
+import (
+	"bytes"
+	"io"
+)
+
+// Runs of zero bytes at least this long are skipped, rather than written, by
+// a sparseWriter. Shorter runs aren't worth a seek, and filesystems can't
+// leave holes smaller than a block anyway.
+const sparseRunLength = 64 * 1024
+
+// Written in place of pending zero bytes that are too few to skip.
+var zeroBlock = make([]byte, sparseRunLength)
+
+// Wraps a seekable writer, such as a file, seeking past long runs of zero
+// bytes rather than writing them. Everything between those runs, including
+// shorter runs of zeros, is passed to the underlying writer in a single call.
+// Finish must be called after the last write, to set the file's size if it
+// ends with a skipped run.
+type sparseWriter struct {
+	w io.WriteSeeker
+	// The number of zero bytes at the end of the data written so far that
+	// haven't been written or seeked past yet, since the run may continue in
+	// the next write.
+	pending int64
+}
+
+// Writes the pending zero bytes, or seeks past them if there are enough.
+func (s *sparseWriter) flushPending() error {
+	if s.pending == 0 {
+		return nil
+	}
+	var e error
+	if s.pending >= sparseRunLength {
+		_, e = s.w.Seek(s.pending, io.SeekCurrent)
+	} else {
+		_, e = s.w.Write(zeroBlock[:s.pending])
+	}
+	s.pending = 0
+	return e
+}
+
+// Returns the number of zero bytes at the start of data.
+func leadingZeros(data []byte) int {
+	for i, b := range data {
+		if b != 0 {
+			return i
+		}
+	}
+	return len(data)
+}
+
+func (s *sparseWriter) Write(data []byte) (int, error) {
+	// A run of zeros continuing from the previous write is skipped along
+	// with the pending bytes if it's long enough in total, and otherwise
+	// written with the data following it.
+	start := 0
+	if s.pending != 0 {
+		zeros := leadingZeros(data)
+		if zeros == len(data) {
+			s.pending += int64(zeros)
+			return len(data), nil
+		}
+		if (s.pending + int64(zeros)) >= sparseRunLength {
+			s.pending += int64(zeros)
+			start = zeros
+		}
+		e := s.flushPending()
+		if e != nil {
+			return 0, e
+		}
+	}
+	// The start of the data that hasn't been written yet.
+	chunkStart := start
+	position := start
+	for position < len(data) {
+		next := bytes.IndexByte(data[position:], 0)
+		if next < 0 {
+			break
+		}
+		runStart := position + next
+		runEnd := runStart + leadingZeros(data[runStart:])
+		if (runEnd < len(data)) && ((runEnd - runStart) < sparseRunLength) {
+			position = runEnd
+			continue
+		}
+		// The run is either long enough to skip, or reaches the end of the
+		// data, so it's left pending in case the next write continues it.
+		if runStart > chunkStart {
+			_, e := s.w.Write(data[chunkStart:runStart])
+			if e != nil {
+				return chunkStart, e
+			}
+		}
+		s.pending = int64(runEnd - runStart)
+		chunkStart = runEnd
+		position = runEnd
+		if runEnd == len(data) {
+			return len(data), nil
+		}
+		e := s.flushPending()
+		if e != nil {
+			return runEnd, e
+		}
+	}
+	if chunkStart < len(data) {
+		_, e := s.w.Write(data[chunkStart:])
+		if e != nil {
+			return chunkStart, e
+		}
+	}
+	return len(data), nil
+}
+
+// Handles any trailing zero bytes. A skipped run at the end of the file is
+// written as a seek followed by a single zero byte, which sets the file's
+// size without needing to truncate it.
+func (s *sparseWriter) Finish() error {
+	if s.pending < sparseRunLength {
+		return s.flushPending()
+	}
+	s.pending--
+	e := s.flushPending()
+	if e != nil {
+		return e
+	}
+	_, e = s.w.Write([]byte{0})
+	return e
+}
+
+// Writes content to w. If w is seekable (e.g. a new or truncated file), long
+// runs of zero bytes are seeked past rather than written, so that the
+// filesystem can leave holes in place of them. In that case, w must be
+// positioned at the end of any data already written. Otherwise (e.g. if w is
+// a pipe), the content is written normally.
+func WriteSparse(w io.Writer, content []byte) (int64, error) {
+	return outputPieces{content}.WriteTo(w)
+}
+
+// Holds the pieces of an output file, which are written in order. Implements
+// io.WriterTo, writing sparsely if w is seekable.
+type outputPieces [][]byte
+
+func (p outputPieces) WriteTo(w io.Writer) (int64, error) {
+	seeker, ok := w.(io.WriteSeeker)
+	if ok {
+		_, e := seeker.Seek(0, io.SeekCurrent)
+		ok = e == nil
+	}
+	if ok {
+		return p.writeSparse(seeker)
+	}
+	var total int64
+	for _, piece := range p {
+		n, e := w.Write(piece)
+		total += int64(n)
+		if e != nil {
+			return total, e
+		}
+	}
+	return total, nil
+}
+
+// Writes the pieces to w using a sparseWriter.
+func (p outputPieces) writeSparse(w io.WriteSeeker) (int64, error) {
+	s := &sparseWriter{
+		w: w,
+	}
+	var total int64
+	for _, piece := range p {
+		_, e := s.Write(piece)
+		if e != nil {
+			return total, e
+		}
+		total += int64(len(piece))
+	}
+	e := s.Finish()
+	if e != nil {
+		return total, e
+	}
+	return total, nil
+}
+
+// Like Replace, but writes the modified ELF file to w rather than returning
+// it. Patching still requires a single working copy of the input, but the
+// unchanged ranges of the file are written directly from the input, followed
+// by the changed ranges and appended data from the working copy, so no
+// further copy of the output is built. Nothing is written if an error occurs
+// while patching, or if options.DryRun is set.
+func ReplaceTo(w io.Writer, input []byte, options Options) (*Report, error) {
+	f, report, e := patchCopy(input, &options)
+	if e != nil {
+		return nil, e
+	}
+	if options.DryRun {
+		return report, nil
+	}
+	_, e = patchedPieces(input, f.Raw, report).WriteTo(w)
+	if e != nil {
+		return nil, e
+	}
+	return report, nil
+}
+
+// Returns the pieces making up the patched file, taking the ranges the report
+// lists as unchanged from the original content, and the rest, including
+// anything appended, from the patched content.
+func patchedPieces(original, patched []byte, report *Report) outputPieces {
+	limit := len(original)
+	if len(patched) < limit {
+		limit = len(patched)
+	}
+	toReturn := make(outputPieces, 0, 2*len(report.Restore)+2)
+	position := 0
+	for _, r := range report.Restore {
+		start := int(r.FileOffset)
+		// The last range may hold the end of a file that shrank.
+		if start >= limit {
+			break
+		}
+		end := start + len(r.Original)
+		toReturn = append(toReturn, original[position:start],
+			patched[start:end])
+		position = end
+	}
+	return append(toReturn, original[position:limit], patched[limit:])
+}
+
+// Like ReplaceEmbedded, but writes the patched blob to w. Unlike
+// ReplaceEmbedded, this never copies the blob: only the ELF image is copied
+// while it's being patched, and the unmodified data surrounding it is written
+// directly from blob. Nothing is written if options.DryRun is set.
+func ReplaceEmbeddedTo(w io.Writer, blob []byte, offset int,
+	options Options) (*Report, error) {
+	image, report, e := replaceEmbeddedImage(blob, offset, options)
+	if e != nil {
+		return nil, e
+	}
+	if options.DryRun {
+		return report, nil
+	}
+	end := offset + len(image)
+	_, e = outputPieces{blob[:offset], image, blob[end:]}.WriteTo(w)
+	if e != nil {
+		return nil, e
+	}
+	return report, nil
+}
@@ -0,0 +1,129 @@
+package stringreplace
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// An in-memory io.WriteSeeker that records how it was used.
+type recordingWriter struct {
+	content []byte
+	offset  int64
+	writes  int
+	// The number of bytes passed to Write, as opposed to seeked past.
+	written int64
+}
+
+func (w *recordingWriter) Write(data []byte) (int, error) {
+	end := w.offset + int64(len(data))
+	if end > int64(len(w.content)) {
+		w.content = append(w.content, make([]byte,
+			end-int64(len(w.content)))...)
+	}
+	copy(w.content[w.offset:], data)
+	w.offset = end
+	w.writes++
+	w.written += int64(len(data))
+	return len(data), nil
+}
+
+func (w *recordingWriter) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		w.offset = offset
+	case io.SeekCurrent:
+		w.offset += offset
+	default:
+		return 0, fmt.Errorf("Unsupported whence: %d", whence)
+	}
+	return w.offset, nil
+}
+
+// Returns content with the given number of bytes made up of short runs of
+// zeros and non-zero bytes, followed by a long run of zeros.
+func sparseTestContent(dataLength, zeroLength int) []byte {
+	toReturn := make([]byte, dataLength+zeroLength)
+	for i := 0; i < dataLength; i++ {
+		// Runs of 7 non-zero bytes separated by single zeros.
+		if (i % 8) != 0 {
+			toReturn[i] = byte(i)
+		}
+	}
+	return toReturn
+}
+
+func TestSparseWriter(t *testing.T) {
+	data := sparseTestContent(1024*1024, 4*sparseRunLength)
+	// Non-zero data after the long run of zeros, which must still be
+	// written at the right offset.
+	data = append(data, 1, 2, 3)
+	w := &recordingWriter{}
+	// Split the content so that pieces end and start in the middle of runs
+	// of zeros, including the long one.
+	split := 1024*1024 + 10
+	pieces := outputPieces{data[:8], data[8:split], data[split:]}
+	n, e := pieces.WriteTo(w)
+	if e != nil {
+		t.Fatalf("Failed writing sparse content: %s", e)
+	}
+	if n != int64(len(data)) {
+		t.Errorf("Expected to write %d bytes, got %d", len(data), n)
+	}
+	if !bytes.Equal(w.content, data) {
+		t.Fatalf("The written content doesn't match the original")
+	}
+	expected := int64(len(data) - 4*sparseRunLength)
+	if w.written != expected {
+		t.Errorf("Expected %d bytes to be written, got %d", expected,
+			w.written)
+	}
+	// The zeros between pieces are written separately, and each piece may
+	// need one more write, but the short runs within a piece mustn't split
+	// it up.
+	if w.writes > 6 {
+		t.Errorf("Expected at most 6 writes, got %d", w.writes)
+	}
+}
+
+func TestSparseWriterTrailingZeros(t *testing.T) {
+	// A trailing run of zeros ends with a single written zero byte, so the
+	// run needs to be longer than sparseRunLength to be skipped.
+	runs := []int{0, 10, sparseRunLength, 3 * sparseRunLength}
+	for _, zeros := range runs {
+		data := sparseTestContent(1000, zeros)
+		w := &recordingWriter{}
+		_, e := WriteSparse(w, data)
+		if e != nil {
+			t.Fatalf("Failed writing %d trailing zeros: %s", zeros, e)
+		}
+		if !bytes.Equal(w.content, data) {
+			t.Errorf("The content with %d trailing zeros wasn't written "+
+				"correctly", zeros)
+		}
+		if (zeros > sparseRunLength) && (w.written != 1001) {
+			t.Errorf("Expected %d trailing zeros to be skipped, but %d "+
+				"bytes were written", zeros, w.written)
+		}
+	}
+}
+
+func BenchmarkWriteSparse(b *testing.B) {
+	data := sparseTestContent(8*1024*1024, 4*sparseRunLength)
+	path := filepath.Join(b.TempDir(), "output")
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		f, e := os.Create(path)
+		if e != nil {
+			b.Fatalf("Failed creating %s: %s", path, e)
+		}
+		_, e = WriteSparse(f, data)
+		f.Close()
+		if e != nil {
+			b.Fatalf("Failed writing %s: %s", path, e)
+		}
+	}
+}
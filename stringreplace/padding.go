@@ -0,0 +1,212 @@
+package stringreplace
+
+// This file contains the logic for placing relocated string tables in unused
+// padding at the end of existing loadable segments, which avoids growing the
+// file or adding a new segment.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/yalue/elf_reader"
+)
+
+// Describes unused, zero-filled file space immediately following the data of
+// a loadable segment, within the segment's last page in memory.
+type paddingRegion struct {
+	segmentIndex   int
+	fileOffset     uint32
+	virtualAddress uint32
+	size           uint32
+}
+
+// Returns the number of bytes starting at offset which aren't used by the ELF
+// header, any section, or any segment, up to limit bytes. Returns 0 if offset
+// is already in use.
+func unusedBytesAt(f *elf_reader.ELF32File, offset, limit uint32) uint32 {
+	end := uint64(offset) + uint64(limit)
+	if end > uint64(len(f.Raw)) {
+		end = uint64(len(f.Raw))
+	}
+	// Trims end to the start of the given range if the range starts after
+	// offset, and returns false if the range contains offset.
+	checkRange := func(start, size uint64) bool {
+		if size == 0 {
+			return true
+		}
+		if (start <= uint64(offset)) && ((start + size) > uint64(offset)) {
+			return false
+		}
+		if (start > uint64(offset)) && (start < end) {
+			end = start
+		}
+		return true
+	}
+	headerSize := uint64(binary.Size(&f.Header))
+	phdrSize := uint64(binary.Size(f.Segments))
+	shdrSize := uint64(binary.Size(f.Sections))
+	if !checkRange(0, headerSize) ||
+		!checkRange(uint64(f.Header.ProgramHeaderOffset), phdrSize) ||
+		!checkRange(uint64(f.Header.SectionHeaderOffset), shdrSize) {
+		return 0
+	}
+	var section *elf_reader.ELF32SectionHeader
+	for i := range f.Sections {
+		section = &(f.Sections[i])
+		// SHT_NOBITS (8) sections don't occupy any file space.
+		if section.Type == 8 {
+			continue
+		}
+		if !checkRange(uint64(section.FileOffset), uint64(section.Size)) {
+			return 0
+		}
+	}
+	var s *elf_reader.ELF32ProgramHeader
+	for i := range f.Segments {
+		s = &(f.Segments[i])
+		if !checkRange(uint64(s.FileOffset), uint64(s.FileSize)) {
+			return 0
+		}
+	}
+	if end <= uint64(offset) {
+		return 0
+	}
+	// Only treat zero bytes as padding, in case some data isn't described by
+	// any header.
+	for i := uint64(offset); i < end; i++ {
+		if f.Raw[i] != 0 {
+			end = i
+			break
+		}
+	}
+	return uint32(end - uint64(offset))
+}
+
+// Returns the unused padding at the end of each readable loadable segment
+// that can be grown in place: segments whose file and memory sizes match, and
+// whose last page in memory isn't shared with another loadable segment.
+func findPaddingRegions(f *elf_reader.ELF32File,
+	report *Report) []paddingRegion {
+	pageSize := loadPageSize(f, report.pageSize)
+	toReturn := make([]paddingRegion, 0, len(f.Segments))
+	var s *elf_reader.ELF32ProgramHeader
+	var fileEnd uint32
+	var memoryEnd, pageLimit uint64
+	for i := range f.Segments {
+		s = &(f.Segments[i])
+		if (s.Type != elf_reader.LoadableSegment) || (s.FileSize == 0) ||
+			(s.FileSize != s.MemorySize) || ((uint32(s.Flags) & 4) == 0) {
+			continue
+		}
+		fileEnd = s.FileOffset + s.FileSize
+		memoryEnd = uint64(s.VirtualAddress) + uint64(s.MemorySize)
+		pageLimit = pageEnd(memoryEnd, pageSize)
+		if (pageLimit == memoryEnd) || overlapsOtherLoadSegment(f, i,
+			memoryEnd, pageLimit) {
+			continue
+		}
+		size := unusedBytesAt(f, fileEnd, uint32(pageLimit-memoryEnd))
+		if size == 0 {
+			continue
+		}
+		toReturn = append(toReturn, paddingRegion{
+			segmentIndex:   i,
+			fileOffset:     fileEnd,
+			virtualAddress: uint32(memoryEnd),
+			size:           size,
+		})
+	}
+	return toReturn
+}
+
+// Returns true if any loadable segment other than the one at the given index
+// overlaps the given range of addresses.
+func overlapsOtherLoadSegment(f *elf_reader.ELF32File, index int, start,
+	end uint64) bool {
+	var s *elf_reader.ELF32ProgramHeader
+	for i := range f.Segments {
+		s = &(f.Segments[i])
+		if (i == index) || (s.Type != elf_reader.LoadableSegment) {
+			continue
+		}
+		if (start < (uint64(s.VirtualAddress) + uint64(s.MemorySize))) &&
+			(end > uint64(s.VirtualAddress)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Attempts to place every new table in the padding at the end of existing
+// loadable segments, growing those segments to cover the tables. Returns
+// false without modifying f if the tables don't all fit. On success, sets the
+// newFileOffset, newVirtualAddress and newSegmentIndex fields of each table,
+// updates the section and program headers, and adds the grown segments to
+// the report.
+func placeTablesInPadding(f *elf_reader.ELF32File,
+	newTables []replacedStringTable, report *Report) (bool, error) {
+	regions := findPaddingRegions(f, report)
+	placements := make([]int, len(newTables))
+	used := make([]uint32, len(regions))
+	var size uint32
+	for i := range newTables {
+		placements[i] = -1
+		size = uint32(len(newTables[i].newContent))
+		for j := range regions {
+			if (regions[j].size - used[j]) >= size {
+				placements[i] = j
+				used[j] += size
+				break
+			}
+		}
+		if placements[i] < 0 {
+			report.logf("Not enough segment padding for the string table in "+
+				"section %d; appending it instead.\n",
+				newTables[i].sectionIndex)
+			return false, nil
+		}
+	}
+	var t *replacedStringTable
+	var r *paddingRegion
+	var section *elf_reader.ELF32SectionHeader
+	var segment *elf_reader.ELF32ProgramHeader
+	for i := range newTables {
+		t = &(newTables[i])
+		r = &(regions[placements[i]])
+		size = uint32(len(t.newContent))
+		t.newFileOffset = r.fileOffset
+		t.newVirtualAddress = r.virtualAddress
+		t.newSegmentIndex = r.segmentIndex
+		copy(f.Raw[r.fileOffset:], t.newContent)
+		r.fileOffset += size
+		r.virtualAddress += size
+		section = &(f.Sections[t.sectionIndex])
+		section.VirtualAddress = t.newVirtualAddress
+		section.FileOffset = t.newFileOffset
+		section.Size = size
+		segment = &(f.Segments[r.segmentIndex])
+		segment.FileSize = r.fileOffset - segment.FileOffset
+		segment.MemorySize = segment.FileSize
+		report.logf("String table in section %d moved from %s to padding in "+
+			"%s\n", t.sectionIndex, describeSegment(f, t.oldSegmentIndex),
+			describeSegment(f, t.newSegmentIndex))
+	}
+	e := writeAtELFOffset(f, f.Header.SectionHeaderOffset, f.Sections,
+		"section headers")
+	if e != nil {
+		return false, fmt.Errorf("Error updating section headers: %s", e)
+	}
+	e = writeAtELFOffset(f, f.Header.ProgramHeaderOffset, f.Segments,
+		"program headers")
+	if e != nil {
+		return false, fmt.Errorf("Error updating program headers: %s", e)
+	}
+	e = reparseELF(f)
+	if e != nil {
+		return false, fmt.Errorf("Error re-parsing ELF file after placing "+
+			"string tables in padding: %s", e)
+	}
+	for i := range newTables {
+		report.addSegment(f, newTables[i].newSegmentIndex, true)
+	}
+	return true, nil
+}
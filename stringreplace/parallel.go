@@ -0,0 +1,54 @@
+package stringreplace
+
+import (
+	"runtime"
+	"sync"
+)
+
+// Returns the number of goroutines to use for the given Parallelism setting.
+// Values less than 1 select the number of usable CPUs.
+func effectiveParallelism(parallelism int) int {
+	if parallelism < 1 {
+		return runtime.GOMAXPROCS(0)
+	}
+	return parallelism
+}
+
+// Calls work(i) for every i in [0, count), using up to parallelism goroutines
+// at once. Returns the error from the lowest i for which work failed, or nil
+// if every call succeeded. The work function must be safe to call
+// concurrently.
+func runParallel(count, parallelism int, work func(i int) error) error {
+	if parallelism > count {
+		parallelism = count
+	}
+	errors := make([]error, count)
+	if parallelism <= 1 {
+		for i := 0; i < count; i++ {
+			errors[i] = work(i)
+		}
+	} else {
+		indices := make(chan int)
+		var wg sync.WaitGroup
+		wg.Add(parallelism)
+		for j := 0; j < parallelism; j++ {
+			go func() {
+				defer wg.Done()
+				for i := range indices {
+					errors[i] = work(i)
+				}
+			}()
+		}
+		for i := 0; i < count; i++ {
+			indices <- i
+		}
+		close(indices)
+		wg.Wait()
+	}
+	for _, e := range errors {
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
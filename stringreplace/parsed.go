@@ -0,0 +1,129 @@
+package stringreplace
+
+// This file contains the ParsedFile type, which lets several independent sets
+// of rules be applied to the same ELF file without re-parsing it, or
+// re-splitting its string tables, each time.
+
+import (
+	"fmt"
+	"github.com/yalue/elf_reader"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Identifies a string table by its location in the file.
+type tableLocation struct {
+	offset uint32
+	size   uint32
+}
+
+// Holds state derived from an unmodified ELF file, which is shared by every
+// replacement computed from the same ParsedFile. Safe for concurrent use.
+type fileCache struct {
+	mutex sync.Mutex
+	// The strings in each string table, as split by doReplacements.
+	tableStrings map[tableLocation][]string
+}
+
+// Returns the strings in the string table with the given file offset and
+// content, splitting the content only the first time the table is seen. The
+// returned slice must not be modified. Works with a nil cache, in which case
+// the content is always split.
+func (c *fileCache) splitTable(offset uint32, content []byte) []string {
+	if c == nil {
+		return strings.Split(string(content), "\x00")
+	}
+	location := tableLocation{
+		offset: offset,
+		size:   uint32(len(content)),
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	toReturn, ok := c.tableStrings[location]
+	if !ok {
+		toReturn = strings.Split(string(content), "\x00")
+		c.tableStrings[location] = toReturn
+	}
+	return toReturn
+}
+
+// Holds an ELF file that has been parsed once, to which any number of
+// independent sets of rules can be applied, e.g. to produce several variants
+// of the same library. Each application starts from the original file, and
+// never modifies it, so a ParsedFile is safe to use concurrently.
+type ParsedFile struct {
+	original *elf_reader.ELF32File
+	cache    *fileCache
+}
+
+// Returns a copy of the parsed file, which can be modified without affecting
+// the original.
+func cloneELF32File(f *elf_reader.ELF32File) *elf_reader.ELF32File {
+	clone := *f
+	clone.Raw = append([]byte(nil), f.Raw...)
+	clone.Sections = append([]elf_reader.ELF32SectionHeader(nil),
+		f.Sections...)
+	clone.Segments = append([]elf_reader.ELF32ProgramHeader(nil),
+		f.Segments...)
+	return &clone
+}
+
+// Parses the given 32-bit ELF file content, so that rules can be applied to
+// it repeatedly. The input slice is not modified, or referred to by the
+// returned ParsedFile.
+func Parse(input []byte) (*ParsedFile, error) {
+	raw := make([]byte, len(input))
+	copy(raw, input)
+	f, e := ParseELF32File(raw)
+	if e != nil {
+		return nil, fmt.Errorf("Failed parsing the input file: %s", e)
+	}
+	return &ParsedFile{
+		original: f,
+		cache: &fileCache{
+			tableStrings: make(map[tableLocation][]string),
+		},
+	}, nil
+}
+
+// Returns a copy of the parsed file, which the caller may modify, e.g. to
+// pass to ReplaceStrings.
+func (p *ParsedFile) File() *elf_reader.ELF32File {
+	return cloneELF32File(p.original)
+}
+
+// Like the Replace function, but starts from a copy of the parsed file
+// rather than parsing the input again. The report's first timing is the time
+// taken to copy the file, rather than to parse it.
+func (p *ParsedFile) Replace(options Options) ([]byte, *Report, error) {
+	start := time.Now()
+	f := cloneELF32File(p.original)
+	copyTime := time.Since(start)
+	options.cache = p.cache
+	report, e := ReplaceStrings(f, &options)
+	if e != nil {
+		return nil, nil, e
+	}
+	report.prependTiming("copy", copyTime)
+	if options.DryRun {
+		return nil, report, nil
+	}
+	return f.Raw, report, nil
+}
+
+// Like the Analyze function, but starts from a copy of the parsed file rather
+// than parsing the input again.
+func (p *ParsedFile) Analyze(options Options) (*Analysis, error) {
+	start := time.Now()
+	f := cloneELF32File(p.original)
+	copyTime := time.Since(start)
+	options.cache = p.cache
+	analysis, e := analyzeFile(f, &options)
+	if e != nil {
+		return nil, e
+	}
+	analysis.Timings = append([]PhaseTiming{{"copy", copyTime}},
+		analysis.Timings...)
+	return analysis, nil
+}
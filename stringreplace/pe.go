@@ -0,0 +1,416 @@
+package stringreplace
+
+// This file contains support for renaming DLL dependencies in PE files: the
+// names in the import directory and the delay-load import directory. Names
+// are overwritten in place if the new name fits, and are otherwise placed in
+// unused space at the end of a section.
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// The indices of the PE data directories used here.
+const (
+	peImportDirectory      = 1
+	peSecurityDirectory    = 4
+	peBoundImportDirectory = 11
+	peDelayImportDirectory = 13
+)
+
+// Describes a DLL name replaced in a PE file.
+type PEChange struct {
+	// The directory containing the reference: "import" or "delay_import".
+	Directory string `json:"directory"`
+	// The index of the descriptor within the directory.
+	DescriptorIndex uint32 `json:"descriptor_index"`
+	// The relative virtual addresses of the original and new names. These
+	// are the same if the name was overwritten in place.
+	OriginalRVA uint32 `json:"original_rva"`
+	NewRVA      uint32 `json:"new_rva"`
+	// The original and new names, escaped using EscapeString.
+	Original string `json:"original"`
+	New      string `json:"new"`
+}
+
+// Holds the parts of a PE file's headers needed to rename imports.
+type peFile struct {
+	data []byte
+	// The file offsets of the optional header, its data directories, and the
+	// section table.
+	optionalHeaderOffset uint32
+	directoriesOffset    uint32
+	directoryCount       uint32
+	sectionsOffset       uint32
+	sectionCount         uint32
+	imageBase            uint64
+	// The RVAs of the names that have been replaced so far, mapped to the
+	// RVAs of their new names, so that names shared by several descriptors
+	// are only replaced once.
+	movedNames map[uint32]uint32
+}
+
+// Returns the file offset of the PE signature, or 0 if the data doesn't
+// start with a DOS header pointing to one.
+func peSignatureOffset(data []byte) uint32 {
+	if (len(data) < 0x40) || (data[0] != 'M') || (data[1] != 'Z') {
+		return 0
+	}
+	offset := binary.LittleEndian.Uint32(data[0x3c:])
+	if (offset < 0x40) || ((uint64(offset) + 24) > uint64(len(data))) {
+		return 0
+	}
+	if string(data[offset:offset+4]) != "PE\x00\x00" {
+		return 0
+	}
+	return offset
+}
+
+// Returns true if the data starts with the headers of a PE file, such as a
+// Windows executable or DLL.
+func IsPEFile(data []byte) bool {
+	return peSignatureOffset(data) != 0
+}
+
+// Parses the headers of a PE file.
+func parsePEFile(data []byte) (*peFile, error) {
+	signature := peSignatureOffset(data)
+	if signature == 0 {
+		return nil, fmt.Errorf("Not a PE file")
+	}
+	toReturn := &peFile{
+		data:       data,
+		movedNames: make(map[uint32]uint32),
+	}
+	// The 20-byte COFF header follows the signature, and is followed by the
+	// optional header and the section table.
+	coff := signature + 4
+	toReturn.sectionCount = uint32(binary.LittleEndian.Uint16(data[coff+2:]))
+	optionalSize := uint32(binary.LittleEndian.Uint16(data[coff+16:]))
+	toReturn.optionalHeaderOffset = coff + 20
+	toReturn.sectionsOffset = toReturn.optionalHeaderOffset + optionalSize
+	if (uint64(toReturn.sectionsOffset) + 40*uint64(toReturn.sectionCount)) >
+		uint64(len(data)) {
+		return nil, fmt.Errorf("The section table extends past the end of " +
+			"the file")
+	}
+	optional := toReturn.optionalHeaderOffset
+	if optionalSize < 2 {
+		return nil, fmt.Errorf("The file has no optional header")
+	}
+	var directories uint32
+	switch binary.LittleEndian.Uint16(data[optional:]) {
+	case 0x10b:
+		// PE32
+		directories = 96
+		if optionalSize >= 32 {
+			toReturn.imageBase = uint64(binary.LittleEndian.Uint32(
+				data[optional+28:]))
+		}
+	case 0x20b:
+		// PE32+
+		directories = 112
+		if optionalSize >= 32 {
+			toReturn.imageBase = binary.LittleEndian.Uint64(data[optional+24:])
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported optional header magic 0x%x",
+			binary.LittleEndian.Uint16(data[optional:]))
+	}
+	if optionalSize < directories {
+		return nil, fmt.Errorf("The optional header is too short (%d bytes)",
+			optionalSize)
+	}
+	toReturn.directoriesOffset = optional + directories
+	toReturn.directoryCount = binary.LittleEndian.Uint32(
+		data[optional+directories-4:])
+	if (directories + 8*toReturn.directoryCount) > optionalSize {
+		toReturn.directoryCount = (optionalSize - directories) / 8
+	}
+	return toReturn, nil
+}
+
+// Returns the RVA and size of the data directory with the given index, or
+// zeros if the file doesn't have it.
+func (f *peFile) directory(index uint32) (uint32, uint32) {
+	if index >= f.directoryCount {
+		return 0, 0
+	}
+	offset := f.directoriesOffset + index*8
+	return binary.LittleEndian.Uint32(f.data[offset:]),
+		binary.LittleEndian.Uint32(f.data[offset+4:])
+}
+
+// Returns the section header at the given index.
+func (f *peFile) sectionHeader(index uint32) []byte {
+	offset := f.sectionsOffset + index*40
+	return f.data[offset : offset+40]
+}
+
+// Converts an RVA to a file offset. Returns an error if the RVA isn't backed
+// by file data.
+func (f *peFile) rvaToOffset(rva uint32) (uint32, error) {
+	for i := uint32(0); i < f.sectionCount; i++ {
+		header := f.sectionHeader(i)
+		virtualSize := binary.LittleEndian.Uint32(header[8:])
+		address := binary.LittleEndian.Uint32(header[12:])
+		rawSize := binary.LittleEndian.Uint32(header[16:])
+		rawOffset := binary.LittleEndian.Uint32(header[20:])
+		if virtualSize == 0 {
+			virtualSize = rawSize
+		}
+		if (rva < address) || (uint64(rva) >= (uint64(address) +
+			uint64(virtualSize))) {
+			continue
+		}
+		if (rva - address) >= rawSize {
+			break
+		}
+		offset := uint64(rawOffset) + uint64(rva-address)
+		if offset >= uint64(len(f.data)) {
+			break
+		}
+		return uint32(offset), nil
+	}
+	return 0, fmt.Errorf("RVA 0x%08x isn't in any section's file data", rva)
+}
+
+// Returns the NUL-terminated string at the given RVA.
+func (f *peFile) readString(rva uint32) (string, error) {
+	offset, e := f.rvaToOffset(rva)
+	if e != nil {
+		return "", e
+	}
+	for i := offset; i < uint32(len(f.data)); i++ {
+		if f.data[i] == 0 {
+			return string(f.data[offset:i]), nil
+		}
+	}
+	return "", fmt.Errorf("The string at RVA 0x%08x isn't terminated", rva)
+}
+
+// Finds room for a string of the given size (including its NUL terminator)
+// in the file data between the end of a readable, initialized-data
+// section's virtual size and the end of its raw data, which is zero-filled
+// padding. The section's virtual size is grown to cover the string, so it's
+// loaded. Returns the string's RVA and file offset.
+func (f *peFile) allocate(size uint32) (uint32, uint32, error) {
+	for i := uint32(0); i < f.sectionCount; i++ {
+		header := f.sectionHeader(i)
+		virtualSize := binary.LittleEndian.Uint32(header[8:])
+		address := binary.LittleEndian.Uint32(header[12:])
+		rawSize := binary.LittleEndian.Uint32(header[16:])
+		rawOffset := binary.LittleEndian.Uint32(header[20:])
+		characteristics := binary.LittleEndian.Uint32(header[36:])
+		// IMAGE_SCN_CNT_INITIALIZED_DATA and IMAGE_SCN_MEM_READ
+		if (characteristics & 0x40000040) != 0x40000040 {
+			continue
+		}
+		if (virtualSize == 0) || (virtualSize >= rawSize) ||
+			((uint64(rawOffset) + uint64(rawSize)) > uint64(len(f.data))) {
+			continue
+		}
+		if (rawSize - virtualSize) < size {
+			continue
+		}
+		// Only use space that is still zero, in case the padding holds data
+		// after all.
+		start := rawOffset + virtualSize
+		allZero := true
+		for j := start; j < (start + size); j++ {
+			if f.data[j] != 0 {
+				allZero = false
+				break
+			}
+		}
+		if !allZero {
+			continue
+		}
+		binary.LittleEndian.PutUint32(header[8:], virtualSize+size)
+		return address + virtualSize, start, nil
+	}
+	return 0, 0, fmt.Errorf("No section has %d bytes of unused padding for "+
+		"the new name", size)
+}
+
+// Replaces the name at the given RVA, if any rules apply to it. Returns the
+// RVA of the new name, which is the same unless the name had to be moved,
+// and the change, or nil if the name wasn't changed.
+func (f *peFile) replaceName(rva uint32, directory string,
+	options *Options) (uint32, *PEChange, error) {
+	if newRVA, ok := f.movedNames[rva]; ok {
+		return newRVA, nil, nil
+	}
+	oldName, e := f.readString(rva)
+	if e != nil {
+		return 0, nil, e
+	}
+	newName := applyNamedRules(options, directory, oldName)
+	if newName == oldName {
+		return rva, nil, nil
+	}
+	if !options.AllowRawBytes {
+		e = checkRawBytes(oldName, newName, false)
+		if e != nil {
+			return 0, nil, e
+		}
+	}
+	newRVA := rva
+	offset, _ := f.rvaToOffset(rva)
+	if len(newName) <= len(oldName) {
+		copy(f.data[offset:], newName)
+		for i := len(newName); i < len(oldName); i++ {
+			f.data[int(offset)+i] = 0
+		}
+	} else {
+		newRVA, offset, e = f.allocate(uint32(len(newName)) + 1)
+		if e != nil {
+			return 0, nil, e
+		}
+		copy(f.data[offset:], newName)
+		f.data[int(offset)+len(newName)] = 0
+	}
+	f.movedNames[rva] = newRVA
+	options.logf("Replaced %s DLL name at RVA 0x%08x: %s -> %s (RVA 0x%08x)\n",
+		directory, rva, EscapeString(oldName), EscapeString(newName), newRVA)
+	return newRVA, &PEChange{
+		Directory:   directory,
+		OriginalRVA: rva,
+		NewRVA:      newRVA,
+		Original:    EscapeString(oldName),
+		New:         EscapeString(newName),
+	}, nil
+}
+
+// Renames the DLLs in the import directory (20-byte descriptors with the
+// name's RVA at offset 12) or the delay-load import directory (32-byte
+// descriptors with the name at offset 4). Both lists end with a descriptor
+// that is all zeros.
+func (f *peFile) replaceDirectoryNames(index uint32, directory string,
+	descriptorSize, nameField uint32, options *Options) ([]PEChange, error) {
+	rva, size := f.directory(index)
+	if (rva == 0) || (size == 0) {
+		return nil, nil
+	}
+	offset, e := f.rvaToOffset(rva)
+	if e != nil {
+		return nil, fmt.Errorf("Bad %s directory: %s", directory, e)
+	}
+	var changes []PEChange
+	for i := uint32(0); ; i++ {
+		descriptor := uint64(offset) + uint64(i)*uint64(descriptorSize)
+		if (descriptor + uint64(descriptorSize)) > uint64(len(f.data)) {
+			return nil, fmt.Errorf("The %s directory isn't terminated",
+				directory)
+		}
+		nameOffset := uint32(descriptor) + nameField
+		nameRVA := binary.LittleEndian.Uint32(f.data[nameOffset:])
+		if nameRVA == 0 {
+			break
+		}
+		// Delay-load descriptors without the RVA attribute (bit 0) use
+		// virtual addresses, as produced by old versions of Visual C++.
+		isVA := (index == peDelayImportDirectory) &&
+			((binary.LittleEndian.Uint32(f.data[descriptor:]) & 1) == 0)
+		if isVA {
+			nameRVA = uint32(uint64(nameRVA) - f.imageBase)
+		}
+		newRVA, change, e := f.replaceName(nameRVA, directory, options)
+		if e != nil {
+			return nil, fmt.Errorf("Failed renaming %s descriptor %d: %s",
+				directory, i, e)
+		}
+		if newRVA != nameRVA {
+			value := newRVA
+			if isVA {
+				value = uint32(uint64(newRVA) + f.imageBase)
+			}
+			binary.LittleEndian.PutUint32(f.data[nameOffset:], value)
+		}
+		if change != nil {
+			change.DescriptorIndex = i
+			changes = append(changes, *change)
+		}
+	}
+	return changes, nil
+}
+
+// Returns the PE checksum of the data, as computed by the Windows
+// CheckSumMappedFile function: a 16-bit ones' complement sum of the file,
+// excluding the checksum field at the given offset, plus the file's size.
+func peChecksum(data []byte, checksumOffset uint32) uint32 {
+	var sum uint64
+	for i := 0; i < len(data); i += 2 {
+		if (uint32(i) >= checksumOffset) && (uint32(i) < (checksumOffset + 4)) {
+			continue
+		}
+		word := uint64(data[i])
+		if (i + 1) < len(data) {
+			word |= uint64(data[i+1]) << 8
+		}
+		sum += word
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	sum = (sum & 0xffff) + (sum >> 16)
+	return uint32(sum) + uint32(len(data))
+}
+
+// Returns a copy of the data with DLL names in the PE file's import and
+// delay-load import directories replaced according to the options. Only
+// Rules, NotMatching, ExcludeSections, and AllowRawBytes are used; the
+// directory's name ("import" or "delay_import") is used in place of a
+// section name. The file's size never changes: longer names are placed in
+// the zero padding at the end of a section. The optional header's checksum
+// is updated if it was set.
+func ReplacePE(input []byte, options *Options) ([]byte, []PEChange, error) {
+	if len(options.Rules) == 0 {
+		return nil, nil, fmt.Errorf("No replacement rules were provided")
+	}
+	e := options.validateRules()
+	if e != nil {
+		return nil, nil, e
+	}
+	output := make([]byte, len(input))
+	copy(output, input)
+	f, e := parsePEFile(output)
+	if e != nil {
+		return nil, nil, e
+	}
+	changes, e := f.replaceDirectoryNames(peImportDirectory, "import", 20, 12,
+		options)
+	if e != nil {
+		return nil, nil, e
+	}
+	delayChanges, e := f.replaceDirectoryNames(peDelayImportDirectory,
+		"delay_import", 32, 4, options)
+	if e != nil {
+		return nil, nil, e
+	}
+	changes = append(changes, delayChanges...)
+	if len(changes) == 0 {
+		return output, changes, nil
+	}
+	// Bound imports record the old names and timestamps, so drop them, and
+	// let the loader resolve the imports normally.
+	rva, _ := f.directory(peBoundImportDirectory)
+	if rva != 0 {
+		offset := f.directoriesOffset + peBoundImportDirectory*8
+		binary.LittleEndian.PutUint64(output[offset:], 0)
+		options.logf("WARNING: Removed the bound import directory, which " +
+			"referred to the original DLL names.\n")
+	}
+	rva, _ = f.directory(peSecurityDirectory)
+	if rva != 0 {
+		options.logf("WARNING: The file's Authenticode signature is no " +
+			"longer valid, and it must be re-signed.\n")
+	}
+	checksumOffset := f.optionalHeaderOffset + 64
+	oldChecksum := binary.LittleEndian.Uint32(output[checksumOffset:])
+	if oldChecksum != 0 {
+		newChecksum := peChecksum(output, checksumOffset)
+		binary.LittleEndian.PutUint32(output[checksumOffset:], newChecksum)
+		options.logf("Updated the PE checksum: 0x%08x -> 0x%08x\n", oldChecksum,
+			newChecksum)
+	}
+	return output, changes, nil
+}
@@ -0,0 +1,108 @@
+package stringreplace
+
+// This file contains a check, run after patching, for loadable segments with
+// permissions that hardened kernels and SELinux policies refuse to map (or
+// that defeat W^X protections), so problems introduced by a patch are
+// reported before the output is deployed.
+
+import (
+	"github.com/yalue/elf_reader"
+)
+
+// Returns a description of what's wrong with the given program header
+// permissions for a loadable segment, or an empty string if they're fine.
+func segmentPermissionProblem(flags uint32) string {
+	// PF_X is 1, PF_W is 2, and PF_R is 4.
+	if ((flags & 2) != 0) && ((flags & 1) != 0) {
+		return "writable and executable"
+	}
+	if ((flags & 2) != 0) && ((flags & 4) == 0) {
+		return "writable but not readable"
+	}
+	return ""
+}
+
+// The permissions relevant to checkSegmentPermissions, recorded before
+// patching.
+type permissionSnapshot struct {
+	// Maps the index of each loadable segment with dangerous permissions to
+	// a description of the problem.
+	problems map[int]string
+	// The section indices of the string tables in writable segments.
+	writableTables map[uint16]bool
+}
+
+// Returns a description of each loadable segment with dangerous permissions,
+// keyed by segment index.
+func segmentPermissionProblems(f *elf_reader.ELF32File) map[int]string {
+	toReturn := make(map[int]string)
+	for i := range f.Segments {
+		s := &(f.Segments[i])
+		if s.Type != elf_reader.LoadableSegment {
+			continue
+		}
+		problem := segmentPermissionProblem(uint32(s.Flags))
+		if problem != "" {
+			toReturn[i] = problem
+		}
+	}
+	return toReturn
+}
+
+// Records the permissions of the file's loadable segments, and of the
+// segments containing the given tables, before they're relocated.
+func snapshotPermissions(f *elf_reader.ELF32File,
+	tables []replacedStringTable) *permissionSnapshot {
+	toReturn := &permissionSnapshot{
+		problems:       segmentPermissionProblems(f),
+		writableTables: make(map[uint16]bool),
+	}
+	for i := range tables {
+		t := &(tables[i])
+		if (t.oldSegmentIndex < 0) || (t.oldSegmentIndex >= len(f.Segments)) {
+			continue
+		}
+		if (uint32(f.Segments[t.oldSegmentIndex].Flags) & 2) != 0 {
+			toReturn.writableTables[t.sectionIndex] = true
+		}
+	}
+	return toReturn
+}
+
+// Adds a warning to the report for each loadable segment with dangerous
+// permissions that weren't already present in the same segment before
+// patching, and for each string table moved from read-only memory into a
+// writable segment. Problems present in the input are only logged.
+func checkSegmentPermissions(f *elf_reader.ELF32File,
+	before *permissionSnapshot, tables []replacedStringTable,
+	report *Report) {
+	after := segmentPermissionProblems(f)
+	for i := range f.Segments {
+		problem, ok := after[i]
+		if !ok {
+			continue
+		}
+		if before.problems[i] == problem {
+			report.logf("The input's %s is already %s.\n",
+				describeSegment(f, i), problem)
+			continue
+		}
+		report.addWarning("After patching, %s is %s, which hardened "+
+			"kernels and SELinux policies may refuse to map",
+			describeSegment(f, i), problem)
+	}
+	for i := range tables {
+		t := &(tables[i])
+		if (t.oldSegmentIndex < 0) || (t.newSegmentIndex < 0) ||
+			(t.newSegmentIndex >= len(f.Segments)) ||
+			before.writableTables[t.sectionIndex] {
+			continue
+		}
+		if (uint32(f.Segments[t.newSegmentIndex].Flags) & 2) == 0 {
+			continue
+		}
+		report.addWarning("The string table in section %d was moved from "+
+			"read-only memory into %s", t.sectionIndex,
+			describeSegment(f, t.newSegmentIndex))
+	}
+}
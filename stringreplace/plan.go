@@ -0,0 +1,141 @@
+package stringreplace
+
+// This file contains the Plan type, which separates computing a patch from
+// applying it. A plan lists every byte range the patch overwrites and the
+// data it appends, so callers can inspect it, serialize it (e.g. as JSON),
+// or compare the plans for two sets of rules, and then apply it to any file
+// identical to the one it was computed from without repeating the analysis.
+
+import (
+	"fmt"
+)
+
+// A range of the input file overwritten by a plan.
+type PlanWrite struct {
+	FileOffset uint32 `json:"file_offset"`
+	// The input's content in this range, before it's overwritten.
+	Original []byte `json:"original"`
+	// The content written to this range.
+	Data []byte `json:"data"`
+}
+
+// Describes every change patching a file makes, without changing it. Apply
+// produces the patched file from the original content.
+type Plan struct {
+	// The size and hex-encoded SHA-256 digest of the file the plan was
+	// computed from. The plan may only be applied to identical content.
+	InputSize   uint32 `json:"input_size"`
+	InputSHA256 string `json:"input_sha256"`
+	// The size and digest of the patched file.
+	OutputSize   uint32 `json:"output_size"`
+	OutputSHA256 string `json:"output_sha256"`
+	// The ranges of the input that are overwritten, in order of offset.
+	Writes []PlanWrite `json:"writes"`
+	// The data appended after the end of the input, such as the relocated
+	// string tables and program headers. If OutputSize is smaller than
+	// InputSize, this is empty and the file is truncated instead.
+	Appended []byte `json:"appended"`
+	// The report describing the patch, as returned by Replace.
+	Report *Report `json:"report"`
+}
+
+// Returns a plan to turn the original content into the patched content.
+func newPlan(original, patched []byte, report *Report) *Plan {
+	toReturn := &Plan{
+		InputSize:    uint32(len(original)),
+		InputSHA256:  contentDigest(original),
+		OutputSize:   uint32(len(patched)),
+		OutputSHA256: contentDigest(patched),
+		Writes:       make([]PlanWrite, 0, 16),
+		Report:       report,
+	}
+	for _, changed := range changedRanges(original, patched) {
+		toReturn.Writes = append(toReturn.Writes, PlanWrite{
+			FileOffset: uint32(changed.start),
+			Original: append([]byte(nil),
+				original[changed.start:changed.end]...),
+			Data: append([]byte(nil), patched[changed.start:changed.end]...),
+		})
+	}
+	if len(patched) > len(original) {
+		toReturn.Appended = append([]byte(nil), patched[len(original):]...)
+	}
+	return toReturn
+}
+
+// Computes the changes Replace would make to the given 32-bit ELF file
+// content, without producing the patched file. The input slice is not
+// modified. The options' hooks are called while computing the plan, and any
+// changes a PatchHook makes are included in it.
+func ComputePlan(input []byte, options Options) (*Plan, error) {
+	patched, report, e := Replace(input, options)
+	if e != nil {
+		return nil, e
+	}
+	start := report.startPhase("plan")
+	toReturn := newPlan(input, patched, report)
+	report.addTiming("plan", start)
+	return toReturn, nil
+}
+
+// Like ComputePlan, but starts from a copy of the parsed file rather than
+// parsing the input again.
+func (p *ParsedFile) Plan(options Options) (*Plan, error) {
+	patched, report, e := p.Replace(options)
+	if e != nil {
+		return nil, e
+	}
+	start := report.startPhase("plan")
+	toReturn := newPlan(p.original.Raw, patched, report)
+	report.addTiming("plan", start)
+	return toReturn, nil
+}
+
+// Returns true if the plan can be applied to the given content, i.e. if the
+// content is identical to the file the plan was computed from.
+func (p *Plan) Matches(input []byte) bool {
+	return (uint32(len(input)) == p.InputSize) &&
+		(contentDigest(input) == p.InputSHA256)
+}
+
+// Returns true if the plan doesn't change the file.
+func (p *Plan) Empty() bool {
+	return (len(p.Writes) == 0) && (p.InputSize == p.OutputSize)
+}
+
+// Applies the plan to the given content, which must be identical to the file
+// the plan was computed from, and returns the patched content. Nothing is
+// recomputed, so this is much faster than calling Replace again, e.g. when
+// patching many copies of the same file. The input slice is not modified.
+func (p *Plan) Apply(input []byte) ([]byte, error) {
+	if !p.Matches(input) {
+		return nil, fmt.Errorf("The file's SHA-256 digest doesn't match the " +
+			"file the plan was computed from")
+	}
+	size := p.OutputSize
+	if p.InputSize < size {
+		size = p.InputSize
+	}
+	if (uint64(p.InputSize) + uint64(len(p.Appended))) <
+		uint64(p.OutputSize) {
+		return nil, fmt.Errorf("The plan's appended data (%d bytes) doesn't "+
+			"reach its output size (%d bytes)", len(p.Appended), p.OutputSize)
+	}
+	toReturn := make([]byte, p.OutputSize)
+	copy(toReturn, input[:size])
+	for _, w := range p.Writes {
+		if (uint64(w.FileOffset) + uint64(len(w.Data))) > uint64(size) {
+			return nil, fmt.Errorf("Invalid write at offset 0x%08x: extends "+
+				"past the end of the file", w.FileOffset)
+		}
+		copy(toReturn[w.FileOffset:], w.Data)
+	}
+	if p.OutputSize > p.InputSize {
+		copy(toReturn[p.InputSize:], p.Appended)
+	}
+	if contentDigest(toReturn) != p.OutputSHA256 {
+		return nil, fmt.Errorf("The patched file's SHA-256 digest doesn't " +
+			"match the plan")
+	}
+	return toReturn, nil
+}
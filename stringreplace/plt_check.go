@@ -0,0 +1,222 @@
+package stringreplace
+
+// This file contains a check, run after patching, that the dynamic
+// relocations (including the ones binding the PLT and GOT) still refer to the
+// intended symbols. Nothing is disassembled: every relocation in a SHT_REL or
+// SHT_RELA section linked to a dynamic symbol table must refer to a symbol
+// inside the table, each symbol whose name changed must have had its st_name
+// updated by the patch (rather than overwritten by something else), and
+// DT_JMPREL and DT_PLTRELSZ must still describe relocations in one of those
+// sections, since the loader finds the PLT relocations through them.
+
+import (
+	"fmt"
+	"github.com/yalue/elf_reader"
+)
+
+// The size of an Elf32_Rel entry: r_offset and r_info.
+const relEntrySize = 8
+
+// The symbol a dynamic relocation refers to.
+type relocationTarget struct {
+	// The symbol's index, the file offset of its st_name field, and its
+	// name.
+	symbol     uint32
+	nameOffset uint32
+	name       string
+}
+
+// Holds the targets of the dynamic relocations, keyed by the relocation
+// section's index and the relocation's index in it, and a description of
+// each problem found, keyed in the same way. Problems with a whole section
+// use index 0xffffffff, and problems with DT_JMPREL use section 0xffff.
+type relocationTargets struct {
+	targets  map[symbolLocation]relocationTarget
+	problems map[symbolLocation]string
+}
+
+// Returns the indices of the relocation sections (SHT_REL is 9, and SHT_RELA
+// is 4) linked to a dynamic symbol table.
+func dynamicRelocationSections(f *elf_reader.ELF32File) []uint16 {
+	var toReturn []uint16
+	for i := range f.Sections {
+		section := &(f.Sections[i])
+		if (section.Type != 9) && (section.Type != 4) {
+			continue
+		}
+		link := section.LinkedIndex
+		// SHT_DYNSYM is 11.
+		if (link >= uint32(len(f.Sections))) || (f.Sections[link].Type != 11) {
+			continue
+		}
+		toReturn = append(toReturn, uint16(i))
+	}
+	return toReturn
+}
+
+// Adds a problem if DT_JMPREL and DT_PLTRELSZ don't describe relocations of
+// the type given by DT_PLTREL, inside one of the given sections.
+func (r *relocationTargets) checkJumpRelocations(f *elf_reader.ELF32File,
+	sections []uint16) {
+	var address, size, kind uint32
+	found := false
+	for i := range f.Sections {
+		if !f.IsDynamicSection(uint16(i)) {
+			continue
+		}
+		entries, e := f.GetDynamicTable(uint16(i))
+		if e != nil {
+			return
+		}
+		// DT_PLTRELSZ is 2, DT_PLTREL is 20, and DT_JMPREL is 23.
+		for _, entry := range entries {
+			switch entry.Tag {
+			case 2:
+				size = entry.Value
+			case 20:
+				kind = entry.Value
+			case 23:
+				address = entry.Value
+				found = true
+			}
+		}
+		break
+	}
+	if !found || (size == 0) {
+		return
+	}
+	location := symbolLocation{0xffff, 0xffffffff}
+	for _, index := range sections {
+		section := &(f.Sections[index])
+		if (address < section.VirtualAddress) || ((uint64(address) +
+			uint64(size)) > (uint64(section.VirtualAddress) +
+			uint64(section.Size))) {
+			continue
+		}
+		// DT_PLTREL holds DT_REL (17) or DT_RELA (7).
+		if ((kind == 17) && (section.Type != 9)) ||
+			((kind == 7) && (section.Type != 4)) {
+			r.problems[location] = fmt.Sprintf("DT_PLTREL (%d) doesn't "+
+				"match the type of section %d, which holds the PLT "+
+				"relocations", kind, index)
+		}
+		return
+	}
+	r.problems[location] = fmt.Sprintf("DT_JMPREL (0x%08x, %d bytes) isn't "+
+		"inside a relocation section linked to the dynamic symbols",
+		address, size)
+}
+
+// Reads the targets of the relocations in every relocation section linked to
+// a dynamic symbol table.
+func readRelocationTargets(f *elf_reader.ELF32File) *relocationTargets {
+	toReturn := &relocationTargets{
+		targets:  make(map[symbolLocation]relocationTarget),
+		problems: make(map[symbolLocation]string),
+	}
+	sections := dynamicRelocationSections(f)
+	for _, index := range sections {
+		section := &(f.Sections[index])
+		symbols := &(f.Sections[section.LinkedIndex])
+		entrySize := uint32(relEntrySize)
+		if section.Type == 4 {
+			entrySize = relaEntrySize
+		}
+		content, e := f.GetSectionContent(index)
+		if e != nil {
+			toReturn.problems[symbolLocation{index, 0xffffffff}] =
+				fmt.Sprintf("Failed reading the relocations in section %d: %s",
+					index, e)
+			continue
+		}
+		// Symbols with invalid names are reported by checkSymbolNames, so
+		// only the indices are checked if the names can't be read.
+		names, _ := readSymbolNames(f, uint16(section.LinkedIndex))
+		count := symbols.Size / 16
+		relocations := uint32(len(content)) / entrySize
+		for j := uint32(0); j < relocations; j++ {
+			symbol := f.Endianness.Uint32(content[j*entrySize+4:]) >> 8
+			if symbol == 0 {
+				continue
+			}
+			location := symbolLocation{index, j}
+			if symbol >= count {
+				toReturn.problems[location] = fmt.Sprintf("Relocation %d in "+
+					"section %d refers to symbol %d, beyond the %d symbols "+
+					"in section %d", j, index, symbol, count,
+					section.LinkedIndex)
+				continue
+			}
+			target := relocationTarget{
+				symbol:     symbol,
+				nameOffset: symbols.FileOffset + symbol*16,
+			}
+			if symbol < uint32(len(names)) {
+				target.name = string(names[symbol])
+			}
+			toReturn.targets[location] = target
+		}
+	}
+	toReturn.checkJumpRelocations(f, sections)
+	return toReturn
+}
+
+// Adds a warning for each problem with the dynamic relocations before
+// patching, and returns the relocations' targets, to pass to
+// checkRelocationTargets.
+func checkOriginalRelocationTargets(f *elf_reader.ELF32File,
+	report *Report) *relocationTargets {
+	before := readRelocationTargets(f)
+	for _, problem := range sortedSymbolNameProblems(before.problems) {
+		report.addWarning("%s (before patching)", problem)
+	}
+	return before
+}
+
+// Returns an error if a dynamic relocation no longer refers to the same
+// symbol after patching, or refers to a renamed symbol whose st_name wasn't
+// updated by the patch, unless the problem was already present before.
+func checkRelocationTargets(f *elf_reader.ELF32File,
+	before *relocationTargets, report *Report) error {
+	after := readRelocationTargets(f)
+	updated := make(map[uint32]bool)
+	for _, r := range report.References {
+		updated[r.FileOffset] = true
+	}
+	introduced := make(map[symbolLocation]string)
+	for location, problem := range after.problems {
+		if _, ok := before.problems[location]; !ok {
+			introduced[location] = problem
+		}
+	}
+	for location, old := range before.targets {
+		if _, ok := introduced[location]; ok {
+			continue
+		}
+		prefix := fmt.Sprintf("Relocation %d in section %d", location.index,
+			location.section)
+		target, ok := after.targets[location]
+		if !ok {
+			introduced[location] = prefix + " no longer refers to a dynamic " +
+				"symbol"
+		} else if target.symbol != old.symbol {
+			introduced[location] = fmt.Sprintf("%s refers to symbol %d "+
+				"rather than %d", prefix, target.symbol, old.symbol)
+		} else if (target.name != old.name) && !updated[target.nameOffset] {
+			introduced[location] = fmt.Sprintf("%s refers to symbol %d, "+
+				"whose name changed from %s to %s without its st_name "+
+				"being updated", prefix, target.symbol,
+				EscapeString(old.name), EscapeString(target.name))
+		} else if (target.name == "") && (old.name != "") {
+			introduced[location] = fmt.Sprintf("%s refers to symbol %d, "+
+				"whose name %s was removed", prefix, target.symbol,
+				EscapeString(old.name))
+		}
+	}
+	if len(introduced) == 0 {
+		return nil
+	}
+	problems := sortedSymbolNameProblems(introduced)
+	return fmt.Errorf("Patching left %d dynamic relocations unable to bind "+
+		"to their symbols. The first was: %s", len(problems), problems[0])
+}
@@ -0,0 +1,133 @@
+package stringreplace
+
+// This file contains support for files modified by prelink, which records the
+// libraries an executable was prelinked against (.gnu.liblist), their
+// timestamps and checksums, and precomputed symbol conflicts (.gnu.conflict).
+// glibc trusts these as long as each library's DT_GNU_PRELINKED and
+// DT_CHECKSUM values are unchanged, so patching a prelinked file without
+// clearing them can leave the loader using stale relocations.
+
+import (
+	"fmt"
+	"github.com/yalue/elf_reader"
+	"sort"
+)
+
+// The dynamic tags added by prelink, with their names.
+var prelinkDynamicTags = map[elf_reader.ELF32DynamicTag]string{
+	0x6ffffdf5: "DT_GNU_PRELINKED",
+	0x6ffffdf6: "DT_GNU_CONFLICTSZ",
+	0x6ffffdf7: "DT_GNU_LIBLISTSZ",
+	0x6ffffdf8: "DT_CHECKSUM",
+	0x6ffffef8: "DT_GNU_CONFLICT",
+	0x6ffffef9: "DT_GNU_LIBLIST",
+}
+
+// The sections added by prelink.
+var prelinkSectionNames = map[string]bool{
+	".gnu.liblist":      true,
+	".gnu.conflict":     true,
+	".gnu.prelink_undo": true,
+}
+
+// Returns the names of the prelink sections and dynamic entries in the file,
+// sorted, or an empty slice if the file hasn't been prelinked.
+func findPrelinkStructures(f *elf_reader.ELF32File) ([]string, error) {
+	found := make(map[string]bool)
+	for i := range f.Sections {
+		name, e := SectionName(f, uint16(i))
+		if e != nil {
+			continue
+		}
+		// Type 0x6ffffff7 is SHT_GNU_LIBLIST.
+		if prelinkSectionNames[name] || (f.Sections[i].Type == 0x6ffffff7) {
+			found[name] = true
+		}
+		if !f.IsDynamicSection(uint16(i)) {
+			continue
+		}
+		entries, e := f.GetDynamicTable(uint16(i))
+		if e != nil {
+			return nil, fmt.Errorf("Failed parsing dynamic table: %s", e)
+		}
+		for _, entry := range entries {
+			name, ok := prelinkDynamicTags[entry.Tag]
+			if ok {
+				found[name] = true
+			}
+		}
+	}
+	toReturn := make([]string, 0, len(found))
+	for name := range found {
+		toReturn = append(toReturn, name)
+	}
+	sort.Strings(toReturn)
+	return toReturn, nil
+}
+
+// Returns an error if the file has been prelinked, unless ClearPrelink is
+// set in the options.
+func checkPrelink(f *elf_reader.ELF32File, options *Options) error {
+	if options.ClearPrelink {
+		return nil
+	}
+	found, e := findPrelinkStructures(f)
+	if e != nil {
+		return e
+	}
+	if len(found) == 0 {
+		return nil
+	}
+	return fmt.Errorf("The file has been prelinked (it contains %s). "+
+		"Renaming strings invalidates the prelink information, so either "+
+		"undo prelinking first (prelink -u), or use -clear_prelink "+
+		"(ClearPrelink) to remove it so the loader relocates the file "+
+		"normally", found[0])
+}
+
+// Removes the prelink entries from the dynamic table, moving the remaining
+// entries down and filling the end of the table with DT_NULL entries. Without
+// DT_GNU_PRELINKED and DT_GNU_LIBLIST, glibc ignores the rest of the prelink
+// information in an executable, and without DT_GNU_PRELINKED and DT_CHECKSUM,
+// executables prelinked against a library no longer match it. The prelink
+// sections are left in place, but unused.
+func clearPrelink(f *elf_reader.ELF32File, report *Report) error {
+	for i := range f.Sections {
+		if !f.IsDynamicSection(uint16(i)) {
+			continue
+		}
+		entries, e := f.GetDynamicTable(uint16(i))
+		if e != nil {
+			return fmt.Errorf("Failed parsing dynamic table: %s", e)
+		}
+		kept := make([]elf_reader.ELF32DynamicEntry, 0, len(entries))
+		for _, entry := range entries {
+			name, ok := prelinkDynamicTags[entry.Tag]
+			if !ok {
+				kept = append(kept, entry)
+				continue
+			}
+			report.logf("Removing the %s dynamic entry.\n", name)
+		}
+		if len(kept) == len(entries) {
+			continue
+		}
+		offset := f.Sections[i].FileOffset
+		for j := range entries {
+			var tag, value uint32
+			if j < len(kept) {
+				tag, value = uint32(kept[j].Tag), kept[j].Value
+			}
+			e = writeELFUint32(f, offset, tag, "dynamic entry")
+			if e == nil {
+				e = writeELFUint32(f, offset+4, value,
+					"dynamic entry")
+			}
+			if e != nil {
+				return fmt.Errorf("Failed writing dynamic entry %d: %s", j, e)
+			}
+			offset += 8
+		}
+	}
+	return nil
+}
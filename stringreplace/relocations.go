@@ -0,0 +1,132 @@
+package stringreplace
+
+// This file contains code for updating RELA relocations whose addends point
+// into a relocated string table. Such relocations (e.g. R_ARM_RELATIVE in a
+// shared library) initialize data pointers to strings at load time, and
+// contain the string's address rather than its offset in the table, so
+// they're missed when updating string offsets.
+
+import (
+	"fmt"
+	"github.com/yalue/elf_reader"
+)
+
+// The size of an Elf32_Rela entry: r_offset, r_info, and r_addend.
+const relaEntrySize = 12
+
+// Returns the table whose original content was loaded at the given address,
+// if it was moved to a new loaded location, or nil otherwise.
+func tableAtOldAddress(replacements []replacedStringTable,
+	address uint32) *replacedStringTable {
+	for i := range replacements {
+		t := &(replacements[i])
+		if (t.oldSegmentIndex < 0) || (t.newSegmentIndex < 0) ||
+			(len(t.replacements) == 0) {
+			continue
+		}
+		if (address >= t.oldVirtualAddress) && (uint64(address) <
+			uint64(t.oldVirtualAddress)+uint64(len(t.oldContent))) {
+			return t
+		}
+	}
+	return nil
+}
+
+// Updates the addends of the relocations in the given SHT_RELA section that
+// don't refer to a symbol, and whose addends are the addresses of replaced
+// strings (see relocationAddendIsAddress), to the replacement strings'
+// addresses. Addends pointing into the middle of a replaced string are left
+// alone, with a warning, since the old string remains in place.
+func replaceRelocationAddends(f *elf_reader.ELF32File, sectionIndex uint16,
+	replacements []replacedStringTable, report *Report) error {
+	section := &(f.Sections[sectionIndex])
+	if (section.EntrySize != 0) && (section.EntrySize != relaEntrySize) {
+		return fmt.Errorf("Unexpected entry size in section %d: %d",
+			sectionIndex, section.EntrySize)
+	}
+	count := section.Size / relaEntrySize
+	for i := uint32(0); i < count; i++ {
+		entryOffset := section.FileOffset + (i * relaEntrySize)
+		info, e := readELFUint32(f, entryOffset+4, "relocation")
+		if e != nil {
+			return fmt.Errorf("Failed reading relocation %d: %s", i, e)
+		}
+		// Relocations against a symbol add the addend to the symbol's
+		// address, so the addend isn't an address by itself.
+		if ((info >> 8) != 0) || !relocationAddendIsAddress(f, info) {
+			continue
+		}
+		addend, e := readELFUint32(f, entryOffset+8,
+			"relocation addend")
+		if e != nil {
+			return fmt.Errorf("Failed reading relocation %d: %s", i, e)
+		}
+		t := tableAtOldAddress(replacements, addend)
+		if t == nil {
+			continue
+		}
+		offset := addend - t.oldVirtualAddress
+		index, ok := t.replacementIndices[offset]
+		if !ok {
+			if replacedStringContaining(t, offset) {
+				report.addWarning("Relocation %d in section %d points into "+
+					"the middle of a replaced string, at address 0x%08x, "+
+					"so it wasn't updated", i, sectionIndex, addend)
+			}
+			continue
+		}
+		r := &(t.replacements[index])
+		newAddend := t.newVirtualAddress + r.newOffset
+		e = writeELFUint32(f, entryOffset+8, newAddend,
+			"relocation addend")
+		if e != nil {
+			return fmt.Errorf("Failed updating relocation %d: %s", i, e)
+		}
+		report.addReference(ReferenceUpdate{
+			FileOffset:    entryOffset + 8,
+			SectionIndex:  t.sectionIndex,
+			OriginalValue: addend,
+			NewValue:      newAddend,
+			Location: fmt.Sprintf("section %d relocation %d r_addend",
+				sectionIndex, i),
+		})
+		report.logf("Replaced relocation addend at offset 0x%08x: %s\n",
+			entryOffset+8, t.showReplacement(index))
+	}
+	return nil
+}
+
+// Returns true if the offset is inside, but not at the start of, a string
+// that was replaced in the table.
+func replacedStringContaining(t *replacedStringTable, offset uint32) bool {
+	start := offset
+	for (start > 0) && (t.oldContent[start-1] != 0) {
+		start--
+	}
+	_, ok := t.replacementIndices[start]
+	return ok && (start != offset)
+}
+
+// Updates the addends of relocations in every SHT_RELA section pointing to
+// replaced strings in relocated tables. Relocatable objects are skipped,
+// since their addends are relative to sections rather than addresses, and so
+// are files using SHT_REL relocations, which keep their addends in the
+// relocated data instead.
+func replaceRelocationStrings(f *elf_reader.ELF32File,
+	replacements []replacedStringTable, report *Report) error {
+	// ET_REL is 1.
+	if uint32(f.Header.Type) == 1 {
+		return nil
+	}
+	for i := range f.Sections {
+		// SHT_RELA is 4.
+		if f.Sections[i].Type != 4 {
+			continue
+		}
+		e := replaceRelocationAddends(f, uint16(i), replacements, report)
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package stringreplace
+
+// This file contains the Replacer type, which is configured using functional
+// options, so that new settings can be added without changing the signature
+// of its constructor.
+
+import (
+	"fmt"
+	"github.com/yalue/elf_reader"
+	"log"
+)
+
+// Replaces strings in ELF files according to a fixed configuration. Create
+// one using NewReplacer. A Replacer is never modified after it's created, so
+// it's safe to use concurrently, provided its hooks are.
+type Replacer struct {
+	options Options
+	// The sections the rules are limited to, if set by WithSections.
+	sections []string
+}
+
+// Configures a Replacer. Returned by the With... functions, and passed to
+// NewReplacer.
+type ReplacerOption func(r *Replacer) error
+
+// Adds rules to apply, in order, to each string table entry. May be given
+// more than once, in which case the rules are applied in the order given.
+func WithRules(rules ...Rule) ReplacerOption {
+	return func(r *Replacer) error {
+		for i := range rules {
+			e := ValidateRule(&(rules[i]))
+			if e != nil {
+				return fmt.Errorf("Invalid rule %d: %s", i, e)
+			}
+		}
+		r.options.Rules = append(r.options.Rules, rules...)
+		return nil
+	}
+}
+
+// Limits the rules to string tables in sections with the given names, e.g.
+// ".dynstr". Rules with their own Sections lists aren't affected.
+func WithSections(names ...string) ReplacerOption {
+	return func(r *Replacer) error {
+		if len(names) == 0 {
+			return fmt.Errorf("No section names were provided")
+		}
+		r.sections = append(r.sections, names...)
+		return nil
+	}
+}
+
+// Sets the smallest page size to assume when choosing where to load the
+// relocated string tables. See Options.PageSize.
+func WithPageSize(pageSize uint32) ReplacerOption {
+	return func(r *Replacer) error {
+		e := ValidatePageSize(pageSize)
+		if e != nil {
+			return e
+		}
+		r.options.PageSize = pageSize
+		return nil
+	}
+}
+
+// Treats anything that would produce a warning as an error.
+func WithStrict() ReplacerOption {
+	return func(r *Replacer) error {
+		r.options.Strict = true
+		return nil
+	}
+}
+
+// Only computes the report, without returning the patched content. See
+// Options.DryRun.
+func WithDryRun() ReplacerOption {
+	return func(r *Replacer) error {
+		r.options.DryRun = true
+		return nil
+	}
+}
+
+// Logs progress messages and warnings to the given logger. Nothing is logged
+// by default.
+func WithLogger(logger *log.Logger) ReplacerOption {
+	return func(r *Replacer) error {
+		r.options.Logger = logger
+		return nil
+	}
+}
+
+// Starts from the given options, for settings that don't have their own
+// ReplacerOption. Options given before this one are overwritten.
+func WithOptions(options Options) ReplacerOption {
+	return func(r *Replacer) error {
+		r.options = options
+		r.options.Rules = append([]Rule(nil), options.Rules...)
+		return nil
+	}
+}
+
+// Returns a new Replacer using the given options, or an error if any of them
+// are invalid. At least one rule must be provided, using WithRules or
+// WithOptions.
+func NewReplacer(options ...ReplacerOption) (*Replacer, error) {
+	r := &Replacer{}
+	for _, option := range options {
+		e := option(r)
+		if e != nil {
+			return nil, e
+		}
+	}
+	if (len(r.options.Rules) == 0) && (len(r.options.VersionedRenames) == 0) {
+		return nil, fmt.Errorf("No replacement rules were provided")
+	}
+	if len(r.sections) != 0 {
+		for i := range r.options.Rules {
+			rule := &(r.options.Rules[i])
+			if len(rule.Sections) == 0 {
+				rule.Sections = r.sections
+			}
+		}
+	}
+	return r, nil
+}
+
+// Returns a copy of the options the Replacer uses, e.g. for calling functions
+// such as ReplaceFS or ReplaceMachO.
+func (r *Replacer) Options() Options {
+	toReturn := r.options
+	toReturn.Rules = append([]Rule(nil), r.options.Rules...)
+	return toReturn
+}
+
+// Like the Replace function, using the Replacer's options.
+func (r *Replacer) Replace(input []byte) ([]byte, *Report, error) {
+	return Replace(input, r.Options())
+}
+
+// Like the ReplaceStrings function, using the Replacer's options.
+func (r *Replacer) ReplaceStrings(f *elf_reader.ELF32File) (*Report, error) {
+	options := r.Options()
+	return ReplaceStrings(f, &options)
+}
+
+// Like the ParsedFile's Replace method, using the Replacer's options.
+func (r *Replacer) ReplaceParsed(p *ParsedFile) ([]byte, *Report, error) {
+	return p.Replace(r.Options())
+}
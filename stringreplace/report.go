@@ -0,0 +1,309 @@
+package stringreplace
+
+// This file defines the Report returned by ReplaceStrings, describing every
+// change made to a file.
+
+import (
+	"fmt"
+	"github.com/yalue/elf_reader"
+	"log"
+	"sync"
+	"time"
+)
+
+// Describes a string table that was modified.
+type TableReport struct {
+	// The index and name of the string table's section.
+	SectionIndex uint16 `json:"section_index"`
+	Name         string `json:"name"`
+	// The table's file offset, virtual address, and size before and after
+	// patching.
+	OriginalOffset  uint32 `json:"original_offset"`
+	NewOffset       uint32 `json:"new_offset"`
+	OriginalAddress uint32 `json:"original_address"`
+	NewAddress      uint32 `json:"new_address"`
+	OriginalSize    uint32 `json:"original_size"`
+	NewSize         uint32 `json:"new_size"`
+	// The indices of the loadable segments containing the original and new
+	// tables, or -1 if the table isn't loaded.
+	OriginalSegment int `json:"original_segment"`
+	NewSegment      int `json:"new_segment"`
+}
+
+// Describes a string that was replaced. The strings are escaped using
+// EscapeString.
+type Replacement struct {
+	// The index of the string table's section.
+	SectionIndex uint16 `json:"section_index"`
+	// The offsets of the original and new strings in the original and new
+	// string tables.
+	OriginalOffset uint32 `json:"original_offset"`
+	NewOffset      uint32 `json:"new_offset"`
+	Original       string `json:"original"`
+	New            string `json:"new"`
+}
+
+// Describes a 32-bit reference to a string table, or to a string in one,
+// that was updated.
+type ReferenceUpdate struct {
+	// The offset of the reference in the file.
+	FileOffset uint32 `json:"file_offset"`
+	// The index of the referenced string table's section.
+	SectionIndex uint16 `json:"section_index"`
+	// The reference's value before and after patching: either a string
+	// offset, or a table's virtual address.
+	OriginalValue uint32 `json:"original_value"`
+	NewValue      uint32 `json:"new_value"`
+	// Describes the field containing the reference, such as "dynamic entry
+	// 2 DT_NEEDED" or "section 5 symbol 12 st_name".
+	Location string `json:"location"`
+}
+
+// Describes a loadable segment that was added or grown to hold the new
+// string tables.
+type SegmentReport struct {
+	// The index of the segment in the program header table.
+	Index          int    `json:"index"`
+	FileOffset     uint32 `json:"file_offset"`
+	VirtualAddress uint32 `json:"virtual_address"`
+	FileSize       uint32 `json:"file_size"`
+	MemorySize     uint32 `json:"memory_size"`
+	Flags          uint32 `json:"flags"`
+	// True if this is an existing segment that was grown, rather than a new
+	// one.
+	Extended bool `json:"extended"`
+}
+
+// Records the time taken by one phase of the replacement process.
+type PhaseTiming struct {
+	Phase    string        `json:"phase"`
+	Duration time.Duration `json:"duration_ns"`
+}
+
+// Describes every change made by ReplaceStrings. The same information is
+// logged while the file is being patched.
+type Report struct {
+	Tables       []TableReport     `json:"tables"`
+	Replacements []Replacement     `json:"replacements"`
+	References   []ReferenceUpdate `json:"references"`
+	NewSegments  []SegmentReport   `json:"new_segments"`
+	Warnings     []string          `json:"warnings"`
+	// The strings replaced through symbols, if Options.SymbolStrings was
+	// set.
+	SymbolStrings []SymbolStringReport `json:"symbol_strings,omitempty"`
+	// The fields referring to replaced strings (or changed tables) which
+	// aren't updated, so they still refer to the original strings.
+	UnsupportedReferences []UnsupportedReference `json:"unsupported_references"`
+	// The time taken by each phase, in the order they ran.
+	Timings []PhaseTiming `json:"timings"`
+	// The information needed to revert the patch using Revert: the size and
+	// SHA-256 digest of the file before and after patching, and the original
+	// content of each range that was changed.
+	OriginalSize   uint32         `json:"original_size"`
+	OriginalSHA256 string         `json:"original_sha256"`
+	PatchedSHA256  string         `json:"patched_sha256"`
+	Restore        []RestoreRange `json:"restore"`
+	// The ELF header, section headers, and program headers before patching,
+	// so structural changes can be found by comparing them to the output's.
+	OriginalLayout *LayoutSnapshot `json:"original_layout,omitempty"`
+	// Each allocated section whose containing segments changed, such as a
+	// relocated string table moving to a new LOAD segment.
+	SectionMapping []SectionMappingChange `json:"section_mapping,omitempty"`
+	// Why each rule did or didn't take effect in each string table, if
+	// Options.Explain was set.
+	Explanations []RuleExplanation `json:"explanations,omitempty"`
+	// The entries added to the dynamic table, if Options.AddNeeded or
+	// another option adding entries was set.
+	DynamicEntries []DynamicEntryReport `json:"dynamic_entries,omitempty"`
+	// The deprecated features that were used, from Options.Deprecations,
+	// and what to use instead. These keep working, and aren't warnings.
+	Deprecations []DeprecationNotice `json:"deprecations,omitempty"`
+	// Protects Warnings, which may be added concurrently.
+	mutex sync.Mutex
+	// Receives events as the report is filled in, and ensures the handler is
+	// never called concurrently.
+	eventHandler EventHandler
+	eventMutex   sync.Mutex
+	// Receives log messages, if it isn't nil.
+	logger *log.Logger
+	// The smallest page size to assume when placing the relocated tables.
+	pageSize uint32
+	// True if explanations should be added to the report.
+	explain bool
+	// The space freed by segments removed during this run.
+	freed *freeSpace
+}
+
+// Returns a new, empty report, which passes events to the options' event
+// handler and log messages to their logger, if they aren't nil.
+func newReport(options *Options) *Report {
+	pageSize := options.PageSize
+	if pageSize == 0 {
+		pageSize = minimumPageSize
+	}
+	return &Report{
+		eventHandler:          options.OnEvent,
+		logger:                options.Logger,
+		pageSize:              pageSize,
+		explain:               options.Explain,
+		freed:                 &freeSpace{},
+		Tables:                make([]TableReport, 0, 4),
+		Replacements:          make([]Replacement, 0, 16),
+		References:            make([]ReferenceUpdate, 0, 64),
+		NewSegments:           make([]SegmentReport, 0, 1),
+		Warnings:              make([]string, 0, 4),
+		UnsupportedReferences: make([]UnsupportedReference, 0),
+		Timings:               make([]PhaseTiming, 0, 10),
+		Deprecations:          options.Deprecations,
+	}
+}
+
+// Logs a warning and adds it to the report. Safe to call concurrently.
+func (r *Report) addWarning(format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	r.logf("WARNING: %s\n", message)
+	r.mutex.Lock()
+	r.Warnings = append(r.Warnings, message)
+	r.mutex.Unlock()
+	r.emit(&Event{
+		Type:    WarningEvent,
+		Message: message,
+	})
+}
+
+// Logs a message using the report's logger, if there is one. Safe to call
+// concurrently.
+func (r *Report) logf(format string, args ...interface{}) {
+	if r.logger != nil {
+		r.logger.Printf(format, args...)
+	}
+}
+
+// Records an updated reference. References are always updated serially, so
+// this isn't safe to call concurrently.
+func (r *Report) addReference(reference ReferenceUpdate) {
+	r.References = append(r.References, reference)
+	r.emit(&Event{
+		Type:      ReferencePatchedEvent,
+		Reference: &reference,
+	})
+}
+
+// Records the time taken by the named phase, which started at the given time
+// (as returned by startPhase).
+func (r *Report) addTiming(phase string, start time.Time) {
+	duration := time.Since(start)
+	r.Timings = append(r.Timings, PhaseTiming{
+		Phase:    phase,
+		Duration: duration,
+	})
+	r.emit(&Event{
+		Type:     PhaseFinishedEvent,
+		Phase:    phase,
+		Duration: duration,
+	})
+}
+
+// Adds the timing for a phase that ran before ReplaceStrings, such as
+// parsing the file, to the start of the list.
+func (r *Report) prependTiming(phase string, duration time.Duration) {
+	r.Timings = append([]PhaseTiming{{phase, duration}}, r.Timings...)
+}
+
+// Records that the loadable segment at the given index was added or grown.
+// Must be called after the segment's final size is known.
+func (r *Report) addSegment(f *elf_reader.ELF32File, index int,
+	extended bool) {
+	for _, s := range r.NewSegments {
+		if s.Index == index {
+			return
+		}
+	}
+	s := &(f.Segments[index])
+	r.addSegmentReport(SegmentReport{
+		Index:          index,
+		FileOffset:     s.FileOffset,
+		VirtualAddress: s.VirtualAddress,
+		FileSize:       s.FileSize,
+		MemorySize:     s.MemorySize,
+		Flags:          uint32(s.Flags),
+		Extended:       extended,
+	})
+}
+
+// Adds the description of a new or grown segment to the report, and emits
+// its event.
+func (r *Report) addSegmentReport(segment SegmentReport) {
+	r.NewSegments = append(r.NewSegments, segment)
+	r.emit(&Event{
+		Type:    SegmentAddedEvent,
+		Segment: &segment,
+	})
+}
+
+// Records the updated string tables and each string replaced in them.
+func (r *Report) addTables(f *elf_reader.ELF32File,
+	tables []replacedStringTable) {
+	var t *replacedStringTable
+	for i := range tables {
+		t = &(tables[i])
+		name, e := SectionName(f, t.sectionIndex)
+		if e != nil {
+			name = fmt.Sprintf("<bad name: %s>", e)
+		}
+		r.addTable(t, EscapeString(name))
+	}
+}
+
+// Records a single updated string table, with the given (escaped) name, and
+// each string replaced in it.
+func (r *Report) addTable(t *replacedStringTable, name string) {
+	r.Tables = append(r.Tables, TableReport{
+		SectionIndex:    t.sectionIndex,
+		Name:            name,
+		OriginalOffset:  t.oldFileOffset,
+		NewOffset:       t.newFileOffset,
+		OriginalAddress: t.oldVirtualAddress,
+		NewAddress:      t.newVirtualAddress,
+		OriginalSize:    uint32(len(t.oldContent)),
+		NewSize:         uint32(len(t.newContent)),
+		OriginalSegment: t.oldSegmentIndex,
+		NewSegment:      t.newSegmentIndex,
+	})
+	for j := range t.replacements {
+		r.Replacements = append(r.Replacements, t.describeReplacement(j))
+	}
+}
+
+// Emits the events for a string table in which strings were replaced, with
+// the given (escaped) name, and for each of its replacements.
+func (r *Report) emitTable(t *replacedStringTable, name string) {
+	r.emit(&Event{
+		Type:         TableFoundEvent,
+		SectionIndex: t.sectionIndex,
+		Name:         name,
+	})
+	for j := range t.replacements {
+		replacement := t.describeReplacement(j)
+		r.emit(&Event{
+			Type:        StringReplacedEvent,
+			Replacement: &replacement,
+		})
+	}
+}
+
+// Returns the exported description of the replacement at the given index in
+// the table.
+func (t *replacedStringTable) describeReplacement(index int) Replacement {
+	s := &(t.replacements[index])
+	toReturn := Replacement{
+		SectionIndex:   t.sectionIndex,
+		OriginalOffset: s.originalOffset,
+		NewOffset:      s.newOffset,
+	}
+	tmp, _ := elf_reader.ReadStringAtOffset(s.originalOffset, t.oldContent)
+	toReturn.Original = EscapeString(string(tmp))
+	tmp, _ = elf_reader.ReadStringAtOffset(s.newOffset, t.newContent)
+	toReturn.New = EscapeString(string(tmp))
+	return toReturn
+}
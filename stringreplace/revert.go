@@ -0,0 +1,125 @@
+package stringreplace
+
+// This file contains code for recording the original content of every byte
+// range changed while patching a file, and for using these records to revert
+// the patch.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// Ranges of changed bytes separated by fewer than this many unchanged bytes
+// are recorded as a single range, to keep the report short.
+const restoreMergeDistance = 8
+
+// Records the original content of a range of the file that was overwritten
+// while patching it.
+type RestoreRange struct {
+	FileOffset uint32 `json:"file_offset"`
+	Original   []byte `json:"original"`
+}
+
+// Returns the hex-encoded SHA-256 digest of the given content.
+func contentDigest(content []byte) string {
+	digest := sha256.Sum256(content)
+	return hex.EncodeToString(digest[:])
+}
+
+// A range of byte offsets, from start up to (but not including) end.
+type byteRange struct {
+	start int
+	end   int
+}
+
+// Returns the ranges of bytes that differ between the original and patched
+// content, up to the shorter of the two lengths. Ranges separated by fewer
+// than restoreMergeDistance unchanged bytes are merged.
+func changedRanges(original, patched []byte) []byteRange {
+	toReturn := make([]byteRange, 0, 16)
+	limit := len(original)
+	if len(patched) < limit {
+		limit = len(patched)
+	}
+	for i := 0; i < limit; i++ {
+		if original[i] == patched[i] {
+			continue
+		}
+		start := i
+		end := i + 1
+		for j := end; (j < limit) && (j < (end + restoreMergeDistance)); j++ {
+			if original[j] != patched[j] {
+				end = j + 1
+			}
+		}
+		toReturn = append(toReturn, byteRange{start, end})
+		i = end - 1
+	}
+	return toReturn
+}
+
+// Records the information needed to revert the patch in the report: the size
+// and digest of the original and patched content, and the original content
+// of every range of the original file that was changed. Anything beyond the
+// original size was appended, so reverting it only requires truncating the
+// file.
+func (r *Report) recordRestore(original, patched []byte) {
+	r.OriginalSize = uint32(len(original))
+	r.OriginalSHA256 = contentDigest(original)
+	r.PatchedSHA256 = contentDigest(patched)
+	r.Restore = make([]RestoreRange, 0, 16)
+	limit := len(original)
+	if len(patched) < limit {
+		limit = len(patched)
+	}
+	for _, changed := range changedRanges(original, patched) {
+		r.Restore = append(r.Restore, RestoreRange{
+			FileOffset: uint32(changed.start),
+			Original: append([]byte(nil),
+				original[changed.start:changed.end]...),
+		})
+	}
+	// The file shrinks if a segment appended by a previous run was rewritten,
+	// and a patch hook could also shrink it.
+	if len(original) > limit {
+		r.Restore = append(r.Restore, RestoreRange{
+			FileOffset: uint32(limit),
+			Original:   append([]byte(nil), original[limit:]...),
+		})
+	}
+}
+
+// Undoes the patch described by the report, which must have been returned
+// when patching the given file content. This restores every overwritten
+// reference, header field, and string, and drops anything appended to the
+// file, such as the relocated string tables and new program headers. Returns
+// an error if the content doesn't match the digest recorded in the report,
+// e.g. because the file was modified again after it was patched. The patched
+// slice is not modified.
+func Revert(patched []byte, report *Report) ([]byte, error) {
+	if report.PatchedSHA256 == "" {
+		return nil, fmt.Errorf("The report doesn't contain the information " +
+			"needed to revert the patch")
+	}
+	if contentDigest(patched) != report.PatchedSHA256 {
+		return nil, fmt.Errorf("The file's SHA-256 digest doesn't match the " +
+			"patched file described by the report")
+	}
+	toReturn := make([]byte, report.OriginalSize)
+	copy(toReturn, patched)
+	for _, r := range report.Restore {
+		if (uint64(r.FileOffset) + uint64(len(r.Original))) >
+			uint64(len(toReturn)) {
+			return nil, fmt.Errorf("Invalid restore range at offset 0x%08x: "+
+				"extends past the original size (%d bytes)", r.FileOffset,
+				len(toReturn))
+		}
+		copy(toReturn[r.FileOffset:], r.Original)
+	}
+	if contentDigest(toReturn) != report.OriginalSHA256 {
+		return nil, fmt.Errorf("The reverted file's SHA-256 digest doesn't " +
+			"match the original file described by the report")
+	}
+	return toReturn, nil
+}
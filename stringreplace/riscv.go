@@ -0,0 +1,46 @@
+package stringreplace
+
+// This file contains support for RISC-V files, such as those for embedded
+// RV32 Linux targets. Their dynamic relocations include types that don't
+// refer to a symbol, but whose addends aren't addresses, such as
+// R_RISCV_TLS_TPREL32, so only the types known to hold addresses are
+// considered when updating relocations pointing to strings. RISC-V files also
+// carry a .riscv.attributes section, covered by a PT_RISCV_ATTRIBUTES segment,
+// holding the target's ISA string among other build attributes. It's never
+// treated as a string table (see mayBeMistypedStringTable), and the segment,
+// which isn't loaded, is left alone.
+
+import (
+	"github.com/yalue/elf_reader"
+)
+
+// The e_machine value of RISC-V files.
+const machineRISCV = 243
+
+// The type of the .riscv.attributes section (SHT_RISCV_ATTRIBUTES), and of
+// the PT_RISCV_ATTRIBUTES segment covering it. ARM uses the same section type
+// for .ARM.attributes.
+const riscvAttributes = 0x70000003
+
+// The RISC-V relocation types whose addends are addresses when they don't
+// refer to a symbol.
+const (
+	riscvRelocation32       = 1 // R_RISCV_32
+	riscvRelocationRelative = 3 // R_RISCV_RELATIVE
+)
+
+// Returns true if the addend of a relocation with the given r_info, which
+// doesn't refer to a symbol, is an address that may point to a string. This
+// is assumed for every relocation type except on RISC-V, where only
+// R_RISCV_32 and R_RISCV_RELATIVE qualify: the addends of the TLS types are
+// offsets into the TLS block, and R_RISCV_IRELATIVE's is a resolver function.
+func relocationAddendIsAddress(f *elf_reader.ELF32File, info uint32) bool {
+	if uint32(f.Header.Machine) != machineRISCV {
+		return true
+	}
+	switch info & 0xff {
+	case riscvRelocation32, riscvRelocationRelative:
+		return true
+	}
+	return false
+}
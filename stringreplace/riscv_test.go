@@ -0,0 +1,41 @@
+package stringreplace
+
+import (
+	"github.com/yalue/elf_reader"
+	"testing"
+)
+
+func TestRelocationAddendIsAddress(t *testing.T) {
+	riscv := &elf_reader.ELF32File{}
+	riscv.Header.Machine = machineRISCV
+	// EM_386
+	other := &elf_reader.ELF32File{}
+	other.Header.Machine = 3
+	tests := []struct {
+		f        *elf_reader.ELF32File
+		info     uint32
+		expected bool
+	}{
+		// R_RISCV_32 and R_RISCV_RELATIVE, with a symbol index in the
+		// upper bits that must be ignored.
+		{riscv, 1, true},
+		{riscv, 3, true},
+		{riscv, 0x103, true},
+		// R_RISCV_TLS_DTPMOD32, R_RISCV_TLS_TPREL32, and
+		// R_RISCV_IRELATIVE.
+		{riscv, 6, false},
+		{riscv, 10, false},
+		{riscv, 58, false},
+		// Every type is assumed to hold an address on other machines.
+		{other, 8, true},
+		{other, 10, true},
+	}
+	for _, test := range tests {
+		actual := relocationAddendIsAddress(test.f, test.info)
+		if actual != test.expected {
+			t.Errorf("Relocation info 0x%x on machine %d: expected %v, "+
+				"got %v", test.info, test.f.Header.Machine, test.expected,
+				actual)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package stringreplace
+
+// This file contains CheckRoundTrip, which runs the full patching pipeline
+// with a rule that can't match anything, and checks that the output is
+// identical to the input. Parsing the file, searching its tables, and
+// serializing the result must never change a file on their own, so any
+// difference is a bug.
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+)
+
+// A regular expression matching no strings at all: a class excluding every
+// character.
+var neverMatches = regexp.MustCompile(`[^\x00-\x{10ffff}]`)
+
+// Patches the given ELF file content using the options, but with a
+// single rule that matches nothing in place of the options' rules, versioned
+// renames, and symbol strings, and returns an error if the output differs
+// from the input in any way, or if the report records any replacements. The
+// input slice is not modified.
+func CheckRoundTrip(input []byte, options Options) error {
+	options.Rules = []Rule{
+		{
+			Match: neverMatches,
+		},
+	}
+	options.VersionedRenames = nil
+	options.SymbolStrings = nil
+	output, report, e := Replace(input, options)
+	if e != nil {
+		return fmt.Errorf("Patching failed: %s", e)
+	}
+	if len(report.Replacements) != 0 {
+		return fmt.Errorf("The report records %d replacements, but none "+
+			"were possible", len(report.Replacements))
+	}
+	if len(output) != len(input) {
+		return fmt.Errorf("The file's size changed from %d to %d bytes",
+			len(input), len(output))
+	}
+	if bytes.Equal(output, input) {
+		return nil
+	}
+	changed := changedRanges(input, output)
+	return fmt.Errorf("%d ranges of the file changed, the first at offset "+
+		"0x%08x", len(changed), changed[0].start)
+}
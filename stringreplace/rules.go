@@ -0,0 +1,290 @@
+package stringreplace
+
+// This file contains checks for mistakes in replacement rules, such as
+// references to capture groups that don't exist.
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strconv"
+	"strings"
+)
+
+// Returns a rule replacing exactly the whole string old with new, rather
+// than every match of a regular expression. The new string is used
+// literally, so it may contain $ (e.g. in $ORIGIN).
+func LiteralRule(old, new string) Rule {
+	return Rule{
+		Match:       regexp.MustCompile("^" + regexp.QuoteMeta(old) + "$"),
+		Replacement: strings.Replace(new, "$", "$$", -1),
+	}
+}
+
+// Returns the names of the capture groups referenced by the replacement
+// template, using the same syntax as regexp.Regexp.Expand: $name or ${name},
+// where the name is a number or a group name, and $$ is a literal $.
+func templateReferences(template string) []string {
+	toReturn := make([]string, 0, 2)
+	isNameByte := func(c byte) bool {
+		return (c == '_') || ((c >= '0') && (c <= '9')) ||
+			((c >= 'a') && (c <= 'z')) || ((c >= 'A') && (c <= 'Z'))
+	}
+	for i := 0; i < len(template); i++ {
+		if (template[i] != '$') || ((i + 1) >= len(template)) {
+			continue
+		}
+		i++
+		if template[i] == '$' {
+			continue
+		}
+		if template[i] == '{' {
+			end := i + 1
+			for (end < len(template)) && isNameByte(template[end]) {
+				end++
+			}
+			if (end < len(template)) && (template[end] == '}') &&
+				(end > (i + 1)) {
+				toReturn = append(toReturn, template[i+1:end])
+				i = end
+			}
+			continue
+		}
+		end := i
+		for (end < len(template)) && isNameByte(template[end]) {
+			end++
+		}
+		if end > i {
+			toReturn = append(toReturn, template[i:end])
+			i = end - 1
+		}
+	}
+	return toReturn
+}
+
+// Returns true if the name refers to a capture group by number.
+func isGroupNumber(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if (name[i] < '0') || (name[i] > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns an error if the rule's replacement refers to a capture group that
+// doesn't exist in its regular expression, which would silently expand to an
+// empty string. This catches mistakes such as "$1x", which refers to a group
+// named "1x" rather than group 1 followed by an x.
+func ValidateRule(r *Rule) error {
+	if r.Match == nil {
+		return fmt.Errorf("The rule has no regular expression")
+	}
+	groupCount := r.Match.NumSubexp()
+	names := make(map[string]bool)
+	for _, name := range r.Match.SubexpNames() {
+		if name != "" {
+			names[name] = true
+		}
+	}
+	for _, name := range templateReferences(r.Replacement) {
+		if isGroupNumber(name) {
+			n, e := strconv.Atoi(name)
+			if (e != nil) || (n > groupCount) {
+				return fmt.Errorf("The replacement refers to group $%s, but "+
+					"%q only has %d capture groups", name, r.Match.String(),
+					groupCount)
+			}
+			continue
+		}
+		if names[name] {
+			continue
+		}
+		hint := ""
+		digits := 0
+		for (digits < len(name)) && (name[digits] >= '0') &&
+			(name[digits] <= '9') {
+			digits++
+		}
+		if digits != 0 {
+			hint = fmt.Sprintf(" (did you mean ${%s}%s?)", name[:digits],
+				name[digits:])
+		}
+		return fmt.Errorf("The replacement refers to the undefined group "+
+			"$%s%s", name, hint)
+	}
+	return nil
+}
+
+// Returns true if the parsed regular expression can match an empty string
+// somewhere, assuming any of its empty-width assertions (such as ^, $, or \b)
+// may hold.
+func canMatchEmpty(re *syntax.Regexp) bool {
+	switch re.Op {
+	case syntax.OpEmptyMatch, syntax.OpBeginLine, syntax.OpEndLine,
+		syntax.OpBeginText, syntax.OpEndText, syntax.OpWordBoundary,
+		syntax.OpNoWordBoundary, syntax.OpStar, syntax.OpQuest:
+		return true
+	case syntax.OpLiteral:
+		return len(re.Rune) == 0
+	case syntax.OpCapture, syntax.OpPlus:
+		return canMatchEmpty(re.Sub[0])
+	case syntax.OpRepeat:
+		return (re.Min == 0) || canMatchEmpty(re.Sub[0])
+	case syntax.OpConcat:
+		for _, sub := range re.Sub {
+			if !canMatchEmpty(sub) {
+				return false
+			}
+		}
+		return true
+	case syntax.OpAlternate:
+		for _, sub := range re.Sub {
+			if canMatchEmpty(sub) {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// Returns an error if the rule's regular expression can match an empty
+// string, e.g. "x*" or "^". Such a match would insert the replacement
+// between characters of nearly every string table entry, or replace empty
+// strings, rather than replacing a name.
+func checkEmptyMatch(r *Rule) error {
+	parsed, e := syntax.Parse(r.Match.String(), syntax.Perl)
+	if e != nil {
+		return fmt.Errorf("Failed parsing %q: %s", r.Match.String(), e)
+	}
+	if !canMatchEmpty(parsed) {
+		return nil
+	}
+	return fmt.Errorf("%q can match an empty string, so the replacement "+
+		"would be inserted into nearly every string", r.Match.String())
+}
+
+// Checks each of the options' rules using ValidateRule, and, unless
+// AllowEmptyMatch is set, checkEmptyMatch.
+func (o *Options) validateRules() error {
+	for i := range o.Rules {
+		e := ValidateRule(&(o.Rules[i]))
+		if (e == nil) && !o.AllowEmptyMatch {
+			e = checkEmptyMatch(&(o.Rules[i]))
+		}
+		if e != nil {
+			return fmt.Errorf("Invalid rule %d: %s", i, e)
+		}
+	}
+	return nil
+}
+
+// Returns true if the rule's replacement refers to any capture groups.
+func usesCaptureGroups(r *Rule) bool {
+	return len(templateReferences(r.Replacement)) != 0
+}
+
+// Records, for the given rule, whether it matched the string s, and whether
+// any of its matches expanded to a non-empty replacement. Only used for rules
+// referring to capture groups, and skipped once a non-empty expansion has
+// been seen, since that's all checkEmptyExpansions needs to know.
+func (t *replacedStringTable) recordExpansions(ruleIndex int, r *Rule,
+	s string) {
+	if t.ruleExpanded[ruleIndex] {
+		return
+	}
+	for _, match := range r.Match.FindAllStringSubmatchIndex(s, -1) {
+		t.ruleMatched[ruleIndex] = true
+		if len(r.Match.ExpandString(nil, r.Replacement, s, match)) != 0 {
+			t.ruleExpanded[ruleIndex] = true
+			return
+		}
+	}
+}
+
+// Returns an error if a rule referring to capture groups matched at least one
+// string, but every match expanded to an empty replacement, which usually
+// means the rule refers to the wrong group.
+func checkEmptyExpansions(rules []Rule, tables []replacedStringTable) error {
+	var matched, expanded bool
+	for i := range rules {
+		if !usesCaptureGroups(&(rules[i])) {
+			continue
+		}
+		matched = false
+		expanded = false
+		for j := range tables {
+			matched = matched || tables[j].ruleMatched[i]
+			expanded = expanded || tables[j].ruleExpanded[i]
+		}
+		if matched && !expanded {
+			return fmt.Errorf("The replacement %q in rule %d expanded to an "+
+				"empty string for every match", rules[i].Replacement, i)
+		}
+	}
+	return nil
+}
+
+// Returns a description of the first byte in s that is likely to cause
+// problems in a string table, or an empty string if there are none. NUL
+// bytes terminate the string early, and control characters and non-ASCII
+// bytes are rarely intended in names, unless allowNonASCII is set because the
+// string table uses an encoding such as Latin-1 or Shift-JIS.
+func findRawByte(s string, allowNonASCII bool) string {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == 0:
+			return "NUL byte"
+		case (c == '\n') || (c == '\r'):
+			return "newline"
+		case (c < 0x20) || (c == 0x7f):
+			return fmt.Sprintf("control character (0x%02x)", c)
+		case (c >= 0x80) && !allowNonASCII:
+			return fmt.Sprintf("non-ASCII byte (0x%02x)", c)
+		}
+	}
+	return ""
+}
+
+// Returns an error if the new string contains a problematic byte (see
+// findRawByte). Strings that already contained such bytes are exempt, so
+// that they can still be modified.
+func checkRawBytes(oldString, newString string,
+	allowNonASCII bool) error {
+	problem := findRawByte(newString, allowNonASCII)
+	if (problem == "") || (findRawByte(oldString, allowNonASCII) != "") {
+		return nil
+	}
+	return fmt.Errorf("The replacement %q for %q contains a %s, which "+
+		"isn't allowed unless raw bytes are enabled", newString, oldString,
+		problem)
+}
+
+// Applies the options' rules to a single string s, outside of an ELF string
+// table, in order, and returns the result. The name, such as a Mach-O load
+// command's name, is used in place of a section name when checking
+// ExcludeSections and each rule's section lists, and is passed to the
+// options' OnReplace callback.
+func applyNamedRules(options *Options, name, s string) string {
+	if (options.ExcludeSections != nil) &&
+		options.ExcludeSections.MatchString(name) {
+		return s
+	}
+	if (options.NotMatching != nil) && options.NotMatching.MatchString(s) {
+		return s
+	}
+	original := s
+	for i := range options.Rules {
+		r := &(options.Rules[i])
+		if !r.appliesToSection(name) {
+			continue
+		}
+		s = r.Match.ReplaceAllString(s, r.Replacement)
+	}
+	if s == original {
+		return s
+	}
+	return applyReplaceCallback(options, name, original, s)
+}
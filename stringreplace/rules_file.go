@@ -0,0 +1,87 @@
+package stringreplace
+
+// This file contains the parser for rules files, which hold several
+// replacement rules so that they can all be applied in a single pass. A rules
+// file is either a JSON array in the format accepted by ParseJSONRules, or a
+// simple line format, for example:
+//
+//    # Rename two dependencies, but only in .dynstr.
+//    libfoo.so.1 libfoo_compat.so.1 literal sections=.dynstr
+//    libbar\.so\.(\d+) libbar_compat.so.$1 sections=.dynstr
+//
+// Each line holds a regular expression, its replacement, and any options,
+// separated by whitespace. The "literal" option makes the first two fields
+// exact whole strings (see LiteralRule), and "sections=" and
+// "exclude_sections=" take comma-separated lists of section names. Blank
+// lines and lines starting with # are ignored.
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Parses a single line of a rules file in the line format.
+func parseRuleLine(line string) (Rule, error) {
+	var toReturn Rule
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return toReturn, fmt.Errorf("Expected a regular expression and a " +
+			"replacement")
+	}
+	literal := false
+	var sections, excludeSections []string
+	for _, option := range fields[2:] {
+		switch {
+		case option == "literal":
+			literal = true
+		case strings.HasPrefix(option, "sections="):
+			sections = strings.Split(strings.TrimPrefix(option, "sections="),
+				",")
+		case strings.HasPrefix(option, "exclude_sections="):
+			excludeSections = strings.Split(strings.TrimPrefix(option,
+				"exclude_sections="), ",")
+		default:
+			return toReturn, fmt.Errorf("Unknown option %s", option)
+		}
+	}
+	if literal {
+		toReturn = LiteralRule(fields[0], fields[1])
+	} else {
+		regex, e := regexp.Compile(fields[0])
+		if e != nil {
+			return toReturn, fmt.Errorf("Invalid regular expression: %s", e)
+		}
+		toReturn.Match = regex
+		toReturn.Replacement = fields[1]
+	}
+	toReturn.Sections = sections
+	toReturn.ExcludeSections = excludeSections
+	return toReturn, ValidateRule(&toReturn)
+}
+
+// Parses the content of a rules file: a JSON array of rules if it starts
+// with "[", or otherwise one rule per line in the format described above.
+// Strings containing whitespace can only be given in the JSON format.
+func ParseRulesFile(data []byte) ([]Rule, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		return ParseJSONRules(data)
+	}
+	var toReturn []Rule
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if (line == "") || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, e := parseRuleLine(line)
+		if e != nil {
+			return nil, fmt.Errorf("Line %d: %s", i+1, e)
+		}
+		toReturn = append(toReturn, rule)
+	}
+	if len(toReturn) == 0 {
+		return nil, fmt.Errorf("The rules file contains no rules")
+	}
+	return toReturn, nil
+}
@@ -0,0 +1,112 @@
+package stringreplace
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRulesFileLines(t *testing.T) {
+	rules, e := ParseRulesFile([]byte(`
+# Rename two dependencies, but only in .dynstr.
+libfoo.so.1 libfoo_compat.so.1 literal sections=.dynstr
+	libbar\.so\.(\d+)   libbar_compat.so.$1 sections=.dynstr,.stabstr
+
+  # Comments may be indented.
+^lib(\w+)$ lib${1}_new exclude_sections=.strtab,.comment
+a.b price_in_$ literal
+`))
+	if e != nil {
+		t.Fatalf("Failed parsing a valid rules file: %s", e)
+	}
+	if len(rules) != 4 {
+		t.Fatalf("Expected 4 rules, got %d", len(rules))
+	}
+	tests := []struct {
+		rule     int
+		input    string
+		expected string
+	}{
+		{0, "libfoo.so.1", "libfoo_compat.so.1"},
+		// Literal rules match the whole string exactly.
+		{0, "libfooXso.1", "libfooXso.1"},
+		{0, "libfoo.so.12", "libfoo.so.12"},
+		{1, "libbar.so.3", "libbar_compat.so.3"},
+		{2, "libz", "libz_new"},
+		// A literal replacement containing $ isn't treated as a template.
+		{3, "a.b", "price_in_$"},
+		{3, "axb", "axb"},
+	}
+	for _, test := range tests {
+		r := &(rules[test.rule])
+		actual := r.Match.ReplaceAllString(test.input, r.Replacement)
+		if actual != test.expected {
+			t.Errorf("Expected rule %d to replace %q with %q, got %q",
+				test.rule, test.input, test.expected, actual)
+		}
+	}
+	sections := [][]string{{".dynstr"}, {".dynstr", ".stabstr"}, nil, nil}
+	excluded := [][]string{nil, nil, {".strtab", ".comment"}, nil}
+	for i := range rules {
+		if !reflect.DeepEqual(rules[i].Sections, sections[i]) {
+			t.Errorf("Expected rule %d's sections to be %q, got %q", i,
+				sections[i], rules[i].Sections)
+		}
+		if !reflect.DeepEqual(rules[i].ExcludeSections, excluded[i]) {
+			t.Errorf("Expected rule %d's excluded sections to be %q, got %q",
+				i, excluded[i], rules[i].ExcludeSections)
+		}
+	}
+}
+
+func TestParseRulesFileJSON(t *testing.T) {
+	rules, e := ParseRulesFile([]byte(`
+  [{"to_match": "libc\\.so", "replace": "libc copy.so",
+    "sections": [".dynstr"]}]`))
+	if e != nil {
+		t.Fatalf("Failed parsing JSON rules: %s", e)
+	}
+	if len(rules) != 1 {
+		t.Fatalf("Expected 1 rule, got %d", len(rules))
+	}
+	// Unlike the line format, JSON strings may contain whitespace.
+	actual := rules[0].Match.ReplaceAllString("libc.so.6",
+		rules[0].Replacement)
+	if actual != "libc copy.so.6" {
+		t.Errorf("Expected libc copy.so.6, got %q", actual)
+	}
+	if !reflect.DeepEqual(rules[0].Sections, []string{".dynstr"}) {
+		t.Errorf("Expected the rule to apply to .dynstr, got %q",
+			rules[0].Sections)
+	}
+}
+
+func TestParseRulesFileErrors(t *testing.T) {
+	tests := []struct {
+		content string
+		// A substring of the expected error.
+		expected string
+	}{
+		{"# Only a comment\n\n", "contains no rules"},
+		{"", "contains no rules"},
+		{"libc.so.6 libz.so.1\nlibm.so.6\n", "Line 2: Expected a regular " +
+			"expression and a replacement"},
+		{"\n\nlibc.so.6 libz.so.1 sections=.dynstr global\n",
+			"Line 3: Unknown option global"},
+		{"lib(c.so libz.so", "Line 1: Invalid regular expression"},
+		{"# Comment\nlibc\\.so\\.(\\d) libz.so.$2", "Line 2: The replacement " +
+			"refers to group $2"},
+		{"[{\"to_match\": \"libc\"", ""},
+	}
+	for _, test := range tests {
+		_, e := ParseRulesFile([]byte(test.content))
+		if e == nil {
+			t.Errorf("Didn't get an error parsing %q", test.content)
+			continue
+		}
+		if !strings.Contains(e.Error(), test.expected) {
+			t.Errorf("Expected an error containing %q parsing %q, got: %s",
+				test.expected, test.content, e)
+		}
+	}
+}
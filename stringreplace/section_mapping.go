@@ -0,0 +1,186 @@
+package stringreplace
+
+// This file contains code for comparing which segments contain each section
+// before and after patching, which is what loaders and audit tools actually
+// rely on. Relocated string tables leave their original LOAD segment for the
+// new one, and any other change to the mapping is unexpected, so each change
+// is described in the report.
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Describes how the segments containing an allocated section changed during
+// patching.
+type SectionMappingChange struct {
+	SectionIndex int    `json:"section_index"`
+	Name         string `json:"name,omitempty"`
+	// The indices of the segments containing the section before and after
+	// patching.
+	OriginalSegments []int `json:"original_segments"`
+	NewSegments      []int `json:"new_segments"`
+	// A human-readable description of the change, e.g. "Section 5
+	// (.dynstr) left segment 2 (LOAD), and joined new segment 9 (LOAD)".
+	Description string `json:"description"`
+}
+
+// Returns true if the section's memory, and its file content unless it's
+// SHT_NOBITS (8), lies entirely within the segment. Only allocated
+// (SHF_ALLOC) sections with a nonzero size are considered to be in a segment.
+func sectionInSegment(section *SectionSnapshot,
+	segment *SegmentSnapshot) bool {
+	if ((section.Flags & 2) == 0) || (section.Size == 0) {
+		return false
+	}
+	end := uint64(section.VirtualAddress) + uint64(section.Size)
+	if (section.VirtualAddress < segment.VirtualAddress) || (end >
+		(uint64(segment.VirtualAddress) + uint64(segment.MemorySize))) {
+		return false
+	}
+	if section.Type == 8 {
+		return true
+	}
+	end = uint64(section.FileOffset) + uint64(section.Size)
+	return (section.FileOffset >= segment.FileOffset) && (end <=
+		(uint64(segment.FileOffset) + uint64(segment.FileSize)))
+}
+
+// Returns the indices of the segments containing each section in the layout.
+func sectionSegments(layout *LayoutSnapshot) [][]int {
+	toReturn := make([][]int, len(layout.Sections))
+	for i := range layout.Sections {
+		for j := range layout.Segments {
+			if sectionInSegment(&(layout.Sections[i]),
+				&(layout.Segments[j])) {
+				toReturn[i] = append(toReturn[i], j)
+			}
+		}
+	}
+	return toReturn
+}
+
+// Returns the index of a segment in the layout with the same type and
+// virtual address as the given one, or -1 if there isn't one. Segments are
+// matched this way rather than by index, since removing a segment renumbers
+// the ones after it, and growing a segment doesn't change its address.
+func matchingSegment(layout *LayoutSnapshot, s *SegmentSnapshot) int {
+	for i := range layout.Segments {
+		other := &(layout.Segments[i])
+		if (other.Type == s.Type) &&
+			(other.VirtualAddress == s.VirtualAddress) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Returns the indices in a, of segments in aLayout, that don't match any of
+// the segments in bLayout with the indices in b.
+func segmentDifference(a []int, aLayout *LayoutSnapshot, b []int,
+	bLayout *LayoutSnapshot) []int {
+	var toReturn []int
+	for _, index := range a {
+		s := &(aLayout.Segments[index])
+		found := false
+		for _, other := range b {
+			o := &(bLayout.Segments[other])
+			found = found || ((o.Type == s.Type) &&
+				(o.VirtualAddress == s.VirtualAddress))
+		}
+		if !found {
+			toReturn = append(toReturn, index)
+		}
+	}
+	return toReturn
+}
+
+// Returns a description of the segments in the layout with the given
+// indices, e.g. "segments 2 (LOAD) and 4 (GNU_RELRO)". If original isn't
+// nil, segments that don't match any in it are described as new segments.
+func describeSegmentList(layout *LayoutSnapshot, indices []int,
+	original *LayoutSnapshot) string {
+	names := make([]string, len(indices))
+	added := original != nil
+	for i, index := range indices {
+		s := &(layout.Segments[index])
+		names[i] = fmt.Sprintf("%d (%s)", index,
+			MachineSegmentTypeName(layout.Header.Machine, s.Type))
+		added = added && (matchingSegment(original, s) < 0)
+	}
+	prefix := "segment"
+	if len(names) > 1 {
+		prefix = "segments"
+	}
+	if added {
+		prefix = "new " + prefix
+	}
+	switch len(names) {
+	case 1:
+		return prefix + " " + names[0]
+	case 2:
+		return prefix + " " + names[0] + " and " + names[1]
+	}
+	return prefix + " " + strings.Join(names[:len(names)-1], ", ") +
+		", and " + names[len(names)-1]
+}
+
+// Returns true if one of the given segments is a PT_LOAD segment.
+func includesLoadSegment(layout *LayoutSnapshot, indices []int) bool {
+	for _, index := range indices {
+		// PT_LOAD is 1.
+		if layout.Segments[index].Type == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// Compares the segments containing each section in the original layout with
+// those in the patched layout, adding a SectionMappingChange to the report
+// for each section whose segments changed. Adds a warning for each section
+// that's still allocated, and was loaded before patching, but no longer is.
+func (r *Report) addSectionMapping(original, patched *LayoutSnapshot) {
+	before := sectionSegments(original)
+	after := sectionSegments(patched)
+	for i := range after {
+		if i >= len(before) {
+			break
+		}
+		left := segmentDifference(before[i], original, after[i], patched)
+		joined := segmentDifference(after[i], patched, before[i], original)
+		if (len(left) == 0) && (len(joined) == 0) {
+			continue
+		}
+		name := patched.Sections[i].Name
+		description := fmt.Sprintf("Section %d", i)
+		if name != "" {
+			description += " (" + name + ")"
+		}
+		var changes []string
+		if len(left) != 0 {
+			changes = append(changes, "left "+describeSegmentList(original,
+				left, nil))
+		}
+		if len(joined) != 0 {
+			changes = append(changes, "joined "+describeSegmentList(patched,
+				joined, original))
+		}
+		description += " " + strings.Join(changes, ", and ")
+		r.SectionMapping = append(r.SectionMapping, SectionMappingChange{
+			SectionIndex:     i,
+			Name:             name,
+			OriginalSegments: before[i],
+			NewSegments:      after[i],
+			Description:      description,
+		})
+		// Sections that are no longer allocated, such as stripped notes,
+		// aren't expected to be loaded.
+		if includesLoadSegment(original, before[i]) &&
+			!includesLoadSegment(patched, after[i]) &&
+			((patched.Sections[i].Flags & 2) != 0) {
+			r.addWarning("Section %d (%s) is no longer in any loadable "+
+				"segment", i, name)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package stringreplace
+
+// This file contains lookups of the section name table (.shstrtab) that
+// handle the two special values of e_shstrndx: SHN_UNDEF, used by files
+// without a section name table, and SHN_XINDEX, used when the table's index
+// doesn't fit in the ELF header, in which case it's in section 0's sh_link.
+// elf_reader's GetSectionName uses e_shstrndx as-is, so it fails for the
+// former and reads the wrong section for the latter.
+
+import (
+	"fmt"
+	"github.com/yalue/elf_reader"
+)
+
+// The e_shstrndx value (SHN_XINDEX) indicating that the index of the section
+// name table is in section 0's sh_link.
+const extendedSectionIndex = 0xffff
+
+// Returns the index of the section holding the section names, and false if
+// the file has none, i.e. if e_shstrndx is SHN_UNDEF (0), or it (or the
+// extended index in section 0's sh_link) isn't a valid section index.
+func SectionNamesTable(f *elf_reader.ELF32File) (uint16, bool) {
+	index := uint32(f.Header.SectionNamesTable)
+	if (index == extendedSectionIndex) && (len(f.Sections) != 0) {
+		index = f.Sections[0].LinkedIndex
+	}
+	if (index == 0) || (index >= uint32(len(f.Sections))) {
+		return 0, false
+	}
+	return uint16(index), true
+}
+
+// Returns the name of the section with the given index, like elf_reader's
+// GetSectionName, but finding the section name table using
+// SectionNamesTable. Returns an error if the file has no section name table.
+func SectionName(f *elf_reader.ELF32File, sectionIndex uint16) (string,
+	error) {
+	if int(sectionIndex) >= len(f.Sections) {
+		return "", fmt.Errorf("Invalid section index: %d", sectionIndex)
+	}
+	namesIndex, ok := SectionNamesTable(f)
+	if !ok {
+		return "", fmt.Errorf("The file has no section name table")
+	}
+	names, e := f.GetSectionContent(namesIndex)
+	if e != nil {
+		return "", e
+	}
+	name, e := elf_reader.ReadStringAtOffset(f.Sections[sectionIndex].Name,
+		names)
+	if e != nil {
+		return "", e
+	}
+	return string(name), nil
+}
@@ -0,0 +1,499 @@
+package stringreplace
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/yalue/elf_reader"
+)
+
+// Returns a readelf-style representation of program header flags, e.g. "R E".
+func SegmentFlagsString(flags uint32) string {
+	toReturn := []byte("   ")
+	if (flags & 4) != 0 {
+		toReturn[0] = 'R'
+	}
+	if (flags & 2) != 0 {
+		toReturn[1] = 'W'
+	}
+	if (flags & 1) != 0 {
+		toReturn[2] = 'E'
+	}
+	return string(toReturn)
+}
+
+// Maps program header types to the names used by readelf.
+var segmentTypeNames = map[uint32]string{
+	0:          "NULL",
+	1:          "LOAD",
+	2:          "DYNAMIC",
+	3:          "INTERP",
+	4:          "NOTE",
+	5:          "SHLIB",
+	6:          "PHDR",
+	7:          "TLS",
+	0x6474e550: "GNU_EH_FRAME",
+	0x6474e551: "GNU_STACK",
+	0x6474e552: "GNU_RELRO",
+	0x6474e553: "GNU_PROPERTY",
+	0x70000001: "ARM_EXIDX",
+}
+
+// Returns the readelf-style name for a program header type.
+func SegmentTypeName(segmentType uint32) string {
+	name, ok := segmentTypeNames[segmentType]
+	if !ok {
+		return fmt.Sprintf("0x%08x", segmentType)
+	}
+	return name
+}
+
+// The names of processor-specific program header types whose meaning depends
+// on the file's e_machine value, keyed by it.
+var machineSegmentTypeNames = map[uint16]map[uint32]string{
+	machineRISCV: {riscvAttributes: "RISCV_ATTRIBUTES"},
+}
+
+// Returns the readelf-style name for a program header type in a file with
+// the given e_machine value, including that machine's processor-specific
+// types.
+func MachineSegmentTypeName(machine uint16, segmentType uint32) string {
+	name, ok := machineSegmentTypeNames[machine][segmentType]
+	if ok {
+		return name
+	}
+	return SegmentTypeName(segmentType)
+}
+
+// Returns the index of the first loadable segment containing the entire file
+// range of the given size starting at offset, or -1 if no loadable segment
+// contains it.
+func ContainingLoadSegment(f *elf_reader.ELF32File, offset,
+	size uint32) int {
+	var s *elf_reader.ELF32ProgramHeader
+	end := uint64(offset) + uint64(size)
+	for i := range f.Segments {
+		s = &(f.Segments[i])
+		if s.Type != elf_reader.LoadableSegment {
+			continue
+		}
+		if (offset >= s.FileOffset) &&
+			(end <= (uint64(s.FileOffset) + uint64(s.FileSize))) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Returns a short description of the segment at the given index, including
+// its permissions, for logging.
+func describeSegment(f *elf_reader.ELF32File, index int) string {
+	if (index < 0) || (index >= len(f.Segments)) {
+		return "no loadable segment"
+	}
+	s := &(f.Segments[index])
+	return fmt.Sprintf("segment %d (LOAD at VA 0x%08x, %s)", index,
+		s.VirtualAddress, SegmentFlagsString(uint32(s.Flags)))
+}
+
+// The program header type of the PT_GNU_RELRO segment, which marks a region
+// the dynamic loader makes read-only after applying relocations.
+const gnuRELROSegment = 0x6474e552
+
+// The smallest page size assumed when reasoning about how segments are
+// mapped.
+const minimumPageSize = 0x1000
+
+// The e_phnum value (PN_XNUM) indicating that the number of program headers
+// doesn't fit in the ELF header, in which case it's in section 0's sh_info.
+const extendedProgramHeaderCount = 0xffff
+
+// Parses a 32-bit ELF file, like elf_reader.ParseELF32File, but reads every
+// program header in files using PN_XNUM, which elf_reader limits to the first
+// 0xffff.
+func ParseELF32File(raw []byte) (*elf_reader.ELF32File, error) {
+	f, e := elf_reader.ParseELF32File(raw)
+	if e != nil {
+		return nil, e
+	}
+	e = readExtendedProgramHeaders(f)
+	if e != nil {
+		return nil, e
+	}
+	return f, nil
+}
+
+// Calls f.ReparseData, and then reads every program header if the file uses
+// PN_XNUM. Used in place of f.ReparseData everywhere in this package.
+func reparseELF(f *elf_reader.ELF32File) error {
+	e := f.ReparseData()
+	if e != nil {
+		return e
+	}
+	return readExtendedProgramHeaders(f)
+}
+
+// If e_phnum is PN_XNUM and section 0's sh_info holds a larger count, replaces
+// f.Segments with that many entries read from the program header table.
+func readExtendedProgramHeaders(f *elf_reader.ELF32File) error {
+	h := &(f.Header)
+	if (h.ProgramHeaderEntries != extendedProgramHeaderCount) ||
+		(len(f.Sections) == 0) {
+		return nil
+	}
+	count := f.Sections[0].Info
+	if count <= extendedProgramHeaderCount {
+		return nil
+	}
+	end := uint64(h.ProgramHeaderOffset) + uint64(count)*
+		uint64(binary.Size(elf_reader.ELF32ProgramHeader{}))
+	if end > uint64(len(f.Raw)) {
+		return fmt.Errorf("The program header table's %d entries (from "+
+			"section 0's sh_info) extend past the end of the file", count)
+	}
+	segments := make([]elf_reader.ELF32ProgramHeader, count)
+	e := binary.Read(bytes.NewReader(f.Raw[h.ProgramHeaderOffset:end]),
+		f.Endianness, segments)
+	if e != nil {
+		return fmt.Errorf("Failed reading program headers: %s", e)
+	}
+	f.Segments = segments
+	return nil
+}
+
+// Returns an error if the ELF header's program header count or entry size is
+// inconsistent with the file. If e_phnum is PN_XNUM, section 0's sh_info must
+// hold a count of at least PN_XNUM, as in files parsed by ParseELF32File.
+func checkProgramHeaderCount(f *elf_reader.ELF32File) error {
+	h := &(f.Header)
+	if h.ProgramHeaderEntries == 0 {
+		return nil
+	}
+	entrySize := binary.Size(elf_reader.ELF32ProgramHeader{})
+	if int(h.ProgramHeaderEntrySize) != entrySize {
+		return fmt.Errorf("Invalid program header entry size: %d (expected "+
+			"%d)", h.ProgramHeaderEntrySize, entrySize)
+	}
+	if h.ProgramHeaderEntries != extendedProgramHeaderCount {
+		return nil
+	}
+	if len(f.Sections) == 0 {
+		return fmt.Errorf("e_phnum is PN_XNUM (0x%x), but the file has no "+
+			"section 0 holding the number of program headers",
+			extendedProgramHeaderCount)
+	}
+	count := f.Sections[0].Info
+	if count < extendedProgramHeaderCount {
+		return fmt.Errorf("e_phnum is PN_XNUM, but section 0's sh_info "+
+			"holds %d program headers, which should have been stored in "+
+			"e_phnum", count)
+	}
+	if uint32(len(f.Segments)) != count {
+		return fmt.Errorf("Section 0's sh_info holds %d program headers, "+
+			"but %d were read", count, len(f.Segments))
+	}
+	return nil
+}
+
+// Sets the number of program headers in the ELF header (e_phnum) to the
+// number of entries in f.Segments, using the PN_XNUM convention if there are
+// too many to fit, in which case the count is written to section 0's
+// sh_info. Returns an error if the file has no section 0 to hold it.
+// reparseELF must be called afterwards.
+func writeProgramHeaderCount(f *elf_reader.ELF32File) error {
+	count := len(f.Segments)
+	if count < extendedProgramHeaderCount {
+		// e_phnum is at offset 44 in the ELF header.
+		return writeELFUint16(f, 44, uint16(count), "ELF header")
+	}
+	if len(f.Sections) == 0 {
+		return fmt.Errorf("The file would need %d program headers, which "+
+			"requires a section header table to hold the count", count)
+	}
+	// sh_info is at offset 28 in section 0's header.
+	e := writeELFUint32(f, getSectionHeaderOffset(f, 0)+28, uint32(count),
+		"section header")
+	if e != nil {
+		return e
+	}
+	f.Sections[0].Info = uint32(count)
+	return writeELFUint16(f, 44, extendedProgramHeaderCount,
+		"ELF header")
+}
+
+// Returns the page size to assume when checking how segments will be mapped:
+// the largest alignment of any loadable segment, but at least the given
+// minimum, which should be at least minimumPageSize.
+func loadPageSize(f *elf_reader.ELF32File, minimum uint32) uint32 {
+	toReturn := minimum
+	for i := range f.Segments {
+		if f.Segments[i].Type != elf_reader.LoadableSegment {
+			continue
+		}
+		if f.Segments[i].Align > toReturn {
+			toReturn = f.Segments[i].Align
+		}
+	}
+	return toReturn
+}
+
+// Returns the start of the page containing the given address.
+func pageStart(address uint64, pageSize uint32) uint64 {
+	return address - (address % uint64(pageSize))
+}
+
+// Returns the start of the first page at or after the given address.
+func pageEnd(address uint64, pageSize uint32) uint64 {
+	return pageStart(address+uint64(pageSize)-1, pageSize)
+}
+
+// Returns the range of pages, [start, end), that the dynamic loader will make
+// read-only due to the PT_GNU_RELRO segment. Like glibc, the end of the
+// region is rounded down to a page boundary. Returns false if the file has no
+// PT_GNU_RELRO segment, or if it doesn't cover a full page.
+func relroPageRange(f *elf_reader.ELF32File, pageSize uint32) (uint64, uint64,
+	bool) {
+	var s *elf_reader.ELF32ProgramHeader
+	for i := range f.Segments {
+		s = &(f.Segments[i])
+		if uint32(s.Type) != gnuRELROSegment {
+			continue
+		}
+		start := pageStart(uint64(s.VirtualAddress), pageSize)
+		end := pageStart(uint64(s.VirtualAddress)+uint64(s.MemorySize),
+			pageSize)
+		return start, end, start < end
+	}
+	return 0, 0, false
+}
+
+// Returns the address just past the end of the highest loadable segment in
+// memory.
+func loadSegmentsEnd(f *elf_reader.ELF32File) uint64 {
+	var toReturn, end uint64
+	var s *elf_reader.ELF32ProgramHeader
+	for i := range f.Segments {
+		s = &(f.Segments[i])
+		if s.Type != elf_reader.LoadableSegment {
+			continue
+		}
+		end = uint64(s.VirtualAddress) + uint64(s.MemorySize)
+		if end > toReturn {
+			toReturn = end
+		}
+	}
+	return toReturn
+}
+
+// Returns the virtual address at which to map a new loadable segment of the
+// given size, holding the file data starting at offset. This is normally
+// preferredAddress, but if any page of the new segment would fall in the
+// region made read-only by PT_GNU_RELRO, the loader would either reject the
+// file or silently protect the new data along with the RELRO region. In that
+// case, this adds a warning to the report and returns the first suitable
+// address past all existing loadable segments instead.
+func avoidRELROPages(f *elf_reader.ELF32File, offset, size,
+	preferredAddress uint32, report *Report) (uint32, error) {
+	pageSize := loadPageSize(f, report.pageSize)
+	relroStart, relroEnd, ok := relroPageRange(f, pageSize)
+	if !ok {
+		return preferredAddress, nil
+	}
+	start := pageStart(uint64(preferredAddress), pageSize)
+	end := pageEnd(uint64(preferredAddress)+uint64(size), pageSize)
+	if (end <= relroStart) || (start >= relroEnd) {
+		return preferredAddress, nil
+	}
+	newAddress, e := afterLastLoadAddress(f, offset, size, report)
+	if e != nil {
+		return 0, e
+	}
+	report.addWarning("VA 0x%08x for the new segment overlaps the "+
+		"GNU_RELRO pages (0x%08x-0x%08x). Using VA 0x%08x instead.",
+		preferredAddress, relroStart, relroEnd, newAddress)
+	return newAddress, nil
+}
+
+// Adds a warning to the report if the PT_GNU_RELRO segment is no longer
+// contained in a single loadable segment, which hardened loaders treat as an
+// error.
+func checkRELROCoverage(f *elf_reader.ELF32File, report *Report) {
+	var s, load *elf_reader.ELF32ProgramHeader
+	var covered bool
+	for i := range f.Segments {
+		s = &(f.Segments[i])
+		if uint32(s.Type) != gnuRELROSegment {
+			continue
+		}
+		covered = false
+		for j := range f.Segments {
+			load = &(f.Segments[j])
+			if load.Type != elf_reader.LoadableSegment {
+				continue
+			}
+			if (s.VirtualAddress >= load.VirtualAddress) &&
+				((uint64(s.VirtualAddress) + uint64(s.MemorySize)) <=
+					(uint64(load.VirtualAddress) + uint64(load.MemorySize))) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			report.addWarning("The GNU_RELRO segment (VA 0x%08x, size "+
+				"0x%x) isn't contained in a loadable segment",
+				s.VirtualAddress, s.MemorySize)
+		}
+	}
+}
+
+// Checks that the PT_PHDR segment, if present, lies within a loadable segment
+// at a virtual address consistent with that segment's mapping. glibc and the
+// kernel use PT_PHDR to locate the program headers in memory (and, for
+// position-independent files, to compute the load bias), so an inconsistent
+// entry breaks loading. If the table is loaded at a different address than
+// PT_PHDR claims, PT_PHDR is repaired. Returns an error if the table isn't
+// loaded at all. reparseELF must be called if this modifies the file.
+// Warnings are added to the report.
+func validateProgramHeaderSegment(f *elf_reader.ELF32File,
+	report *Report) (bool, error) {
+	var s *elf_reader.ELF32ProgramHeader
+	for i := range f.Segments {
+		s = &(f.Segments[i])
+		if s.Type != elf_reader.ProgramHeaderSegment {
+			continue
+		}
+		if (s.FileOffset != f.Header.ProgramHeaderOffset) ||
+			(s.FileSize < uint32(binary.Size(f.Segments))) {
+			return false, fmt.Errorf("The PHDR segment (offset 0x%x, size "+
+				"0x%x) doesn't match the program header table", s.FileOffset,
+				s.FileSize)
+		}
+		loadIndex := ContainingLoadSegment(f, s.FileOffset, s.FileSize)
+		if loadIndex < 0 {
+			return false, fmt.Errorf("The program header table at offset "+
+				"0x%x isn't covered by a loadable segment", s.FileOffset)
+		}
+		load := &(f.Segments[loadIndex])
+		expected := load.VirtualAddress + (s.FileOffset - load.FileOffset)
+		if s.VirtualAddress == expected {
+			return false, nil
+		}
+		report.logf("Repairing the PHDR segment's VA: 0x%08x -> 0x%08x\n",
+			s.VirtualAddress, expected)
+		s.VirtualAddress = expected
+		e := writeAtELFOffset(f, f.Header.ProgramHeaderOffset, f.Segments,
+			"program headers")
+		if e != nil {
+			return false, fmt.Errorf("Failed updating the PHDR segment: %s",
+				e)
+		}
+		return true, nil
+	}
+	return false, validateUnreferencedProgramHeaders(f, report)
+}
+
+// Validates the location of the program header table in a file without a
+// PT_PHDR segment. The table must still be loaded, since the kernel passes
+// its address to executables (as AT_PHDR), and static executables use it to
+// find segments such as PT_TLS. Some kernels compute that address from the
+// first loadable segment's mapping and e_phoff, without checking which
+// segment actually loads the table, so a warning is added to the report if
+// that address would be wrong.
+func validateUnreferencedProgramHeaders(f *elf_reader.ELF32File,
+	report *Report) error {
+	tableOffset := f.Header.ProgramHeaderOffset
+	tableSize := uint32(binary.Size(f.Segments))
+	if uint64(tableOffset)+uint64(tableSize) > uint64(len(f.Raw)) {
+		return fmt.Errorf("The program header table at offset 0x%x extends "+
+			"past the end of the file", tableOffset)
+	}
+	loadIndex := ContainingLoadSegment(f, tableOffset, tableSize)
+	if loadIndex < 0 {
+		// This is only a problem if the file gets loaded at all; relocatable
+		// objects, for example, have no segments.
+		if len(f.Segments) != 0 {
+			report.addWarning("The program header table at offset 0x%x "+
+				"isn't loaded, and there's no PHDR segment", tableOffset)
+		}
+		return nil
+	}
+	load := &(f.Segments[loadIndex])
+	address := load.VirtualAddress + (tableOffset - load.FileOffset)
+	var first *elf_reader.ELF32ProgramHeader
+	for i := range f.Segments {
+		if f.Segments[i].Type != elf_reader.LoadableSegment {
+			continue
+		}
+		if (first == nil) || (f.Segments[i].FileOffset < first.FileOffset) {
+			first = &(f.Segments[i])
+		}
+	}
+	derived := first.VirtualAddress - first.FileOffset + tableOffset
+	// The dynamic loader finds a shared library's program headers on its own,
+	// so this only matters for executables.
+	if (derived != address) && isExecutable(f) {
+		report.addWarning("The program header table is loaded at VA "+
+			"0x%08x, but kernels deriving its address from the first "+
+			"loadable segment will expect it at 0x%08x", address, derived)
+	}
+	return nil
+}
+
+// Returns true if f is an executable: either ET_EXEC, or a file requesting a
+// program interpreter (e.g. a PIE).
+func isExecutable(f *elf_reader.ELF32File) bool {
+	if uint32(f.Header.Type) == 2 {
+		return true
+	}
+	for i := range f.Segments {
+		// PT_INTERP is 3.
+		if uint32(f.Segments[i].Type) == 3 {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the index of the loadable segment that can be grown to cover data
+// appended at the given file offset, or -1 and the reason it can't be done.
+// This must be the last loadable segment, both in memory and in the file,
+// its file and memory sizes must match (so appended data doesn't overlap
+// zero-filled memory), and it must be readable but not executable.
+func extendableLoadSegment(f *elf_reader.ELF32File,
+	appendOffset uint32) (int, string) {
+	lastIndex := -1
+	var s, last *elf_reader.ELF32ProgramHeader
+	for i := range f.Segments {
+		s = &(f.Segments[i])
+		if s.Type != elf_reader.LoadableSegment {
+			continue
+		}
+		if (last == nil) || (s.VirtualAddress > last.VirtualAddress) {
+			lastIndex = i
+			last = s
+		}
+	}
+	if last == nil {
+		return -1, "the file has no loadable segments"
+	}
+	for i := range f.Segments {
+		s = &(f.Segments[i])
+		if (s.Type == elf_reader.LoadableSegment) &&
+			(s.FileOffset > last.FileOffset) {
+			return -1, "the last loadable segment in memory isn't the last " +
+				"one in the file"
+		}
+	}
+	if last.FileSize != last.MemorySize {
+		return -1, "the last loadable segment contains zero-filled memory"
+	}
+	flags := uint32(last.Flags)
+	if ((flags & 4) == 0) || ((flags & 1) != 0) {
+		return -1, fmt.Sprintf("the last loadable segment's permissions "+
+			"(%s) don't match", SegmentFlagsString(flags))
+	}
+	if appendOffset < (last.FileOffset + last.FileSize) {
+		return -1, "the appended data would overlap the last loadable segment"
+	}
+	return lastIndex, ""
+}
@@ -0,0 +1,148 @@
+package stringreplace
+
+// This file contains support for sections whose entire content is a single
+// NUL-terminated string, such as .interp or some vendor-specific configuration
+// sections. They're patched like string tables, except that a replacement
+// string replaces the section's whole content, rather than being appended to
+// it, and the PT_INTERP segment is updated to follow the .interp section.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/yalue/elf_reader"
+)
+
+// The program header type of the PT_INTERP segment, which holds the path to
+// the program interpreter.
+const interpreterSegment = 3
+
+// Returns true if the content is a single string: it doesn't start with a
+// NUL byte, ends with one, contains no others, and contains only printable
+// ASCII characters and tabs.
+func looksLikeSingleString(content []byte) bool {
+	if (len(content) < 2) || (content[len(content)-1] != 0) {
+		return false
+	}
+	for _, c := range content[:len(content)-1] {
+		if ((c < 0x20) && (c != '\t')) || (c >= 0x7f) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the index of the section holding the path in the PT_INTERP segment,
+// or -1 if there isn't one.
+func interpreterSection(f *elf_reader.ELF32File) int {
+	for i := range f.Segments {
+		s := &(f.Segments[i])
+		if uint32(s.Type) != interpreterSegment {
+			continue
+		}
+		for j := range f.Sections {
+			section := &(f.Sections[j])
+			// SHT_NOBITS is 8.
+			if (section.Type != 8) && (section.Size != 0) &&
+				(section.FileOffset == s.FileOffset) {
+				return j
+			}
+		}
+	}
+	return -1
+}
+
+// Replaces the new content of each table that's a single string with only
+// the replacement string, so the relocated section still holds a single
+// string. In same-size mode, the replacement already overwrote the original,
+// as it does in in-place mode if it fit.
+func collapseSingleStringTables(tables []replacedStringTable,
+	options *Options) error {
+	if options.SameSize {
+		return nil
+	}
+	for i := range tables {
+		t := &(tables[i])
+		if (len(t.replacements) != 1) || !looksLikeSingleString(t.oldContent) {
+			continue
+		}
+		r := &(t.replacements[0])
+		if options.InPlace && (r.newOffset == r.originalOffset) {
+			continue
+		}
+		s, e := elf_reader.ReadStringAtOffset(r.newOffset, t.newContent)
+		if e != nil {
+			return fmt.Errorf("Failed reading the replacement in section %d: "+
+				"%s", t.sectionIndex, e)
+		}
+		t.newContent = append(append([]byte(nil), s...), 0)
+		r.newOffset = 0
+	}
+	return nil
+}
+
+// Updates the PT_INTERP segment to refer to the replacement for the path in
+// the .interp section, if it was replaced.
+func replaceInterpreterPath(f *elf_reader.ELF32File,
+	replacements []replacedStringTable, report *Report) error {
+	headerSize := uint32(binary.Size(elf_reader.ELF32ProgramHeader{}))
+	changed := false
+	for i := range f.Segments {
+		s := &(f.Segments[i])
+		if uint32(s.Type) != interpreterSegment {
+			continue
+		}
+		var t *replacedStringTable
+		for j := range replacements {
+			if (replacements[j].oldFileOffset == s.FileOffset) &&
+				looksLikeSingleString(replacements[j].oldContent) {
+				t = &(replacements[j])
+				break
+			}
+		}
+		if t == nil {
+			continue
+		}
+		index, ok := t.replacementIndices[0]
+		if !ok {
+			continue
+		}
+		r := &(t.replacements[index])
+		path, e := elf_reader.ReadStringAtOffset(r.newOffset, t.newContent)
+		if e != nil {
+			return fmt.Errorf("Failed reading the new interpreter path: %s", e)
+		}
+		newOffset := t.newFileOffset + r.newOffset
+		newAddress := t.newVirtualAddress + r.newOffset
+		headerOffset := f.Header.ProgramHeaderOffset + uint32(i)*headerSize
+		// p_offset and p_vaddr are at offsets 4 and 8 in the program header.
+		report.addReference(ReferenceUpdate{
+			FileOffset:    headerOffset + 4,
+			SectionIndex:  t.sectionIndex,
+			OriginalValue: s.FileOffset,
+			NewValue:      newOffset,
+			Location:      fmt.Sprintf("segment %d PT_INTERP p_offset", i),
+		})
+		report.addReference(ReferenceUpdate{
+			FileOffset:    headerOffset + 8,
+			SectionIndex:  t.sectionIndex,
+			OriginalValue: s.VirtualAddress,
+			NewValue:      newAddress,
+			Location:      fmt.Sprintf("segment %d PT_INTERP p_vaddr", i),
+		})
+		if s.PhysicalAddress == s.VirtualAddress {
+			s.PhysicalAddress = newAddress
+		}
+		s.FileOffset = newOffset
+		s.VirtualAddress = newAddress
+		s.FileSize = uint32(len(path) + 1)
+		s.MemorySize = s.FileSize
+		report.logf("Replaced interpreter path: %s\n",
+			t.showReplacement(index))
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return writeAtELFOffset(f, f.Header.ProgramHeaderOffset, f.Segments,
+		"program headers")
+}
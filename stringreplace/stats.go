@@ -0,0 +1,229 @@
+package stringreplace
+
+// This file contains ComputeStatistics, which summarizes a file's string
+// tables and symbol names without patching anything: how large each table
+// is, how many strings it holds and how many fields refer to them, which
+// strings are duplicated, and how long symbol names tend to be. This helps to
+// judge which tables dominate a file, and roughly how much a rename will grow
+// it.
+
+import (
+	"fmt"
+	"github.com/yalue/elf_reader"
+	"sort"
+)
+
+// The number of most-duplicated strings listed for each table.
+const maxListedDuplicates = 5
+
+// A string that occurs more than once in a string table.
+type DuplicateString struct {
+	// The string, escaped using EscapeString.
+	String string `json:"string"`
+	// The number of times the string occurs.
+	Count int `json:"count"`
+}
+
+// Statistics about a single string table.
+type TableStatistics struct {
+	SectionIndex uint16 `json:"section_index"`
+	// The section's name, escaped using EscapeString.
+	Name string `json:"name"`
+	// The size of the table, in bytes.
+	Size uint32 `json:"size"`
+	// True if the table is loaded into memory (SHF_ALLOC), in which case it
+	// must be relocated if it grows.
+	Loaded bool `json:"loaded"`
+	// The number of non-empty strings in the table, and the number of
+	// distinct ones.
+	Entries       int `json:"entries"`
+	UniqueEntries int `json:"unique_entries"`
+	// The number of bytes, including NUL terminators, taken by the second
+	// and later copies of duplicated strings.
+	DuplicateBytes uint32 `json:"duplicate_bytes"`
+	// The most-duplicated strings, most frequent first.
+	Duplicates []DuplicateString `json:"duplicates,omitempty"`
+	// The longest string, escaped using EscapeString, and its length before
+	// escaping.
+	Longest       string `json:"longest"`
+	LongestLength int    `json:"longest_length"`
+	// False if the table may be referred to by something this package
+	// doesn't know about, in which case References and ReferencedStrings
+	// are 0.
+	ReferencesKnown bool `json:"references_known"`
+	// The number of fields (section names, symbol names, dynamic entries,
+	// version requirements, and so on) referring to strings in the table,
+	// and the number of distinct offsets they refer to.
+	References        int `json:"references"`
+	ReferencedStrings int `json:"referenced_strings"`
+}
+
+// The number of symbol names with lengths in the range [MinLength,
+// MaxLength]. MaxLength is 0 for the last bucket, which has no upper bound.
+type LengthBucket struct {
+	MinLength int `json:"min_length"`
+	MaxLength int `json:"max_length"`
+	Count     int `json:"count"`
+}
+
+// Holds the result of ComputeStatistics.
+type Statistics struct {
+	// The size of the file, and the total size of its string tables.
+	FileSize        uint32 `json:"file_size"`
+	StringTableSize uint32 `json:"string_table_size"`
+	// The string tables, largest first.
+	Tables []TableStatistics `json:"tables"`
+	// The number of named entries in all of the symbol tables, and a
+	// histogram of their names' lengths. A symbol in both .symtab and
+	// .dynsym is counted twice.
+	Symbols           int            `json:"symbols"`
+	SymbolNameLengths []LengthBucket `json:"symbol_name_lengths"`
+}
+
+// Returns the statistics for the string table with the given index.
+func computeTableStatistics(f *elf_reader.ELF32File,
+	tableIndex uint16) (*TableStatistics, error) {
+	content, e := f.GetSectionContent(tableIndex)
+	if e != nil {
+		return nil, fmt.Errorf("Failed reading section %d: %s", tableIndex, e)
+	}
+	section := &(f.Sections[tableIndex])
+	name, _ := SectionName(f, tableIndex)
+	toReturn := &TableStatistics{
+		SectionIndex: tableIndex,
+		Name:         EscapeString(name),
+		Size:         uint32(len(content)),
+		// SHF_ALLOC is 2.
+		Loaded: (uint32(section.Flags) & 2) != 0,
+	}
+	counts := make(map[string]int)
+	longest := ""
+	start := 0
+	for i, b := range content {
+		if b != 0 {
+			continue
+		}
+		s := string(content[start:i])
+		start = i + 1
+		if len(s) == 0 {
+			continue
+		}
+		toReturn.Entries++
+		counts[s]++
+		if counts[s] > 1 {
+			toReturn.DuplicateBytes += uint32(len(s)) + 1
+		}
+		if len(s) > len(longest) {
+			longest = s
+		}
+	}
+	toReturn.UniqueEntries = len(counts)
+	toReturn.Longest = EscapeString(longest)
+	toReturn.LongestLength = len(longest)
+	for s, count := range counts {
+		if count > 1 {
+			toReturn.Duplicates = append(toReturn.Duplicates, DuplicateString{
+				String: s,
+				Count:  count,
+			})
+		}
+	}
+	sort.Slice(toReturn.Duplicates, func(a, b int) bool {
+		x, y := &(toReturn.Duplicates[a]), &(toReturn.Duplicates[b])
+		if x.Count != y.Count {
+			return x.Count > y.Count
+		}
+		return x.String < y.String
+	})
+	if len(toReturn.Duplicates) > maxListedDuplicates {
+		toReturn.Duplicates = toReturn.Duplicates[:maxListedDuplicates]
+	}
+	for i := range toReturn.Duplicates {
+		d := &(toReturn.Duplicates[i])
+		d.String = EscapeString(d.String)
+	}
+	references, ok, e := findTableReferences(f, tableIndex, nil)
+	if e != nil {
+		return nil, fmt.Errorf("Failed finding references to section %d: %s",
+			tableIndex, e)
+	}
+	if ok {
+		toReturn.ReferencesKnown = true
+		toReturn.ReferencedStrings = len(references.counts)
+		for _, count := range references.counts {
+			toReturn.References += count
+		}
+	}
+	return toReturn, nil
+}
+
+// Returns a histogram of the lengths of the symbol names in all of the
+// file's symbol tables, in buckets doubling in size (1, 2-3, 4-7, and so on,
+// up to 256 and longer), along with the number of named symbols.
+func symbolNameHistogram(f *elf_reader.ELF32File) ([]LengthBucket, int,
+	error) {
+	var toReturn []LengthBucket
+	for length := 1; length <= 256; length *= 2 {
+		toReturn = append(toReturn, LengthBucket{
+			MinLength: length,
+			MaxLength: length*2 - 1,
+		})
+	}
+	toReturn[len(toReturn)-1].MaxLength = 0
+	symbols := 0
+	for i := range f.Sections {
+		sectionType := uint32(f.Sections[i].Type)
+		// SHT_SYMTAB is 2, and SHT_DYNSYM is 11.
+		if (sectionType != 2) && (sectionType != 11) {
+			continue
+		}
+		names, e := readSymbolNames(f, uint16(i))
+		if e != nil {
+			return nil, 0, fmt.Errorf("Failed reading section %d: %s", i, e)
+		}
+		for _, name := range names {
+			if len(name) == 0 {
+				continue
+			}
+			symbols++
+			bucket := 0
+			for (bucket < (len(toReturn) - 1)) &&
+				(len(name) > toReturn[bucket].MaxLength) {
+				bucket++
+			}
+			toReturn[bucket].Count++
+		}
+	}
+	return toReturn, symbols, nil
+}
+
+// Returns statistics about the string tables and symbol names in the given
+// 32-bit ELF file content. The input isn't modified.
+func ComputeStatistics(input []byte) (*Statistics, error) {
+	f, e := ParseELF32File(input)
+	if e != nil {
+		return nil, fmt.Errorf("Failed parsing the input file: %s", e)
+	}
+	toReturn := &Statistics{
+		FileSize: uint32(len(input)),
+	}
+	for i := range f.Sections {
+		if !f.IsStringTable(uint16(i)) {
+			continue
+		}
+		table, e := computeTableStatistics(f, uint16(i))
+		if e != nil {
+			return nil, e
+		}
+		toReturn.StringTableSize += table.Size
+		toReturn.Tables = append(toReturn.Tables, *table)
+	}
+	sort.SliceStable(toReturn.Tables, func(a, b int) bool {
+		return toReturn.Tables[a].Size > toReturn.Tables[b].Size
+	})
+	toReturn.SymbolNameLengths, toReturn.Symbols, e = symbolNameHistogram(f)
+	if e != nil {
+		return nil, e
+	}
+	return toReturn, nil
+}
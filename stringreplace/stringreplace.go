@@ -0,0 +1,1999 @@
+// Package stringreplace implements the replacement of strings in the string
+// tables of 32-bit ELF files, without breaking the ELF format. Modified string
+// tables are appended to the end of the file, in a new loadable segment, and
+// every known reference to a replaced string is updated to point to its new
+// location.
+//
+// This package only operates on byte slices, parsed ELF files, and fs.FS
+// implementations supplied by the caller. It never accesses the operating
+// system's filesystem directly, so it can be used in environments such as
+// WebAssembly.
+package stringreplace
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/yalue/elf_reader"
+	"log"
+	"regexp"
+	"time"
+)
+
+// This tracks each string that was replaced, including old and new offsets
+// into the string table.
+type replacedString struct {
+	originalOffset uint32
+	newOffset      uint32
+}
+
+// This tracks each updated string table.
+type replacedStringTable struct {
+	oldContent        []byte
+	newContent        []byte
+	oldFileOffset     uint32
+	newFileOffset     uint32
+	oldVirtualAddress uint32
+	newVirtualAddress uint32
+	sectionIndex      uint16
+	// The name of the table's section, used to decide which rules apply.
+	sectionName string
+	// Other sections describing the same table, and their names. See
+	// alias.go.
+	aliases    []uint16
+	aliasNames []string
+	// If not nil, only strings starting at these offsets may be replaced.
+	allowedOffsets map[uint32]bool
+	// Strings starting at these offsets may not be replaced.
+	excludedOffsets map[uint32]bool
+	replacements    []replacedString
+	// Maps each replaced string's original offset to its index in
+	// replacements.
+	replacementIndices map[uint32]int
+	// The indices of the loadable segments that contained the original and
+	// relocated tables, or -1 if the table wasn't loaded into memory.
+	oldSegmentIndex int
+	newSegmentIndex int
+	// The report to which updated references and warnings are added.
+	report *Report
+	// For each rule, whether it matched any string in the table, and whether
+	// any match expanded to a non-empty string. Only tracked for rules which
+	// refer to capture groups.
+	ruleMatched  []bool
+	ruleExpanded []bool
+	// What each rule did in the table, only tracked if the report includes
+	// explanations.
+	ruleStats []ruleStats
+	// The number of strings appended to newContent for new dynamic table
+	// entries. See dynamic_growth.go.
+	addedStrings int
+	// The offsets referred to by anything in the file, if strings are
+	// overwritten in place and the table's references are all known, or
+	// nil otherwise. See canOverwrite.
+	referencedOffsets map[uint32]bool
+}
+
+// Returns a string representation of the replacedString value at
+// replacements[i]. This is mostly for logging/debugging, so the string values
+// may be incorrect if the index or replacedStringTable structure contains any
+// errors.
+func (r *replacedStringTable) showReplacement(replacementIndex int) string {
+	if replacementIndex > len(r.replacements) {
+		return fmt.Sprintf("Invalid replacedString index %d", replacementIndex)
+	}
+	originalOffset := r.replacements[replacementIndex].originalOffset
+	newOffset := r.replacements[replacementIndex].newOffset
+	tmp, e := elf_reader.ReadStringAtOffset(originalOffset, r.oldContent)
+	var originalString, newString string
+	if e != nil {
+		originalString = fmt.Sprintf("<error reading: %s>", e)
+	} else {
+		originalString = EscapeString(string(tmp))
+	}
+	tmp, e = elf_reader.ReadStringAtOffset(newOffset, r.newContent)
+	if e != nil {
+		newString = fmt.Sprintf("<error reading: %s>", e)
+	} else {
+		newString = EscapeString(string(tmp))
+	}
+	return fmt.Sprintf("%s -> %s", originalString, newString)
+}
+
+// A single replacement rule: strings matching the regular expression will be
+// replaced.
+type Rule struct {
+	// The regular expression to match against each string table entry.
+	Match *regexp.Regexp
+	// Matched strings will be replaced with this. This may refer to capture
+	// groups in Match using $<number>.
+	Replacement string
+	// If non-empty, the rule only applies to string tables in sections with
+	// these names, e.g. ".dynstr".
+	Sections []string
+	// The rule never applies to string tables in sections with these names.
+	ExcludeSections []string
+	// If non-empty, the rule only applies to files whose e_machine is one of
+	// these values. See ParseMachine.
+	Machines []uint16
+	// Set when the rule is disabled because the file being patched is for
+	// another machine.
+	otherMachine bool
+}
+
+// Returns true if the rule applies to strings in the section with the given
+// name, according to its Sections and ExcludeSections lists.
+func (r *Rule) appliesToSection(name string) bool {
+	if r.otherMachine {
+		return false
+	}
+	for _, excluded := range r.ExcludeSections {
+		if name == excluded {
+			return false
+		}
+	}
+	if len(r.Sections) == 0 {
+		return true
+	}
+	for _, included := range r.Sections {
+		if name == included {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if any of the rules applies to the string table in the
+// section with the given name.
+func anyRuleApplies(rules []Rule, name string) bool {
+	for i := range rules {
+		if rules[i].appliesToSection(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the section with the given name was explicitly requested,
+// by being named in a rule's Sections list or in TreatAsStringTables.
+func isRequestedSection(options *Options, name string) bool {
+	for _, s := range options.TreatAsStringTables {
+		if s == name {
+			return true
+		}
+	}
+	for i := range options.Rules {
+		for _, s := range options.Rules[i].Sections {
+			if s == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Fills in the replacements and newContent slices in the replacedStringTable
+// structure. Each rule is applied to the result of the previous one, so every
+// string is only replaced once, even when multiple rules match it. The
+// oldContent field must already be set before calling this. If no strings are
+// replaced, the replacements and newContent fields will be set to nil, but no
+// error will be returned. Otherwise, newContent will be set to a newly
+// allocated string table with the replaced values, and replacements will
+// contain the replaced string offsets. If options.SameSize is true, replaced
+// strings overwrite the originals in newContent (padded with null bytes)
+// rather than being appended, and an error is returned if any replacement is
+// longer than the original string, or would change another string sharing its
+// bytes. If options.InPlace is true, replacements that can overwrite the
+// originals do so in the same way, and only the rest are appended. Rules that
+// don't apply to the table's section (see Rule.Sections) are skipped, as are
+// strings matching options.NotMatching, not in t.allowedOffsets, or in
+// t.excludedOffsets. The options' CandidateHook and OnReplace callback, if
+// set, are consulted for each string the rules would change. Unless
+// options.AllowRawBytes is true, an error is returned if a replacement
+// introduces NULs, newlines, other control characters, or non-ASCII bytes
+// (which are allowed if options.Encoding isn't UTF-8). The rules are applied
+// to strings decoded from options.Encoding, and their results are encoded
+// again before being written.
+func (t *replacedStringTable) doReplacements(options *Options) error {
+	rules := options.Rules
+	replacements := make([]replacedString, 0, 4)
+	sectionStrings := options.cache.splitTable(t.oldFileOffset, t.oldContent)
+	var currentOldOffset uint32
+	var newString string
+	var replacementOffsets replacedString
+	newContent := make([]byte, len(t.oldContent))
+	copy(newContent, t.oldContent)
+	tableChanged := false
+	checkExpansions := make([]bool, len(rules))
+	active := make([]bool, len(rules))
+	for i := range rules {
+		checkExpansions[i] = usesCaptureGroups(&(rules[i]))
+		active[i] = t.ruleApplies(&(rules[i]))
+	}
+	t.ruleMatched = make([]bool, len(rules))
+	t.ruleExpanded = make([]bool, len(rules))
+	explain := t.report.explain
+	// The rules that changed the current string, if explaining.
+	var changedBy []bool
+	if explain {
+		t.ruleStats = make([]ruleStats, len(rules))
+		changedBy = make([]bool, len(rules))
+	}
+	for _, oldString := range sectionStrings {
+		// The rules see the decoded text, but the offsets, lengths, and hooks
+		// use the bytes in the table.
+		decoded := options.Encoding.decode(oldString)
+		newString = decoded
+		replacementOffsets.originalOffset = currentOldOffset
+		currentOldOffset += uint32(len(oldString)) + 1
+		if ((options.NotMatching != nil) &&
+			options.NotMatching.MatchString(decoded)) ||
+			((t.allowedOffsets != nil) &&
+				!t.allowedOffsets[replacementOffsets.originalOffset]) ||
+			t.excludedOffsets[replacementOffsets.originalOffset] {
+			if explain {
+				t.recordFilteredString(rules, active, decoded)
+			}
+			continue
+		}
+		for i := range rules {
+			if !active[i] {
+				continue
+			}
+			r := &(rules[i])
+			if checkExpansions[i] {
+				t.recordExpansions(i, r, newString)
+			}
+			if !explain {
+				newString = r.Match.ReplaceAllString(newString, r.Replacement)
+				continue
+			}
+			changedBy[i] = false
+			if !r.Match.MatchString(newString) {
+				continue
+			}
+			t.ruleStats[i].matched++
+			previous := newString
+			newString = r.Match.ReplaceAllString(newString, r.Replacement)
+			changedBy[i] = previous != newString
+		}
+		if decoded == newString {
+			continue
+		}
+		encoded, e := options.Encoding.encode(newString)
+		if e != nil {
+			return e
+		}
+		newString = applyReplacementHooks(options, t.report, t.sectionIndex,
+			t.sectionName, replacementOffsets.originalOffset, oldString,
+			encoded)
+		if oldString == newString {
+			continue
+		}
+		if !options.AllowRawBytes {
+			e = checkRawBytes(oldString, newString,
+				options.Encoding != UTF8Encoding)
+			if e != nil {
+				return e
+			}
+		}
+		if explain {
+			t.recordChangedString(changedBy,
+				replacementOffsets.originalOffset)
+		}
+		if options.SameSize && (len(newString) > len(oldString)) {
+			return fmt.Errorf("Replacement %q is longer than the original "+
+				"string %q", newString, oldString)
+		}
+		overwrite, e := t.canOverwrite(replacementOffsets.originalOffset,
+			oldString, newString, options)
+		if e != nil {
+			return e
+		}
+		if overwrite {
+			replacementOffsets.newOffset = replacementOffsets.originalOffset
+			tableChanged = true
+			replacements = append(replacements, replacementOffsets)
+			start := replacementOffsets.originalOffset
+			copy(newContent[start:], newString)
+			for j := len(newString); j < len(oldString); j++ {
+				newContent[int(start)+j] = 0
+			}
+			continue
+		}
+		// New strings will be appended to the end of the table.
+		replacementOffsets.newOffset = uint32(len(newContent))
+		tableChanged = true
+		replacements = append(replacements, replacementOffsets)
+		newContent = append(newContent, []byte(newString)...)
+		newContent = append(newContent, 0x00)
+	}
+	if !tableChanged {
+		return nil
+	}
+	t.newContent = newContent
+	t.replacements = replacements
+	t.replacementIndices = make(map[uint32]int, len(replacements))
+	for i, r := range replacements {
+		t.replacementIndices[r.originalOffset] = i
+	}
+	return nil
+}
+
+// Adds a warning to the report for each section named in a rule's Sections
+// list that isn't one of the given string tables, which is usually a typo.
+func warnMissingRuleSections(rules []Rule, tables []replacedStringTable,
+	report *Report) {
+	var found bool
+	for i := range rules {
+		for _, name := range rules[i].Sections {
+			found = false
+			for j := range tables {
+				if tables[j].hasSectionName(name) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				report.addWarning("Rule %d is limited to section %s, which "+
+					"isn't a string table in this file", i,
+					EscapeString(name))
+			}
+		}
+	}
+}
+
+// Returns a replacedStringTable for the string table in the given section,
+// with no replacements, recording its references in the given report.
+func newReplacedStringTable(f *elf_reader.ELF32File, sectionIndex uint16,
+	sectionName string, report *Report) (replacedStringTable, error) {
+	section := &(f.Sections[sectionIndex])
+	t := replacedStringTable{
+		sectionIndex:      sectionIndex,
+		sectionName:       sectionName,
+		oldFileOffset:     section.FileOffset,
+		oldVirtualAddress: section.VirtualAddress,
+		oldSegmentIndex: ContainingLoadSegment(f, section.FileOffset,
+			section.Size),
+		newSegmentIndex: -1,
+		report:          report,
+	}
+	var e error
+	t.oldContent, e = f.GetSectionContent(sectionIndex)
+	if e != nil {
+		return t, fmt.Errorf("Failed reading section %d: %s", sectionIndex,
+			e)
+	}
+	return t, nil
+}
+
+// Creates the list of string tables with replaced strings, and returns a slice
+// of them. May return a nil or 0-length slice if no strings were replaced.
+// Returns an error if one occurs. The replacements in each table are computed
+// using up to the given number of goroutines, according to the options.
+// Each table's references will be recorded in the given report.
+func processReplacements(f *elf_reader.ELF32File, options *Options,
+	parallelism int, report *Report) ([]replacedStringTable, error) {
+	candidates := make([]replacedStringTable, 0, 4)
+	var t replacedStringTable
+	var e error
+	var sectionName string
+	var neededStrings, filteredSymbolNames map[uint16]map[uint32]bool
+	if options.OnlyNeeded {
+		neededStrings, e = findNeededStrings(f)
+		if e != nil {
+			return nil, e
+		}
+	}
+	if options.SymbolFilter != nil {
+		filteredSymbolNames = findFilteredSymbolNames(f, options.SymbolFilter,
+			options.SameSize || options.InPlace)
+	}
+	referenced := referencedStringTables(f)
+	for i := range f.Sections {
+		if !f.IsStringTable(uint16(i)) {
+			continue
+		}
+		sectionName, _ = SectionName(f, uint16(i))
+		if options.OnlyNeeded && (neededStrings[uint16(i)] == nil) {
+			report.explainSkippedTable(options.Rules, uint16(i), sectionName,
+				RuleTableSkipped, "the table contains no dependency names, "+
+					"and only those are being replaced")
+			continue
+		}
+		if (options.ExcludeSections != nil) &&
+			options.ExcludeSections.MatchString(sectionName) {
+			report.logf("Skipping excluded section %s.\n",
+				EscapeString(sectionName))
+			report.explainSkippedTable(options.Rules, uint16(i), sectionName,
+				RuleSectionExcluded, "the section is excluded by "+
+					"-exclude_sections")
+			continue
+		}
+		if !options.AllStringTables && !referenced[uint16(i)] &&
+			!isRequestedSection(options, sectionName) {
+			report.logf("Skipping unreferenced string table %s.\n",
+				EscapeString(sectionName))
+			report.explainSkippedTable(options.Rules, uint16(i), sectionName,
+				RuleTableSkipped, "nothing this tool updates refers to the "+
+					"table; use -all_strtabs or name it in the rule's "+
+					"sections to modify it anyway")
+			continue
+		}
+		if !anyRuleApplies(options.Rules, sectionName) {
+			report.explainSkippedTable(options.Rules, uint16(i), sectionName,
+				RuleSectionExcluded, "")
+			continue
+		}
+		// A bad name simply won't match any rule's section list.
+		t, e = newReplacedStringTable(f, uint16(i), sectionName, report)
+		if e != nil {
+			return nil, e
+		}
+		if options.OnlyNeeded {
+			t.allowedOffsets = neededStrings[uint16(i)]
+		}
+		t.excludedOffsets = filteredSymbolNames[uint16(i)]
+		candidates = append(candidates, t)
+	}
+	candidates = mergeAliasedTables(candidates, report)
+	warnMissingRuleSections(options.Rules, candidates, report)
+	if options.SameSize || options.InPlace {
+		for i := range candidates {
+			e = candidates[i].findReferencedOffsets(f, options.SymbolFilter)
+			if e != nil {
+				return nil, e
+			}
+		}
+	}
+	// Each table is independent, so the replacements can be computed
+	// concurrently.
+	e = runParallel(len(candidates), parallelism, func(i int) error {
+		e := (&(candidates[i])).doReplacements(options)
+		if e != nil {
+			return fmt.Errorf("Failed replacing strings in sec. %d: %s",
+				candidates[i].sectionIndex, e)
+		}
+		return nil
+	})
+	if e != nil {
+		return nil, e
+	}
+	e = checkEmptyExpansions(options.Rules, candidates)
+	if e != nil {
+		return nil, e
+	}
+	e = collapseSingleStringTables(candidates, options)
+	if e != nil {
+		return nil, e
+	}
+	if options.RenameWarningSections {
+		candidates, e = renameWarningSections(f, candidates, options, report)
+		if e != nil {
+			return nil, fmt.Errorf("Failed renaming warning sections: %s", e)
+		}
+	}
+	toReturn := make([]replacedStringTable, 0, 1)
+	for i := range candidates {
+		t = candidates[i]
+		// Only keep track of sections where strings were actually replaced.
+		if len(t.replacements) == 0 {
+			report.explainTable(f, &t, options.Rules)
+			continue
+		}
+		sectionName, e = SectionName(f, t.sectionIndex)
+		if e != nil {
+			report.logf("Replaced strings in sec. %d (bad name: %s)\n",
+				t.sectionIndex, e)
+			sectionName = ""
+		} else {
+			sectionName = EscapeString(sectionName)
+			report.logf("Replaced strings in section %s\n", sectionName)
+		}
+		report.emitTable(&t, sectionName)
+		toReturn = append(toReturn, t)
+	}
+	return toReturn, nil
+}
+
+// Converts a given file offset to a virtual address, based on the base virtual
+// address from the given section index.
+func fileOffsetToVirtualAddress(f *elf_reader.ELF32File, sectionIndex uint16,
+	offset uint32) (uint32, error) {
+	if int(sectionIndex) > len(f.Sections) {
+		return 0, fmt.Errorf("Invalid section index: %d", sectionIndex)
+	}
+	section := &(f.Sections[sectionIndex])
+	return offset + (section.VirtualAddress - section.FileOffset), nil
+}
+
+// Returns the byte offset to the start of the section header in f.Raw.
+func getSectionHeaderOffset(f *elf_reader.ELF32File,
+	sectionIndex uint16) uint32 {
+	return f.Header.SectionHeaderOffset + uint32(sectionIndex)*
+		uint32(binary.Size(elf_reader.ELF32SectionHeader{}))
+}
+
+// Wraps elf_reader.WriteAtOffset for this particular ELF file. Remember that
+// reparseELF must still be called later on. The structure names what's
+// being written, for the *OutOfRangeError returned if any of it would lie
+// past the end of the file; the file is never grown, so data must be appended
+// to f.Raw before it's written. Integers and byte slices are written directly
+// into f.Raw, without the intermediate buffer WriteAtOffset requires, since
+// this is called for every updated reference.
+func writeAtELFOffset(f *elf_reader.ELF32File, offset uint32,
+	toWrite interface{}, structure string) error {
+	switch v := toWrite.(type) {
+	case uint32:
+		return writeELFUint32(f, offset, v, structure)
+	case uint16:
+		return writeELFUint16(f, offset, v, structure)
+	case []byte:
+		e := checkFileRange(f, offset, uint64(len(v)), structure, true)
+		if e != nil {
+			return e
+		}
+		copy(f.Raw[offset:], v)
+		return nil
+	}
+	size := binary.Size(toWrite)
+	if size < 0 {
+		return fmt.Errorf("Can't write the %s: unsupported type %T",
+			structure, toWrite)
+	}
+	e := checkFileRange(f, offset, uint64(size), structure, true)
+	if e != nil {
+		return e
+	}
+	f.Raw, e = elf_reader.WriteAtOffset(f.Raw, uint64(offset), f.Endianness,
+		toWrite)
+	return e
+}
+
+// Writes a 32-bit integer, part of the given structure, at the given offset
+// in f.Raw. Returns an *OutOfRangeError if the value doesn't fit in the file.
+func writeELFUint32(f *elf_reader.ELF32File, offset, value uint32,
+	structure string) error {
+	e := checkFileRange(f, offset, 4, structure, true)
+	if e != nil {
+		return e
+	}
+	f.Endianness.PutUint32(f.Raw[offset:], value)
+	return nil
+}
+
+// Writes a 16-bit integer, part of the given structure, at the given offset
+// in f.Raw. Returns an *OutOfRangeError if the value doesn't fit in the file.
+func writeELFUint16(f *elf_reader.ELF32File, offset uint32, value uint16,
+	structure string) error {
+	e := checkFileRange(f, offset, 2, structure, true)
+	if e != nil {
+		return e
+	}
+	f.Endianness.PutUint16(f.Raw[offset:], value)
+	return nil
+}
+
+// Returns true if none of the given tables' sections are loaded into memory
+// (i.e. none have the SHF_ALLOC flag).
+func allTablesUnloaded(f *elf_reader.ELF32File,
+	tables []replacedStringTable) bool {
+	for i := range tables {
+		if (uint32(f.Sections[tables[i].sectionIndex].Flags) & 2) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Appends new string tables to the end of the ELF file without loading them,
+// for use when none of the tables need to be in memory (e.g. .strtab or
+// .shstrtab in a static executable). Only the section headers are updated;
+// the program headers are left alone. Returns nil on success.
+func appendUnloadedTables(f *elf_reader.ELF32File,
+	newTables []replacedStringTable, report *Report) error {
+	var t *replacedStringTable
+	var section *elf_reader.ELF32SectionHeader
+	for i := range newTables {
+		t = &(newTables[i])
+		for (len(f.Raw) % 8) != 0 {
+			f.Raw = append(f.Raw, 0)
+		}
+		section = &(f.Sections[t.sectionIndex])
+		t.newFileOffset = uint32(len(f.Raw))
+		t.newVirtualAddress = section.VirtualAddress
+		t.newSegmentIndex = -1
+		f.Raw = append(f.Raw, t.newContent...)
+		section.FileOffset = t.newFileOffset
+		section.Size = uint32(len(t.newContent))
+		report.logf("String table in section %d moved to offset 0x%08x, "+
+			"without loading it.\n", t.sectionIndex, t.newFileOffset)
+	}
+	e := writeAtELFOffset(f, f.Header.SectionHeaderOffset, f.Sections,
+		"section headers")
+	if e != nil {
+		return fmt.Errorf("Error updating section headers: %s", e)
+	}
+	e = reparseELF(f)
+	if e != nil {
+		return fmt.Errorf("Error re-parsing ELF file after appending new "+
+			"string tables: %s", e)
+	}
+	return nil
+}
+
+// Writes each of the new string tables over the original table, for use in
+// same-size mode, where the tables are never larger than the originals.
+func writeTablesInPlace(f *elf_reader.ELF32File,
+	newTables []replacedStringTable, report *Report) error {
+	var t *replacedStringTable
+	var e error
+	for i := range newTables {
+		t = &(newTables[i])
+		if len(t.newContent) != len(t.oldContent) {
+			return fmt.Errorf("Table in section %d changed size from %d to "+
+				"%d bytes", t.sectionIndex, len(t.oldContent),
+				len(t.newContent))
+		}
+		t.newFileOffset = t.oldFileOffset
+		t.newVirtualAddress = t.oldVirtualAddress
+		t.newSegmentIndex = t.oldSegmentIndex
+		// The old content may refer to the same memory we're about to
+		// overwrite, but it's still needed to log the replacements.
+		t.oldContent = append([]byte(nil), t.oldContent...)
+		e = writeAtELFOffset(f, t.oldFileOffset, t.newContent,
+			"string table")
+		if e != nil {
+			return fmt.Errorf("Failed overwriting the string table in "+
+				"section %d: %s", t.sectionIndex, e)
+		}
+		report.logf("String table in section %d overwritten in place.\n",
+			t.sectionIndex)
+	}
+	e = reparseELF(f)
+	if e != nil {
+		return fmt.Errorf("Error re-parsing ELF file after overwriting "+
+			"string tables: %s", e)
+	}
+	return nil
+}
+
+// Appends new string tables (containing the replacements) to the end of the
+// ELF file, relocating the original string table sections to point to the new
+// tables. If none of the tables need to be loaded into memory, this is done by
+// appendUnloadedTables, without modifying the program headers. In same-size
+// mode, the tables are written over the originals instead, as are any tables
+// whose replacements fit in the original table (see rewriteTablesInPlace, or
+// relocateGrownTables if options.InPlace is set). Sets the newFileOffset and
+// newVirtualAddress fields in each of the replacedStringTable entries. The
+// tables are loaded by a new segment, at a virtual address chosen according to
+// the options' AddressStrategy, unless options.ExtendLastLoad is set and the
+// last loadable segment can be grown to cover them instead. If
+// options.ReusePadding is set, the tables are first placed in unused padding
+// within existing segments, if they all fit. If options.StripNotes removed any
+// note segments, the space they used is tried next, and a freed program header
+// slot is used for the new segment. Any new or extended segments and warnings
+// are added to the report. Returns nil on success.
+func relocateStringTables(f *elf_reader.ELF32File,
+	newTables []replacedStringTable, options *Options, report *Report) error {
+	if len(newTables) == 0 {
+		return nil
+	}
+	if options.SameSize {
+		return writeTablesInPlace(f, newTables, report)
+	}
+	if options.InPlace {
+		return relocateGrownTables(f, newTables, options, report)
+	}
+	remaining, positions, e := rewriteTablesInPlace(f, newTables, options,
+		report)
+	if e != nil {
+		return e
+	}
+	if len(remaining) == 0 {
+		return nil
+	}
+	if options.Hybrid {
+		e = layoutHybridTables(f, remaining, options, report)
+		if e != nil {
+			return e
+		}
+	}
+	e = relocateRemainingTables(f, remaining, options, report)
+	// Copy the new locations back, even on failure, so the caller's tables
+	// stay consistent with the file.
+	for i := range remaining {
+		newTables[positions[i]] = remaining[i]
+	}
+	return e
+}
+
+// Carries out relocateStringTables for the tables which couldn't be rewritten
+// in their original locations.
+func relocateRemainingTables(f *elf_reader.ELF32File,
+	newTables []replacedStringTable, options *Options, report *Report) error {
+	if allTablesUnloaded(f, newTables) {
+		return appendUnloadedTables(f, newTables, report)
+	}
+	if options.ReusePadding {
+		placed, e := placeTablesInPadding(f, newTables, report)
+		if e != nil {
+			return fmt.Errorf("Failed placing tables in padding: %s", e)
+		}
+		if placed {
+			checkRELROCoverage(f, report)
+			return nil
+		}
+	}
+	// Space freed by stripped note segments is used before growing the file.
+	placed, e := placeTablesInFreedRegions(f, newTables, report)
+	if e != nil {
+		return fmt.Errorf("Failed placing tables in freed space: %s", e)
+	}
+	if placed {
+		checkRELROCoverage(f, report)
+		return nil
+	}
+	if (report.freed.slots > 0) && !options.ExtendLastLoad {
+		return appendTablesInFreeSlot(f, newTables, options, report)
+	}
+	// Files patched repeatedly would otherwise gain a segment every time.
+	discardAppendedSegment(f, newTables, report)
+	programHeaderAlign := options.ProgramHeaderAlign
+	if programHeaderAlign == 0 {
+		programHeaderAlign = 8
+	}
+	// Align the end of the file to 8 bytes, or to the program header table's
+	// alignment if the table will be at the start of the new data.
+	startAlign := uint32(8)
+	if options.ProgramHeadersFirst && (programHeaderAlign > startAlign) {
+		startAlign = programHeaderAlign
+	}
+	for (uint32(len(f.Raw)) % startAlign) != 0 {
+		f.Raw = append(f.Raw, 0)
+	}
+	originalEndOffset := uint32(len(f.Raw))
+	originalEndVA, e := fileOffsetToVirtualAddress(f,
+		newTables[0].sectionIndex, originalEndOffset)
+	if e != nil {
+		return fmt.Errorf("Couldn't calculate ELF file end VA: %s", e)
+	}
+	extendIndex := -1
+	if options.ExtendLastLoad {
+		var reason string
+		extendIndex, reason = extendableLoadSegment(f, originalEndOffset)
+		if extendIndex < 0 {
+			report.logf("Adding a new segment rather than extending the last "+
+				"one: %s.\n", reason)
+		}
+	}
+	// The new segment will hold the tables, padded to the program header
+	// table's alignment, followed by the program header table with one
+	// additional entry, or the program header table followed by the tables if
+	// options.ProgramHeadersFirst is set. Its size must be known up front in
+	// order to choose where to map it.
+	newSegmentCount := 1
+	if extendIndex >= 0 {
+		newSegmentCount = 0
+	}
+	var tablesSize uint32
+	for i := range newTables {
+		tablesSize += uint32(len(newTables[i].newContent))
+	}
+	programHeadersSize := uint32(binary.Size(elf_reader.ELF32ProgramHeader{})) *
+		uint32(len(f.Segments)+newSegmentCount)
+	// The offsets of the tables and program header table relative to the
+	// start of the new data.
+	var tablesOffset, programHeadersOffset, newSegmentSize uint32
+	if options.ProgramHeadersFirst {
+		tablesOffset = programHeadersSize
+		newSegmentSize = programHeadersSize + tablesSize
+	} else {
+		programHeadersOffset = tablesSize
+		for ((originalEndOffset + programHeadersOffset) %
+			programHeaderAlign) != 0 {
+			programHeadersOffset++
+		}
+		newSegmentSize = programHeadersOffset + programHeadersSize
+	}
+	if extendIndex >= 0 {
+		// The extended segment's mapping determines the address.
+		load := &(f.Segments[extendIndex])
+		originalEndVA = load.VirtualAddress +
+			(originalEndOffset - load.FileOffset)
+		if (uint64(originalEndVA) + uint64(newSegmentSize)) > 0xffffffff {
+			return fmt.Errorf("No room to extend the last loadable segment")
+		}
+	} else {
+		originalEndVA, e = chooseSegmentAddress(f, originalEndOffset,
+			newSegmentSize, originalEndVA, options, report)
+		if e != nil {
+			return fmt.Errorf("Couldn't choose a VA for the new segment: %s",
+				e)
+		}
+	}
+	// Reserve space for the program header table if it comes first. It's
+	// written once the new segment's entry is complete.
+	f.Raw = append(f.Raw, make([]byte, tablesOffset)...)
+	// Start by appending all of the tables to the end of the file
+	currentFileOffset := originalEndOffset + tablesOffset
+	currentVirtualAddress := originalEndVA + tablesOffset
+	var newContentLength uint32
+	var t *replacedStringTable
+	var section *elf_reader.ELF32SectionHeader
+	for i := range newTables {
+		t = &(newTables[i])
+		t.newFileOffset = currentFileOffset
+		t.newVirtualAddress = currentVirtualAddress
+		f.Raw = append(f.Raw, t.newContent...)
+		newContentLength = uint32(len(t.newContent))
+		currentFileOffset += newContentLength
+		currentVirtualAddress += newContentLength
+		// Update the size, virtual address, and file offset in the section
+		// header for the original string table.
+		section = &(f.Sections[t.sectionIndex])
+		section.VirtualAddress = t.newVirtualAddress
+		section.FileOffset = t.newFileOffset
+		section.Size = newContentLength
+	}
+	// Write the (potentially) modified section headers back into the ELF file
+	// content.
+	e = writeAtELFOffset(f, f.Header.SectionHeaderOffset, f.Sections,
+		"section headers")
+	if e != nil {
+		return fmt.Errorf("Error updating section headers: %s", e)
+	}
+	// Pad to the program header table's alignment, and make room for it,
+	// since writing it won't grow the file. (The program header segment will
+	// overlap with the new loadable string table segment, so that it
+	// actually gets loaded.)
+	programHeadersFileOffset := originalEndOffset + programHeadersOffset
+	programHeadersVA := originalEndVA + programHeadersOffset
+	for uint32(len(f.Raw)) < (programHeadersFileOffset + programHeadersSize) {
+		f.Raw = append(f.Raw, 0)
+	}
+	loadIndex := extendIndex
+	if loadIndex < 0 {
+		// Create a new segment which will hold the updated string tables.
+		newSegment := elf_reader.ELF32ProgramHeader{
+			Type:            elf_reader.LoadableSegment,
+			FileOffset:      originalEndOffset,
+			VirtualAddress:  originalEndVA,
+			PhysicalAddress: 0,
+			FileSize:        newSegmentSize,
+			MemorySize:      newSegmentSize,
+			Flags:           4, // PF_R
+			Align:           loadPageSize(f, report.pageSize),
+		}
+		f.Segments = append(f.Segments, newSegment)
+		loadIndex = len(f.Segments) - 1
+	} else {
+		// Grow the existing segment to cover everything up to the end of the
+		// new data, including any data that was already between them.
+		load := &(f.Segments[loadIndex])
+		load.FileSize = originalEndOffset + newSegmentSize - load.FileOffset
+		load.MemorySize = load.FileSize
+	}
+	for i := range newTables {
+		t = &(newTables[i])
+		t.newSegmentIndex = loadIndex
+		report.logf("String table in section %d moved from %s to %s\n",
+			t.sectionIndex, describeSegment(f, t.oldSegmentIndex),
+			describeSegment(f, t.newSegmentIndex))
+	}
+	// Find the self-referential program header table segment, then update its
+	// VA, offset, and size, too.
+	foundPHDR := false
+	for i := range f.Segments {
+		if f.Segments[i].Type != elf_reader.ProgramHeaderSegment {
+			continue
+		}
+		f.Segments[i].FileOffset = programHeadersFileOffset
+		f.Segments[i].VirtualAddress = programHeadersVA
+		f.Segments[i].PhysicalAddress = 0
+		f.Segments[i].FileSize = programHeadersSize
+		f.Segments[i].MemorySize = programHeadersSize
+		f.Segments[i].Align = programHeaderAlign
+		foundPHDR = true
+		break
+	}
+	if !foundPHDR {
+		report.logf("No PHDR segment; the moved program header table will " +
+			"only be referenced by the ELF header.\n")
+	}
+	// Write the updated program header table into the new data.
+	if uint32(binary.Size(f.Segments)) != programHeadersSize {
+		return fmt.Errorf("The program header table's size changed from %d "+
+			"to %d bytes", programHeadersSize, binary.Size(f.Segments))
+	}
+	e = writeAtELFOffset(f, programHeadersFileOffset, f.Segments,
+		"program headers")
+	if e != nil {
+		return fmt.Errorf("Error writing updated program headers: %s", e)
+	}
+	// Update the ELF header to point to the new program header table. The
+	// offset to the start of the table is at 28 bytes into the ELF header.
+	e = writeAtELFOffset(f, 28, programHeadersFileOffset, "ELF header")
+	if e != nil {
+		return fmt.Errorf("Failed writing the program header table offset: %s",
+			e)
+	}
+	e = writeProgramHeaderCount(f)
+	if e != nil {
+		return fmt.Errorf("Failed writing the number of program header "+
+			"entries: %s", e)
+	}
+	e = reparseELF(f)
+	if e != nil {
+		return fmt.Errorf("Error re-parsing ELF file after appending new "+
+			"string tables: %s", e)
+	}
+	checkRELROCoverage(f, report)
+	repaired, e := validateProgramHeaderSegment(f, report)
+	if e != nil {
+		return fmt.Errorf("Invalid program header layout: %s", e)
+	}
+	if repaired {
+		e = reparseELF(f)
+		if e != nil {
+			return fmt.Errorf("Error re-parsing ELF file after repairing "+
+				"the PHDR segment: %s", e)
+		}
+	}
+	report.addSegment(f, loadIndex, extendIndex >= 0)
+	return nil
+}
+
+// Reads a 32-bit integer, part of the given structure, at the given offset
+// in the ELF file. Returns an *OutOfRangeError if it doesn't fit in the file.
+func readELFUint32(f *elf_reader.ELF32File, offset uint32,
+	structure string) (uint32, error) {
+	e := checkFileRange(f, offset, 4, structure, false)
+	if e != nil {
+		return 0, e
+	}
+	return f.Endianness.Uint32(f.Raw[offset:]), nil
+}
+
+// Reads a 32-bit value the given offset in f.Raw, then uses this value as an
+// offset into the replaced string table. Returns the index of the matching
+// entry in replacedTable.replacements, or -1 if the string wasn't replaced.
+// This doesn't modify f, so it's safe to call concurrently.
+func findOffsetReplacement(f *elf_reader.ELF32File, offset uint32,
+	replacedTable *replacedStringTable) (int, error) {
+	value, e := readELFUint32(f, offset, "string table offset")
+	if e != nil {
+		return -1, e
+	}
+	return replacedTable.findReplacement(uint64(value))
+}
+
+// Returns the index in t.replacements of the replacement for the string at
+// the given offset in the original table, or -1 if the string wasn't
+// replaced. The offset is the value of a field referring to the string, which
+// may be 32 or 64 bits wide. Safe to call concurrently.
+func (t *replacedStringTable) findReplacement(value uint64) (int, error) {
+	if value > uint64(len(t.oldContent)) {
+		return -1, fmt.Errorf("String offset %d is invalid for table %d",
+			value, t.sectionIndex)
+	}
+	// Check this condition so we can at least know if the ELF file is doing
+	// any funny business (replacing strings of this sort is ambiguous in the
+	// current framework, so it won't occur).
+	offset := uint32(value)
+	if (offset != 0) && (t.oldContent[offset-1] != 0) {
+		s, e := elf_reader.ReadStringAtOffset(offset, t.oldContent)
+		if e != nil {
+			s = []byte(fmt.Sprintf("<error reading string: %s>", e))
+		}
+		t.report.addWarning("String at offset %d in section %d (%s) "+
+			"doesn't start immediately after the previous string", offset,
+			t.sectionIndex, EscapeString(string(s)))
+	}
+	index, ok := t.replacementIndices[offset]
+	if !ok {
+		return -1, nil
+	}
+	return index, nil
+}
+
+// Writes the new offset of the string at the given index in
+// replacedTable.replacements to the given offset in f.Raw, and records the
+// updated reference in the table's report. The location describes the field
+// containing the reference, e.g. "section 3 sh_name".
+func writeOffsetReplacement(f *elf_reader.ELF32File, offset uint32,
+	replacedTable *replacedStringTable, index int, location string) error {
+	r := &(replacedTable.replacements[index])
+	e := writeAtELFOffset(f, offset, r.newOffset, location)
+	if e != nil {
+		return fmt.Errorf("Failed writing new string table offset: %s", e)
+	}
+	replacedTable.report.addReference(ReferenceUpdate{
+		FileOffset:    offset,
+		SectionIndex:  replacedTable.sectionIndex,
+		OriginalValue: r.originalOffset,
+		NewValue:      r.newOffset,
+		Location:      location,
+	})
+	replacedTable.report.logf("Replaced string reference at offset "+
+		"0x%08x: %s\n", offset, replacedTable.showReplacement(index))
+	return nil
+}
+
+// Reads a 32-bit value the given offset in f.Raw, then uses this value as an
+// offset into the replaced string table. If the string has been replaced, the
+// 32-bit value in f.Raw will be replaced with a value pointing to the new
+// string. The location is recorded in the report, as in
+// writeOffsetReplacement.
+func replaceSingleOffset(f *elf_reader.ELF32File, offset uint32,
+	replacedTable *replacedStringTable, location string) error {
+	index, e := findOffsetReplacement(f, offset, replacedTable)
+	if e != nil {
+		return e
+	}
+	if index < 0 {
+		return nil
+	}
+	return writeOffsetReplacement(f, offset, replacedTable, index, location)
+}
+
+// Returns a reference to the correct replacements table for the given section
+// index, or nil if no replacements were made in the section.
+func getReplacementTable(replacements []replacedStringTable,
+	sectionIndex uint16) *replacedStringTable {
+	var toReturn *replacedStringTable
+	for i := range replacements {
+		if replacements[i].sectionIndex != sectionIndex {
+			continue
+		}
+		toReturn = &(replacements[i])
+		break
+	}
+	return toReturn
+}
+
+// Replaces any section names that may have been changed
+func replaceSectionNames(f *elf_reader.ELF32File,
+	replacements []replacedStringTable) error {
+	namesIndex, ok := SectionNamesTable(f)
+	if !ok {
+		// The file has no section names table (e_shstrndx is SHN_UNDEF).
+		return nil
+	}
+	table := getReplacementTable(replacements, namesIndex)
+	if table == nil {
+		// No strings were replaced in the section names table.
+		return nil
+	}
+	var baseOffset uint32
+	var e error
+	for i := range f.Sections {
+		baseOffset = getSectionHeaderOffset(f, uint16(i))
+		if e != nil {
+			return fmt.Errorf("Failed finding section %d header: %s", i, e)
+		}
+		e = replaceSingleOffset(f, baseOffset, table,
+			fmt.Sprintf("section %d sh_name", i))
+		if e != nil {
+			return fmt.Errorf("Failed replacing section %d name: %s", i, e)
+		}
+	}
+	return nil
+}
+
+// Records a string reference that must be updated, found while scanning a
+// table concurrently.
+type pendingOffsetUpdate struct {
+	fileOffset       uint32
+	replacementIndex int
+	// The index of the entry containing the reference, e.g. the symbol.
+	entryIndex uint32
+}
+
+// Checks all symbol tables in the ELF file, and replaces the name field of
+// each symbol as necessary. Large symbol tables are scanned using up to the
+// given number of goroutines, but all writes happen afterwards, in order.
+// Symbols rejected by the filter, if it isn't nil, keep their original names.
+func replaceSymbolNames(f *elf_reader.ELF32File,
+	replacements []replacedStringTable, parallelism int,
+	filter *SymbolFilter) error {
+	var e error
+	var section *elf_reader.ELF32SectionHeader
+	var table *replacedStringTable
+	var symbolCount, chunkSize uint32
+	var updates [][]pendingOffsetUpdate
+	symbolSize := uint32(binary.Size(&elf_reader.ELF32Symbol{}))
+	// Loop through all symbol table sections
+	for i := range f.Sections {
+		if !f.IsSymbolTable(uint16(i)) {
+			continue
+		}
+		section = &(f.Sections[i])
+		table = getReplacementTable(replacements, uint16(section.LinkedIndex))
+		if table == nil {
+			continue
+		}
+		// Split the symbols into one contiguous chunk per goroutine.
+		symbolCount = section.Size / symbolSize
+		chunkSize = (symbolCount / uint32(parallelism)) + 1
+		updates = make([][]pendingOffsetUpdate, parallelism)
+		e = runParallel(parallelism, parallelism, func(chunk int) error {
+			start := uint32(chunk) * chunkSize
+			end := start + chunkSize
+			if end > symbolCount {
+				end = symbolCount
+			}
+			var offset uint32
+			for j := start; j < end; j++ {
+				// The name is the first field in the symbol structure.
+				offset = section.FileOffset + j*symbolSize
+				if !filter.acceptsSymbolAt(f, offset) {
+					continue
+				}
+				index, e := findOffsetReplacement(f, offset, table)
+				if e != nil {
+					return fmt.Errorf("Failed replacing symbol name: %s", e)
+				}
+				if index < 0 {
+					continue
+				}
+				updates[chunk] = append(updates[chunk], pendingOffsetUpdate{
+					fileOffset:       offset,
+					replacementIndex: index,
+					entryIndex:       j,
+				})
+			}
+			return nil
+		})
+		if e != nil {
+			return e
+		}
+		for _, chunkUpdates := range updates {
+			for _, u := range chunkUpdates {
+				e = writeOffsetReplacement(f, u.fileOffset, table,
+					u.replacementIndex, fmt.Sprintf("section %d symbol %d "+
+						"st_name", i, u.entryIndex))
+				if e != nil {
+					return fmt.Errorf("Failed replacing symbol name: %s", e)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Replaces names in the elf32_Verdaux structures, which are in turn referred
+// to by elf32_Verdef structures. These are generally only used by shared
+// library files to define symbol names.
+func replaceVersionDefinitionStrings(f *elf_reader.ELF32File,
+	replacements []replacedStringTable) error {
+	for i := range f.Sections {
+		if uint32(f.Sections[i].Type) != VersionDefinitionSection {
+			continue
+		}
+		e := replaceDefinitionSectionStrings(f, uint16(i), replacements)
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// Replaces the names in a single version definition section. The first name
+// of each definition is the version's own (or the file's soname, for the
+// base definition), whose hash is stored in vd_hash, so the hash is updated
+// along with it: the loader compares it with the vna_hash of each file
+// requiring the version.
+func replaceDefinitionSectionStrings(f *elf_reader.ELF32File,
+	sectionIndex uint16, replacements []replacedStringTable) error {
+	section := &(f.Sections[sectionIndex])
+	table := getReplacementTable(replacements, uint16(section.LinkedIndex))
+	// Do nothing if no strings were replaced in the section's string table
+	if table == nil {
+		return nil
+	}
+	defOffset := section.FileOffset
+	// sh_info holds the number of Elf32_Verdef entries.
+	for i := uint32(0); i < section.Info; i++ {
+		// vd_cnt, vd_hash, vd_aux, and vd_next follow the 2-byte vd_version,
+		// vd_flags, and vd_ndx fields.
+		count, e := readSectionUint16(f, section, defOffset+6)
+		var hash, auxDelta, next uint32
+		if e == nil {
+			hash, e = readSectionUint32(f, section, defOffset+8)
+		}
+		if e == nil {
+			auxDelta, e = readSectionUint32(f, section, defOffset+12)
+		}
+		if e == nil {
+			next, e = readSectionUint32(f, section, defOffset+16)
+		}
+		if e != nil {
+			return fmt.Errorf("Bad verdef %d: %s", i, e)
+		}
+		auxOffset := defOffset + auxDelta
+		for j := uint16(0); j < count; j++ {
+			// vda_name is the first field, followed by vda_next.
+			index, e := findOffsetReplacement(f, auxOffset, table)
+			if e != nil {
+				return fmt.Errorf("Bad verdef %d aux %d: %s", i, j, e)
+			}
+			if index >= 0 {
+				e = writeOffsetReplacement(f, auxOffset, table, index,
+					fmt.Sprintf("verdef %d aux %d vda_name", i, j))
+				if e != nil {
+					return fmt.Errorf("Failed replacing version definition "+
+						"name: %s", e)
+				}
+			}
+			if (index >= 0) && (j == 0) {
+				e = updateDefinitionHash(f, defOffset+8, hash, table, index,
+					fmt.Sprintf("verdef %d vd_hash", i))
+				if e != nil {
+					return e
+				}
+			}
+			auxNext, e := readSectionUint32(f, section, auxOffset+4)
+			if e != nil {
+				return fmt.Errorf("Bad verdef %d aux %d: %s", i, j, e)
+			}
+			auxOffset += auxNext
+		}
+		if next == 0 {
+			break
+		}
+		defOffset += next
+	}
+	return nil
+}
+
+// Sets the vd_hash field at the given offset, whose current value is given,
+// to the hash of the replacement string with the given index in the table,
+// recording the change in the report.
+func updateDefinitionHash(f *elf_reader.ELF32File, offset, original uint32,
+	table *replacedStringTable, index int, location string) error {
+	name, e := elf_reader.ReadStringAtOffset(
+		table.replacements[index].newOffset, table.newContent)
+	if e != nil {
+		return fmt.Errorf("Failed reading new version name: %s", e)
+	}
+	hash := sysvHash(name)
+	if hash == original {
+		return nil
+	}
+	e = writeELFUint32(f, offset, hash, "version definition hash")
+	if e != nil {
+		return fmt.Errorf("Failed updating %s: %s", location, e)
+	}
+	table.report.addReference(ReferenceUpdate{
+		FileOffset:    offset,
+		SectionIndex:  table.sectionIndex,
+		OriginalValue: original,
+		NewValue:      hash,
+		Location:      location,
+	})
+	table.report.logf("Updated %s at offset 0x%08x: 0x%x -> 0x%x\n",
+		location, offset, original, hash)
+	return nil
+}
+
+// Replaces file and requirement names in the elf32_verneed and elf32_vernaux
+// structures, from the .gnu.version_r sections. Each section's names are
+// looked up in the string table it's linked to, which repairStringTableLinks
+// has already checked against the names' hashes.
+func replaceVersionRequirementStrings(f *elf_reader.ELF32File,
+	replacements []replacedStringTable) error {
+	for i := range f.Sections {
+		if !f.IsVersionRequirementSection(uint16(i)) {
+			continue
+		}
+		e := replaceRequirementSectionStrings(f, uint16(i), replacements)
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// Replaces the names in a single version requirement section.
+func replaceRequirementSectionStrings(f *elf_reader.ELF32File,
+	sectionIndex uint16, replacements []replacedStringTable) error {
+	section := &(f.Sections[sectionIndex])
+	table := getReplacementTable(replacements, uint16(section.LinkedIndex))
+	// Do nothing if no strings were replaced in the section's string table
+	if table == nil {
+		return nil
+	}
+	need, aux, e := f.ParseVersionRequirementSection(sectionIndex)
+	if e != nil {
+		return fmt.Errorf("Failed parsing version requirement section: %s", e)
+	}
+	currentNeedOffset := section.FileOffset
+	var currentAuxOffset uint32
+	// Loop through all elf32_verneed and associated elf32_vernaux structures
+	// See the elf_reader package and
+	// http://docs.oracle.com/cd/E19683-01/816-1386/chapter6-61174/index.html
+	for i, n := range need {
+		// The file name follows 2 2-byte fields in the structure
+		e = replaceSingleOffset(f, currentNeedOffset+4, table,
+			fmt.Sprintf("verneed %d vn_file", i))
+		if e != nil {
+			return fmt.Errorf("Failed replacing requirement file name: %s", e)
+		}
+		currentAuxOffset = currentNeedOffset + n.AuxOffset
+		for j, x := range aux[i] {
+			// The requirement name follows 1 4-byte and 2 2-byte fields
+			e = replaceSingleOffset(f, currentAuxOffset+8, table,
+				fmt.Sprintf("verneed %d aux %d vna_name", i, j))
+			if e != nil {
+				return fmt.Errorf("Failed replacing requirement name: %s", e)
+			}
+			currentAuxOffset += x.Next
+		}
+		currentNeedOffset += n.Next
+	}
+	return nil
+}
+
+// The names of the dynamic table tags whose values are string offsets.
+var dynamicStringTagNames = map[elf_reader.ELF32DynamicTag]string{
+	1:  "DT_NEEDED",
+	14: "DT_SONAME",
+	15: "DT_RPATH",
+	29: "DT_RUNPATH",
+}
+
+// Replaces strings and the string table address in the dynamic linking table.
+// Assumes that the file will only contain one dynamic linking table.
+func replaceDynamicTableStrings(f *elf_reader.ELF32File,
+	replacements []replacedStringTable) error {
+	var sectionIndex uint16
+	var section *elf_reader.ELF32SectionHeader
+	for i := range f.Sections {
+		if !f.IsDynamicSection(uint16(i)) {
+			continue
+		}
+		sectionIndex = uint16(i)
+		section = &(f.Sections[i])
+		break
+	}
+	// Do nothing if the ELF didn't have a dynamic linking table.
+	if section == nil {
+		return nil
+	}
+	table := getReplacementTable(replacements, uint16(section.LinkedIndex))
+	// Do nothing if no strings were replaced for this section.
+	if table == nil {
+		return nil
+	}
+	entries, e := f.GetDynamicTable(sectionIndex)
+	if e != nil {
+		return fmt.Errorf("Failed parsing dynamic table: %s", e)
+	}
+	currentOffset := section.FileOffset
+	entrySize := uint32(binary.Size(&elf_reader.ELF32DynamicEntry{}))
+	for i, entry := range entries {
+		// Tags 1, 14, 15, and 29 have strings as values, as do the tags in
+		// unsupportedDynamicStringTags. Tags 5 and 10 contain the string
+		// table's address and size. The value field is 4 bytes from the start
+		// of the table entry.
+		switch entry.Tag {
+		case 1, 14, 15, 29:
+			e = replaceSingleOffset(f, currentOffset+4, table,
+				fmt.Sprintf("dynamic entry %d %s", i,
+					dynamicStringTagNames[entry.Tag]))
+			if e != nil {
+				return fmt.Errorf("Failed replacing dynamic table string: %s",
+					e)
+			}
+		case 5, 10:
+			e = updateStringTableEntry(f, table, currentOffset+4, i, entry)
+			if e != nil {
+				return fmt.Errorf("Failed updating dynamic entry %d: %s", i,
+					e)
+			}
+		default:
+		}
+		currentOffset += entrySize
+	}
+	return nil
+}
+
+// Updates all known string table references in the ELF file to point to new
+// string locations, if the referenced string was replaced. If this function
+// returns an error, the ELF32File structure may be inconsistent, so an error
+// should be treated as fatal to the entire procedure. Symbols rejected by the
+// filter, if it isn't nil, aren't updated.
+func updateStringReferences(f *elf_reader.ELF32File,
+	replacements []replacedStringTable, parallelism int,
+	filter *SymbolFilter, report *Report) error {
+	report.logf("Replacing section names.\n")
+	start := report.startPhase("section names")
+	e := replaceSectionNames(f, replacements)
+	if e != nil {
+		return fmt.Errorf("Failed replacing section names: %s", e)
+	}
+	report.addTiming("section names", start)
+	report.logf("Replacing symbol names.\n")
+	start = report.startPhase("symbol names")
+	e = replaceSymbolNames(f, replacements, parallelism, filter)
+	if e != nil {
+		return fmt.Errorf("Failed replacing symbol names: %s", e)
+	}
+	report.addTiming("symbol names", start)
+	report.logf("Replacing version definitions.\n")
+	start = report.startPhase("version definitions")
+	e = replaceVersionDefinitionStrings(f, replacements)
+	if e != nil {
+		return fmt.Errorf("Failed replacing version definition strings: %s", e)
+	}
+	report.addTiming("version definitions", start)
+	report.logf("Replacing version requirements.\n")
+	start = report.startPhase("version requirements")
+	e = replaceVersionRequirementStrings(f, replacements)
+	if e != nil {
+		return fmt.Errorf("Failed replacing version req. strings: %s", e)
+	}
+	report.addTiming("version requirements", start)
+	report.logf("Replacing dynamic table strings.\n")
+	start = report.startPhase("dynamic table")
+	e = replaceDynamicTableStrings(f, replacements)
+	if e != nil {
+		return fmt.Errorf("Failed replacing dynamic table strings: %s", e)
+	}
+	report.addTiming("dynamic table", start)
+	report.logf("Replacing relocation addends.\n")
+	start = report.startPhase("relocations")
+	e = replaceRelocationStrings(f, replacements, report)
+	if e != nil {
+		return fmt.Errorf("Failed replacing relocation addends: %s", e)
+	}
+	report.addTiming("relocations", start)
+	report.logf("Replacing interpreter path.\n")
+	e = replaceInterpreterPath(f, replacements, report)
+	if e != nil {
+		return fmt.Errorf("Failed replacing interpreter path: %s", e)
+	}
+	report.logf("Sanity-checking result.\n")
+	start = report.startPhase("reparse")
+	e = reparseELF(f)
+	if e != nil {
+		return fmt.Errorf("Failed re-parsing ELF post-string-replacement: %s",
+			e)
+	}
+	report.addTiming("reparse", start)
+	return nil
+}
+
+// Returns an error if f's type (e_type) isn't one that can be patched:
+// relocatable objects, executables, and shared objects. In particular, core
+// dumps describe a process' memory rather than a program to load, so
+// relocating their string tables would only produce garbage.
+func checkFileType(f *elf_reader.ELF32File) error {
+	fileType := uint32(f.Header.Type)
+	switch fileType {
+	case 1, 2, 3:
+		return nil
+	case 0:
+		return fmt.Errorf("The file has no ELF type (ET_NONE), so it can't " +
+			"be patched")
+	case 4:
+		return fmt.Errorf("The file is a core dump (ET_CORE), which can't " +
+			"be patched")
+	}
+	return fmt.Errorf("The file has an unsupported ELF type (0x%04x), so it "+
+		"can't be patched", fileType)
+}
+
+// Holds the state set up by prepareReplacement.
+type replacementSetup struct {
+	// The options to use, which differ from those passed to
+	// prepareReplacement when using versioned renames.
+	options *Options
+	report  *Report
+	// The original types of the string tables given the SHT_STRTAB type.
+	mistyped map[uint16]uint32
+	// Set when using versioned renames.
+	versioned *versionedRenamePlan
+	// The entries to add to the dynamic table, if any.
+	dynamicAdditions []dynamicAddition
+}
+
+// Checks that the file and options can be used, and prepares f for computing
+// the replacements: mistyped string tables are given the SHT_STRTAB type, and
+// incorrect links to string tables are fixed. Returns an error if the file or
+// options are invalid.
+func prepareReplacement(f *elf_reader.ELF32File,
+	options *Options) (*replacementSetup, error) {
+	e := checkFileType(f)
+	if e != nil {
+		return nil, e
+	}
+	e = checkProgramHeaderCount(f)
+	if e != nil {
+		return nil, e
+	}
+	e = checkPrelink(f, options)
+	if e != nil {
+		return nil, e
+	}
+	e = ValidatePageSize(options.PageSize)
+	if e != nil {
+		return nil, e
+	}
+	e = ValidateProgramHeaderAlign(options.ProgramHeaderAlign)
+	if e != nil {
+		return nil, e
+	}
+	// Mistyped string tables are given the SHT_STRTAB type until patching is
+	// done, so that the links to them are recognized.
+	mistyped, e := findMistypedStringTables(f, options)
+	if e != nil {
+		return nil, e
+	}
+	retyped, e := retypeStringTables(f, mistyped)
+	if e != nil {
+		return nil, e
+	}
+	report := newReport(options)
+	setup := &replacementSetup{
+		options:  options,
+		report:   report,
+		mistyped: mistyped,
+	}
+	for _, message := range retyped {
+		report.logf("%s.\n", message)
+	}
+	// Post-processed and packed files sometimes contain incorrect sh_link
+	// fields, which must be fixed before looking up any string tables.
+	linkProblems, e := repairStringTableLinks(f)
+	if e != nil {
+		return nil, e
+	}
+	for _, problem := range linkProblems {
+		report.addWarning("%s", problem)
+	}
+	if len(options.VersionedRenames) != 0 {
+		if len(options.Rules) != 0 {
+			return nil, fmt.Errorf("Versioned renames can't be combined " +
+				"with other replacement rules")
+		}
+		versioned, e := planVersionedRenames(f, options.VersionedRenames,
+			report)
+		if e != nil {
+			return nil, fmt.Errorf("Invalid versioned rename: %s", e)
+		}
+		options = versioned.adjustOptions(options)
+		setup.versioned = versioned
+	} else if (len(options.Rules) == 0) && (len(options.SymbolStrings) == 0) &&
+		!options.addsDynamicEntries() {
+		return nil, fmt.Errorf("No replacement rules were provided")
+	}
+	e = options.validateRules()
+	if e != nil {
+		return nil, e
+	}
+	if options.addsDynamicEntries() {
+		if options.SameSize {
+			return nil, fmt.Errorf("Dynamic table entries can't be added " +
+				"in same-size mode, since the string table must grow")
+		}
+		setup.dynamicAdditions, e = planDynamicAdditions(f, options, report)
+		if e != nil {
+			return nil, e
+		}
+	}
+	setup.options = selectMachineRules(f, options, report)
+	return setup, nil
+}
+
+// Replaces all strings in the string tables of f matching the given options'
+// rules. The modified string tables are appended to the end of f.Raw, and all
+// known references to replaced strings are updated. Returns a report
+// describing the changes. If this returns an error, f may be left in an
+// inconsistent state.
+func ReplaceStrings(f *elf_reader.ELF32File, options *Options) (*Report,
+	error) {
+	// Keep the original content, so the report can describe how to revert
+	// the patch.
+	original := make([]byte, len(f.Raw))
+	copy(original, f.Raw)
+	return replaceStrings(f, options, original)
+}
+
+// Implements ReplaceStrings. The original content must match f.Raw before
+// anything is changed, and must not be modified while patching f, since it's
+// used to record how to revert the patch. Callers that already have an
+// unmodified copy of the file can pass it here instead of copying f.Raw.
+func replaceStrings(f *elf_reader.ELF32File, options *Options,
+	original []byte) (*Report, error) {
+	layout := snapshotLayout(f)
+	setup, e := prepareReplacement(f, options)
+	if e != nil {
+		return nil, e
+	}
+	options = setup.options
+	report := setup.report
+	report.OriginalLayout = layout
+	mistyped := setup.mistyped
+	versioned := setup.versioned
+	parallelism := effectiveParallelism(options.Parallelism)
+	symbolNamesBefore := checkOriginalSymbolNames(f, report)
+	relocationsBefore := checkOriginalRelocationTargets(f, report)
+	// Strings found through symbols are overwritten in place, so they can be
+	// replaced before the string tables are.
+	if len(options.SymbolStrings) != 0 {
+		e = replaceSymbolStrings(f, options, report)
+		if e != nil {
+			return nil, e
+		}
+	}
+	if options.StripNotes {
+		e = stripNoteSegments(f, report)
+		if e != nil {
+			return nil, fmt.Errorf("Error stripping note segments: %s", e)
+		}
+	}
+	// First, calculate new string table content.
+	start := report.startPhase("compute replacements")
+	replacements, e := processReplacements(f, options, parallelism, report)
+	if e != nil {
+		return nil, fmt.Errorf("Error performing string replacements: %s", e)
+	}
+	if len(setup.dynamicAdditions) != 0 {
+		replacements, e = addDynamicStrings(f, setup.dynamicAdditions,
+			replacements, report)
+		if e != nil {
+			return nil, fmt.Errorf("Error adding dynamic strings: %s", e)
+		}
+	}
+	report.addTiming("compute replacements", start)
+	// Second, append the new string tables to the end of the file, and update
+	// necessary headers to the new locations.
+	start = report.startPhase("relocate tables")
+	propertyValid := len(gnuPropertyProblems(f)) == 0
+	danglingBefore, e := danglingDynamicPointers(f)
+	if e != nil {
+		return nil, e
+	}
+	permissionsBefore := snapshotPermissions(f, replacements)
+	e = relocateStringTables(f, replacements, options, report)
+	if e != nil {
+		return nil, fmt.Errorf("Error relocating string tables: %s", e)
+	}
+	replacements, e = expandAliasedTables(f, replacements)
+	if e != nil {
+		return nil, e
+	}
+	e = checkGNUPropertyPreserved(f, propertyValid)
+	if e != nil {
+		return nil, e
+	}
+	report.addTiming("relocate tables", start)
+	// Third, update all of the string table references (now that the
+	// replacements list has all the needed information).
+	e = updateStringReferences(f, replacements, parallelism,
+		options.SymbolFilter, report)
+	if e != nil {
+		return nil, fmt.Errorf("Error updating string references: %s", e)
+	}
+	if len(setup.dynamicAdditions) != 0 {
+		start = report.startPhase("dynamic entries")
+		e = growDynamicTable(f, setup.dynamicAdditions, options, report)
+		if e != nil {
+			return nil, fmt.Errorf("Error adding dynamic entries: %s", e)
+		}
+		report.addTiming("dynamic entries", start)
+	}
+	if options.RewriteWarningText {
+		e = rewriteWarningText(f, replacements, report)
+		if e != nil {
+			return nil, fmt.Errorf("Error rewriting warning text: %s", e)
+		}
+	}
+	if options.ClearPrelink {
+		e = clearPrelink(f, report)
+		if e != nil {
+			return nil, fmt.Errorf("Error clearing prelink information: %s",
+				e)
+		}
+	}
+	// The dynamic linker looks up symbols by the hash of their names, so the
+	// hash tables must match the new names.
+	start = report.startPhase("hash tables")
+	e = rebuildHashTables(f, report)
+	if e != nil {
+		return nil, fmt.Errorf("Error rebuilding hash tables: %s", e)
+	}
+	report.addTiming("hash tables", start)
+	if versioned != nil {
+		e = versioned.apply(f, report)
+		if e != nil {
+			return nil, fmt.Errorf("Error updating symbol versions: %s", e)
+		}
+	}
+	e = setSectionTypes(f, mistyped)
+	if e != nil {
+		return nil, fmt.Errorf("Error restoring section types: %s", e)
+	}
+	e = checkDynamicPointers(f, danglingBefore, report)
+	if e != nil {
+		return nil, fmt.Errorf("Error checking dynamic table addresses: %s",
+			e)
+	}
+	checkSegmentPermissions(f, permissionsBefore, replacements, report)
+	e = checkSymbolNames(f, symbolNamesBefore)
+	if e != nil {
+		return nil, e
+	}
+	e = checkRelocationTargets(f, relocationsBefore, report)
+	if e != nil {
+		return nil, e
+	}
+	report.addUnsupportedReferences(f, replacements)
+	report.addTables(f, replacements)
+	for i := range replacements {
+		report.explainTable(f, &(replacements[i]), options.Rules)
+	}
+	report.sortExplanations()
+	// Finally, let the caller make any additional changes.
+	if options.PatchHook != nil {
+		start = report.startPhase("patch hook")
+		e = runPatchHook(f, report, options)
+		if e != nil {
+			return nil, e
+		}
+		report.addTiming("patch hook", start)
+	}
+	report.addSectionMapping(layout, snapshotLayout(f))
+	if options.Strict && (len(report.Warnings) != 0) {
+		return nil, fmt.Errorf("Strict mode is enabled, but patching "+
+			"produced %d warnings. The first was: %s", len(report.Warnings),
+			report.Warnings[0])
+	}
+	report.recordRestore(original, f.Raw)
+	return report, nil
+}
+
+// Returns an error if the page size can't be used as Options.PageSize: it
+// must be 0, or a power of two of at least 0x1000.
+func ValidatePageSize(pageSize uint32) error {
+	if pageSize == 0 {
+		return nil
+	}
+	if (pageSize < minimumPageSize) || ((pageSize & (pageSize - 1)) != 0) {
+		return fmt.Errorf("Invalid page size 0x%x: it must be a power of "+
+			"two of at least 0x%x", pageSize, minimumPageSize)
+	}
+	return nil
+}
+
+// Returns an error if the alignment can't be used as
+// Options.ProgramHeaderAlign: it must be 0, or a power of two between 4 and
+// 0x1000.
+func ValidateProgramHeaderAlign(align uint32) error {
+	if align == 0 {
+		return nil
+	}
+	if (align < 4) || (align > minimumPageSize) ||
+		((align & (align - 1)) != 0) {
+		return fmt.Errorf("Invalid program header table alignment 0x%x: it "+
+			"must be a power of two between 4 and 0x%x", align,
+			minimumPageSize)
+	}
+	return nil
+}
+
+// Holds the settings used when calling Replace.
+type Options struct {
+	// The rules to apply, in order, to each string table entry.
+	Rules []Rule
+	// The maximum number of goroutines to use when computing replacements
+	// and scanning for string references. Writes to the file are always
+	// serialized. If this is less than 1, the number of usable CPUs is used.
+	Parallelism int
+	// Controls the virtual address at which the relocated string tables are
+	// loaded. Defaults to MirrorOffsetAddress.
+	AddressStrategy AddressStrategy
+	// The virtual address to use if AddressStrategy is FixedAddress.
+	FixedAddress uint32
+	// If true, grow the last loadable segment to cover the relocated string
+	// tables rather than adding a new program header entry, if possible.
+	// AddressStrategy is ignored if the segment is extended.
+	ExtendLastLoad bool
+	// If true, place the relocated string tables in unused padding at the end
+	// of existing loadable segments, if they all fit, leaving the file size
+	// and number of program headers unchanged.
+	ReusePadding bool
+	// If true, remove PT_NOTE segments, such as the build ID and ABI tag,
+	// before patching, and place the relocated string tables in the space
+	// they used if possible. Otherwise, a freed program header entry is used
+	// for the new segment, so the program header table doesn't move. Notes
+	// read through another segment, such as PT_GNU_PROPERTY, are kept.
+	StripNotes bool
+	// The alignment of the relocated program header table within the
+	// appended data. Must be a power of two between 4 and 0x1000, or 0 to use
+	// 8.
+	ProgramHeaderAlign uint32
+	// If true, place the relocated program header table at the start of the
+	// appended data, before the relocated string tables, rather than after
+	// them.
+	ProgramHeadersFirst bool
+	// If true, the file's size and layout are never changed: replacements
+	// overwrite the original strings in place, padded with null bytes, and it
+	// is an error for a replacement to be longer than the string it replaces.
+	// This is required when the file is embedded in a larger image. It's
+	// also an error to overwrite a string whose bytes are shared by another
+	// referenced string (from suffix sharing), which would change that string
+	// too, or any string in a table that something unknown may refer to.
+	SameSize bool
+	// If true, string tables that must be relocated keep every replacement
+	// that fits in the space of the string it replaces (or in space freed by
+	// other replacements) within their original content, and only the rest
+	// are added to the end of the table, minimizing the appended data.
+	// Ignored if SameSize or InPlace is set.
+	Hybrid bool
+	// If true, each replacement that's no longer than the string it replaces
+	// overwrites it in place, padded with null bytes, as with SameSize, and
+	// only the string tables containing a longer replacement are relocated.
+	// Tables that aren't relocated keep their layout, so the file size and
+	// program headers only change if a replacement grows. Set SameSize as
+	// well to make that an error instead.
+	InPlace bool
+	// If set, called for each string the rules would replace, and may veto
+	// or override the replacement.
+	CandidateHook CandidateHook
+	// If set, called for each string the rules would replace, after
+	// CandidateHook, with the name of the string's section. May substitute a
+	// different replacement or reject it.
+	OnReplace ReplaceCallback
+	// If set, called once all string references have been updated, and may
+	// make additional changes to the file.
+	PatchHook PatchHook
+	// If set, receives an event for each action taken while patching, as it
+	// happens, including the start and end of each phase, so callers can
+	// show progress without parsing the log.
+	OnEvent EventHandler
+	// If set, string tables in sections with names matching this are never
+	// modified.
+	ExcludeSections *regexp.Regexp
+	// If set, strings matching this are never replaced, even if a rule
+	// matches them.
+	NotMatching *regexp.Regexp
+	// If true, only strings used as dependency names (by DT_NEEDED entries in
+	// the dynamic table) are replaced. Other references to the same strings,
+	// such as version requirements naming the same file, are still updated.
+	OnlyNeeded bool
+	// If set, only symbols accepted by this filter are renamed.
+	SymbolFilter *SymbolFilter
+	// Strings to overwrite in place, located through the symbols referring
+	// to them rather than through string tables. May be combined with Rules.
+	SymbolStrings []SymbolString
+	// Dependencies to add as DT_NEEDED entries, after the existing ones.
+	// Names the file already depends on are skipped. The dynamic table is
+	// relocated to a new segment if it has no room for the new entries. May
+	// be used without Rules, but not with SameSize.
+	AddNeeded []string
+	// If set, a DT_SONAME, DT_RPATH, or DT_RUNPATH entry, respectively, with
+	// this value is added, like AddNeeded. It's an error if the file already
+	// has one with a different value; use a rule to replace it instead.
+	AddSoname  string
+	AddRPath   string
+	AddRunPath string
+	// Renames specific versions of dynamic symbols, and changes their
+	// versions. Can't be combined with Rules.
+	VersionedRenames []VersionedRename
+	// The names of sections to treat as string tables, even though they don't
+	// have the SHT_STRTAB type, e.g. because the linker used SHT_PROGBITS.
+	TreatAsStringTables []string
+	// If true, sections of other types (SHT_PROGBITS, or OS, processor or
+	// user-specific types) whose content looks like a string table are also
+	// treated as string tables. This is a heuristic, and may match other data
+	// consisting of NUL-separated text.
+	DetectStringTables bool
+	// If true, string tables that aren't used by any structure this package
+	// updates (e.g. .stabstr, or tables nothing refers to) are also modified.
+	// Otherwise, they're only modified if they're named in a rule's Sections
+	// list or in TreatAsStringTables.
+	AllStringTables bool
+	// If true, the .gnu.warning.<symbol> section of each renamed symbol,
+	// whose content the GNU linker prints when the symbol is used, is
+	// renamed to match the symbol's new name.
+	RenameWarningSections bool
+	// If true, renamed symbols' old names are replaced in the text of
+	// .gnu.warning sections, where the new text fits.
+	RewriteWarningText bool
+	// If true, prelinked files may be patched, and the dynamic entries added
+	// by prelink are removed so the loader relocates the file normally.
+	// Otherwise, patching a prelinked file is an error.
+	ClearPrelink bool
+	// If true, the report's Explanations describe why each rule did or
+	// didn't take effect in each string table.
+	Explain bool
+	// Receives progress messages and warnings while patching. If this is nil,
+	// nothing is logged, although warnings are still added to the report.
+	Logger *log.Logger
+	// The smallest page size to assume when choosing where to load the
+	// relocated string tables, for targets with pages larger than 4 KiB
+	// whose segments aren't aligned accordingly. Must be a power of two of at
+	// least 0x1000, or 0 to use 0x1000.
+	PageSize uint32
+	// State shared with other replacements in the same file, set by
+	// ParsedFile. May be nil.
+	cache *fileCache
+	// If true, anything that would add a warning to the report is treated as
+	// an error instead.
+	Strict bool
+	// If true, replacements may introduce NUL bytes (which end the string
+	// early), newlines and other control characters, and non-ASCII bytes.
+	// Otherwise, these are treated as errors.
+	AllowRawBytes bool
+	// If true, rules whose regular expressions can match an empty string
+	// (e.g. "x*" or "^") may be used. Otherwise, these are treated as errors,
+	// since each empty match inserts the replacement into the string.
+	AllowEmptyMatch bool
+	// If true, Replace (and the ParsedFile and Replacer methods using it)
+	// only computes the report, returning nil rather than the patched
+	// content, so changes can be previewed without handling an output file.
+	// The input is never modified either way. ReplaceStrings ignores this,
+	// since it patches the parsed file it's given.
+	DryRun bool
+	// The encoding of the text in ELF32 string tables. Each string is
+	// decoded to UTF-8 before the rules and NotMatching are applied, and the
+	// result is encoded again, which is an error if it contains a character
+	// the encoding can't represent. CandidateHook, OnReplace, and the report
+	// still see the bytes in the table. Defaults to UTF8Encoding, which
+	// leaves strings unchanged.
+	Encoding Encoding
+	// Deprecated features the caller used to request this run, such as an
+	// old command-line syntax, which are copied into the report's
+	// Deprecations.
+	Deprecations []DeprecationNotice
+}
+
+// Logs a message using the options' logger, if there is one.
+func (o *Options) logf(format string, args ...interface{}) {
+	if o.Logger != nil {
+		o.Logger.Printf(format, args...)
+	}
+}
+
+// Parses the given ELF file content and replaces strings according to the
+// given options. Returns the content of the modified ELF file, and the report
+// describing the changes. The input slice is not modified. This works
+// entirely in memory: it never accesses the filesystem, and only logs to
+// options.Logger, so it has no side effects beyond calling the options' hooks
+// and event handler. 64-bit ELF files are passed to ReplaceELF64, which
+// supports fewer options.
+func Replace(input []byte, options Options) ([]byte, *Report, error) {
+	if IsELF64File(input) {
+		return ReplaceELF64(input, options)
+	}
+	f, report, e := patchCopy(input, &options)
+	if e != nil {
+		return nil, nil, e
+	}
+	if options.DryRun {
+		return nil, report, nil
+	}
+	return f.Raw, report, nil
+}
+
+// Parses a copy of the input and replaces strings in it. The input itself is
+// used as the original content when recording how to revert the patch, so
+// the copy being patched is the only one made.
+func patchCopy(input []byte, options *Options) (*elf_reader.ELF32File,
+	*Report, error) {
+	start := time.Now()
+	raw := make([]byte, len(input))
+	copy(raw, input)
+	f, e := ParseELF32File(raw)
+	if e != nil {
+		return nil, nil, fmt.Errorf("Failed parsing the input file: %s", e)
+	}
+	parseTime := time.Since(start)
+	report, e := replaceStrings(f, options, input)
+	if e != nil {
+		return nil, nil, e
+	}
+	report.prependTiming("parse", parseTime)
+	return f, report, nil
+}
@@ -0,0 +1,205 @@
+package stringreplace
+
+// This file contains support for removing PT_NOTE segments, such as the ABI
+// tag and build ID, before patching. The program header slots they used,
+// and the file ranges of the note sections in them, are recorded in the
+// report's free space, so that the relocated string tables can use them
+// rather than growing the file (see free_space.go).
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/yalue/elf_reader"
+)
+
+// The program header type of PT_NOTE segments, and the section type of the
+// note sections in them.
+const (
+	noteSegment = 4
+	noteSection = 7
+)
+
+// Returns a reason why the note segment at the given index can't be
+// stripped, or "" if it can: every section overlapping it must be a note
+// section entirely inside it, and no segment other than a loadable or note
+// segment may overlap it. The latter keeps notes that the loader reads
+// through another segment, such as .note.gnu.property through
+// PT_GNU_PROPERTY.
+func noteSegmentProblem(f *elf_reader.ELF32File, index int) string {
+	s := &(f.Segments[index])
+	start := uint64(s.FileOffset)
+	end := start + uint64(s.FileSize)
+	for i := range f.Sections {
+		section := &(f.Sections[i])
+		// SHT_NOBITS (8) sections have no content in the file.
+		if (section.Type == 0) || (section.Type == 8) ||
+			(section.Size == 0) {
+			continue
+		}
+		sectionStart := uint64(section.FileOffset)
+		sectionEnd := sectionStart + uint64(section.Size)
+		if (sectionEnd <= start) || (sectionStart >= end) {
+			continue
+		}
+		if (section.Type != noteSection) || (sectionStart < start) ||
+			(sectionEnd > end) {
+			name, _ := SectionName(f, uint16(i))
+			return fmt.Sprintf("section %d (%s) isn't a note section "+
+				"inside it", i, EscapeString(name))
+		}
+	}
+	for i := range f.Segments {
+		other := &(f.Segments[i])
+		if (i == index) || (other.Type == elf_reader.LoadableSegment) ||
+			(uint32(other.Type) == noteSegment) || (other.FileSize == 0) {
+			continue
+		}
+		otherEnd := uint64(other.FileOffset) + uint64(other.FileSize)
+		if (otherEnd > start) && (uint64(other.FileOffset) < end) {
+			return fmt.Sprintf("%s segment %d overlaps it",
+				MachineSegmentTypeName(uint16(f.Header.Machine),
+					uint32(other.Type)), i)
+		}
+	}
+	return ""
+}
+
+// Returns true if the segments at the given indices overlap in the file.
+func segmentsOverlap(f *elf_reader.ELF32File, a, b int) bool {
+	first := &(f.Segments[a])
+	second := &(f.Segments[b])
+	return (uint64(first.FileOffset) < (uint64(second.FileOffset) +
+		uint64(second.FileSize))) && (uint64(second.FileOffset) <
+		(uint64(first.FileOffset) + uint64(first.FileSize)))
+}
+
+// Returns a reason why each note segment can't be stripped, keyed by its
+// index, using noteSegmentProblem. A note segment overlapping another that
+// can't be stripped can't be stripped either, since clearing its sections
+// would clear part of the other.
+func noteSegmentProblems(f *elf_reader.ELF32File) map[int]string {
+	toReturn := make(map[int]string)
+	var notes []int
+	for i := range f.Segments {
+		if uint32(f.Segments[i].Type) != noteSegment {
+			continue
+		}
+		notes = append(notes, i)
+		problem := noteSegmentProblem(f, i)
+		if problem != "" {
+			toReturn[i] = problem
+		}
+	}
+	changed := true
+	for changed {
+		changed = false
+		for _, i := range notes {
+			if _, ok := toReturn[i]; ok {
+				continue
+			}
+			for _, j := range notes {
+				if _, ok := toReturn[j]; !ok || !segmentsOverlap(f, i, j) {
+					continue
+				}
+				toReturn[i] = fmt.Sprintf("it overlaps note segment %d, "+
+					"which can't be stripped", j)
+				changed = true
+				break
+			}
+		}
+	}
+	return toReturn
+}
+
+// Removes every PT_NOTE segment that noteSegmentProblems allows, along with
+// the content of the note sections in it. The sections become
+// non-allocated SHT_NOBITS sections at address 0, keeping their indices for
+// any symbols referring to them, and their zero-filled file ranges are added
+// to the report's free space, along with the freed program header slots. The
+// program header table stays in place, with the unused entries at its end
+// zeroed. Segments that can't be removed are reported as warnings.
+func stripNoteSegments(f *elf_reader.ELF32File, report *Report) error {
+	kept := make([]elf_reader.ELF32ProgramHeader, 0, len(f.Segments))
+	var removed []elf_reader.ELF32ProgramHeader
+	problems := noteSegmentProblems(f)
+	for i := range f.Segments {
+		s := &(f.Segments[i])
+		if uint32(s.Type) != noteSegment {
+			kept = append(kept, *s)
+			continue
+		}
+		problem, ok := problems[i]
+		if ok {
+			report.addWarning("Not stripping note segment %d: %s", i,
+				problem)
+			kept = append(kept, *s)
+			continue
+		}
+		e := writeAtELFOffset(f, s.FileOffset, make([]byte, s.FileSize),
+			"note segment")
+		if e != nil {
+			return fmt.Errorf("Failed clearing note segment %d: %s", i, e)
+		}
+		for j := range f.Sections {
+			section := &(f.Sections[j])
+			if (section.Type != noteSection) ||
+				(section.FileOffset < s.FileOffset) ||
+				((uint64(section.FileOffset) + uint64(section.Size)) >
+					(uint64(s.FileOffset) + uint64(s.FileSize))) {
+				continue
+			}
+			section.Type = 8
+			// Clear SHF_ALLOC. Like other non-allocated sections, the
+			// section no longer has an address.
+			section.Flags &^= 2
+			section.VirtualAddress = 0
+		}
+		removed = append(removed, *s)
+		report.logf("Stripped note segment %d (%d bytes at offset 0x%x).\n",
+			i, s.FileSize, s.FileOffset)
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	oldSize := uint32(binary.Size(f.Segments))
+	f.Segments = kept
+	newSize := uint32(binary.Size(f.Segments))
+	for i := range f.Segments {
+		if f.Segments[i].Type == elf_reader.ProgramHeaderSegment {
+			f.Segments[i].FileSize = newSize
+			f.Segments[i].MemorySize = newSize
+		}
+	}
+	e := writeAtELFOffset(f, f.Header.ProgramHeaderOffset, f.Segments,
+		"program headers")
+	if e != nil {
+		return fmt.Errorf("Error writing updated program headers: %s", e)
+	}
+	e = writeAtELFOffset(f, f.Header.ProgramHeaderOffset+newSize,
+		make([]byte, oldSize-newSize), "unused program headers")
+	if e != nil {
+		return fmt.Errorf("Error clearing unused program headers: %s", e)
+	}
+	e = writeAtELFOffset(f, f.Header.SectionHeaderOffset, f.Sections,
+		"section headers")
+	if e != nil {
+		return fmt.Errorf("Error updating section headers: %s", e)
+	}
+	e = writeProgramHeaderCount(f)
+	if e != nil {
+		return fmt.Errorf("Failed writing the number of program header "+
+			"entries: %s", e)
+	}
+	e = reparseELF(f)
+	if e != nil {
+		return fmt.Errorf("Error re-parsing ELF file after stripping note "+
+			"segments: %s", e)
+	}
+	// The freed ranges are looked up in the remaining segments.
+	for i := range removed {
+		report.freed.slots++
+		report.freed.addRegion(f, removed[i].FileOffset,
+			removed[i].FileSize)
+	}
+	return nil
+}
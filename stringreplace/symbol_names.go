@@ -0,0 +1,125 @@
+package stringreplace
+
+// This file contains a check that every symbol's name (st_name) points to a
+// NUL-terminated string inside the string table its symbol table links to.
+// It runs before patching, to report corruption that was already there, and
+// again afterwards, so that a patching error leaving a symbol pointing
+// outside of its (old or new) string table is caught, rather than only
+// bounds-checking the offsets that are replaced.
+
+import (
+	"fmt"
+	"github.com/yalue/elf_reader"
+	"sort"
+)
+
+// Identifies a symbol by its symbol table's section index and its index in
+// the table.
+type symbolLocation struct {
+	section uint16
+	index   uint32
+}
+
+// Returns a description of the problem with each symbol whose name isn't a
+// NUL-terminated string in its symbol table's linked string table, keyed by
+// the symbol's location. Symbol tables linking to a section that isn't a
+// string table in the file are reported as a whole, using index 0xffffffff.
+func symbolNameProblems(f *elf_reader.ELF32File) map[symbolLocation]string {
+	toReturn := make(map[symbolLocation]string)
+	for i := range f.Sections {
+		section := &(f.Sections[i])
+		// SHT_SYMTAB is 2, and SHT_DYNSYM is 11.
+		if (section.Type != 2) && (section.Type != 11) {
+			continue
+		}
+		link := section.LinkedIndex
+		// SHT_NOBITS is 8.
+		if (link == 0) || (link >= uint32(len(f.Sections))) ||
+			(f.Sections[link].Type == 8) {
+			toReturn[symbolLocation{uint16(i), 0xffffffff}] = fmt.Sprintf(
+				"Symbol table in section %d links to section %d, which "+
+					"can't hold its names", i, link)
+			continue
+		}
+		symbols, e := f.GetSectionContent(uint16(i))
+		if e != nil {
+			continue
+		}
+		names, e := f.GetSectionContent(uint16(link))
+		if e != nil {
+			toReturn[symbolLocation{uint16(i), 0xffffffff}] = fmt.Sprintf(
+				"Failed reading the names of the symbols in section %d: %s",
+				i, e)
+			continue
+		}
+		// Each Elf32_Sym is 16 bytes, starting with st_name.
+		for j := 0; (j + 16) <= len(symbols); j += 16 {
+			name := f.Endianness.Uint32(symbols[j:])
+			problem := ""
+			if uint64(name) >= uint64(len(names)) {
+				problem = fmt.Sprintf("is outside of the %d-byte string "+
+					"table in section %d", len(names), link)
+			} else if _, e := elf_reader.ReadStringAtOffset(name,
+				names); e != nil {
+				problem = fmt.Sprintf("isn't a NUL-terminated string in "+
+					"section %d", link)
+			}
+			if problem == "" {
+				continue
+			}
+			toReturn[symbolLocation{uint16(i), uint32(j / 16)}] =
+				fmt.Sprintf("Symbol %d in section %d: name offset 0x%x %s",
+					j/16, i, name, problem)
+		}
+	}
+	return toReturn
+}
+
+// Returns the problems, sorted by location.
+func sortedSymbolNameProblems(
+	problems map[symbolLocation]string) []string {
+	locations := make([]symbolLocation, 0, len(problems))
+	for location := range problems {
+		locations = append(locations, location)
+	}
+	sort.Slice(locations, func(a, b int) bool {
+		if locations[a].section != locations[b].section {
+			return locations[a].section < locations[b].section
+		}
+		return locations[a].index < locations[b].index
+	})
+	toReturn := make([]string, len(locations))
+	for i, location := range locations {
+		toReturn[i] = problems[location]
+	}
+	return toReturn
+}
+
+// Adds a warning for each symbol whose name was already invalid before
+// patching, and returns them, to pass to checkSymbolNames.
+func checkOriginalSymbolNames(f *elf_reader.ELF32File,
+	report *Report) map[symbolLocation]string {
+	before := symbolNameProblems(f)
+	for _, problem := range sortedSymbolNameProblems(before) {
+		report.addWarning("%s (before patching)", problem)
+	}
+	return before
+}
+
+// Returns an error if a symbol's name is invalid after patching, unless it
+// was already invalid before.
+func checkSymbolNames(f *elf_reader.ELF32File,
+	before map[symbolLocation]string) error {
+	introduced := make(map[symbolLocation]string)
+	for location, problem := range symbolNameProblems(f) {
+		if _, ok := before[location]; !ok {
+			introduced[location] = problem
+		}
+	}
+	if len(introduced) == 0 {
+		return nil
+	}
+	problems := sortedSymbolNameProblems(introduced)
+	return fmt.Errorf("Patching left %d symbols with invalid names. The "+
+		"first was: %s", len(problems), problems[0])
+}
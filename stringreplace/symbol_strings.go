@@ -0,0 +1,304 @@
+package stringreplace
+
+// This file contains support for replacing strings located through symbols
+// rather than through string tables, such as configuration strings embedded
+// in .rodata or .data and only referred to by a symbol (e.g. "const char
+// default_path[]" or "const char *_dl_platform"). Nothing else refers to
+// these strings in a way this package can update, so they're always
+// overwritten in place, and the replacement may not be longer than the space
+// available.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/yalue/elf_reader"
+	"strings"
+)
+
+// Replaces the string a symbol refers to. The symbol's value must either be
+// the address of the string itself, or, for a 4-byte symbol, the address of
+// a pointer to the string.
+type SymbolString struct {
+	// The name of the symbol, in .symtab or .dynsym.
+	Symbol string `json:"symbol"`
+	// The string to write in place of the original.
+	Replacement string `json:"replacement"`
+}
+
+// Describes a string replaced through a symbol.
+type SymbolStringReport struct {
+	Symbol string `json:"symbol"`
+	// The index of the section containing the string, and the string's file
+	// offset and virtual address.
+	SectionIndex   uint16 `json:"section_index"`
+	FileOffset     uint32 `json:"file_offset"`
+	VirtualAddress uint32 `json:"virtual_address"`
+	// True if the symbol refers to a pointer to the string, rather than to
+	// the string itself.
+	Indirect bool `json:"indirect"`
+	// The original and new strings, escaped using EscapeString.
+	Original string `json:"original"`
+	New      string `json:"new"`
+	// The number of bytes available for the string, including its NUL
+	// terminator.
+	Capacity uint32 `json:"capacity"`
+}
+
+// Parses a symbol string replacement of the form "symbol=replacement".
+func ParseSymbolString(s string) (*SymbolString, error) {
+	equals := strings.Index(s, "=")
+	if equals <= 0 {
+		return nil, fmt.Errorf("%q isn't of the form symbol=replacement", s)
+	}
+	return &SymbolString{
+		Symbol:      s[:equals],
+		Replacement: s[equals+1:],
+	}, nil
+}
+
+// Holds the location of a string found through a symbol.
+type symbolStringLocation struct {
+	sectionIndex uint16
+	fileOffset   uint32
+	address      uint32
+	indirect     bool
+	original     []byte
+	// The number of bytes that may be overwritten, including the NUL
+	// terminator.
+	capacity uint32
+}
+
+// Returns the first defined symbol with the given name in the file's symbol
+// tables, preferring .symtab, which usually holds more precise sizes, to
+// .dynsym.
+func findSymbolByName(f *elf_reader.ELF32File,
+	name string) (*elf_reader.ELF32Symbol, error) {
+	symbolSize := uint32(binary.Size(&elf_reader.ELF32Symbol{}))
+	// SHT_SYMTAB is 2, and SHT_DYNSYM is 11.
+	for _, sectionType := range []uint32{2, 11} {
+		for i := range f.Sections {
+			section := &(f.Sections[i])
+			if uint32(section.Type) != sectionType {
+				continue
+			}
+			names, e := readSymbolNames(f, uint16(i))
+			if e != nil {
+				continue
+			}
+			for j, symbolName := range names {
+				if string(symbolName) != name {
+					continue
+				}
+				offset := section.FileOffset + uint32(j)*symbolSize
+				if (uint64(offset) + uint64(symbolSize)) >
+					uint64(len(f.Raw)) {
+					break
+				}
+				var symbol elf_reader.ELF32Symbol
+				symbol.Value, _ = readELFUint32(f, offset+4, "symbol")
+				symbol.Size, _ = readELFUint32(f, offset+8, "symbol")
+				symbol.Info = f.Raw[offset+12]
+				symbol.Other = f.Raw[offset+13]
+				symbol.SectionIndex = f.Endianness.Uint16(f.Raw[offset+14:])
+				// SHN_UNDEF is 0, and the reserved indices (such as
+				// SHN_ABS) start at 0xff00.
+				if (symbol.SectionIndex == 0) ||
+					(symbol.SectionIndex >= 0xff00) {
+					continue
+				}
+				return &symbol, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("No defined symbol named %q was found", name)
+}
+
+// Returns the index of the section with file content that contains the
+// given virtual address, or -1 if there isn't one.
+func sectionContainingAddress(f *elf_reader.ELF32File, address uint32) int {
+	for i := range f.Sections {
+		section := &(f.Sections[i])
+		// SHT_NOBITS is 8, and SHF_ALLOC is 2.
+		if (section.Type == 8) || ((uint32(section.Flags) & 2) == 0) {
+			continue
+		}
+		if (address >= section.VirtualAddress) && (uint64(address) <
+			(uint64(section.VirtualAddress) + uint64(section.Size))) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Returns the location of the NUL-terminated string at the given offset in
+// the section, or an error if there isn't one.
+func readSectionString(f *elf_reader.ELF32File, sectionIndex uint16,
+	offset uint32) (*symbolStringLocation, error) {
+	if f.IsStringTable(sectionIndex) {
+		return nil, fmt.Errorf("It's in a string table (section %d); use a "+
+			"replacement rule instead", sectionIndex)
+	}
+	content, e := f.GetSectionContent(sectionIndex)
+	if e != nil {
+		return nil, fmt.Errorf("Failed reading section %d: %s", sectionIndex,
+			e)
+	}
+	if offset >= uint32(len(content)) {
+		return nil, fmt.Errorf("Offset 0x%x is outside of section %d",
+			offset, sectionIndex)
+	}
+	s, e := elf_reader.ReadStringAtOffset(offset, content)
+	if e != nil {
+		return nil, fmt.Errorf("There's no NUL-terminated string at offset "+
+			"0x%x in section %d", offset, sectionIndex)
+	}
+	section := &(f.Sections[sectionIndex])
+	return &symbolStringLocation{
+		sectionIndex: sectionIndex,
+		fileOffset:   section.FileOffset + offset,
+		address:      section.VirtualAddress + offset,
+		original:     s,
+		capacity:     uint32(len(s)) + 1,
+	}, nil
+}
+
+// Returns the location of the non-empty string pointed to by the 32-bit word
+// loaded at the given address.
+func findPointedToString(f *elf_reader.ELF32File,
+	address uint32) (*symbolStringLocation, error) {
+	target, e := readLoadedUint32(f, address)
+	if e != nil {
+		return nil, e
+	}
+	sectionIndex := sectionContainingAddress(f, target)
+	if sectionIndex < 0 {
+		return nil, fmt.Errorf("0x%08x isn't the address of a string in the "+
+			"file", target)
+	}
+	toReturn, e := readSectionString(f, uint16(sectionIndex),
+		target-f.Sections[sectionIndex].VirtualAddress)
+	if e != nil {
+		return nil, e
+	}
+	if len(toReturn.original) == 0 {
+		return nil, fmt.Errorf("0x%08x is the address of an empty string",
+			target)
+	}
+	toReturn.indirect = true
+	return toReturn, nil
+}
+
+// Returns the location of the string the named symbol refers to.
+func findSymbolString(f *elf_reader.ELF32File,
+	name string) (*symbolStringLocation, error) {
+	symbol, e := findSymbolByName(f, name)
+	if e != nil {
+		return nil, e
+	}
+	if int(symbol.SectionIndex) >= len(f.Sections) {
+		return nil, fmt.Errorf("The symbol refers to section %d, which "+
+			"doesn't exist", symbol.SectionIndex)
+	}
+	section := &(f.Sections[symbol.SectionIndex])
+	// SHT_NOBITS is 8.
+	if section.Type == 8 {
+		return nil, fmt.Errorf("The symbol is in a section with no content " +
+			"in the file (e.g. .bss), so it's only set at runtime")
+	}
+	// A 4-byte symbol in a linked file may be a pointer to the string. This
+	// is checked first, since a pointer's bytes may also look like a short
+	// string. Symbols in relocatable (ET_REL, 1) files hold offsets in their
+	// sections rather than addresses, and their pointers aren't filled in.
+	relocatable := uint32(f.Header.Type) == 1
+	if (symbol.Size == 4) && !relocatable {
+		toReturn, e := findPointedToString(f, symbol.Value)
+		if e == nil {
+			return toReturn, nil
+		}
+	}
+	offset := symbol.Value
+	if !relocatable {
+		offset -= section.VirtualAddress
+	}
+	toReturn, e := readSectionString(f, symbol.SectionIndex, offset)
+	if e != nil {
+		return nil, e
+	}
+	if len(toReturn.original) == 0 {
+		return nil, fmt.Errorf("It refers to an empty string")
+	}
+	// A character array may be larger than the string it initially holds.
+	if (symbol.Size > toReturn.capacity) && ((uint64(offset) +
+		uint64(symbol.Size)) <= uint64(section.Size)) {
+		toReturn.capacity = symbol.Size
+	}
+	return toReturn, nil
+}
+
+// Overwrites the string each of the options' SymbolStrings refers to, padding
+// the remainder of the original string with NUL bytes. Returns an error if a
+// symbol can't be found, doesn't refer to a string, or if its replacement is
+// too long. Warns about instructions that appear to refer to the middle of a
+// replaced string, which will see different content.
+func replaceSymbolStrings(f *elf_reader.ELF32File, options *Options,
+	report *Report) error {
+	for _, s := range options.SymbolStrings {
+		location, e := findSymbolString(f, s.Symbol)
+		if e != nil {
+			return fmt.Errorf("Can't replace the string for symbol %s: %s",
+				s.Symbol, e)
+		}
+		original := string(location.original)
+		if !options.AllowRawBytes {
+			e = checkRawBytes(original, s.Replacement, false)
+			if e != nil {
+				return e
+			}
+		}
+		if uint32(len(s.Replacement)) >= location.capacity {
+			return fmt.Errorf("The replacement for symbol %s's string %q is "+
+				"%d bytes, but only %d are available", s.Symbol, original,
+				len(s.Replacement), location.capacity-1)
+		}
+		length := len(s.Replacement) + 1
+		if length < (len(original) + 1) {
+			length = len(original) + 1
+		}
+		content := make([]byte, length)
+		copy(content, s.Replacement)
+		e = writeAtELFOffset(f, location.fileOffset, content,
+			"symbol's string")
+		if e != nil {
+			return fmt.Errorf("Failed writing symbol %s's string: %s",
+				s.Symbol, e)
+		}
+		report.SymbolStrings = append(report.SymbolStrings,
+			SymbolStringReport{
+				Symbol:         s.Symbol,
+				SectionIndex:   location.sectionIndex,
+				FileOffset:     location.fileOffset,
+				VirtualAddress: location.address,
+				Indirect:       location.indirect,
+				Original:       EscapeString(original),
+				New:            EscapeString(s.Replacement),
+				Capacity:       location.capacity,
+			})
+		report.logf("Replaced symbol %s's string at 0x%08x: %s -> %s\n",
+			s.Symbol, location.address, EscapeString(original),
+			EscapeString(s.Replacement))
+		references, e := FindCodeReferences(f, location.address+1,
+			location.address+uint32(length))
+		if e != nil {
+			report.addWarning("Failed checking for code referring to symbol "+
+				"%s's string: %s", s.Symbol, e)
+			continue
+		}
+		if len(references) != 0 {
+			report.addWarning("%d instructions appear to refer to the middle "+
+				"of symbol %s's string, and will see the new content. The "+
+				"first is at 0x%08x (%s)", len(references), s.Symbol,
+				references[0].Address, references[0].Kind)
+		}
+	}
+	return nil
+}
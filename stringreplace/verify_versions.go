@@ -0,0 +1,422 @@
+package stringreplace
+
+// This file contains a consistency checker for the GNU symbol versioning
+// sections, which is useful for confirming that a patched file will still be
+// accepted by the dynamic linker.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/yalue/elf_reader"
+)
+
+// The dynamic table tags referring to the symbol versioning sections.
+const (
+	dynamicTagVersym     = 0x6ffffff0
+	dynamicTagVerdef     = 0x6ffffffc
+	dynamicTagVerdefNum  = 0x6ffffffd
+	dynamicTagVerneed    = 0x6ffffffe
+	dynamicTagVerneedNum = 0x6fffffff
+)
+
+// Holds the state used while checking the symbol versioning sections.
+type versionChecker struct {
+	f        *elf_reader.ELF32File
+	problems []string
+	// The index of the dynamic symbol table, or -1 if there isn't one.
+	dynsymIndex int
+	// The version indices defined by .gnu.version_d and .gnu.version_r,
+	// mapped to their names.
+	defined  map[uint16]string
+	required map[uint16]string
+}
+
+// Records an inconsistency.
+func (c *versionChecker) addProblem(format string, args ...interface{}) {
+	c.problems = append(c.problems, fmt.Sprintf(format, args...))
+}
+
+// Records a problem if the given versioning section doesn't use the same
+// string table as the dynamic symbols.
+func (c *versionChecker) checkStringTableLink(name string,
+	section *elf_reader.ELF32SectionHeader) {
+	if c.dynsymIndex < 0 {
+		return
+	}
+	expected := c.f.Sections[c.dynsymIndex].LinkedIndex
+	if section.LinkedIndex != expected {
+		c.addProblem("%s is linked to section %d, but .dynsym uses string "+
+			"table %d", name, section.LinkedIndex, expected)
+	}
+}
+
+// Records a version index from a requirement or definition, reporting a
+// problem if it's reserved or already in use.
+func (c *versionChecker) addVersionIndex(index uint16, name, location string,
+	required bool) {
+	if index < 2 {
+		// Definitions may use index 1 for the file's own base version.
+		if (index == 1) && !required {
+			c.defined[index] = name
+			return
+		}
+		c.addProblem("%s uses reserved version index %d", location, index)
+		return
+	}
+	if other, ok := c.defined[index]; ok {
+		c.addProblem("%s uses version index %d, which is already used by "+
+			"the definition of %s", location, index, EscapeString(other))
+		return
+	}
+	if other, ok := c.required[index]; ok {
+		c.addProblem("%s uses version index %d, which is already used by "+
+			"the requirement for %s", location, index, EscapeString(other))
+		return
+	}
+	if required {
+		c.required[index] = name
+	} else {
+		c.defined[index] = name
+	}
+}
+
+// Records a problem if the stored hash doesn't match the version's name.
+func (c *versionChecker) checkHash(location, name string, hash uint32) {
+	expected := sysvHash([]byte(name))
+	if hash != expected {
+		c.addProblem("%s has hash 0x%08x, but the hash of %s is 0x%08x",
+			location, hash, EscapeString(name), expected)
+	}
+}
+
+// Checks every Elf32_Verdef entry and its Elf32_Verdaux entries.
+func (c *versionChecker) checkDefinitions(index int) {
+	section := &(c.f.Sections[index])
+	c.checkStringTableLink(".gnu.version_d", section)
+	offset := section.FileOffset
+	var count uint32
+	for count = 0; count < section.Info; count++ {
+		location := fmt.Sprintf("verdef %d", count)
+		version, e := readSectionUint16(c.f, section, offset)
+		if e != nil {
+			c.addProblem("%s: %s", location, e)
+			return
+		}
+		if version != 1 {
+			c.addProblem("%s has unsupported vd_version %d", location,
+				version)
+		}
+		var versionIndex, auxCount uint16
+		var hash, auxDelta, next uint32
+		versionIndex, e = readSectionUint16(c.f, section, offset+4)
+		if e == nil {
+			auxCount, e = readSectionUint16(c.f, section, offset+6)
+		}
+		if e == nil {
+			hash, e = readSectionUint32(c.f, section, offset+8)
+		}
+		if e == nil {
+			auxDelta, e = readSectionUint32(c.f, section, offset+12)
+		}
+		if e == nil {
+			next, e = readSectionUint32(c.f, section, offset+16)
+		}
+		if e != nil {
+			c.addProblem("%s: %s", location, e)
+			return
+		}
+		if auxCount == 0 {
+			c.addProblem("%s has no names (vd_cnt is 0)", location)
+		}
+		auxOffset := offset + auxDelta
+		for j := uint16(0); j < auxCount; j++ {
+			auxLocation := fmt.Sprintf("%s aux %d", location, j)
+			var nameOffset, auxNext uint32
+			nameOffset, e = readSectionUint32(c.f, section, auxOffset)
+			if e == nil {
+				auxNext, e = readSectionUint32(c.f, section, auxOffset+4)
+			}
+			if e != nil {
+				c.addProblem("%s: %s", auxLocation, e)
+				break
+			}
+			name, e := readLinkedString(c.f, section, nameOffset)
+			if e != nil {
+				c.addProblem("%s has a bad vda_name (0x%x): %s", auxLocation,
+					nameOffset, e)
+			} else if j == 0 {
+				c.checkHash(location+" vd_hash", name, hash)
+				c.addVersionIndex(versionIndex, name, location, false)
+			}
+			if (auxNext == 0) && ((j + 1) < auxCount) {
+				c.addProblem("%s has vd_cnt %d, but only %d names are "+
+					"chained", location, auxCount, j+1)
+				break
+			}
+			if (auxNext != 0) && ((j + 1) == auxCount) {
+				c.addProblem("%s has vd_cnt %d, but more names are chained",
+					location, auxCount)
+			}
+			auxOffset += auxNext
+		}
+		if next == 0 {
+			count++
+			break
+		}
+		offset += next
+	}
+	if count != section.Info {
+		c.addProblem(".gnu.version_d sh_info is %d, but %d definitions are "+
+			"chained", section.Info, count)
+	}
+}
+
+// Checks every Elf32_Verneed entry and its Elf32_Vernaux entries.
+func (c *versionChecker) checkRequirements(index int) {
+	section := &(c.f.Sections[index])
+	c.checkStringTableLink(".gnu.version_r", section)
+	offset := section.FileOffset
+	var count uint32
+	for count = 0; count < section.Info; count++ {
+		location := fmt.Sprintf("verneed %d", count)
+		version, e := readSectionUint16(c.f, section, offset)
+		if e != nil {
+			c.addProblem("%s: %s", location, e)
+			return
+		}
+		if version != 1 {
+			c.addProblem("%s has unsupported vn_version %d", location,
+				version)
+		}
+		var auxCount uint16
+		var fileName, auxDelta, next uint32
+		auxCount, e = readSectionUint16(c.f, section, offset+2)
+		if e == nil {
+			fileName, e = readSectionUint32(c.f, section, offset+4)
+		}
+		if e == nil {
+			auxDelta, e = readSectionUint32(c.f, section, offset+8)
+		}
+		if e == nil {
+			next, e = readSectionUint32(c.f, section, offset+12)
+		}
+		if e != nil {
+			c.addProblem("%s: %s", location, e)
+			return
+		}
+		_, e = readLinkedString(c.f, section, fileName)
+		if e != nil {
+			c.addProblem("%s has a bad vn_file (0x%x): %s", location,
+				fileName, e)
+		}
+		auxOffset := offset + auxDelta
+		for j := uint16(0); j < auxCount; j++ {
+			auxLocation := fmt.Sprintf("%s aux %d", location, j)
+			var hash, nameOffset, auxNext uint32
+			var versionIndex uint16
+			hash, e = readSectionUint32(c.f, section, auxOffset)
+			if e == nil {
+				versionIndex, e = readSectionUint16(c.f, section,
+					auxOffset+6)
+			}
+			if e == nil {
+				nameOffset, e = readSectionUint32(c.f, section, auxOffset+8)
+			}
+			if e == nil {
+				auxNext, e = readSectionUint32(c.f, section, auxOffset+12)
+			}
+			if e != nil {
+				c.addProblem("%s: %s", auxLocation, e)
+				break
+			}
+			name, e := readLinkedString(c.f, section, nameOffset)
+			if e != nil {
+				c.addProblem("%s has a bad vna_name (0x%x): %s", auxLocation,
+					nameOffset, e)
+			} else {
+				c.checkHash(auxLocation+" vna_hash", name, hash)
+				c.addVersionIndex(versionIndex, name, auxLocation, true)
+			}
+			if (auxNext == 0) && ((j + 1) < auxCount) {
+				c.addProblem("%s has vn_cnt %d, but only %d entries are "+
+					"chained", location, auxCount, j+1)
+				break
+			}
+			if (auxNext != 0) && ((j + 1) == auxCount) {
+				c.addProblem("%s has vn_cnt %d, but more entries are chained",
+					location, auxCount)
+			}
+			auxOffset += auxNext
+		}
+		if next == 0 {
+			count++
+			break
+		}
+		offset += next
+	}
+	if count != section.Info {
+		c.addProblem(".gnu.version_r sh_info is %d, but %d requirements "+
+			"are chained", section.Info, count)
+	}
+}
+
+// Checks that each .gnu.version entry refers to a known version, and that
+// it's consistent with whether the symbol is defined.
+func (c *versionChecker) checkSymbolVersions(index int) {
+	section := &(c.f.Sections[index])
+	if c.dynsymIndex < 0 {
+		c.addProblem(".gnu.version is linked to section %d, which isn't a "+
+			"dynamic symbol table", section.LinkedIndex)
+		return
+	}
+	dynsym := &(c.f.Sections[c.dynsymIndex])
+	symbolSize := uint32(binary.Size(&elf_reader.ELF32Symbol{}))
+	symbolCount := dynsym.Size / symbolSize
+	if section.Size != (symbolCount * 2) {
+		c.addProblem(".gnu.version has %d bytes, but .dynsym has %d "+
+			"symbols, which need %d bytes", section.Size, symbolCount,
+			symbolCount*2)
+	}
+	versions, _, _, e := ReadSymbolVersions(c.f)
+	if e != nil {
+		c.addProblem("%s", e)
+		return
+	}
+	for i := uint32(1); i < symbolCount; i++ {
+		if int(i) >= len(versions) {
+			break
+		}
+		versionIndex := versions[i] & 0x7fff
+		if versionIndex < 2 {
+			continue
+		}
+		symbolOffset := dynsym.FileOffset + i*symbolSize
+		if (uint64(symbolOffset) + uint64(symbolSize)) >
+			uint64(len(c.f.Raw)) {
+			c.addProblem(".dynsym symbol %d is outside of the file", i)
+			break
+		}
+		undefined := c.f.Endianness.Uint16(c.f.Raw[symbolOffset+14:]) == 0
+		if name, ok := c.required[versionIndex]; ok {
+			if !undefined {
+				c.addProblem("Symbol %d is defined, but its version %s is "+
+					"required from another file", i, EscapeString(name))
+			}
+			continue
+		}
+		if name, ok := c.defined[versionIndex]; ok {
+			if undefined {
+				c.addProblem("Symbol %d is undefined, but its version %s is "+
+					"defined by this file", i, EscapeString(name))
+			}
+			continue
+		}
+		c.addProblem("Symbol %d uses version index %d, which isn't defined "+
+			"or required", i, versionIndex)
+	}
+}
+
+// Checks that the dynamic table's versioning entries match the sections.
+func (c *versionChecker) checkDynamicTable(versymIndex, verdefIndex,
+	verneedIndex int) {
+	values := make(map[elf_reader.ELF32DynamicTag]uint32)
+	found := false
+	for i := range c.f.Sections {
+		if !c.f.IsDynamicSection(uint16(i)) {
+			continue
+		}
+		entries, e := c.f.GetDynamicTable(uint16(i))
+		if e != nil {
+			c.addProblem("Failed parsing the dynamic table: %s", e)
+			return
+		}
+		for _, entry := range entries {
+			values[entry.Tag] = entry.Value
+		}
+		found = true
+		break
+	}
+	if !found {
+		c.addProblem("The file has symbol versioning sections, but no " +
+			"dynamic table")
+		return
+	}
+	checkTag := func(tag elf_reader.ELF32DynamicTag, tagName, name string,
+		index int, count bool) {
+		value, present := values[tag]
+		if index < 0 {
+			if present {
+				c.addProblem("The dynamic table has a %s entry, but there is "+
+					"no %s section", tagName, name)
+			}
+			return
+		}
+		if !present {
+			c.addProblem("The dynamic table has no %s entry for %s",
+				tagName, name)
+			return
+		}
+		section := &(c.f.Sections[index])
+		if count {
+			if value != section.Info {
+				c.addProblem("%s is %d, but %s sh_info is %d", tagName, value,
+					name, section.Info)
+			}
+		} else if value != section.VirtualAddress {
+			c.addProblem("%s is 0x%08x, but %s is at VA 0x%08x", tagName,
+				value, name, section.VirtualAddress)
+		}
+	}
+	checkTag(dynamicTagVersym, "DT_VERSYM", ".gnu.version", versymIndex,
+		false)
+	checkTag(dynamicTagVerdef, "DT_VERDEF", ".gnu.version_d", verdefIndex,
+		false)
+	checkTag(dynamicTagVerdefNum, "DT_VERDEFNUM", ".gnu.version_d",
+		verdefIndex, true)
+	checkTag(dynamicTagVerneed, "DT_VERNEED", ".gnu.version_r",
+		verneedIndex, false)
+	checkTag(dynamicTagVerneedNum, "DT_VERNEEDNUM", ".gnu.version_r",
+		verneedIndex, true)
+}
+
+// Cross-checks the file's .dynsym, .gnu.version, .gnu.version_r, and
+// .gnu.version_d sections, and the dynamic table entries referring to them:
+// entry counts, version indices, name hashes, and string offsets. Returns a
+// description of each inconsistency found, or an empty list if there are
+// none or the file doesn't use symbol versioning.
+func VerifyVersions(f *elf_reader.ELF32File) []string {
+	c := &versionChecker{
+		f:           f,
+		dynsymIndex: -1,
+		defined:     make(map[uint16]string),
+		required:    make(map[uint16]string),
+	}
+	versymIndex := findSectionByType(f, VersionSymbolSection)
+	verdefIndex := findSectionByType(f, VersionDefinitionSection)
+	verneedIndex := findSectionByType(f, VersionRequirementSection)
+	if (versymIndex < 0) && (verdefIndex < 0) && (verneedIndex < 0) {
+		return c.problems
+	}
+	if versymIndex < 0 {
+		c.addProblem("The file has version definitions or requirements, " +
+			"but no .gnu.version section")
+	} else {
+		linked := f.Sections[versymIndex].LinkedIndex
+		// SHT_DYNSYM is 11.
+		if (int(linked) < len(f.Sections)) &&
+			(f.Sections[linked].Type == 11) {
+			c.dynsymIndex = int(linked)
+		}
+	}
+	if verdefIndex >= 0 {
+		c.checkDefinitions(verdefIndex)
+	}
+	if verneedIndex >= 0 {
+		c.checkRequirements(verneedIndex)
+	}
+	if versymIndex >= 0 {
+		c.checkSymbolVersions(versymIndex)
+	}
+	c.checkDynamicTable(versymIndex, verdefIndex, verneedIndex)
+	return c.problems
+}
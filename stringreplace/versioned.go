@@ -0,0 +1,271 @@
+package stringreplace
+
+// This file implements versioned symbol renames, such as
+// "foo@GLIBC_2.4=foo_compat@MYLIB_1.0", which rename a dynamic symbol and
+// retarget it to a different version in one operation, coordinating changes
+// to .dynsym, .gnu.version, and .gnu.version_r.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/yalue/elf_reader"
+	"strings"
+)
+
+// Renames the dynamic symbols named Symbol with version Version to NewSymbol,
+// and changes their version to NewVersion. Other symbols with the same name
+// but different versions are left alone.
+type VersionedRename struct {
+	Symbol     string
+	Version    string
+	NewSymbol  string
+	NewVersion string
+}
+
+// Splits a "name@VERSION" string. Both parts must be non-empty.
+func splitVersionedName(s string) (string, string, error) {
+	at := strings.Index(s, "@")
+	if (at <= 0) || (at == (len(s) - 1)) {
+		return "", "", fmt.Errorf("%q isn't of the form name@VERSION", s)
+	}
+	return s[:at], strings.TrimPrefix(s[at+1:], "@"), nil
+}
+
+// Parses a versioned rename of the form "foo@GLIBC_2.4=foo_compat@MYLIB_1.0".
+// A "@@" separator, as used for default versions, is accepted too.
+func ParseVersionedRename(s string) (*VersionedRename, error) {
+	equals := strings.Index(s, "=")
+	if equals < 0 {
+		return nil, fmt.Errorf("%q isn't of the form "+
+			"name@VERSION=new_name@NEW_VERSION", s)
+	}
+	var toReturn VersionedRename
+	var e error
+	toReturn.Symbol, toReturn.Version, e = splitVersionedName(s[:equals])
+	if e != nil {
+		return nil, e
+	}
+	toReturn.NewSymbol, toReturn.NewVersion, e = splitVersionedName(
+		s[equals+1:])
+	if e != nil {
+		return nil, e
+	}
+	return &toReturn, nil
+}
+
+// A 16- or 32-bit field in one of the versioning sections to update after
+// the strings have been replaced.
+type versionFieldUpdate struct {
+	fileOffset   uint32
+	sectionIndex uint16
+	is16Bit      bool
+	original     uint32
+	value        uint32
+	location     string
+}
+
+// Holds the changes needed to carry out a list of versioned renames.
+type versionedRenamePlan struct {
+	// Rules replacing the symbol and version names, limited to the dynamic
+	// string table.
+	rules []Rule
+	// The file offsets of the symbols to rename. Other symbols keep their
+	// names, even if they share a string with a renamed symbol.
+	symbolOffsets map[uint32]bool
+	// The file offsets of the symbols to rename, mapped to their new names,
+	// used to verify the result.
+	newNames map[uint32]string
+	updates  []versionFieldUpdate
+}
+
+// Returns a rule replacing exactly the string old with new, in the given
+// section.
+func exactStringRule(old, new, section string) Rule {
+	toReturn := LiteralRule(old, new)
+	toReturn.Sections = []string{section}
+	return toReturn
+}
+
+// Works out the changes needed to carry out the given renames.
+func planVersionedRenames(f *elf_reader.ELF32File, renames []VersionedRename,
+	report *Report) (*versionedRenamePlan, error) {
+	versions, versymIndex, dynsymIndex, e := ReadSymbolVersions(f)
+	if e != nil {
+		return nil, e
+	}
+	if versymIndex < 0 {
+		return nil, fmt.Errorf("The file has no .gnu.version section")
+	}
+	if !f.IsSymbolTable(uint16(dynsymIndex)) {
+		return nil, fmt.Errorf(".gnu.version isn't linked to a symbol table")
+	}
+	nodes, e := ReadVersionNodes(f)
+	if e != nil {
+		return nil, e
+	}
+	names, e := readSymbolNames(f, uint16(dynsymIndex))
+	if e != nil {
+		return nil, e
+	}
+	if len(names) > len(versions) {
+		return nil, fmt.Errorf(".gnu.version has %d entries, but the symbol "+
+			"table has %d symbols", len(versions), len(names))
+	}
+	dynsym := &(f.Sections[dynsymIndex])
+	stringTableName, e := SectionName(f, uint16(dynsym.LinkedIndex))
+	if e != nil {
+		return nil, fmt.Errorf("Bad dynamic string table name: %s", e)
+	}
+	versym := &(f.Sections[versymIndex])
+	symbolSize := uint32(binary.Size(&elf_reader.ELF32Symbol{}))
+	plan := &versionedRenamePlan{
+		symbolOffsets: make(map[uint32]bool),
+		newNames:      make(map[uint32]string),
+	}
+	for _, r := range renames {
+		sourceIndices := make(map[uint16]bool)
+		var target *VersionNode
+		for i := range nodes {
+			if nodes[i].Name == r.Version {
+				sourceIndices[nodes[i].Index] = true
+			}
+			if (nodes[i].Name == r.NewVersion) && (target == nil) {
+				target = &(nodes[i])
+			}
+		}
+		if len(sourceIndices) == 0 {
+			return nil, fmt.Errorf("Version %s isn't used in the file",
+				r.Version)
+		}
+		selected := make(map[int]bool)
+		for i := 1; i < len(names); i++ {
+			if (string(names[i]) == r.Symbol) &&
+				sourceIndices[versions[i]&0x7fff] {
+				selected[i] = true
+			}
+		}
+		if len(selected) == 0 {
+			return nil, fmt.Errorf("No dynamic symbol %s@%s was found",
+				r.Symbol, r.Version)
+		}
+		report.logf("Renaming %d dynamic symbols %s@%s to %s@%s.\n",
+			len(selected), r.Symbol, r.Version, r.NewSymbol, r.NewVersion)
+		if r.NewSymbol != r.Symbol {
+			plan.rules = append(plan.rules, exactStringRule(r.Symbol,
+				r.NewSymbol, stringTableName))
+			for i := range selected {
+				offset := dynsym.FileOffset + uint32(i)*symbolSize
+				plan.symbolOffsets[offset] = true
+				plan.newNames[offset] = r.NewSymbol
+			}
+		}
+		if r.NewVersion == r.Version {
+			continue
+		}
+		if target != nil {
+			// Point the symbols at the existing version, keeping the hidden
+			// bit.
+			for i := range selected {
+				value := (versions[i] & 0x8000) | target.Index
+				plan.updates = append(plan.updates, versionFieldUpdate{
+					fileOffset:   versym.FileOffset + uint32(i*2),
+					sectionIndex: uint16(versymIndex),
+					is16Bit:      true,
+					original:     uint32(versions[i]),
+					value:        uint32(value),
+					location:     fmt.Sprintf("symbol %d versym", i),
+				})
+			}
+			continue
+		}
+		// The new version doesn't exist, so the old version must be renamed,
+		// which is only possible if nothing else uses it.
+		for i := 1; i < len(names); i++ {
+			if sourceIndices[versions[i]&0x7fff] && !selected[i] {
+				return nil, fmt.Errorf("Version %s isn't defined or "+
+					"required by the file, and %s is also used by %s, so "+
+					"it can't be renamed", r.NewVersion, r.Version,
+					EscapeString(string(names[i])))
+			}
+		}
+		for i := range nodes {
+			if nodes[i].Name != r.Version {
+				continue
+			}
+			if !nodes[i].Required {
+				return nil, fmt.Errorf("Version %s is defined by the file, "+
+					"and renaming version definitions isn't supported",
+					r.Version)
+			}
+			plan.updates = append(plan.updates, versionFieldUpdate{
+				fileOffset:   nodes[i].HashOffset,
+				sectionIndex: nodes[i].SectionIndex,
+				original:     nodes[i].Hash,
+				value:        sysvHash([]byte(r.NewVersion)),
+				location:     fmt.Sprintf("vernaux %s vna_hash", r.Version),
+			})
+		}
+		plan.rules = append(plan.rules, exactStringRule(r.Version,
+			r.NewVersion, stringTableName))
+	}
+	return plan, nil
+}
+
+// Returns a copy of the options, with the plan's rules, and a symbol filter
+// limited to the symbols being renamed.
+func (p *versionedRenamePlan) adjustOptions(options *Options) *Options {
+	toReturn := *options
+	toReturn.Rules = p.rules
+	var filter SymbolFilter
+	if options.SymbolFilter != nil {
+		filter = *(options.SymbolFilter)
+	}
+	filter.symbolOffsets = p.symbolOffsets
+	toReturn.SymbolFilter = &filter
+	return &toReturn
+}
+
+// Writes the version field updates, after the strings have been replaced,
+// and checks that every selected symbol was renamed.
+func (p *versionedRenamePlan) apply(f *elf_reader.ELF32File,
+	report *Report) error {
+	var e error
+	for _, u := range p.updates {
+		if u.is16Bit {
+			e = writeELFUint16(f, u.fileOffset, uint16(u.value),
+				"version field")
+		} else {
+			e = writeELFUint32(f, u.fileOffset, u.value, "version field")
+		}
+		if e != nil {
+			return fmt.Errorf("Failed updating %s: %s", u.location, e)
+		}
+		report.addReference(ReferenceUpdate{
+			FileOffset:    u.fileOffset,
+			SectionIndex:  u.sectionIndex,
+			OriginalValue: u.original,
+			NewValue:      u.value,
+			Location:      u.location,
+		})
+		report.logf("Updated %s at offset 0x%08x: 0x%x -> 0x%x\n", u.location,
+			u.fileOffset, u.original, u.value)
+	}
+	_, _, dynsymIndex, e := ReadSymbolVersions(f)
+	if e != nil {
+		return e
+	}
+	dynsym := &(f.Sections[dynsymIndex])
+	for offset, newName := range p.newNames {
+		nameOffset, e := readELFUint32(f, offset, "symbol")
+		if e != nil {
+			return e
+		}
+		name, e := readLinkedString(f, dynsym, nameOffset)
+		if (e != nil) || (name != newName) {
+			return fmt.Errorf("The symbol at offset 0x%08x couldn't be "+
+				"renamed to %s, possibly because its name is shared with "+
+				"other symbols", offset, newName)
+		}
+	}
+	return nil
+}
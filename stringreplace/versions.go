@@ -0,0 +1,251 @@
+package stringreplace
+
+// This file contains code for reading the GNU symbol versioning sections:
+// .gnu.version (one version index per dynamic symbol), .gnu.version_r
+// (versions required from other files), and .gnu.version_d (versions defined
+// by this file).
+
+import (
+	"fmt"
+	"github.com/yalue/elf_reader"
+)
+
+// The section types of the GNU symbol versioning sections.
+const (
+	VersionDefinitionSection  = 0x6ffffffd
+	VersionRequirementSection = 0x6ffffffe
+	VersionSymbolSection      = 0x6fffffff
+)
+
+// Describes a single version, either required from another file (an
+// Elf32_Vernaux entry) or defined by this file (an Elf32_Verdef entry and
+// its first Elf32_Verdaux).
+type VersionNode struct {
+	// The index used to refer to the version in .gnu.version.
+	Index uint16
+	Name  string
+	// The hash of the name stored in the structure.
+	Hash uint32
+	// True for a required version, false for a defined one.
+	Required bool
+	// For required versions, the name of the file they're required from.
+	File string
+	// The index of the section containing the structure, the structure's
+	// file offset, and the file offsets of its name and hash fields.
+	SectionIndex uint16
+	FileOffset   uint32
+	NameOffset   uint32
+	HashOffset   uint32
+}
+
+// Returns the index of the first section with the given type, or -1 if there
+// isn't one.
+func findSectionByType(f *elf_reader.ELF32File, sectionType uint32) int {
+	for i := range f.Sections {
+		if uint32(f.Sections[i].Type) == sectionType {
+			return i
+		}
+	}
+	return -1
+}
+
+// Reads a 16-bit value at the given file offset, checking that it's within
+// the given section.
+func readSectionUint16(f *elf_reader.ELF32File,
+	section *elf_reader.ELF32SectionHeader, offset uint32) (uint16, error) {
+	if (offset < section.FileOffset) || ((uint64(offset) + 2) >
+		(uint64(section.FileOffset) + uint64(section.Size))) ||
+		((uint64(offset) + 2) > uint64(len(f.Raw))) {
+		return 0, fmt.Errorf("Offset 0x%08x is outside of the section",
+			offset)
+	}
+	return f.Endianness.Uint16(f.Raw[offset:]), nil
+}
+
+// Like readSectionUint16, but reads a 32-bit value.
+func readSectionUint32(f *elf_reader.ELF32File,
+	section *elf_reader.ELF32SectionHeader, offset uint32) (uint32, error) {
+	if (offset < section.FileOffset) || ((uint64(offset) + 4) >
+		(uint64(section.FileOffset) + uint64(section.Size))) ||
+		((uint64(offset) + 4) > uint64(len(f.Raw))) {
+		return 0, fmt.Errorf("Offset 0x%08x is outside of the section",
+			offset)
+	}
+	return f.Endianness.Uint32(f.Raw[offset:]), nil
+}
+
+// Returns the string at the given offset in the section's linked string
+// table.
+func readLinkedString(f *elf_reader.ELF32File,
+	section *elf_reader.ELF32SectionHeader, offset uint32) (string, error) {
+	content, e := f.GetSectionContent(uint16(section.LinkedIndex))
+	if e != nil {
+		return "", e
+	}
+	s, e := elf_reader.ReadStringAtOffset(offset, content)
+	if e != nil {
+		return "", e
+	}
+	return string(s), nil
+}
+
+// Reads every Elf32_Vernaux entry in the version requirement section.
+func readRequiredVersions(f *elf_reader.ELF32File,
+	sectionIndex int) ([]VersionNode, error) {
+	section := &(f.Sections[sectionIndex])
+	var toReturn []VersionNode
+	needOffset := section.FileOffset
+	// sh_info holds the number of Elf32_Verneed entries.
+	for i := uint32(0); i < section.Info; i++ {
+		count, e := readSectionUint16(f, section, needOffset+2)
+		if e != nil {
+			return nil, fmt.Errorf("Bad verneed %d: %s", i, e)
+		}
+		fileName, e := readSectionUint32(f, section, needOffset+4)
+		if e != nil {
+			return nil, fmt.Errorf("Bad verneed %d: %s", i, e)
+		}
+		file, e := readLinkedString(f, section, fileName)
+		if e != nil {
+			return nil, fmt.Errorf("Bad file name in verneed %d: %s", i, e)
+		}
+		auxDelta, e := readSectionUint32(f, section, needOffset+8)
+		if e != nil {
+			return nil, fmt.Errorf("Bad verneed %d: %s", i, e)
+		}
+		auxOffset := needOffset + auxDelta
+		for j := uint16(0); j < count; j++ {
+			node := VersionNode{
+				Required:     true,
+				File:         file,
+				SectionIndex: uint16(sectionIndex),
+				FileOffset:   auxOffset,
+				HashOffset:   auxOffset,
+				NameOffset:   auxOffset + 8,
+			}
+			node.Hash, e = readSectionUint32(f, section, auxOffset)
+			if e == nil {
+				node.Index, e = readSectionUint16(f, section, auxOffset+6)
+			}
+			var name, next uint32
+			if e == nil {
+				name, e = readSectionUint32(f, section, auxOffset+8)
+			}
+			if e == nil {
+				node.Name, e = readLinkedString(f, section, name)
+			}
+			if e == nil {
+				next, e = readSectionUint32(f, section, auxOffset+12)
+			}
+			if e != nil {
+				return nil, fmt.Errorf("Bad vernaux %d of verneed %d: %s", j,
+					i, e)
+			}
+			toReturn = append(toReturn, node)
+			if next == 0 {
+				break
+			}
+			auxOffset += next
+		}
+		next, e := readSectionUint32(f, section, needOffset+12)
+		if e != nil {
+			return nil, fmt.Errorf("Bad verneed %d: %s", i, e)
+		}
+		if next == 0 {
+			break
+		}
+		needOffset += next
+	}
+	return toReturn, nil
+}
+
+// Reads every Elf32_Verdef entry in the version definition section. Only the
+// first Elf32_Verdaux of each definition, which holds its name, is read.
+func readDefinedVersions(f *elf_reader.ELF32File,
+	sectionIndex int) ([]VersionNode, error) {
+	section := &(f.Sections[sectionIndex])
+	var toReturn []VersionNode
+	defOffset := section.FileOffset
+	// sh_info holds the number of Elf32_Verdef entries.
+	for i := uint32(0); i < section.Info; i++ {
+		node := VersionNode{
+			SectionIndex: uint16(sectionIndex),
+			FileOffset:   defOffset,
+			HashOffset:   defOffset + 8,
+		}
+		var e error
+		var auxDelta, name, next uint32
+		node.Index, e = readSectionUint16(f, section, defOffset+4)
+		if e == nil {
+			node.Hash, e = readSectionUint32(f, section, defOffset+8)
+		}
+		if e == nil {
+			auxDelta, e = readSectionUint32(f, section, defOffset+12)
+		}
+		if e == nil {
+			node.NameOffset = defOffset + auxDelta
+			name, e = readSectionUint32(f, section, node.NameOffset)
+		}
+		if e == nil {
+			node.Name, e = readLinkedString(f, section, name)
+		}
+		if e == nil {
+			next, e = readSectionUint32(f, section, defOffset+16)
+		}
+		if e != nil {
+			return nil, fmt.Errorf("Bad verdef %d: %s", i, e)
+		}
+		toReturn = append(toReturn, node)
+		if next == 0 {
+			break
+		}
+		defOffset += next
+	}
+	return toReturn, nil
+}
+
+// Returns every version required or defined by the file. Returns an empty
+// list if the file doesn't use symbol versioning.
+func ReadVersionNodes(f *elf_reader.ELF32File) ([]VersionNode, error) {
+	var toReturn []VersionNode
+	index := findSectionByType(f, VersionRequirementSection)
+	if index >= 0 {
+		required, e := readRequiredVersions(f, index)
+		if e != nil {
+			return nil, e
+		}
+		toReturn = append(toReturn, required...)
+	}
+	index = findSectionByType(f, VersionDefinitionSection)
+	if index >= 0 {
+		defined, e := readDefinedVersions(f, index)
+		if e != nil {
+			return nil, e
+		}
+		toReturn = append(toReturn, defined...)
+	}
+	return toReturn, nil
+}
+
+// Returns the .gnu.version entry for each symbol in the section it's linked
+// to (normally .dynsym), along with the indices of both sections. Returns a
+// nil slice and -1 indices if the file has no .gnu.version section.
+func ReadSymbolVersions(f *elf_reader.ELF32File) ([]uint16, int, int,
+	error) {
+	index := findSectionByType(f, VersionSymbolSection)
+	if index < 0 {
+		return nil, -1, -1, nil
+	}
+	section := &(f.Sections[index])
+	toReturn := make([]uint16, section.Size/2)
+	var e error
+	for i := range toReturn {
+		toReturn[i], e = readSectionUint16(f, section,
+			section.FileOffset+uint32(i*2))
+		if e != nil {
+			return nil, -1, -1, fmt.Errorf("Bad .gnu.version entry %d: %s",
+				i, e)
+		}
+	}
+	return toReturn, index, int(section.LinkedIndex), nil
+}
@@ -0,0 +1,180 @@
+package stringreplace
+
+// This file defines the OutputWriter interface, which abstracts how a patched
+// file is emitted, and implementations writing to an io.Writer, tar entries,
+// and cpio members, or passing the output to a callback. This lets packaging
+// tools patch artifacts directly inside the archives they're constructing,
+// without writing them to disk first. Creating files is left to callers.
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Emits a patched file. The name is a path relative to wherever the writer
+// places its outputs, e.g. the name of a tar entry.
+type OutputWriter interface {
+	WriteOutput(name string, content []byte, mode os.FileMode) error
+}
+
+// An OutputWriter that calls the function for each output.
+type OutputFunc func(name string, content []byte, mode os.FileMode) error
+
+func (f OutputFunc) WriteOutput(name string, content []byte,
+	mode os.FileMode) error {
+	return f(name, content, mode)
+}
+
+// An OutputWriter that writes the content of each output to an io.Writer,
+// such as a file opened by the caller, ignoring its name and mode. Long runs
+// of zero bytes are skipped if the writer is seekable, as by WriteSparse.
+type StreamOutputWriter struct {
+	Writer io.Writer
+}
+
+func (w *StreamOutputWriter) WriteOutput(name string, content []byte,
+	mode os.FileMode) error {
+	n, e := WriteSparse(w.Writer, content)
+	if (e == nil) && (n != int64(len(content))) {
+		e = io.ErrShortWrite
+	}
+	if e != nil {
+		return fmt.Errorf("Failed writing %s: %s", name, e)
+	}
+	return nil
+}
+
+// An OutputWriter that adds each output to a tar archive as a regular file.
+// The caller is responsible for closing the tar.Writer.
+type TarOutputWriter struct {
+	Writer *tar.Writer
+	// The modification time given to each entry. The current time is used
+	// if this is zero.
+	ModTime time.Time
+}
+
+func (w *TarOutputWriter) WriteOutput(name string, content []byte,
+	mode os.FileMode) error {
+	modTime := w.ModTime
+	if modTime.IsZero() {
+		modTime = time.Now()
+	}
+	e := w.Writer.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     filepath.ToSlash(name),
+		Mode:     int64(mode.Perm()),
+		Size:     int64(len(content)),
+		ModTime:  modTime,
+	})
+	if e != nil {
+		return fmt.Errorf("Failed writing tar header for %s: %s", name, e)
+	}
+	_, e = w.Writer.Write(content)
+	if e != nil {
+		return fmt.Errorf("Failed writing tar entry %s: %s", name, e)
+	}
+	return nil
+}
+
+// An OutputWriter that adds each output to a newc-format cpio archive, such
+// as a Linux initramfs image, as a regular file. Close must be called after
+// the last output, to write the archive's trailer.
+type CPIOOutputWriter struct {
+	w io.Writer
+	// The number of bytes written so far, since entries are padded relative
+	// to the start of the archive.
+	written int64
+	// The inode number to give the next entry. Each entry gets a distinct
+	// one, so they aren't treated as hard links when extracted.
+	nextInode uint32
+	// The modification time given to each entry. The current time is used
+	// if this is zero.
+	ModTime time.Time
+}
+
+// Returns a new CPIOOutputWriter writing the archive to w.
+func NewCPIOOutputWriter(w io.Writer) *CPIOOutputWriter {
+	return &CPIOOutputWriter{
+		w:         w,
+		nextInode: 1,
+	}
+}
+
+// Writes bytes to the archive, followed by NUL bytes padding the archive to a
+// multiple of 4 bytes.
+func (w *CPIOOutputWriter) writePadded(data []byte) error {
+	n, e := w.w.Write(data)
+	w.written += int64(n)
+	if e != nil {
+		return e
+	}
+	padding := (4 - (w.written % 4)) % 4
+	n, e = w.w.Write(make([]byte, padding))
+	w.written += int64(n)
+	return e
+}
+
+// Writes a single newc entry with the given name, mode, and content.
+func (w *CPIOOutputWriter) writeEntry(name string, mode uint32,
+	content []byte) error {
+	modTime := w.ModTime
+	if modTime.IsZero() {
+		modTime = time.Now()
+	}
+	inode := uint32(0)
+	if mode != 0 {
+		inode = w.nextInode
+		w.nextInode++
+	}
+	nlink := uint32(1)
+	// The fields are the inode, mode, uid, gid, nlink, mtime, file size,
+	// device major and minor, rdev major and minor, name size, and checksum.
+	header := fmt.Sprintf("070701%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X"+
+		"%08X%08X%08X", inode, mode, 0, 0, nlink, uint32(modTime.Unix()),
+		len(content), 0, 0, 0, 0, len(name)+1, 0)
+	e := w.writePadded(append([]byte(header+name), 0))
+	if e != nil {
+		return e
+	}
+	return w.writePadded(content)
+}
+
+func (w *CPIOOutputWriter) WriteOutput(name string, content []byte,
+	mode os.FileMode) error {
+	// S_IFREG is 0100000.
+	e := w.writeEntry(filepath.ToSlash(name), 0100000|uint32(mode.Perm()),
+		content)
+	if e != nil {
+		return fmt.Errorf("Failed writing cpio entry %s: %s", name, e)
+	}
+	return nil
+}
+
+// Writes the archive's trailer. Doesn't close the underlying writer.
+func (w *CPIOOutputWriter) Close() error {
+	e := w.writeEntry("TRAILER!!!", 0, nil)
+	if e != nil {
+		return fmt.Errorf("Failed writing cpio trailer: %s", e)
+	}
+	return nil
+}
+
+// Like Replace, but passes the modified ELF file to the output writer, under
+// the given name, rather than returning it. Nothing is written if an error
+// occurs while patching.
+func ReplaceToOutput(output OutputWriter, name string, input []byte,
+	mode os.FileMode, options Options) (*Report, error) {
+	result, report, e := Replace(input, options)
+	if e != nil {
+		return nil, e
+	}
+	e = output.WriteOutput(name, result, mode)
+	if e != nil {
+		return nil, e
+	}
+	return report, nil
+}
@@ -0,0 +1,30 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// Flushes the directory at the given path to storage, so that a file renamed
+// into it remains there after a crash.
+func syncDirectory(path string) error {
+	d, e := os.Open(path)
+	if e != nil {
+		return fmt.Errorf("Failed opening directory %s to flush it: %s",
+			path, e)
+	}
+	e = d.Sync()
+	closeError := d.Close()
+	if e != nil {
+		return fmt.Errorf("Failed flushing directory %s to storage: %s",
+			path, e)
+	}
+	if closeError != nil {
+		return fmt.Errorf("Failed closing directory %s: %s", path,
+			closeError)
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build windows
+// +build windows
+
+package main
+
+// Directories can't be flushed using os.File.Sync on Windows, so this does
+// nothing there.
+func syncDirectory(path string) error {
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+// This file contains support for reading and re-writing UF2 files, the block
+// format used to flash many microcontroller boards (e.g. the RP2040) over USB
+// mass storage.
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+)
+
+// The size of every UF2 block.
+const uf2BlockSize = 512
+
+// The maximum number of payload bytes in a UF2 block.
+const uf2MaxPayloadSize = 476
+
+// Magic numbers at the start and end of every UF2 block.
+const (
+	uf2MagicStart0 = 0x0a324655
+	uf2MagicStart1 = 0x9e5d5157
+	uf2MagicEnd    = 0x0ab16f30
+)
+
+// UF2 block flags.
+const (
+	// The block isn't part of the main flash image.
+	uf2FlagNotMainFlash = 0x00000001
+	// The block is part of a file container rather than a memory image.
+	uf2FlagFileContainer = 0x00001000
+	// The block's data area ends with an MD5 checksum of a range of memory.
+	uf2FlagMD5Checksum = 0x00004000
+)
+
+// The header at the start of every UF2 block.
+type uf2BlockHeader struct {
+	MagicStart0   uint32
+	MagicStart1   uint32
+	Flags         uint32
+	TargetAddress uint32
+	PayloadSize   uint32
+	BlockNumber   uint32
+	BlockCount    uint32
+	// Either the total file size, or the board family ID, depending on the
+	// flags.
+	FileSizeOrFamilyID uint32
+}
+
+// Holds the content of a UF2 file.
+type uf2File struct {
+	content []byte
+	headers []uf2BlockHeader
+	memoryImage
+}
+
+// Returns true if the block's payload belongs in the memory image.
+func uf2BlockIsImageData(header *uf2BlockHeader) bool {
+	return (header.Flags & (uf2FlagNotMainFlash | uf2FlagFileContainer)) == 0
+}
+
+// Parses the content of a UF2 file, and reconstructs the memory image it
+// contains.
+func parseUF2File(content []byte) (*uf2File, error) {
+	if (len(content) == 0) || ((len(content) % uf2BlockSize) != 0) {
+		return nil, fmt.Errorf("The file size isn't a multiple of %d bytes",
+			uf2BlockSize)
+	}
+	blockCount := len(content) / uf2BlockSize
+	toReturn := &uf2File{
+		content: make([]byte, len(content)),
+		headers: make([]uf2BlockHeader, blockCount),
+	}
+	copy(toReturn.content, content)
+	chunks := make([]imageChunk, 0, blockCount)
+	var block []byte
+	var header *uf2BlockHeader
+	for i := range toReturn.headers {
+		block = toReturn.content[i*uf2BlockSize : (i+1)*uf2BlockSize]
+		header = &(toReturn.headers[i])
+		header.MagicStart0 = binary.LittleEndian.Uint32(block[0:])
+		header.MagicStart1 = binary.LittleEndian.Uint32(block[4:])
+		header.Flags = binary.LittleEndian.Uint32(block[8:])
+		header.TargetAddress = binary.LittleEndian.Uint32(block[12:])
+		header.PayloadSize = binary.LittleEndian.Uint32(block[16:])
+		header.BlockNumber = binary.LittleEndian.Uint32(block[20:])
+		header.BlockCount = binary.LittleEndian.Uint32(block[24:])
+		header.FileSizeOrFamilyID = binary.LittleEndian.Uint32(block[28:])
+		if (header.MagicStart0 != uf2MagicStart0) ||
+			(header.MagicStart1 != uf2MagicStart1) ||
+			(binary.LittleEndian.Uint32(block[508:]) != uf2MagicEnd) {
+			return nil, fmt.Errorf("Block %d has an invalid signature", i)
+		}
+		if header.PayloadSize > uf2MaxPayloadSize {
+			return nil, fmt.Errorf("Block %d has an invalid payload size: %d",
+				i, header.PayloadSize)
+		}
+		if !uf2BlockIsImageData(header) {
+			continue
+		}
+		chunks = append(chunks, imageChunk{
+			address: header.TargetAddress,
+			data:    block[32 : 32+header.PayloadSize],
+		})
+	}
+	e := toReturn.build(chunks)
+	if e != nil {
+		return nil, e
+	}
+	return toReturn, nil
+}
+
+// Returns the name of the file's format.
+func (u *uf2File) formatName() string {
+	return "uf2"
+}
+
+// Returns the content of the UF2 file, with the payloads updated to match the
+// (possibly modified) image. Block numbers are regenerated, and MD5
+// checksums are recomputed for blocks that contain them.
+func (u *uf2File) encode() ([]byte, error) {
+	e := u.checkUncoveredChanges()
+	if e != nil {
+		return nil, e
+	}
+	toReturn := make([]byte, len(u.content))
+	copy(toReturn, u.content)
+	var block []byte
+	var header *uf2BlockHeader
+	for i := range u.headers {
+		block = toReturn[i*uf2BlockSize : (i+1)*uf2BlockSize]
+		header = &(u.headers[i])
+		binary.LittleEndian.PutUint32(block[20:], uint32(i))
+		binary.LittleEndian.PutUint32(block[24:], uint32(len(u.headers)))
+		if !uf2BlockIsImageData(header) {
+			continue
+		}
+		copy(block[32:], u.imageData(header.TargetAddress,
+			int(header.PayloadSize)))
+		if (header.Flags & uf2FlagMD5Checksum) == 0 {
+			continue
+		}
+		// The last 24 bytes of the data area hold the address and length of
+		// the checksummed range, followed by its MD5 hash.
+		checksumInfo := block[32+uf2MaxPayloadSize-24 : 32+uf2MaxPayloadSize]
+		address := binary.LittleEndian.Uint32(checksumInfo[0:])
+		length := binary.LittleEndian.Uint32(checksumInfo[4:])
+		start := uint64(address) - uint64(u.baseAddress)
+		if (address < u.baseAddress) ||
+			((start + uint64(length)) > uint64(len(u.image))) {
+			return nil, fmt.Errorf("Block %d has a checksum for memory "+
+				"outside of the image", i)
+		}
+		hash := md5.Sum(u.imageData(address, int(length)))
+		copy(checksumInfo[8:], hash[:])
+	}
+	return toReturn, nil
+}
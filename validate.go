@@ -0,0 +1,82 @@
+package main
+
+// This file implements the -validate_with flag, which runs an external tool
+// from binutils on each patched ELF file before it's moved into place, as a
+// check independent of the ELF parser this tool uses.
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// The arguments passed to each supported validation tool, before the path to
+// the file. Between them, they make the tool parse the ELF header, program
+// and section headers, dynamic section, and symbol version information.
+var validationToolArguments = map[string][]string{
+	"readelf": {"--file-header", "--program-headers", "--section-headers",
+		"--dynamic", "--version-info", "--wide"},
+	"objdump": {"--file-headers", "--private-headers", "--section-headers",
+		"--dynamic-syms"},
+}
+
+// Returns the kind of validation tool ("readelf" or "objdump") named by the
+// -validate_with setting, which may also be the name of or path to a
+// cross-toolchain's tool, e.g. arm-linux-gnueabi-readelf. Returns an error if
+// it isn't a supported tool.
+func validationToolKind(tool string) (string, error) {
+	base := filepath.Base(tool)
+	for kind := range validationToolArguments {
+		if (base == kind) || strings.HasSuffix(base, "-"+kind) {
+			return kind, nil
+		}
+	}
+	return "", fmt.Errorf("Unsupported validation tool %s: must be readelf "+
+		"or objdump, optionally with a cross-toolchain prefix", tool)
+}
+
+// Runs the given validation tool on the file at path, returning an error if
+// it exits with an error or reports one. Other messages the tool prints, such
+// as warnings, are logged. If the tool isn't installed, a message is logged
+// and no error is returned.
+func validateWithTool(tool, path string) error {
+	kind, e := validationToolKind(tool)
+	if e != nil {
+		return e
+	}
+	toolPath, e := exec.LookPath(tool)
+	if e != nil {
+		log.Printf("Skipping validation with %s, which wasn't found: %s\n",
+			tool, e)
+		return nil
+	}
+	arguments := append(append([]string(nil),
+		validationToolArguments[kind]...), path)
+	var stderr bytes.Buffer
+	c := exec.Command(toolPath, arguments...)
+	c.Stderr = &stderr
+	e = c.Run()
+	var firstError string
+	for _, line := range strings.Split(stderr.String(), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if (firstError == "") && strings.Contains(strings.ToLower(line),
+			"error") {
+			firstError = line
+			continue
+		}
+		log.Printf("%s\n", line)
+	}
+	if firstError != "" {
+		return fmt.Errorf("%s reported an error: %s", tool, firstError)
+	}
+	if e != nil {
+		return fmt.Errorf("%s failed: %s", tool, e)
+	}
+	return nil
+}
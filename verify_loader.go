@@ -0,0 +1,63 @@
+package main
+
+// This file implements the "verify-loader" subcommand, which checks that a
+// file satisfies the invariants of the glibc, musl, and uClibc-ng dynamic
+// loaders.
+
+import (
+	"flag"
+	"github.com/yalue/elf32_string_replace/stringreplace"
+	"io/ioutil"
+	"log"
+)
+
+func runVerifyLoaderCommand(arguments []string) int {
+	var inputFile, loaderName string
+	flags := flag.NewFlagSet("verify-loader", flag.ContinueOnError)
+	flags.StringVar(&inputFile, "file", "", "The path to the ELF file to "+
+		"check.")
+	flags.StringVar(&loaderName, "loader", "all", "The dynamic loader whose "+
+		"invariants to check: glibc, musl, uclibc, or all.")
+	e := flags.Parse(arguments)
+	if e != nil {
+		return 1
+	}
+	if inputFile == "" {
+		log.Println("Invalid arguments. Run with -help for more information.")
+		return 1
+	}
+	loaders := stringreplace.AllLoaders
+	if loaderName != "all" {
+		loader, e := stringreplace.ParseLoader(loaderName)
+		if e != nil {
+			log.Printf("%s\n", e)
+			return 1
+		}
+		loaders = []stringreplace.Loader{loader}
+	}
+	rawInput, e := ioutil.ReadFile(inputFile)
+	if e != nil {
+		log.Printf("Failed reading input file: %s\n", e)
+		return 1
+	}
+	elf, e := stringreplace.ParseELF32File(rawInput)
+	if e != nil {
+		log.Printf("Failed parsing the input file: %s\n", e)
+		return 1
+	}
+	count := 0
+	for _, loader := range loaders {
+		problems := stringreplace.VerifyLoader(elf, loader)
+		for _, p := range problems {
+			log.Printf("%s\n", p)
+		}
+		count += len(problems)
+	}
+	if count != 0 {
+		log.Printf("Found %d loader compatibility problems in %s.\n", count,
+			inputFile)
+		return 1
+	}
+	log.Printf("%s satisfies the checked loaders' invariants.\n", inputFile)
+	return 0
+}
@@ -0,0 +1,48 @@
+package main
+
+// This file implements the "verify-versions" subcommand, which checks that a
+// file's symbol versioning sections are consistent with each other.
+
+import (
+	"flag"
+	"github.com/yalue/elf32_string_replace/stringreplace"
+	"io/ioutil"
+	"log"
+)
+
+func runVerifyVersionsCommand(arguments []string) int {
+	var inputFile string
+	flags := flag.NewFlagSet("verify-versions", flag.ContinueOnError)
+	flags.StringVar(&inputFile, "file", "", "The path to the ELF file to "+
+		"check.")
+	e := flags.Parse(arguments)
+	if e != nil {
+		return 1
+	}
+	if inputFile == "" {
+		log.Println("Invalid arguments. Run with -help for more information.")
+		return 1
+	}
+	rawInput, e := ioutil.ReadFile(inputFile)
+	if e != nil {
+		log.Printf("Failed reading input file: %s\n", e)
+		return 1
+	}
+	elf, e := stringreplace.ParseELF32File(rawInput)
+	if e != nil {
+		log.Printf("Failed parsing the input file: %s\n", e)
+		return 1
+	}
+	problems := stringreplace.VerifyVersions(elf)
+	for _, p := range problems {
+		log.Printf("%s\n", p)
+	}
+	if len(problems) != 0 {
+		log.Printf("Found %d symbol versioning problems in %s.\n",
+			len(problems), inputFile)
+		return 1
+	}
+	log.Printf("The symbol versioning sections in %s are consistent.\n",
+		inputFile)
+	return 0
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"github.com/yalue/elf32_string_replace/stringreplace"
+	"regexp"
+	"testing"
+)
+
+// Replaces strings in defined_versions.so using the given rules, and checks
+// that the names and hashes of its version definitions were updated to match.
+func checkDefinitionRename(t *testing.T, options stringreplace.Options,
+	base, version string) {
+	output, _, e := stringreplace.Replace(corpusInput(t,
+		"defined_versions.so"), options)
+	if e != nil {
+		t.Fatalf("Failed replacing strings: %s", e)
+	}
+	f := parseTestELF(t, output)
+	// DT_SONAME is 14.
+	if s := dynamicString(t, f, 14); s != base {
+		t.Errorf("Expected the SONAME to be %q, got %q", base, s)
+	}
+	for _, problem := range stringreplace.VerifyVersions(f) {
+		t.Errorf("Inconsistent symbol versions: %s", problem)
+	}
+	nodes, e := stringreplace.ReadVersionNodes(f)
+	if e != nil {
+		t.Fatalf("Failed reading versions: %s", e)
+	}
+	expected := map[uint16]string{1: base, 3: version}
+	for _, n := range nodes {
+		if n.Required {
+			continue
+		}
+		if n.Name != expected[n.Index] {
+			t.Errorf("Expected version definition %d to be named %q, got "+
+				"%q", n.Index, expected[n.Index], n.Name)
+		}
+		delete(expected, n.Index)
+	}
+	if len(expected) != 0 {
+		t.Errorf("Missing version definitions: %v", expected)
+	}
+}
+
+func TestReplaceVersionDefinitions(t *testing.T) {
+	rules := []stringreplace.Rule{
+		{
+			Match:       regexp.MustCompile(`^libcorpus\.so\.1$`),
+			Replacement: "libcorpus_renamed.so.1",
+		},
+		{
+			Match:       regexp.MustCompile(`^LIBCORPUS_1\.0$`),
+			Replacement: "LIBRENAMED_1.0",
+		},
+	}
+	checkDefinitionRename(t, stringreplace.Options{Rules: rules},
+		"libcorpus_renamed.so.1", "LIBRENAMED_1.0")
+	rules[0].Replacement = "libcorpus.so.2"
+	rules[1].Replacement = "LIBCORPUS_2.0"
+	checkDefinitionRename(t, stringreplace.Options{
+		Rules:    rules,
+		InPlace:  true,
+		SameSize: true,
+	}, "libcorpus.so.2", "LIBCORPUS_2.0")
+}
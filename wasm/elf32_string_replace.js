@@ -0,0 +1,31 @@
+// A small wrapper around the WebAssembly build of elf32_string_replace. Go's
+// wasm_exec.js (found in "$(go env GOROOT)/misc/wasm" or "lib/wasm") must be
+// loaded before this file.
+//
+// Example usage:
+//    const replacer = await loadELF32StringReplace("elf32_string_replace.wasm");
+//    const output = replacer.replace(inputBytes, "libc\\.so", "libc_copy.so");
+
+// Loads the WebAssembly module from the given URL. Returns a promise
+// resolving to an object with a replace(input, toMatch, replacement) function.
+// The input must be a Uint8Array containing a 32-bit ELF file, and the
+// returned value is a Uint8Array containing the modified file. Errors are
+// thrown as exceptions.
+async function loadELF32StringReplace(wasmURL) {
+  const go = new Go();
+  const result = await WebAssembly.instantiateStreaming(fetch(wasmURL),
+    go.importObject);
+  // Do not wait for this promise: it never resolves, since the Go program
+  // waits forever in order to keep elf32StringReplace callable.
+  go.run(result.instance);
+  return {
+    replace: function(input, toMatch, replacement) {
+      const result = globalThis.elf32StringReplace(input, toMatch,
+        replacement);
+      if (result.error) {
+        throw new Error(result.error);
+      }
+      return result.output;
+    },
+  };
+}
@@ -0,0 +1,62 @@
+//go:build js && wasm
+// +build js,wasm
+
+// This program exposes the string replacement library to JavaScript when
+// compiled to WebAssembly. It registers a global elf32StringReplace function,
+// and then waits forever so the function remains callable. See
+// elf32_string_replace.js for a wrapper that loads the module.
+//
+// Build using:
+//
+//	GOOS=js GOARCH=wasm go build -o elf32_string_replace.wasm
+package main
+
+import (
+	"fmt"
+	"github.com/yalue/elf32_string_replace/stringreplace"
+	"regexp"
+	"syscall/js"
+)
+
+// Returns a JS object with an "error" property holding the given message.
+func errorResult(format string, args ...interface{}) interface{} {
+	return map[string]interface{}{
+		"error": fmt.Sprintf(format, args...),
+	}
+}
+
+// Implements the JS elf32StringReplace(input, toMatch, replacement) function.
+// The input must be a Uint8Array holding the ELF file. Returns an object with
+// either an "output" Uint8Array or an "error" string.
+func replaceJS(this js.Value, arguments []js.Value) interface{} {
+	if len(arguments) != 3 {
+		return errorResult("Expected 3 arguments, got %d", len(arguments))
+	}
+	input := make([]byte, arguments[0].Get("length").Int())
+	js.CopyBytesToGo(input, arguments[0])
+	regex, e := regexp.Compile(arguments[1].String())
+	if e != nil {
+		return errorResult("Invalid regular expression: %s", e)
+	}
+	output, _, e := stringreplace.Replace(input, stringreplace.Options{
+		Rules: []stringreplace.Rule{
+			{
+				Match:       regex,
+				Replacement: arguments[2].String(),
+			},
+		},
+	})
+	if e != nil {
+		return errorResult("%s", e)
+	}
+	outputArray := js.Global().Get("Uint8Array").New(len(output))
+	js.CopyBytesToJS(outputArray, output)
+	return map[string]interface{}{
+		"output": outputArray,
+	}
+}
+
+func main() {
+	js.Global().Set("elf32StringReplace", js.FuncOf(replaceJS))
+	select {}
+}
@@ -0,0 +1,193 @@
+package main
+
+// This file implements the -watch flag, which monitors a directory and
+// patches 32-bit ELF files as they're written to it, for build pipelines that
+// drop artifacts into a staging directory.
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Tracks a file seen in the watched directory.
+type watchedFile struct {
+	size    int64
+	modTime time.Time
+	// Set once the file has been patched (or skipped), and cleared if it's
+	// modified again.
+	handled bool
+}
+
+// Holds the state of a directory being watched.
+type directoryWatcher struct {
+	root string
+	// If empty, files are patched in place. Otherwise, patched copies are
+	// written under this directory, mirroring the watched tree.
+	outputDir string
+	// If not nil, only files with base names matching this are patched.
+	filter   *regexp.Regexp
+	settings *fileSettings
+	files    map[string]*watchedFile
+}
+
+// Returns true if the file at path should be ignored: it doesn't match the
+// filter, is hidden (which includes our own temporary output files), or is
+// inside the output directory.
+func (w *directoryWatcher) ignore(path string) bool {
+	name := filepath.Base(path)
+	if strings.HasPrefix(name, ".") {
+		return true
+	}
+	if (w.filter != nil) && !w.filter.MatchString(name) {
+		return true
+	}
+	if w.outputDir != "" {
+		relativePath, e := filepath.Rel(w.outputDir, path)
+		if (e == nil) && !strings.HasPrefix(relativePath, "..") {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the size and modification time of every regular file under the
+// watched directory that isn't ignored.
+func (w *directoryWatcher) scan() (map[string]os.FileInfo, error) {
+	toReturn := make(map[string]os.FileInfo)
+	e := filepath.Walk(w.root, func(path string, info os.FileInfo,
+		e error) error {
+		if e != nil {
+			// Files may be removed while walking the directory.
+			if os.IsNotExist(e) {
+				return nil
+			}
+			return e
+		}
+		if info.Mode().IsRegular() && !w.ignore(path) {
+			toReturn[path] = info
+		}
+		return nil
+	})
+	return toReturn, e
+}
+
+// Patches the file at path, which has stopped changing, and marks it as
+// handled.
+func (w *directoryWatcher) patch(path string, file *watchedFile) {
+	file.handled = true
+	format, skipReason, e := identifyFile(path)
+	if e != nil {
+		log.Printf("Failed reading %s: %s\n", path, e)
+		return
+	}
+	if format == "" {
+		return
+	}
+	if skipReason != "" {
+		log.Printf("Skipping %s (%s): %s.\n", path, format, skipReason)
+		return
+	}
+	outputPath := path
+	if w.outputDir != "" {
+		relativePath, e := filepath.Rel(w.root, path)
+		if e != nil {
+			log.Printf("Failed finding output path for %s: %s\n", path, e)
+			return
+		}
+		job := batchJob{
+			inputPath:  path,
+			outputPath: filepath.Join(w.outputDir, relativePath),
+		}
+		e = createOutputDirectory(&job)
+		if e != nil {
+			log.Printf("Failed creating output directory: %s\n", e)
+			return
+		}
+		outputPath = job.outputPath
+	}
+	log.Printf("Patching %s.\n", path)
+	e = processFile(path, outputPath, w.settings)
+	if e != nil {
+		log.Printf("Failed processing %s: %s\n", path, e)
+		return
+	}
+	// Don't patch our own output again when patching in place.
+	info, e := os.Stat(path)
+	if e == nil {
+		file.size = info.Size()
+		file.modTime = info.ModTime()
+	}
+}
+
+// Checks the watched directory for new or modified files. A file is only
+// patched once its size and modification time are unchanged since the
+// previous poll, so files that are still being written are left alone.
+// Files present when watching started are recorded without being patched.
+func (w *directoryWatcher) poll(initial bool) error {
+	current, e := w.scan()
+	if e != nil {
+		return e
+	}
+	for path := range w.files {
+		if current[path] == nil {
+			delete(w.files, path)
+		}
+	}
+	for path, info := range current {
+		file := w.files[path]
+		if (file == nil) || (file.size != info.Size()) ||
+			!file.modTime.Equal(info.ModTime()) {
+			w.files[path] = &watchedFile{
+				size:    info.Size(),
+				modTime: info.ModTime(),
+				handled: initial,
+			}
+			continue
+		}
+		if !file.handled {
+			w.patch(path, file)
+		}
+	}
+	return nil
+}
+
+// Watches the directory at root until interrupted, patching each matching
+// 32-bit ELF file written to it. Returns the process exit code.
+func runWatch(root, outputDir string, filter *regexp.Regexp,
+	interval time.Duration, settings *fileSettings) int {
+	w := &directoryWatcher{
+		root:      root,
+		outputDir: outputDir,
+		filter:    filter,
+		settings:  settings,
+		files:     make(map[string]*watchedFile),
+	}
+	e := w.poll(true)
+	if e != nil {
+		log.Printf("Failed reading %s: %s\n", root, e)
+		return 1
+	}
+	log.Printf("Watching %s for new ELF files. Press Ctrl+C to stop.\n", root)
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-interrupted:
+			log.Printf("Stopped watching %s.\n", root)
+			return 0
+		case <-ticker.C:
+		}
+		e = w.poll(false)
+		if e != nil {
+			log.Printf("Failed reading %s: %s\n", root, e)
+			return 1
+		}
+	}
+}